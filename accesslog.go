@@ -0,0 +1,165 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry is a single line of the access log.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID"`
+	ClientIP  string    `json:"clientIP"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMS float64   `json:"latencyMs"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// accessLog writes one JSON line per request to w once the request finishes.
+func accessLog(w io.Writer) HandlerFunc {
+	return func(c *Context) {
+		start := time.Now()
+		c.Next()
+
+		entry := AccessLogEntry{
+			Time:      start.UTC(),
+			RequestID: c.GetString(requestIDKey),
+			ClientIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Query:     c.Request.URL.RawQuery,
+			Status:    c.Writer.Status(),
+			Bytes:     max(c.Writer.Size(), 0),
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:   c.Request.Referer(),
+			UserAgent: c.Request.UserAgent(),
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to encode access log entry: %v", err)
+			return
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			logf(c, slog.LevelError, "Failed to write access log: %v", err)
+		}
+	}
+}
+
+// RotatingFile is an append-only log file that is moved aside and reopened
+// once it grows past maxSize bytes or has been open for longer than interval.
+// A zero limit disables that kind of rotation.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	interval time.Duration
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating first if p would take it over the
+// size limit or the rotation interval has elapsed.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			logAt(slog.LevelError, "Failed to rotate %s: %v", f.path, err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) due(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.opened) >= f.interval
+}
+
+// rotate renames the current file with a timestamp suffix and opens a fresh
+// one in its place.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	f.file = nil
+
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(f.path, rotated); err != nil {
+		return fmt.Errorf("failed to rename log file: %w", err)
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
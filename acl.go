@@ -0,0 +1,155 @@
+package discordcdn
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ACLRule limits the paths an API key, or clients in an IP range, may use.
+type ACLRule struct {
+	// KeyID is the ID of the key the rule binds, as shown in usage reports.
+	KeyID string
+	// Network is the IP range the rule binds, when KeyID is empty.
+	Network *net.IPNet
+	// Paths are the paths allowed, exactly or, ending in /*, along with
+	// everything below them.
+	Paths []string
+}
+
+// parseACL parses comma-separated key:<key ID>=<paths> and ip:<range>=<paths>
+// entries, where paths are separated by |. IP ranges are CIDR blocks or
+// single addresses.
+func parseACL(raw string) ([]ACLRule, error) {
+	var rules []ACLRule
+	for _, entry := range splitList(raw) {
+		subject, paths, ok := strings.Cut(entry, "=")
+		kind, value, _ := strings.Cut(strings.TrimSpace(subject), ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("entry %q must look like key:<key ID>=<paths> or ip:<range>=<paths>", entry)
+		}
+		var rule ACLRule
+		switch kind {
+		case "key":
+			if !strings.HasPrefix(value, "key_") {
+				return nil, fmt.Errorf("entry %q must name a key by its ID, such as key_1a2b3c4d5e6f", entry)
+			}
+			rule.KeyID = value
+		case "ip":
+			network, err := parseIPRange(value)
+			if err != nil {
+				return nil, fmt.Errorf("entry %q has an invalid IP range", entry)
+			}
+			rule.Network = network
+		default:
+			return nil, fmt.Errorf("entry %q must start with key: or ip:", entry)
+		}
+		for _, path := range strings.Split(paths, "|") {
+			path = strings.TrimSpace(path)
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("entry %q has a path %q not starting with /", entry, path)
+			}
+			rule.Paths = append(rule.Paths, path)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseIPRange parses a CIDR block or a single address, which stands for a
+// block of just that address.
+func parseIPRange(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// allows reports whether path is one of the rule's paths.
+func (r *ACLRule) allows(path string) bool {
+	for _, allowed := range r.Paths {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if underPrefix(path, prefix) {
+				return true
+			}
+		} else if path == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is the set of access rules, which can be replaced while the server is
+// running.
+type ACL struct {
+	mu    sync.RWMutex
+	rules []ACLRule
+}
+
+func NewACL(rules []ACLRule) *ACL {
+	return &ACL{rules: rules}
+}
+
+func (a *ACL) Rules() []ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules
+}
+
+func (a *ACL) Set(rules []ACLRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+}
+
+// enforceACL turns away requests to paths that a rule binding their API key
+// or client IP doesn't allow. Keys and IPs no rule names may use any path,
+// and a request matching several rules must be allowed by each of them.
+func enforceACL(acl *ACL, keys *KeySet) HandlerFunc {
+	return func(c *Context) {
+		rules := acl.Rules()
+		if len(rules) == 0 {
+			c.Next()
+			return
+		}
+
+		var id string
+		if key := requestAPIKey(c); key != "" {
+			for _, k := range keys.Keys() {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+					id = keyID(k)
+					break
+				}
+			}
+		}
+		ip := net.ParseIP(c.ClientIP())
+		path := c.Request.URL.Path
+
+		for i := range rules {
+			rule := &rules[i]
+			var kind string
+			switch {
+			case rule.KeyID != "" && rule.KeyID == id:
+				kind = "key"
+			case rule.Network != nil && ip != nil && rule.Network.Contains(ip):
+				kind = "ip"
+			default:
+				continue
+			}
+			if !rule.allows(path) {
+				metrics.Count("acl.rejected", 1, "subject:"+kind)
+				respondError(c, http.StatusForbidden, codeAccessDenied, "Access to this path is not allowed")
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,81 @@
+package discordcdn
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		raw   string
+		rules int
+		ok    bool
+	}{
+		{"key:key_1a2b3c4d5e6f=/api/info/*|/healthz", 1, true},
+		{"ip:192.0.2.0/24=/s/*, ip:2001:db8::1=/p/*", 2, true},
+		{"ip:192.0.2.1=/healthz", 1, true},
+		{"", 0, true},
+		{"key:mykey=/api/*", 0, false},
+		{"ip:not-an-ip=/api/*", 0, false},
+		{"user:alice=/api/*", 0, false},
+		{"key:key_1a2b3c4d5e6f=api/*", 0, false},
+		{"key:key_1a2b3c4d5e6f", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			rules, err := parseACL(tt.raw)
+			if (err == nil) != tt.ok || len(rules) != tt.rules {
+				t.Errorf("parseACL() = %d rules, %v", len(rules), err)
+			}
+		})
+	}
+}
+
+func TestEnforceACL(t *testing.T) {
+	keys := NewKeySet([]string{"bound", "free"})
+	rules, err := parseACL("key:" + keyID("bound") + "=/api/info/*|/healthz, ip:198.51.100.0/24=/s/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	e := NewEngine()
+	e.SetTrustedProxies([]*net.IPNet{proxies})
+	e.Use(enforceACL(NewACL(rules), keys))
+	e.NoRoute(func(c *Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		headers    []string
+		status     int
+	}{
+		{"bound key on its path", "/api/info/1/2/a.png", "192.0.2.1:1234", []string{"X-API-Key", "bound"}, http.StatusOK},
+		{"bound key on an exact path", "/healthz", "192.0.2.1:1234", []string{"X-API-Key", "bound"}, http.StatusOK},
+		{"bound key elsewhere", "/api/shorten", "192.0.2.1:1234", []string{"X-API-Key", "bound"}, http.StatusForbidden},
+		{"bound key past an exact path", "/healthz/deps", "192.0.2.1:1234", []string{"X-API-Key", "bound"}, http.StatusForbidden},
+		{"bound key on a lookalike prefix", "/api/information", "192.0.2.1:1234", []string{"Authorization", "Bearer bound"}, http.StatusForbidden},
+		{"unbound key", "/api/shorten", "192.0.2.1:1234", []string{"X-API-Key", "free"}, http.StatusOK},
+		{"bound range on its path", "/s/abc", "198.51.100.7:1234", nil, http.StatusOK},
+		{"bound range elsewhere", "/api/shorten", "198.51.100.7:1234", []string{"X-API-Key", "free"}, http.StatusForbidden},
+		{"bound range through a trusted proxy", "/api/shorten", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.7"}, http.StatusForbidden},
+		{"spoofed address", "/api/shorten", "198.51.100.7:1234", []string{"X-Forwarded-For", "192.0.2.1"}, http.StatusForbidden},
+		{"bound key and range", "/healthz", "198.51.100.7:1234", []string{"X-API-Key", "bound"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			for i := 0; i+1 < len(tt.headers); i += 2 {
+				req.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package discordcdn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	pagerDutyEventsURL    = "https://events.pagerduty.com/v2/enqueue"
+	defaultOpsgenieAPIURL = "https://api.opsgenie.com"
+	alertTimeout          = 10 * time.Second
+	alertDedupPrefix      = "discord-cdn:"
+)
+
+// alertSeverity is the severity of each event that opens an incident, in
+// PagerDuty's terms.
+var alertSeverity = map[string]string{
+	"token_unhealthy":     "error",
+	"pool_degraded":       "critical",
+	"refresh_errors_high": "error",
+	"discord_outage":      "critical",
+	"rate_limited":        "warning",
+	"canary_failed":       "error",
+}
+
+// alertResolves maps each recovery event to the event whose incident it
+// closes.
+var alertResolves = map[string]string{
+	"token_recovered":          "token_unhealthy",
+	"pool_recovered":           "pool_degraded",
+	"refresh_errors_recovered": "refresh_errors_high",
+	"discord_recovered":        "discord_outage",
+	"rate_limit_recovered":     "rate_limited",
+	"canary_recovered":         "canary_failed",
+}
+
+// Alert is the JSON body posted to the alert webhook. Content repeats the
+// alert as text, so it can be posted straight to a Discord webhook.
+type Alert struct {
+	Event     string    `json:"event"`
+	Token     string    `json:"token,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Healthy   int       `json:"healthy"`
+	Total     int       `json:"total"`
+	ErrorRate float64   `json:"errorRate,omitempty"`
+	Time      time.Time `json:"time"`
+	Content   string    `json:"content"`
+}
+
+// resolved reports whether the alert closes an earlier one.
+func (a *Alert) resolved() bool {
+	_, ok := alertResolves[a.Event]
+	return ok
+}
+
+// dedupKey identifies the incident an alert opens or closes, so that a
+// recovery resolves the incident its failure opened.
+func (a *Alert) dedupKey() string {
+	event := a.Event
+	if opened, ok := alertResolves[event]; ok {
+		event = opened
+	}
+	key := alertDedupPrefix + event
+	if a.Token != "" {
+		key += ":" + a.Token
+	}
+	return key
+}
+
+// Alerter delivers alerts to a generic JSON webhook, which Discord webhooks
+// accept too, a Slack incoming webhook, PagerDuty's Events API and
+// Opsgenie, whichever are configured.
+type Alerter struct {
+	http         *http.Client
+	webhookURL   string
+	slackURL     string
+	pagerDutyKey string
+	opsgenieKey  string
+	opsgenieURL  string
+	source       string
+}
+
+func NewAlerter(config *Config) *Alerter {
+	source, err := os.Hostname()
+	if err != nil {
+		source = "discord-cdn"
+	}
+	return &Alerter{
+		http:         &http.Client{Timeout: alertTimeout},
+		webhookURL:   config.AlertWebhookURL,
+		slackURL:     config.SlackWebhookURL,
+		pagerDutyKey: config.PagerDutyRoutingKey,
+		opsgenieKey:  config.OpsgenieAPIKey,
+		opsgenieURL:  strings.TrimSuffix(config.OpsgenieAPIURL, "/"),
+		source:       source,
+	}
+}
+
+// Send logs the alert and posts it to every configured destination.
+func (a *Alerter) Send(alert Alert) {
+	log.Print(alert.Content)
+	metrics.Count("tokens.alerts", 1, "event:"+alert.Event)
+
+	if a.webhookURL != "" {
+		a.post("webhook", a.webhookURL, nil, alert)
+	}
+	if a.slackURL != "" {
+		a.post("Slack", a.slackURL, nil, map[string]string{"text": alert.Content})
+	}
+	if a.pagerDutyKey != "" {
+		a.post("PagerDuty", pagerDutyEventsURL, nil, a.pagerDutyEvent(alert))
+	}
+	if a.opsgenieKey != "" {
+		header := http.Header{"Authorization": {"GenieKey " + a.opsgenieKey}}
+		if alert.resolved() {
+			endpoint := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", a.opsgenieURL, url.PathEscape(alert.dedupKey()))
+			a.post("Opsgenie", endpoint, header, map[string]string{"source": a.source, "note": alert.Content})
+		} else {
+			a.post("Opsgenie", a.opsgenieURL+"/v2/alerts", header, a.opsgenieAlert(alert))
+		}
+	}
+}
+
+// pagerDutyEvent builds an Events API v2 event, triggering or resolving the
+// alert's incident.
+func (a *Alerter) pagerDutyEvent(alert Alert) map[string]interface{} {
+	event := map[string]interface{}{
+		"routing_key":  a.pagerDutyKey,
+		"event_action": "trigger",
+		"dedup_key":    alert.dedupKey(),
+	}
+	if alert.resolved() {
+		event["event_action"] = "resolve"
+		return event
+	}
+	event["payload"] = map[string]interface{}{
+		"summary":        alert.Content,
+		"source":         a.source,
+		"severity":       alertSeverity[alert.Event],
+		"timestamp":      alert.Time.Format(time.RFC3339),
+		"component":      "discord-cdn",
+		"class":          alert.Event,
+		"custom_details": alert,
+	}
+	return event
+}
+
+func (a *Alerter) opsgenieAlert(alert Alert) map[string]interface{} {
+	priority := "P2"
+	switch alertSeverity[alert.Event] {
+	case "critical":
+		priority = "P1"
+	case "warning":
+		priority = "P3"
+	}
+	details := map[string]string{"event": alert.Event}
+	if alert.Token != "" {
+		details["token"] = alert.Token
+	}
+	if alert.Reason != "" {
+		details["reason"] = alert.Reason
+	}
+	return map[string]interface{}{
+		"message":  alert.Content,
+		"alias":    alert.dedupKey(),
+		"source":   a.source,
+		"priority": priority,
+		"tags":     []string{"discord-cdn", alert.Event},
+		"details":  details,
+	}
+}
+
+func (a *Alerter) post(destination, endpoint string, header http.Header, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logAt(slog.LevelError, "Failed to encode alert for %s: %v", destination, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		logAt(slog.LevelError, "Failed to send alert to %s: %v", destination, err)
+		return
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		logAt(slog.LevelError, "Failed to send alert to %s: %v", destination, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		logAt(slog.LevelError, "Failed to send alert to %s: answered %d", destination, resp.StatusCode)
+	}
+}
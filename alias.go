@@ -0,0 +1,162 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// aliasName is the form of an alias: letters, digits, dots, dashes and
+// underscores, starting with a letter or digit, such as team-logo.png.
+var aliasName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+var errAliasNotFound = errors.New("alias not found")
+
+// Alias is a readable name for an attachment, whose target can be changed.
+// Names are unique regardless of case, and keep the case they were created
+// with.
+type Alias struct {
+	Name string `json:"name"`
+	LinkData
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type AliasRequest struct {
+	// Name is only given when creating an alias; updates take it from the
+	// path.
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+}
+
+// aliasResponse describes an alias to API clients.
+func aliasResponse(c *Context, config *Config, alias *Alias) H {
+	return H{
+		"name":   alias.Name,
+		"url":    publicURL(c, config) + "/a/" + alias.Name,
+		"target": alias.Path(),
+	}
+}
+
+// bindAliasRequest reads an alias request, responding with an error if its
+// attachment is missing or invalid.
+func bindAliasRequest(c *Context) (*AliasRequest, *LinkData, bool) {
+	var req AliasRequest
+	err := c.ShouldBindJSON(&req)
+	if bodyTooLarge(c, err) {
+		return nil, nil, false
+	}
+	if err != nil || req.URL == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+		return nil, nil, false
+	}
+	parsedLink := parseLink(req.URL)
+	if parsedLink.Error != "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+		return nil, nil, false
+	}
+	return &req, parsedLink.Data, true
+}
+
+func handleCreateAlias(store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		req, data, ok := bindAliasRequest(c)
+		if !ok {
+			return
+		}
+		if !aliasName.MatchString(req.Name) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "name must be up to 128 letters, digits, dots, dashes or underscores, starting with a letter or digit")
+			return
+		}
+
+		now := time.Now().UTC()
+		alias := &Alias{Name: req.Name, LinkData: *data, CreatedAt: now, UpdatedAt: now}
+		existing, err := store.AddAlias(alias)
+		if errors.Is(err, errSlugTaken) {
+			respondError(c, http.StatusConflict, codeAliasTaken, fmt.Sprintf("Alias %s is already taken", existing.Name))
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to save alias: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create alias")
+			return
+		}
+		c.JSON(http.StatusCreated, aliasResponse(c, config, alias))
+	}
+}
+
+// handleUpdateAlias points an alias at another attachment, purging the
+// responses cached at the edge for the one it pointed at, as for
+// permalinks.
+func handleUpdateAlias(client *DiscordClient, store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		_, data, ok := bindAliasRequest(c)
+		if !ok {
+			return
+		}
+
+		alias, previous, err := store.UpdateAlias(c.Param("name"), *data)
+		if errors.Is(err, errAliasNotFound) {
+			respondError(c, http.StatusNotFound, codeNotFound, "Alias not found")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to save alias: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to update alias")
+			return
+		}
+		if previous.FileID != data.FileID {
+			client.purgeAttachment(attachmentURL(previous.ChannelID, previous.FileID, previous.FileName))
+		}
+		logf(c, slog.LevelInfo, "Alias %s moved from %s to %s", alias.Name, previous.Path(), data.Path())
+		c.JSON(http.StatusOK, aliasResponse(c, config, alias))
+	}
+}
+
+func handleDeleteAlias(client *DiscordClient, store *Store) HandlerFunc {
+	return func(c *Context) {
+		alias, err := store.DeleteAlias(c.Param("name"))
+		if errors.Is(err, errAliasNotFound) {
+			respondError(c, http.StatusNotFound, codeNotFound, "Alias not found")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to delete alias: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to delete alias")
+			return
+		}
+		client.purgeAttachment(attachmentURL(alias.ChannelID, alias.FileID, alias.FileName))
+		logf(c, slog.LevelInfo, "Alias %s to %s deleted", alias.Name, alias.Path())
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func handleListAliases(store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		aliases := store.Aliases()
+		results := make([]H, len(aliases))
+		for i := range aliases {
+			results[i] = aliasResponse(c, config, &aliases[i])
+		}
+		c.JSON(http.StatusOK, H{"aliases": results})
+	}
+}
+
+func handleAlias(client *DiscordClient, store *Store, transformer *Transformer, config *Config) HandlerFunc {
+	return func(c *Context) {
+		alias, ok := store.Alias(c.Param("name"))
+		if !ok {
+			respondError(c, http.StatusNotFound, codeNotFound, "Alias not found")
+			return
+		}
+
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(permalinkMaxAge.Seconds())))
+
+		data := alias.LinkData
+		data.applyQuery(c.QueryValues())
+		serveAttachment(c, client, transformer, config, &data)
+	}
+}
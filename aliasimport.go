@@ -0,0 +1,311 @@
+package discordcdn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxAliasImport bounds the aliases one import may hold.
+const maxAliasImport = 100000
+
+// AliasImportError describes a row that can't be imported. Rows are numbered
+// from 1, not counting a CSV header.
+type AliasImportError struct {
+	Row   int    `json:"row"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+// AliasImportReport is the outcome of an import. Imports are all or nothing:
+// with any errors, nothing is imported.
+type AliasImportReport struct {
+	DryRun bool `json:"dryRun"`
+	Total  int  `json:"total"`
+	// Created and Updated count the aliases that were, or with DryRun would
+	// have been, created and pointed elsewhere.
+	Created int                `json:"created"`
+	Updated int                `json:"updated"`
+	Errors  []AliasImportError `json:"errors,omitempty"`
+}
+
+// readAliasImport reads the aliases to import. CSV takes names and URLs from
+// the columns headed "name" and "url", or from the first two columns when
+// there is no such header. JSON is an array of alias requests, or one per
+// line.
+func readAliasImport(r io.Reader, isCSV bool) ([]AliasRequest, error) {
+	if isCSV {
+		return readCSVAliases(r)
+	}
+	reader := bufio.NewReader(r)
+	first, err := firstNonSpace(reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' {
+		var requests []AliasRequest
+		if err := json.NewDecoder(reader).Decode(&requests); err != nil {
+			return nil, err
+		}
+		return requests, nil
+	}
+
+	var requests []AliasRequest
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var req AliasRequest
+		if err := json.Unmarshal(text, &req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		requests = append(requests, req)
+	}
+	return requests, scanner.Err()
+}
+
+// firstNonSpace returns the first byte of r that isn't white space, leaving
+// it unread.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+func readCSVAliases(r io.Reader) ([]AliasRequest, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	nameColumn, urlColumn := -1, -1
+	for i, header := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(header)) {
+		case "name":
+			nameColumn = i
+		case "url":
+			urlColumn = i
+		}
+	}
+	if nameColumn >= 0 && urlColumn >= 0 {
+		records = records[1:]
+	} else {
+		nameColumn, urlColumn = 0, 1
+	}
+
+	requests := make([]AliasRequest, 0, len(records))
+	for i, record := range records {
+		if max(nameColumn, urlColumn) >= len(record) {
+			return nil, fmt.Errorf("row %d has no column %d", i+1, max(nameColumn, urlColumn)+1)
+		}
+		requests = append(requests, AliasRequest{
+			Name: strings.TrimSpace(record[nameColumn]),
+			URL:  strings.TrimSpace(record[urlColumn]),
+		})
+	}
+	return requests, nil
+}
+
+// validateAliasImport turns the import rows into aliases, reporting the rows
+// with an invalid name or link, and names listed more than once in any case.
+func validateAliasImport(requests []AliasRequest) ([]*Alias, []AliasImportError) {
+	now := time.Now().UTC()
+	aliases := make([]*Alias, 0, len(requests))
+	var errs []AliasImportError
+	rows := map[string]int{}
+	for i, req := range requests {
+		row := i + 1
+		if !aliasName.MatchString(req.Name) {
+			errs = append(errs, AliasImportError{Row: row, Name: req.Name, Error: "name must be up to 128 letters, digits, dots, dashes or underscores, starting with a letter or digit"})
+			continue
+		}
+		key := strings.ToLower(req.Name)
+		if first, ok := rows[key]; ok {
+			errs = append(errs, AliasImportError{Row: row, Name: req.Name, Error: fmt.Sprintf("name is also on row %d", first)})
+			continue
+		}
+		rows[key] = row
+		if req.URL == "" {
+			errs = append(errs, AliasImportError{Row: row, Name: req.Name, Error: "URL is required"})
+			continue
+		}
+		parsedLink := parseLink(req.URL)
+		if parsedLink.Error != "" {
+			errs = append(errs, AliasImportError{Row: row, Name: req.Name, Error: parsedLink.Error})
+			continue
+		}
+		aliases = append(aliases, &Alias{Name: req.Name, LinkData: *parsedLink.Data, CreatedAt: now, UpdatedAt: now})
+	}
+	return aliases, errs
+}
+
+// handleImportAliases creates aliases in bulk from CSV or JSON, such as
+// when moving links over from another shortener. Existing names are errors
+// unless replace is set, which points them at the imported attachments
+// instead. With dryRun set, the import is only validated.
+func handleImportAliases(client *DiscordClient, store *Store) HandlerFunc {
+	return func(c *Context) {
+		raw, err := io.ReadAll(c.Request.Body)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Failed to read request body")
+			return
+		}
+		dryRun := c.Query("dryRun") == "true"
+		replace := c.Query("replace") == "true"
+
+		mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		requests, err := readAliasImport(bytes.NewReader(raw), mediaType == "text/csv")
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid import: "+err.Error())
+			return
+		}
+		if len(requests) == 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "No aliases to import")
+			return
+		}
+		if len(requests) > maxAliasImport {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Imports are limited to %d aliases", maxAliasImport))
+			return
+		}
+
+		report := AliasImportReport{DryRun: dryRun, Total: len(requests)}
+		aliases, errs := validateAliasImport(requests)
+		report.Errors = errs
+		if len(errs) == 0 {
+			result, err := store.ImportAliases(aliases, replace, dryRun)
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to import aliases: %v", err)
+				respondError(c, http.StatusInternalServerError, codeInternal, "Failed to import aliases")
+				return
+			}
+			for _, i := range result.Taken {
+				report.Errors = append(report.Errors, AliasImportError{Row: i + 1, Name: aliases[i].Name, Error: "alias is already taken"})
+			}
+			report.Created, report.Updated = result.Created, len(result.Moved)
+			if len(report.Errors) == 0 && !dryRun {
+				for _, previous := range result.Moved {
+					client.purgeAttachment(attachmentURL(previous.ChannelID, previous.FileID, previous.FileName))
+				}
+				logf(c, slog.LevelInfo, "Imported %d aliases, %d new", len(aliases), result.Created)
+			}
+		}
+
+		if len(report.Errors) > 0 {
+			report.Created, report.Updated = 0, 0
+			c.Set(errorCodeKey, codeInvalidParameter)
+			c.AbortWithStatusJSON(http.StatusBadRequest, struct {
+				ErrorResponse
+				AliasImportReport
+			}{
+				ErrorResponse: ErrorResponse{
+					Error:     fmt.Sprintf("%d of %d aliases can't be imported", len(report.Errors), len(requests)),
+					Code:      codeInvalidParameter,
+					RequestID: c.GetString(requestIDKey),
+				},
+				AliasImportReport: report,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// runAliasImport implements the alias-import subcommand, which sends a CSV
+// or JSON file of aliases to a running instance.
+func runAliasImport(args []string) error {
+	fs := flag.NewFlagSet("alias-import", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the instance, including any base path")
+	apiKey := fs.String("api-key", "", "API key allowed to use the API")
+	dryRun := fs.Bool("dry-run", false, "only validate the file, importing nothing")
+	replace := fs.Bool("replace", false, "point aliases that already exist at the imported attachments")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn alias-import [flags] <file.csv|file.json|file.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	query := url.Values{}
+	query.Set("dryRun", fmt.Sprint(*dryRun))
+	query.Set("replace", fmt.Sprint(*replace))
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*target, "/")+"/api/import/aliases?"+query.Encode(), file)
+	if err != nil {
+		return err
+	}
+	if isCSV(fs.Arg(0)) {
+		req.Header.Set("Content-Type", "text/csv")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *apiKey != "" {
+		req.Header.Set("X-API-Key", *apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		ErrorResponse
+		AliasImportReport
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s: failed to decode response: %w", resp.Status, err)
+	}
+	for _, e := range body.Errors {
+		fmt.Fprintf(os.Stderr, "row %d (%s): %s\n", e.Row, e.Name, e.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if body.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, body.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if body.DryRun {
+		fmt.Printf("Dry run: %d aliases would be imported, %d new and %d updated\n", body.Total, body.Created, body.Updated)
+	} else {
+		fmt.Printf("Imported %d aliases, %d new and %d updated\n", body.Total, body.Created, body.Updated)
+	}
+	return nil
+}
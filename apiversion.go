@@ -0,0 +1,122 @@
+package discordcdn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	discordAPIHost    = "https://discord.com/api"
+	defaultAPIVersion = 9
+)
+
+// discordAPIVersions are the API versions the client knows how to talk to.
+var discordAPIVersions = []int{9, 10}
+
+// discordErrInvalidAPIVersion is the JSON error code Discord answers with
+// when it no longer accepts the requested API version.
+const discordErrInvalidAPIVersion = 50041
+
+func discordAPIURL(version int) string {
+	return fmt.Sprintf("%s/v%d", discordAPIHost, version)
+}
+
+// SetAPIVersion sets the API version used for subsequent calls. With
+// fallback set, the client switches to the other supported version once if
+// Discord rejects this one.
+func (c *DiscordClient) SetAPIVersion(version int, fallback bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiVersion = version
+	c.fallbackVersion = 0
+	if fallback {
+		for _, v := range discordAPIVersions {
+			if v != version {
+				c.fallbackVersion = v
+			}
+		}
+	}
+}
+
+// apiBase returns the base URL of the API version currently in use.
+func (c *DiscordClient) apiBase() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return discordAPIURL(c.apiVersion)
+}
+
+// versionRejected reports whether resp says Discord no longer serves the
+// requested API version. The body is kept readable for the caller.
+func versionRejected(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusGone:
+		return true
+	case http.StatusBadRequest:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		var apiErr struct {
+			Code int `json:"code"`
+		}
+		return json.Unmarshal(body, &apiErr) == nil && apiErr.Code == discordErrInvalidAPIVersion
+	}
+	return false
+}
+
+// fallBack switches to the fallback API version after Discord rejected
+// rejected, and returns the version now in use. It reports false when there
+// is nothing to fall back to. Another request may have switched already, in
+// which case the current version is returned as is.
+func (c *DiscordClient) fallBack(rejected int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.apiVersion != rejected {
+		return c.apiVersion, true
+	}
+	if c.fallbackVersion == 0 {
+		return 0, false
+	}
+	logAt(slog.LevelWarn, "Discord rejected API v%d, falling back to v%d", c.apiVersion, c.fallbackVersion)
+	metrics.Count("discord.api_fallback", 1, fmt.Sprintf("from:v%d", c.apiVersion), fmt.Sprintf("to:v%d", c.fallbackVersion))
+	// Fall back only once, so two rejected versions don't alternate.
+	c.apiVersion, c.fallbackVersion = c.fallbackVersion, 0
+	return c.apiVersion, true
+}
+
+// retryWithFallback retries an API request that Discord rejected for its
+// version against the fallback version. Requests whose body can't be
+// replayed get the original response, and later calls use the new version.
+func (c *DiscordClient) retryWithFallback(req *http.Request, resp *http.Response) (*http.Response, error) {
+	var rejected int
+	rest, ok := strings.CutPrefix(req.URL.String(), discordAPIHost+"/v")
+	if !ok {
+		return resp, nil
+	}
+	if _, err := fmt.Sscanf(rest, "%d", &rejected); err != nil || !versionRejected(resp) {
+		return resp, nil
+	}
+	version, ok := c.fallBack(rejected)
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	retry.URL.Path = strings.Replace(retry.URL.Path, fmt.Sprintf("/api/v%d/", rejected), fmt.Sprintf("/api/v%d/", version), 1)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return c.httpClient().Do(retry)
+}
@@ -0,0 +1,92 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const cdnBase = "https://cdn.discordapp.com"
+
+// assetKinds are the CDN directories of hashed user and guild images.
+var assetKinds = []string{"avatars", "icons", "banners", "splashes"}
+
+// assetHash matches an image hash. Animated images have an a_ prefix.
+var assetHash = regexp.MustCompile(`^(a_)?[0-9a-f]{32}$`)
+
+// assetFormats are the formats an asset can be requested in. Only gif and
+// webp can be animated.
+var assetFormats = map[string]bool{"png": true, "jpg": true, "jpeg": true, "webp": true, "gif": true}
+
+// assetURL picks the CDN URL of an asset the way Discord clients do:
+// animated images are served as gif, or as animated webp when webp is asked
+// for, and everything else as png. static forces a still image, and size is
+// passed through to the CDN.
+func assetURL(kind string, id int64, hash, format string, static bool, size string) (string, error) {
+	animated := strings.HasPrefix(hash, "a_") && !static
+	switch {
+	case format == "":
+		format = "png"
+		if animated {
+			format = "gif"
+		}
+	case !assetFormats[format]:
+		return "", errors.New("format must be png, jpg, webp or gif")
+	case format == "gif" && !animated:
+		return "", errors.New("only animated images can be served as gif")
+	}
+
+	query := url.Values{}
+	if size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 16 || n > 4096 || n&(n-1) != 0 {
+			return "", errors.New("size must be a power of two between 16 and 4096")
+		}
+		query.Set("size", size)
+	}
+	if animated && format == "webp" {
+		query.Set("animated", "true")
+	}
+
+	u := fmt.Sprintf("%s/%s/%d/%s.%s", cdnBase, kind, id, hash, format)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u, nil
+}
+
+// handleAsset serves a user or guild image from its ID and hash, with any
+// extension on the hash ignored in favour of ?format. Asset URLs aren't
+// signed, so nothing needs refreshing.
+func handleAsset(client *DiscordClient, config *Config, kind string) HandlerFunc {
+	return func(c *Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || !validSnowflake(id) {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "ID is not a Discord ID")
+			return
+		}
+		hash := c.Param("hash")
+		hash = strings.TrimSuffix(hash, path.Ext(hash))
+		if !assetHash.MatchString(hash) {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "Invalid image hash")
+			return
+		}
+
+		target, err := assetURL(kind, id, hash, c.Query("format"), c.Query("static") == "1", c.Query("size"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid asset: "+err.Error())
+			return
+		}
+
+		if config.ProxyMode {
+			proxyContent(c, client, target, config.MaxProxySize, "")
+			return
+		}
+		c.Redirect(http.StatusMovedPermanently, target)
+	}
+}
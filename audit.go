@@ -0,0 +1,288 @@
+package discordcdn
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// auditRotateInterval starts a new audit file every day, so old entries
+	// can be dropped a whole file at a time.
+	auditRotateInterval = 24 * time.Hour
+	// auditRotatedFormat is the timestamp suffix RotatingFile gives rotated
+	// files.
+	auditRotatedFormat = "20060102T150405.000"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Outcomes of a refresh besides the error code of a failed one.
+const auditRefreshed = "refreshed"
+
+// AuditEntry records one attachment refresh: who asked for it, which
+// attachment, the token used and how it went.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Requester  string    `json:"requester"`
+	Attachment string    `json:"attachment"`
+	Token      string    `json:"token"`
+	Priority   string    `json:"priority"`
+	Outcome    string    `json:"outcome"`
+}
+
+// AuditLog appends refresh records to a JSON lines file. Entries are never
+// changed once written; the file is rotated daily and rotated files are
+// deleted once all their entries are older than the retention period.
+type AuditLog struct {
+	file      *RotatingFile
+	path      string
+	retention time.Duration
+}
+
+func OpenAuditLog(path string, retention time.Duration) (*AuditLog, error) {
+	file, err := OpenRotatingFile(path, 0, auditRotateInterval)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{file: file, path: path, retention: retention}
+	go func() {
+		for ; ; time.Sleep(time.Hour) {
+			a.prune()
+		}
+	}()
+	return a, nil
+}
+
+// Record appends entries to the log.
+func (a *AuditLog) Record(entries []AuditEntry) {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			logAt(slog.LevelError, "Failed to encode audit entry: %v", err)
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := a.file.Write(buf); err != nil {
+		logAt(slog.LevelError, "Failed to write audit log: %v", err)
+	}
+}
+
+// rotated returns the rotated files, oldest first, with the time each was
+// rotated at.
+func (a *AuditLog) rotated() ([]string, []time.Time) {
+	matches, _ := filepath.Glob(a.path + ".*")
+	slices.Sort(matches)
+	var files []string
+	var times []time.Time
+	for _, m := range matches {
+		t, err := time.Parse(auditRotatedFormat, strings.TrimPrefix(m, a.path+"."))
+		if err != nil {
+			continue
+		}
+		files = append(files, m)
+		times = append(times, t)
+	}
+	return files, times
+}
+
+func (a *AuditLog) prune() {
+	files, times := a.rotated()
+	cutoff := time.Now().Add(-a.retention)
+	for i, file := range files {
+		if times[i].Before(cutoff) {
+			if err := os.Remove(file); err != nil {
+				logAt(slog.LevelError, "Failed to remove expired audit log %s: %v", file, err)
+			}
+		}
+	}
+}
+
+// auditFilter selects audit entries. Empty fields match everything, and
+// attachment matches by prefix, so a channel ID selects the whole channel.
+type auditFilter struct {
+	requester  string
+	attachment string
+	token      string
+	outcome    string
+	from, to   time.Time
+}
+
+func (f *auditFilter) matches(e *AuditEntry) bool {
+	return (f.requester == "" || e.Requester == f.requester) &&
+		(f.attachment == "" || strings.HasPrefix(e.Attachment, f.attachment)) &&
+		(f.token == "" || e.Token == f.token) &&
+		(f.outcome == "" || e.Outcome == f.outcome) &&
+		(f.from.IsZero() || !e.Time.Before(f.from)) &&
+		(f.to.IsZero() || e.Time.Before(f.to))
+}
+
+// Query returns up to limit of the most recent entries matching filter,
+// newest first.
+func (a *AuditLog) Query(filter auditFilter, limit int) ([]AuditEntry, error) {
+	files, _ := a.rotated()
+	var entries []AuditEntry
+	for _, path := range append(files, a.path) {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !filter.matches(&entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+	slices.Reverse(entries)
+	return entries, nil
+}
+
+// SetAuditLog sets the log every refresh is recorded in.
+func (c *DiscordClient) SetAuditLog(audit *AuditLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auditLog = audit
+}
+
+// AuditLog returns the audit log, or nil when auditing is off.
+func (c *DiscordClient) AuditLog() *AuditLog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.auditLog
+}
+
+// audit records the outcome of refreshing attachmentURLs with token.
+func (c *DiscordClient) audit(requester, token string, priority Priority, attachmentURLs []string, refreshed map[string]string, err error) {
+	audit := c.AuditLog()
+	if audit == nil {
+		return
+	}
+	now := time.Now().UTC()
+	entries := make([]AuditEntry, len(attachmentURLs))
+	for i, u := range attachmentURLs {
+		outcome := auditRefreshed
+		switch {
+		case err != nil:
+			outcome = classifyRefreshError(err).code
+		case refreshed[u] == "":
+			outcome = codeAttachmentNotFound
+		}
+		entries[i] = AuditEntry{
+			Time:       now,
+			Requester:  requester,
+			Attachment: strings.TrimPrefix(u, attachmentURLPrefix),
+			Token:      tokenID(token),
+			Priority:   priority.String(),
+			Outcome:    outcome,
+		}
+	}
+	audit.Record(entries)
+}
+
+// requesterOf identifies who a request was made by, for the audit log: the
+// API key, JWT subject or Discord user it authenticated as, or else the
+// client IP.
+func requesterOf(c *Context) string {
+	if key := c.GetString(apiKeyKey); key != "" {
+		return key
+	}
+	if value, ok := c.Get(claimsKey); ok && value.(*jwtClaims).Subject != "" {
+		return "jwt:" + value.(*jwtClaims).Subject
+	}
+	if value, ok := c.Get(sessionKey); ok {
+		return "user:" + strconv.FormatInt(value.(*oauthSession).userID, 10)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// grpcRequester identifies who made a gRPC call, like requesterOf: the API
+// key or client certificate it authenticated with, its JWT subject, or else
+// its peer's address.
+func grpcRequester(ctx context.Context) string {
+	if key, ok := ctx.Value(grpcKeyContextKey{}).(string); ok {
+		return key
+	}
+	if claims, ok := ctx.Value(grpcClaimsContextKey{}).(*jwtClaims); ok && claims.Subject != "" {
+		return "jwt:" + claims.Subject
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "grpc"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return "ip:" + host
+}
+
+func handleAudit(audit *AuditLog) HandlerFunc {
+	return func(c *Context) {
+		filter := auditFilter{
+			requester:  c.Query("requester"),
+			attachment: c.Query("attachment"),
+			token:      c.Query("token"),
+			outcome:    c.Query("outcome"),
+		}
+		for _, t := range []struct {
+			param string
+			value *time.Time
+		}{{"from", &filter.from}, {"to", &filter.to}} {
+			if raw := c.Query(t.param); raw != "" {
+				parsed, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					respondError(c, http.StatusBadRequest, codeInvalidParameter, t.param+" must be a time such as 2006-01-02T15:04:05Z")
+					return
+				}
+				*t.value = parsed
+			}
+		}
+		limit := defaultAuditLimit
+		if raw := c.Query("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxAuditLimit {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit))
+				return
+			}
+			limit = n
+		}
+
+		entries, err := audit.Query(filter, limit)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to query audit log: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read audit log")
+			return
+		}
+		c.JSON(http.StatusOK, H{"entries": entries})
+	}
+}
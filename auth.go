@@ -0,0 +1,183 @@
+package discordcdn
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// apiKeyKey holds the keyID of the API key a request authenticated with, or
+// the name of its client certificate prefixed with certPrefix.
+const apiKeyKey = "apiKey"
+
+// keyID identifies an API key in usage reports without revealing it.
+func keyID(key string) string {
+	return "key_" + secretHash(key)
+}
+
+// secretHash returns a short hash of a secret, stable enough to tell secrets
+// apart in logs and reports.
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:6])
+}
+
+// adminPrefix marks a requester that authenticated with an admin key rather
+// than an API key, ahead of the key's keyID.
+const adminPrefix = "admin:"
+
+// requireAPIKey rejects requests that don't carry one of the configured keys,
+// either as an X-API-Key header, a bearer token, or the password of HTTP basic
+// auth. Requests made with a verified client certificate that certNames
+// allows need no key.
+func requireAPIKey(keys *KeySet, certNames []string) HandlerFunc {
+	return func(c *Context) {
+		if authenticateAPIKey(c, keys, certNames) {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="discord-cdn"`)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid API key")
+	}
+}
+
+// requireAdminKey rejects requests that don't carry one of DCDN_ADMIN_KEYS,
+// sent the same ways as an API key, so that browsers can log in to the admin
+// dashboard with basic auth. API keys and client certificates aren't enough.
+func requireAdminKey(keys []string) HandlerFunc {
+	admin := NewKeySet(keys)
+	return func(c *Context) {
+		if id, ok := matchAPIKey(admin, requestAPIKey(c)); ok {
+			c.Set(apiKeyKey, adminPrefix+id)
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="discord-cdn admin"`)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid admin key")
+	}
+}
+
+// authenticateAPIKey reports whether the request carries one of the keys or
+// an allowed client certificate, recording which under apiKeyKey.
+func authenticateAPIKey(c *Context, keys *KeySet, certNames []string) bool {
+	if name, ok := requestClientCert(c, certNames); ok {
+		c.Set(apiKeyKey, certPrefix+name)
+		return true
+	}
+	if id, ok := matchAPIKey(keys, requestAPIKey(c)); ok {
+		c.Set(apiKeyKey, id)
+		return true
+	}
+	return false
+}
+
+// matchAPIKey returns the keyID of key if it is one of the configured keys.
+func matchAPIKey(keys *KeySet, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	for _, k := range keys.Keys() {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return keyID(k), true
+		}
+	}
+	return "", false
+}
+
+// requestAPIKey returns the API key the request carries, if any.
+func requestAPIKey(c *Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		if c.GetString(basicAuthUserKey) != "" {
+			return ""
+		}
+		return password
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// authorizeChannel checks that the request's JWT or Discord login grants
+// access to the channel. It writes a 403 response and returns false if not,
+// and always allows requests when neither is enabled.
+func authorizeChannel(c *Context, client *DiscordClient, channelID int64) bool {
+	grant := requestGrant(c)
+	denial := grant.denial(client, channelID)
+	if denial == "" {
+		return true
+	}
+	logf(c, slog.LevelWarn, "%s denied access to channel %d", grant, channelID)
+	respondError(c, http.StatusForbidden, codeAccessDenied, denial)
+	return false
+}
+
+// channelGrant is what a JWT or Discord login grants access to. The zero
+// value, for requests with neither, grants every channel.
+type channelGrant struct {
+	claims  *jwtClaims
+	session *oauthSession
+}
+
+func requestGrant(c *Context) channelGrant {
+	var grant channelGrant
+	if value, ok := c.Get(claimsKey); ok {
+		grant.claims = value.(*jwtClaims)
+	}
+	if value, ok := c.Get(sessionKey); ok {
+		grant.session = value.(*oauthSession)
+	}
+	return grant
+}
+
+// denial returns why the grant doesn't extend to channelID, or an empty
+// string if it does. A token takes precedence over a login.
+func (g channelGrant) denial(client *DiscordClient, channelID int64) string {
+	switch {
+	case g.claims != nil:
+		if !g.claims.allows(channelID) {
+			return "Token does not grant access to this channel"
+		}
+	case g.session != nil:
+		if guildID := client.ChannelGuild(channelID); guildID == 0 || !g.session.guilds[guildID] {
+			return "You are not a member of the attachment's server"
+		}
+	}
+	return ""
+}
+
+// String names the holder of the grant in logs.
+func (g channelGrant) String() string {
+	if g.claims == nil && g.session != nil {
+		return fmt.Sprintf("User %d", g.session.userID)
+	}
+	return "Token"
+}
+
+// KeySet is the set of accepted API keys, which can be replaced while the
+// server is running.
+type KeySet struct {
+	mu   sync.RWMutex
+	keys []string
+}
+
+func NewKeySet(keys []string) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+func (s *KeySet) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+func (s *KeySet) Set(keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
@@ -0,0 +1,263 @@
+package discordcdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets stored in AWS are referred to as awssm:<secret ID or ARN>, with
+// #<key> to pick one key of a JSON secret, or ssm:<parameter name> for
+// Parameter Store.
+const (
+	awsSecretsManagerPrefix = "awssm:"
+	awsParameterPrefix      = "ssm:"
+)
+
+// awsTimeout bounds each call to AWS, including fetching credentials.
+const awsTimeout = 10 * time.Second
+
+// ecsCredentialsHost serves task role credentials to ECS containers.
+const ecsCredentialsHost = "http://169.254.170.2"
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// AWSClient reads secrets from AWS Secrets Manager and SSM Parameter Store,
+// and keeps the URL cache in DynamoDB, signing requests itself so the AWS SDK
+// isn't needed for a handful of calls. Credentials and region come from the
+// standard AWS environment variables, or from the ECS task role.
+type AWSClient struct {
+	http    *http.Client
+	credsMu sync.Mutex
+	creds   *awsCredentials
+}
+
+func newAWSClient() *AWSClient {
+	return &AWSClient{http: &http.Client{Timeout: awsTimeout}}
+}
+
+// credentials returns credentials from AWS_ACCESS_KEY_ID and friends, as
+// set on Lambda, or else from the ECS container credentials endpoint.
+func (a *AWSClient) credentials() (*awsCredentials, error) {
+	a.credsMu.Lock()
+	defer a.credsMu.Unlock()
+	if a.creds != nil {
+		return a.creds, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		a.creds = &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return a.creds, nil
+	}
+
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = ecsCredentialsHost + uri
+	}
+	if endpoint == "" {
+		return nil, errors.New("no AWS credentials found in the environment or ECS task role")
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credentials request: %w", err)
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch AWS credentials: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AWS credentials endpoint answered %d", resp.StatusCode)
+	}
+	var creds awsCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("failed to decode AWS credentials: %w", err)
+	}
+	a.creds = &creds
+	return a.creds, nil
+}
+
+// awsRegion returns the region of an ARN, or the configured region for
+// plain names.
+func awsRegion(id string) (string, error) {
+	if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3], nil
+	}
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(key); region != "" {
+			return region, nil
+		}
+	}
+	return "", errors.New("AWS_REGION is not set")
+}
+
+// call invokes a JSON API action such as secretsmanager.GetSecretValue.
+func (a *AWSClient) call(service, region, target string, in, out interface{}) error {
+	creds, err := a.credentials()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	host := fmt.Sprintf("%s.%s.amazonaws.com", service, region)
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	// DynamoDB speaks an older version of the same protocol.
+	if service == "dynamodb" {
+		req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	} else {
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	}
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, creds, service, region, time.Now().UTC())
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach AWS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		json.Unmarshal(data, &awsErr)
+		return fmt.Errorf("AWS answered %d: %s %s", resp.StatusCode, awsErr.Type, awsErr.Message)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode AWS response: %w", err)
+	}
+	return nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to req.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, service, region string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// secret returns a Secrets Manager secret, given as id or id#key. With a
+// key, the secret must be a JSON object and that key's value is returned.
+func (a *AWSClient) secret(ref string) (string, error) {
+	id, key, hasKey := strings.Cut(ref, "#")
+	region, err := awsRegion(id)
+	if err != nil {
+		return "", err
+	}
+
+	var out struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := a.call("secretsmanager", region, "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+		return "", err
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary, not a string", id)
+	}
+	if !hasKey {
+		return *out.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(*out.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object", id)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", id, key)
+	}
+	return value, nil
+}
+
+// parameter returns an SSM parameter, decrypting SecureString parameters.
+func (a *AWSClient) parameter(name string) (string, error) {
+	region, err := awsRegion(name)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	in := map[string]interface{}{"Name": name, "WithDecryption": true}
+	if err := a.call("ssm", region, "AmazonSSM.GetParameter", in, &out); err != nil {
+		return "", err
+	}
+	return out.Parameter.Value, nil
+}
@@ -0,0 +1,55 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Queues that shed load once they are saturated, which tag
+// backpressure.rejected.
+const (
+	queueBudget      = "budget"
+	queueGlobal      = "global"
+	queueConcurrency = "concurrency"
+)
+
+// OverloadError is returned instead of waiting behind a saturated queue for
+// longer than DCDN_MAX_QUEUE_WAIT, so clients are told when to come back
+// rather than kept waiting ever longer as load grows.
+type OverloadError struct {
+	// Queue names the saturated queue.
+	Queue string
+	// RetryAfter estimates when the queue will have room again.
+	RetryAfter time.Duration
+}
+
+func newOverloadError(queue string, retryAfter time.Duration) *OverloadError {
+	metrics.Count("backpressure.rejected", 1, "queue:"+queue)
+	return &OverloadError{Queue: queue, RetryAfter: retryAfter}
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("%s queue is saturated, retry in %s", e.Queue, e.RetryAfter.Round(time.Second))
+}
+
+// retryAfterHeader formats d as a Retry-After value: whole seconds, rounded
+// up, and at least one.
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
+
+// respondOverloaded sends a 503 for an overloaded queue, reporting whether
+// err was one.
+func respondOverloaded(c *Context, err error) bool {
+	var overload *OverloadError
+	if !errors.As(err, &overload) {
+		return false
+	}
+	c.Header("Retry-After", retryAfterHeader(overload.RetryAfter))
+	respondError(c, http.StatusServiceUnavailable, codeOverloaded, "The server is overloaded, try again later")
+	return true
+}
@@ -0,0 +1,197 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// backupFormat identifies backup files, so import refuses anything else.
+const backupFormat = "discord-cdn-backup"
+
+// Backup is a portable copy of the data files of a deployment and its
+// tenants: manifests, short links, usage and the attachment index.
+type Backup struct {
+	Format    string        `json:"format"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Stores    []BackupStore `json:"stores"`
+}
+
+// BackupStore is the data file of the default configuration, when Tenant is
+// empty, or of a tenant. Data is the store document at the version it was
+// exported at, which import upgrades as need be.
+type BackupStore struct {
+	Tenant string          `json:"tenant,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// errDatabaseBackup is returned by export and import when stores are kept in
+// DCDN_DATABASE_URL rather than in data files.
+var errDatabaseBackup = errors.New("stores kept in a database are backed up with the database's own tools")
+
+// backupTargets lists the data files of the default configuration and of
+// every tenant, keyed by tenant name.
+func backupTargets(config *Config) map[string]string {
+	targets := map[string]string{"": config.DataPath}
+	for _, t := range config.Tenants {
+		targets[t.Name] = tenantPath(config.DataPath, t.Name)
+	}
+	return targets
+}
+
+// exportBackup reads every data file that exists into a backup, upgrading
+// them in memory only, so exporting never changes them.
+func exportBackup(config *Config) (*Backup, error) {
+	if config.DatabaseURL != "" {
+		return nil, errDatabaseBackup
+	}
+	backup := &Backup{Format: backupFormat, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	targets := backupTargets(config)
+	for _, tenant := range slices.Sorted(maps.Keys(targets)) {
+		raw, err := os.ReadFile(targets[tenant])
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read store: %w", err)
+		}
+		migrated, _, err := migrateStoreDocument(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", targets[tenant], err)
+		}
+		backup.Stores = append(backup.Stores, BackupStore{Tenant: tenant, Data: migrated})
+	}
+	return backup, nil
+}
+
+// importBackup writes the stores of a backup to the data files configured
+// for them. Existing data files are left alone unless force is set, in which
+// case they are copied to <path>.pre-import.bak first.
+func importBackup(config *Config, backup *Backup, force bool) ([]string, error) {
+	if config.DatabaseURL != "" {
+		return nil, errDatabaseBackup
+	}
+	if backup.Format != backupFormat {
+		return nil, errors.New("not a discord-cdn backup")
+	}
+	targets := backupTargets(config)
+
+	// Check every store before writing any, so a bad backup changes nothing.
+	stores := make([]*Store, len(backup.Stores))
+	for i, b := range backup.Stores {
+		path, ok := targets[b.Tenant]
+		if !ok {
+			return nil, fmt.Errorf("backup has data for tenant %s, which isn't configured", b.Tenant)
+		}
+		migrated, _, err := migrateStoreDocument(b.Data)
+		if err != nil {
+			return nil, fmt.Errorf("store of tenant %q: %w", b.Tenant, err)
+		}
+		s := &Store{path: path}
+		if err := json.Unmarshal(migrated, &s.data); err != nil {
+			return nil, fmt.Errorf("failed to decode store: %w", err)
+		}
+		s.data.init()
+		if _, err := os.Stat(path); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists; pass -force to replace it", path)
+		}
+		stores[i] = s
+	}
+
+	var written []string
+	for _, s := range stores {
+		if raw, err := os.ReadFile(s.path); err == nil {
+			if err := os.WriteFile(s.path+".pre-import.bak", raw, 0o600); err != nil {
+				return written, fmt.Errorf("failed to back up store: %w", err)
+			}
+		}
+		s.mu.Lock()
+		err := s.save()
+		s.mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written = append(written, s.path)
+	}
+	return written, nil
+}
+
+// runExport implements the export subcommand, which writes a backup of the
+// data files to a file or standard output.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "", "file to write to (default: standard output)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn export [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	backup, err := exportBackup(config)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(backup); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d data files\n", len(backup.Stores))
+	return nil
+}
+
+// runImport implements the import subcommand, which restores the data files
+// from a backup. The server must be stopped, or it overwrites them the next
+// time it saves.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	force := fs.Bool("force", false, "replace data files that already exist")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn import [flags] <backup>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	raw, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var backup Backup
+	if err := json.Unmarshal(raw, &backup); err != nil {
+		return fmt.Errorf("failed to decode backup: %w", err)
+	}
+
+	written, err := importBackup(config, &backup, *force)
+	for _, path := range written {
+		fmt.Printf("Restored %s\n", path)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package discordcdn
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// pathPrefixKey is the request context key of the path prefix a request was
+// mounted under.
+type pathPrefixKey struct{}
+
+// pathPrefix returns the path prefix the request arrived under, made of the
+// base path and the tenant's prefix, or "". Links and redirects the service
+// generates start with it.
+func pathPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(pathPrefixKey{}).(string)
+	return prefix
+}
+
+// underPrefix reports whether path is prefix or lies below it.
+func underPrefix(path, prefix string) bool {
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/"))
+}
+
+// mount returns r with prefix removed from its path and added to its path
+// prefix, so routers see the paths they registered.
+func mount(r *http.Request, prefix string) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, pathPrefix(r)+prefix))
+	u := *r.URL
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+	r.URL = &u
+	return r
+}
+
+// mountBasePath serves handler under basePath. Requests whose path still
+// carries it have it removed; others are served as they are, for reverse
+// proxies that strip the base path themselves. Either way, generated links
+// and redirects include it.
+func mountBasePath(basePath string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if underPrefix(r.URL.Path, basePath) {
+			r = mount(r, basePath)
+		} else {
+			r = r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, basePath))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package discordcdn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthUserKey holds the user a request passed basic auth as.
+const basicAuthUserKey = "basicAuthUser"
+
+// loadHtpasswd reads the users of an htpasswd file and their password
+// hashes, which must be bcrypt, as written by htpasswd -B, or {SHA}.
+func loadHtpasswd(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d must look like <user>:<hash>", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d has an unsupported hash for %s; use htpasswd -B", line, user)
+		}
+		users[user] = hash
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("has no users")
+	}
+	return users, nil
+}
+
+// checkPassword reports whether password matches an htpasswd hash.
+func checkPassword(hash, password string) bool {
+	if encoded, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(encoded)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// BasicAuth is the set of users allowed in by basic auth, which can be
+// replaced while the server is running. Credentials that matched are
+// remembered, so bcrypt's deliberately slow check is paid once per user
+// rather than on every request.
+type BasicAuth struct {
+	mu       sync.RWMutex
+	users    map[string]string
+	verified map[[sha256.Size]byte]bool
+}
+
+func NewBasicAuth(users map[string]string) *BasicAuth {
+	return &BasicAuth{users: users, verified: map[[sha256.Size]byte]bool{}}
+}
+
+func (a *BasicAuth) Set(users map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	a.verified = map[[sha256.Size]byte]bool{}
+}
+
+// enabled reports whether any users are configured.
+func (a *BasicAuth) enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users) > 0
+}
+
+// check reports whether user and password are the credentials of a
+// configured user.
+func (a *BasicAuth) check(user, password string) bool {
+	sum := sha256.Sum256([]byte(user + ":" + password))
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	verified := a.verified[sum]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if verified {
+		return true
+	}
+	if !checkPassword(hash, password) {
+		return false
+	}
+	a.mu.Lock()
+	if a.users[user] == hash {
+		a.verified[sum] = true
+	}
+	a.mu.Unlock()
+	return true
+}
+
+// requireBasicAuth keeps out requests without the username and password of
+// one of the users, when there are any. API keys then have to be sent in the
+// X-API-Key header, since the Authorization header is spoken for.
+func requireBasicAuth(auth *BasicAuth) HandlerFunc {
+	return func(c *Context) {
+		if !auth.enabled() {
+			c.Next()
+			return
+		}
+		if user, password, ok := c.Request.BasicAuth(); ok && auth.check(user, password) {
+			c.Set(basicAuthUserKey, user)
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", `Basic realm="discord-cdn", charset="UTF-8"`)
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid username or password")
+	}
+}
@@ -0,0 +1,98 @@
+package discordcdn
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		users   int
+		ok      bool
+	}{
+		{"bcrypt and SHA", "# users\nalice:$2y$05$abcdefghijklmnopqrstuu5s2v8.iO4lBkv1mMtE9yh6E5gY6eH2\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 2, true},
+		{"crypt hash", "alice:rl3k2JvOtmkg.\n", 0, false},
+		{"no hash", "alice\n", 0, false},
+		{"empty user", ":{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 0, false},
+		{"no users", "# nobody yet\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			users, err := loadHtpasswd(path)
+			if (err == nil) != tt.ok || len(users) != tt.users {
+				t.Errorf("loadHtpasswd() = %d users, %v", len(users), err)
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]string{
+		"alice": string(hash),
+		// "password", as written by htpasswd -s.
+		"bob": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}
+	fake, client := newFakeDiscord(t)
+	link := fake.put(testChannelID, testFileID, "a.png", []byte("image"))
+	router := newTestRouter(t, &Config{HtpasswdUsers: users, APIKeys: []string{"key"}}, client)
+	info := "/api/info" + link
+
+	tests := []struct {
+		name    string
+		target  string
+		headers []string
+		status  int
+	}{
+		{"bcrypt user", link, []string{"Authorization", "Basic YWxpY2U6c2VjcmV0"}, http.StatusMovedPermanently},
+		{"bcrypt user again", link, []string{"Authorization", "Basic YWxpY2U6c2VjcmV0"}, http.StatusMovedPermanently},
+		{"SHA user", link, []string{"Authorization", "Basic Ym9iOnBhc3N3b3Jk"}, http.StatusMovedPermanently},
+		{"wrong password", link, []string{"Authorization", "Basic YWxpY2U6d3Jvbmc="}, http.StatusUnauthorized},
+		{"another user's password", link, []string{"Authorization", "Basic Ym9iOnNlY3JldA=="}, http.StatusUnauthorized},
+		{"unknown user", link, []string{"Authorization", "Basic Y2Fyb2w6c2VjcmV0"}, http.StatusUnauthorized},
+		{"no credentials", link, nil, http.StatusUnauthorized},
+		{"API key alone", info, []string{"X-API-Key", "key"}, http.StatusUnauthorized},
+		{"API key and user", info, []string{"Authorization", "Basic YWxpY2U6c2VjcmV0", "X-API-Key", "key"}, http.StatusOK},
+		{"user without API key", info, []string{"Authorization", "Basic YWxpY2U6c2VjcmV0"}, http.StatusUnauthorized},
+		{"health check", "/healthz", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, http.MethodGet, tt.target, nil, tt.headers...)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	if w := doRequest(router, http.MethodGet, link, nil); w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without a WWW-Authenticate challenge")
+	}
+}
+
+func TestBasicAuthSet(t *testing.T) {
+	auth := NewBasicAuth(map[string]string{"bob": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="})
+	if !auth.check("bob", "password") {
+		t.Fatal("check() rejected bob's password")
+	}
+	// Remembered credentials go with the users they were checked against.
+	auth.Set(map[string]string{"bob": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="})
+	if auth.check("bob", "password") {
+		t.Error("check() accepted bob's old password")
+	}
+	if !auth.check("bob", "secret") {
+		t.Error("check() rejected bob's new password")
+	}
+}
@@ -0,0 +1,156 @@
+package discordcdn
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// refreshBatchSize is how many URLs are sent to Discord per refresh call.
+	refreshBatchSize = 50
+	// maxRefreshRetries is how many times a batch is retried after a Discord
+	// error other than a rate limit before its links are marked as failed.
+	maxRefreshRetries = 3
+)
+
+// linkRefresh is the outcome of refreshing one link of a batch.
+type linkRefresh struct {
+	raw  string
+	data *LinkData
+	// url is the refreshed URL, with any media parameters applied.
+	url       string
+	expiresAt time.Time
+	code      string
+	message   string
+}
+
+func (r *linkRefresh) failed() bool {
+	return r.code != ""
+}
+
+// refreshBatch refreshes up to refreshBatchSize links with a single Discord
+// call. Results are in the order of raws; links that can't be parsed or
+// refreshed carry an error code and message instead of a URL. The error of the
+// Discord call itself, if any, is also returned so callers can retry.
+func refreshBatch(client *DiscordClient, priority Priority, requester string, raws []string) ([]linkRefresh, error) {
+	results := make([]linkRefresh, len(raws))
+	var targets []string
+	for i, raw := range raws {
+		results[i].raw = raw
+		parsedLink := parseLink(raw)
+		if parsedLink.Error != "" {
+			results[i].code, results[i].message = codeInvalidLink, parsedLink.Error
+			continue
+		}
+		if t := client.takedown(parsedLink.Data.FileID); t != nil {
+			failure := classifyRefreshError(&TakedownError{FileID: parsedLink.Data.FileID, Status: t.Status})
+			results[i].code, results[i].message = failure.code, failure.message
+			continue
+		}
+		results[i].data = parsedLink.Data
+		targets = append(targets, attachmentURL(parsedLink.Data.ChannelID, parsedLink.Data.FileID, parsedLink.Data.FileName))
+	}
+	if len(targets) == 0 {
+		return results, nil
+	}
+
+	refreshed, err := client.RefreshAttachmentURLs(context.Background(), priority, requester, targets)
+	if err != nil {
+		logAt(slog.LevelError, "Error refreshing attachment URLs: %v", err)
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.data == nil {
+			continue
+		}
+
+		var newURL string
+		if err == nil {
+			newURL = refreshed[attachmentURL(r.data.ChannelID, r.data.FileID, r.data.FileName)]
+		}
+		if newURL == "" {
+			failure := classifyRefreshError(errAttachmentNotFound)
+			if err != nil {
+				failure = classifyRefreshError(err)
+			}
+			r.code, r.message = failure.code, failure.message
+			// Discord may say which links of the batch it rejected, and why.
+			var discordErr *DiscordError
+			if errors.As(err, &discordErr) {
+				if reason := discordErr.Errors[attachmentURL(r.data.ChannelID, r.data.FileID, r.data.FileName)]; reason != "" {
+					r.message += ": " + reason
+				} else if discordErr.Message != "" {
+					r.message += ": " + discordErr.Message
+				}
+			}
+			continue
+		}
+
+		r.expiresAt, _ = urlExpiry(newURL)
+		r.url = newURL
+		if len(r.data.Media) > 0 {
+			r.url = mediaURL(newURL, r.data.Media)
+		}
+	}
+	return results, err
+}
+
+// refreshGranted is refreshBatch for callers holding a channel grant: links
+// to channels it doesn't extend to fail with access_denied without being
+// refreshed.
+func refreshGranted(client *DiscordClient, priority Priority, requester string, grant channelGrant, raws []string) ([]linkRefresh, error) {
+	results := make([]linkRefresh, len(raws))
+	allowed := make([]string, 0, len(raws))
+	var indexes []int
+	for i, raw := range raws {
+		if parsedLink := parseLink(raw); parsedLink.Error == "" {
+			if denial := grant.denial(client, parsedLink.Data.ChannelID); denial != "" {
+				results[i] = linkRefresh{raw: raw, code: codeAccessDenied, message: denial}
+				continue
+			}
+		}
+		allowed = append(allowed, raw)
+		indexes = append(indexes, i)
+	}
+	refreshed, err := refreshBatch(client, priority, requester, allowed)
+	for j, r := range refreshed {
+		results[indexes[j]] = r
+	}
+	return results, err
+}
+
+// refreshWithRetry refreshes one batch at background priority, waiting out
+// rate limits and overloaded queues and retrying other Discord errors with
+// backoff.
+func refreshWithRetry(client *DiscordClient, requester string, raws []string) []linkRefresh {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		results, err := refreshBatch(client, PriorityBackground, requester, raws)
+		if err == nil {
+			return results
+		}
+
+		var overload *OverloadError
+		if errors.As(err, &overload) {
+			time.Sleep(overload.RetryAfter)
+			continue
+		}
+		var discordErr *DiscordError
+		if errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusTooManyRequests {
+			time.Sleep(retryAfter(discordErr))
+			continue
+		}
+		if errors.As(err, &discordErr) && discordErr.StatusCode < 500 {
+			return results
+		}
+		if attempt >= maxRefreshRetries {
+			return results
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,338 @@
+package discordcdn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchMockFileSize is the size of the files the mock upstream serves in
+// proxy mode.
+const benchMockFileSize = 64 << 10
+
+// benchQuantiles are the latency percentiles the bench command reports.
+var benchQuantiles = []struct {
+	name string
+	q    float64
+}{{"p50", 0.5}, {"p90", 0.9}, {"p95", 0.95}, {"p99", 0.99}}
+
+// runBench implements the bench subcommand, which replays a file of
+// attachment paths at a fixed rate and reports the latency of the responses.
+// Requests go to a running instance, or with -mock to an in-process server
+// whose calls to Discord are answered by a mock upstream.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the instance to load")
+	mock := fs.Bool("mock", false, "load an in-process server with a mock Discord upstream instead of -target")
+	mockLatency := fs.Duration("mock-latency", 100*time.Millisecond, "how long the mock upstream takes to answer")
+	rate := fs.Float64("rate", 10, "requests per second")
+	requests := fs.Int("requests", 0, "requests to send, cycling through the paths; defaults to one per path")
+	concurrency := fs.Int("concurrency", 100, "most requests in flight at once")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each request")
+	apiKey := fs.String("api-key", "", "API key sent with every request")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn bench [flags] <paths>")
+		fmt.Fprintln(fs.Output(), "The paths file has one attachment path or URL per line; blank lines and lines starting with # are skipped.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *rate <= 0 || *concurrency < 1 || *requests < 0 {
+		return errors.New("-rate and -concurrency must be positive, and -requests not negative")
+	}
+
+	paths, err := readBenchPaths(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", fs.Arg(0), err)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%s has no paths", fs.Arg(0))
+	}
+	if *requests == 0 {
+		*requests = len(paths)
+	}
+
+	base := strings.TrimSuffix(*target, "/")
+	if *mock {
+		addr, stop, err := startBenchServer(*mockLatency)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		base = "http://" + addr
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		// Redirects point at Discord's CDN, which isn't what is being
+		// measured.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	log.Printf("Sending %d requests to %s at %g per second", *requests, base, *rate)
+	result := replayBench(client, base, *apiKey, paths, *requests, *rate, *concurrency)
+	result.print(os.Stdout)
+	return nil
+}
+
+// readBenchPaths reads the paths to request. Full URLs are reduced to their
+// path and query, so CDN links can be replayed as they are.
+func readBenchPaths(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.Contains(text, "://") {
+			u, err := url.Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			text = u.RequestURI()
+		}
+		if !strings.HasPrefix(text, "/") {
+			text = "/" + text
+		}
+		paths = append(paths, text)
+	}
+	return paths, scanner.Err()
+}
+
+// benchResult collects the outcome of every request sent.
+type benchResult struct {
+	mu        sync.Mutex
+	started   time.Time
+	elapsed   time.Duration
+	latencies []time.Duration
+	statuses  map[int]int
+	// errors counts requests that got no response, by error.
+	errors map[string]int
+}
+
+func (r *benchResult) record(status int, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors[err.Error()]++
+		return
+	}
+	r.statuses[status]++
+	r.latencies = append(r.latencies, latency)
+}
+
+// replayBench sends n requests for paths in turn, starting one every 1/rate
+// seconds. Once concurrency requests are in flight, the next waits for one
+// to finish, so an overloaded target shows up as a lower achieved rate.
+func replayBench(client *http.Client, base, apiKey string, paths []string, n int, rate float64, concurrency int) *benchResult {
+	result := &benchResult{started: time.Now(), statuses: map[int]int{}, errors: map[string]int{}}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			<-ticker.C
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(path string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			req, err := http.NewRequest(http.MethodGet, base+path, nil)
+			if err != nil {
+				result.record(0, 0, err)
+				return
+			}
+			if apiKey != "" {
+				req.Header.Set("X-API-Key", apiKey)
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				result.record(0, 0, err)
+				return
+			}
+			// The latency includes reading the body, as proxied files
+			// would be.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			result.record(resp.StatusCode, time.Since(start), nil)
+		}(paths[i%len(paths)])
+	}
+	wg.Wait()
+	result.elapsed = time.Since(result.started)
+	return result
+}
+
+func (r *benchResult) print(w io.Writer) {
+	sent := len(r.latencies)
+	for _, n := range r.errors {
+		sent += n
+	}
+	fmt.Fprintf(w, "Requests:  %d in %s (%.1f per second)\n", sent, r.elapsed.Round(time.Millisecond), float64(sent)/r.elapsed.Seconds())
+
+	codes := make([]int, 0, len(r.statuses))
+	for code := range r.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	statuses := make([]string, 0, len(codes))
+	for _, code := range codes {
+		statuses = append(statuses, fmt.Sprintf("%d: %d", code, r.statuses[code]))
+	}
+	fmt.Fprintf(w, "Statuses:  %s\n", strings.Join(statuses, ", "))
+	for err, n := range r.errors {
+		fmt.Fprintf(w, "Error:     %s (%d)\n", err, n)
+	}
+
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	var latencies []string
+	for _, q := range benchQuantiles {
+		latencies = append(latencies, fmt.Sprintf("%s %.1fms", q.name, milliseconds(percentile(r.latencies, q.q))))
+	}
+	latencies = append(latencies, fmt.Sprintf("max %.1fms", milliseconds(r.latencies[len(r.latencies)-1])))
+	fmt.Fprintf(w, "Latency:   %s\n", strings.Join(latencies, ", "))
+}
+
+// startBenchServer serves the configured router on a loopback port, with
+// calls to Discord answered by a mock upstream, and returns its address.
+// Persistent data goes to a temporary directory, and rate limits are
+// counted locally, so a run leaves nothing behind.
+func startBenchServer(latency time.Duration) (addr string, stop func(), err error) {
+	if os.Getenv(envPrefix+"TOKEN") == "" && os.Getenv(envPrefix+"TOKEN_FILE") == "" {
+		os.Setenv(envPrefix+"TOKEN", "bench")
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "discord-cdn-bench")
+	if err != nil {
+		return "", nil, err
+	}
+	store, err := OpenStore(filepath.Join(dir, "data.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	discordClient := NewDiscordClient(config.Token)
+	discordClient.SetTransport(benchUpstream{latency: latency})
+	discordClient.SetTokenMap(config.TokenMap)
+	discordClient.SetShards(config.ShardTokens, config.ShardBy)
+	discordClient.SetInteractiveReserve(config.InteractiveReserve)
+	discordClient.SetGlobalLimit(config.DiscordRateLimit)
+	discordClient.SetFallbacks(config.RefreshFallbacks, config.MirrorURL, config.StaleURLCacheSize)
+	transformer := NewTransformer(discordClient, NewByteCache(config.TransformCache))
+
+	requestLogWriter = io.Discard
+	router, _, _ := setupRouter(config, discordClient, store, transformer, nil, newLocalCounter(), nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	server := &http.Server{Handler: router}
+	go server.Serve(listener)
+	return listener.Addr().String(), func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// benchUpstream stands in for Discord: it signs every URL it is asked to
+// refresh, and serves any other request with an empty JSON object from the
+// API or a file of zeros from the CDN, each after latency.
+type benchUpstream struct {
+	latency time.Duration
+}
+
+func (b benchUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	// Like a real transport, give up when the request is canceled.
+	select {
+	case <-time.After(b.latency):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	body := []byte("{}")
+	contentType := "application/json"
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/attachments/refresh-urls"):
+		var in struct {
+			URLs []string `json:"attachment_urls"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+			return nil, fmt.Errorf("mock upstream: %w", err)
+		}
+		now := time.Now()
+		out := RefreshURLsResponse{}
+		out.RefreshedURLs = make([]struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		}, len(in.URLs))
+		for i, u := range in.URLs {
+			out.RefreshedURLs[i].Original = u
+			out.RefreshedURLs[i].Refreshed = fmt.Sprintf("%s?ex=%x&is=%x&hm=%064x", strings.SplitN(u, "?", 2)[0], now.Add(24*time.Hour).Unix(), now.Unix(), i)
+		}
+		body, _ = json.Marshal(out)
+	case !strings.HasPrefix(req.URL.String(), discordAPIHost):
+		body = make([]byte, benchMockFileSize)
+		contentType = "application/octet-stream"
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	length := int64(len(body))
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,43 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// limitBody caps request bodies at limit bytes, so an oversized upload or
+// JSON document can't exhaust memory or disk. Bodies that declare a larger
+// length are refused with 413 before any of them is read; others are cut
+// off at the limit, which handlers report with bodyTooLarge. A zero limit
+// disables the check.
+func limitBody(limit int64) HandlerFunc {
+	return func(c *Context) {
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			respondBodyTooLarge(c, limit)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// bodyTooLarge responds with 413 and returns true if err came from reading
+// past the body limit.
+func bodyTooLarge(c *Context, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	respondBodyTooLarge(c, maxErr.Limit)
+	return true
+}
+
+func respondBodyTooLarge(c *Context, limit int64) {
+	metrics.Count("http.body_too_large", 1, "route:"+c.FullPath())
+	respondError(c, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("Request body exceeds %d bytes", limit))
+}
@@ -0,0 +1,159 @@
+package discordcdn
+
+import (
+	"container/list"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the caches, which tag their metrics.
+const (
+	cacheVariants = "variants"
+	cacheURLs     = "urls"
+	cacheDNS      = "dns"
+)
+
+// recordCacheLookup reports a lookup in the named cache that started at
+// start, and for a hit the age of the entry found.
+func recordCacheLookup(cache string, start time.Time, hit bool, age time.Duration) {
+	tag := "cache:" + cache
+	metrics.Timing("cache.lookup_duration", time.Since(start), tag)
+	if !hit {
+		metrics.Count("cache.misses", 1, tag)
+		return
+	}
+	metrics.Count("cache.hits", 1, tag)
+	metrics.Timing("cache.entry_age", age, tag)
+}
+
+// recordCacheSize reports how many entries the named cache holds and, when
+// known, their size in bytes.
+func recordCacheSize(cache string, entries int, bytes int64) {
+	tag := "cache:" + cache
+	metrics.Gauge("cache.entries", float64(entries), tag)
+	if bytes >= 0 {
+		metrics.Gauge("cache.bytes", float64(bytes), tag)
+	}
+}
+
+// ByteCache is a size-bounded LRU cache of small blobs such as transformed
+// image variants.
+type ByteCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type byteCacheEntry struct {
+	key         string
+	contentType string
+	data        []byte
+	stored      time.Time
+	used        time.Time
+}
+
+func NewByteCache(maxBytes int64) *ByteCache {
+	return &ByteCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (c *ByteCache) Get(key string) ([]byte, string, bool) {
+	start := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		recordCacheLookup(cacheVariants, start, false, 0)
+		return nil, "", false
+	}
+	c.ll.MoveToFront(el)
+	entry := el.Value.(*byteCacheEntry)
+	entry.used = time.Now()
+	recordCacheLookup(cacheVariants, start, true, entry.used.Sub(entry.stored))
+	return entry.data, entry.contentType, true
+}
+
+// Put stores data under key, evicting the least recently used entries until
+// the cache fits within its size limit. Blobs larger than the whole cache are
+// not stored.
+func (c *ByteCache) Put(key, contentType string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+
+	c.items[key] = c.ll.PushFront(&byteCacheEntry{key: key, contentType: contentType, data: data, stored: time.Now(), used: time.Now()})
+	c.size += int64(len(data))
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+		metrics.Count("cache.evictions", 1, "cache:"+cacheVariants)
+	}
+	recordCacheSize(cacheVariants, c.ll.Len(), c.size)
+}
+
+func (c *ByteCache) removeElement(el *list.Element) {
+	entry := el.Value.(*byteCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// Clear removes every entry and returns how many there were.
+func (c *ByteCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	clear(c.items)
+	c.size = 0
+	recordCacheSize(cacheVariants, 0, 0)
+	return n
+}
+
+// Evict removes the entries derived from an attachment, whose keys have its
+// file ID as one of their segments, and returns how many it removed.
+func (c *ByteCache) Evict(fileID int64) int {
+	id := strconv.FormatInt(fileID, 10)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.items {
+		path, _, _ := strings.Cut(key, "?")
+		if slices.Contains(strings.Split(path, "/"), id) {
+			c.removeElement(el)
+			removed++
+		}
+	}
+	recordCacheSize(cacheVariants, c.ll.Len(), c.size)
+	return removed
+}
+
+// Expire removes the entries last used before cutoff and returns how many
+// it removed and their size.
+func (c *ByteCache) Expire(cutoff time.Time) (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Back(); el != nil && el.Value.(*byteCacheEntry).used.Before(cutoff); el = c.ll.Back() {
+		entries++
+		bytes += int64(len(el.Value.(*byteCacheEntry).data))
+		c.removeElement(el)
+	}
+	recordCacheSize(cacheVariants, c.ll.Len(), c.size)
+	return entries, bytes
+}
@@ -0,0 +1,145 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheDumpJSONL writes one JSON object per cache entry and line.
+	cacheDumpJSONL = "jsonl"
+	// cacheDumpLinks writes one link per line, in the format of the
+	// warm-list file.
+	cacheDumpLinks = "links"
+)
+
+// CachedURL is a line of the cache dump.
+type CachedURL struct {
+	// Attachment is the unsigned attachment URL the entry is cached under.
+	Attachment string `json:"attachment"`
+	// URL is the signed URL Discord last returned for it.
+	URL string `json:"url"`
+	// Expires is when URL's signature expires, if it has one.
+	Expires  *time.Time `json:"expires,omitempty"`
+	Stored   time.Time  `json:"stored"`
+	LastUsed time.Time  `json:"lastUsed"`
+	Hits     int        `json:"hits"`
+}
+
+// writeCacheDump writes the URL cache in format, most recently used first.
+// In the links format, URLs whose signature has expired are replaced by the
+// attachment URL, which warm-up refreshes.
+func writeCacheDump(w io.Writer, entries []urlCacheEntry, format string) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	now := time.Now()
+	for _, entry := range entries {
+		var expires *time.Time
+		if expiry, ok := urlExpiry(entry.url); ok {
+			expires = &expiry
+		}
+		var err error
+		if format == cacheDumpLinks {
+			link := entry.url
+			if expires == nil || !now.Before(*expires) {
+				link = entry.key
+			}
+			_, err = fmt.Fprintln(w, link)
+		} else {
+			err = enc.Encode(CachedURL{
+				Attachment: entry.key,
+				URL:        entry.url,
+				Expires:    expires,
+				Stored:     entry.stored,
+				LastUsed:   entry.used,
+				Hits:       entry.hits,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleCacheDump streams the URL cache behind Early Hints and the stale
+// fallback, for offline analysis or as the warm-list of the next start.
+func handleCacheDump(client *DiscordClient) HandlerFunc {
+	return func(c *Context) {
+		format := c.DefaultQuery("format", cacheDumpJSONL)
+		if format != cacheDumpJSONL && format != cacheDumpLinks {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "format must be jsonl or links")
+			return
+		}
+		client.mu.RLock()
+		stale := client.stale
+		client.mu.RUnlock()
+
+		if format == cacheDumpLinks {
+			c.Header("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			c.Header("Content-Type", "application/jsonl; charset=utf-8")
+		}
+		c.Status(http.StatusOK)
+		if err := writeCacheDump(c.Writer, stale.Entries(), format); err != nil {
+			logf(c, slog.LevelError, "Failed to write cache dump: %v", err)
+		}
+	}
+}
+
+// runCacheDump implements the cache-dump subcommand, which fetches the URL
+// cache of a running instance, since it is only held in memory.
+func runCacheDump(args []string) error {
+	fs := flag.NewFlagSet("cache-dump", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the instance, including any base path")
+	apiKey := fs.String("api-key", "", "API key allowed to use the admin routes")
+	format := fs.String("format", cacheDumpJSONL, "output format (jsonl, or links for a warm-list file)")
+	output := fs.String("o", "", "file to write to (default: standard output)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn cache-dump [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*target, "/")+"/admin/cache?format="+*format, nil)
+	if err != nil {
+		return err
+	}
+	if *apiKey != "" {
+		req.Header.Set("X-API-Key", *apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, body.Error)
+		}
+		return errors.New(resp.Status)
+	}
+
+	if *output == "" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
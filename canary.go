@@ -0,0 +1,133 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// canaryTimeout bounds each probe, so a hanging refresh counts as a failure
+// instead of holding up the next one.
+const canaryTimeout = 15 * time.Second
+
+// CanaryStatus is the outcome of the latest canary probe.
+type CanaryStatus struct {
+	// Status is pending until the first probe completes, then ok or error.
+	Status    string     `json:"status"`
+	LatencyMS float64    `json:"latencyMS,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+	// LastSuccess is when a probe last succeeded, to tell how long a failure
+	// has lasted.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Failures    int        `json:"consecutiveFailures"`
+}
+
+// Canary refreshes a known-good attachment every interval, the way a
+// request for it would, so a revoked token or a change on Discord's side
+// shows up in metrics and alerts before users run into it.
+type Canary struct {
+	client   *DiscordClient
+	url      string
+	interval time.Duration
+	alerter  *Alerter
+
+	mu     sync.Mutex
+	status CanaryStatus
+}
+
+func NewCanary(client *DiscordClient, config *Config) *Canary {
+	return &Canary{
+		client:   client,
+		url:      canonicalAttachmentURL(config.CanaryURL),
+		interval: config.CanaryInterval,
+		alerter:  NewAlerter(config),
+		status:   CanaryStatus{Status: "pending"},
+	}
+}
+
+// canonicalAttachmentURL returns the unsigned CDN URL of a link, which
+// config validation has already parsed.
+func canonicalAttachmentURL(link string) string {
+	data := parseLink(link).Data
+	return attachmentURL(data.ChannelID, data.FileID, data.FileName)
+}
+
+// run probes right away and then every interval, for the life of the
+// process.
+func (c *Canary) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.probe()
+		<-ticker.C
+	}
+}
+
+// probe refreshes the canary attachment at interactive priority, like a
+// visitor's request, records the result and alerts when the canary starts
+// failing or recovers.
+func (c *Canary) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), canaryTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := c.client.RefreshAttachmentURL(ctx, "canary", c.url)
+	latency := time.Since(start)
+
+	c.mu.Lock()
+	now := time.Now().UTC()
+	wasFailing := c.status.Status == "error"
+	c.status.CheckedAt = &now
+	c.status.LatencyMS = milliseconds(latency)
+	if err != nil {
+		c.status.Status = "error"
+		c.status.Error = err.Error()
+		c.status.Failures++
+	} else {
+		c.status.Status = "ok"
+		c.status.Error = ""
+		c.status.Failures = 0
+		c.status.LastSuccess = &now
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		logAt(slog.LevelWarn, "Canary refresh of %s failed: %v", c.url, err)
+		metrics.Count("canary.probes", 1, "result:error")
+		metrics.Gauge("canary.up", 0)
+		if !wasFailing {
+			c.alerter.Send(Alert{Event: "canary_failed", Reason: err.Error(), Time: now, Content: fmt.Sprintf("Canary refresh of %s is failing: %v", c.url, err)})
+		}
+		return
+	}
+	metrics.Count("canary.probes", 1, "result:ok")
+	metrics.Timing("canary.latency", latency)
+	metrics.Gauge("canary.up", 1)
+	if wasFailing {
+		c.alerter.Send(Alert{Event: "canary_recovered", Time: now, Content: fmt.Sprintf("Canary refresh of %s is succeeding again", c.url)})
+	}
+}
+
+// Status returns the outcome of the latest probe.
+func (c *Canary) Status() CanaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// handleCanary reports the latest canary probe, answering 503 while it
+// fails. Until the first probe completes, the canary is pending and the
+// endpoint answers 200.
+func handleCanary(canary *Canary) HandlerFunc {
+	return func(c *Context) {
+		status := canary.Status()
+		code := http.StatusOK
+		if status.Status == "error" {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, status)
+	}
+}
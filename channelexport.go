@@ -0,0 +1,280 @@
+package discordcdn
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// channelExportIndex is the last entry of a channel export, describing the
+// attachments before it.
+const channelExportIndex = "index.jsonl"
+
+// ExportedAttachment is a line of a channel export's index.
+type ExportedAttachment struct {
+	IndexedAttachment
+	// Path is the attachment's entry in the archive, empty if it couldn't
+	// be exported.
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// exportEntryName names an attachment's entry in a channel export. The file
+// ID keeps names from different messages apart.
+func exportEntryName(a *IndexedAttachment) string {
+	return fmt.Sprintf("%d-%s", a.FileID, strings.ReplaceAll(a.FileName, "/", "_"))
+}
+
+// writeChannelExport streams attachments as a tar archive, oldest first,
+// followed by channelExportIndex. URLs are refreshed a batch at a time at
+// background priority, right before the batch is downloaded, so a long
+// export neither outruns the rate limit left to interactive traffic nor
+// holds URLs long enough for them to expire. Attachments that can't be
+// refreshed or downloaded are left out and listed in the index with the
+// error; one failing midway ends the archive.
+func writeChannelExport(c *Context, client *DiscordClient, w io.Writer, attachments []IndexedAttachment) error {
+	archive := tar.NewWriter(w)
+	index := make([]ExportedAttachment, len(attachments))
+	for start := 0; start < len(attachments); start += refreshBatchSize {
+		if err := c.Request.Context().Err(); err != nil {
+			return err
+		}
+		batch := attachments[start:min(start+refreshBatchSize, len(attachments))]
+		raws := make([]string, len(batch))
+		for i := range batch {
+			raws[i] = attachmentURL(batch[i].ChannelID, batch[i].FileID, batch[i].FileName)
+		}
+
+		for i, r := range refreshWithRetry(client, "export", raws) {
+			exported := &index[start+i]
+			exported.IndexedAttachment = batch[i]
+			if r.failed() {
+				exported.Error = r.message
+				continue
+			}
+			entry := exportEntryName(&batch[i])
+			written, err := writeExportEntry(c, client, archive, entry, r.url, &batch[i])
+			if written {
+				exported.Path = entry
+			}
+			if err != nil && written {
+				return fmt.Errorf("failed to export %s: %w", entry, err)
+			}
+			if err != nil {
+				logf(c, slog.LevelWarn, "Left %s out of the export: %v", entry, err)
+				exported.Error = err.Error()
+			}
+		}
+	}
+
+	var lines strings.Builder
+	enc := json.NewEncoder(&lines)
+	enc.SetEscapeHTML(false)
+	for i := range index {
+		if err := enc.Encode(&index[i]); err != nil {
+			return err
+		}
+	}
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    channelExportIndex,
+		Mode:    0o644,
+		Size:    int64(lines.Len()),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(archive, lines.String()); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeExportEntry downloads an attachment into the next entry of archive,
+// reporting whether the entry was started, after which a failure can't be
+// undone.
+func writeExportEntry(c *Context, client *DiscordClient, archive *tar.Writer, entry, target string, a *IndexedAttachment) (bool, error) {
+	resp, err := client.Download(c.Request.Context(), target, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	// Tar headers carry the size up front.
+	size := responseSize(resp)
+	if size < 0 {
+		size = a.Size
+	}
+
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    entry,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: a.CreatedAt,
+	}); err != nil {
+		return true, err
+	}
+	n, err := io.Copy(archive, io.LimitReader(resp.Body, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return true, err
+}
+
+// handleChannelExport streams the indexed attachments of a channel, posted
+// between ?after and ?before if given, as a tar archive.
+func handleChannelExport(client *DiscordClient, store *Store) HandlerFunc {
+	return func(c *Context) {
+		channelID, err := strconv.ParseInt(c.Param("channelID"), 10, 64)
+		if err != nil || !validSnowflake(channelID) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid channel ID")
+			return
+		}
+		filter := attachmentFilter{channelID: channelID}
+		if v := c.Query("after"); v != "" {
+			if filter.after, err = time.Parse(time.RFC3339, v); err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "After must be an RFC 3339 timestamp")
+				return
+			}
+		}
+		if v := c.Query("before"); v != "" {
+			if filter.before, err = time.Parse(time.RFC3339, v); err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Before must be an RFC 3339 timestamp")
+				return
+			}
+		}
+
+		attachments := store.FindAttachments(filter.match)
+		if len(attachments) == 0 {
+			respondError(c, http.StatusNotFound, codeNotFound, "No indexed attachments in this channel")
+			return
+		}
+		sort.Slice(attachments, func(i, j int) bool {
+			if !attachments[i].CreatedAt.Equal(attachments[j].CreatedAt) {
+				return attachments[i].CreatedAt.Before(attachments[j].CreatedAt)
+			}
+			return attachments[i].FileID < attachments[j].FileID
+		})
+
+		name := fmt.Sprintf("channel-%d.tar", channelID)
+		c.Header("Content-Type", "application/x-tar")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		c.Status(http.StatusOK)
+		start := time.Now()
+		if err := writeChannelExport(c, client, c.Writer, attachments); err != nil {
+			logf(c, slog.LevelError, "Aborted export of channel %d: %v", channelID, err)
+			c.Abort()
+			return
+		}
+		logf(c, slog.LevelInfo, "Exported %d attachments of channel %d in %s", len(attachments), channelID, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// runChannelExport implements the channel-export subcommand, which saves the
+// export of a channel from a running instance, whose rate limits it shares.
+func runChannelExport(args []string) error {
+	fs := flag.NewFlagSet("channel-export", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the instance, including any base path")
+	apiKey := fs.String("api-key", "", "API key allowed to use the API")
+	after := fs.String("after", "", "only export attachments posted after this RFC 3339 time")
+	before := fs.String("before", "", "only export attachments posted before this RFC 3339 time")
+	output := fs.String("o", "", "file to write to (default: channel-<id>.tar)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn channel-export [flags] <channel ID>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	if *after != "" {
+		query.Set("after", *after)
+	}
+	if *before != "" {
+		query.Set("before", *before)
+	}
+	endpoint := fmt.Sprintf("%s/api/channels/%s/export", strings.TrimSuffix(*target, "/"), url.PathEscape(fs.Arg(0)))
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if *apiKey != "" {
+		req.Header.Set("X-API-Key", *apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, body.Error)
+		}
+		return errors.New(resp.Status)
+	}
+
+	path := *output
+	if path == "" {
+		path = "channel-" + fs.Arg(0) + ".tar"
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// The archive is read as it is saved, since an export that failed
+	// midway still ends in a 200, just without its index.
+	entries, complete, err := readChannelExport(io.TeeReader(resp.Body, file))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !complete {
+		return fmt.Errorf("export of %d attachments to %s was cut short; see the server log", entries, path)
+	}
+	fmt.Printf("Exported %d attachments to %s\n", entries, path)
+	return nil
+}
+
+// readChannelExport reads a channel export to its end, counting the
+// attachments in it and reporting whether it ends with its index.
+func readChannelExport(r io.Reader) (int, bool, error) {
+	archive := tar.NewReader(r)
+	entries, complete := 0, false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries, complete, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return entries, false, nil
+		}
+		if err != nil {
+			return entries, false, err
+		}
+		if complete = header.Name == channelExportIndex; !complete {
+			entries++
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// channelLimiterKey holds the *ChannelLimiter for handlers that serve
+// attachments.
+const channelLimiterKey = "channelLimiter"
+
+// ChannelLimit caps the requests per minute and the bandwidth in bytes per
+// second of one channel's attachments. Zero leaves a cap off.
+type ChannelLimit struct {
+	ChannelID int64
+	Requests  int64
+	Bandwidth int64
+}
+
+// parseChannelLimits parses a comma-separated list of
+// <channel ID>:<requests per minute>:<bytes per second> entries.
+func parseChannelLimits(raw string) ([]ChannelLimit, error) {
+	var limits []ChannelLimit
+	for _, entry := range splitList(raw) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("entry %q must look like <channel ID>:<requests>:<bandwidth>", entry)
+		}
+		var values [3]int64
+		for i, part := range parts {
+			v, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("entry %q has an invalid number %q", entry, part)
+			}
+			values[i] = v
+		}
+		if values[0] == 0 {
+			return nil, errors.New("channel ID must not be 0")
+		}
+		limits = append(limits, ChannelLimit{ChannelID: values[0], Requests: values[1], Bandwidth: values[2]})
+	}
+	return limits, nil
+}
+
+// ChannelLimiter caps requests and bandwidth per channel, so one channel's
+// hotlinked attachments can't use up the Discord API budget and bandwidth
+// shared by every channel the instance serves. Requests are counted with
+// the shared RequestCounter, bandwidth per replica.
+type ChannelLimiter struct {
+	counter RequestCounter
+	failing atomic.Bool
+
+	mu        sync.Mutex
+	defaults  ChannelLimit
+	overrides map[int64]ChannelLimit
+	bandwidth map[int64]*ipLimiter
+}
+
+func NewChannelLimiter(counter RequestCounter, requests, bandwidth int64, overrides []ChannelLimit) *ChannelLimiter {
+	l := &ChannelLimiter{counter: counter, bandwidth: map[int64]*ipLimiter{}}
+	l.SetLimits(requests, bandwidth, overrides)
+	go l.cleanup()
+	return l
+}
+
+// SetLimits replaces the default caps and the per-channel overrides.
+// Bandwidth caps also apply to transfers already in progress.
+func (l *ChannelLimiter) SetLimits(requests, bandwidth int64, overrides []ChannelLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.defaults = ChannelLimit{Requests: requests, Bandwidth: bandwidth}
+	l.overrides = make(map[int64]ChannelLimit, len(overrides))
+	for _, o := range overrides {
+		l.overrides[o.ChannelID] = o
+	}
+	for channelID, entry := range l.bandwidth {
+		l.setBandwidth(channelID, entry, l.limitFor(channelID).Bandwidth)
+	}
+}
+
+// limitFor returns the caps of a channel. Callers must hold the lock.
+func (l *ChannelLimiter) limitFor(channelID int64) ChannelLimit {
+	if o, ok := l.overrides[channelID]; ok {
+		return o
+	}
+	return l.defaults
+}
+
+// setBandwidth applies a new cap to a channel's limiter. Callers must hold
+// the lock.
+func (l *ChannelLimiter) setBandwidth(channelID int64, entry *ipLimiter, limit int64) {
+	if limit == 0 {
+		// A zero rate.Limit blocks forever, so release transfers that are
+		// still holding the old limiter and forget it.
+		entry.limiter.SetLimit(rate.Inf)
+		entry.limiter.SetBurst(math.MaxInt)
+		delete(l.bandwidth, channelID)
+		return
+	}
+	entry.limiter.SetLimit(rate.Limit(limit))
+	entry.limiter.SetBurst(bandwidthBurst(limit))
+}
+
+// get returns the caps of a channel and its shared bandwidth limiter, which
+// is nil when its bandwidth is unlimited.
+func (l *ChannelLimiter) get(channelID int64) (ChannelLimit, *rate.Limiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limitFor(channelID)
+	if limit.Bandwidth == 0 {
+		return limit, nil
+	}
+	entry, ok := l.bandwidth[channelID]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(limit.Bandwidth), bandwidthBurst(limit.Bandwidth))}
+		l.bandwidth[channelID] = entry
+	}
+	entry.lastSeen = time.Now()
+	return limit, entry.limiter
+}
+
+func (l *ChannelLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for channelID, entry := range l.bandwidth {
+			if time.Since(entry.lastSeen) > limiterIdleTimeout {
+				delete(l.bandwidth, channelID)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limitChannels makes the limiter available to the handlers that serve
+// attachments, which apply it with limitChannel once the channel is known.
+func limitChannels(l *ChannelLimiter) HandlerFunc {
+	return func(c *Context) {
+		c.Set(channelLimiterKey, l)
+		c.Next()
+	}
+}
+
+// limitChannel counts the request against its channel's caps and throttles
+// the response to the channel's bandwidth. It reports false, having written
+// a 429, when the channel is over its request cap.
+func limitChannel(c *Context, channelID int64) bool {
+	value, ok := c.Get(channelLimiterKey)
+	if !ok {
+		return true
+	}
+	l := value.(*ChannelLimiter)
+
+	limit, limiter := l.get(channelID)
+	if !allowRequest(c, l.counter, "channel", strconv.FormatInt(channelID, 10), limit.Requests, &l.failing, false) {
+		return false
+	}
+	if limiter != nil {
+		c.Writer = &throttledWriter{ResponseWriter: c.Writer, ctx: c.Request.Context(), limiters: []*rate.Limiter{limiter}}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package discordcdn
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errChecksumTooLarge is returned for attachments past the size limit.
+var errChecksumTooLarge = errors.New("attachment is too large to checksum")
+
+// Checksum is the digest of an attachment's content.
+type Checksum struct {
+	FileID     int64     `json:"fileID"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	MD5        string    `json:"md5"`
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+// checksumCall is a computation in flight, shared by every request for the
+// same attachment.
+type checksumCall struct {
+	done chan struct{}
+	sum  *Checksum
+	err  error
+}
+
+// Checksummer computes the checksums of attachments by streaming them
+// through the hashes, and records them in the store for good, since the
+// content behind a file ID never changes.
+type Checksummer struct {
+	client  *DiscordClient
+	store   *Store
+	maxSize int64
+	// timeout bounds a computation, which no request waits on to the end.
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[int64]*checksumCall
+}
+
+func NewChecksummer(client *DiscordClient, store *Store, maxSize int64, timeout time.Duration) *Checksummer {
+	return &Checksummer{
+		client:  client,
+		store:   store,
+		maxSize: maxSize,
+		timeout: timeout,
+		pending: map[int64]*checksumCall{},
+	}
+}
+
+// Sum returns the checksum of an attachment, and whether it was recorded
+// already. Requests for an attachment being hashed wait for the same
+// computation. A computation outlives the request that started it, so when
+// a large file runs past the request's deadline, asking again later finds
+// the result, unless it runs past the Checksummer's timeout too. Failed
+// computations aren't kept, so the next request starts over.
+func (k *Checksummer) Sum(ctx context.Context, requester string, data *LinkData) (*Checksum, bool, error) {
+	if sum, ok := k.store.Checksum(data.FileID); ok {
+		return sum, true, nil
+	}
+
+	k.mu.Lock()
+	call, ok := k.pending[data.FileID]
+	if !ok {
+		call = &checksumCall{done: make(chan struct{})}
+		k.pending[data.FileID] = call
+		go func() {
+			defer func() {
+				k.mu.Lock()
+				delete(k.pending, data.FileID)
+				k.mu.Unlock()
+				close(call.done)
+			}()
+			call.sum, call.err = k.compute(requester, data)
+		}()
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.sum, false, call.err
+	case <-ctx.Done():
+		return nil, false, context.Cause(ctx)
+	}
+}
+
+func (k *Checksummer) compute(requester string, data *LinkData) (*Checksum, error) {
+	ctx := context.Background()
+	if k.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.timeout)
+		defer cancel()
+	}
+	newURL, err := k.client.RefreshAttachmentURL(ctx, requester, attachmentURL(data.ChannelID, data.FileID, data.FileName))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Download(ctx, newURL, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errAttachmentNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	if k.maxSize > 0 && responseSize(resp) > k.maxSize {
+		return nil, errChecksumTooLarge
+	}
+
+	sha, md := sha256.New(), md5.New()
+	var src io.Reader = resp.Body
+	if k.maxSize > 0 {
+		src = io.LimitReader(resp.Body, k.maxSize+1)
+	}
+	start := time.Now()
+	size, err := io.Copy(io.MultiWriter(sha, md), src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if k.maxSize > 0 && size > k.maxSize {
+		return nil, errChecksumTooLarge
+	}
+
+	sum := &Checksum{
+		FileID:     data.FileID,
+		Size:       size,
+		SHA256:     hex.EncodeToString(sha.Sum(nil)),
+		MD5:        hex.EncodeToString(md.Sum(nil)),
+		ComputedAt: time.Now().UTC(),
+	}
+	logAt(slog.LevelDebug, "Hashed %d bytes of %s in %s", size, data.Path(), time.Since(start).Round(time.Millisecond))
+	if err := k.store.AddChecksum(sum); err != nil {
+		logAt(slog.LevelError, "Failed to save checksum of %s: %v", data.Path(), err)
+	}
+	return sum, nil
+}
+
+func handleChecksum(client *DiscordClient, checksums *Checksummer) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+		if !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+		// Recorded checksums skip Discord, so the allowlist is checked here
+		// rather than by the refresh.
+		if !client.allowsChannel(data.ChannelID) {
+			respondError(c, http.StatusNotFound, codeAttachmentNotFound, "Attachment not found")
+			return
+		}
+
+		sum, cached, err := checksums.Sum(c.Request.Context(), requesterOf(c), data)
+		c.Set(refreshedKey, err == nil)
+		if errors.Is(err, errChecksumTooLarge) {
+			respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Attachment is too large to checksum")
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			respondTimeout(c)
+			return
+		}
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, H{
+			"size":       sum.Size,
+			"sha256":     sum.SHA256,
+			"md5":        sum.MD5,
+			"computedAt": sum.ComputedAt,
+			"cached":     cached,
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBatchSize is how many links the server refreshes per GraphQL
+	// query; larger batches are split.
+	maxBatchSize = 1000
+	// maxJobPage is the most job results the server returns per page.
+	maxJobPage = 10000
+)
+
+// linkPath turns a link, in any form the server accepts, into a path.
+func linkPath(link string) string {
+	return "/" + strings.TrimPrefix(link, "/")
+}
+
+// Refresh returns a freshly signed URL for link, which can be a CDN URL or
+// any other form the server accepts. It reads the server's redirect, so it
+// doesn't work against servers in proxy mode; use RefreshBatch for those.
+func (c *Client) Refresh(ctx context.Context, link string) (string, error) {
+	noRedirects := *c.httpClient()
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := c.do(ctx, &noRedirects, http.MethodGet, linkPath(link), nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", decodeError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("discord-cdn: expected a redirect, got %d", resp.StatusCode)
+	}
+	return location, nil
+}
+
+// Share returns a share link to link and when it expires, which is after
+// ttl, or after the server's default when ttl is zero. The server must be
+// configured with a share secret.
+func (c *Client) Share(ctx context.Context, link string, ttl time.Duration) (string, time.Time, error) {
+	in := map[string]interface{}{"url": link}
+	if ttl > 0 {
+		in["expiresIn"] = ttl.String()
+	}
+	var resp struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := c.call(ctx, http.MethodPost, "/api/share", in, &resp); err != nil {
+		return "", time.Time{}, err
+	}
+	return resp.URL, resp.ExpiresAt, nil
+}
+
+// RefreshResult is the outcome of refreshing one link in a batch. Links
+// that failed have an Error instead of a RefreshedURL.
+type RefreshResult struct {
+	URL          string     `json:"url"`
+	RefreshedURL string     `json:"refreshedURL,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	FileName     string     `json:"fileName,omitempty"`
+	Error        *Error     `json:"-"`
+}
+
+// RefreshBatch refreshes links over the GraphQL API, returning one result
+// per link in the same order. Links that fail don't fail the batch; their
+// results carry the error instead.
+func (c *Client) RefreshBatch(ctx context.Context, links []string) ([]RefreshResult, error) {
+	const query = `query($urls: [String!]!) { refresh(urls: $urls) { url refreshedURL expiresAt fileName error { code message } } }`
+	results := make([]RefreshResult, 0, len(links))
+	for start := 0; start < len(links); start += maxBatchSize {
+		batch := links[start:min(start+maxBatchSize, len(links))]
+		var resp struct {
+			Data struct {
+				Refresh []struct {
+					RefreshResult
+					Error *struct {
+						Code    string `json:"code"`
+						Message string `json:"message"`
+					} `json:"error"`
+				} `json:"refresh"`
+			} `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		in := map[string]interface{}{"query": query, "variables": map[string]interface{}{"urls": batch}}
+		if err := c.call(ctx, http.MethodPost, "/graphql", in, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("discord-cdn: GraphQL error: %s", resp.Errors[0].Message)
+		}
+		for _, r := range resp.Data.Refresh {
+			result := r.RefreshResult
+			if r.Error != nil {
+				result.Error = &Error{Code: r.Error.Code, Message: r.Error.Message}
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// Metadata describes an attachment behind a freshly signed URL.
+type Metadata struct {
+	ContentType string `json:"contentType,omitempty"`
+	// ContentLength is nil when the CDN doesn't report a size.
+	ContentLength *int64     `json:"contentLength,omitempty"`
+	URL           string     `json:"url"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Metadata refreshes link and returns the attachment's type and size.
+func (c *Client) Metadata(ctx context.Context, link string) (*Metadata, error) {
+	var metadata Metadata
+	if err := c.call(ctx, http.MethodGet, "/api/metadata"+linkPath(link), nil, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// Attachment states returned by Exists.
+const (
+	StateAlive     = "alive"
+	StateDeleted   = "deleted"
+	StateForbidden = "forbidden"
+)
+
+// Exists reports whether the attachment behind link still exists. The state
+// tells a deleted attachment from one no token of the server can see.
+func (c *Client) Exists(ctx context.Context, link string) (exists bool, state string, err error) {
+	var resp struct {
+		Exists bool   `json:"exists"`
+		Status string `json:"status"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/api/exists"+linkPath(link), nil, &resp); err != nil {
+		return false, "", err
+	}
+	return resp.Exists, resp.Status, nil
+}
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// JobResult is the outcome of one link of a refresh job.
+type JobResult struct {
+	URL          string     `json:"url"`
+	RefreshedURL string     `json:"refreshedURL,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	ErrorCode    string     `json:"errorCode,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Job is the state of a refresh job, with a page of its results.
+type Job struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Failed     int        `json:"failed"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Callback is the delivery state of the job's callback, if it has one:
+	// pending, delivered or failed.
+	Callback string      `json:"callback,omitempty"`
+	Results  []JobResult `json:"results"`
+	// NextOffset is the offset of the next page of results, or nil on the
+	// last page.
+	NextOffset *int `json:"nextOffset,omitempty"`
+}
+
+// SubmitJob queues a background refresh of links and returns the job's ID.
+// When too many jobs are queued, it is retried after the server's
+// Retry-After.
+func (c *Client) SubmitJob(ctx context.Context, links []string) (string, error) {
+	return c.SubmitJobWithCallback(ctx, links, "")
+}
+
+// SubmitJobWithCallback queues a background refresh of links like SubmitJob,
+// and has the server post the job with all of its results to callbackURL
+// once it is done; see VerifyCallback.
+func (c *Client) SubmitJobWithCallback(ctx context.Context, links []string, callbackURL string) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	in := map[string]interface{}{"urls": links}
+	if callbackURL != "" {
+		in["callbackURL"] = callbackURL
+	}
+	if err := c.call(ctx, http.MethodPost, "/jobs/refresh", in, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// VerifyCallback reports whether body, as posted to a job's callback URL,
+// carries the X-Signature-256 header signature made with the server's
+// callback secret.
+func VerifyCallback(body []byte, signature, secret string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte(signature), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+}
+
+// Job returns the state of a job with up to limit of its results, starting
+// at offset. A zero limit uses the server's default.
+func (c *Client) Job(ctx context.Context, id string, offset, limit int) (*Job, error) {
+	query := url.Values{"offset": {fmt.Sprint(offset)}}
+	if limit > 0 {
+		query.Set("limit", fmt.Sprint(limit))
+	}
+	var job Job
+	if err := c.call(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"?"+query.Encode(), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls a job every interval until it is done, then returns it with
+// all of its results.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.Job(ctx, id, 0, maxJobPage)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == JobDone {
+			for job.NextOffset != nil {
+				page, err := c.Job(ctx, id, *job.NextOffset, maxJobPage)
+				if err != nil {
+					return nil, err
+				}
+				if len(page.Results) == 0 {
+					return nil, errors.New("discord-cdn: job results ended early")
+				}
+				job.Results = append(job.Results, page.Results...)
+				job.NextOffset = page.NextOffset
+			}
+			return job, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package client is a Go client for the discord-cdn HTTP API: refreshing
+// links one at a time or in batches, refresh jobs, and attachment metadata.
+// Calls that fail because the server or Discord is overloaded are retried
+// with backoff, and error responses are returned as *Error.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	// defaultRetryDelay is the first backoff delay, doubled on every retry
+	// up to maxRetryDelay.
+	defaultRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 30 * time.Second
+)
+
+// Error codes the server returns in Error.Code.
+const (
+	CodeAccessDenied        = "access_denied"
+	CodeAliasTaken          = "alias_taken"
+	CodeAttachmentForbidden = "attachment_forbidden"
+	CodeAttachmentNotFound  = "attachment_not_found"
+	CodeAttachmentTooLarge  = "attachment_too_large"
+	CodeBodyTooLarge        = "body_too_large"
+	CodeContentBlocked      = "content_blocked"
+	CodeCrawlerBlocked      = "crawler_blocked"
+	CodeHotlinkBlocked      = "hotlink_blocked"
+	CodeInternal            = "internal_error"
+	CodeInvalidLink         = "invalid_link"
+	CodeInvalidParameter    = "invalid_parameter"
+	CodeMalwareDetected     = "malware_detected"
+	CodeModerationFailed    = "moderation_failed"
+	CodeNotFound            = "not_found"
+	CodeOverloaded          = "overloaded"
+	CodeQuotaExceeded       = "quota_exceeded"
+	CodeRateLimited         = "rate_limited"
+	CodeRequestTimeout      = "request_timeout"
+	CodeScanFailed          = "scan_failed"
+	CodeShareExpired        = "share_expired"
+	CodeShareUsed           = "share_used"
+	CodeTooManyJobs         = "too_many_jobs"
+	CodeUnauthorized        = "unauthorized"
+	CodeUpstreamError       = "upstream_error"
+	CodeUpstreamRateLimited = "upstream_rate_limited"
+)
+
+// Error is an error response from the server, or the error of one link in
+// a batch, which has no status code.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+	// RetryAfter is how long the server asked to wait before trying again,
+	// if it said.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("discord-cdn: %s: %s", e.Code, e.Message)
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("discord-cdn: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// ErrorCode returns the server's error code for err, or "" if err isn't an
+// error response.
+func ErrorCode(err error) string {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// Client calls a discord-cdn server. Its fields may be changed before first
+// use.
+type Client struct {
+	// BaseURL is the server's address, such as https://cdn.example.com.
+	BaseURL string
+	// APIKey is sent as X-API-Key when set.
+	APIKey     string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a failed call is retried; 0 disables
+	// retries.
+	MaxRetries int
+	// RetryDelay is the first backoff delay, doubled on every retry.
+	RetryDelay time.Duration
+}
+
+// New returns a client for the server at baseURL, authenticating with
+// apiKey if it isn't empty.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: defaultTimeout},
+		MaxRetries: defaultMaxRetries,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// retryable reports whether a response with status is worth retrying. Calls
+// that aren't idempotent are only retried when the server turned them away
+// before doing anything.
+func retryable(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// do sends a request, retrying with backoff when the server is overloaded
+// or, for idempotent calls, unreachable. The response is returned whatever
+// its status, once retries run out.
+func (c *Client) do(ctx context.Context, httpClient *http.Client, method, path string, body []byte, idempotent bool) (*http.Response, error) {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.APIKey != "" {
+			req.Header.Set("X-API-Key", c.APIKey)
+		}
+
+		resp, err := httpClient.Do(req)
+		if attempt >= c.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := delay
+		switch {
+		case err != nil:
+			if !idempotent {
+				return nil, err
+			}
+		case retryable(resp.StatusCode, idempotent):
+			if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > 0 {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		select {
+		case <-time.After(min(wait, maxRetryDelay)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// call sends a request with an optional JSON body and decodes the JSON
+// response into out, turning error responses into *Error.
+func (c *Client) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := c.do(ctx, c.httpClient(), method, path, body, method == http.MethodGet)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("discord-cdn: failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// decodeError reads the error envelope of resp. Responses that don't carry
+// one, such as from a proxy in front of the server, keep their status.
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    http.StatusText(resp.StatusCode),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	var envelope struct {
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		RequestID string `json:"requestID"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err == nil && envelope.Code != "" {
+		apiErr.Code, apiErr.Message, apiErr.RequestID = envelope.Code, envelope.Error, envelope.RequestID
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
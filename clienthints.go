@@ -0,0 +1,56 @@
+package discordcdn
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// acceptClientHints is the Accept-CH header asking browsers for the hints
+// images are sized by. Browsers only honor it on documents, so it is sent
+// with previews and galleries as well as images.
+const acceptClientHints = "Sec-CH-DPR, Sec-CH-Width"
+
+// clientHintStep is what widths from client hints are rounded up to a
+// multiple of, so layouts a few pixels apart share a variant.
+const clientHintStep = 100
+
+// maxClientHintDPR bounds the device pixel ratio honored; no screen needs
+// more.
+const maxClientHintDPR = 4
+
+// hintedExtensions are the images sized by client hints with
+// DCDN_CLIENT_HINTS. GIFs are left alone, since transforms only keep their
+// first frame.
+var hintedExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".avif"}
+
+// applyClientHints sizes an image by the client's hints. Sec-CH-Width, the
+// width the image is laid out at in device pixels, is used when the query
+// sets no size; otherwise Sec-CH-DPR scales the size it sets, taken to be
+// in CSS pixels.
+func applyClientHints(header http.Header, transform *TransformOptions) *TransformOptions {
+	if transform != nil && (transform.Width > 0 || transform.Height > 0) {
+		dpr, err := strconv.ParseFloat(header.Get("Sec-CH-DPR"), 64)
+		if err != nil || dpr <= 1 {
+			return transform
+		}
+		dpr = min(dpr, maxClientHintDPR)
+		scaled := *transform
+		for _, n := range []*int{&scaled.Width, &scaled.Height} {
+			if *n > 0 {
+				*n = min(maxTransformDimension, int(math.Ceil(float64(*n)*dpr)))
+			}
+		}
+		return &scaled
+	}
+
+	width, err := strconv.Atoi(header.Get("Sec-CH-Width"))
+	if err != nil || width <= 0 {
+		return transform
+	}
+	if transform == nil {
+		transform = &TransformOptions{}
+	}
+	transform.Width = min(maxTransformDimension, (width+clientHintStep-1)/clientHintStep*clientHintStep)
+	return transform
+}
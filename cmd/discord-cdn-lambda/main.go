@@ -0,0 +1,9 @@
+// Command discord-cdn-lambda serves Discord attachments through permanent
+// links as an AWS Lambda function on a custom runtime, built as bootstrap.
+package main
+
+import discordcdn "github.com/rexdotsh/discord-cdn"
+
+func main() {
+	discordcdn.RunLambda()
+}
@@ -0,0 +1,8 @@
+// Command discord-cdn serves Discord attachments through permanent links.
+package main
+
+import discordcdn "github.com/rexdotsh/discord-cdn"
+
+func main() {
+	discordcdn.Main()
+}
@@ -0,0 +1,80 @@
+package discordcdn
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the best supported content coding from an
+// Accept-Encoding header, preferring brotli over gzip. It returns "" when
+// the response should be sent as is.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		if (coding != "br" && coding != "gzip") || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && coding == "br") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter wraps w in an encoder for the given content coding.
+func compressWriter(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == "br" {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+	return gzip.NewWriter(w)
+}
+
+// shouldCompress reports whether an upstream response can be compressed on
+// the fly: complete, not already encoded, and of a compressible type.
+func shouldCompress(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Content-Encoding") == "" &&
+		isCompressible(resp.Header.Get("Content-Type"))
+}
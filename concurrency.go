@@ -0,0 +1,158 @@
+package discordcdn
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// initialConcurrency is the limit calls to Discord start out with,
+	// before any latency has been observed.
+	initialConcurrency = 16
+	// latencyTolerance is how much slower than the baseline a call may be
+	// before it is taken as a sign of too much parallelism.
+	latencyTolerance = 2
+	// concurrencyBackoff is what the limit is multiplied by when calls slow
+	// down or fail.
+	concurrencyBackoff = 0.9
+	// baselineWindow is how often the baseline latency is measured anew, so
+	// it follows Discord getting slower or faster over the day.
+	baselineWindow = time.Minute
+)
+
+// ConcurrencyLimiter bounds how many calls to Discord are in flight, finding
+// the limit as it goes rather than relying on a fixed one: while calls stay
+// close to the fastest latency seen recently, the limit grows by about one
+// call per round trip, and when they slow down or fail it shrinks by a tenth,
+// as TCP does with its congestion window.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	max      float64
+	inflight int
+	// waiters are the calls waiting for a slot, in arrival order.
+	waiters []chan struct{}
+	// baseline is the lowest latency of the last window, and windowMin the
+	// lowest of the current one.
+	baseline     time.Duration
+	windowMin    time.Duration
+	windowStart  time.Time
+	lastDecrease time.Time
+}
+
+// NewConcurrencyLimiter creates a limiter that lets at most ceiling calls run
+// at once.
+func NewConcurrencyLimiter(ceiling int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limit:       float64(min(initialConcurrency, ceiling)),
+		max:         float64(ceiling),
+		windowStart: time.Now(),
+	}
+}
+
+// acquire waits for a slot, giving up with ctx's error once ctx is done, or
+// with an OverloadError once it has waited maxWait, unless that is zero.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, maxWait time.Duration) error {
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.inflight < int(l.limit) {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-ready:
+		metrics.Timing("discord.concurrency_wait", time.Since(start))
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i := slices.Index(l.waiters, ready); i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+	} else {
+		// The slot was handed over just as waiting ended; pass it on.
+		l.inflight--
+		l.wake()
+	}
+	if err == nil {
+		// The calls waiting are let through a limit's worth per round trip.
+		err = newOverloadError(queueConcurrency, l.baseline*time.Duration(len(l.waiters)/max(int(l.limit), 1)+1))
+	}
+	return err
+}
+
+// release frees a slot taken by a call that took latency, adjusting the
+// limit unless the call was abandoned and says nothing about Discord.
+func (l *ConcurrencyLimiter) release(latency time.Duration, failed, abandoned bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if !abandoned {
+		l.adjust(latency, failed)
+	}
+	l.wake()
+}
+
+func (l *ConcurrencyLimiter) adjust(latency time.Duration, failed bool) {
+	now := time.Now()
+	if l.windowMin == 0 || latency < l.windowMin {
+		l.windowMin = latency
+	}
+	if l.baseline == 0 {
+		l.baseline = latency
+	}
+	if now.Sub(l.windowStart) >= baselineWindow {
+		l.baseline, l.windowMin, l.windowStart = l.windowMin, 0, now
+	}
+
+	previous := l.limit
+	switch {
+	case failed || latency > l.baseline*latencyTolerance:
+		// Calls already in flight when the limit was cut finish slow too,
+		// so the limit is cut at most once per round trip.
+		if now.Sub(l.lastDecrease) >= l.baseline {
+			l.limit = max(l.limit*concurrencyBackoff, 1)
+			l.lastDecrease = now
+		}
+	case float64(l.inflight+1) >= l.limit/2:
+		// Only grow a limit that is being used, or it grows without bound
+		// while traffic is light.
+		l.limit = min(l.limit+1/l.limit, l.max)
+	}
+	if int(l.limit) != int(previous) {
+		metrics.Gauge("discord.concurrency_limit", float64(int(l.limit)))
+	}
+}
+
+// wake hands free slots to the calls waiting longest.
+func (l *ConcurrencyLimiter) wake() {
+	for len(l.waiters) > 0 && l.inflight < int(l.limit) {
+		l.inflight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// Limit returns the current limit and how many calls are in flight.
+func (l *ConcurrencyLimiter) Limit() (limit, inflight int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit), l.inflight
+}
@@ -0,0 +1,975 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+)
+
+// envPrefix namespaces every configuration variable. Unprefixed names are
+// still read as a fallback so existing deployments keep working.
+const envPrefix = "DCDN_"
+
+type Config struct {
+	Token                  string
+	VaultRenewInterval     time.Duration
+	TokenFile              string
+	Port                   int
+	Listen                 []string
+	AdminListen            []string
+	AdminToken             string
+	AdminKeys              []string
+	GRPCListen             []string
+	TLSCert                string
+	TLSKey                 string
+	ClientCA               string
+	RequireClientCert      bool
+	ClientCertNames        []string
+	RequestTimeout         time.Duration
+	ShutdownTimeout        time.Duration
+	PublicURL              string
+	BasePath               string
+	DataPath               string
+	DatabaseURL            string
+	StoreAutoMigrate       bool
+	LogLevel               string
+	LogFormat              string
+	Retention              time.Duration
+	JanitorInterval        time.Duration
+	APIKeys                []string
+	UploadChannelID        int64
+	ChunkSize              int64
+	ProxyMode              bool
+	TransformCache         int64
+	DiskCachePath          string
+	DiskCacheSize          int64
+	DiskCacheMaxFileSize   int64
+	FFmpegPath             string
+	LottieConverterPath    string
+	BandwidthPerConnection int64
+	BandwidthPerIP         int64
+	MaxStreams             int
+	MaxStreamsPerIP        int
+	MaxProxySize           int64
+	ChecksumTimeout        time.Duration
+	MaxBodySize            int64
+	MaxJobBodySize         int64
+	MaxUploadSize          int64
+	ClamAVAddress          string
+	ClamAVFailOpen         bool
+	ClamAVMaxSize          int64
+	ClamAVTimeout          time.Duration
+	ModerationURL          string
+	ModerationToken        string
+	ModerationTimeout      time.Duration
+	ModerationFailOpen     bool
+	MaxOpenReports         int
+	StripMetadata          bool
+	NegotiateFormat        bool
+	ClientHints            bool
+	WatermarkImage         string
+	WatermarkText          string
+	WatermarkPosition      string
+	WatermarkOpacity       float64
+	WatermarkSize          float64
+	WatermarkChannels      []int64
+	AccessLogPath          string
+	AccessLogMaxSize       int64
+	AccessLogRotate        time.Duration
+	AuditLogPath           string
+	AuditRetention         time.Duration
+	UpstreamWindow         time.Duration
+	SentryDSN              string
+	SentryEnvironment      string
+	SentrySampleRate       float64
+	StatsDAddr             string
+	StatsDPrefix           string
+	StatsDDatadog          bool
+	StatsDFlushInterval    time.Duration
+	JobBatchInterval       time.Duration
+	JobCallbackSecret      string
+	NATSURL                string
+	NATSSubject            string
+	NATSQueue              string
+	NATSResultSubject      string
+	NATSConcurrency        int
+	Workers                int
+	WorkerQueueDepth       int
+	InteractiveReserve     int
+	DiscordRateLimit       int
+	MaxQueueWait           time.Duration
+	UpstreamConcurrency    int
+	UpstreamIdleConns      int
+	UpstreamIdleTimeout    time.Duration
+	UpstreamHTTP1          bool
+	OutboundBindIP         net.IP
+	EgressPool             []string
+	EgressCooldown         time.Duration
+	DNSCacheTTL            time.Duration
+	DNSRefreshInterval     time.Duration
+	DiscordAPIVersion      int
+	DiscordAPIFallback     bool
+	RefreshFallbacks       []string
+	MirrorURL              string
+	MirrorDeleted          bool
+	MirrorPath             string
+	MirrorInterval         time.Duration
+	MirrorConcurrency      int
+	StaleURLCacheSize      int
+	URLCacheFile           string
+	URLCacheBackend        string
+	DynamoDBTable          string
+	StaleWhileRevalidate   time.Duration
+	WarmupTop              int
+	WarmupFile             string
+	WarmupRefresh          bool
+	EarlyHints             bool
+	VerifyRedirects        bool
+	WebUI                  bool
+	PurgeProvider          string
+	PurgeZone              string
+	PurgeToken             string
+	PurgeInterval          time.Duration
+	RobotsTxt              string
+	BlockCrawlers          bool
+	HotlinkAllow           []string
+	HotlinkAllowDirect     bool
+	HotlinkPlaceholder     string
+	ShareSecret            string
+	ShareTTL               time.Duration
+	ShareMaxTTL            time.Duration
+	UserAgent              string
+	ExtraHeaders           http.Header
+	IndexChannels          []int64
+	EnrichAttachments      bool
+	AllowedChannels        []int64
+	AllowedGuilds          []int64
+	TokenMap               []TokenRule
+	ShardTokens            []string
+	ShardBy                string
+	TokenOverride          bool
+	OAuthClientID          string
+	OAuthClientSecret      string
+	JWTSecret              string
+	JWTJWKSURL             string
+	JWTIssuer              string
+	JWTAudience            string
+	KeyDailyQuota          int64
+	KeyMonthlyQuota        int64
+	RequestsPerIP          int64
+	RequestsPerKey         int64
+	RequestsPerChannel     int64
+	BandwidthPerChannel    int64
+	ChannelLimits          []ChannelLimit
+	ACL                    []ACLRule
+	TrustedProxies         []*net.IPNet
+	HtpasswdUsers          map[string]string
+	RedisURL               string
+	RedisPrefix            string
+	ReadyCheckDiscord      bool
+	ReadyCheckInterval     time.Duration
+	CanaryURL              string
+	CanaryInterval         time.Duration
+	ValidateTokens         string
+	AlertWebhookURL        string
+	TokenErrorThreshold    float64
+	TokenPoolMinHealthy    float64
+	RefreshErrorThreshold  float64
+	OutageThreshold        float64
+	RateLimitThreshold     float64
+	SlackWebhookURL        string
+	PagerDutyRoutingKey    string
+	OpsgenieAPIKey         string
+	OpsgenieAPIURL         string
+	Tenants                []Tenant
+	VirtualHosts           []VirtualHost
+	// Tenant names the tenant this configuration is for, or is empty for
+	// the deployment's own.
+	Tenant string
+
+	// settings lists every variable read and its effective value, for
+	// --print-config.
+	settings []configSetting
+	// vault is the client secrets were read from, if any referred to Vault,
+	// and vaultValues the secrets read, by reference.
+	vault       *VaultClient
+	vaultValues map[string]string
+}
+
+type configSetting struct {
+	name   string
+	value  string
+	secret bool
+}
+
+func loadConfig() (*Config, error) {
+	if err := godotenv.Load(); err != nil {
+		// continue with environment variables
+	}
+
+	p := &configParser{}
+	config := &Config{
+		Token:                  p.secret("TOKEN"),
+		TokenFile:              p.string("TOKEN_FILE", ""),
+		Port:                   p.int("PORT", 8080),
+		Listen:                 splitList(p.string("LISTEN", "")),
+		AdminListen:            splitList(p.string("ADMIN_LISTEN", "")),
+		AdminToken:             p.secret("ADMIN_TOKEN"),
+		AdminKeys:              splitList(p.secret("ADMIN_KEYS")),
+		GRPCListen:             splitList(p.string("GRPC_LISTEN", "")),
+		TLSCert:                p.string("TLS_CERT", ""),
+		TLSKey:                 p.string("TLS_KEY", ""),
+		ClientCA:               p.string("CLIENT_CA", ""),
+		RequireClientCert:      p.bool("REQUIRE_CLIENT_CERT", false),
+		ClientCertNames:        splitList(p.string("CLIENT_CERT_NAMES", "")),
+		RequestTimeout:         p.duration("REQUEST_TIMEOUT", 30*time.Second),
+		ShutdownTimeout:        p.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		PublicURL:              strings.TrimSuffix(p.string("PUBLIC_URL", ""), "/"),
+		BasePath:               strings.TrimSuffix(p.string("BASE_PATH", ""), "/"),
+		DataPath:               p.string("DATA_PATH", "data.json"),
+		DatabaseURL:            p.secret("DATABASE_URL"),
+		StoreAutoMigrate:       p.bool("STORE_AUTO_MIGRATE", true),
+		LogLevel:               strings.ToLower(p.string("LOG_LEVEL", "info")),
+		LogFormat:              p.string("LOG_FORMAT", logFormatConsole),
+		Retention:              p.duration("RETENTION", 0),
+		JanitorInterval:        p.duration("JANITOR_INTERVAL", time.Hour),
+		APIKeys:                splitList(p.secret("API_KEYS")),
+		UploadChannelID:        p.int64("UPLOAD_CHANNEL_ID", 0),
+		ChunkSize:              p.int64("CHUNK_SIZE", 26214400),
+		ProxyMode:              p.bool("PROXY_MODE", false),
+		TransformCache:         p.int64("TRANSFORM_CACHE_SIZE", 67108864),
+		DiskCachePath:          p.string("DISK_CACHE_PATH", ""),
+		DiskCacheSize:          p.int64("DISK_CACHE_SIZE", 10737418240),
+		DiskCacheMaxFileSize:   p.int64("DISK_CACHE_MAX_FILE_SIZE", 104857600),
+		FFmpegPath:             p.string("FFMPEG_PATH", "ffmpeg"),
+		LottieConverterPath:    p.string("LOTTIE_CONVERTER_PATH", ""),
+		BandwidthPerConnection: p.int64("BANDWIDTH_PER_CONNECTION", 0),
+		BandwidthPerIP:         p.int64("BANDWIDTH_PER_IP", 0),
+		MaxStreams:             p.int("MAX_STREAMS", 0),
+		MaxStreamsPerIP:        p.int("MAX_STREAMS_PER_IP", 0),
+		MaxProxySize:           p.int64("MAX_PROXY_SIZE", 0),
+		ChecksumTimeout:        p.duration("CHECKSUM_TIMEOUT", 10*time.Minute),
+		MaxBodySize:            p.int64("MAX_BODY_SIZE", 1<<20),
+		MaxJobBodySize:         p.int64("MAX_JOB_BODY_SIZE", 64<<20),
+		MaxUploadSize:          p.int64("MAX_UPLOAD_SIZE", 0),
+		ClamAVAddress:          p.string("CLAMAV_ADDRESS", ""),
+		ClamAVFailOpen:         p.bool("CLAMAV_FAIL_OPEN", false),
+		ClamAVMaxSize:          p.int64("CLAMAV_MAX_SIZE", 26214400),
+		ClamAVTimeout:          p.duration("CLAMAV_TIMEOUT", time.Minute),
+		ModerationURL:          p.string("MODERATION_URL", ""),
+		ModerationToken:        p.secret("MODERATION_TOKEN"),
+		ModerationTimeout:      p.duration("MODERATION_TIMEOUT", 10*time.Second),
+		ModerationFailOpen:     p.bool("MODERATION_FAIL_OPEN", false),
+		MaxOpenReports:         p.int("MAX_OPEN_REPORTS", 1000),
+		StripMetadata:          p.bool("STRIP_METADATA", false),
+		NegotiateFormat:        p.bool("NEGOTIATE_FORMAT", false),
+		ClientHints:            p.bool("CLIENT_HINTS", false),
+		WatermarkImage:         p.file("WATERMARK_IMAGE", ""),
+		WatermarkText:          p.string("WATERMARK_TEXT", ""),
+		WatermarkPosition:      p.string("WATERMARK_POSITION", "bottom-right"),
+		WatermarkOpacity:       p.float("WATERMARK_OPACITY", 0.5),
+		WatermarkSize:          p.float("WATERMARK_SIZE", 0.25),
+		WatermarkChannels:      p.int64List("WATERMARK_CHANNELS"),
+		AccessLogPath:          p.string("ACCESS_LOG_PATH", ""),
+		AccessLogMaxSize:       p.int64("ACCESS_LOG_MAX_SIZE", 104857600),
+		AccessLogRotate:        p.duration("ACCESS_LOG_ROTATE_INTERVAL", 24*time.Hour),
+		AuditLogPath:           p.string("AUDIT_LOG_PATH", ""),
+		AuditRetention:         p.duration("AUDIT_RETENTION", 90*24*time.Hour),
+		UpstreamWindow:         p.duration("UPSTREAM_WINDOW", 5*time.Minute),
+		SentryDSN:              p.secret("SENTRY_DSN"),
+		SentryEnvironment:      p.string("SENTRY_ENVIRONMENT", ""),
+		SentrySampleRate:       p.float("SENTRY_SAMPLE_RATE", 1),
+		StatsDAddr:             p.string("STATSD_ADDR", ""),
+		StatsDPrefix:           p.string("STATSD_PREFIX", "discord_cdn."),
+		StatsDDatadog:          p.bool("STATSD_DATADOG", false),
+		StatsDFlushInterval:    p.duration("STATSD_FLUSH_INTERVAL", time.Second),
+		JobBatchInterval:       p.duration("JOB_BATCH_INTERVAL", 250*time.Millisecond),
+		JobCallbackSecret:      p.secret("JOB_CALLBACK_SECRET"),
+		NATSURL:                p.secret("NATS_URL"),
+		NATSSubject:            p.string("NATS_SUBJECT", "dcdn.refresh"),
+		NATSQueue:              p.string("NATS_QUEUE", "dcdn"),
+		NATSResultSubject:      p.string("NATS_RESULT_SUBJECT", "dcdn.results"),
+		NATSConcurrency:        p.int("NATS_CONCURRENCY", 4),
+		Workers:                p.int("WORKERS", 2),
+		WorkerQueueDepth:       p.int("WORKER_QUEUE_DEPTH", 100),
+		InteractiveReserve:     p.int("INTERACTIVE_RESERVE", 2),
+		DiscordRateLimit:       p.int("DISCORD_RATE_LIMIT", 50),
+		MaxQueueWait:           p.duration("MAX_QUEUE_WAIT", 10*time.Second),
+		UpstreamConcurrency:    p.int("UPSTREAM_CONCURRENCY", 64),
+		UpstreamIdleConns:      p.int("UPSTREAM_IDLE_CONNS", defaultUpstreamIdleConns),
+		UpstreamIdleTimeout:    p.duration("UPSTREAM_IDLE_TIMEOUT", defaultUpstreamIdleTimeout),
+		UpstreamHTTP1:          p.bool("UPSTREAM_HTTP1", false),
+		OutboundBindIP:         p.bindIP("OUTBOUND_BIND_IP"),
+		EgressPool:             splitList(p.secret("EGRESS_POOL")),
+		EgressCooldown:         p.duration("EGRESS_COOLDOWN", 30*time.Second),
+		DNSCacheTTL:            p.duration("DNS_CACHE_TTL", time.Minute),
+		DNSRefreshInterval:     p.duration("DNS_REFRESH_INTERVAL", 30*time.Second),
+		DiscordAPIVersion:      p.int("DISCORD_API_VERSION", defaultAPIVersion),
+		DiscordAPIFallback:     p.bool("DISCORD_API_FALLBACK", true),
+		RefreshFallbacks:       splitList(p.string("REFRESH_FALLBACKS", "")),
+		MirrorURL:              p.string("MIRROR_URL", ""),
+		MirrorDeleted:          p.bool("MIRROR_DELETED", false),
+		MirrorPath:             p.string("MIRROR_PATH", ""),
+		MirrorInterval:         p.duration("MIRROR_INTERVAL", 24*time.Hour),
+		MirrorConcurrency:      p.int("MIRROR_CONCURRENCY", 4),
+		StaleURLCacheSize:      p.int("STALE_URL_CACHE_SIZE", 10000),
+		URLCacheFile:           p.string("URL_CACHE_FILE", ""),
+		URLCacheBackend:        p.string("URL_CACHE_BACKEND", urlCacheMemory),
+		DynamoDBTable:          p.string("DYNAMODB_TABLE", ""),
+		StaleWhileRevalidate:   p.duration("STALE_WHILE_REVALIDATE", 0),
+		WarmupTop:              p.int("WARMUP_TOP", 0),
+		WarmupFile:             p.string("WARMUP_FILE", ""),
+		WarmupRefresh:          p.bool("WARMUP_REFRESH", true),
+		EarlyHints:             p.bool("EARLY_HINTS", true),
+		VerifyRedirects:        p.bool("VERIFY_REDIRECTS", false),
+		WebUI:                  p.bool("WEB_UI", true),
+		PurgeProvider:          p.string("PURGE_PROVIDER", ""),
+		PurgeZone:              p.string("PURGE_ZONE", ""),
+		PurgeToken:             p.secret("PURGE_TOKEN"),
+		PurgeInterval:          p.duration("PURGE_INTERVAL", 5*time.Second),
+		RobotsTxt:              p.file("ROBOTS_TXT", defaultRobotsTxt),
+		BlockCrawlers:          p.bool("BLOCK_CRAWLERS", false),
+		HotlinkAllow:           splitList(p.string("HOTLINK_ALLOW", "")),
+		HotlinkAllowDirect:     p.bool("HOTLINK_ALLOW_DIRECT", false),
+		HotlinkPlaceholder:     p.file("HOTLINK_PLACEHOLDER", ""),
+		ShareSecret:            p.secret("SHARE_SECRET"),
+		ShareTTL:               p.duration("SHARE_TTL", 24*time.Hour),
+		ShareMaxTTL:            p.duration("SHARE_MAX_TTL", 30*24*time.Hour),
+		UserAgent:              p.string("USER_AGENT", ""),
+		ExtraHeaders:           p.headers("EXTRA_HEADERS"),
+		IndexChannels:          p.int64List("INDEX_CHANNELS"),
+		EnrichAttachments:      p.bool("ENRICH_ATTACHMENTS", false),
+		AllowedChannels:        p.int64List("ALLOWED_CHANNELS"),
+		AllowedGuilds:          p.int64List("ALLOWED_GUILDS"),
+		TokenMap:               p.tokenMap("TOKEN_MAP"),
+		ShardTokens:            splitList(p.secret("SHARD_TOKENS")),
+		ShardBy:                p.string("SHARD_BY", shardByChannel),
+		TokenOverride:          p.bool("TOKEN_OVERRIDE", false),
+		OAuthClientID:          p.string("OAUTH_CLIENT_ID", ""),
+		OAuthClientSecret:      p.secret("OAUTH_CLIENT_SECRET"),
+		JWTSecret:              p.secret("JWT_SECRET"),
+		JWTJWKSURL:             p.string("JWT_JWKS_URL", ""),
+		JWTIssuer:              p.string("JWT_ISSUER", ""),
+		JWTAudience:            p.string("JWT_AUDIENCE", ""),
+		KeyDailyQuota:          p.int64("KEY_DAILY_QUOTA", 0),
+		KeyMonthlyQuota:        p.int64("KEY_MONTHLY_QUOTA", 0),
+		RequestsPerIP:          p.int64("REQUESTS_PER_IP", 0),
+		RequestsPerKey:         p.int64("REQUESTS_PER_KEY", 0),
+		RequestsPerChannel:     p.int64("REQUESTS_PER_CHANNEL", 0),
+		BandwidthPerChannel:    p.int64("BANDWIDTH_PER_CHANNEL", 0),
+		ChannelLimits:          p.channelLimits("CHANNEL_LIMITS"),
+		ACL:                    p.acl("ACL"),
+		TrustedProxies:         p.ipRanges("TRUSTED_PROXIES"),
+		HtpasswdUsers:          p.htpasswd("HTPASSWD"),
+		RedisURL:               p.secret("REDIS_URL"),
+		RedisPrefix:            p.string("REDIS_PREFIX", "dcdn:"),
+		ReadyCheckDiscord:      p.bool("READY_CHECK_DISCORD", false),
+		ReadyCheckInterval:     p.duration("READY_CHECK_INTERVAL", 30*time.Second),
+		CanaryURL:              p.string("CANARY_URL", ""),
+		CanaryInterval:         p.duration("CANARY_INTERVAL", time.Minute),
+		ValidateTokens:         p.string("VALIDATE_TOKENS", "warn"),
+		AlertWebhookURL:        p.secret("ALERT_WEBHOOK_URL"),
+		VaultRenewInterval:     p.duration("VAULT_RENEW_INTERVAL", 5*time.Minute),
+		TokenErrorThreshold:    p.float("TOKEN_ERROR_THRESHOLD", 0.5),
+		TokenPoolMinHealthy:    p.float("TOKEN_POOL_MIN_HEALTHY", 0.5),
+		RefreshErrorThreshold:  p.float("REFRESH_ERROR_THRESHOLD", 0.2),
+		OutageThreshold:        p.float("OUTAGE_THRESHOLD", 0.9),
+		RateLimitThreshold:     p.float("RATE_LIMIT_ALERT_THRESHOLD", 0.2),
+		SlackWebhookURL:        p.secret("SLACK_WEBHOOK_URL"),
+		PagerDutyRoutingKey:    p.secret("PAGERDUTY_ROUTING_KEY"),
+		OpsgenieAPIKey:         p.secret("OPSGENIE_API_KEY"),
+		OpsgenieAPIURL:         p.string("OPSGENIE_API_URL", defaultOpsgenieAPIURL),
+		Tenants:                p.tenants("TENANTS_FILE"),
+		VirtualHosts:           p.virtualHosts("VIRTUAL_HOSTS"),
+	}
+	config.settings = p.settings
+	config.vault, config.vaultValues = p.vault, p.vaultValues
+	if len(config.Listen) == 0 {
+		config.Listen = []string{fmt.Sprintf(":%d", config.Port)}
+	}
+	for _, l := range []struct {
+		key   string
+		addrs *[]string
+		port  int
+	}{
+		{"LISTEN", &config.Listen, config.Port},
+		{"ADMIN_LISTEN", &config.AdminListen, 0},
+		{"GRPC_LISTEN", &config.GRPCListen, 0},
+	} {
+		addrs, err := normalizeListen(*l.addrs, l.port)
+		if err != nil {
+			p.fail(l.key, "%v", err)
+			continue
+		}
+		*l.addrs = addrs
+	}
+
+	if !p.failed["TENANTS_FILE"] {
+		config.applyVirtualHosts(p)
+	}
+	// Links are built on PUBLIC_URL, so it has to carry the base path too.
+	if config.BasePath != "" && config.PublicURL != "" && !strings.HasSuffix(config.PublicURL, config.BasePath) {
+		config.PublicURL += config.BasePath
+	}
+	config.validate(p)
+	if len(p.errs) > 0 {
+		return nil, errors.Join(p.errs...)
+	}
+	return config, nil
+}
+
+// apiAuth reports whether authenticated routes are enabled, which clients
+// reach with an API key or a client certificate.
+func (c *Config) apiAuth() bool {
+	return len(c.APIKeys) > 0 || c.ClientCA != ""
+}
+
+// validate checks settings that parse fine on their own but are out of range
+// or inconsistent with each other.
+func (c *Config) validate(p *configParser) {
+	if c.Token == "" && c.TokenFile == "" {
+		p.fail("TOKEN", "is required, or set %sTOKEN_FILE", envPrefix)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		p.fail("PORT", "must be between 1 and 65535")
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.ContainsAny(c.BasePath, "?#")) {
+		p.fail("BASE_PATH", "must be a path such as /discord-cdn")
+	}
+	if c.DatabaseURL != "" {
+		if _, _, err := parseDatabaseURL(c.DatabaseURL); err != nil {
+			p.fail("DATABASE_URL", "%v", err)
+		}
+	}
+	if c.ChunkSize <= 0 {
+		p.fail("CHUNK_SIZE", "must be positive")
+	}
+	if c.UploadChannelID != 0 && !c.apiAuth() {
+		p.fail("API_KEYS", "is required when uploads are enabled, unless %sCLIENT_CA is set", envPrefix)
+	}
+	if slices.ContainsFunc(c.AdminKeys, func(key string) bool { return slices.Contains(c.APIKeys, key) }) {
+		p.fail("ADMIN_KEYS", "must not repeat %sAPI_KEYS", envPrefix)
+	}
+	if c.TokenOverride && !c.apiAuth() {
+		p.fail("TOKEN_OVERRIDE", "requires %sAPI_KEYS or %sCLIENT_CA", envPrefix, envPrefix)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		p.fail("TLS_KEY", "must be set along with %sTLS_CERT", envPrefix)
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		p.fail("CLIENT_CA", "requires %sTLS_CERT and %sTLS_KEY", envPrefix, envPrefix)
+	}
+	if (c.RequireClientCert || len(c.ClientCertNames) > 0) && c.ClientCA == "" {
+		p.fail("CLIENT_CA", "is required to check client certificates")
+	}
+	if c.OAuthClientID != "" && c.OAuthClientSecret == "" {
+		p.fail("OAUTH_CLIENT_SECRET", "is required when OAuth login is enabled")
+	}
+	if c.SentrySampleRate < 0 || c.SentrySampleRate > 1 {
+		p.fail("SENTRY_SAMPLE_RATE", "must be between 0 and 1")
+	}
+	if c.StatsDFlushInterval <= 0 {
+		p.fail("STATSD_FLUSH_INTERVAL", "must be positive")
+	}
+	if !slices.Contains(discordAPIVersions, c.DiscordAPIVersion) {
+		p.fail("DISCORD_API_VERSION", "must be 9 or 10")
+	}
+	if err := validateFallbacks(c.RefreshFallbacks, c.MirrorURL); err != nil {
+		p.fail("REFRESH_FALLBACKS", "%v", err)
+	}
+	if c.MirrorDeleted && c.MirrorURL == "" {
+		p.fail("MIRROR_DELETED", "requires %sMIRROR_URL", envPrefix)
+	}
+	if c.MirrorInterval <= 0 {
+		p.fail("MIRROR_INTERVAL", "must be positive")
+	}
+	if c.MirrorConcurrency < 1 {
+		p.fail("MIRROR_CONCURRENCY", "must be positive")
+	}
+	if c.StaleURLCacheSize < 1 {
+		p.fail("STALE_URL_CACHE_SIZE", "must be positive")
+	}
+	switch c.URLCacheBackend {
+	case urlCacheMemory:
+	case urlCacheRedis:
+		if c.RedisURL == "" {
+			p.fail("URL_CACHE_BACKEND", "redis requires %sREDIS_URL", envPrefix)
+		}
+	case urlCacheDynamoDB:
+		if c.DynamoDBTable == "" {
+			p.fail("URL_CACHE_BACKEND", "dynamodb requires %sDYNAMODB_TABLE", envPrefix)
+		}
+	default:
+		p.fail("URL_CACHE_BACKEND", "must be memory, redis or dynamodb")
+	}
+	if err := validatePurge(c.PurgeProvider, c.PurgeZone, c.PurgeToken); err != nil {
+		p.fail("PURGE_PROVIDER", "%v", err)
+	}
+	if c.PurgeInterval <= 0 {
+		p.fail("PURGE_INTERVAL", "must be positive")
+	}
+	if c.ValidateTokens != "off" && c.ValidateTokens != "warn" && c.ValidateTokens != "fail" {
+		p.fail("VALIDATE_TOKENS", "must be off, warn or fail")
+	}
+	if c.TokenErrorThreshold <= 0 || c.TokenErrorThreshold > 1 {
+		p.fail("TOKEN_ERROR_THRESHOLD", "must be above 0 and at most 1")
+	}
+	if c.TokenPoolMinHealthy < 0 || c.TokenPoolMinHealthy > 1 {
+		p.fail("TOKEN_POOL_MIN_HEALTHY", "must be between 0 and 1")
+	}
+	for _, v := range []struct {
+		key   string
+		value float64
+	}{
+		{"REFRESH_ERROR_THRESHOLD", c.RefreshErrorThreshold},
+		{"OUTAGE_THRESHOLD", c.OutageThreshold},
+		{"RATE_LIMIT_ALERT_THRESHOLD", c.RateLimitThreshold},
+		{"WATERMARK_OPACITY", c.WatermarkOpacity},
+		{"WATERMARK_SIZE", c.WatermarkSize},
+	} {
+		if v.value <= 0 || v.value > 1 {
+			p.fail(v.key, "must be above 0 and at most 1")
+		}
+	}
+	if c.AuditRetention <= 0 {
+		p.fail("AUDIT_RETENTION", "must be positive")
+	}
+	if c.UpstreamWindow <= 0 {
+		p.fail("UPSTREAM_WINDOW", "must be positive")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		p.fail("LOG_LEVEL", "%v", err)
+	}
+	if !validLogFormat(c.LogFormat) {
+		p.fail("LOG_FORMAT", "must be console or json")
+	}
+	if c.Retention > 0 && c.JanitorInterval <= 0 {
+		p.fail("JANITOR_INTERVAL", "must be positive when a retention is set")
+	}
+	if c.VaultRenewInterval <= 0 {
+		p.fail("VAULT_RENEW_INTERVAL", "must be positive")
+	}
+	if c.ClamAVTimeout <= 0 {
+		p.fail("CLAMAV_TIMEOUT", "must be positive")
+	}
+	if c.ModerationURL != "" && !strings.HasPrefix(c.ModerationURL, "http://") && !strings.HasPrefix(c.ModerationURL, "https://") {
+		p.fail("MODERATION_URL", "must be an http:// or https:// URL")
+	}
+	if c.ModerationTimeout <= 0 {
+		p.fail("MODERATION_TIMEOUT", "must be positive")
+	}
+	if c.WatermarkImage != "" && c.WatermarkText != "" {
+		p.fail("WATERMARK_TEXT", "can't be set along with %sWATERMARK_IMAGE", envPrefix)
+	}
+	if c.WatermarkImage != "" {
+		if _, _, err := image.Decode(strings.NewReader(c.WatermarkImage)); err != nil {
+			p.fail("WATERMARK_IMAGE", "could not be decoded as an image: %v", err)
+		}
+	}
+	if !slices.Contains(watermarkPositions, c.WatermarkPosition) {
+		p.fail("WATERMARK_POSITION", "must be one of %s", strings.Join(watermarkPositions, ", "))
+	}
+	if c.ShardBy != shardByChannel && c.ShardBy != shardByGuild {
+		p.fail("SHARD_BY", "must be channel or guild")
+	}
+	if c.ReadyCheckInterval <= 0 {
+		p.fail("READY_CHECK_INTERVAL", "must be positive")
+	}
+	if c.CanaryURL != "" {
+		if parsed := parseLink(c.CanaryURL); parsed.Error != "" {
+			p.fail("CANARY_URL", "is not an attachment link: %s", parsed.Error)
+		}
+		if c.CanaryInterval <= 0 {
+			p.fail("CANARY_INTERVAL", "must be positive")
+		}
+	}
+	if c.Workers < 1 {
+		p.fail("WORKERS", "must be positive")
+	}
+	for _, t := range c.Tenants {
+		if _, err := c.tenantConfig(t.Name); err != nil {
+			p.fail("TENANTS_FILE", "%v", err)
+		}
+	}
+	// gRPC calls serve the default configuration and skip the checks
+	// HTTP middleware makes, so they would get around these.
+	if len(c.GRPCListen) > 0 {
+		switch {
+		case len(c.Tenants) > 0:
+			p.fail("GRPC_LISTEN", "can't be used with %sTENANTS_FILE", envPrefix)
+		case len(c.ACL) > 0:
+			p.fail("GRPC_LISTEN", "can't be used with %sACL", envPrefix)
+		case len(c.HtpasswdUsers) > 0:
+			p.fail("GRPC_LISTEN", "can't be used with %sHTPASSWD", envPrefix)
+		}
+	}
+	if c.ShareTTL <= 0 {
+		p.fail("SHARE_TTL", "must be positive")
+	} else if c.ShareMaxTTL > 0 && c.ShareTTL > c.ShareMaxTTL {
+		p.fail("SHARE_TTL", "must not exceed %sSHARE_MAX_TTL", envPrefix)
+	}
+	if c.RedisURL != "" {
+		if _, err := redis.ParseURL(c.RedisURL); err != nil {
+			p.fail("REDIS_URL", "must be a redis:// or rediss:// URL")
+		}
+	}
+	if len(c.EgressPool) > 0 && c.OutboundBindIP != nil {
+		p.fail("EGRESS_POOL", "can't be set along with %sOUTBOUND_BIND_IP", envPrefix)
+	}
+	for _, entry := range c.EgressPool {
+		if _, err := newEgress(entry, func(net.IP) *http.Transport { return &http.Transport{} }); err != nil {
+			p.fail("EGRESS_POOL", "%v", err)
+		}
+	}
+	if c.EgressCooldown <= 0 {
+		p.fail("EGRESS_COOLDOWN", "must be positive")
+	}
+	if c.AdminToken != "" {
+		if len(c.AdminListen) == 0 {
+			p.fail("ADMIN_TOKEN", "requires %sADMIN_LISTEN", envPrefix)
+		}
+		if len(c.AdminToken) < minAdminTokenLength {
+			p.fail("ADMIN_TOKEN", "must be at least %d characters", minAdminTokenLength)
+		}
+	}
+	if c.NATSURL != "" {
+		if u, err := url.Parse(c.NATSURL); err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+			p.fail("NATS_URL", "must be a nats:// or tls:// URL")
+		}
+	}
+	if !validNATSSubject(c.NATSSubject) {
+		p.fail("NATS_SUBJECT", "must be a NATS subject")
+	}
+	if c.NATSQueue == "" || strings.ContainsAny(c.NATSQueue, " \t\r\n") {
+		p.fail("NATS_QUEUE", "must be a queue group name")
+	}
+	if c.NATSResultSubject != "" && (!validNATSSubject(c.NATSResultSubject) || strings.ContainsAny(c.NATSResultSubject, "*>")) {
+		p.fail("NATS_RESULT_SUBJECT", "must be a NATS subject without wildcards")
+	}
+	if c.NATSConcurrency < 1 {
+		p.fail("NATS_CONCURRENCY", "must be positive")
+	}
+
+	for _, v := range []struct {
+		key   string
+		value int64
+	}{
+		{"UPLOAD_CHANNEL_ID", c.UploadChannelID},
+		{"TRANSFORM_CACHE_SIZE", c.TransformCache},
+		{"DISK_CACHE_SIZE", c.DiskCacheSize},
+		{"DISK_CACHE_MAX_FILE_SIZE", c.DiskCacheMaxFileSize},
+		{"BANDWIDTH_PER_CONNECTION", c.BandwidthPerConnection},
+		{"BANDWIDTH_PER_IP", c.BandwidthPerIP},
+		{"MAX_STREAMS", int64(c.MaxStreams)},
+		{"MAX_STREAMS_PER_IP", int64(c.MaxStreamsPerIP)},
+		{"REQUEST_TIMEOUT", int64(c.RequestTimeout)},
+		{"SHUTDOWN_TIMEOUT", int64(c.ShutdownTimeout)},
+		{"MAX_QUEUE_WAIT", int64(c.MaxQueueWait)},
+		{"UPSTREAM_CONCURRENCY", int64(c.UpstreamConcurrency)},
+		{"WARMUP_TOP", int64(c.WarmupTop)},
+		{"MAX_OPEN_REPORTS", int64(c.MaxOpenReports)},
+		{"MAX_PROXY_SIZE", c.MaxProxySize},
+		{"CHECKSUM_TIMEOUT", int64(c.ChecksumTimeout)},
+		{"MAX_BODY_SIZE", c.MaxBodySize},
+		{"MAX_JOB_BODY_SIZE", c.MaxJobBodySize},
+		{"MAX_UPLOAD_SIZE", c.MaxUploadSize},
+		{"CLAMAV_MAX_SIZE", c.ClamAVMaxSize},
+		{"ACCESS_LOG_MAX_SIZE", c.AccessLogMaxSize},
+		{"ACCESS_LOG_ROTATE_INTERVAL", int64(c.AccessLogRotate)},
+		{"JOB_BATCH_INTERVAL", int64(c.JobBatchInterval)},
+		{"WORKER_QUEUE_DEPTH", int64(c.WorkerQueueDepth)},
+		{"INTERACTIVE_RESERVE", int64(c.InteractiveReserve)},
+		{"DISCORD_RATE_LIMIT", int64(c.DiscordRateLimit)},
+		{"UPSTREAM_IDLE_CONNS", int64(c.UpstreamIdleConns)},
+		{"UPSTREAM_IDLE_TIMEOUT", int64(c.UpstreamIdleTimeout)},
+		{"DNS_CACHE_TTL", int64(c.DNSCacheTTL)},
+		{"DNS_REFRESH_INTERVAL", int64(c.DNSRefreshInterval)},
+		{"STALE_WHILE_REVALIDATE", int64(c.StaleWhileRevalidate)},
+		{"SHARE_MAX_TTL", int64(c.ShareMaxTTL)},
+		{"RETENTION", int64(c.Retention)},
+		{"KEY_DAILY_QUOTA", c.KeyDailyQuota},
+		{"KEY_MONTHLY_QUOTA", c.KeyMonthlyQuota},
+		{"REQUESTS_PER_IP", c.RequestsPerIP},
+		{"REQUESTS_PER_KEY", c.RequestsPerKey},
+		{"REQUESTS_PER_CHANNEL", c.RequestsPerChannel},
+		{"BANDWIDTH_PER_CHANNEL", c.BandwidthPerChannel},
+	} {
+		if v.value < 0 {
+			p.fail(v.key, "must not be negative")
+		}
+	}
+}
+
+// printConfig writes the effective configuration in .env format, with
+// secrets redacted.
+func (c *Config) printConfig(w io.Writer) {
+	for _, s := range c.settings {
+		value := s.value
+		if s.secret && value != "" {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s=%s\n", s.name, value)
+	}
+}
+
+// configParser reads typed settings, collecting every error instead of
+// stopping at the first so that all problems are reported together.
+type configParser struct {
+	settings    []configSetting
+	errs        []error
+	failed      map[string]bool
+	vault       *VaultClient
+	vaultValues map[string]string
+	aws         *AWSClient
+}
+
+// fail records an error for key. Only the first error per key is kept, so a
+// value that doesn't parse isn't also reported as out of range.
+func (p *configParser) fail(key, format string, args ...interface{}) {
+	if p.failed[key] {
+		return
+	}
+	if p.failed == nil {
+		p.failed = map[string]bool{}
+	}
+	p.failed[key] = true
+	p.errs = append(p.errs, fmt.Errorf("%s%s %s", envPrefix, key, fmt.Sprintf(format, args...)))
+}
+
+func (p *configParser) lookup(key, fallback string, secret bool) string {
+	value := getEnv(key, fallback)
+	p.settings = append(p.settings, configSetting{name: envPrefix + key, value: value, secret: secret})
+	return value
+}
+
+func (p *configParser) string(key, fallback string) string {
+	return p.lookup(key, fallback, false)
+}
+
+func (p *configParser) secret(key string) string {
+	return p.secretValue(key)
+}
+
+func (p *configParser) int(key string, fallback int) int {
+	raw := p.lookup(key, strconv.Itoa(fallback), false)
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		p.fail(key, "must be an integer, got %q", raw)
+	}
+	return v
+}
+
+func (p *configParser) int64(key string, fallback int64) int64 {
+	raw := p.lookup(key, strconv.FormatInt(fallback, 10), false)
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		p.fail(key, "must be an integer, got %q", raw)
+	}
+	return v
+}
+
+func (p *configParser) int64List(key string) []int64 {
+	var values []int64
+	for _, item := range splitList(p.lookup(key, "", false)) {
+		v, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			p.fail(key, "must be a list of integers, got %q", item)
+			continue
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func (p *configParser) tokenMap(key string) []TokenRule {
+	rules, err := parseTokenMap(p.secretValue(key))
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return rules
+}
+
+func (p *configParser) channelLimits(key string) []ChannelLimit {
+	limits, err := parseChannelLimits(p.lookup(key, "", false))
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return limits
+}
+
+// tenants reads the tenants from the JSON file named by key.
+func (p *configParser) tenants(key string) []Tenant {
+	tenants, err := parseTenants(p.file(key, ""))
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return tenants
+}
+
+func (p *configParser) virtualHosts(key string) []VirtualHost {
+	hosts, err := parseVirtualHosts(p.lookup(key, "", false))
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return hosts
+}
+
+func (p *configParser) acl(key string) []ACLRule {
+	rules, err := parseACL(p.lookup(key, "", false))
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return rules
+}
+
+// ipRanges reads a comma-separated list of CIDR blocks and single addresses.
+func (p *configParser) ipRanges(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range splitList(p.lookup(key, "", false)) {
+		network, err := parseIPRange(value)
+		if err != nil {
+			p.fail(key, "must list CIDR blocks or IP addresses, not %q", value)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// bindIP reads an IP address or network interface name to bind outbound
+// connections to, if any.
+func (p *configParser) bindIP(key string) net.IP {
+	value := p.lookup(key, "", false)
+	if value == "" {
+		return nil
+	}
+	ip, err := outboundBindIP(value)
+	if err != nil {
+		p.fail(key, "must be a local IP address or network interface: %v", err)
+	}
+	return ip
+}
+
+// htpasswd reads the users of the htpasswd file the setting names, if any.
+func (p *configParser) htpasswd(key string) map[string]string {
+	path := p.lookup(key, "", false)
+	if path == "" {
+		return nil
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		p.fail(key, "%v", err)
+	}
+	return users
+}
+
+// headers parses a comma-separated list of Name: value pairs. Values may
+// carry credentials, so the setting is treated as a secret.
+func (p *configParser) headers(key string) http.Header {
+	var headers http.Header
+	for _, item := range splitList(p.secretValue(key)) {
+		name, value, ok := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			p.fail(key, "must be a list of Name: value headers, got %q", item)
+			continue
+		}
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers
+}
+
+// file reads the file named by key, returning fallback when key is unset.
+func (p *configParser) file(key, fallback string) string {
+	path := p.lookup(key, "", false)
+	if path == "" {
+		return fallback
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		p.fail(key, "could not be read: %v", err)
+	}
+	return string(data)
+}
+
+func (p *configParser) float(key string, fallback float64) float64 {
+	raw := p.lookup(key, strconv.FormatFloat(fallback, 'f', -1, 64), false)
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		p.fail(key, "must be a number, got %q", raw)
+	}
+	return v
+}
+
+func (p *configParser) bool(key string, fallback bool) bool {
+	raw := p.lookup(key, strconv.FormatBool(fallback), false)
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.fail(key, "must be true or false, got %q", raw)
+	}
+	return v
+}
+
+func (p *configParser) duration(key string, fallback time.Duration) time.Duration {
+	raw := p.lookup(key, fallback.String(), false)
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		p.fail(key, "must be a duration such as 30s or 1h, got %q", raw)
+	}
+	return v
+}
+
+// legacyNames are the settings the first release read without a prefix,
+// which are still read under their old names. Settings added since only have
+// prefixed names, so generic variables such as API_KEYS set for other
+// programs aren't taken for this one's.
+var legacyNames = map[string]bool{"TOKEN": true, "PORT": true}
+
+// legacyWarned remembers which unprefixed variables have already been
+// reported, so reloads don't repeat the warning.
+var legacyWarned sync.Map
+
+// getEnv returns the prefixed variable, falling back to its unprefixed
+// legacy name, for the settings that have one, and then to fallback.
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(envPrefix + key); value != "" {
+		return value
+	}
+	if !legacyNames[key] {
+		return fallback
+	}
+	if value := os.Getenv(key); value != "" {
+		if _, warned := legacyWarned.LoadOrStore(key, true); !warned {
+			logAt(slog.LevelWarn, "%s is deprecated, use %s%s instead", key, envPrefix, key)
+		}
+		return value
+	}
+	return fallback
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
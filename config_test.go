@@ -0,0 +1,22 @@
+package discordcdn
+
+import "testing"
+
+func TestGetEnvLegacyNames(t *testing.T) {
+	t.Setenv("PORT", "9000")
+	t.Setenv("API_KEYS", "key")
+	t.Setenv("PUBLIC_URL", "https://example.com")
+
+	if got := getEnv("PORT", "8080"); got != "9000" {
+		t.Errorf("PORT = %q, want the unprefixed value", got)
+	}
+	for _, key := range []string{"API_KEYS", "PUBLIC_URL"} {
+		if got := getEnv(key, ""); got != "" {
+			t.Errorf("%s = %q, want only the prefixed name read", key, got)
+		}
+	}
+	t.Setenv("DCDN_PORT", "9100")
+	if got := getEnv("PORT", "8080"); got != "9100" {
+		t.Errorf("PORT = %q, want the prefixed value first", got)
+	}
+}
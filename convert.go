@@ -0,0 +1,114 @@
+package discordcdn
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// homeTemplate is the link conversion page served at /. The page is
+// embedded at build time, so parsing it cannot fail.
+var homeTemplate = template.Must(template.ParseFS(webFS, "web/index.html"))
+
+// ConvertRequest is the body of POST /api/convert.
+type ConvertRequest struct {
+	// Link is an attachment link, in any form links are accepted in, or a
+	// link to a message, which stands for all of its attachments.
+	Link string `json:"link"`
+}
+
+// ConvertedLink is one attachment a converted link stands for: the link to
+// it through this server, and the URL Discord signed for it just now.
+type ConvertedLink struct {
+	FileName     string `json:"fileName,omitempty"`
+	ProxyURL     string `json:"proxyURL,omitempty"`
+	RefreshedURL string `json:"refreshedURL,omitempty"`
+	// ExpiresAt is when the signature of RefreshedURL runs out; ProxyURL
+	// keeps working after that.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ErrorCode string     `json:"errorCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// handleHome serves the link conversion page, a form for people who'd rather
+// not call the API themselves. The page calls POST /api/convert, so it needs
+// an API key whenever the API does, which browsers ask for with the basic
+// auth prompt.
+func handleHome() HandlerFunc {
+	return func(c *Context) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		homeTemplate.Execute(c.Writer, struct{ Prefix string }{pathPrefix(c.Request)})
+	}
+}
+
+// handleConvert turns an attachment or message link into links through this
+// server and refreshed Discord URLs, one per attachment. Attachments that
+// fail to refresh carry an error code and message instead, like the results
+// of refresh jobs.
+func handleConvert(client *DiscordClient, config *Config) HandlerFunc {
+	return func(c *Context) {
+		var req ConvertRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		link := strings.TrimSpace(req.Link)
+		if err != nil || link == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "Link is required")
+			return
+		}
+
+		// Message links are refreshed by the path of each attachment, others
+		// as they were given, media proxy parameters included.
+		raws := []string{link}
+		if _, ok := parseMessageLink(link); ok {
+			_, message, ok := fetchGalleryMessage(c, client, link)
+			if !ok {
+				return
+			}
+			raws = raws[:0]
+			for _, file := range messageFiles(message) {
+				raws = append(raws, file.Path())
+			}
+		} else {
+			parsedLink := parseLink(link)
+			if parsedLink.Error != "" {
+				respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+				return
+			}
+			if !authorizeChannel(c, client, parsedLink.Data.ChannelID) {
+				return
+			}
+		}
+
+		base := publicURL(c, config)
+		var links []ConvertedLink
+		for start := 0; start < len(raws); start += refreshBatchSize {
+			results, _ := refreshBatch(client, PriorityInteractive, requesterOf(c), raws[start:min(start+refreshBatchSize, len(raws))])
+			for _, r := range results {
+				result := newJobResult(r)
+				converted := ConvertedLink{
+					RefreshedURL: result.RefreshedURL,
+					ExpiresAt:    result.ExpiresAt,
+					ErrorCode:    result.ErrorCode,
+					Error:        result.Error,
+				}
+				if r.data != nil {
+					converted.FileName = r.data.FileName
+					converted.ProxyURL = base + "/" + r.data.Path()
+					if len(r.data.Media) > 0 {
+						converted.ProxyURL += "?" + r.data.Media.Encode()
+					}
+				}
+				links = append(links, converted)
+			}
+		}
+		c.JSON(http.StatusOK, H{"links": links})
+	}
+}
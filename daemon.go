@@ -0,0 +1,31 @@
+package discordcdn
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	// windowsServiceName is the name the Windows service is installed and
+	// logs to the event log under.
+	windowsServiceName = "discord-cdn"
+	// serviceLogFile is where the Windows service writes its logs and
+	// request logs, in the directory it runs in.
+	serviceLogFile = "discord-cdn.log"
+)
+
+// shutdownSignals returns a channel closed on SIGINT or SIGTERM, which Ctrl+C,
+// systemd, Docker and Kubernetes send to stop the server. Signals after the
+// first are no longer caught, so a second Ctrl+C exits at once.
+func shutdownSignals() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		close(stop)
+	}()
+	return stop
+}
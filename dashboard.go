@@ -0,0 +1,243 @@
+package discordcdn
+
+import (
+	"embed"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminFS holds the dashboard's static assets.
+//
+//go:embed admin
+var adminFS embed.FS
+
+const (
+	// attachmentKey holds a label for the attachment a request served, for
+	// the dashboard's top attachments list.
+	attachmentKey = "attachment"
+	// errorCodeKey holds the code of the error response sent, if any.
+	errorCodeKey = "errorCode"
+
+	dashboardWindow       = 60
+	dashboardRecentErrors = 20
+	dashboardTopN         = 10
+	// dashboardMaxTracked bounds how many distinct attachments are counted;
+	// once exceeded, attachments seen only once are forgotten.
+	dashboardMaxTracked = 10000
+)
+
+// Dashboard keeps the live, in-memory statistics shown on the admin
+// dashboard. It is fed by its own middleware and by the metrics registry.
+type Dashboard struct {
+	mu       sync.Mutex
+	started  time.Time
+	buckets  [dashboardWindow]int64
+	bucketAt [dashboardWindow]int64
+	total    int64
+
+	cacheHits   int64
+	cacheMisses int64
+
+	discordOK        int64
+	discordErrors    int64
+	discordLatency   time.Duration
+	discordTimings   int64
+	lastDiscord      time.Time
+	lastDiscordState string
+
+	recentErrors []DashboardError
+	attachments  map[string]int64
+}
+
+type DashboardError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Code      string    `json:"code,omitempty"`
+}
+
+type DashboardAttachment struct {
+	Attachment string `json:"attachment"`
+	Requests   int64  `json:"requests"`
+}
+
+type DashboardStats struct {
+	Uptime        string                `json:"uptime"`
+	Requests      int64                 `json:"requests"`
+	RequestRate   float64               `json:"requestRate"`
+	CacheHitRatio float64               `json:"cacheHitRatio"`
+	Discord       DashboardDiscord      `json:"discord"`
+	RecentErrors  []DashboardError      `json:"recentErrors"`
+	Top           []DashboardAttachment `json:"topAttachments"`
+}
+
+type DashboardDiscord struct {
+	Healthy    bool      `json:"healthy"`
+	LastStatus string    `json:"lastStatus"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	LatencyMS  float64   `json:"avgLatencyMs"`
+}
+
+func NewDashboard() *Dashboard {
+	return &Dashboard{
+		started:     time.Now(),
+		attachments: map[string]int64{},
+	}
+}
+
+// record counts every request and remembers failed ones and the attachments
+// they served.
+func (d *Dashboard) record() HandlerFunc {
+	return func(c *Context) {
+		c.Next()
+
+		now := time.Now()
+		status := c.Writer.Status()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		sec := now.Unix()
+		i := sec % dashboardWindow
+		if d.bucketAt[i] != sec {
+			d.bucketAt[i] = sec
+			d.buckets[i] = 0
+		}
+		d.buckets[i]++
+		d.total++
+
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			d.recentErrors = append(d.recentErrors, DashboardError{
+				Time:      now.UTC(),
+				RequestID: c.GetString(requestIDKey),
+				Method:    c.Request.Method,
+				Path:      c.Request.URL.Path,
+				Status:    status,
+				Code:      c.GetString(errorCodeKey),
+			})
+			if len(d.recentErrors) > dashboardRecentErrors {
+				d.recentErrors = d.recentErrors[1:]
+			}
+		}
+
+		if attachment := c.GetString(attachmentKey); attachment != "" && status < http.StatusBadRequest {
+			d.attachments[attachment]++
+			if len(d.attachments) > dashboardMaxTracked {
+				for k, n := range d.attachments {
+					if n == 1 {
+						delete(d.attachments, k)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (d *Dashboard) Count(name string, value int64, tags []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch name {
+	case "cache.hits":
+		if tagValue(tags, "cache") == cacheVariants {
+			d.cacheHits += value
+		}
+	case "cache.misses":
+		if tagValue(tags, "cache") == cacheVariants {
+			d.cacheMisses += value
+		}
+	case "discord.requests":
+		status := tagValue(tags, "status")
+		if status == "200" {
+			d.discordOK += value
+		} else {
+			d.discordErrors += value
+		}
+		d.lastDiscord = time.Now()
+		d.lastDiscordState = status
+	}
+}
+
+func (d *Dashboard) Gauge(string, float64, []string) {}
+
+func (d *Dashboard) Timing(name string, dur time.Duration, tags []string) {
+	if name != "discord.request_duration" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.discordLatency += dur
+	d.discordTimings++
+}
+
+func tagValue(tags []string, key string) string {
+	for _, t := range tags {
+		if v, ok := strings.CutPrefix(t, key+":"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func (d *Dashboard) Stats() DashboardStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	var recent int64
+	for i, at := range d.bucketAt {
+		if now-at < dashboardWindow {
+			recent += d.buckets[i]
+		}
+	}
+
+	stats := DashboardStats{
+		Uptime:       time.Since(d.started).Truncate(time.Second).String(),
+		Requests:     d.total,
+		RequestRate:  float64(recent) / dashboardWindow,
+		RecentErrors: append([]DashboardError(nil), d.recentErrors...),
+		Discord: DashboardDiscord{
+			Healthy:    d.lastDiscordState == "200",
+			LastStatus: d.lastDiscordState,
+			LastSeen:   d.lastDiscord,
+			Requests:   d.discordOK + d.discordErrors,
+			Errors:     d.discordErrors,
+		},
+	}
+	if lookups := d.cacheHits + d.cacheMisses; lookups > 0 {
+		stats.CacheHitRatio = float64(d.cacheHits) / float64(lookups)
+	}
+	if d.discordTimings > 0 {
+		stats.Discord.LatencyMS = float64((d.discordLatency / time.Duration(d.discordTimings)).Microseconds()) / 1000
+	}
+
+	for k, n := range d.attachments {
+		stats.Top = append(stats.Top, DashboardAttachment{Attachment: k, Requests: n})
+	}
+	sort.Slice(stats.Top, func(i, j int) bool { return stats.Top[i].Requests > stats.Top[j].Requests })
+	if len(stats.Top) > dashboardTopN {
+		stats.Top = stats.Top[:dashboardTopN]
+	}
+	return stats
+}
+
+func handleDashboard() HandlerFunc {
+	// The page is embedded at build time, so reading it cannot fail.
+	page, _ := adminFS.ReadFile("admin/index.html")
+	return func(c *Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	}
+}
+
+func handleDashboardStats(dashboard *Dashboard) HandlerFunc {
+	return func(c *Context) {
+		c.JSON(http.StatusOK, dashboard.Stats())
+	}
+}
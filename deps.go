@@ -0,0 +1,127 @@
+package discordcdn
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dependencyCheck checks that one dependency the instance relies on works.
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// DependencyStatus is the outcome of one dependency check.
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMS"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// DependencyHealth checks every configured dependency, caching the results
+// for interval so frequent probes don't load them, or spend the Discord
+// rate limit.
+type DependencyHealth struct {
+	checks   []dependencyCheck
+	interval time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   []DependencyStatus
+}
+
+// NewDependencyHealth sets up checks of the Discord API, the data store and,
+// when configured, Redis and Vault.
+func NewDependencyHealth(config *Config, client *DiscordClient, store *Store, counter RequestCounter) *DependencyHealth {
+	h := &DependencyHealth{interval: config.ReadyCheckInterval}
+	h.checks = append(h.checks,
+		dependencyCheck{"discord", func(ctx context.Context) error { return pingDiscord(ctx, client) }},
+		dependencyCheck{"store", func(context.Context) error { return store.check() }},
+	)
+	if redis, ok := counter.(*redisCounter); ok {
+		h.checks = append(h.checks, dependencyCheck{"redis", func(ctx context.Context) error {
+			return redis.client.Ping(ctx).Err()
+		}})
+	}
+	if config.vault != nil {
+		h.checks = append(h.checks, dependencyCheck{"vault", func(context.Context) error {
+			var out struct{}
+			return config.vault.call(http.MethodGet, "auth/token/lookup-self", &out)
+		}})
+	}
+	return h
+}
+
+// check returns the status of every dependency, checking them all again, in
+// parallel, once the last results are older than the interval.
+func (h *DependencyHealth) check() []DependencyStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < h.interval {
+		return h.results
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discordCheckTimeout)
+	defer cancel()
+	results := make([]DependencyStatus, len(h.checks))
+	var wg sync.WaitGroup
+	for i, dep := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := dep.check(ctx)
+			results[i] = DependencyStatus{
+				Name:      dep.name,
+				Status:    "ok",
+				LatencyMS: milliseconds(time.Since(start)),
+			}
+			if err != nil {
+				results[i].Status = "error"
+				results[i].Error = err.Error()
+			}
+			metrics.Timing("deps.check_duration", time.Since(start), "dependency:"+dep.name, "status:"+results[i].Status)
+		}()
+	}
+	wg.Wait()
+
+	h.results = results
+	h.checkedAt = time.Now()
+	return results
+}
+
+// handleDependencies reports the status and latency of each dependency,
+// answering 503 when any of them fails so on-call can tell a broken
+// dependency from a broken instance.
+func handleDependencies(health *DependencyHealth) HandlerFunc {
+	return func(c *Context) {
+		results := health.check()
+		status, code := "ok", http.StatusOK
+		for _, r := range results {
+			if r.Status != "ok" {
+				status, code = "degraded", http.StatusServiceUnavailable
+			}
+		}
+		c.JSON(code, H{"status": status, "dependencies": results})
+	}
+}
+
+// check verifies that the store's directory accepts the writes saving it
+// takes.
+func (s *Store) check() error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,906 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RefreshURLsResponse struct {
+	RefreshedURLs []struct {
+		Original  string `json:"original"`
+		Refreshed string `json:"refreshed"`
+	} `json:"refreshed_urls"`
+}
+
+// attachmentFlagVoiceMessage marks an attachment recorded as a voice
+// message, an OGG Opus file Discord sends along with its duration and
+// waveform.
+const attachmentFlagVoiceMessage = 1 << 13
+
+type Attachment struct {
+	ID          int64  `json:"id,string"`
+	FileName    string `json:"filename"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Flags       int    `json:"flags"`
+	// DurationSecs and Waveform are only set on voice messages. The
+	// waveform is base64 encoded, one byte of amplitude per sample.
+	DurationSecs float64 `json:"duration_secs"`
+	Waveform     string  `json:"waveform"`
+}
+
+// IsVoiceMessage reports whether the attachment is a voice message.
+func (a *Attachment) IsVoiceMessage() bool {
+	return a.Flags&attachmentFlagVoiceMessage != 0
+}
+
+type User struct {
+	ID       int64  `json:"id,string"`
+	Username string `json:"username"`
+}
+
+// messageTypeThreadStarter marks the first message of a thread started from
+// an existing message, which references that message.
+const messageTypeThreadStarter = 21
+
+type Message struct {
+	ID                int64        `json:"id,string"`
+	Type              int          `json:"type"`
+	ChannelID         int64        `json:"channel_id,string"`
+	GuildID           int64        `json:"guild_id,string"`
+	Author            User         `json:"author"`
+	Content           string       `json:"content"`
+	Timestamp         time.Time    `json:"timestamp"`
+	Attachments       []Attachment `json:"attachments"`
+	ReferencedMessage *Message     `json:"referenced_message"`
+}
+
+// Channel is a guild channel or thread. ParentID is set for threads,
+// including forum posts.
+type Channel struct {
+	ID       int64 `json:"id,string"`
+	GuildID  int64 `json:"guild_id,string"`
+	ParentID int64 `json:"parent_id,string"`
+}
+
+// DiscordError is returned when the Discord API answers with a non-success
+// status.
+type DiscordError struct {
+	StatusCode int
+	// RetryAfter carries Discord's Retry-After header on rate-limited
+	// responses.
+	RetryAfter string
+	// Code and Message are Discord's JSON error code and message, when the
+	// response had them.
+	Code    int
+	Message string
+	// Errors maps the fields of the request Discord rejected, such as
+	// attachment_urls.0, to why. For refreshes, the attachment URLs
+	// rejected are given instead of their field.
+	Errors map[string]string
+}
+
+func (e *DiscordError) Error() string {
+	msg := fmt.Sprintf("discord API error: %d", e.StatusCode)
+	if e.Message != "" {
+		msg += fmt.Sprintf(": %s (code %d)", e.Message, e.Code)
+	}
+	for _, field := range slices.Sorted(maps.Keys(e.Errors)) {
+		msg += fmt.Sprintf("; %s: %s", field, e.Errors[field])
+	}
+	return msg
+}
+
+// DiscordErrorDetails is what Discord said about a call it refused, passed on
+// in error responses.
+type DiscordErrorDetails struct {
+	Code    int               `json:"code,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// details returns what Discord said about the error, or nil if it said
+// nothing.
+func (e *DiscordError) details() *DiscordErrorDetails {
+	if e.Message == "" && len(e.Errors) == 0 {
+		return nil
+	}
+	return &DiscordErrorDetails{Code: e.Code, Message: e.Message, Errors: e.Errors}
+}
+
+// retryAfter returns how long Discord asked us to wait, in seconds that may
+// be fractional, falling back to a few seconds when it didn't say.
+func retryAfter(err *DiscordError) time.Duration {
+	seconds, parseErr := strconv.ParseFloat(err.RetryAfter, 64)
+	if parseErr != nil || seconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// errAttachmentNotFound is returned when Discord accepts a refresh request but
+// has no URL for the attachment, meaning it no longer exists.
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// maxDiscordErrorBody bounds how much of an error response is read for its
+// details.
+const maxDiscordErrorBody = 64 << 10
+
+// newDiscordError reads the error Discord answered with from resp, whose body
+// it consumes: a JSON object with a code, a message and, for invalid requests,
+// the errors of each field nested by its path.
+func newDiscordError(resp *http.Response) *DiscordError {
+	e := &DiscordError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	var body struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Errors  json.RawMessage `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxDiscordErrorBody))
+	if json.Unmarshal(data, &body) != nil {
+		return e
+	}
+	e.Code, e.Message = body.Code, body.Message
+	var tree map[string]any
+	if json.Unmarshal(body.Errors, &tree) == nil {
+		e.Errors = map[string]string{}
+		flattenDiscordErrors("", tree, e.Errors)
+	}
+	return e
+}
+
+// flattenDiscordErrors collects the messages of Discord's nested field errors,
+// which sit in an _errors list under the path of the field, keyed by that
+// path with its parts joined by dots.
+func flattenDiscordErrors(path string, tree map[string]any, errs map[string]string) {
+	for key, value := range tree {
+		if key == "_errors" {
+			list, _ := value.([]any)
+			var messages []string
+			for _, item := range list {
+				if fields, ok := item.(map[string]any); ok {
+					if message, ok := fields["message"].(string); ok {
+						messages = append(messages, message)
+					}
+				}
+			}
+			if len(messages) > 0 {
+				errs[path] = strings.Join(messages, "; ")
+			}
+			continue
+		}
+		if subtree, ok := value.(map[string]any); ok {
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			flattenDiscordErrors(sub, subtree, errs)
+		}
+	}
+}
+
+type DiscordClient struct {
+	mu       sync.RWMutex
+	token    string
+	tokenMap []TokenRule
+	client   *http.Client
+	reserve  int
+	// shards are the tokens calls about channels no rule matches are spread
+	// across, by channel or by guild as shardBy says.
+	shards  []string
+	shardBy string
+	// budgets tracks the rate limit of each token separately, and
+	// overrides that of callers' own tokens.
+	budgets   map[string]*rateBudget
+	overrides overrideBudgets
+	// counter counts calls towards globalLimit, the calls per second allowed
+	// for each token.
+	counter     RequestCounter
+	globalLimit int
+	// maxQueueWait bounds how long a call waits for the rate limit before
+	// it is shed; see backpressure.go.
+	maxQueueWait time.Duration
+	// concurrency bounds the API calls in flight, if set.
+	concurrency    *ConcurrencyLimiter
+	counterFailing atomic.Bool
+	monitor        *TokenMonitor
+	// apiVersion is the API version calls are made with, and
+	// fallbackVersion the one to switch to if Discord rejects it.
+	apiVersion      int
+	fallbackVersion int
+	// fallbacks are tried in order when a refresh fails; see fallback.go.
+	fallbacks []string
+	mirrorURL string
+	stale     *urlCache
+	// shared is where refreshed URLs are shared with other instances, if
+	// anywhere; see sharedcache.go.
+	shared sharedURLCache
+	// mirrorDeleted serves the mirror's copy of attachments deleted from
+	// Discord.
+	mirrorDeleted bool
+	// revalidateWindow is how long a refreshed URL is reused while it is
+	// refreshed in the background, and revalidating holds the attachment
+	// URLs being refreshed; see revalidate.go.
+	revalidateWindow time.Duration
+	revalidating     map[string]bool
+	// userAgent and headers are sent with every request to Discord.
+	userAgent string
+	headers   http.Header
+	// purger purges deleted and re-signed attachments from the CDN in
+	// front of the server, if one is configured.
+	purger *CDNPurger
+	// enricher indexes the attachments refreshed, if enrichment is on.
+	enricher *Enricher
+	// scanner checks proxied files for malware, if scanning is on.
+	scanner *Scanner
+	// moderation decides which attachments may be served, if it is on.
+	moderation *Moderation
+	// takedowns are the attachments that must not be served; see
+	// takedown.go.
+	takedowns *Takedowns
+	// diskCache keeps proxied content on disk, if it is configured.
+	diskCache *DiskCache
+	// variants is the cache of transformed variants, and invalidator tells
+	// other replicas about attachments dropped from the caches; see
+	// invalidate.go.
+	variants    *ByteCache
+	invalidator *Invalidator
+	// auditLog records every refresh, if auditing is enabled.
+	auditLog *AuditLog
+	// upstream keeps latency and availability statistics of API calls.
+	upstream *UpstreamStats
+	// allowedChannels and allowedGuilds limit the attachments refreshed, for
+	// tenants; see tenant.go.
+	allowedChannels []int64
+	allowedGuilds   []int64
+
+	guildsMu sync.Mutex
+	guilds   map[int64]guildLookup
+}
+
+func NewDiscordClient(token string) *DiscordClient {
+	return &DiscordClient{
+		token:      token,
+		client:     &http.Client{Transport: newUpstreamTransport(defaultUpstreamIdleConns, defaultUpstreamIdleTimeout, nil, false, nil)},
+		apiVersion: defaultAPIVersion,
+		budgets:    map[string]*rateBudget{},
+		guilds:     map[int64]guildLookup{},
+	}
+}
+
+// SetToken replaces the token used for subsequent API calls.
+func (c *DiscordClient) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// SetInteractiveReserve sets how much of Discord's rate limit budget is kept
+// for interactive calls: background calls wait for a reset once no more than
+// reserve requests remain.
+func (c *DiscordClient) SetInteractiveReserve(reserve int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reserve = reserve
+	for _, b := range c.budgets {
+		b.setReserve(reserve)
+	}
+}
+
+// SetRequestCounter sets the counter API calls are counted with, for the
+// global limit. Every instance sharing the counter keeps to the limit
+// together.
+func (c *DiscordClient) SetRequestCounter(counter RequestCounter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counter = counter
+}
+
+// SetGlobalLimit sets how many API calls per second are made with each token.
+// A zero limit disables it.
+func (c *DiscordClient) SetGlobalLimit(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.globalLimit = limit
+}
+
+// SetMaxQueueWait sets how long a call may wait for the rate limit before
+// it fails with an OverloadError. Zero waits as long as it takes.
+func (c *DiscordClient) SetMaxQueueWait(wait time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxQueueWait = wait
+}
+
+func (c *DiscordClient) MaxQueueWait() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxQueueWait
+}
+
+// SetConcurrencyLimit bounds the API calls in flight to an adaptive limit of
+// at most ceiling, or lifts the bound when ceiling is 0.
+func (c *DiscordClient) SetConcurrencyLimit(ceiling int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.concurrency = nil
+	if ceiling > 0 {
+		c.concurrency = NewConcurrencyLimiter(ceiling)
+	}
+}
+
+// Concurrency returns the concurrency limiter, or nil if there is none.
+func (c *DiscordClient) Concurrency() *ConcurrencyLimiter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.concurrency
+}
+
+// SetHeaders sets the User-Agent and extra headers sent with every request to
+// Discord and its CDN. An empty userAgent keeps Go's default. Headers the
+// client sets itself, such as Authorization, take precedence.
+func (c *DiscordClient) SetHeaders(userAgent string, headers http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userAgent = userAgent
+	c.headers = headers
+}
+
+// requestHeaders returns the headers to add to an outgoing request.
+func (c *DiscordClient) requestHeaders() http.Header {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	headers := c.headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if c.userAgent != "" {
+		headers.Set("User-Agent", c.userAgent)
+	}
+	return headers
+}
+
+// do sends req with the configured headers added, retrying API calls
+// against the fallback version if Discord rejects the current one. API calls
+// first wait for a slot from the concurrency limiter, if there is one.
+func (c *DiscordClient) do(req *http.Request) (*http.Response, error) {
+	for name, values := range c.requestHeaders() {
+		if req.Header.Get(name) == "" {
+			req.Header[name] = values
+		}
+	}
+	limiter := c.Concurrency()
+	if limiter == nil || !strings.HasPrefix(req.URL.String(), discordAPIHost) {
+		limiter = nil
+	} else if err := limiter.acquire(req.Context(), c.MaxQueueWait()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.httpClient().Do(traceConnection(req))
+	if limiter != nil {
+		failed := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		limiter.release(time.Since(start), failed, errors.Is(err, context.Canceled))
+	}
+	if err != nil {
+		logAt(slog.LevelDebug, "Discord %s %s failed after %s: %v", req.Method, req.URL.Path, time.Since(start), err)
+		return nil, err
+	}
+	logAt(slog.LevelDebug, "Discord %s %s answered %d in %s", req.Method, req.URL.Path, resp.StatusCode, time.Since(start))
+	return c.retryWithFallback(req, resp)
+}
+
+// SetMonitor sets the monitor that the result of every API call is reported
+// to.
+func (c *DiscordClient) SetMonitor(monitor *TokenMonitor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.monitor = monitor
+}
+
+// Monitor returns the client's token monitor, or nil if it has none.
+func (c *DiscordClient) Monitor() *TokenMonitor {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.monitor
+}
+
+// record reports the result of an API call made with token to the monitor,
+// if there is one.
+func (c *DiscordClient) record(token string, resp *http.Response, err error) {
+	c.Monitor().record(token, resp, err)
+}
+
+func (c *DiscordClient) budgetFor(token string) *rateBudget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.budgets[token]
+	if !ok {
+		b = newRateBudget()
+		b.setReserve(c.reserve)
+		c.budgets[token] = b
+	}
+	return b
+}
+
+func (c *DiscordClient) authorization() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// RefreshAttachmentURL refreshes a single attachment URL at interactive
+// priority on behalf of requester, as recorded in the audit log.
+func (c *DiscordClient) RefreshAttachmentURL(ctx context.Context, requester, attachmentURL string) (string, error) {
+	if _, fileID := attachmentIDs(attachmentURL); fileID != 0 {
+		if t := c.takedown(fileID); t != nil {
+			return "", &TakedownError{FileID: fileID, Status: t.Status}
+		}
+	}
+	refreshed, err := c.RefreshAttachmentURLs(ctx, PriorityInteractive, requester, []string{attachmentURL})
+	if err != nil {
+		return "", err
+	}
+
+	newURL, ok := refreshed[attachmentURL]
+	if !ok || newURL == "" {
+		return "", errAttachmentNotFound
+	}
+	return newURL, nil
+}
+
+// RefreshAttachmentURLs refreshes several attachment URLs and returns the
+// refreshed URLs keyed by the original URL. URLs sharing a token are refreshed
+// in a single API call. Background calls first wait until the rate limit
+// budget allows them. Every refresh is recorded in the audit log, if one is
+// set, as made on behalf of requester. The calls are abandoned once ctx is
+// done.
+func (c *DiscordClient) RefreshAttachmentURLs(ctx context.Context, priority Priority, requester string, attachmentURLs []string) (map[string]string, error) {
+	// A caller's own token is used for every URL, and neither falls back to
+	// the configured tokens nor touches the shared caches, which it may see
+	// more or less of than they do.
+	override := discordTokenFrom(ctx)
+	var tokens []string
+	groups := map[string][]string{}
+	denied := map[string]bool{}
+	for _, u := range attachmentURLs {
+		// Attachments outside the allowlist are left unrefreshed, so they
+		// look deleted rather than revealing that they exist.
+		if !c.allowsChannel(attachmentChannel(u)) {
+			denied[u] = true
+			continue
+		}
+		// Attachments taken down aren't refreshed either, nor purged as
+		// deleted.
+		if _, fileID := attachmentIDs(u); c.takedown(fileID) != nil {
+			denied[u] = true
+			continue
+		}
+		token := override
+		if token == "" {
+			token = c.tokenFor(attachmentChannel(u))
+		}
+		if _, ok := groups[token]; !ok {
+			tokens = append(tokens, token)
+		}
+		groups[token] = append(groups[token], u)
+	}
+
+	refreshed := make(map[string]string, len(attachmentURLs))
+	for _, token := range tokens {
+		used := token
+		urls, err := c.refreshURLs(ctx, priority, token, groups[token])
+		if alternate := c.alternateToken(token, err); alternate != "" && override == "" {
+			logAt(slog.LevelWarn, "Refresh with %s failed (%v), retrying with %s", tokenID(token), err, tokenID(alternate))
+			metrics.Count("discord.token_retries", 1)
+			used = alternate
+			urls, err = c.refreshURLs(ctx, priority, alternate, groups[token])
+		}
+		c.audit(requester, used, priority, groups[token], urls, err)
+		// Callers' tokens failing says nothing about Discord or the
+		// service's tokens.
+		if override == "" {
+			c.Monitor().recordRefresh(err != nil && classifyRefreshError(err).upstream)
+		}
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(refreshed, urls)
+	}
+	if override != "" {
+		return refreshed, nil
+	}
+	for _, u := range attachmentURLs {
+		if refreshed[u] == "" && !denied[u] {
+			c.purgeAttachment(u)
+			c.unshareURL(u)
+			_, fileID := attachmentIDs(u)
+			c.invalidateAttachment(fileID)
+		}
+	}
+	c.remember(refreshed)
+	c.enrich(refreshed)
+	return refreshed, nil
+}
+
+func (c *DiscordClient) refreshURLs(ctx context.Context, priority Priority, token string, attachmentURLs []string) (map[string]string, error) {
+	body := map[string]interface{}{
+		"attachment_urls": attachmentURLs,
+	}
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiBase()+"/attachments/refresh-urls", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+
+	var budget *rateBudget
+	override := token == discordTokenFrom(ctx)
+	if override {
+		budget = c.overrideBudgetFor(token)
+	} else {
+		budget = c.budgetFor(token)
+	}
+	if err := budget.wait(ctx, priority, c.MaxQueueWait()); err != nil {
+		return nil, err
+	}
+	if err := c.waitGlobal(ctx, token, priority); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.do(req)
+	if !override {
+		c.record(token, resp, err)
+	}
+	if err != nil {
+		metrics.Count("discord.requests", 1, "endpoint:refresh", "status:error")
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	budget.update(resp)
+
+	status := "status:" + strconv.Itoa(resp.StatusCode)
+	metrics.Count("discord.requests", 1, "endpoint:refresh", status)
+	metrics.Timing("discord.request_duration", time.Since(start), "endpoint:refresh", status)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, refreshError(newDiscordError(resp), attachmentURLs)
+	}
+
+	var refreshResponse RefreshURLsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&refreshResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	refreshed := make(map[string]string, len(refreshResponse.RefreshedURLs))
+	for _, u := range refreshResponse.RefreshedURLs {
+		refreshed[u.Original] = u.Refreshed
+	}
+	return refreshed, nil
+}
+
+// refreshError names the attachment URLs Discord rejected in a refresh by
+// their URL rather than their index in the request.
+func refreshError(e *DiscordError, attachmentURLs []string) *DiscordError {
+	for field, message := range e.Errors {
+		rest, ok := strings.CutPrefix(field, "attachment_urls.")
+		if !ok {
+			continue
+		}
+		index, _, _ := strings.Cut(rest, ".")
+		if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < len(attachmentURLs) {
+			delete(e.Errors, field)
+			e.Errors[attachmentURLs[i]] = message
+		}
+	}
+	return e
+}
+
+// UploadAttachment posts content as a single-attachment message in the given
+// channel and returns the message. The body is streamed, so content is never
+// buffered in memory.
+func (c *DiscordClient) UploadAttachment(ctx context.Context, channelID int64, fileName string, content io.Reader) (*Message, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"attachments": []map[string]interface{}{{"id": 0, "filename": fileName}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		err := form.WriteField("payload_json", string(payload))
+		if err == nil {
+			var part io.Writer
+			part, err = form.CreateFormFile("files[0]", fileName)
+			if err == nil {
+				_, err = io.Copy(part, content)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	endpoint := fmt.Sprintf("%s/channels/%d/messages", c.apiBase(), channelID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, pr)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	token := c.tokenFor(channelID)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", token)
+
+	if err := c.waitGlobal(ctx, token, PriorityInteractive); err != nil {
+		pr.Close()
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.do(req)
+	c.record(token, resp, err)
+	if err != nil {
+		metrics.Count("discord.requests", 1, "endpoint:upload", "status:error")
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	status := "status:" + strconv.Itoa(resp.StatusCode)
+	metrics.Count("discord.requests", 1, "endpoint:upload", status)
+	metrics.Timing("discord.request_duration", time.Since(start), "endpoint:upload", status)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newDiscordError(resp)
+	}
+
+	var message Message
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(message.Attachments) == 0 {
+		return nil, fmt.Errorf("no attachments returned")
+	}
+	return &message, nil
+}
+
+// DeleteMessage deletes a message the bot posted, such as an upload.
+func (c *DiscordClient) DeleteMessage(ctx context.Context, channelID, messageID int64) error {
+	endpoint := fmt.Sprintf("%s/channels/%d/messages/%d", c.apiBase(), channelID, messageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	token := c.tokenFor(channelID)
+	req.Header.Set("Authorization", token)
+
+	if err := c.waitGlobal(ctx, token, PriorityBackground); err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := c.do(req)
+	c.record(token, resp, err)
+	if err != nil {
+		metrics.Count("discord.requests", 1, "endpoint:delete", "status:error")
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	status := "status:" + strconv.Itoa(resp.StatusCode)
+	metrics.Count("discord.requests", 1, "endpoint:delete", status)
+	metrics.Timing("discord.request_duration", time.Since(start), "endpoint:delete", status)
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return newDiscordError(resp)
+	}
+	return nil
+}
+
+// get calls a read-only API endpoint with token at priority and decodes its
+// response into v. endpoint names the call in metrics.
+func (c *DiscordClient) get(priority Priority, token, endpoint, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.apiBase()+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	if err := c.waitGlobal(req.Context(), token, priority); err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := c.do(req)
+	c.record(token, resp, err)
+	if err != nil {
+		metrics.Count("discord.requests", 1, "endpoint:"+endpoint, "status:error")
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	status := "status:" + strconv.Itoa(resp.StatusCode)
+	metrics.Count("discord.requests", 1, "endpoint:"+endpoint, status)
+	metrics.Timing("discord.request_duration", time.Since(start), "endpoint:"+endpoint, status)
+
+	if resp.StatusCode != http.StatusOK {
+		return newDiscordError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// Message fetches a message with the token mapped to its channel. Threads
+// and forum posts are channels of their own, and the ID of a thread is also
+// the ID of the message it starts from. When that message lives in the
+// parent channel, because the thread was started from an existing message,
+// it is fetched from there.
+func (c *DiscordClient) Message(channelID, messageID int64) (*Message, error) {
+	token := c.tokenFor(channelID)
+	var message Message
+	err := c.get(PriorityInteractive, token, "message", fmt.Sprintf("/channels/%d/messages/%d", channelID, messageID), &message)
+
+	var discordErr *DiscordError
+	if errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusNotFound && messageID == channelID {
+		channel, chErr := c.fetchChannel(token, channelID)
+		if chErr != nil || channel.ParentID == 0 {
+			return nil, err
+		}
+		return c.Message(channel.ParentID, messageID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Type == messageTypeThreadStarter && message.ReferencedMessage != nil {
+		return message.ReferencedMessage, nil
+	}
+	return &message, nil
+}
+
+// CurrentUser returns the user the default token belongs to, which fails
+// with a 401 once the token has been revoked.
+func (c *DiscordClient) CurrentUser(ctx context.Context) (*User, error) {
+	return c.TokenUser(ctx, c.authorization())
+}
+
+// TokenUser returns the user a token belongs to.
+func (c *DiscordClient) TokenUser(ctx context.Context, token string) (*User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.apiBase()+"/users/@me", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	if err := c.waitGlobal(ctx, token, PriorityInteractive); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.do(req)
+	c.record(token, resp, err)
+	if err != nil {
+		metrics.Count("discord.requests", 1, "endpoint:user", "status:error")
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	status := "status:" + strconv.Itoa(resp.StatusCode)
+	metrics.Count("discord.requests", 1, "endpoint:user", status)
+	metrics.Timing("discord.request_duration", time.Since(start), "endpoint:user", status)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newDiscordError(resp)
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &user, nil
+}
+
+// Download starts a GET for a CDN URL. rangeHeader, when non-empty, is sent
+// as the Range header. The caller must close the response body.
+func (c *DiscordClient) Download(ctx context.Context, target, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	return resp, nil
+}
+
+// Stat issues a HEAD request for a CDN URL and returns the attachment's size
+// and content type. A deleted attachment returns errAttachmentNotFound.
+func (c *DiscordClient) Stat(ctx context.Context, target string) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		c.purgeAttachment(target)
+		_, fileID := attachmentIDs(target)
+		c.invalidateAttachment(fileID)
+		return 0, "", errAttachmentNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected CDN status: %d", resp.StatusCode)
+	}
+	return resp.ContentLength, resp.Header.Get("Content-Type"), nil
+}
+
+// urlExpiry returns when a signed CDN URL expires, taken from the hex Unix
+// timestamp in its ex parameter.
+// The query is scanned in place, since this runs for every cached URL looked
+// up.
+func urlExpiry(signedURL string) (time.Time, bool) {
+	_, query, _ := strings.Cut(signedURL, "?")
+	query, _, _ = strings.Cut(query, "#")
+	for query != "" {
+		var param string
+		param, query, _ = strings.Cut(query, "&")
+		if value, ok := strings.CutPrefix(param, "ex="); ok {
+			ex, err := strconv.ParseInt(value, 16, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.Unix(ex, 0).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+const attachmentURLPrefix = cdnBase + "/attachments/"
+
+// attachmentURL builds the CDN URL of an attachment in a single allocation.
+func attachmentURL(channelID, fileID int64, fileName string) string {
+	var ids [20]byte
+	var b strings.Builder
+	b.Grow(len(attachmentURLPrefix) + 2*len(ids) + len(fileName))
+	b.WriteString(attachmentURLPrefix)
+	b.Write(strconv.AppendInt(ids[:0], channelID, 10))
+	b.WriteByte('/')
+	b.Write(strconv.AppendInt(ids[:0], fileID, 10))
+	b.WriteByte('/')
+	b.WriteString(fileName)
+	return b.String()
+}
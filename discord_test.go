@@ -0,0 +1,152 @@
+package discordcdn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDiscord stands in for Discord's API and CDN. Refreshes sign every URL
+// for a day, uploads are kept as CDN files, and the tokens calls were made
+// with are recorded.
+type fakeDiscord struct {
+	mu sync.Mutex
+	// files holds CDN content by path, such as /attachments/1/2/a.png.
+	files   map[string][]byte
+	nextID  int64
+	tokens  []string
+	deleted []string
+	// failUpload, if set, fails the nth upload, counting from 1, with 500.
+	failUpload func(n int) bool
+	uploads    int
+}
+
+// newFakeDiscord returns a fake and a client whose calls, to the API and
+// the CDN alike, all go to it.
+func newFakeDiscord(t *testing.T) (*fakeDiscord, *DiscordClient) {
+	t.Helper()
+	f := &fakeDiscord{files: map[string][]byte{}, nextID: 1151234567890200000}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+
+	client := NewDiscordClient("token")
+	client.client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	return f, client
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// put adds a CDN file and returns its link path.
+func (f *fakeDiscord) put(channelID, fileID int64, name string, content []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[fmt.Sprintf("/attachments/%d/%d/%s", channelID, fileID, name)] = content
+	return fmt.Sprintf("/%d/%d/%s", channelID, fileID, name)
+}
+
+func (f *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	f.mu.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/attachments/refresh-urls"):
+		var body struct {
+			AttachmentURLs []string `json:"attachment_urls"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		expiry := fmt.Sprintf("%x", time.Now().Add(24*time.Hour).Unix())
+		var resp RefreshURLsResponse
+		for _, u := range body.AttachmentURLs {
+			resp.RefreshedURLs = append(resp.RefreshedURLs, struct {
+				Original  string `json:"original"`
+				Refreshed string `json:"refreshed"`
+			}{u, u + "?ex=" + expiry + "&is=0&hm=0"})
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/messages"):
+		f.mu.Lock()
+		f.uploads++
+		fail := f.failUpload != nil && f.failUpload(f.uploads)
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"message": "Internal Server Error", "code": 0}`)
+			return
+		}
+		file, header, err := r.FormFile("files[0]")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		channelID := strings.Split(r.URL.Path, "/")[len(strings.Split(r.URL.Path, "/"))-2]
+		f.mu.Lock()
+		f.nextID++
+		id := f.nextID
+		f.files[fmt.Sprintf("/attachments/%s/%d/%s", channelID, id, header.Filename)] = content
+		f.mu.Unlock()
+		fmt.Fprintf(w, `{"id": "%d", "channel_id": %q, "attachments": [{"id": "%d", "filename": %q, "size": %d}]}`, id, channelID, id, header.Filename, len(content))
+
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.URL.Path)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasPrefix(r.URL.Path, "/attachments/"):
+		f.mu.Lock()
+		content, ok := f.files[r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newTestRouter returns the public router of a deployment configured by
+// config, calling Discord through client.
+func newTestRouter(t *testing.T, config *Config, client *DiscordClient) *Engine {
+	t.Helper()
+	store, err := OpenStore(t.TempDir() + "/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, _, _ := setupRouter(config, client, store, NewTransformer(client, NewByteCache(1<<20)), NewPosterExtractor("ffmpeg", NewByteCache(1<<20)), newLocalCounter(), nil)
+	return router
+}
+
+// doRequest sends a request to router, with headers given as name and value
+// pairs.
+func doRequest(router http.Handler, method, target string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,389 @@
+package discordcdn
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheDisk = "disk"
+
+// diskCacheMagic starts every file of the disk cache, followed by the
+// content type and key, a line each, then the content.
+const diskCacheMagic = "DCDN1\n"
+
+// diskCacheTempPrefix names files still being written, which are left over
+// only by a crash and removed on startup.
+const diskCacheTempPrefix = ".tmp-"
+
+// DiskCache is a size-bounded LRU cache of attachment content on disk, so
+// hot files are served without going to Discord at all. Entries survive
+// restarts: the directory is read back on startup, the least recently used
+// files being those modified longest ago.
+type DiskCache struct {
+	dir         string
+	maxBytes    int64
+	maxFileSize int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key         string
+	name        string
+	contentType string
+	// offset is where the content starts in the file, after the header.
+	offset int64
+	size   int64
+	used   time.Time
+}
+
+// OpenDiskCache opens the disk cache in dir, creating it if needed, and
+// indexes the entries already there.
+func OpenDiskCache(dir string, maxBytes, maxFileSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		ll:          list.New(),
+		items:       map[string]*list.Element{},
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*diskCacheEntry
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), diskCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		entry, err := d.readEntry(file.Name())
+		if err != nil {
+			logAt(slog.LevelWarn, "Removing unreadable disk cache file %s: %v", file.Name(), err)
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		// Entries cached before keys carried the channel can't be checked
+		// against it.
+		if path, _, _ := strings.Cut(entry.key, "?"); !strings.Contains(path, "/") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, entry := range entries {
+		d.items[entry.key] = d.ll.PushFront(entry)
+		d.size += entry.offset + entry.size
+	}
+	d.evict()
+	logAt(slog.LevelInfo, "Disk cache holds %d files, %d bytes", d.ll.Len(), d.size)
+	return d, nil
+}
+
+func (d *DiskCache) readEntry(name string) (*diskCacheEntry, error) {
+	f, err := os.Open(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, 4096))
+	var header [3]string
+	for i := range header {
+		if header[i], err = r.ReadString('\n'); err != nil {
+			return nil, errors.New("truncated header")
+		}
+	}
+	if header[0] != diskCacheMagic {
+		return nil, errors.New("not a disk cache file")
+	}
+	offset := int64(len(header[0]) + len(header[1]) + len(header[2]))
+	return &diskCacheEntry{
+		key:         strings.TrimSuffix(header[2], "\n"),
+		name:        name,
+		contentType: strings.TrimSuffix(header[1], "\n"),
+		offset:      offset,
+		size:        info.Size() - offset,
+		used:        info.ModTime(),
+	}, nil
+}
+
+// diskCacheName names the file of a key.
+func diskCacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// DiskCacheKey keys an attachment's content by channel and file ID, and
+// media proxy parameters for the variants Discord renders. Entries are
+// served after checking access to the channel alone, so the key has to tie
+// the file to the channel Discord refreshed it in; otherwise a link pairing
+// a channel the caller may see with a file from another would hit.
+func DiskCacheKey(data *LinkData) string {
+	key := fmt.Sprintf("%d/%d", data.ChannelID, data.FileID)
+	if len(data.Media) > 0 {
+		key += "?" + data.Media.Encode()
+	}
+	return key
+}
+
+// Open returns the file of a cached entry with a reader of its content, and
+// the content's type. The caller closes the file.
+func (d *DiskCache) Open(key string) (*os.File, *io.SectionReader, string, bool) {
+	start := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.items[key]
+	if !ok {
+		recordCacheLookup(cacheDisk, start, false, 0)
+		return nil, nil, "", false
+	}
+	entry := el.Value.(*diskCacheEntry)
+	path := filepath.Join(d.dir, entry.name)
+	f, err := os.Open(path)
+	if err != nil {
+		logAt(slog.LevelWarn, "Dropping disk cache entry %s: %v", key, err)
+		d.removeElement(el)
+		recordCacheLookup(cacheDisk, start, false, 0)
+		return nil, nil, "", false
+	}
+	d.ll.MoveToFront(el)
+	now := time.Now()
+	// The modification time orders entries after a restart.
+	os.Chtimes(path, now, now)
+	recordCacheLookup(cacheDisk, start, true, now.Sub(entry.used))
+	entry.used = now
+	return f, io.NewSectionReader(f, entry.offset, entry.size), entry.contentType, true
+}
+
+// Create starts writing an entry of the given size, or -1 if unknown,
+// returning nil if it is too large to cache.
+func (d *DiskCache) Create(key, contentType string, size int64) *DiskCacheWriter {
+	if size > d.maxFileSize || size > d.maxBytes {
+		return nil
+	}
+	f, err := os.CreateTemp(d.dir, diskCacheTempPrefix+"*")
+	if err != nil {
+		logAt(slog.LevelError, "Failed to create disk cache file: %v", err)
+		return nil
+	}
+	w := &DiskCacheWriter{cache: d, f: f, entry: &diskCacheEntry{key: key, name: diskCacheName(key), contentType: contentType}}
+	header := diskCacheMagic + contentType + "\n" + key + "\n"
+	w.entry.offset = int64(len(header))
+	if _, w.err = io.WriteString(f, header); w.err != nil {
+		w.Abort()
+		return nil
+	}
+	return w
+}
+
+// Evict removes the entries of an attachment, such as one taken down, and
+// returns how many it removed.
+func (d *DiskCache) Evict(fileID int64) int {
+	id := strconv.FormatInt(fileID, 10)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := 0
+	for key, el := range d.items {
+		path, _, _ := strings.Cut(key, "?")
+		if _, file, _ := strings.Cut(path, "/"); file == id {
+			d.removeElement(el)
+			removed++
+		}
+	}
+	recordCacheSize(cacheDisk, d.ll.Len(), d.size)
+	return removed
+}
+
+// Clear removes every entry and returns how many there were.
+func (d *DiskCache) Clear() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.ll.Len()
+	for d.ll.Len() > 0 {
+		d.removeElement(d.ll.Back())
+	}
+	recordCacheSize(cacheDisk, 0, 0)
+	return n
+}
+
+// add indexes a written entry, replacing any earlier one under its key, and
+// evicts the least recently used entries until the cache fits.
+func (d *DiskCache) add(entry *diskCacheEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[entry.key]; ok {
+		// The file was replaced already, so only the index is updated.
+		old := el.Value.(*diskCacheEntry)
+		d.ll.Remove(el)
+		delete(d.items, old.key)
+		d.size -= old.offset + old.size
+	}
+	d.items[entry.key] = d.ll.PushFront(entry)
+	d.size += entry.offset + entry.size
+	d.evict()
+	recordCacheSize(cacheDisk, d.ll.Len(), d.size)
+}
+
+func (d *DiskCache) evict() {
+	for d.size > d.maxBytes && d.ll.Len() > 0 {
+		d.removeElement(d.ll.Back())
+		metrics.Count("cache.evictions", 1, "cache:"+cacheDisk)
+	}
+}
+
+func (d *DiskCache) removeElement(el *list.Element) {
+	entry := el.Value.(*diskCacheEntry)
+	d.ll.Remove(el)
+	delete(d.items, entry.key)
+	d.size -= entry.offset + entry.size
+	// Open files are still read to the end after they are removed.
+	if err := os.Remove(filepath.Join(d.dir, entry.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logAt(slog.LevelWarn, "Failed to remove disk cache file %s: %v", entry.name, err)
+	}
+}
+
+// DiskCacheWriter writes an entry of the disk cache alongside a response.
+// Failing to write only gives up on caching, never on the response.
+type DiskCacheWriter struct {
+	cache *DiskCache
+	f     *os.File
+	entry *diskCacheEntry
+	err   error
+}
+
+func (w *DiskCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if w.entry.size+int64(len(p)) > w.cache.maxFileSize {
+		w.err = errors.New("too large to cache")
+		return len(p), nil
+	}
+	n, err := w.f.Write(p)
+	w.entry.size += int64(n)
+	w.err = err
+	return len(p), nil
+}
+
+// Commit adds the entry to the cache if all of its content, of the given
+// size or -1 if unknown, was written.
+func (w *DiskCacheWriter) Commit(size int64) {
+	if w.err == nil && size >= 0 && w.entry.size != size {
+		w.err = fmt.Errorf("wrote %d of %d bytes", w.entry.size, size)
+	}
+	if w.err == nil {
+		w.err = w.f.Close()
+	}
+	if w.err != nil {
+		logAt(slog.LevelDebug, "Not caching %s on disk: %v", w.entry.key, w.err)
+		w.Abort()
+		return
+	}
+	w.entry.used = time.Now()
+	if err := os.Rename(w.f.Name(), filepath.Join(w.cache.dir, w.entry.name)); err != nil {
+		logAt(slog.LevelError, "Failed to store disk cache file: %v", err)
+		os.Remove(w.f.Name())
+		return
+	}
+	w.cache.add(w.entry)
+}
+
+// Abort discards the entry.
+func (w *DiskCacheWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// SetDiskCache sets the cache proxied content is kept in.
+func (c *DiscordClient) SetDiskCache(cache *DiskCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.diskCache = cache
+}
+
+// DiskCache returns the disk cache, or nil if there is none.
+func (c *DiscordClient) DiskCache() *DiskCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.diskCache
+}
+
+// serveDiskCached serves an attachment from the disk cache, reporting
+// whether it was there. Cached content is checked by the virus scanner like
+// any other, from the copy on disk.
+func serveDiskCached(c *Context, client *DiscordClient, cache *DiskCache, data *LinkData) bool {
+	f, content, contentType, ok := cache.Open(DiskCacheKey(data))
+	if !ok {
+		return false
+	}
+	defer f.Close()
+
+	if scanner := client.Scanner(); scanner != nil {
+		flag, err := scanner.Check(c.Request.Context(), fmt.Sprint(data.FileID), data.Path(), func(context.Context) (io.ReadCloser, int64, error) {
+			return io.NopCloser(io.NewSectionReader(content, 0, content.Size())), content.Size(), nil
+		})
+		if !scanner.allowScanned(c, flag, err) {
+			return true
+		}
+	}
+
+	setContentHeaders(c, contentType)
+	http.ServeContent(c.Writer, c.Request, "", snowflakeTime(data.FileID), content)
+	return true
+}
+
+// handleEvictDiskCache removes an attachment from the disk cache, and the
+// other caches of every replica.
+func handleEvictDiskCache(client *DiscordClient, cache *DiskCache) HandlerFunc {
+	return func(c *Context) {
+		fileID, err := strconv.ParseInt(c.Param("fileID"), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid file ID")
+			return
+		}
+		// Other replicas may have it cached even if this one doesn't.
+		removed := cache.Evict(fileID)
+		client.invalidateAttachment(fileID)
+		if removed == 0 && client.Invalidator() == nil {
+			respondError(c, http.StatusNotFound, codeNotFound, "Attachment isn't cached")
+			return
+		}
+		logf(c, slog.LevelInfo, "Evicted %d from the disk cache", fileID)
+		c.Status(http.StatusNoContent)
+	}
+}
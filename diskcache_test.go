@@ -0,0 +1,91 @@
+package discordcdn
+
+import (
+	"io"
+	"net/url"
+	"testing"
+)
+
+func putDiskCache(t *testing.T, cache *DiskCache, key, content string) {
+	t.Helper()
+	w := cache.Create(key, "image/png", int64(len(content)))
+	if w == nil {
+		t.Fatalf("Create(%q) = nil", key)
+	}
+	w.Write([]byte(content))
+	w.Commit(int64(len(content)))
+}
+
+func TestDiskCacheKey(t *testing.T) {
+	tests := []struct {
+		name string
+		data *LinkData
+		want string
+	}{
+		{"original", &LinkData{ChannelID: testChannelID, FileID: testFileID}, "1151234567890123456/1151234567890123457"},
+		{"media parameters", &LinkData{ChannelID: testChannelID, FileID: testFileID, Media: url.Values{"width": {"320"}}}, "1151234567890123456/1151234567890123457?width=320"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiskCacheKey(tt.data); got != tt.want {
+				t.Errorf("DiskCacheKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskCacheChannelMismatch(t *testing.T) {
+	cache, err := OpenDiskCache(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := &LinkData{ChannelID: testChannelID, FileID: testFileID}
+	putDiskCache(t, cache, DiskCacheKey(cached), "secret")
+
+	other := &LinkData{ChannelID: testChannelID + 100, FileID: testFileID}
+	if f, _, _, ok := cache.Open(DiskCacheKey(other)); ok {
+		f.Close()
+		t.Fatal("file cached for one channel was served for another")
+	}
+
+	f, content, _, ok := cache.Open(DiskCacheKey(cached))
+	if !ok {
+		t.Fatal("cached file missed")
+	}
+	defer f.Close()
+	if body, _ := io.ReadAll(content); string(body) != "secret" {
+		t.Errorf("content = %q, want %q", body, "secret")
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	cache, err := OpenDiskCache(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putDiskCache(t, cache, DiskCacheKey(&LinkData{ChannelID: testChannelID, FileID: testFileID}), "a")
+	putDiskCache(t, cache, DiskCacheKey(&LinkData{ChannelID: testChannelID, FileID: testFileID, Media: url.Values{"width": {"320"}}}), "b")
+	putDiskCache(t, cache, DiskCacheKey(&LinkData{ChannelID: testChannelID, FileID: testFileID + 1}), "c")
+
+	if removed := cache.Evict(testFileID); removed != 2 {
+		t.Errorf("Evict() = %d, want 2", removed)
+	}
+}
+
+func TestDiskCacheDropsUnscopedEntries(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenDiskCache(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putDiskCache(t, cache, "1151234567890123457", "old")
+	putDiskCache(t, cache, DiskCacheKey(&LinkData{ChannelID: testChannelID, FileID: testFileID}), "new")
+
+	reopened, err := OpenDiskCache(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := reopened.ll.Len(); n != 1 {
+		t.Errorf("reopened cache holds %d entries, want 1", n)
+	}
+}
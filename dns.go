@@ -0,0 +1,138 @@
+package discordcdn
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsIdleExpiry is how long a host nobody connects to keeps being refreshed.
+const dnsIdleExpiry = time.Hour
+
+// DNSCache resolves upstream hosts and keeps their addresses for ttl, so calls
+// to Discord don't wait on DNS, and refreshes them in the background. When a
+// lookup fails the last addresses are kept, riding out resolvers that fail
+// intermittently, as they do in some container environments.
+type DNSCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs    []string
+	resolved time.Time
+	used     time.Time
+	// next picks the address tried first, spreading connections over the
+	// host's addresses.
+	next atomic.Uint32
+}
+
+func NewDNSCache(ttl time.Duration) *DNSCache {
+	return &DNSCache{resolver: net.DefaultResolver, ttl: ttl, entries: map[string]*dnsEntry{}}
+}
+
+// lookup returns the addresses of host, resolving it only if the cached ones
+// are older than the TTL.
+func (d *DNSCache) lookup(ctx context.Context, host string) (*dnsEntry, error) {
+	now := time.Now()
+	d.mu.Lock()
+	entry := d.entries[host]
+	if entry != nil {
+		entry.used = now
+	}
+	d.mu.Unlock()
+	if entry != nil && now.Sub(entry.resolved) < d.ttl {
+		metrics.Count("dns.lookups", 1, "result:hit")
+		recordCacheLookup(cacheDNS, now, true, now.Sub(entry.resolved))
+		return entry, nil
+	}
+	// Misses include the time resolving the host takes.
+	defer recordCacheLookup(cacheDNS, now, false, 0)
+	return d.resolve(ctx, host, entry)
+}
+
+// resolve looks host up and caches the result. If the lookup fails, previous
+// is returned when there is one.
+func (d *DNSCache) resolve(ctx context.Context, host string, previous *dnsEntry) (*dnsEntry, error) {
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		if previous != nil {
+			metrics.Count("dns.lookups", 1, "result:stale")
+			metrics.Count("cache.stale_serves", 1, "cache:"+cacheDNS)
+			return previous, nil
+		}
+		metrics.Count("dns.lookups", 1, "result:error")
+		return nil, err
+	}
+	metrics.Count("dns.lookups", 1, "result:miss")
+
+	now := time.Now()
+	entry := &dnsEntry{addrs: addrs, resolved: now, used: now}
+	d.mu.Lock()
+	if previous != nil {
+		entry.used = previous.used
+	}
+	d.entries[host] = entry
+	recordCacheSize(cacheDNS, len(d.entries), -1)
+	d.mu.Unlock()
+	return entry, nil
+}
+
+// run re-resolves every host in use each interval, so connections rarely
+// wait on a lookup. Hosts not connected to for a while are dropped.
+func (d *DNSCache) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		d.mu.Lock()
+		stale := map[string]*dnsEntry{}
+		for host, entry := range d.entries {
+			if now.Sub(entry.used) > dnsIdleExpiry {
+				delete(d.entries, host)
+				metrics.Count("cache.evictions", 1, "cache:"+cacheDNS)
+				continue
+			}
+			stale[host] = entry
+		}
+		recordCacheSize(cacheDNS, len(d.entries), -1)
+		d.mu.Unlock()
+
+		for host, entry := range stale {
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamDialTimeout)
+			if _, err := d.resolve(ctx, host, entry); err != nil {
+				logAt(slog.LevelError, "Failed to refresh DNS for %s: %v", host, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// dialer returns a DialContext function that connects through the cache,
+// trying each of the host's addresses in turn.
+func (d *DNSCache) dialer(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		entry, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		start := int(entry.next.Add(1))
+		var conn net.Conn
+		for i := range entry.addrs {
+			ip := entry.addrs[(start+i)%len(entry.addrs)]
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,14 @@
+package discordcdn
+
+import (
+	"net/http"
+)
+
+// sendEarlyHints sends a 103 Early Hints response asking the client to
+// preload target while the final response is prepared. The response writer
+// passes informational responses straight through, so the final status is
+// unaffected.
+func sendEarlyHints(c *Context, target string) {
+	c.Writer.Header().Add("Link", "<"+target+">; rel=preload")
+	c.Writer.WriteHeader(http.StatusEarlyHints)
+}
@@ -0,0 +1,136 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// egress is one way out to Discord: a local address connections leave from,
+// or a proxy they go through.
+type egress struct {
+	// name identifies the egress in logs and metrics, without any proxy
+	// credentials.
+	name      string
+	transport *http.Transport
+	// benchedUntil is when the egress may be used again after failing, in
+	// Unix nanoseconds.
+	benchedUntil atomic.Int64
+}
+
+// EgressPool spreads calls to Discord over several egresses in turn, so
+// high-volume deployments don't run into throttling of a single address.
+// An egress whose connections fail, or that Discord throttles by IP rather
+// than by token, is benched for a cooldown and skipped until then. Each
+// egress has its own connections, so they keep being reused as before.
+type EgressPool struct {
+	egresses []*egress
+	next     atomic.Uint64
+	cooldown time.Duration
+}
+
+// NewEgressPool builds a pool from entries that are local IP addresses,
+// network interface names or http://, https://, socks5:// or socks5h://
+// proxy URLs. newTransport returns the transport for an egress, given the
+// address to bind to, if any.
+func NewEgressPool(entries []string, cooldown time.Duration, newTransport func(bind net.IP) *http.Transport) (*EgressPool, error) {
+	pool := &EgressPool{cooldown: cooldown}
+	for _, entry := range entries {
+		e, err := newEgress(entry, newTransport)
+		if err != nil {
+			return nil, err
+		}
+		pool.egresses = append(pool.egresses, e)
+	}
+	return pool, nil
+}
+
+func newEgress(entry string, newTransport func(bind net.IP) *http.Transport) (*egress, error) {
+	if !strings.Contains(entry, "://") {
+		ip, err := outboundBindIP(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+		return &egress{name: ip.String(), transport: newTransport(ip)}, nil
+	}
+	u, err := url.Parse(entry)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%s proxies aren't supported", u.Scheme)
+	}
+	transport := newTransport(nil)
+	transport.Proxy = http.ProxyURL(u)
+	return &egress{name: u.Scheme + "://" + u.Host, transport: transport}, nil
+}
+
+// pick returns the next egress that isn't benched, or the one back soonest
+// if they all are, so calls are never refused for want of one.
+func (p *EgressPool) pick() *egress {
+	now := time.Now().UnixNano()
+	start := p.next.Add(1)
+	var soonest *egress
+	for i := range p.egresses {
+		e := p.egresses[(start+uint64(i))%uint64(len(p.egresses))]
+		until := e.benchedUntil.Load()
+		if until <= now {
+			return e
+		}
+		if soonest == nil || until < soonest.benchedUntil.Load() {
+			soonest = e
+		}
+	}
+	return soonest
+}
+
+func (p *EgressPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := p.pick()
+	resp, err := e.transport.RoundTrip(req)
+	switch {
+	case err != nil:
+		// Calls given up on say nothing about the egress.
+		if req.Context().Err() == nil {
+			p.bench(e, p.cooldown, err.Error())
+		}
+		metrics.Count("egress.requests", 1, "egress:"+e.name, "result:error")
+	case resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("X-RateLimit-Scope") == "":
+		// Discord's own rate limits, which apply to the token whatever
+		// the address, carry a scope; throttling in front of the API, such
+		// as Cloudflare's, applies to the address.
+		wait := p.cooldown
+		if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+			wait = max(wait, time.Duration(seconds*float64(time.Second)))
+		}
+		p.bench(e, wait, "throttled")
+		metrics.Count("egress.requests", 1, "egress:"+e.name, "result:throttled")
+	default:
+		metrics.Count("egress.requests", 1, "egress:"+e.name, "result:ok")
+	}
+	return resp, err
+}
+
+// bench keeps an egress out of rotation for d, logging it unless it already
+// was.
+func (p *EgressPool) bench(e *egress, d time.Duration, reason string) {
+	now := time.Now()
+	if e.benchedUntil.Swap(now.Add(d).UnixNano()) < now.UnixNano() {
+		logAt(slog.LevelWarn, "Egress %s benched for %s: %s", e.name, d, reason)
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every egress.
+func (p *EgressPool) CloseIdleConnections() {
+	for _, e := range p.egresses {
+		e.transport.CloseIdleConnections()
+	}
+}
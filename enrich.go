@@ -0,0 +1,156 @@
+package discordcdn
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// maxContentSnippet is how many characters of a message's text are
+	// indexed with its attachments.
+	maxContentSnippet = 200
+	// enrichQueueSize bounds the attachments waiting to be looked up; more
+	// are dropped until the enricher catches up.
+	enrichQueueSize = 1000
+	// enrichRetry is how long an attachment that couldn't be found is left
+	// alone before it is looked up again.
+	enrichRetry = time.Hour
+	// enrichAround is how many messages around an attachment's ID are
+	// searched for the one it was posted with.
+	enrichAround = 100
+)
+
+// Enricher indexes the attachments the server refreshes that the gateway
+// never saw, such as those posted before indexing was turned on or in
+// channels it doesn't watch. An attachment's ID is minted moments before its
+// message, so the message is found among those around that ID, and gives
+// the uploader, timestamp, text and content type the index needs.
+type Enricher struct {
+	client *DiscordClient
+	store  *Store
+	queue  chan string
+
+	mu sync.Mutex
+	// looked holds when each attachment was queued, so it isn't looked up
+	// again for enrichRetry.
+	looked map[int64]time.Time
+}
+
+func NewEnricher(client *DiscordClient, store *Store) *Enricher {
+	return &Enricher{
+		client: client,
+		store:  store,
+		queue:  make(chan string, enrichQueueSize),
+		looked: map[int64]time.Time{},
+	}
+}
+
+// SetEnricher sets the enricher told about every attachment refreshed.
+func (c *DiscordClient) SetEnricher(enricher *Enricher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enricher = enricher
+}
+
+// enrich queues the refreshed attachments for the enricher, if there is one.
+func (c *DiscordClient) enrich(refreshed map[string]string) {
+	c.mu.RLock()
+	enricher := c.enricher
+	c.mu.RUnlock()
+	if enricher == nil {
+		return
+	}
+	for attachmentURL, newURL := range refreshed {
+		if newURL != "" {
+			enricher.enqueue(attachmentURL)
+		}
+	}
+}
+
+// enqueue queues an attachment to be looked up, unless it is indexed
+// already or was looked up recently.
+func (e *Enricher) enqueue(attachmentURL string) {
+	_, fileID := attachmentIDs(attachmentURL)
+	if fileID == 0 || e.store.HasAttachment(fileID) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if queued, ok := e.looked[fileID]; ok && now.Sub(queued) < enrichRetry {
+		return
+	}
+	if len(e.looked) >= 10*enrichQueueSize {
+		for id, queued := range e.looked {
+			if now.Sub(queued) >= enrichRetry {
+				delete(e.looked, id)
+			}
+		}
+	}
+	select {
+	case e.queue <- attachmentURL:
+		e.looked[fileID] = now
+	default:
+		metrics.Count("enrich.lookups", 1, "result:dropped")
+	}
+}
+
+// run looks up the queued attachments one at a time, at background priority.
+func (e *Enricher) run() {
+	for attachmentURL := range e.queue {
+		result := "indexed"
+		indexed, err := e.lookup(attachmentURL)
+		switch {
+		case err != nil:
+			result = "error"
+			logAt(slog.LevelWarn, "Failed to look up the message of %s: %v", attachmentURL, err)
+		case indexed == 0:
+			result = "not_found"
+			logAt(slog.LevelDebug, "No message found for %s", attachmentURL)
+		}
+		metrics.Count("enrich.lookups", 1, "result:"+result)
+	}
+}
+
+// lookup finds the message an attachment was posted with and indexes its
+// attachments, returning how many it indexed.
+func (e *Enricher) lookup(attachmentURL string) (int, error) {
+	channelID, fileID := attachmentIDs(attachmentURL)
+	message, err := e.client.attachmentMessage(PriorityBackground, channelID, fileID)
+	if err != nil || message == nil {
+		return 0, err
+	}
+	attachments := indexedAttachments(message)
+	if err := e.store.IndexAttachments(attachments); err != nil {
+		return 0, fmt.Errorf("failed to index: %w", err)
+	}
+	return len(attachments), nil
+}
+
+// attachmentMessage finds the message an attachment was posted with among
+// those around its ID, returning nil if there is none.
+func (c *DiscordClient) attachmentMessage(priority Priority, channelID, fileID int64) (*Message, error) {
+	var messages []Message
+	path := fmt.Sprintf("/channels/%d/messages?around=%d&limit=%d", channelID, fileID, enrichAround)
+	if err := c.get(priority, c.tokenFor(channelID), "messages", path, &messages); err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		for _, a := range message.Attachments {
+			if a.ID != fileID {
+				continue
+			}
+			// Messages fetched from the API don't say which guild they
+			// belong to.
+			message.ChannelID = channelID
+			message.GuildID = c.ChannelGuild(channelID)
+			return message, nil
+		}
+	}
+	return nil, nil
+}
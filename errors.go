@@ -0,0 +1,146 @@
+package discordcdn
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Error codes returned in the code field of error responses. Clients should
+// branch on these rather than on the human-readable message.
+const (
+	codeAccessDenied        = "access_denied"
+	codeAliasTaken          = "alias_taken"
+	codeAttachmentForbidden = "attachment_forbidden"
+	codeAttachmentNotFound  = "attachment_not_found"
+	codeAttachmentTooLarge  = "attachment_too_large"
+	codeBodyTooLarge        = "body_too_large"
+	codeContentBlocked      = "content_blocked"
+	codeCrawlerBlocked      = "crawler_blocked"
+	codeHotlinkBlocked      = "hotlink_blocked"
+	codeInternal            = "internal_error"
+	codeInvalidConfig       = "invalid_config"
+	codeInvalidLink         = "invalid_link"
+	codeInvalidParameter    = "invalid_parameter"
+	codeInvalidUpload       = "invalid_upload"
+	codeMaintenance         = "maintenance"
+	codeMalwareDetected     = "malware_detected"
+	codeModerationFailed    = "moderation_failed"
+	codeNotFound            = "not_found"
+	codeOverloaded          = "overloaded"
+	codeQuotaExceeded       = "quota_exceeded"
+	codeRateLimited         = "rate_limited"
+	codeRequestTimeout      = "request_timeout"
+	codeScanFailed          = "scan_failed"
+	codeShareExpired        = "share_expired"
+	codeShareUsed           = "share_used"
+	codeTakenDown           = "taken_down"
+	codeTooManyJobs         = "too_many_jobs"
+	codeTooManyTransfers    = "too_many_transfers"
+	codeUnauthorized        = "unauthorized"
+	codeUnsupportedMedia    = "unsupported_media"
+	codeUpstreamError       = "upstream_error"
+	codeUpstreamRateLimited = "upstream_rate_limited"
+)
+
+// errorCodes lists every error code, for the OpenAPI document.
+var errorCodes = []string{
+	codeAccessDenied, codeAliasTaken, codeAttachmentForbidden, codeAttachmentNotFound, codeAttachmentTooLarge,
+	codeBodyTooLarge, codeContentBlocked, codeCrawlerBlocked, codeHotlinkBlocked, codeInternal, codeInvalidConfig,
+	codeInvalidLink, codeInvalidParameter, codeInvalidUpload, codeMaintenance, codeMalwareDetected, codeModerationFailed,
+	codeNotFound, codeOverloaded, codeQuotaExceeded, codeRateLimited, codeRequestTimeout, codeScanFailed,
+	codeShareExpired, codeShareUsed, codeTakenDown, codeTooManyJobs, codeTooManyTransfers, codeUnauthorized, codeUnsupportedMedia,
+	codeUpstreamError, codeUpstreamRateLimited,
+}
+
+// ErrorResponse is the envelope used for every error returned by the API.
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestID,omitempty"`
+	// Discord is what Discord said about a refresh it refused, if anything.
+	Discord *DiscordErrorDetails `json:"discord,omitempty"`
+}
+
+// respondError aborts the request with an error envelope.
+func respondError(c *Context, status int, code, message string) {
+	c.Set(errorCodeKey, code)
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Error:     message,
+		Code:      code,
+		RequestID: c.GetString(requestIDKey),
+	})
+}
+
+// refreshFailure describes how a failed refresh is reported to clients.
+type refreshFailure struct {
+	status  int
+	code    string
+	message string
+	// upstream marks failures worth reporting, as opposed to attachments
+	// that are simply gone or inaccessible.
+	upstream bool
+}
+
+// classifyRefreshError translates a failed refresh into a client-facing
+// failure, keeping 502 for genuine upstream failures.
+func classifyRefreshError(err error) refreshFailure {
+	if errors.Is(err, errAttachmentNotFound) {
+		return refreshFailure{http.StatusNotFound, codeAttachmentNotFound, "Attachment not found", false}
+	}
+	var takedown *TakedownError
+	if errors.As(err, &takedown) {
+		return refreshFailure{takedown.Status, codeTakenDown, "Attachment was taken down", false}
+	}
+	var overload *OverloadError
+	if errors.As(err, &overload) {
+		return refreshFailure{http.StatusServiceUnavailable, codeOverloaded, "The server is overloaded, try again later", false}
+	}
+
+	var discordErr *DiscordError
+	if errors.As(err, &discordErr) {
+		switch discordErr.StatusCode {
+		case http.StatusNotFound:
+			return refreshFailure{http.StatusNotFound, codeAttachmentNotFound, "Attachment not found", false}
+		case http.StatusForbidden:
+			return refreshFailure{http.StatusForbidden, codeAttachmentForbidden, "No access to attachment", false}
+		case http.StatusTooManyRequests:
+			return refreshFailure{http.StatusTooManyRequests, codeUpstreamRateLimited, "Rate limited by Discord", true}
+		}
+	}
+
+	return refreshFailure{http.StatusBadGateway, codeUpstreamError, "Failed to refresh URL", true}
+}
+
+// respondRefreshError sends the error response for a failed refresh.
+func respondRefreshError(c *Context, err error) {
+	logf(c, slog.LevelError, "Error refreshing attachment URL: %v", err)
+	if timedOut(c) {
+		respondTimeout(c)
+		return
+	}
+	if respondOverloaded(c, err) {
+		return
+	}
+
+	failure := classifyRefreshError(err)
+	var discordErr *DiscordError
+	errors.As(err, &discordErr)
+	if discordErr != nil && discordErr.RetryAfter != "" && failure.status == http.StatusTooManyRequests {
+		c.Header("Retry-After", discordErr.RetryAfter)
+	}
+	if failure.upstream {
+		reportError(c, err)
+	}
+	if discordErr != nil && discordErr.details() != nil {
+		c.Set(errorCodeKey, failure.code)
+		c.AbortWithStatusJSON(failure.status, ErrorResponse{
+			Error:     failure.message,
+			Code:      failure.code,
+			RequestID: c.GetString(requestIDKey),
+			Discord:   discordErr.details(),
+		})
+		return
+	}
+	respondError(c, failure.status, failure.code, failure.message)
+}
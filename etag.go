@@ -0,0 +1,47 @@
+package discordcdn
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// attachmentETag derives a strong ETag for an attachment response. Discord
+// attachments are immutable, so the file ID identifies the content and only
+// requested variants need to be folded in.
+func attachmentETag(data *LinkData, transform *TransformOptions) string {
+	variant := data.Media.Encode()
+	if transform != nil {
+		variant += "|" + transform.cacheKey(data.ChannelID, data.FileID)
+	}
+	if variant == "" {
+		return fmt.Sprintf(`"%d"`, data.FileID)
+	}
+
+	sum := sha1.Sum([]byte(variant))
+	return fmt.Sprintf(`"%d-%s"`, data.FileID, hex.EncodeToString(sum[:6]))
+}
+
+// notModified reports whether the request's validators show the client
+// already holds the current representation. If-None-Match takes precedence
+// over If-Modified-Since, as in RFC 9110.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
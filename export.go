@@ -0,0 +1,221 @@
+package discordcdn
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var usageExportCSVHeader = []string{"day", "kind", "id", "requests", "refreshes", "refreshErrors"}
+
+// UsageExportRow is one line of a usage export: the counts of an API key or
+// a channel on a day, or over the whole range when grouped by total.
+// Refreshes are only tracked for channels.
+type UsageExportRow struct {
+	Day  string `json:"day,omitempty"`
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	UsageCounts
+}
+
+// usageExport describes which usage to export and how.
+type usageExport struct {
+	from, to string
+	// total sums each key and channel over the range instead of reporting
+	// each day.
+	total bool
+	csv   bool
+}
+
+// parseUsageExport validates the options of an export. The range defaults
+// to the current UTC month so far.
+func parseUsageExport(from, to, group, format string) (usageExport, error) {
+	now := time.Now().UTC()
+	e := usageExport{
+		from: now.Format("2006-01") + "-01",
+		to:   now.Format(usageDayFormat),
+	}
+	if from != "" {
+		if _, err := time.Parse(usageDayFormat, from); err != nil {
+			return e, errors.New("from must be a date such as 2006-01-02")
+		}
+		e.from = from
+	}
+	if to != "" {
+		if _, err := time.Parse(usageDayFormat, to); err != nil {
+			return e, errors.New("to must be a date such as 2006-01-02")
+		}
+		e.to = to
+	}
+	if e.to < e.from {
+		return e, errors.New("to must not be before from")
+	}
+
+	switch group {
+	case "", "day":
+	case "total":
+		e.total = true
+	default:
+		return e, errors.New("group must be day or total")
+	}
+	switch format {
+	case "", "json":
+	case "csv":
+		e.csv = true
+	default:
+		return e, errors.New("format must be json or csv")
+	}
+	return e, nil
+}
+
+// rows returns the export's rows ordered by day, then keys before channels.
+func (e *usageExport) rows(usage *UsageData) []UsageExportRow {
+	type rowKey struct{ day, kind, id string }
+	counts := map[rowKey]*UsageCounts{}
+	add := func(day, kind, id string, c *UsageCounts) {
+		if day < e.from || day > e.to {
+			return
+		}
+		if e.total {
+			day = ""
+		}
+		k := rowKey{day, kind, id}
+		if counts[k] == nil {
+			counts[k] = &UsageCounts{}
+		}
+		counts[k].add(c)
+	}
+	for id, days := range usage.Keys {
+		for day, n := range days {
+			add(day, "key", id, &UsageCounts{Requests: n})
+		}
+	}
+	for channel, days := range usage.ChannelDays {
+		for day, c := range days {
+			add(day, "channel", channel, c)
+		}
+	}
+
+	rows := make([]UsageExportRow, 0, len(counts))
+	for k, c := range counts {
+		rows = append(rows, UsageExportRow{Day: k.day, Kind: k.kind, ID: k.id, UsageCounts: *c})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Kind != b.Kind {
+			return a.Kind == "key"
+		}
+		return a.ID < b.ID
+	})
+	return rows
+}
+
+func (e *usageExport) write(w io.Writer, usage *UsageData) error {
+	rows := e.rows(usage)
+	if !e.csv {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			From string           `json:"from"`
+			To   string           `json:"to"`
+			Rows []UsageExportRow `json:"rows"`
+		}{e.from, e.to, rows})
+	}
+
+	out := csv.NewWriter(w)
+	out.Write(usageExportCSVHeader)
+	for _, r := range rows {
+		out.Write([]string{
+			r.Day,
+			r.Kind,
+			r.ID,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.Refreshes, 10),
+			strconv.FormatInt(r.RefreshErrors, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// handleUsageExport exports per-key and per-channel usage between ?from and
+// ?to as JSON or, with ?format=csv, as a CSV download.
+func handleUsageExport(tracker *UsageTracker, store *Store) HandlerFunc {
+	return func(c *Context) {
+		export, err := parseUsageExport(c.Query("from"), c.Query("to"), c.Query("group"), c.Query("format"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid export: "+err.Error())
+			return
+		}
+
+		tracker.Flush()
+		usage := store.Usage()
+
+		if export.csv {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`, export.from, export.to))
+		} else {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+		}
+		c.Status(http.StatusOK)
+		if err := export.write(c.Writer, usage); err != nil {
+			logf(c, slog.LevelError, "Failed to write usage export: %v", err)
+		}
+	}
+}
+
+// runUsageExport implements the usage-export subcommand, which exports usage
+// from the store file. Counts a running server hasn't saved yet, at most a
+// minute's worth, are not included.
+func runUsageExport(args []string) error {
+	fs := flag.NewFlagSet("usage-export", flag.ExitOnError)
+	from := fs.String("from", "", "first day to export, such as 2006-01-02 (default: start of this month)")
+	to := fs.String("to", "", "last day to export (default: today)")
+	group := fs.String("group", "day", "report each day, or the total over the range (day or total)")
+	format := fs.String("format", "csv", "output format (csv or json)")
+	output := fs.String("o", "", "file to write to (default: standard output)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn usage-export [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	export, err := parseUsageExport(*from, *to, *group, *format)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return export.write(os.Stdout, store.Usage())
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := export.write(file, store.Usage()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
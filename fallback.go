@@ -0,0 +1,362 @@
+package discordcdn
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fallbacks tried, in the configured order, when Discord can't refresh a
+// link.
+const (
+	// fallbackStale reuses the last URL Discord returned for the
+	// attachment, while its signature is still valid.
+	fallbackStale = "stale"
+	// fallbackMirror points at a copy of the attachment under the mirror URL.
+	fallbackMirror = "mirror"
+	// fallbackCDN passes the unsigned CDN URL through as is.
+	fallbackCDN = "cdn"
+)
+
+var refreshFallbacks = []string{fallbackStale, fallbackMirror, fallbackCDN}
+
+// SetFallbacks sets the fallbacks tried in order when a refresh fails.
+// mirrorURL is the base URL of the mirror, and staleSize how many refreshed
+// URLs are remembered for the stale fallback and Early Hints.
+func (c *DiscordClient) SetFallbacks(chain []string, mirrorURL string, staleSize int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallbacks = chain
+	c.mirrorURL = strings.TrimSuffix(mirrorURL, "/")
+	c.stale = newURLCache(staleSize)
+}
+
+// SetMirrorDeleted sets whether attachments Discord reports as deleted are
+// served from the mirror, when it has a copy.
+func (c *DiscordClient) SetMirrorDeleted(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mirrorDeleted = enabled
+}
+
+// remember records refreshed URLs, once the URL cache is set up. Responses
+// cached downstream still point at a URL that was replaced, so those are
+// purged.
+func (c *DiscordClient) remember(refreshed map[string]string) {
+	c.mu.RLock()
+	stale := c.stale
+	c.mu.RUnlock()
+	if stale == nil {
+		return
+	}
+	for original, newURL := range refreshed {
+		if newURL == "" {
+			continue
+		}
+		if previous := stale.Put(original, newURL); previous != "" && previous != newURL {
+			c.purgeAttachment(original)
+		}
+	}
+	c.shareURLs(refreshed)
+}
+
+// CachedURL returns the last URL Discord returned for an attachment, if its
+// signature is still valid.
+func (c *DiscordClient) CachedURL(attachmentURL string) (string, bool) {
+	c.mu.RLock()
+	stale := c.stale
+	c.mu.RUnlock()
+	entry, ok := c.lookupURL(stale, attachmentURL)
+	if !ok {
+		return "", false
+	}
+	cached := entry.url
+	expiry, ok := urlExpiry(cached)
+	if !ok || !time.Now().Before(expiry) {
+		return "", false
+	}
+	return cached, true
+}
+
+// RefreshWithFallback refreshes an attachment URL like RefreshAttachmentURL,
+// but when Discord fails or rate limits the refresh, or the server is too
+// busy to make it, it tries the configured fallbacks in order, and returns the
+// name of the one used. Attachments that
+// are gone or inaccessible aren't papered over, unless the mirror is set to
+// stand in for deleted ones, and neither are failures no fallback can serve. URLs refreshed within the stale-while-revalidate
+// window are returned without waiting for Discord; see revalidate.go.
+func (c *DiscordClient) RefreshWithFallback(ctx context.Context, requester, attachmentURL string) (newURL, fallback string, err error) {
+	if _, fileID := attachmentIDs(attachmentURL); fileID != 0 {
+		if t := c.takedown(fileID); t != nil {
+			return "", "", &TakedownError{FileID: fileID, Status: t.Status}
+		}
+	}
+	if newURL, ok := c.revalidate(requester, attachmentURL); ok {
+		return newURL, "", nil
+	}
+	newURL, err = c.RefreshAttachmentURL(ctx, requester, attachmentURL)
+	if err != nil && classifyRefreshError(err).status == http.StatusNotFound {
+		if target := c.deletedMirror(ctx, attachmentURL); target != "" {
+			logAt(slog.LevelInfo, "Attachment deleted from Discord, serving mirror copy")
+			metrics.Count("refresh.fallbacks", 1, "fallback:"+fallbackMirror)
+			return target, fallbackMirror, nil
+		}
+		return "", "", err
+	}
+	var overload *OverloadError
+	if err == nil || !classifyRefreshError(err).upstream && !errors.As(err, &overload) {
+		return newURL, "", err
+	}
+
+	c.mu.RLock()
+	chain, mirrorURL := c.fallbacks, c.mirrorURL
+	c.mu.RUnlock()
+
+	for _, f := range chain {
+		var target string
+		switch f {
+		case fallbackStale:
+			target, _ = c.CachedURL(attachmentURL)
+		case fallbackMirror:
+			target = mirrorPath(mirrorURL, attachmentURL)
+		case fallbackCDN:
+			target = attachmentURL
+		}
+		if target != "" {
+			logAt(slog.LevelWarn, "Refresh failed (%v), serving %s fallback", err, f)
+			metrics.Count("refresh.fallbacks", 1, "fallback:"+f)
+			if f == fallbackStale {
+				metrics.Count("cache.stale_serves", 1, "cache:"+cacheURLs)
+			}
+			return target, f, nil
+		}
+	}
+	return "", "", err
+}
+
+// mirrorPath returns where the mirror keeps its copy of an attachment.
+func mirrorPath(mirrorURL, attachmentURL string) string {
+	return mirrorURL + "/" + strings.TrimPrefix(attachmentURL, attachmentURLPrefix)
+}
+
+// deletedMirror returns the mirror's copy of an attachment Discord reports
+// as deleted, if deleted attachments are served from the mirror and it
+// answers for the copy. Attachments outside the allowlist also look deleted,
+// so those are never looked up.
+func (c *DiscordClient) deletedMirror(ctx context.Context, attachmentURL string) string {
+	c.mu.RLock()
+	enabled, mirrorURL := c.mirrorDeleted, c.mirrorURL
+	c.mu.RUnlock()
+	if !enabled || mirrorURL == "" || !c.allowsChannel(attachmentChannel(attachmentURL)) {
+		return ""
+	}
+	target := mirrorPath(mirrorURL, attachmentURL)
+	if _, _, err := c.Stat(ctx, target); err != nil {
+		logAt(slog.LevelDebug, "No mirror copy of deleted attachment %s: %v", attachmentURL, err)
+		return ""
+	}
+	return target
+}
+
+func validateFallbacks(chain []string, mirrorURL string) error {
+	for _, f := range chain {
+		if !slices.Contains(refreshFallbacks, f) {
+			return fmt.Errorf("unknown fallback %q, must be one of %s", f, strings.Join(refreshFallbacks, ", "))
+		}
+		if f == fallbackMirror && mirrorURL == "" {
+			return fmt.Errorf("mirror fallback requires %sMIRROR_URL", envPrefix)
+		}
+	}
+	return nil
+}
+
+// urlCache is a bounded LRU map of attachment URLs to their last refreshed
+// URL.
+type urlCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+	// changes counts the URLs stored and removed, so snapshots are only
+	// written when there is something new.
+	changes uint64
+}
+
+type urlCacheEntry struct {
+	key, url     string
+	stored, used time.Time
+	hits         int
+}
+
+func newURLCache(maxEntries int) *urlCache {
+	return &urlCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+func (c *urlCache) Get(key string) (string, bool) {
+	entry, ok := c.Lookup(key)
+	return entry.url, ok
+}
+
+// Lookup returns a copy of the entry for key, with when its URL was stored.
+func (c *urlCache) Lookup(key string) (urlCacheEntry, bool) {
+	if c == nil {
+		return urlCacheEntry{}, false
+	}
+	start := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		recordCacheLookup(cacheURLs, start, false, 0)
+		return urlCacheEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	entry := el.Value.(*urlCacheEntry)
+	entry.used = time.Now()
+	entry.hits++
+	recordCacheLookup(cacheURLs, start, true, entry.used.Sub(entry.stored))
+	return *entry, true
+}
+
+// Delete removes the entry for key, if there is one.
+func (c *urlCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.changes++
+		recordCacheSize(cacheURLs, c.ll.Len(), -1)
+	}
+}
+
+// Clear removes every entry and returns how many there were.
+func (c *urlCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	clear(c.items)
+	c.changes++
+	recordCacheSize(cacheURLs, 0, -1)
+	return n
+}
+
+// DeleteFile removes the entries of an attachment by file ID.
+func (c *urlCache) DeleteFile(fileID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.items {
+		if _, id := attachmentIDs(key); id == fileID {
+			c.ll.Remove(el)
+			delete(c.items, key)
+			c.changes++
+		}
+	}
+	recordCacheSize(cacheURLs, c.ll.Len(), -1)
+}
+
+// Put stores url for key and returns the URL it replaced, if any.
+func (c *urlCache) Put(key, url string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*urlCacheEntry)
+		previous := entry.url
+		if previous != url {
+			c.changes++
+		}
+		entry.url = url
+		entry.stored, entry.used = time.Now(), time.Now()
+		c.ll.MoveToFront(el)
+		return previous
+	}
+	c.items[key] = c.ll.PushFront(&urlCacheEntry{key: key, url: url, stored: time.Now(), used: time.Now()})
+	c.changes++
+	c.trim()
+	return ""
+}
+
+// Restore adds entries read back from a snapshot, most recently used first,
+// keeping when they were stored and used. Entries already cached are left
+// alone, being newer.
+func (c *urlCache) Restore(entries []urlCacheEntry) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	restored := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if _, ok := c.items[entry.key]; ok {
+			continue
+		}
+		c.items[entry.key] = c.ll.PushBack(&entry)
+		restored++
+	}
+	c.trim()
+	return restored
+}
+
+// trim evicts the least recently used entries beyond the bound.
+func (c *urlCache) trim() {
+	for c.ll.Len() > c.maxEntries {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*urlCacheEntry).key)
+		metrics.Count("cache.evictions", 1, "cache:"+cacheURLs)
+	}
+	recordCacheSize(cacheURLs, c.ll.Len(), -1)
+}
+
+// Expire removes the entries last used before cutoff and returns how many
+// it removed and their size.
+func (c *urlCache) Expire(cutoff time.Time) (entries int, bytes int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Back(); el != nil && el.Value.(*urlCacheEntry).used.Before(cutoff); el = c.ll.Back() {
+		entry := el.Value.(*urlCacheEntry)
+		entries++
+		bytes += int64(len(entry.key) + len(entry.url))
+		c.ll.Remove(el)
+		delete(c.items, entry.key)
+		c.changes++
+	}
+	recordCacheSize(cacheURLs, c.ll.Len(), -1)
+	return entries, bytes
+}
+
+// Changes returns how many times the cached URLs have changed.
+func (c *urlCache) Changes() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changes
+}
+
+// Entries returns a copy of the entries, most recently used first.
+func (c *urlCache) Entries() []urlCacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]urlCacheEntry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*urlCacheEntry))
+	}
+	return entries
+}
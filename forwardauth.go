@@ -0,0 +1,101 @@
+package discordcdn
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Identity headers returned by /auth, named as oauth2-proxy names them so
+// edge configurations written for it carry over.
+const (
+	forwardAuthUserHeader     = "X-Auth-Request-User"
+	forwardAuthUsernameHeader = "X-Auth-Request-Preferred-Username"
+)
+
+// ForwardAuth answers the subrequests of reverse proxies that delegate
+// authentication, such as Traefik's ForwardAuth middleware and nginx's
+// auth_request, with the credentials this server accepts: API keys and client
+// certificates, JWTs and Discord logins.
+type ForwardAuth struct {
+	client    *DiscordClient
+	keys      *KeySet
+	certNames []string
+	// jwt and oauth are nil unless enabled.
+	jwt      *JWTVerifier
+	oauth    *OAuthGate
+	basePath string
+}
+
+// handle answers 200 with the caller's identity in X-Auth-Request-User when
+// the request carries valid credentials, and 401 otherwise. When the original
+// request, given in X-Forwarded-Uri or X-Original-URI, is for an attachment,
+// a JWT or login that doesn't grant its channel gets 403.
+func (a *ForwardAuth) handle() HandlerFunc {
+	return func(c *Context) {
+		original := forwardedURI(c)
+		if !a.authenticate(c, original) {
+			logf(c, slog.LevelDebug, "Forward auth refused %s", original.Path)
+			c.Header("WWW-Authenticate", `Bearer realm="discord-cdn"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid credentials")
+			return
+		}
+
+		path := strings.TrimPrefix(original.Path, a.basePath)
+		if parsed := parseLink(path); parsed.Error == "" && !authorizeChannel(c, a.client, parsed.Data.ChannelID) {
+			return
+		}
+
+		c.Header(forwardAuthUserHeader, requesterOf(c))
+		if value, ok := c.Get(sessionKey); ok {
+			c.Header(forwardAuthUsernameHeader, value.(*oauthSession).username)
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// authenticate checks the credentials a request carries, recording whose they
+// are as the matching gate would. A JWT may also be in the token query
+// parameter of the original request, as for embedded media.
+func (a *ForwardAuth) authenticate(c *Context, original *url.URL) bool {
+	if authenticateAPIKey(c, a.keys, a.certNames) {
+		return true
+	}
+	if a.jwt != nil {
+		raw := original.Query().Get("token")
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			raw = strings.TrimPrefix(header, "Bearer ")
+		}
+		if raw != "" {
+			claims, err := a.jwt.verify(raw)
+			if err == nil {
+				c.Set(claimsKey, claims)
+				return true
+			}
+			logf(c, slog.LevelWarn, "Rejected JWT: %v", err)
+		}
+	}
+	if a.oauth != nil {
+		if session := a.oauth.session(c); session != nil {
+			c.Set(sessionKey, session)
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedURI returns the URI of the request being authorized, as Traefik
+// passes it in X-Forwarded-Uri or nginx configurations conventionally in
+// X-Original-URI. It is empty when neither is set or it doesn't parse.
+func forwardedURI(c *Context) *url.URL {
+	raw := c.GetHeader("X-Forwarded-Uri")
+	if raw == "" {
+		raw = c.GetHeader("X-Original-URI")
+	}
+	u, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
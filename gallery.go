@@ -0,0 +1,231 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// galleryMaxAge is how long clients may cache a gallery, and so how long
+// edits to its message can take to show.
+const galleryMaxAge = 5 * time.Minute
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:type" content="website">
+{{- with .Cover}}
+<meta property="og:image" content="{{.URL}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.URL}}">
+{{- else}}
+<meta name="twitter:card" content="summary">
+{{- end}}
+<style>body{margin:0;padding:16px;background:#111;color:#ddd;font-family:sans-serif}p{white-space:pre-wrap}main{display:grid;grid-template-columns:repeat(auto-fill,minmax(280px,1fr));gap:12px}figure{margin:0}img,video,audio{width:100%;border-radius:4px}a{color:#ddd}</style>
+</head>
+<body>
+{{- if .Content}}
+<p>{{.Content}}</p>
+{{- end}}
+<p><a href="?format=zip" download>Download all</a></p>
+<main>
+{{- range .Attachments}}
+<figure>
+{{- if .IsImage}}
+<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.FileName}}" loading="lazy"></a>
+{{- else if .IsVideo}}
+<video src="{{.URL}}" controls preload="metadata"></video>
+{{- else if .IsAudio}}
+<audio src="{{.URL}}" controls preload="metadata"></audio>
+{{- else}}
+<a href="{{.URL}}">{{.FileName}}</a>
+{{- end}}
+</figure>
+{{- end}}
+</main>
+</body>
+</html>
+`))
+
+// GalleryAttachment is an attachment of a gallery, linked through the
+// service.
+type GalleryAttachment struct {
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	PreviewURL  string `json:"previewURL"`
+	// DurationSecs and WaveformURL are set on voice messages.
+	DurationSecs float64 `json:"durationSecs,omitempty"`
+	WaveformURL  string  `json:"waveformURL,omitempty"`
+	IsImage      bool    `json:"-"`
+	IsVideo      bool    `json:"-"`
+	IsAudio      bool    `json:"-"`
+}
+
+// Gallery lists the attachments of a message.
+type Gallery struct {
+	MessageURL  string              `json:"messageURL"`
+	Author      string              `json:"author,omitempty"`
+	Content     string              `json:"content,omitempty"`
+	Timestamp   time.Time           `json:"timestamp"`
+	Attachments []GalleryAttachment `json:"attachments"`
+}
+
+type galleryPage struct {
+	*Gallery
+	Title string
+	// Cover is the first image, shown in embeds of the page.
+	Cover *GalleryAttachment
+}
+
+// parseGalleryPath reads the message a gallery path names: a message link,
+// possibly encoded or with a slash lost after its scheme, or the
+// <guild>/<channel>/<message> part of one.
+func parseGalleryPath(path string) (*MessageLink, bool) {
+	raw := strings.TrimPrefix(path, "/")
+	if decoded, err := url.PathUnescape(raw); err == nil {
+		raw = decoded
+	}
+	if !strings.Contains(raw, "://") {
+		rest := strings.TrimPrefix(strings.TrimPrefix(raw, "https:"), "http:")
+		rest = strings.TrimLeft(rest, "/")
+		if host, _, _ := strings.Cut(rest, "/"); !messageLinkHosts[strings.ToLower(host)] {
+			rest = "discord.com/channels/" + rest
+		}
+		raw = "https://" + rest
+	}
+	return parseMessageLink(raw)
+}
+
+// fetchGalleryMessage fetches the message a gallery path or link names,
+// responding with an error if it can't be served.
+func fetchGalleryMessage(c *Context, client *DiscordClient, raw string) (*MessageLink, *Message, bool) {
+	link, ok := parseGalleryPath(raw)
+	if !ok {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, "Invalid message link")
+		return nil, nil, false
+	}
+	// Messages outside the allowlist look missing, like their attachments.
+	if !client.allowsChannel(link.ChannelID) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Message not found")
+		return nil, nil, false
+	}
+	if !authorizeChannel(c, client, link.ChannelID) || !limitChannel(c, link.ChannelID) {
+		return nil, nil, false
+	}
+
+	message, err := client.Message(link.ChannelID, link.MessageID)
+	var discordErr *DiscordError
+	if errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusNotFound {
+		respondError(c, http.StatusNotFound, codeNotFound, "Message not found")
+		return nil, nil, false
+	}
+	if err != nil {
+		respondRefreshError(c, err)
+		return nil, nil, false
+	}
+	if len(message.Attachments) == 0 {
+		respondError(c, http.StatusNotFound, codeNotFound, "Message has no attachments")
+		return nil, nil, false
+	}
+	return link, message, true
+}
+
+// messageFiles returns the attachments of a message.
+func messageFiles(message *Message) []LinkData {
+	files := make([]LinkData, len(message.Attachments))
+	for i, a := range message.Attachments {
+		files[i] = LinkData{ChannelID: message.ChannelID, FileID: a.ID, FileName: a.FileName}
+	}
+	return files
+}
+
+// handleGallery serves the attachments of a message as one link, as an HTML
+// page or, with format=json, as JSON. Attachments are linked through the
+// service, so they keep working after Discord's URLs expire. format=zip
+// downloads them all as one archive.
+func handleGallery(client *DiscordClient, config *Config) HandlerFunc {
+	return func(c *Context) {
+		format := c.DefaultQuery("format", "html")
+		if format != "html" && format != "json" && format != "zip" {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "format must be html, json or zip")
+			return
+		}
+		link, message, ok := fetchGalleryMessage(c, client, c.Param("message"))
+		if !ok {
+			return
+		}
+		files := messageFiles(message)
+		if format == "zip" {
+			serveZip(c, client, config, files, fmt.Sprintf("%d.zip", link.MessageID))
+			return
+		}
+
+		guild := "@me"
+		if link.GuildID != 0 {
+			guild = fmt.Sprint(link.GuildID)
+		}
+		base := publicURL(c, config)
+		gallery := &Gallery{
+			MessageURL: fmt.Sprintf("https://discord.com/channels/%s/%d/%d", guild, message.ChannelID, message.ID),
+			Author:     message.Author.Username,
+			Content:    message.Content,
+			Timestamp:  message.Timestamp,
+		}
+		for i, a := range message.Attachments {
+			path := files[i].Path()
+			attachment := GalleryAttachment{
+				FileName:    a.FileName,
+				ContentType: a.ContentType,
+				Size:        a.Size,
+				URL:         base + "/" + path,
+				PreviewURL:  base + "/preview/" + path,
+				IsImage:     hasExtension(a.FileName, imageExtensions),
+				IsVideo:     hasExtension(a.FileName, videoExtensions),
+				IsAudio:     hasExtension(a.FileName, audioExtensions),
+			}
+			if a.IsVoiceMessage() {
+				attachment.DurationSecs = a.DurationSecs
+				attachment.WaveformURL = base + "/waveform/" + path
+			}
+			gallery.Attachments = append(gallery.Attachments, attachment)
+		}
+
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(galleryMaxAge.Seconds())))
+		if format == "json" {
+			c.JSON(http.StatusOK, gallery)
+			return
+		}
+
+		if config.ClientHints {
+			c.Header("Accept-CH", acceptClientHints)
+		}
+		page := galleryPage{Gallery: gallery, Title: "1 attachment"}
+		if n := len(gallery.Attachments); n > 1 {
+			page.Title = fmt.Sprintf("%d attachments", n)
+		}
+		if gallery.Author != "" {
+			page.Title += " from " + gallery.Author
+		}
+		for i := range gallery.Attachments {
+			if gallery.Attachments[i].IsImage {
+				page.Cover = &gallery.Attachments[i]
+				break
+			}
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := galleryTemplate.Execute(c.Writer, page); err != nil {
+			logf(c, slog.LevelError, "Failed to render gallery page: %v", err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package discordcdn
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGalleryEdgeControls(t *testing.T) {
+	_, client := newFakeDiscord(t)
+	router := newTestRouter(t, &Config{HotlinkAllow: []string{"example.com"}, BlockCrawlers: true}, client)
+	path := fmt.Sprintf("/gallery/1/%d/%d", testChannelID, testFileID)
+
+	tests := []struct {
+		name    string
+		headers []string
+	}{
+		{"hotlink", []string{"Referer", "https://elsewhere.example.net/page"}},
+		{"crawler", []string{"Referer", "https://example.com/page", "User-Agent", "Googlebot/2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doRequest(router, http.MethodGet, path, nil, tt.headers...); w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+			}
+		})
+	}
+}
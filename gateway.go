@@ -0,0 +1,343 @@
+package discordcdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const (
+	gatewayURL = "wss://gateway.discord.gg"
+	// gatewayQuery selects the gateway version and payload encoding.
+	gatewayQuery = "/?v=10&encoding=json"
+	// gatewayReadLimit bounds a single gateway message. READY can be large
+	// for bots in many guilds.
+	gatewayReadLimit = 16 << 20
+
+	// gatewayIntents subscribes to guild messages. Attachments of messages
+	// that don't mention the bot are only sent with the privileged message
+	// content intent.
+	gatewayIntents = 1<<9 | 1<<15
+
+	gatewayMinBackoff = time.Second
+	gatewayMaxBackoff = 5 * time.Minute
+)
+
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opResume         = 6
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+	opHeartbeatACK   = 11
+)
+
+// gatewayFatalCodes are close codes after which reconnecting can't help, such
+// as a rejected token or intents the bot isn't allowed to use.
+var gatewayFatalCodes = map[websocket.StatusCode]bool{
+	4004: true, // authentication failed
+	4010: true, // invalid shard
+	4011: true, // sharding required
+	4012: true, // invalid API version
+	4013: true, // invalid intents
+	4014: true, // disallowed intents
+}
+
+// gatewaySessionCodes are close codes after which the session can't be
+// resumed and a fresh one must be identified.
+var gatewaySessionCodes = map[websocket.StatusCode]bool{
+	4007: true, // invalid sequence
+	4009: true, // session timed out
+}
+
+var errGatewayReconnect = errors.New("gateway asked to reconnect")
+
+type gatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  int64           `json:"s"`
+	T  string          `json:"t"`
+}
+
+type gatewayCommand struct {
+	Op int         `json:"op"`
+	D  interface{} `json:"d"`
+}
+
+// Gateway connects to the Discord gateway as a bot and indexes the
+// attachments of new messages in the configured channels, so their links are
+// known before anyone requests them.
+type Gateway struct {
+	client   *DiscordClient
+	store    *Store
+	channels map[int64]bool
+
+	// seq is the last sequence number received, or 0 before the first
+	// dispatch.
+	seq       atomic.Int64
+	sessionID string
+	resumeURL string
+}
+
+func NewGateway(client *DiscordClient, store *Store, channels []int64) *Gateway {
+	g := &Gateway{
+		client:   client,
+		store:    store,
+		channels: map[int64]bool{},
+	}
+	for _, id := range channels {
+		g.channels[id] = true
+	}
+	return g
+}
+
+// run keeps a gateway session open, reconnecting with backoff when it drops.
+// It returns when ctx is cancelled or Discord rejects the connection in a way
+// reconnecting can't fix.
+func (g *Gateway) run(ctx context.Context) {
+	backoff := gatewayMinBackoff
+	for {
+		start := time.Now()
+		err := g.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if gatewayFatalCodes[websocket.CloseStatus(err)] {
+			logAt(slog.LevelError, "Gateway indexing stopped: %v", err)
+			return
+		}
+		if gatewaySessionCodes[websocket.CloseStatus(err)] {
+			g.sessionID = ""
+		}
+
+		if time.Since(start) > gatewayMaxBackoff {
+			backoff = gatewayMinBackoff
+		}
+		logAt(slog.LevelWarn, "Gateway disconnected: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, gatewayMaxBackoff)
+	}
+}
+
+// connect runs a single gateway connection, resuming the previous session
+// when there is one, until it fails.
+func (g *Gateway) connect(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resuming := g.sessionID != ""
+	endpoint := gatewayURL
+	if resuming {
+		endpoint = g.resumeURL
+	}
+	conn, _, err := websocket.Dial(ctx, endpoint+gatewayQuery, &websocket.DialOptions{HTTPClient: g.client.websocketClient(), HTTPHeader: g.client.requestHeaders()})
+	if err != nil {
+		return err
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(gatewayReadLimit)
+
+	var hello gatewayPayload
+	if err := wsjson.Read(ctx, conn, &hello); err != nil {
+		return err
+	}
+	if hello.Op != opHello {
+		return fmt.Errorf("expected hello, got op %d", hello.Op)
+	}
+	var helloData struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(hello.D, &helloData); err != nil {
+		return fmt.Errorf("failed to decode hello: %w", err)
+	}
+
+	var acked atomic.Bool
+	acked.Store(true)
+	go g.heartbeat(ctx, conn, time.Duration(helloData.HeartbeatInterval)*time.Millisecond, &acked)
+
+	token := strings.TrimPrefix(g.client.authorization(), "Bot ")
+	if resuming {
+		err = wsjson.Write(ctx, conn, gatewayCommand{Op: opResume, D: map[string]interface{}{
+			"token":      token,
+			"session_id": g.sessionID,
+			"seq":        g.seq.Load(),
+		}})
+	} else {
+		g.seq.Store(0)
+		err = wsjson.Write(ctx, conn, gatewayCommand{Op: opIdentify, D: map[string]interface{}{
+			"token":   token,
+			"intents": gatewayIntents,
+			"properties": map[string]string{
+				"os":      runtime.GOOS,
+				"browser": "discord-cdn",
+				"device":  "discord-cdn",
+			},
+		}})
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		var payload gatewayPayload
+		if err := wsjson.Read(ctx, conn, &payload); err != nil {
+			return err
+		}
+
+		switch payload.Op {
+		case opDispatch:
+			if payload.S > 0 {
+				g.seq.Store(payload.S)
+			}
+			g.dispatch(payload.T, payload.D)
+		case opHeartbeat:
+			if err := g.sendHeartbeat(ctx, conn); err != nil {
+				return err
+			}
+		case opHeartbeatACK:
+			acked.Store(true)
+		case opReconnect:
+			conn.Close(websocket.StatusCode(4000), "reconnecting")
+			return errGatewayReconnect
+		case opInvalidSession:
+			var resumable bool
+			json.Unmarshal(payload.D, &resumable)
+			if !resumable {
+				g.sessionID = ""
+			}
+			// Discord asks for a short random wait before identifying again.
+			time.Sleep(time.Second + rand.N(4*time.Second))
+			conn.Close(websocket.StatusCode(4000), "invalid session")
+			return errors.New("gateway session invalidated")
+		}
+	}
+}
+
+// heartbeat keeps the connection alive until ctx is cancelled, closing it
+// when Discord stops acknowledging heartbeats.
+func (g *Gateway) heartbeat(ctx context.Context, conn *websocket.Conn, interval time.Duration, acked *atomic.Bool) {
+	// The first heartbeat is jittered so reconnecting bots don't all beat
+	// at once.
+	timer := time.NewTimer(rand.N(interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if !acked.Swap(false) {
+			conn.Close(websocket.StatusCode(4000), "heartbeat not acknowledged")
+			return
+		}
+		if err := g.sendHeartbeat(ctx, conn); err != nil {
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (g *Gateway) sendHeartbeat(ctx context.Context, conn *websocket.Conn) error {
+	var seq interface{}
+	if s := g.seq.Load(); s > 0 {
+		seq = s
+	}
+	return wsjson.Write(ctx, conn, gatewayCommand{Op: opHeartbeat, D: seq})
+}
+
+func (g *Gateway) dispatch(event string, data json.RawMessage) {
+	switch event {
+	case "READY":
+		var ready struct {
+			SessionID        string `json:"session_id"`
+			ResumeGatewayURL string `json:"resume_gateway_url"`
+			User             User   `json:"user"`
+		}
+		if err := json.Unmarshal(data, &ready); err != nil {
+			logAt(slog.LevelError, "Failed to decode gateway READY: %v", err)
+			return
+		}
+		g.sessionID = ready.SessionID
+		g.resumeURL = strings.TrimSuffix(ready.ResumeGatewayURL, "/")
+		log.Printf("Gateway connected as %s, indexing %d channels", ready.User.Username, len(g.channels))
+	case "RESUMED":
+		log.Printf("Gateway session resumed")
+	case "MESSAGE_CREATE":
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			logAt(slog.LevelError, "Failed to decode gateway message: %v", err)
+			return
+		}
+		g.index(&message)
+	}
+}
+
+// index stores the message's attachments if it was posted in one of the
+// configured channels.
+func (g *Gateway) index(message *Message) {
+	if !g.channels[message.ChannelID] || len(message.Attachments) == 0 {
+		return
+	}
+	attachments := indexedAttachments(message)
+	if err := g.store.IndexAttachments(attachments); err != nil {
+		logAt(slog.LevelError, "Failed to index attachments of message %d: %v", message.ID, err)
+		return
+	}
+	metrics.Count("gateway.indexed_attachments", int64(len(attachments)))
+}
+
+// indexedAttachments describes the attachments of a message for the index.
+func indexedAttachments(message *Message) []*IndexedAttachment {
+	guild := "@me"
+	if message.GuildID != 0 {
+		guild = fmt.Sprint(message.GuildID)
+	}
+	messageURL := fmt.Sprintf("https://discord.com/channels/%s/%d/%d", guild, message.ChannelID, message.ID)
+
+	content := message.Content
+	if runes := []rune(content); len(runes) > maxContentSnippet {
+		content = string(runes[:maxContentSnippet]) + "…"
+	}
+	attachments := make([]*IndexedAttachment, len(message.Attachments))
+	for i, a := range message.Attachments {
+		attachments[i] = &IndexedAttachment{
+			LinkData: LinkData{
+				ChannelID: message.ChannelID,
+				FileID:    a.ID,
+				FileName:  a.FileName,
+			},
+			GuildID:     message.GuildID,
+			MessageID:   message.ID,
+			Size:        a.Size,
+			ContentType: a.ContentType,
+			UploaderID:  message.Author.ID,
+			Uploader:    message.Author.Username,
+			MessageURL:  messageURL,
+			Content:     content,
+			CreatedAt:   message.Timestamp.UTC(),
+		}
+		if a.IsVoiceMessage() {
+			attachments[i].DurationSecs = a.DurationSecs
+			attachments[i].Waveform = a.Waveform
+		}
+	}
+	return attachments
+}
@@ -0,0 +1,217 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+// maxGraphQLRefresh bounds the URLs accepted by a single refresh query, which
+// unlike gRPC's BatchRefresh must complete before anything is returned.
+const maxGraphQLRefresh = 1000
+
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# Refreshes every link, in any form the HTTP API accepts, returning one
+	# result per link in the same order.
+	refresh(urls: [String!]!): [RefreshResult!]!
+	# Looks up a short link by its slug.
+	shortLink(slug: String!): ShortLink
+}
+
+type RefreshResult {
+	url: String!
+	refreshedURL: String
+	expiresAt: Time
+	# The attachment's size in bytes, fetched from the CDN only when asked for.
+	size: Float
+	contentType: String
+	fileName: String
+	error: Error
+}
+
+type Error {
+	code: String!
+	message: String!
+}
+
+type ShortLink {
+	slug: String!
+	url: String!
+	createdAt: Time!
+}
+
+scalar Time
+`
+
+// requesterContextKey carries requesterOf the HTTP request into resolvers,
+// and grantContextKey its channelGrant.
+type (
+	requesterContextKey struct{}
+	grantContextKey     struct{}
+)
+
+// handleGraphQL serves GraphQL queries, passing on who made them for the
+// audit log and the channels their JWT or login grants.
+func handleGraphQL(handler http.Handler) HandlerFunc {
+	return func(c *Context) {
+		ctx := context.WithValue(c.Request.Context(), requesterContextKey{}, requesterOf(c))
+		ctx = context.WithValue(ctx, grantContextKey{}, requestGrant(c))
+		handler.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}
+}
+
+func graphqlRequester(ctx context.Context) string {
+	requester, _ := ctx.Value(requesterContextKey{}).(string)
+	return requester
+}
+
+func graphqlGrant(ctx context.Context) channelGrant {
+	grant, _ := ctx.Value(grantContextKey{}).(channelGrant)
+	return grant
+}
+
+// newGraphQLHandler serves the schema above over HTTP POST.
+func newGraphQLHandler(client *DiscordClient, store *Store, config *Config) *relay.Handler {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{client: client, store: store, config: config},
+		graphql.UseFieldResolvers(),
+		graphql.MaxDepth(5),
+	)
+	return &relay.Handler{Schema: schema}
+}
+
+type graphqlResolver struct {
+	client *DiscordClient
+	store  *Store
+	config *Config
+}
+
+func (r *graphqlResolver) Refresh(ctx context.Context, args struct{ URLs []string }) ([]*refreshResolver, error) {
+	if len(args.URLs) > maxGraphQLRefresh {
+		return nil, fmt.Errorf("at most %d URLs can be refreshed per query", maxGraphQLRefresh)
+	}
+
+	results := make([]*refreshResolver, 0, len(args.URLs))
+	for start := 0; start < len(args.URLs); start += refreshBatchSize {
+		batch, _ := refreshGranted(r.client, PriorityBackground, graphqlRequester(ctx), graphqlGrant(ctx), args.URLs[start:min(start+refreshBatchSize, len(args.URLs))])
+		for _, refresh := range batch {
+			results = append(results, &refreshResolver{client: r.client, refresh: refresh})
+		}
+	}
+	return results, nil
+}
+
+func (r *graphqlResolver) ShortLink(args struct{ Slug string }) *shortLinkResolver {
+	link, ok := r.store.ShortLink(args.Slug)
+	if !ok {
+		return nil
+	}
+	return &shortLinkResolver{link: link, config: r.config}
+}
+
+type refreshResolver struct {
+	client  *DiscordClient
+	refresh linkRefresh
+
+	statOnce    sync.Once
+	size        *float64
+	contentType *string
+}
+
+func (r *refreshResolver) URL() string {
+	return r.refresh.raw
+}
+
+func (r *refreshResolver) RefreshedURL() *string {
+	if r.refresh.failed() {
+		return nil
+	}
+	return &r.refresh.url
+}
+
+func (r *refreshResolver) ExpiresAt() *graphql.Time {
+	if r.refresh.expiresAt.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: r.refresh.expiresAt}
+}
+
+func (r *refreshResolver) FileName() *string {
+	if r.refresh.data == nil {
+		return nil
+	}
+	name := r.refresh.data.Name()
+	return &name
+}
+
+func (r *refreshResolver) Size(ctx context.Context) *float64 {
+	r.stat(ctx)
+	return r.size
+}
+
+func (r *refreshResolver) ContentType(ctx context.Context) *string {
+	r.stat(ctx)
+	return r.contentType
+}
+
+// stat fetches the size and content type once, however many of the two
+// fields were selected.
+func (r *refreshResolver) stat(ctx context.Context) {
+	r.statOnce.Do(func() {
+		if r.refresh.failed() {
+			return
+		}
+		size, contentType, err := r.client.Stat(ctx, r.refresh.url)
+		if err != nil {
+			logAt(slog.LevelError, "Error fetching attachment size: %v", err)
+			return
+		}
+		if size >= 0 {
+			s := float64(size)
+			r.size = &s
+		}
+		if contentType != "" {
+			r.contentType = &contentType
+		}
+	})
+}
+
+func (r *refreshResolver) Error() *graphqlError {
+	if !r.refresh.failed() {
+		return nil
+	}
+	return &graphqlError{Code: r.refresh.code, Message: r.refresh.message}
+}
+
+type graphqlError struct {
+	Code    string
+	Message string
+}
+
+type shortLinkResolver struct {
+	link   *ShortLink
+	config *Config
+}
+
+func (r *shortLinkResolver) Slug() string {
+	return r.link.Slug
+}
+
+// URL is the link the short link points at, relative to the service when
+// DCDN_PUBLIC_URL is unset.
+func (r *shortLinkResolver) URL() string {
+	return r.config.PublicURL + "/" + r.link.Path()
+}
+
+func (r *shortLinkResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.link.CreatedAt}
+}
@@ -0,0 +1,272 @@
+package discordcdn
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/rexdotsh/discord-cdn --go-grpc_out=. --go-grpc_opt=module=github.com/rexdotsh/discord-cdn proto/discordcdn/v1/cdn.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/rexdotsh/discord-cdn/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxBatchRefresh bounds the URLs accepted in one BatchRefresh call.
+const maxBatchRefresh = 10000
+
+// grpcServer implements the CDN gRPC service on top of the same client and
+// store as the HTTP API.
+type grpcServer struct {
+	pb.UnimplementedCDNServer
+	client *DiscordClient
+	store  *Store
+	auth   *grpcAuth
+}
+
+// newGRPCServer serves the CDN service, with calls authenticated by auth
+// unless it is nil.
+func newGRPCServer(client *DiscordClient, store *Store, auth *grpcAuth, opts ...grpc.ServerOption) *grpc.Server {
+	unary := []grpc.UnaryServerInterceptor{func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		recordGRPC(info.FullMethod, start, err)
+		return resp, err
+	}}
+	stream := []grpc.StreamServerInterceptor{func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		recordGRPC(info.FullMethod, start, err)
+		return err
+	}}
+	if auth != nil {
+		unary = append(unary, auth.unary)
+		stream = append(stream, auth.stream)
+	}
+	server := grpc.NewServer(append(opts, grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...))...)
+	pb.RegisterCDNServer(server, &grpcServer{client: client, store: store, auth: auth})
+	return server
+}
+
+// grpcTLS returns the options serving gRPC over TLS, or none when tlsConfig
+// is nil.
+func grpcTLS(tlsConfig *tls.Config) []grpc.ServerOption {
+	if tlsConfig == nil {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
+}
+
+func recordGRPC(method string, start time.Time, err error) {
+	tags := []string{"method:" + method, "code:" + status.Code(err).String()}
+	metrics.Count("grpc.requests", 1, tags...)
+	metrics.Timing("grpc.request_duration", time.Since(start), tags...)
+}
+
+// serveGRPC starts server on every address, reporting the first failure of
+// any listener on errs.
+func serveGRPC(addrs []string, server *grpc.Server, errs chan<- error) {
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			errs <- fmt.Errorf("failed to listen on %s: %w", addr, err)
+			return
+		}
+
+		log.Printf("Serving gRPC on %s", addr)
+		go func() {
+			errs <- server.Serve(ln)
+		}()
+	}
+}
+
+// grpcCode maps the HTTP status of a failure onto the closest gRPC code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	default:
+		return codes.Unavailable
+	}
+}
+
+func (s *grpcServer) Refresh(ctx context.Context, req *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	parsedLink := parseLink(req.GetUrl())
+	if parsedLink.Error != "" {
+		return nil, status.Error(codes.InvalidArgument, parsedLink.Error)
+	}
+	data := parsedLink.Data
+	grant, err := s.auth.grant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if denial := grant.denial(s.client, data.ChannelID); denial != "" {
+		return nil, status.Error(codes.PermissionDenied, denial)
+	}
+
+	newURL, fallback, err := s.client.RefreshWithFallback(ctx, grpcRequester(ctx), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+	if err != nil {
+		logAt(slog.LevelError, "Error refreshing attachment URL over gRPC: %v", err)
+		failure := classifyRefreshError(err)
+		return nil, status.Error(grpcCode(failure.status), failure.message)
+	}
+
+	resp := &pb.RefreshResponse{Url: req.GetUrl(), RefreshedUrl: newURL}
+	if expiry, ok := urlExpiry(newURL); ok {
+		resp.ExpiresAt = timestamppb.New(expiry)
+	}
+	if len(data.Media) > 0 && fallback != fallbackMirror {
+		resp.RefreshedUrl = mediaURL(newURL, data.Media)
+	}
+	return resp, nil
+}
+
+// BatchRefresh refreshes the URLs refreshBatchSize at a time, so callers
+// start receiving results before the whole batch is done.
+func (s *grpcServer) BatchRefresh(req *pb.BatchRefreshRequest, stream grpc.ServerStreamingServer[pb.RefreshResponse]) error {
+	urls := req.GetUrls()
+	if len(urls) > maxBatchRefresh {
+		return status.Errorf(codes.InvalidArgument, "at most %d URLs can be refreshed per call", maxBatchRefresh)
+	}
+	grant, err := s.auth.grant(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(urls); start += refreshBatchSize {
+		results, _ := refreshGranted(s.client, PriorityBackground, grpcRequester(stream.Context()), grant, urls[start:min(start+refreshBatchSize, len(urls))])
+		for _, r := range results {
+			resp := &pb.RefreshResponse{Url: r.raw, RefreshedUrl: r.url, ErrorCode: r.code, Error: r.message}
+			if !r.expiresAt.IsZero() {
+				resp.ExpiresAt = timestamppb.New(r.expiresAt)
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *grpcServer) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	switch target := req.GetTarget().(type) {
+	case *pb.ResolveRequest_Url:
+		if link, ok := parseMessageLink(target.Url); ok {
+			return s.resolveMessage(ctx, link)
+		}
+		parsedLink := parseLink(target.Url)
+		if parsedLink.Error != "" {
+			return nil, status.Error(codes.InvalidArgument, parsedLink.Error)
+		}
+		if err := s.authorize(ctx, parsedLink.Data.ChannelID, "Attachment not found"); err != nil {
+			return nil, err
+		}
+		return resolveLink(parsedLink.Data), nil
+
+	case *pb.ResolveRequest_ShortLink:
+		link, ok := s.store.ShortLink(target.ShortLink)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "Short link not found")
+		}
+		if err := s.authorize(ctx, link.ChannelID, "Short link not found"); err != nil {
+			return nil, err
+		}
+		return resolveLink(&link.LinkData), nil
+
+	case *pb.ResolveRequest_UploadId:
+		manifest, ok := s.store.Manifest(target.UploadId)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "File not found")
+		}
+		if len(manifest.Chunks) > 0 {
+			if err := s.authorize(ctx, manifest.Chunks[0].ChannelID, "File not found"); err != nil {
+				return nil, err
+			}
+		}
+		resp := &pb.ResolveResponse{DisplayName: manifest.FileName, ContentType: manifest.ContentType}
+		for _, chunk := range manifest.Chunks {
+			resp.Attachments = append(resp.Attachments, &pb.Attachment{
+				ChannelId: chunk.ChannelID,
+				FileId:    chunk.FileID,
+				FileName:  chunk.FileName,
+				Size:      chunk.Size,
+				Url:       attachmentURL(chunk.ChannelID, chunk.FileID, chunk.FileName),
+			})
+		}
+		return resp, nil
+	}
+
+	return nil, status.Error(codes.InvalidArgument, "A url, short link or upload ID is required")
+}
+
+// authorize checks that the channel is allowed and that the call's token
+// grants access to it, like authorizeChannel. Channels outside the allowlist
+// look missing, with notFound as the message.
+func (s *grpcServer) authorize(ctx context.Context, channelID int64, notFound string) error {
+	if !s.client.allowsChannel(channelID) {
+		return status.Error(codes.NotFound, notFound)
+	}
+	grant, err := s.auth.grant(ctx)
+	if err != nil {
+		return err
+	}
+	if denial := grant.denial(s.client, channelID); denial != "" {
+		return status.Error(codes.PermissionDenied, denial)
+	}
+	return nil
+}
+
+// resolveMessage returns the attachments of a linked message, if its channel
+// is allowed and the call's token grants access to it.
+func (s *grpcServer) resolveMessage(ctx context.Context, link *MessageLink) (*pb.ResolveResponse, error) {
+	if err := s.authorize(ctx, link.ChannelID, "Message not found"); err != nil {
+		return nil, err
+	}
+	message, err := s.client.Message(link.ChannelID, link.MessageID)
+	if err != nil {
+		logAt(slog.LevelError, "Error fetching message over gRPC: %v", err)
+		failure := classifyRefreshError(err)
+		return nil, status.Error(grpcCode(failure.status), failure.message)
+	}
+
+	resp := &pb.ResolveResponse{}
+	for _, a := range message.Attachments {
+		resp.Attachments = append(resp.Attachments, &pb.Attachment{
+			ChannelId: message.ChannelID,
+			FileId:    a.ID,
+			FileName:  a.FileName,
+			Size:      a.Size,
+			Url:       attachmentURL(message.ChannelID, a.ID, a.FileName),
+		})
+	}
+	if len(message.Attachments) == 1 {
+		resp.DisplayName = message.Attachments[0].FileName
+		resp.ContentType = message.Attachments[0].ContentType
+	}
+	return resp, nil
+}
+
+func resolveLink(data *LinkData) *pb.ResolveResponse {
+	return &pb.ResolveResponse{
+		DisplayName: data.Name(),
+		Attachments: []*pb.Attachment{{
+			ChannelId: data.ChannelID,
+			FileId:    data.FileID,
+			FileName:  data.FileName,
+			Url:       attachmentURL(data.ChannelID, data.FileID, data.FileName),
+		}},
+	}
+}
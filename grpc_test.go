@@ -0,0 +1,108 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rexdotsh/discord-cdn/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCResolveChecksChannel(t *testing.T) {
+	client := NewDiscordClient("token")
+	client.SetChannelAllowlist([]int64{testChannelID, testChannelID + 1}, nil)
+	store, err := OpenStore(t.TempDir() + "/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, channelID := range []int64{testChannelID, testChannelID + 1, testChannelID + 2} {
+		slug := fmt.Sprintf("slug%d", i)
+		if err := store.AddShortLink(&ShortLink{Slug: slug, LinkData: LinkData{ChannelID: channelID, FileID: testFileID, FileName: "a.png"}}); err != nil {
+			t.Fatal(err)
+		}
+		manifest := &Manifest{ID: fmt.Sprintf("file%d", i), FileName: "a.png", Chunks: []Chunk{{ChannelID: channelID, FileID: testFileID, FileName: "a.png"}}}
+		if err := store.PutManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &grpcServer{client: client, store: store, auth: &grpcAuth{gated: true}}
+
+	// The token grants the first channel only; the third isn't allowed.
+	claims := &jwtClaims{Channels: []string{strconv.FormatInt(testChannelID, 10)}}
+	granted := context.WithValue(context.Background(), grpcClaimsContextKey{}, claims)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  *pb.ResolveRequest
+		code codes.Code
+	}{
+		{"short link granted", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_ShortLink{ShortLink: "slug0"}}, codes.OK},
+		{"short link not granted", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_ShortLink{ShortLink: "slug1"}}, codes.PermissionDenied},
+		{"short link outside allowlist", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_ShortLink{ShortLink: "slug2"}}, codes.NotFound},
+		{"short link without token", context.Background(), &pb.ResolveRequest{Target: &pb.ResolveRequest_ShortLink{ShortLink: "slug0"}}, codes.Unauthenticated},
+		{"upload granted", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_UploadId{UploadId: "file0"}}, codes.OK},
+		{"upload not granted", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_UploadId{UploadId: "file1"}}, codes.PermissionDenied},
+		{"upload outside allowlist", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_UploadId{UploadId: "file2"}}, codes.NotFound},
+		{"message outside allowlist", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_Url{Url: fmt.Sprintf("https://discord.com/channels/1/%d/%d", testChannelID+2, testFileID)}}, codes.NotFound},
+		{"message not granted", granted, &pb.ResolveRequest{Target: &pb.ResolveRequest_Url{Url: fmt.Sprintf("https://discord.com/channels/1/%d/%d", testChannelID+1, testFileID)}}, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := server.Resolve(tt.ctx, tt.req)
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("code = %v, want %v: %v", code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestGRPCLimitsPerIP(t *testing.T) {
+	limit := &atomic.Int64{}
+	limit.Store(2)
+	auth := &grpcAuth{counter: newLocalCounter(), perIP: limit}
+	call := func(ip string) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}})
+		_, err := auth.authenticate(ctx)
+		return err
+	}
+
+	for i := range 2 {
+		if err := call("192.0.2.1"); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+	if err := call("192.0.2.1"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("call over the limit: %v, want ResourceExhausted", err)
+	}
+	if err := call("192.0.2.2"); err != nil {
+		t.Errorf("call from another address: %v", err)
+	}
+}
+
+func TestGRPCRefusesBypassedSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"tenants", Config{Tenants: []Tenant{{Name: "acme", Token: "Bot x"}}}},
+		{"ACL", Config{ACL: []ACLRule{{KeyID: "key_1a2b3c4d5e6f"}}}},
+		{"basic auth", Config{HtpasswdUsers: map[string]string{"alice": "{SHA}x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.GRPCListen = []string{":9000"}
+			var p configParser
+			tt.config.validate(&p)
+			if !p.failed["GRPC_LISTEN"] {
+				t.Errorf("%s accepted along with gRPC", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package discordcdn
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcKeyContextKey carries the keyID, or client certificate name, a gRPC
+// call authenticated with, and grpcClaimsContextKey the *jwtClaims of its
+// token.
+type (
+	grpcKeyContextKey    struct{}
+	grpcClaimsContextKey struct{}
+)
+
+// grpcAuth authenticates gRPC calls with the API keys, client certificates
+// and JWTs the HTTP API accepts, and counts them against the same per-IP and
+// per-key rate limits and quotas.
+type grpcAuth struct {
+	// keys is nil when the HTTP API takes requests without a key.
+	keys      *KeySet
+	certNames []string
+	counter   RequestCounter
+	perIP     *atomic.Int64
+	ipFailing atomic.Bool
+	limit     *atomic.Int64
+	usage     *UsageTracker
+	daily     int64
+	monthly   int64
+	failing   atomic.Bool
+	// jwt verifies the tokens of calls when JWTs are enabled. gated is set
+	// when routes handing out attachments are behind the login gate, so
+	// calls need a token to refresh links.
+	jwt   *JWTVerifier
+	gated bool
+}
+
+// newGRPCAuth returns the authentication of the deployment reloader
+// configures.
+func newGRPCAuth(reloader *Reloader) *grpcAuth {
+	config := reloader.Config()
+	a := &grpcAuth{
+		counter: reloader.counter,
+		perIP:   reloader.requestsPerIP,
+		gated:   config.JWTSecret != "" || config.JWTJWKSURL != "" || config.OAuthClientID != "",
+	}
+	if config.apiAuth() {
+		a.keys = reloader.keys
+		a.certNames = config.ClientCertNames
+		a.limit = reloader.requestsPerKey
+		a.usage = reloader.usage
+		a.daily, a.monthly = config.KeyDailyQuota, config.KeyMonthlyQuota
+	}
+	if config.JWTSecret != "" || config.JWTJWKSURL != "" {
+		a.jwt = NewJWTVerifier(config, false)
+	}
+	return a
+}
+
+// unary and stream reject calls authenticate refuses, passing the rest on
+// with their key and token claims in the context.
+func (a *grpcAuth) unary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *grpcAuth) stream(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticate counts a call against the per-IP rate limit, then checks its
+// client certificate or API key, like requireAPIKey, and its key's rate limit
+// and quotas, like limitRequests and limitKey. Calls and HTTP requests made
+// from the same address, or with the same key, share limits.
+//
+// A valid JWT in bearer authorization metadata is passed on too, for the
+// methods that need one to check against. Which is why, with JWTs enabled,
+// keys go in x-api-key, as they go in X-API-Key on gated HTTP routes.
+func (a *grpcAuth) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if limit := a.perIP.Load(); limit > 0 {
+		if p, ok := peer.FromContext(ctx); ok {
+			if count, _, ok := countRequest(ctx, a.counter, "ip", peerIP(p), time.Now(), &a.ipFailing); ok && count > limit {
+				metrics.Count("ratelimit.rejected", 1, "scope:ip")
+				return nil, status.Error(codes.ResourceExhausted, "Too many requests")
+			}
+		}
+	}
+	if a.keys != nil {
+		id, ok := a.identify(ctx, md)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+
+		now := time.Now().UTC()
+		if limit := a.limit.Load(); limit > 0 {
+			if count, _, ok := countRequest(ctx, a.counter, "key", id, now, &a.failing); ok && count > limit {
+				metrics.Count("ratelimit.rejected", 1, "scope:key")
+				return nil, status.Error(codes.ResourceExhausted, "Too many requests")
+			}
+		}
+		if reset := a.usage.takeQuota(id, a.daily, a.monthly, now); !reset.IsZero() {
+			return nil, status.Errorf(codes.ResourceExhausted, "API key quota exceeded until %s", reset.Format(time.RFC3339))
+		}
+		ctx = context.WithValue(ctx, grpcKeyContextKey{}, id)
+	}
+
+	if a.jwt != nil {
+		if raw, ok := strings.CutPrefix(firstMetadata(md, "authorization"), "Bearer "); ok {
+			if claims, err := a.jwt.verify(raw); err == nil {
+				ctx = context.WithValue(ctx, grpcClaimsContextKey{}, claims)
+			}
+		}
+	}
+	return ctx, nil
+}
+
+// grant returns what a call's token grants access to. Calls must carry one
+// to refresh links when the login gate is on; Discord logins are only for
+// browsers, so with login alone calls can't refresh at all.
+func (a *grpcAuth) grant(ctx context.Context) (channelGrant, error) {
+	claims, _ := ctx.Value(grpcClaimsContextKey{}).(*jwtClaims)
+	if a != nil && a.gated && claims == nil {
+		return channelGrant{}, status.Error(codes.Unauthenticated, "Missing or invalid token")
+	}
+	return channelGrant{claims: claims}, nil
+}
+
+// identify returns who a call authenticated as: the name of an allowed,
+// verified client certificate prefixed with certPrefix, or else the keyID of
+// the key in its x-api-key or bearer authorization metadata.
+func (a *grpcAuth) identify(ctx context.Context, md metadata.MD) (string, bool) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			if name, ok := clientCertName(info.State.PeerCertificates[0], a.certNames); ok {
+				return certPrefix + name, true
+			}
+		}
+	}
+	if key := firstMetadata(md, "x-api-key"); key != "" {
+		return matchAPIKey(a.keys, key)
+	}
+	return matchAPIKey(a.keys, strings.TrimPrefix(firstMetadata(md, "authorization"), "Bearer "))
+}
+
+// peerIP returns the address a call came from, without its port, as the
+// per-IP limits of HTTP requests key it.
+func peerIP(p *peer.Peer) string {
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// contextStream is a server stream whose handler sees ctx in place of the
+// stream's own context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
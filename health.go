@@ -0,0 +1,89 @@
+package discordcdn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// discordCheckTimeout bounds a readiness check of the Discord API, so a slow
+// API fails the check rather than the load balancer's probe.
+const discordCheckTimeout = 5 * time.Second
+
+// DiscordHealth checks that the Discord API is reachable and accepts the
+// configured token, caching the result so probes don't spend the rate limit.
+type DiscordHealth struct {
+	mu        sync.Mutex
+	client    *DiscordClient
+	interval  time.Duration
+	checkedAt time.Time
+	err       error
+}
+
+func NewDiscordHealth(client *DiscordClient, interval time.Duration) *DiscordHealth {
+	return &DiscordHealth{client: client, interval: interval}
+}
+
+// check returns the result of the last check, checking again once it is
+// older than the interval. Concurrent callers wait for a single check.
+func (h *DiscordHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < h.interval {
+		return h.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discordCheckTimeout)
+	defer cancel()
+	err := pingDiscord(ctx, h.client)
+	h.err = err
+	h.checkedAt = time.Now()
+	return err
+}
+
+// pingDiscord checks that the Discord API is reachable and accepts the
+// client's token.
+func pingDiscord(ctx context.Context, client *DiscordClient) error {
+	_, err := client.CurrentUser(ctx)
+	// Being rate limited says nothing about the token, so it doesn't take
+	// the instance out of rotation.
+	var discordErr *DiscordError
+	if errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusTooManyRequests {
+		return nil
+	}
+	return err
+}
+
+func handleHealth() HandlerFunc {
+	return func(c *Context) {
+		c.JSON(http.StatusOK, H{"status": "ok"})
+	}
+}
+
+// handleReady reports whether the instance should receive traffic. Without a
+// Discord check it is ready as soon as it serves requests.
+func handleReady(discord *DiscordHealth) HandlerFunc {
+	return func(c *Context) {
+		if ops.draining.Load() {
+			c.JSON(http.StatusServiceUnavailable, H{"status": "draining"})
+			return
+		}
+		if discord == nil {
+			c.JSON(http.StatusOK, H{"status": "ready"})
+			return
+		}
+		if err := discord.check(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, H{
+				"status": "unavailable",
+				"checks": H{"discord": err.Error()},
+			})
+			return
+		}
+		c.JSON(http.StatusOK, H{
+			"status": "ready",
+			"checks": H{"discord": "ok"},
+		})
+	}
+}
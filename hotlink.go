@@ -0,0 +1,84 @@
+package discordcdn
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hotlinkProtection lets media be embedded only by sites in allow, matched
+// against the host of the request's Origin, or of its Referer when there is
+// no Origin. An entry such as *.example.com matches any subdomain. Pages of
+// the server itself, such as link previews, are always allowed, and
+// requests with neither header, such as a link opened directly, only with
+// allowDirect. Rejected requests get a 403, with placeholder as the body
+// when it is set so embeds show an image rather than a broken one. No
+// entries disable the check.
+func hotlinkProtection(allow []string, allowDirect bool, placeholder []byte) HandlerFunc {
+	placeholderType := ""
+	if len(placeholder) > 0 {
+		placeholderType = http.DetectContentType(placeholder)
+	}
+	return func(c *Context) {
+		if len(allow) == 0 {
+			c.Next()
+			return
+		}
+
+		source := c.GetHeader("Origin")
+		if source == "" || source == "null" {
+			source = c.GetHeader("Referer")
+		}
+		if source == "" {
+			if allowDirect {
+				c.Next()
+				return
+			}
+		} else if host := sourceHost(source); host != "" && (host == requestHost(c) || hostAllowed(host, allow)) {
+			c.Next()
+			return
+		}
+
+		metrics.Count("hotlinks.rejected", 1)
+		// The verdict depends on who asked, so it mustn't be cached for
+		// anyone else.
+		c.Header("Cache-Control", "private, no-store")
+		if placeholderType != "" {
+			c.Data(http.StatusForbidden, placeholderType, placeholder)
+			c.Abort()
+			return
+		}
+		respondError(c, http.StatusForbidden, codeHotlinkBlocked, "Embedding from this site is not allowed")
+	}
+}
+
+// sourceHost returns the lowercased host name of an Origin or Referer.
+func sourceHost(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func requestHost(c *Context) string {
+	host := c.Request.Host
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+func hostAllowed(host string, allow []string) bool {
+	for _, entry := range allow {
+		entry = strings.ToLower(entry)
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// LinkInfo is what an attachment link says about itself, without asking
+// Discord.
+type LinkInfo struct {
+	ChannelID int64  `json:"channelID"`
+	FileID    int64  `json:"fileID"`
+	FileName  string `json:"fileName"`
+	// UploadedAt is the creation time of the file ID, which Discord assigns
+	// when the attachment is uploaded.
+	UploadedAt       time.Time `json:"uploadedAt"`
+	ChannelCreatedAt time.Time `json:"channelCreatedAt"`
+	// URL is the attachment's CDN URL without the signature a refresh adds,
+	// and ProxyURL the link to it through this server.
+	URL      string `json:"url"`
+	ProxyURL string `json:"proxyURL"`
+}
+
+// handleInfo decodes the IDs of an attachment link. It never calls Discord,
+// so it works for links to attachments that have since been deleted.
+func handleInfo(config *Config) HandlerFunc {
+	return func(c *Context) {
+		parsed := parseLink(fmt.Sprintf("%s/%s/%s", c.Param("channelID"), c.Param("fileID"), c.Param("fileName")))
+		if parsed.Error != "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, parsed.Error)
+			return
+		}
+		data := parsed.Data
+
+		c.JSON(http.StatusOK, LinkInfo{
+			ChannelID:        data.ChannelID,
+			FileID:           data.FileID,
+			FileName:         data.FileName,
+			UploadedAt:       snowflakeTime(data.FileID),
+			ChannelCreatedAt: snowflakeTime(data.ChannelID),
+			URL:              attachmentURL(data.ChannelID, data.FileID, url.PathEscape(data.FileName)),
+			ProxyURL:         publicURL(c, config) + "/" + data.Path(),
+		})
+	}
+}
+
+// ValidatedLink is how a link is understood, down to the CDN URL a refresh
+// would be asked for.
+type ValidatedLink struct {
+	ChannelID   int64      `json:"channelID"`
+	FileID      int64      `json:"fileID"`
+	FileName    string     `json:"fileName"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Media       url.Values `json:"media,omitempty"`
+	// Path is the link in its canonical form, and ProxyURL the link to it
+	// through this server.
+	Path     string `json:"path"`
+	URL      string `json:"url"`
+	ProxyURL string `json:"proxyURL"`
+}
+
+// handleValidate parses a link the way the proxy would, query string
+// included, and reports what it makes of it without calling Discord, so
+// integrators can check their links are encoded right. Links that don't
+// parse get the same error the proxy would answer.
+func handleValidate(config *Config) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+		c.JSON(http.StatusOK, ValidatedLink{
+			ChannelID:   data.ChannelID,
+			FileID:      data.FileID,
+			FileName:    data.FileName,
+			DisplayName: data.DisplayName,
+			Media:       data.Media,
+			Path:        data.Path(),
+			URL:         attachmentURL(data.ChannelID, data.FileID, data.FileName),
+			ProxyURL:    publicURL(c, config) + "/" + data.Path(),
+		})
+	}
+}
+
+// AttachmentMetadata describes an attachment as the CDN serves it.
+type AttachmentMetadata struct {
+	ContentType string `json:"contentType,omitempty"`
+	// ContentLength is omitted when the CDN doesn't report a size.
+	ContentLength *int64     `json:"contentLength,omitempty"`
+	URL           string     `json:"url"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+}
+
+// handleMetadata refreshes an attachment's URL and asks the CDN for its
+// type and size with a HEAD request, so clients can show file details
+// without downloading it. Media proxy parameters are carried onto the URL,
+// so the details are those of the variant the link would serve.
+func handleMetadata(client *DiscordClient) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+		if !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+
+		newURL, err := client.RefreshAttachmentURL(c.Request.Context(), requesterOf(c), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+		c.Set(refreshedKey, err == nil)
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+		if len(data.Media) > 0 {
+			newURL = mediaURL(newURL, data.Media)
+		}
+
+		size, contentType, err := client.Stat(c.Request.Context(), newURL)
+		if errors.Is(err, errAttachmentNotFound) {
+			respondError(c, http.StatusNotFound, codeAttachmentNotFound, "Attachment not found")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Error fetching attachment metadata: %v", err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to fetch attachment metadata")
+			return
+		}
+
+		metadata := AttachmentMetadata{ContentType: contentType, URL: newURL}
+		if size >= 0 {
+			metadata.ContentLength = &size
+		}
+		if expiry, ok := urlExpiry(newURL); ok {
+			metadata.ExpiresAt = &expiry
+		}
+		c.JSON(http.StatusOK, metadata)
+	}
+}
+
+// Attachment states reported by the existence check.
+const (
+	attachmentAlive     = "alive"
+	attachmentDeleted   = "deleted"
+	attachmentForbidden = "forbidden"
+)
+
+// handleExists reports whether an attachment still exists: alive, deleted,
+// or forbidden when none of the tokens can see its channel. Discord signs
+// URLs for attachments that are gone, so a HEAD against the CDN settles it.
+// Anything else, such as Discord being unreachable, is an error rather than
+// a verdict, so callers pruning dead links don't drop live ones.
+func handleExists(client *DiscordClient) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+		if !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+
+		state := attachmentAlive
+		newURL, err := client.RefreshAttachmentURL(c.Request.Context(), requesterOf(c), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+		c.Set(refreshedKey, err == nil)
+		if err == nil {
+			_, _, err = client.Stat(c.Request.Context(), newURL)
+		}
+		if err != nil {
+			switch classifyRefreshError(err).code {
+			case codeAttachmentNotFound:
+				state = attachmentDeleted
+			case codeAttachmentForbidden:
+				state = attachmentForbidden
+			default:
+				respondRefreshError(c, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, H{"exists": state == attachmentAlive, "status": state})
+	}
+}
@@ -0,0 +1,159 @@
+package discordcdn
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// invalidationTimeout bounds publishing an invalidation to Redis.
+const invalidationTimeout = 5 * time.Second
+
+// invalidation is the message replicas exchange when an attachment must be
+// dropped from their caches.
+type invalidation struct {
+	// Origin tells the replica that published it apart, which has already
+	// dropped the attachment.
+	Origin string `json:"origin"`
+	FileID int64  `json:"fileID"`
+}
+
+// Invalidator keeps the caches of replicas consistent. When one replica
+// finds an attachment deleted, or one is evicted by hand, it publishes the
+// file ID on a Redis channel, and every replica drops the attachment from the
+// caches of its Discord clients: the URL cache, the disk cache and the
+// transform cache. Without Redis it does nothing, as there is no one to tell.
+type Invalidator struct {
+	client  *redis.Client
+	channel string
+	id      string
+
+	mu      sync.RWMutex
+	clients []*DiscordClient
+}
+
+// NewInvalidator shares invalidations through the Redis instance rate limits
+// are counted in, if any, and returns nil otherwise.
+func NewInvalidator(counter RequestCounter, config *Config) (*Invalidator, error) {
+	r, ok := counter.(*redisCounter)
+	if !ok {
+		return nil, nil
+	}
+	hostname, _ := os.Hostname()
+	suffix, err := newID(8)
+	if err != nil {
+		return nil, err
+	}
+	return &Invalidator{
+		client:  r.client,
+		channel: config.RedisPrefix + "invalidate",
+		id:      hostname + "-" + suffix,
+	}, nil
+}
+
+// Add has invalidations from other replicas applied to client's caches.
+func (inv *Invalidator) Add(client *DiscordClient) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.clients = append(inv.clients, client)
+}
+
+// Publish tells the other replicas to drop an attachment.
+func (inv *Invalidator) Publish(fileID int64) {
+	payload, _ := json.Marshal(invalidation{Origin: inv.id, FileID: fileID})
+	ctx, cancel := context.WithTimeout(context.Background(), invalidationTimeout)
+	defer cancel()
+	if err := inv.client.Publish(ctx, inv.channel, payload).Err(); err != nil {
+		logAt(slog.LevelError, "Failed to publish invalidation of %d: %v", fileID, err)
+		metrics.Count("cache.invalidations", 1, "direction:published", "status:error")
+		return
+	}
+	metrics.Count("cache.invalidations", 1, "direction:published", "status:ok")
+}
+
+// run applies the invalidations other replicas publish. It never returns;
+// the subscription is restored by the Redis client when the connection
+// drops, and invalidations published in between are missed.
+func (inv *Invalidator) run() {
+	sub := inv.client.Subscribe(context.Background(), inv.channel)
+	for msg := range sub.Channel() {
+		var in invalidation
+		if err := json.Unmarshal([]byte(msg.Payload), &in); err != nil || in.FileID == 0 {
+			logAt(slog.LevelWarn, "Ignoring invalid invalidation %q", msg.Payload)
+			continue
+		}
+		if in.Origin == inv.id {
+			continue
+		}
+		inv.mu.RLock()
+		clients := inv.clients
+		inv.mu.RUnlock()
+		for _, client := range clients {
+			client.dropAttachment(in.FileID)
+		}
+		logAt(slog.LevelDebug, "Dropped %d from the caches on behalf of %s", in.FileID, in.Origin)
+		metrics.Count("cache.invalidations", 1, "direction:received", "status:ok")
+	}
+}
+
+// SetInvalidator sets the invalidator other replicas are told about
+// attachments this one drops through, and applies theirs to this client.
+func (c *DiscordClient) SetInvalidator(inv *Invalidator) {
+	c.mu.Lock()
+	c.invalidator = inv
+	c.mu.Unlock()
+	inv.Add(c)
+}
+
+// SetVariantCache sets the cache of transformed variants, dropped along with
+// the other caches when an attachment is invalidated.
+func (c *DiscordClient) SetVariantCache(cache *ByteCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.variants = cache
+}
+
+// invalidateAttachment drops an attachment from the caches of this instance
+// and tells the other replicas to do the same, such as once Discord reports
+// it deleted.
+func (c *DiscordClient) invalidateAttachment(fileID int64) {
+	if fileID == 0 {
+		return
+	}
+	c.dropAttachment(fileID)
+	if inv := c.Invalidator(); inv != nil {
+		go inv.Publish(fileID)
+	}
+}
+
+// Invalidator returns the invalidator, or nil if there is none.
+func (c *DiscordClient) Invalidator() *Invalidator {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.invalidator
+}
+
+// dropAttachment drops an attachment from the caches of this instance: its
+// last refreshed URL, its copy on disk and its transformed variants.
+func (c *DiscordClient) dropAttachment(fileID int64) {
+	c.mu.RLock()
+	stale, disk, variants := c.stale, c.diskCache, c.variants
+	c.mu.RUnlock()
+	if stale != nil {
+		stale.DeleteFile(fileID)
+	}
+	if disk != nil {
+		disk.Evict(fileID)
+	}
+	if variants != nil {
+		variants.Evict(fileID)
+	}
+}
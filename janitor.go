@@ -0,0 +1,227 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// servedRecordKey holds the recordKey of the manifest or short link a request
+// served.
+const servedRecordKey = "servedRecord"
+
+// Kinds of stored records, whose last access the store tracks.
+const (
+	recordManifest   = "manifest"
+	recordShortLink  = "shortlink"
+	recordAttachment = "attachment"
+)
+
+// recordCollections names the store collection of each kind of record.
+var recordCollections = map[string]string{
+	recordManifest:   "manifests",
+	recordShortLink:  "shortLinks",
+	recordAttachment: "attachments",
+}
+
+// recordKey identifies a record in the store's access times, such as
+// shortlink/abc123.
+func recordKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+// maxBufferedAccesses bounds how many records' access times are buffered
+// between janitor runs; records first served once the buffer is full aren't
+// tracked until the next run.
+const maxBufferedAccesses = 1 << 20
+
+// trackAccess records when the manifests, short links and indexed
+// attachments requests are served from were last used, for the janitor.
+func trackAccess(store *Store) HandlerFunc {
+	return func(c *Context) {
+		c.Next()
+
+		if c.Writer.Status() >= 400 {
+			return
+		}
+		var keys []string
+		if key := c.GetString(servedRecordKey); key != "" {
+			keys = append(keys, key)
+		}
+		if v, ok := c.Get(linkKey); ok {
+			keys = append(keys, recordKey(recordAttachment, strconv.FormatInt(v.(*LinkData).FileID, 10)))
+		}
+		if len(keys) > 0 {
+			store.Touch(keys...)
+		}
+	}
+}
+
+// Touch marks the records as accessed now. It is called on every request,
+// so rather than taking the store's lock it buffers the times, which
+// CollectGarbage merges into the store before deciding what to delete.
+func (s *Store) Touch(keys ...string) {
+	now := time.Now().UTC()
+	for _, key := range keys {
+		if _, ok := s.accessed.Load(key); !ok && s.accessedKeys.Load() >= maxBufferedAccesses {
+			continue
+		}
+		if _, loaded := s.accessed.Swap(key, now); !loaded {
+			s.accessedKeys.Add(1)
+		}
+	}
+}
+
+// mergeAccessed moves the buffered access times into the store, ignoring
+// keys of records it doesn't hold, such as attachments that were never
+// indexed. Callers must hold the lock.
+func (s *Store) mergeAccessed() {
+	s.accessed.Range(func(k, _ any) bool {
+		v, ok := s.accessed.LoadAndDelete(k)
+		if !ok {
+			return true
+		}
+		s.accessedKeys.Add(-1)
+		if key := k.(string); s.data.hasRecord(key) {
+			if last := v.(time.Time); last.After(s.data.Accessed[key]) {
+				s.data.Accessed[key] = last
+			}
+		}
+		return true
+	})
+}
+
+func (d *storeData) hasRecord(key string) bool {
+	kind, id, _ := strings.Cut(key, "/")
+	var ok bool
+	switch kind {
+	case recordManifest:
+		_, ok = d.Manifests[id]
+	case recordShortLink:
+		_, ok = d.ShortLinks[id]
+	case recordAttachment:
+		_, ok = d.Attachments[id]
+	}
+	return ok
+}
+
+// reclaimed counts what the janitor deleted of one kind.
+type reclaimed struct {
+	records int
+	bytes   int64
+}
+
+// CollectGarbage deletes the records last accessed before cutoff, or created
+// before it if they were never accessed, along with the usage of attachments
+// last requested before it. It returns what it deleted of each kind, sized as
+// encoded in the store, and saves the store, access times included.
+func (s *Store) CollectGarbage(cutoff time.Time) (map[string]reclaimed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mergeAccessed()
+
+	deleted := map[string]reclaimed{}
+	stale := func(kind, id string, created time.Time, record any) bool {
+		key := recordKey(kind, id)
+		last, ok := s.data.Accessed[key]
+		if !ok {
+			last = created
+		}
+		if !last.Before(cutoff) {
+			return false
+		}
+		raw, _ := json.Marshal(record)
+		r := deleted[kind]
+		r.records++
+		r.bytes += int64(len(raw))
+		deleted[kind] = r
+		delete(s.data.Accessed, key)
+		return true
+	}
+	for id, m := range s.data.Manifests {
+		if stale(recordManifest, id, m.CreatedAt, m) {
+			delete(s.data.Manifests, id)
+		}
+	}
+	for slug, link := range s.data.ShortLinks {
+		if stale(recordShortLink, slug, link.CreatedAt, link) {
+			delete(s.data.ShortLinks, slug)
+		}
+	}
+	for id, a := range s.data.Attachments {
+		if stale(recordAttachment, id, a.CreatedAt, a) {
+			delete(s.data.Attachments, id)
+		}
+	}
+	for key, a := range s.data.Usage.Attachments {
+		if a.LastRequested.Before(cutoff) {
+			raw, _ := json.Marshal(a)
+			r := deleted["usage"]
+			r.records++
+			r.bytes += int64(len(raw))
+			deleted["usage"] = r
+			delete(s.data.Usage.Attachments, key)
+		}
+	}
+	// Drop the access times of records deleted some other way.
+	for key := range s.data.Accessed {
+		if !s.data.hasRecord(key) {
+			delete(s.data.Accessed, key)
+		}
+	}
+	return deleted, s.save()
+}
+
+// Janitor periodically deletes stored records and cache entries that
+// haven't been used within the retention window, so data from long
+// forgotten links doesn't accumulate forever.
+type Janitor struct {
+	store     *Store
+	variants  *ByteCache
+	client    *DiscordClient
+	retention time.Duration
+}
+
+func NewJanitor(store *Store, variants *ByteCache, client *DiscordClient, retention time.Duration) *Janitor {
+	return &Janitor{store: store, variants: variants, client: client, retention: retention}
+}
+
+func (j *Janitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		j.collect()
+	}
+}
+
+// collect deletes everything unused within the retention window and reports
+// what it reclaimed.
+func (j *Janitor) collect() {
+	cutoff := time.Now().Add(-j.retention)
+	deleted, err := j.store.CollectGarbage(cutoff)
+	if err != nil {
+		logAt(slog.LevelError, "Failed to save store after collecting garbage: %v", err)
+	}
+	var r reclaimed
+	r.records, r.bytes = j.variants.Expire(cutoff)
+	deleted["variant"] = r
+	j.client.mu.RLock()
+	stale := j.client.stale
+	j.client.mu.RUnlock()
+	r.records, r.bytes = stale.Expire(cutoff)
+	deleted["url"] = r
+
+	var records int
+	var bytes int64
+	for kind, r := range deleted {
+		metrics.Count("janitor.deleted", int64(r.records), "kind:"+kind)
+		metrics.Count("janitor.reclaimed_bytes", r.bytes, "kind:"+kind)
+		records += r.records
+		bytes += r.bytes
+	}
+	if records > 0 {
+		log.Printf("Janitor deleted %d records and cache entries unused for %s, reclaiming %d bytes", records, j.retention, bytes)
+	}
+}
@@ -0,0 +1,106 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// jobEventInterval is how often a job's progress is checked for changes
+	// to stream.
+	jobEventInterval = time.Second
+	// jobEventKeepAlive is how long a stream may go quiet before a comment
+	// is sent, so proxies don't close it as idle.
+	jobEventKeepAlive = 15 * time.Second
+)
+
+// JobProgress is the payload of the events streamed by GET /jobs/:id/events.
+type JobProgress struct {
+	ID        string    `json:"id"`
+	Status    JobStatus `json:"status"`
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Failed    int       `json:"failed"`
+	// ETASeconds estimates how long a running job has left from its rate so
+	// far, once it has processed a batch.
+	ETASeconds *int `json:"etaSeconds,omitempty"`
+}
+
+// progress reports how far the job has got.
+func (job *Job) progress() JobProgress {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	p := JobProgress{
+		ID:        job.id,
+		Status:    job.status,
+		Total:     len(job.urls),
+		Processed: len(job.results),
+		Failed:    job.failed,
+	}
+	if job.status == JobRunning && p.Processed > 0 {
+		elapsed := time.Since(job.startedAt)
+		remaining := elapsed * time.Duration(p.Total-p.Processed) / time.Duration(p.Processed)
+		eta := int(math.Ceil(remaining.Seconds()))
+		p.ETASeconds = &eta
+	}
+	return p
+}
+
+// handleJobEvents streams a job's progress as server-sent events, for
+// progress bars: a progress event whenever it changes, and a done event
+// once the job is done, which ends the stream.
+func handleJobEvents(jobs *JobQueue) HandlerFunc {
+	return func(c *Context) {
+		job, ok := requestedJob(c, jobs)
+		if !ok {
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		// Keeps nginx from buffering the stream.
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		ticker := time.NewTicker(jobEventInterval)
+		defer ticker.Stop()
+		var last JobProgress
+		var lastSent time.Time
+		for {
+			p := job.progress()
+			event := "progress"
+			if p.Status == JobDone {
+				event = "done"
+			}
+			switch {
+			case lastSent.IsZero() || p.Status != last.Status || p.Processed != last.Processed:
+				data, err := json.Marshal(p)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data); err != nil {
+					return
+				}
+				last, lastSent = p, time.Now()
+			case time.Since(lastSent) >= jobEventKeepAlive:
+				if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				lastSent = time.Now()
+			}
+			c.Writer.Flush()
+			if p.Status == JobDone {
+				return
+			}
+
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package discordcdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxJobURLs bounds the links accepted by a single refresh job.
+	maxJobURLs = 250000
+	// jobRetention is how long a finished job's results stay available.
+	jobRetention = 24 * time.Hour
+
+	defaultJobResultLimit = 1000
+	maxJobResultLimit     = 10000
+
+	// jobCallbackTimeout bounds each attempt to deliver a job's results,
+	// and jobCallbackAttempts how many are made, backing off in between.
+	jobCallbackTimeout  = 30 * time.Second
+	jobCallbackAttempts = 5
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+)
+
+type RefreshJobRequest struct {
+	URLs []string `json:"urls"`
+	// CallbackURL, if set, is posted the job's results once it is done.
+	CallbackURL string `json:"callbackURL,omitempty"`
+}
+
+// Callback delivery states reported by the job status endpoint.
+const (
+	callbackPending   = "pending"
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// JobCallback is the body posted to a job's callback URL when it is done.
+type JobCallback struct {
+	ID         string      `json:"id"`
+	Status     JobStatus   `json:"status"`
+	Total      int         `json:"total"`
+	Failed     int         `json:"failed"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+	Results    []JobResult `json:"results"`
+}
+
+type JobResult struct {
+	URL          string     `json:"url"`
+	RefreshedURL string     `json:"refreshedURL,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	ErrorCode    string     `json:"errorCode,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func newJobResult(r linkRefresh) JobResult {
+	result := JobResult{URL: r.raw, RefreshedURL: r.url, ErrorCode: r.code, Error: r.message}
+	if !r.expiresAt.IsZero() {
+		expiresAt := r.expiresAt
+		result.ExpiresAt = &expiresAt
+	}
+	return result
+}
+
+// Job is a batch refresh processed in the background.
+type Job struct {
+	mu        sync.RWMutex
+	id        string
+	requester string
+	status    JobStatus
+	urls      []string
+	results   []JobResult
+	failed    int
+	// callbackURL is posted the results when the job is done, and
+	// callbackStatus tracks the delivery.
+	callbackURL    string
+	callbackStatus string
+	createdAt      time.Time
+	startedAt      time.Time
+	finishedAt     time.Time
+}
+
+// JobQueue runs submitted refresh jobs on a worker pool, pacing each job's
+// Discord calls so large jobs share the rate limit with interactive traffic
+// instead of saturating it.
+type JobQueue struct {
+	mu       sync.RWMutex
+	client   *DiscordClient
+	pool     *WorkerPool
+	interval time.Duration
+	jobs     map[string]*Job
+	// callbackSecret signs the results posted to callback URLs; callbacks
+	// are refused without one.
+	callbackSecret []byte
+	http           *http.Client
+}
+
+// NewJobQueue creates a queue that runs jobs on pool and waits interval
+// between a job's Discord calls.
+func NewJobQueue(client *DiscordClient, pool *WorkerPool, interval time.Duration, callbackSecret string) *JobQueue {
+	return &JobQueue{
+		client:         client,
+		pool:           pool,
+		interval:       interval,
+		jobs:           map[string]*Job{},
+		callbackSecret: []byte(callbackSecret),
+		http:           newCallbackClient(),
+	}
+}
+
+// newCallbackClient returns the client delivering job results. Callback URLs
+// come from API clients, so it only connects to public addresses, checked
+// once the host is resolved, and never through a proxy, which would hide
+// the address; otherwise a callback could reach services on the server's
+// own network, such as a cloud metadata endpoint.
+func newCallbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout, Control: dialPublicOnly}
+	return &http.Client{
+		Timeout:   jobCallbackTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	}
+}
+
+// dialPublicOnly refuses connections to addresses that aren't public.
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !publicAddr(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// nonPublicPrefixes are the special-purpose ranges publicAddr rejects on top
+// of private, loopback, link-local and multicast addresses.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// publicAddr reports whether ip is reachable on the internet rather than
+// only from the server's own host or network.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Submit queues a job refreshing urls on behalf of requester, returning
+// errPoolFull if too many tasks are already waiting. Its results are posted
+// to callbackURL, if set, once it is done.
+func (q *JobQueue) Submit(requester string, urls []string, callbackURL string) (*Job, error) {
+	id, err := newID(16)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		id:        id,
+		requester: requester,
+		status:    JobQueued,
+		urls:      urls,
+		createdAt: time.Now().UTC(),
+	}
+	if callbackURL != "" {
+		job.callbackURL, job.callbackStatus = callbackURL, callbackPending
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.pool.Submit(func() { q.process(job) }); err != nil {
+		return nil, err
+	}
+	q.jobs[id] = job
+	return job, nil
+}
+
+func (q *JobQueue) Get(id string) (*Job, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+// run drops finished jobs after jobRetention. It never returns.
+func (q *JobQueue) run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.expire()
+	}
+}
+
+func (q *JobQueue) process(job *Job) {
+	job.mu.Lock()
+	job.status = JobRunning
+	job.startedAt = time.Now().UTC()
+	job.results = make([]JobResult, 0, len(job.urls))
+	job.mu.Unlock()
+
+	for start := 0; start < len(job.urls); start += refreshBatchSize {
+		if start > 0 && q.interval > 0 {
+			time.Sleep(q.interval)
+		}
+		results := refreshWithRetry(q.client, job.requester, job.urls[start:min(start+refreshBatchSize, len(job.urls))])
+
+		job.mu.Lock()
+		for _, r := range results {
+			if r.failed() {
+				job.failed++
+			}
+			job.results = append(job.results, newJobResult(r))
+		}
+		job.mu.Unlock()
+	}
+
+	job.mu.Lock()
+	job.status = JobDone
+	job.finishedAt = time.Now().UTC()
+	log.Printf("Refresh job %s finished: %d links, %d failed", job.id, len(job.urls), job.failed)
+	job.mu.Unlock()
+
+	if job.callbackURL != "" {
+		go q.deliver(job)
+	}
+}
+
+// deliver posts a finished job's results to its callback URL, signed with
+// HMAC-SHA256 in the X-Signature-256 header so the receiver can check they
+// came from this server. Failed deliveries are retried with backoff; the
+// results stay available from the status endpoint either way.
+func (q *JobQueue) deliver(job *Job) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	job.mu.RLock()
+	err := enc.Encode(&JobCallback{
+		ID:         job.id,
+		Status:     job.status,
+		Total:      len(job.urls),
+		Failed:     job.failed,
+		CreatedAt:  job.createdAt,
+		StartedAt:  job.startedAt,
+		FinishedAt: job.finishedAt,
+		Results:    job.results,
+	})
+	job.mu.RUnlock()
+	if err != nil {
+		logAt(slog.LevelError, "Failed to encode results of job %s: %v", job.id, err)
+		q.setCallbackStatus(job, callbackFailed)
+		return
+	}
+	body := buf.Bytes()
+	mac := hmac.New(sha256.New, q.callbackSecret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = q.postCallback(job, body, signature)
+		if err == nil {
+			logAt(slog.LevelInfo, "Delivered results of job %s to its callback", job.id)
+			metrics.Count("jobs.callbacks", 1, "result:delivered")
+			q.setCallbackStatus(job, callbackDelivered)
+			return
+		}
+		if attempt == jobCallbackAttempts {
+			break
+		}
+		logAt(slog.LevelWarn, "Callback of job %s failed (%v), retrying in %s", job.id, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	logAt(slog.LevelError, "Giving up on the callback of job %s: %v", job.id, err)
+	metrics.Count("jobs.callbacks", 1, "result:failed")
+	q.setCallbackStatus(job, callbackFailed)
+}
+
+func (q *JobQueue) postCallback(job *Job, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, job.callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", job.id)
+	req.Header.Set("X-Signature-256", signature)
+	resp, err := q.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (q *JobQueue) setCallbackStatus(job *Job, status string) {
+	job.mu.Lock()
+	job.callbackStatus = status
+	job.mu.Unlock()
+}
+
+// validCallbackURL reports whether raw is an absolute http or https URL, to
+// a host that isn't a non-public address. Hostnames are checked when the
+// results are delivered, since what they resolve to can change.
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return false
+	}
+	ip, err := netip.ParseAddr(u.Hostname())
+	return err != nil || publicAddr(ip)
+}
+
+func (q *JobQueue) expire() {
+	cutoff := time.Now().Add(-jobRetention)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.jobs {
+		job.mu.RLock()
+		expired := job.status == JobDone && job.finishedAt.Before(cutoff)
+		job.mu.RUnlock()
+		if expired {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+func handleSubmitJob(jobs *JobQueue, config *Config) HandlerFunc {
+	return func(c *Context) {
+		var req RefreshJobRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || len(req.URLs) == 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "URLs are required")
+			return
+		}
+		if len(req.URLs) > maxJobURLs {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("A job can refresh at most %d links", maxJobURLs))
+			return
+		}
+		if req.CallbackURL != "" {
+			if len(jobs.callbackSecret) == 0 {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Job callbacks are not enabled on this server")
+				return
+			}
+			if !validCallbackURL(req.CallbackURL) {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Callback URL must be an http or https URL on a public host")
+				return
+			}
+		}
+
+		job, err := jobs.Submit(requesterOf(c), req.URLs, req.CallbackURL)
+		if errors.Is(err, errPoolFull) {
+			c.Header("Retry-After", retryAfterHeader(jobs.pool.RetryAfter()))
+			respondError(c, http.StatusServiceUnavailable, codeTooManyJobs, "Too many jobs are queued, try again later")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to create job: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create job")
+			return
+		}
+
+		logf(c, slog.LevelInfo, "Queued refresh job %s with %d links", job.id, len(req.URLs))
+		c.JSON(http.StatusAccepted, H{
+			"id":     job.id,
+			"status": JobQueued,
+			"total":  len(req.URLs),
+			"url":    publicURL(c, config) + "/jobs/" + job.id,
+		})
+	}
+}
+
+// requestedJob returns the job the request names, if whoever made the request
+// submitted it, and otherwise writes a 404, so job IDs reveal nothing to
+// other API keys.
+func requestedJob(c *Context, jobs *JobQueue) (*Job, bool) {
+	job, ok := jobs.Get(c.Param("id"))
+	if !ok || job.requester != requesterOf(c) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Job not found")
+		return nil, false
+	}
+	return job, true
+}
+
+func handleJob(jobs *JobQueue) HandlerFunc {
+	return func(c *Context) {
+		job, ok := requestedJob(c, jobs)
+		if !ok {
+			return
+		}
+
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Offset must be a non-negative integer")
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultJobResultLimit)))
+		if err != nil || limit < 1 || limit > maxJobResultLimit {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Limit must be between 1 and %d", maxJobResultLimit))
+			return
+		}
+
+		job.mu.RLock()
+		defer job.mu.RUnlock()
+
+		response := H{
+			"id":        job.id,
+			"status":    job.status,
+			"total":     len(job.urls),
+			"processed": len(job.results),
+			"failed":    job.failed,
+			"createdAt": job.createdAt,
+		}
+		if !job.startedAt.IsZero() {
+			response["startedAt"] = job.startedAt
+		}
+		if !job.finishedAt.IsZero() {
+			response["finishedAt"] = job.finishedAt
+		}
+		if job.callbackStatus != "" {
+			response["callback"] = job.callbackStatus
+		}
+
+		start := min(offset, len(job.results))
+		end := min(start+limit, len(job.results))
+		if end < len(job.urls) {
+			response["nextOffset"] = end
+		}
+		response["results"] = append([]JobResult{}, job.results[start:end]...)
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,230 @@
+package discordcdn
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// claimsKey holds the *jwtClaims of a request authenticated with a JWT.
+	claimsKey = "claims"
+
+	// jwksMaxAge is how long fetched signing keys are trusted before they are
+	// fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits how often an unknown key ID triggers a fetch.
+	jwksMinRefresh = time.Minute
+)
+
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	// Channels, when present, lists the only channel IDs the token may
+	// access.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// allows reports whether the claims grant access to channelID.
+func (c *jwtClaims) allows(channelID int64) bool {
+	return c.Channels == nil || slices.Contains(c.Channels, strconv.FormatInt(channelID, 10))
+}
+
+// JWTVerifier authenticates requests carrying a JWT signed with a shared
+// HS256 secret or with an RS256 key published at a JWKS URL.
+type JWTVerifier struct {
+	secret []byte
+	jwks   *JWKS
+	parser *jwt.Parser
+	// optional lets requests without a token through, for another gate to
+	// handle.
+	optional bool
+}
+
+func NewJWTVerifier(config *Config, optional bool) *JWTVerifier {
+	var methods []string
+	v := &JWTVerifier{optional: optional}
+	if config.JWTSecret != "" {
+		v.secret = []byte(config.JWTSecret)
+		methods = append(methods, "HS256")
+	}
+	if config.JWTJWKSURL != "" {
+		v.jwks = NewJWKS(config.JWTJWKSURL)
+		methods = append(methods, "RS256")
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if config.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(config.JWTIssuer))
+	}
+	if config.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(config.JWTAudience))
+	}
+	v.parser = jwt.NewParser(options...)
+	return v
+}
+
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == "HS256" {
+		return v.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.jwks.key(kid)
+}
+
+// require rejects requests without a valid token, taken from a bearer
+// Authorization header or, for embedded media, the token query parameter.
+func (v *JWTVerifier) require() HandlerFunc {
+	return func(c *Context) {
+		raw := c.Query("token")
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			raw = strings.TrimPrefix(header, "Bearer ")
+		}
+		if raw == "" && v.optional {
+			c.Next()
+			return
+		}
+
+		claims, err := v.verify(raw)
+		if err != nil {
+			if raw != "" {
+				logf(c, slog.LevelWarn, "Rejected JWT: %v", err)
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="discord-cdn"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid token")
+			return
+		}
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// verify returns the claims of a raw token, if it is valid.
+func (v *JWTVerifier) verify(raw string) (*jwtClaims, error) {
+	var claims jwtClaims
+	if _, err := v.parser.ParseWithClaims(raw, &claims, v.key); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// JWKS caches the RSA signing keys published at a JWKS URL. The key set is
+// fetched in the background and swapped in whole, so lookups of known keys
+// never wait on the JWKS URL.
+type JWKS struct {
+	mu        sync.Mutex
+	url       string
+	http      *http.Client
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the fetch under way, if any, is done.
+	fetching chan struct{}
+}
+
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:  url,
+		http: &http.Client{Timeout: 10 * time.Second},
+		keys: map[string]*rsa.PublicKey{},
+	}
+}
+
+// key returns the key with the given ID, fetching the key set again when it
+// is stale or doesn't have the key, so rotated keys are picked up. A stale
+// key is used while the set is fetched; an unknown one waits for the fetch.
+func (j *JWKS) key(kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	var done chan struct{}
+	if !ok || time.Since(j.fetchedAt) > jwksMaxAge {
+		done = j.refresh()
+	}
+	j.mu.Unlock()
+
+	if !ok && done != nil {
+		<-done
+		j.mu.Lock()
+		key, ok = j.keys[kid]
+		j.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh starts fetching the key set, unless a fetch is under way or the
+// last one was too recent, and returns a channel closed when the fetch under
+// way is done, or nil if there is none. j.mu must be held.
+func (j *JWKS) refresh() chan struct{} {
+	if j.fetching != nil || time.Since(j.fetchedAt) <= jwksMinRefresh {
+		return j.fetching
+	}
+	// Failed fetches count too, so an unreachable JWKS URL isn't hammered.
+	j.fetchedAt = time.Now()
+	done := make(chan struct{})
+	j.fetching = done
+	go func() {
+		keys, err := j.fetch()
+		if err != nil {
+			logAt(slog.LevelError, "Failed to fetch JWKS: %v", err)
+		}
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+		}
+		j.fetching = nil
+		j.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch returns the RSA keys published at the JWKS URL.
+func (j *JWKS) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := j.http.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if err := errors.Join(errN, errE); err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
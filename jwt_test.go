@@ -0,0 +1,195 @@
+package discordcdn
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signJWT returns claims signed with HS256 using secret.
+func signJWT(t *testing.T, secret string, claims jwt.Claims) string {
+	t.Helper()
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestJWTVerify(t *testing.T) {
+	v := NewJWTVerifier(&Config{JWTSecret: "secret", JWTIssuer: "auth.example.com"}, false)
+	now := time.Now()
+	valid := func() jwtClaims {
+		return jwtClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "auth.example.com",
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		}}
+	}
+	modified := func(change func(*jwtClaims)) jwtClaims {
+		claims := valid()
+		change(&claims)
+		return claims
+	}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		ok   bool
+	}{
+		{"valid", signJWT(t, "secret", valid()), true},
+		{"wrong secret", signJWT(t, "other", valid()), false},
+		{"unsigned", none, false},
+		{"tampered", signJWT(t, "secret", valid()) + "x", false},
+		{"expired", signJWT(t, "secret", modified(func(c *jwtClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute)) })), false},
+		{"no expiry", signJWT(t, "secret", modified(func(c *jwtClaims) { c.ExpiresAt = nil })), false},
+		{"not yet valid", signJWT(t, "secret", modified(func(c *jwtClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) })), false},
+		{"valid from now", signJWT(t, "secret", modified(func(c *jwtClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(-time.Minute)) })), true},
+		{"wrong issuer", signJWT(t, "secret", modified(func(c *jwtClaims) { c.Issuer = "elsewhere" })), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.verify(tt.raw); (err == nil) != tt.ok {
+				t.Errorf("verify() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWTChannelClaim(t *testing.T) {
+	fake, client := newFakeDiscord(t)
+	link := fake.put(testChannelID, testFileID, "a.png", []byte("image"))
+	router := newTestRouter(t, &Config{JWTSecret: "secret"}, client)
+	token := func(channels ...string) string {
+		return signJWT(t, "secret", jwtClaims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+			Channels:         channels,
+		})
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"any channel", link + "?token=" + token(), http.StatusMovedPermanently},
+		{"granted channel", link + "?token=" + token(strconv.FormatInt(testChannelID, 10)), http.StatusMovedPermanently},
+		{"other channel", link + "?token=" + token(strconv.FormatInt(testChannelID+1, 10)), http.StatusForbidden},
+		{"no channels", link + "?token=" + signJWT(t, "secret", jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "channels": []string{}}), http.StatusForbidden},
+		{"no token", link, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doRequest(router, http.MethodGet, tt.target, nil); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// jwksServer publishes key under kid and counts the fetches.
+type jwksServer struct {
+	kid     string
+	key     *rsa.PublicKey
+	fetches atomic.Int32
+	// stall, while open, holds fetches back.
+	stall chan struct{}
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.fetches.Add(1)
+	if s.stall != nil {
+		<-s.stall
+	}
+	json.NewEncoder(w).Encode(H{"keys": []H{{
+		"kty": "RSA",
+		"kid": s.kid,
+		"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}})
+}
+
+func TestJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &jwksServer{kid: "a", key: &key.PublicKey}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+
+	v := NewJWTVerifier(&Config{JWTJWKSURL: srv.URL}, false)
+	sign := func(kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwtClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+		token.Header["kid"] = kid
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	if _, err := v.verify(sign("a", key)); err != nil {
+		t.Fatalf("token signed with the published key: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(sign("a", other)); err == nil {
+		t.Error("token signed with another key accepted")
+	}
+	if _, err := v.verify(signJWT(t, "", jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})); err == nil {
+		t.Error("HS256 token accepted without a secret")
+	}
+
+	// While a fetch for an unknown key is held up, the known key is still
+	// served and the unknown one fetched only once.
+	server.stall = make(chan struct{})
+	v.jwks.mu.Lock()
+	v.jwks.fetchedAt = time.Now().Add(-2 * jwksMinRefresh)
+	v.jwks.mu.Unlock()
+	before := server.fetches.Load()
+	unknown := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := v.jwks.key("b")
+			unknown <- err
+		}()
+	}
+	known := make(chan error, 1)
+	go func() {
+		_, err := v.verify(sign("a", key))
+		known <- err
+	}()
+	select {
+	case err := <-known:
+		if err != nil {
+			t.Errorf("known key during a fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("known key waited for the fetch")
+	}
+	close(server.stall)
+	for range 2 {
+		if err := <-unknown; err == nil {
+			t.Error("unknown key found")
+		}
+	}
+	if n := server.fetches.Load() - before; n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
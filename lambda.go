@@ -0,0 +1,298 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// lambdaRuntimeVersion is the version of the Lambda runtime API, whose
+// address Lambda passes in AWS_LAMBDA_RUNTIME_API.
+const lambdaRuntimeVersion = "2018-06-01"
+
+// lambdaEvent is an HTTP request as API Gateway and function URLs pass it to
+// Lambda: version 2.0 of the payload format for HTTP APIs and function URLs,
+// or 1.0 for REST APIs, which has no version field.
+type lambdaEvent struct {
+	Version string `json:"version"`
+
+	RawPath        string            `json:"rawPath"`
+	RawQueryString string            `json:"rawQueryString"`
+	Cookies        []string          `json:"cookies"`
+	Headers        map[string]string `json:"headers"`
+
+	HTTPMethod        string              `json:"httpMethod"`
+	Path              string              `json:"path"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	MultiValueQuery   map[string][]string `json:"multiValueQueryStringParameters"`
+
+	RequestContext struct {
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+
+	Body            string `json:"body"`
+	IsBase64Encoded bool   `json:"isBase64Encoded"`
+}
+
+// lambdaResponse is the answer to a lambdaEvent, in the payload format the
+// event came in: 2.0 takes cookies apart from headers, 1.0 takes headers with
+// several values in multiValueHeaders.
+type lambdaResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// RunLambda runs the service as an AWS Lambda function on a custom runtime,
+// behind API Gateway or a function URL, instead of running the server. The
+// configuration is read from the environment like the server's, secrets
+// included, which may refer to SSM parameters and Secrets Manager. Each
+// invocation is served in full before it is answered, so streaming responses
+// don't suit Lambda, and neither do responses beyond Lambda's payload limit,
+// such as large files in proxy mode.
+func RunLambda() {
+	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if api == "" {
+		fatalf("AWS_LAMBDA_RUNTIME_API is not set; run the server outside Lambda")
+	}
+	runtime := &lambdaRuntime{base: "http://" + api + "/" + lambdaRuntimeVersion, http: &http.Client{}}
+
+	config, err := loadConfig()
+	if err != nil {
+		runtime.initError(fmt.Errorf("failed to load config: %w", err))
+	}
+	setLogging(config.LogLevel, config.LogFormat)
+	if config.SentryDSN != "" {
+		if err := initSentry(config); err != nil {
+			runtime.initError(fmt.Errorf("failed to initialize Sentry: %w", err))
+		}
+	}
+	handler, err := NewHandler(config)
+	if err != nil {
+		runtime.initError(err)
+	}
+
+	for {
+		if err := runtime.invoke(handler); err != nil {
+			fatalf("Lambda runtime API failed: %v", err)
+		}
+		if config.SentryDSN != "" {
+			// The function may be frozen, or never thawed, once it answers.
+			sentry.Flush(2 * time.Second)
+		}
+	}
+}
+
+// lambdaRuntime takes invocations from the Lambda runtime API and answers
+// them.
+type lambdaRuntime struct {
+	base string
+	http *http.Client
+}
+
+// invoke waits for the next invocation, serves it with handler and answers
+// it. Only failures to talk to the runtime API are returned; events that
+// can't be served are answered as errors.
+func (r *lambdaRuntime) invoke(handler http.Handler) error {
+	resp, err := r.http.Get(r.base + "/runtime/invocation/next")
+	if err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("next invocation answered %d", resp.StatusCode)
+	}
+	id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	// X-Ray reads the trace of the current invocation from the environment.
+	os.Setenv("_X_AMZN_TRACE_ID", resp.Header.Get("Lambda-Runtime-Trace-Id"))
+
+	ctx := context.Background()
+	if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(ms))
+		defer cancel()
+	}
+
+	var event lambdaEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return r.post("/runtime/invocation/"+id+"/error", lambdaError(fmt.Errorf("invalid event: %w", err)))
+	}
+	req, err := event.request(ctx)
+	if err != nil {
+		return r.post("/runtime/invocation/"+id+"/error", lambdaError(err))
+	}
+	w := &lambdaResponseWriter{header: http.Header{}}
+	if !serveLambda(handler, w, req) {
+		return r.post("/runtime/invocation/"+id+"/error", lambdaError(fmt.Errorf("response to %s was cut off", req.URL.Path)))
+	}
+	return r.post("/runtime/invocation/"+id+"/response", w.response(event.Version == "2.0"))
+}
+
+// serveLambda serves req, returning false when the handler cut the response
+// off. Lambda responses are sent whole, so one that was cut off can only be
+// failed.
+func serveLambda(handler http.Handler, w http.ResponseWriter, req *http.Request) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			ok = false
+		}
+	}()
+	handler.ServeHTTP(w, req)
+	return true
+}
+
+// initError reports a failure to start to Lambda, which logs it and retries
+// the start on the next invocation, and exits.
+func (r *lambdaRuntime) initError(err error) {
+	if postErr := r.post("/runtime/init/error", lambdaError(err)); postErr != nil {
+		logAt(slog.LevelError, "Failed to report init error: %v", postErr)
+	}
+	fatalf("%v", err)
+}
+
+func (r *lambdaRuntime) post(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", path, err)
+	}
+	resp, err := r.http.Post(r.base+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s answered %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+func lambdaError(err error) map[string]string {
+	return map[string]string{"errorMessage": err.Error(), "errorType": "Runtime.Error"}
+}
+
+// request turns the event into the request it stands for.
+func (e *lambdaEvent) request(ctx context.Context) (*http.Request, error) {
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(e.Body); err != nil {
+			return nil, fmt.Errorf("invalid body: %w", err)
+		}
+	}
+
+	// REST APIs pass the path decoded, so it is encoded again, and only
+	// HTTP APIs and function URLs keep file names with encoded slashes intact.
+	method, sourceIP := e.HTTPMethod, e.RequestContext.Identity.SourceIP
+	target := (&url.URL{Path: e.Path, RawQuery: url.Values(e.MultiValueQuery).Encode()}).RequestURI()
+	if e.Version == "2.0" {
+		method, sourceIP = e.RequestContext.HTTP.Method, e.RequestContext.HTTP.SourceIP
+		target = e.RawPath
+		if e.RawQueryString != "" {
+			target += "?" + e.RawQueryString
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.RequestURI = target
+	req.ContentLength = int64(len(body))
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, values := range e.MultiValueHeaders {
+		req.Header.Del(name)
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if len(e.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(e.Cookies, "; "))
+	}
+	req.Host = req.Header.Get("Host")
+	if sourceIP != "" {
+		req.RemoteAddr = net.JoinHostPort(sourceIP, "0")
+	}
+	return req, nil
+}
+
+// lambdaResponseWriter collects a response to hand back to Lambda whole.
+type lambdaResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lambdaResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *lambdaResponseWriter) WriteHeader(status int) {
+	// Informational responses such as Early Hints can't be passed on.
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *lambdaResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// response returns what was written in the 2.0 payload format, or else 1.0.
+// Bodies that aren't plain text are base64-encoded.
+func (w *lambdaResponseWriter) response(v2 bool) *lambdaResponse {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	resp := &lambdaResponse{StatusCode: w.status}
+	if w.header.Get("Content-Encoding") == "" && utf8.Valid(w.body.Bytes()) {
+		resp.Body = w.body.String()
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(w.body.Bytes())
+		resp.IsBase64Encoded = true
+	}
+	if !v2 {
+		resp.MultiValueHeaders = w.header
+		return resp
+	}
+	resp.Headers = make(map[string]string, len(w.header))
+	for name, values := range w.header {
+		if name == "Set-Cookie" {
+			resp.Cookies = values
+			continue
+		}
+		resp.Headers[name] = strings.Join(values, ", ")
+	}
+	return resp
+}
@@ -0,0 +1,133 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// leaderTTL is how long a lock outlives its holder, and so how long a
+	// crashed leader's work goes undone before another replica takes over.
+	leaderTTL = 15 * time.Second
+	// leaderRenewInterval is how often the leader extends its lock and
+	// standbys try to take it.
+	leaderRenewInterval = 5 * time.Second
+)
+
+// renewLeaderScript extends the lock only if this instance still holds it.
+var renewLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLeaderScript deletes the lock only if this instance still holds it.
+var releaseLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// LeaderElector runs periodic work on a single replica. With Redis
+// configured, replicas compete for a lock per task and the rest stand by,
+// taking over when the leader stops renewing it; otherwise every instance
+// leads.
+type LeaderElector struct {
+	client *redis.Client
+	prefix string
+	// id tells this instance's locks apart from other replicas'.
+	id string
+}
+
+func NewLeaderElector(config *Config) (*LeaderElector, error) {
+	if config.RedisURL == "" {
+		return &LeaderElector{}, nil
+	}
+	options, err := redis.ParseURL(config.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	suffix, err := newID(8)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{
+		client: redis.NewClient(options),
+		prefix: config.RedisPrefix + "leader:",
+		id:     hostname + "-" + suffix,
+	}, nil
+}
+
+// Run runs task whenever this instance holds the lock for name, cancelling
+// its context if the lock is lost. It returns once the task returns on its
+// own, so callers start it in a goroutine.
+func (e *LeaderElector) Run(name string, task func(ctx context.Context)) {
+	if e.client == nil {
+		task(context.Background())
+		return
+	}
+
+	key := e.prefix + name
+	for {
+		ok, err := e.client.SetNX(context.Background(), key, e.id, leaderTTL).Result()
+		if err != nil {
+			logAt(slog.LevelError, "Failed to take %s lock: %v", name, err)
+		}
+		if !ok {
+			time.Sleep(leaderRenewInterval)
+			continue
+		}
+
+		log.Printf("Leading %s", name)
+		metrics.Gauge("leader.leading", 1, "task:"+name)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			task(ctx)
+		}()
+		finished := e.hold(ctx, key, done)
+		cancel()
+		<-done
+		releaseLeaderScript.Run(context.Background(), e.client, []string{key}, e.id)
+		metrics.Gauge("leader.leading", 0, "task:"+name)
+		if finished {
+			return
+		}
+		logAt(slog.LevelWarn, "Lost %s lock, standing by", name)
+	}
+}
+
+// hold renews the lock until it is lost or the task returns, and reports
+// whether the task returned. A renewal that fails outright is retried until
+// the lock would have expired, so a brief Redis outage doesn't stop the task.
+func (e *LeaderElector) hold(ctx context.Context, key string, done <-chan struct{}) bool {
+	ticker := time.NewTicker(leaderRenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-done:
+			return true
+		case <-ticker.C:
+		}
+
+		held, err := renewLeaderScript.Run(ctx, e.client, []string{key}, e.id, leaderTTL.Milliseconds()).Int()
+		switch {
+		case err == nil && held == 1:
+			renewed = time.Now()
+		case err == nil:
+			return false
+		case time.Since(renewed) >= leaderTTL-leaderRenewInterval:
+			logAt(slog.LevelError, "Failed to renew %s lock: %v", key, err)
+			return false
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package discordcdn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listen address as a Unix socket path.
+const unixPrefix = "unix:"
+
+// listen opens a TCP listener for host:port addresses, or a Unix socket for
+// addresses of the form unix:/path/to.sock, replacing any stale socket file.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen(listenNetwork(addr), addr)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenNetwork picks the network for a TCP address. Go listens on both IPv4
+// and IPv6 for any wildcard host, so 0.0.0.0 would accept IPv6 connections
+// too; instead an IPv4 host listens on IPv4 only and an IPv6 host, [::]
+// included, on IPv6 only. An empty host or a name listens on both where the
+// system supports it.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// normalizeListen completes listen addresses: a bare port such as 8080
+// listens on every interface, and a host without a port, such as 10.0.0.5 or
+// [::1], gets port, or is rejected when port is 0. Unix socket addresses are
+// kept as they are.
+func normalizeListen(addrs []string, port int) ([]string, error) {
+	normalized := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, unixPrefix) {
+			if addr == unixPrefix {
+				return nil, errors.New("has a Unix socket address without a path")
+			}
+			normalized = append(normalized, addr)
+			continue
+		}
+		if _, err := strconv.Atoi(addr); err == nil {
+			addr = ":" + addr
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+			if port == 0 || strings.Contains(host, "]") {
+				return nil, fmt.Errorf("has an invalid address %q, expected host:port", addr)
+			}
+			addr = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		_, p, _ := net.SplitHostPort(addr)
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("has an invalid port in %q", addr)
+		}
+		normalized = append(normalized, addr)
+	}
+	return normalized, nil
+}
+
+// serve starts handler on every address, over TLS when tlsConfig is set,
+// reporting the first failure of any listener on errs, and returns the
+// servers started, to be shut down.
+func serve(name string, addrs []string, handler http.Handler, tlsConfig *tls.Config, errs chan<- error) []*http.Server {
+	var servers []*http.Server
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			errs <- fmt.Errorf("failed to listen on %s: %w", addr, err)
+			return servers
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+
+		log.Printf("Serving %s routes on %s", name, addr)
+		server := &http.Server{Handler: handler}
+		servers = append(servers, server)
+		go func() {
+			errs <- server.Serve(ln)
+		}()
+	}
+	return servers
+}
@@ -0,0 +1,190 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var (
+	// logLevel is the least severe level logged.
+	logLevel = new(slog.LevelVar)
+	// logJSON switches logs, request logs included, to JSON lines.
+	logJSON atomic.Bool
+)
+
+// logOutput receives every log line.
+var logOutput io.Writer = os.Stderr
+
+// setupLogging routes logs through logHandler. The log package's output
+// goes through it too, at info level.
+func setupLogging() {
+	slog.SetDefault(slog.New(&logHandler{level: logLevel, mu: new(sync.Mutex)}))
+}
+
+// parseLogLevel parses a level name such as "warn".
+func parseLogLevel(name string) (slog.Level, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("must be debug, info, warn or error, got %q", name)
+	}
+	return level, nil
+}
+
+func validLogFormat(format string) bool {
+	return format == logFormatConsole || format == logFormatJSON
+}
+
+// setLogging applies a level and format, which must be valid.
+func setLogging(level, format string) {
+	l, _ := parseLogLevel(level)
+	logLevel.Set(l)
+	logJSON.Store(format == logFormatJSON)
+}
+
+// currentLogging returns the level and format in effect.
+func currentLogging() (level, format string) {
+	format = logFormatConsole
+	if logJSON.Load() {
+		format = logFormatJSON
+	}
+	return strings.ToLower(logLevel.Level().String()), format
+}
+
+// logAt logs a message at level.
+func logAt(level slog.Level, format string, args ...interface{}) {
+	slog.Default().Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// fatalf logs a message at error level and exits.
+func fatalf(format string, args ...interface{}) {
+	logAt(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// logHandler writes records in the format currently chosen: the log
+// package's layout, with the level added, or JSON lines.
+type logHandler struct {
+	level slog.Leveler
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if logJSON.Load() {
+		handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+		if err := handler.WithAttrs(h.attrs).Handle(context.Background(), r); err != nil {
+			return err
+		}
+	} else {
+		attrs := append([]slog.Attr(nil), h.attrs...)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs = append(attrs, a)
+			return true
+		})
+		fmt.Fprintf(&buf, "%s %s %s", r.Time.Format("2006/01/02 15:04:05"), r.Level, strings.TrimSuffix(r.Message, "\n"))
+		for _, a := range attrs {
+			fmt.Fprintf(&buf, " %s=%v", a.Key, a.Value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := logOutput.Write(buf.Bytes())
+	return err
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{level: h.level, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...), mu: h.mu}
+}
+
+func (h *logHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// LogSettings is the body of /admin/log. Fields left out are unchanged.
+type LogSettings struct {
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// handleLogSettings reports the log level and format in effect.
+func handleLogSettings() HandlerFunc {
+	return func(c *Context) {
+		level, format := currentLogging()
+		c.JSON(http.StatusOK, LogSettings{Level: level, Format: format})
+	}
+}
+
+// handleSetLogSettings changes the log level or format until the next
+// restart or config reload, such as to log debug messages during an
+// incident.
+func handleSetLogSettings() HandlerFunc {
+	return func(c *Context) {
+		var req LogSettings
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Body must be a JSON object with level or format")
+			return
+		}
+		level, format := currentLogging()
+		if req.Level != "" {
+			if _, err := parseLogLevel(req.Level); err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "level "+err.Error())
+				return
+			}
+			level = strings.ToLower(req.Level)
+		}
+		if req.Format != "" {
+			if !validLogFormat(req.Format) {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "format must be console or json")
+				return
+			}
+			format = req.Format
+		}
+
+		setLogging(level, format)
+		logf(c, slog.LevelInfo, "Logging set to %s level in %s format", level, format)
+		c.JSON(http.StatusOK, LogSettings{Level: level, Format: format})
+	}
+}
+
+// requestLogEntry is a request log line in JSON format.
+type requestLogEntry struct {
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latencyMS"`
+	ClientIP  string    `json:"clientIP"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"requestID"`
+}
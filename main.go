@@ -1,152 +1,896 @@
-package main
+package discordcdn
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/getsentry/sentry-go"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
-type Config struct {
-	Token string
-	Port  int
+type LinkData struct {
+	ChannelID int64      `json:"channelID"`
+	FileID    int64      `json:"fileID"`
+	FileName  string     `json:"fileName"`
+	Media     url.Values `json:"media,omitempty"`
+	// DisplayName overrides FileName in Content-Disposition headers, since
+	// Discord often mangles uploaded filenames.
+	DisplayName string `json:"displayName,omitempty"`
 }
 
-type LinkData struct {
-	ChannelID int64  `json:"channelID"`
-	FileID    int64  `json:"fileID"`
-	FileName  string `json:"fileName"`
+// Path returns the link in the channelID/fileID/fileName form accepted by the
+// refresh route, with the display name as an extra segment when set.
+func (d *LinkData) Path() string {
+	p := fmt.Sprintf("%d/%d/%s", d.ChannelID, d.FileID, url.PathEscape(d.FileName))
+	if d.DisplayName != "" {
+		p += "/" + url.PathEscape(d.DisplayName)
+	}
+	return p
 }
 
-type ParsedLink struct {
-	Error string    `json:"error"`
-	Data  *LinkData `json:"data"`
+// Name returns the filename clients should see for the attachment.
+func (d *LinkData) Name() string {
+	if d.DisplayName != "" {
+		return d.DisplayName
+	}
+	return d.FileName
 }
 
-type RefreshURLsResponse struct {
-	RefreshedURLs []struct {
-		Original  string `json:"original"`
-		Refreshed string `json:"refreshed"`
-	} `json:"refreshed_urls"`
+// applyQuery overlays per-request options from the query string onto the link.
+func (d *LinkData) applyQuery(query url.Values) {
+	d.Media = mediaQuery(query, d.Media)
+	if name := query.Get("name"); name != "" {
+		d.DisplayName = name
+	}
 }
 
-type DiscordClient struct {
-	token  string
-	client *http.Client
+type ParsedLink struct {
+	Error string    `json:"error"`
+	Data  *LinkData `json:"data"`
 }
 
-func NewDiscordClient(token string) *DiscordClient {
-	return &DiscordClient{
-		token:  token,
-		client: &http.Client{},
+// Main runs the discord-cdn command: the server, or the subcommand named by
+// the first argument.
+func Main() {
+	setupLogging()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fatalf("Migration failed: %v", err)
+		}
+		return
 	}
-}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-db" {
+		if err := runMigrateDB(os.Args[2:]); err != nil {
+			fatalf("Database migration failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:]); err != nil {
+			fatalf("Benchmark failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-store" {
+		if err := runMigrateStore(os.Args[2:]); err != nil {
+			fatalf("Store migration failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			fatalf("Export failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil {
+			fatalf("Import failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "usage-export" {
+		if err := runUsageExport(os.Args[2:]); err != nil {
+			fatalf("Usage export failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache-dump" {
+		if err := runCacheDump(os.Args[2:]); err != nil {
+			fatalf("Cache dump failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "channel-export" {
+		if err := runChannelExport(os.Args[2:]); err != nil {
+			fatalf("Channel export failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "alias-import" {
+		if err := runAliasImport(os.Args[2:]); err != nil {
+			fatalf("Alias import failed: %v", err)
+		}
+		return
+	}
+
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	chdir := flag.String("chdir", "", "directory to run in, where .env and relative paths are found")
+	installService := flag.Bool("install-service", false, "install as a Windows service started with the system, and exit")
+	uninstallService := flag.Bool("uninstall-service", false, "remove the Windows service and exit")
+	flag.Parse()
 
-func (c *DiscordClient) RefreshAttachmentURL(attachmentURL string) (string, error) {
-	body := map[string]interface{}{
-		"attachment_urls": []string{attachmentURL},
+	if *chdir != "" {
+		if err := os.Chdir(*chdir); err != nil {
+			fatalf("Failed to change directory: %v", err)
+		}
+	}
+	if *installService {
+		if err := installWindowsService(); err != nil {
+			fatalf("Failed to install service: %v", err)
+		}
+		log.Printf("Installed the %s service", windowsServiceName)
+		return
+	}
+	if *uninstallService {
+		if err := uninstallWindowsService(); err != nil {
+			fatalf("Failed to remove service: %v", err)
+		}
+		log.Printf("Removed the %s service", windowsServiceName)
+		return
+	}
+	service := inWindowsService()
+	if service {
+		// Windows discards the output of services.
+		file, err := os.OpenFile(serviceLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fatalf("Failed to open service log: %v", err)
+		}
+		defer file.Close()
+		logOutput, requestLogWriter = file, file
 	}
 
-	bodyBytes, err := json.Marshal(body)
+	config, err := loadConfig()
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+		fatalf("Failed to load config: %v", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, "https://discord.com/api/v9/attachments/refresh-urls", bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	if *printConfig {
+		config.printConfig(os.Stdout)
+		return
 	}
+	setLogging(config.LogLevel, config.LogFormat)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", c.token)
+	if config.SentryDSN != "" {
+		if err := initSentry(config); err != nil {
+			fatalf("Failed to initialize Sentry: %v", err)
+		}
+		defer sentry.Flush(2 * time.Second)
+	}
 
-	resp, err := c.client.Do(req)
+	run := func(stop <-chan struct{}) error {
+		return runServer(config, stop)
+	}
+	if service {
+		err = runWindowsService(run)
+	} else {
+		err = run(shutdownSignals())
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to execute request: %w", err)
+		fatalf("%v", err)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("discord API error: %d", resp.StatusCode)
+// runServer serves until a listener fails, returning why, or until stop is
+// closed, when it stops taking connections and gives the requests in flight
+// up to SHUTDOWN_TIMEOUT to finish.
+func runServer(config *Config, stop <-chan struct{}) error {
+	svc, err := newService(config)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	for _, reloader := range svc.reloaders {
+		go reloader.watchSignals()
 	}
 
-	var refreshResponse RefreshURLsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&refreshResponse); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	tlsConfig, err := loadServerTLS(config)
+	if err != nil {
+		return fmt.Errorf("failed to set up TLS: %w", err)
 	}
 
-	if len(refreshResponse.RefreshedURLs) == 0 {
-		return "", fmt.Errorf("no refreshed URLs returned")
+	log.Printf("Server %s (%s) starting", version, commit)
+	errs := make(chan error, len(config.Listen)+len(config.AdminListen)+len(config.GRPCListen))
+	servers := serve("public", config.Listen, svc.public, tlsConfig, errs)
+	if svc.admin != svc.router {
+		servers = append(servers, serve("admin", config.AdminListen, svc.private, tlsConfig, errs)...)
+	}
+	var grpcServer *grpc.Server
+	if len(config.GRPCListen) > 0 {
+		grpcServer = newGRPCServer(svc.client, svc.store, newGRPCAuth(svc.reloaders[0]), grpcTLS(tlsConfig)...)
+		serveGRPC(config.GRPCListen, grpcServer, errs)
+	}
+	select {
+	case err := <-errs:
+		return fmt.Errorf("server failed: %w", err)
+	case <-stop:
 	}
 
-	return refreshResponse.RefreshedURLs[0].Refreshed, nil
+	log.Printf("Shutting down, waiting up to %s for requests in flight", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logAt(slog.LevelWarn, "Cut off requests still in flight after %s", config.ShutdownTimeout)
+			break
+		}
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}
+	log.Printf("Server stopped")
+	return nil
 }
 
-func main() {
-	config, err := loadConfig()
+// newDiscordClient sets up a client calling Discord with config's tokens and
+// limits. Clients share the transport, the rate limit counter, upstream
+// statistics and the invalidator, so tenants draw on the same connections
+// and global budget.
+func newDiscordClient(config *Config, counter RequestCounter, transport http.RoundTripper, upstream *UpstreamStats, invalidator *Invalidator) (*DiscordClient, error) {
+	discordClient := NewDiscordClient(config.Token)
+	discordClient.SetTransport(transport)
+	discordClient.SetTokenMap(config.TokenMap)
+	discordClient.SetShards(config.ShardTokens, config.ShardBy)
+	discordClient.SetChannelAllowlist(config.AllowedChannels, config.AllowedGuilds)
+	discordClient.SetInteractiveReserve(config.InteractiveReserve)
+	discordClient.SetRequestCounter(counter)
+	discordClient.SetGlobalLimit(config.DiscordRateLimit)
+	discordClient.SetMaxQueueWait(config.MaxQueueWait)
+	discordClient.SetConcurrencyLimit(config.UpstreamConcurrency)
+	discordClient.SetHeaders(config.UserAgent, config.ExtraHeaders)
+	discordClient.SetAPIVersion(config.DiscordAPIVersion, config.DiscordAPIFallback)
+	discordClient.SetFallbacks(config.RefreshFallbacks, config.MirrorURL, config.StaleURLCacheSize)
+	discordClient.SetStaleWhileRevalidate(config.StaleWhileRevalidate)
+	discordClient.SetMirrorDeleted(config.MirrorDeleted)
+	shared, err := newSharedURLCache(config, counter)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		return nil, err
+	}
+	discordClient.SetSharedURLCache(shared)
+	if config.URLCacheFile != "" {
+		if err := discordClient.LoadURLSnapshot(config.URLCacheFile); err != nil {
+			logAt(slog.LevelWarn, "Starting with an empty URL cache: %v", err)
+		}
+		go discordClient.runURLSnapshots(config.URLCacheFile, urlSnapshotInterval)
+	}
+	if config.AuditLogPath != "" {
+		audit, err := OpenAuditLog(config.AuditLogPath, config.AuditRetention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		discordClient.SetAuditLog(audit)
+	}
+	if config.ProxyMode && config.DiskCachePath != "" {
+		cache, err := OpenDiskCache(config.DiskCachePath, config.DiskCacheSize, config.DiskCacheMaxFileSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk cache: %w", err)
+		}
+		discordClient.SetDiskCache(cache)
 	}
+	if config.PurgeProvider != "" {
+		discordClient.SetPurger(NewCDNPurger(config.PurgeProvider, config.PurgeZone, config.PurgeToken, config.PurgeInterval))
+	}
+	discordClient.SetUpstreamStats(upstream)
+	discordClient.SetInvalidator(invalidator)
+	monitor := NewTokenMonitor(discordClient, config)
+	discordClient.SetMonitor(monitor)
+	go monitor.run()
+	switch config.ValidateTokens {
+	case "fail":
+		if err := validateTokens(discordClient, configuredTokens(config)); err != nil {
+			return nil, fmt.Errorf("token validation failed: %w", err)
+		}
+	case "warn":
+		go func() {
+			if err := validateTokens(discordClient, configuredTokens(config)); err != nil {
+				logAt(slog.LevelWarn, "%v; requests using these tokens will fail", err)
+			}
+		}()
+	}
+	return discordClient, nil
+}
 
-	discordClient := NewDiscordClient(config.Token)
-	router := gin.Default()
-	router.GET("/*encodedURL", handleURL(discordClient))
+// setupTenant builds the routers of a tenant, with a Discord client, store
+// and caches of its own so nothing one tenant serves leaks to another.
+func setupTenant(base *Config, name string, counter RequestCounter, transport http.RoundTripper, upstream *UpstreamStats, invalidator *Invalidator, ffmpegPath string, accessLogFile io.Writer) (router, admin *Engine, reloader *Reloader, err error) {
+	config, err := base.tenantConfig(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	discordClient, err := newDiscordClient(config, counter, transport, upstream, invalidator)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	variants := NewByteCache(config.TransformCache)
+	var posters *PosterExtractor
+	if ffmpegPath != "" {
+		posters = NewPosterExtractor(ffmpegPath, variants)
+	}
 
-	addr := fmt.Sprintf(":%d", config.Port)
-	log.Printf("Server starting on %s", addr)
-	if err := router.Run(addr); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	router, admin, reloader = setupRouter(config, discordClient, store, NewTransformer(discordClient, variants), posters, counter, accessLogFile)
+	return router, admin, reloader, nil
+}
+
+func setupRouter(config *Config, discordClient *DiscordClient, store *Store, transformer *Transformer, posters *PosterExtractor, counter RequestCounter, accessLogFile io.Writer) (router, admin *Engine, reloader *Reloader) {
+	common := []HandlerFunc{assignRequestID(), logRequests(), recoverPanics()}
+	if accessLogFile != nil {
+		common = append(common, accessLog(accessLogFile))
+	}
+	if config.SentryDSN != "" {
+		common = append(common, sentryMiddleware())
+	}
+	if config.RequestTimeout > 0 {
+		common = append(common, requestTimeout(config.RequestTimeout))
+	}
+
+	transformer.SetWatermark(NewWatermark(config))
+	discordClient.SetVariantCache(transformer.cache)
+
+	router = NewEngine()
+	router.SetTrustedProxies(config.TrustedProxies)
+	router.Use(common...)
+	router.Use(recordRequests())
+	if config.Retention > 0 {
+		router.Use(trackAccess(store))
+	}
+	if len(config.VirtualHosts) > 0 {
+		router.Use(virtualHosts(config.VirtualHosts))
+	}
+
+	// Health checks are registered before any limits or gates so probes are
+	// never turned away.
+	var discordHealth *DiscordHealth
+	if config.ReadyCheckDiscord {
+		discordHealth = NewDiscordHealth(discordClient, config.ReadyCheckInterval)
+	}
+	router.GET("/healthz", handleHealth())
+	router.GET("/readyz", handleReady(discordHealth))
+	router.GET("/healthz/deps", handleDependencies(NewDependencyHealth(config, discordClient, store, counter)))
+	if config.CanaryURL != "" {
+		canary := NewCanary(discordClient, config)
+		go canary.run()
+		router.GET("/healthz/canary", handleCanary(canary))
+	}
+	router.Use(checkMaintenance())
+
+	// With admin listeners configured, admin routes are served only there and
+	// never on the public port.
+	admin = router
+	if len(config.AdminListen) > 0 {
+		admin = NewEngine()
+		admin.SetTrustedProxies(config.TrustedProxies)
+		admin.Use(common...)
+		admin.NoRoute(func(c *Context) {
+			respondError(c, http.StatusNotFound, codeNotFound, "Not found")
+		})
+	}
+
+	var dashboard *Dashboard
+	var usage *UsageTracker
+	if config.apiAuth() {
+		dashboard = NewDashboard()
+		metrics.AddSink(dashboard)
+		router.Use(dashboard.record())
+
+		usage = NewUsageTracker(store)
+		go usage.run(usageFlushInterval)
+		router.Use(usage.record())
+	}
+	if config.Retention > 0 {
+		go NewJanitor(store, transformer.cache, discordClient, config.Retention).run(config.JanitorInterval)
+	}
+	takedowns := NewTakedowns(store, config.MirrorPath)
+	discordClient.SetTakedowns(takedowns)
+	if config.ClamAVAddress != "" {
+		discordClient.SetScanner(NewScanner(config, store))
+	}
+	if config.ModerationURL != "" {
+		moderator := NewWebhookModerator(config.ModerationURL, config.ModerationToken)
+		discordClient.SetModeration(NewModeration(moderator, store, config.ModerationTimeout, config.ModerationFailOpen))
 	}
+	if config.EnrichAttachments {
+		enricher := NewEnricher(discordClient, store)
+		discordClient.SetEnricher(enricher)
+		go enricher.run()
+	}
+	if config.WarmupTop > 0 || config.WarmupFile != "" {
+		go warmCache(discordClient, store, config.WarmupTop, config.WarmupFile, config.WarmupRefresh)
+	}
+
+	// The limiters are created even when disabled so that a reload can turn
+	// them on.
+	reloader = &Reloader{
+		tenant:         config.Tenant,
+		client:         discordClient,
+		keys:           NewKeySet(config.APIKeys),
+		acl:            NewACL(config.ACL),
+		basicAuth:      NewBasicAuth(config.HtpasswdUsers),
+		streams:        NewStreamLimiter(config.MaxStreams, config.MaxStreamsPerIP),
+		perConnection:  &atomic.Int64{},
+		perIP:          NewIPLimiters(rate.Limit(config.BandwidthPerIP), bandwidthBurst(config.BandwidthPerIP)),
+		requestsPerIP:  &atomic.Int64{},
+		requestsPerKey: &atomic.Int64{},
+		channels:       NewChannelLimiter(counter, config.RequestsPerChannel, config.BandwidthPerChannel, config.ChannelLimits),
+		counter:        counter,
+		usage:          usage,
+	}
+	reloader.config.Store(config)
+	reloader.perConnection.Store(config.BandwidthPerConnection)
+	reloader.requestsPerIP.Store(config.RequestsPerIP)
+	reloader.requestsPerKey.Store(config.RequestsPerKey)
+	keys := reloader.keys
+
+	router.Use(requireBasicAuth(reloader.basicAuth))
+	router.Use(enforceACL(reloader.acl, keys))
+	if admin != router {
+		admin.Use(enforceACL(reloader.acl, keys))
+	}
+	router.Use(overrideToken(keys, config.ClientCertNames, config.TokenOverride))
+	router.Use(limitRequests(counter, "ip", reloader.requestsPerIP, (*Context).ClientIP))
+
+	// With JWT or OAuth login enabled, routes that hand out attachments
+	// require a token or a Discord session. A valid token is accepted in place
+	// of a login when both are enabled.
+	var gate []HandlerFunc
+	forwardAuth := &ForwardAuth{client: discordClient, keys: keys, certNames: config.ClientCertNames, basePath: config.BasePath}
+	if config.JWTSecret != "" || config.JWTJWKSURL != "" {
+		forwardAuth.jwt = NewJWTVerifier(config, config.OAuthClientID != "")
+		gate = append(gate, forwardAuth.jwt.require())
+	}
+	if config.OAuthClientID != "" {
+		oauth := NewOAuthGate(config)
+		forwardAuth.oauth = oauth
+		router.GET("/auth/login", oauth.handleLogin())
+		router.GET("/auth/callback", oauth.handleCallback())
+		router.POST("/auth/logout", oauth.handleLogout())
+		gate = append(gate, oauth.require())
+	}
+	if config.apiAuth() || len(gate) > 0 {
+		router.GET("/auth", forwardAuth.handle())
+		router.Handle(http.MethodHead, "/auth", forwardAuth.handle())
+	}
+
+	router.GET("/robots.txt", handleRobots(config.RobotsTxt))
+	if config.WebUI {
+		router.GET("/", handleHome())
+	}
+
+	// Media routes stream attachment content in proxy mode, so transfer limits
+	// apply to them rather than to the lightweight API routes.
+	edge := []HandlerFunc{
+		crawlerControls(config.BlockCrawlers),
+		hotlinkProtection(config.HotlinkAllow, config.HotlinkAllowDirect, []byte(config.HotlinkPlaceholder)),
+		limitChannels(reloader.channels),
+	}
+	var transfer []HandlerFunc
+	if config.ProxyMode {
+		transfer = []HandlerFunc{limitStreams(reloader.streams), throttleBandwidth(reloader.perConnection, reloader.perIP)}
+	}
+	media := append(append(append([]HandlerFunc{}, edge...), gate...), transfer...)
+
+	mediaRoutes := router.Group("/", media...)
+	mediaRoutes.GET("/f/:id", handleManifest(discordClient, store, config))
+	mediaRoutes.GET("/f/:id/:fileName", handleManifest(discordClient, store, config))
+	mediaRoutes.GET("/s/:slug", handleShortLink(discordClient, store, transformer, config))
+	mediaRoutes.GET("/p/:id", handlePermalink(discordClient, store, transformer, config))
+	mediaRoutes.GET("/a/:name", handleAlias(discordClient, store, transformer, config))
+	mediaRoutes.GET("/gallery/*message", handleGallery(discordClient, config))
+	for _, kind := range assetKinds {
+		mediaRoutes.GET("/"+kind+"/:id/:hash", handleAsset(discordClient, config, kind))
+	}
+
+	// Share links are signed by the service, so they grant access on their own
+	// and skip the login gate. One-time links are proxied even in redirect
+	// mode, so the transfer limits always apply.
+	var shares *ShareSigner
+	if config.ShareSecret != "" {
+		shares = NewShareSigner(config.ShareSecret)
+		uses := newShareUses(counter, store, config)
+		streaming := []HandlerFunc{limitStreams(reloader.streams), throttleBandwidth(reloader.perConnection, reloader.perIP)}
+		router.GET("/share/:token", append(append(edge, streaming...), handleShareLink(discordClient, shares, uses, transformer, config))...)
+	}
+
+	// API routes count against each key's quota, unlike admin routes.
+	var api []HandlerFunc
+	if config.apiAuth() {
+		api = []HandlerFunc{
+			requireAPIKey(keys, config.ClientCertNames),
+			limitRequests(counter, "key", reloader.requestsPerKey, func(c *Context) string { return c.GetString(apiKeyKey) }),
+			usage.limitKey(config.KeyDailyQuota, config.KeyMonthlyQuota),
+		}
+	}
+
+	if config.UploadChannelID != 0 {
+		router.POST("/upload", append(api, limitBody(config.MaxUploadSize), handleUpload(discordClient, store, config))...)
+	}
+	router.GET("/api/info/:channelID/:fileID/:fileName", append(api, handleInfo(config))...)
+	router.GET("/api/validate/*link", append(api, handleValidate(config))...)
+	router.GET("/api/metadata/*link", append(append(api, gate...), handleMetadata(discordClient))...)
+	router.GET("/api/exists/*link", append(append(api, gate...), handleExists(discordClient))...)
+	router.GET("/api/checksum/*link", append(append(api, gate...), handleChecksum(discordClient, NewChecksummer(discordClient, store, config.MaxProxySize, config.ChecksumTimeout)))...)
+	router.POST("/api/convert", append(append(api, gate...), limitBody(config.MaxBodySize), handleConvert(discordClient, config))...)
+	// Archives stream attachment content, so the transfer limits of proxy
+	// mode apply to them too.
+	archives := append(append(append([]HandlerFunc{}, api...), gate...), transfer...)
+	router.POST("/api/zip", append(archives, limitBody(config.MaxBodySize), handleZip(discordClient, config))...)
+	if config.apiAuth() {
+		router.POST("/api/shorten", append(api, limitBody(config.MaxBodySize), handleShorten(store, config))...)
+		router.POST("/api/permalink", append(api, limitBody(config.MaxBodySize), handleCreatePermalink(store, config))...)
+		router.POST("/api/permalink/:id", append(api, limitBody(config.MaxBodySize), handleUpdatePermalink(discordClient, store, config))...)
+		router.GET("/api/aliases", append(api, handleListAliases(store, config))...)
+		router.POST("/api/aliases", append(api, limitBody(config.MaxBodySize), handleCreateAlias(store, config))...)
+		router.POST("/api/aliases/:name", append(api, limitBody(config.MaxBodySize), handleUpdateAlias(discordClient, store, config))...)
+		router.DELETE("/api/aliases/:name", append(api, handleDeleteAlias(discordClient, store))...)
+		router.POST("/api/import/aliases", append(api, limitBody(config.MaxJobBodySize), handleImportAliases(discordClient, store))...)
+		if shares != nil {
+			router.POST("/api/share", append(api, limitBody(config.MaxBodySize), handleShare(shares, config))...)
+		}
+		router.GET("/api/search", append(api, handleSearch(store, config))...)
+		router.GET("/api/channels/:channelID/export", append(api, handleChannelExport(discordClient, store))...)
+
+		workers := NewWorkerPool("background", config.Workers, config.WorkerQueueDepth)
+		jobs := NewJobQueue(discordClient, workers, config.JobBatchInterval, config.JobCallbackSecret)
+		go jobs.run()
+		router.POST("/jobs/refresh", append(api, limitBody(config.MaxJobBodySize), handleSubmitJob(jobs, config))...)
+		router.GET("/jobs/:id", append(api, handleJob(jobs))...)
+		router.GET("/jobs/:id/events", append(api, handleJobEvents(jobs))...)
+	}
+	// Admin routes take keys of their own, so that the API keys handed to
+	// clients don't open them.
+	if len(config.AdminKeys) > 0 {
+		// Reports are only taken while there are admins to review them.
+		if config.MaxOpenReports > 0 {
+			router.POST("/report", limitBody(config.MaxBodySize), handleReport(store, config.MaxOpenReports))
+		}
+
+		admin.GET("/stats", requireAdminKey(config.AdminKeys), handleStats(usage, store))
+
+		dashboardRoutes := admin.Group("/admin", requireAdminKey(config.AdminKeys))
+		dashboardRoutes.GET("/", handleDashboard())
+		dashboardRoutes.GET("/stats", handleDashboardStats(dashboard))
+		dashboardRoutes.POST("/reload", handleReload(reloader))
+		dashboardRoutes.GET("/keys", handleKeyUsage(usage, store, keys, config))
+		dashboardRoutes.GET("/usage/export", handleUsageExport(usage, store))
+		dashboardRoutes.GET("/cache", handleCacheDump(discordClient))
+		if disk := discordClient.DiskCache(); disk != nil {
+			dashboardRoutes.DELETE("/disk-cache/:fileID", handleEvictDiskCache(discordClient, disk))
+		}
+		dashboardRoutes.GET("/reports", handleReports(store))
+		dashboardRoutes.POST("/reports/:id/takedown", limitBody(config.MaxBodySize), handleApproveReport(discordClient, takedowns))
+		dashboardRoutes.POST("/reports/:id/dismiss", handleDismissReport(store))
+		dashboardRoutes.GET("/takedowns", handleTakedowns(store))
+		dashboardRoutes.POST("/takedowns", limitBody(config.MaxBodySize), handleAddTakedown(discordClient, takedowns))
+		dashboardRoutes.DELETE("/takedowns/:key", handleDeleteTakedown(store))
+		if config.ClamAVAddress != "" {
+			dashboardRoutes.GET("/flagged", handleFlagged(store))
+			dashboardRoutes.DELETE("/flagged/*key", handleAllowFlagged(store))
+		}
+		if config.ModerationURL != "" {
+			dashboardRoutes.GET("/moderation", handleModerationVerdicts(store))
+			dashboardRoutes.POST("/moderation/:fileID", limitBody(config.MaxBodySize), handleOverrideModeration(discordClient, store))
+			dashboardRoutes.DELETE("/moderation/:fileID", handleForgetModeration(store))
+		}
+		if monitor := discordClient.Monitor(); monitor != nil {
+			dashboardRoutes.GET("/tokens", handleTokenHealth(monitor))
+		}
+		if audit := discordClient.AuditLog(); audit != nil {
+			dashboardRoutes.GET("/audit", handleAudit(audit))
+		}
+		if upstream := discordClient.UpstreamStats(); upstream != nil {
+			dashboardRoutes.GET("/upstream", handleUpstream(upstream, discordClient.Concurrency()))
+		}
+		// Logging is shared by every tenant, so only the default
+		// configuration's keys may change it.
+		if config.Tenant == "" {
+			dashboardRoutes.GET("/log", handleLogSettings())
+			dashboardRoutes.POST("/log", limitBody(config.MaxBodySize), handleSetLogSettings())
+		}
+	}
+	// The operations API changes the whole instance, so it is only served
+	// on the admin listeners of the default configuration.
+	if admin != router && config.AdminToken != "" && config.Tenant == "" {
+		opsRoutes := admin.Group("/admin/ops", requireAdminToken(config.AdminToken))
+		opsRoutes.GET("", handleOpsStatus())
+		opsRoutes.POST("/drain", handleDrain(true))
+		opsRoutes.DELETE("/drain", handleDrain(false))
+		opsRoutes.POST("/maintenance", limitBody(config.MaxBodySize), handleSetMaintenance())
+		opsRoutes.DELETE("/maintenance", handleClearMaintenance())
+		opsRoutes.POST("/flush", handleFlushCaches(discordClient))
+		opsRoutes.POST("/token", limitBody(config.MaxBodySize), handleRotateToken(discordClient, reloader))
+		opsRoutes.GET("/config", handleDumpConfig(reloader))
+	}
+	router.POST("/graphql", append(append(api, gate...), limitBody(config.MaxBodySize), handleGraphQL(newGraphQLHandler(discordClient, store, config)))...)
+	router.GET("/qr/*link", handleQR(config))
+	router.GET("/oembed", append(gate, handleOEmbed(discordClient, store, config))...)
+	admin.GET("/version", handleVersion(config, posters))
+	router.GET("/preview/*link", handlePreview(config))
+	router.GET("/placeholder/*link", append(gate, handlePlaceholder(discordClient, transformer))...)
+	router.GET("/waveform/*link", append(gate, handleWaveform(discordClient, store))...)
+	if stickers := NewStickerRenderer(discordClient, transformer.cache, config.LottieConverterPath); stickers != nil {
+		router.GET("/sticker/:stickerID", append(gate, handleSticker(stickers))...)
+	}
+	if posters != nil {
+		router.GET("/poster/*link", append(gate, handlePoster(discordClient, posters))...)
+	}
+	// The OpenAPI document is built from the routes above, so it goes last.
+	// Admin routes are described alongside the public ones unless they have
+	// listeners of their own.
+	router.GET("/openapi.json", handleOpenAPI(router))
+	if admin != router {
+		admin.GET("/openapi.json", handleOpenAPI(admin))
+	}
+	router.NoRoute(append(media, handleURL(discordClient, transformer, config))...)
+	return router, admin, reloader
 }
 
-func handleURL(client *DiscordClient) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		encodedURL := strings.TrimPrefix(c.Param("encodedURL"), "/")
-		if encodedURL == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "URL is required"})
+func handleURL(client *DiscordClient, transformer *Transformer, config *Config) HandlerFunc {
+	return func(c *Context) {
+		if c.Request.Method != http.MethodGet {
+			respondError(c, http.StatusNotFound, codeNotFound, "Not found")
+			return
+		}
+
+		data := parseLinkPath(c, c.Request.URL.Path)
+		if data == nil {
 			return
 		}
 
-		decodedURL, err := url.PathUnescape(encodedURL)
+		serveAttachment(c, client, transformer, config, data)
+	}
+}
+
+// parseLinkPath decodes a request path carrying an attachment link and parses
+// it. On failure it writes a 400 response and returns nil.
+func parseLinkPath(c *Context, path string) *LinkData {
+	encodedURL := strings.TrimPrefix(path, "/")
+	if encodedURL == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+		return nil
+	}
+
+	// Links pasted into the path are sometimes encoded twice. A path that
+	// doesn't decode again was only encoded once, and has a literal % in it.
+	decodedURL, err := url.PathUnescape(encodedURL)
+	if err != nil {
+		decodedURL = encodedURL
+	}
+	if channelID, ok := c.Get(defaultChannelKey); ok {
+		decodedURL = withDefaultChannel(decodedURL, channelID.(int64))
+	}
+
+	parsedLink := parseLink(decodedURL)
+	if parsedLink.Error != "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+		return nil
+	}
+
+	parsedLink.Data.applyQuery(c.QueryValues())
+	return parsedLink.Data
+}
+
+// serveAttachment refreshes the attachment's URL and either redirects to it
+// or, in proxy mode, streams its content. Proxied images can additionally be
+// resized and re-encoded through the w, h and fmt query parameters.
+func serveAttachment(c *Context, client *DiscordClient, transformer *Transformer, config *Config, data *LinkData) {
+	target := attachmentURL(data.ChannelID, data.FileID, data.FileName)
+	c.Set(attachmentKey, strings.TrimPrefix(target, attachmentURLPrefix))
+	c.Set(linkKey, data)
+	setSurrogateKeys(c, data)
+	if !authorizeChannel(c, client, data.ChannelID) || !limitChannel(c, data.ChannelID) {
+		return
+	}
+
+	var transform *TransformOptions
+	if config.ProxyMode {
+		var err error
+		transform, err = parseTransformOptions(c.QueryValues())
 		if err != nil {
-			log.Printf("Failed to decode URL: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL format"})
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid transform: "+err.Error())
+			return
+		}
+		// Watermarked images are served as a variant even when the query
+		// asks for none.
+		if transformer.watermark.appliesTo(data) {
+			if transform == nil {
+				transform = &TransformOptions{}
+			}
+			transform.Watermark = true
+		}
+		if config.ClientHints && hasExtension(data.FileName, hintedExtensions) {
+			c.Header("Accept-CH", acceptClientHints)
+			c.Writer.Header().Add("Vary", acceptClientHints)
+			transform = applyClientHints(c.Request.Header, transform)
+		}
+		if config.NegotiateFormat && (transform == nil || transform.Format == "") && hasExtension(data.FileName, negotiableExtensions) {
+			c.Writer.Header().Add("Vary", "Accept")
+			// WebP originals are only worth converting to AVIF.
+			if format := negotiateImageFormat(c.GetHeader("Accept")); format != "" && !(format == "webp" && hasExtension(data.FileName, []string{".webp"})) {
+				if transform == nil {
+					transform = &TransformOptions{}
+				}
+				transform.Format = format
+			}
+		}
+		applyContentDisposition(c, data.Name(), data.DisplayName != "")
+	}
+
+	if takenDown(c, client, data.FileID) {
+		return
+	}
+
+	if config.ProxyMode {
+		etag := attachmentETag(data, transform)
+		modTime := snowflakeTime(data.FileID)
+		c.Header("ETag", etag)
+		c.Header("Last-Modified", modTime.Format(http.TimeFormat))
+		if notModified(c.Request, etag, modTime) {
+			c.Status(http.StatusNotModified)
 			return
 		}
+	}
 
-		parsedLink := parseLink(decodedURL)
-		if parsedLink.Error != "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": parsedLink.Error})
+	// Responses that skip the refresh below still honor kept denials.
+	moderation := client.Moderation()
+	if moderation != nil && moderation.denied(c, data.FileID) {
+		return
+	}
+
+	if transform != nil {
+		if variant, contentType, ok := transformer.Cached(data, transform); ok {
+			c.Data(http.StatusOK, contentType, variant)
+			return
+		}
+	}
+	// Transforms re-encode the image, which leaves its metadata behind anyway.
+	strip := config.ProxyMode && config.StripMetadata && transform == nil && hasExtension(data.FileName, strippableExtensions)
+	if strip {
+		if stripped, contentType, ok := transformer.CachedStripped(data); ok {
+			serveStrippedBytes(c, stripped, contentType, data)
 			return
 		}
+	}
 
-		attachmentURL := fmt.Sprintf("https://cdn.discordapp.com/attachments/%d/%d/%s",
-			parsedLink.Data.ChannelID, parsedLink.Data.FileID, parsedLink.Data.FileName)
+	// Attachments on disk skip Discord altogether, so the allowlist is
+	// checked here rather than by the refresh, and those never moderated,
+	// from before moderation was turned on, go through it.
+	if disk := client.DiskCache(); disk != nil && transform == nil && !strip && client.allowsChannel(data.ChannelID) &&
+		(moderation == nil || moderation.judged(data.FileID)) && serveDiskCached(c, client, disk, data) {
+		return
+	}
 
-		newURL, err := client.RefreshAttachmentURL(attachmentURL)
+	// While Discord refreshes the link, browsers can start loading the URL
+	// it returned last time, which is usually the one it returns again.
+	if !config.ProxyMode && config.EarlyHints {
+		if cached, ok := client.CachedURL(target); ok {
+			if len(data.Media) > 0 {
+				cached = mediaURL(cached, data.Media)
+			}
+			sendEarlyHints(c, cached)
+		}
+	}
+
+	newURL, fallback, err := client.RefreshWithFallback(c.Request.Context(), requesterOf(c), target)
+	c.Set(refreshedKey, err == nil && fallback == "")
+	if err != nil {
+		respondRefreshError(c, err)
+		return
+	}
+	if fallback != "" {
+		c.Header("X-Refresh-Fallback", fallback)
+	}
+	// Links served from the mirror or the stale cache after Discord failed
+	// aren't worth refreshing again.
+	if config.VerifyRedirects && !config.ProxyMode && fallback == "" {
+		newURL, err = client.VerifyRedirect(c.Request.Context(), requesterOf(c), target, newURL)
 		if err != nil {
-			log.Printf("Error refreshing attachment URL: %v", err)
-			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to refresh URL"})
+			respondRefreshError(c, err)
 			return
 		}
+	}
+
+	if moderation != nil && !moderateAttachment(c, moderation, data, newURL) {
+		return
+	}
+
+	// The original is scanned, whatever variant is served.
+	if scanner := client.Scanner(); scanner != nil && config.ProxyMode && !scanAttachment(c, scanner, client, data, newURL) {
+		return
+	}
+
+	// The mirror knows nothing of Discord's media proxy parameters.
+	if len(data.Media) > 0 && fallback != fallbackMirror {
+		newURL = mediaURL(newURL, data.Media)
+	}
+
+	if transform != nil {
+		serveTransformed(c, transformer, data, newURL, transform)
+		return
+	}
+
+	if strip {
+		serveStripped(c, transformer, data, newURL, config.MaxProxySize)
+		return
+	}
 
-		c.Redirect(http.StatusMovedPermanently, newURL)
+	if config.ProxyMode {
+		proxyContent(c, client, newURL, config.MaxProxySize, DiskCacheKey(data))
+		return
 	}
+
+	c.Redirect(http.StatusMovedPermanently, newURL)
 }
 
+// parseLink reads an attachment link in any of the forms clients send: a
+// CDN or media proxy URL, with or without its scheme and in any case, or the
+// bare channelID/fileID/fileName[/displayName] path. Links pasted from chat
+// or exported from JSON often come wrapped, escaped or encoded whole, and
+// filenames percent-encoded, so those are undone before the link is read.
 func parseLink(input string) *ParsedLink {
-	input = cleanURL(input)
-	parts := strings.Split(input, "/")
+	input = unwrapLink(input)
+	// A link with no slashes left was encoded whole, such as in a query
+	// string.
+	if !strings.Contains(input, "/") && strings.Contains(input, "%") {
+		if decoded, err := url.QueryUnescape(input); err == nil {
+			input = unwrapLink(decoded)
+		}
+	}
+	input, _, _ = strings.Cut(input, "#")
 
-	if len(parts) != 3 {
+	var media url.Values
+	if idx := strings.IndexByte(input, '?'); idx != -1 && hasMediaParams(input[idx+1:]) {
+		if query, err := url.ParseQuery(input[idx+1:]); err == nil {
+			media = mediaQuery(query, nil)
+		}
+	}
+
+	// The segments are cut out of the cleaned link rather than split into a
+	// slice, since every request goes through here.
+	var parts [4]string
+	rest := cleanURL(input)
+	n := 0
+	for ; rest != "" && n < len(parts); n++ {
+		parts[n], rest, _ = strings.Cut(rest, "/")
+	}
+	if (n != 3 && n != 4) || rest != "" {
 		return &ParsedLink{Error: "Invalid link format"}
 	}
 
@@ -154,59 +898,115 @@ func parseLink(input string) *ParsedLink {
 	if err != nil {
 		return &ParsedLink{Error: "Invalid Channel ID"}
 	}
+	if !validSnowflake(channelID) {
+		return &ParsedLink{Error: "Channel ID is not a Discord ID"}
+	}
 
 	fileID, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
 		return &ParsedLink{Error: "Invalid File ID"}
 	}
+	if !validSnowflake(fileID) {
+		return &ParsedLink{Error: "File ID is not a Discord ID"}
+	}
 
-	if !strings.Contains(parts[2], ".") {
+	fileName := unescapeFileName(parts[2])
+	if !strings.Contains(fileName, ".") {
 		return &ParsedLink{Error: "File name must include extension"}
 	}
 
 	return &ParsedLink{
 		Data: &LinkData{
-			ChannelID: channelID,
-			FileID:    fileID,
-			FileName:  parts[2],
+			ChannelID:   channelID,
+			FileID:      fileID,
+			FileName:    fileName,
+			Media:       media,
+			DisplayName: unescapeFileName(parts[3]),
 		},
 	}
 }
 
-func cleanURL(url string) string {
-	if idx := strings.Index(url, "?"); idx != -1 {
-		url = url[:idx]
+// unwrapLink trims what a link picks up on its way through chat messages and
+// exports: surrounding whitespace, including the invisible kind, the <> that
+// Discord wraps links in to suppress their embeds, quotes, and the \/ that
+// JSON may escape slashes as.
+func unwrapLink(input string) string {
+	input = strings.TrimFunc(input, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\u200b' || r == '\ufeff'
+	})
+	for _, pair := range [...]string{"<>", `""`, "''"} {
+		if len(input) >= 2 && input[0] == pair[0] && input[len(input)-1] == pair[1] {
+			input = input[1 : len(input)-1]
+		}
 	}
-	if idx := strings.Index(url, "attachments/"); idx != -1 {
-		url = url[idx+len("attachments/"):]
+	if strings.Contains(input, `\/`) {
+		input = strings.ReplaceAll(input, `\/`, "/")
 	}
-	return url
+	return input
 }
 
-func loadConfig() (*Config, error) {
-	if err := godotenv.Load(); err != nil {
-		// continue with environment variables
+// unescapeFileName decodes a percent-encoded filename, such as one copied
+// from a browser's address bar, so the same attachment is read the same
+// whichever way its link was written. Names that don't decode to valid UTF-8
+// are kept as they are, as are names with no escapes, without allocating.
+//
+// Discord replaces ? and # in the filenames it stores, so one decoded here
+// starts a query or fragment that was encoded along with the link.
+func unescapeFileName(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
 	}
-
-	port, err := strconv.Atoi(getEnv("PORT", "8080"))
-	if err != nil {
-		return nil, fmt.Errorf("invalid port value: %w", err)
+	decoded, err := url.PathUnescape(name)
+	if err != nil || !utf8.ValidString(decoded) || strings.Contains(decoded, "/") {
+		return name
 	}
+	if i := strings.IndexAny(decoded, "?#"); i != -1 {
+		decoded = decoded[:i]
+	}
+	return decoded
+}
 
-	token := getEnv("TOKEN", "")
-	if token == "" {
-		return nil, fmt.Errorf("discord token is required")
+// cleanURL reduces a link to channelID/fileID/fileName[/displayName]. Full
+// CDN and media proxy URLs, with or without their scheme, lose everything up
+// to attachments/, matched in any case, and empty segments from leading,
+// trailing or doubled slashes are dropped.
+//
+// Links that are already clean, the common case, come back as a substring
+// without allocating.
+func cleanURL(url string) string {
+	if idx := strings.IndexByte(url, '?'); idx != -1 {
+		url = url[:idx]
+	}
+	if idx := indexAttachments(url); idx != -1 {
+		url = url[idx+len("attachments/"):]
 	}
 
-	return &Config{
-		Token: token,
-		Port:  port,
-	}, nil
+	url = strings.Trim(url, "/")
+	if !strings.Contains(url, "//") {
+		return url
+	}
+	var b strings.Builder
+	b.Grow(len(url))
+	for i := 0; i < len(url); i++ {
+		if url[i] == '/' && url[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(url[i])
+	}
+	return b.String()
 }
 
-func getEnv(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// indexAttachments returns the index of the first attachments/ in a link,
+// ignoring case, or -1 if there is none.
+func indexAttachments(link string) int {
+	const segment = "attachments/"
+	if idx := strings.Index(link, segment); idx != -1 {
+		return idx
+	}
+	for i := 0; i+len(segment) <= len(link); i++ {
+		if strings.EqualFold(link[i:i+len(segment)], segment) {
+			return i
+		}
 	}
-	return fallback
+	return -1
 }
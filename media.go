@@ -0,0 +1,65 @@
+package discordcdn
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const mediaProxyHost = "media.discordapp.net"
+
+// mediaParams are the query parameters Discord's media proxy understands for
+// resizing and re-encoding images.
+var mediaParams = []string{"format", "width", "height", "quality"}
+
+// hasMediaParams reports whether a raw query string has any media proxy
+// parameters, so links carrying only their signature skip parsing it.
+func hasMediaParams(rawQuery string) bool {
+	for rawQuery != "" {
+		var param string
+		param, rawQuery, _ = strings.Cut(rawQuery, "&")
+		key, _, _ := strings.Cut(param, "=")
+		if slices.Contains(mediaParams, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaQuery returns base overlaid with any media proxy parameters present in
+// query. Parameters not understood by the media proxy are dropped.
+func mediaQuery(query, base url.Values) url.Values {
+	var media url.Values
+	for _, key := range mediaParams {
+		value := query.Get(key)
+		if value == "" {
+			value = base.Get(key)
+		}
+		if value == "" {
+			continue
+		}
+		if media == nil {
+			media = url.Values{}
+		}
+		media.Set(key, value)
+	}
+	return media
+}
+
+// mediaURL rewrites a refreshed CDN URL onto the media proxy host with the
+// given parameters added alongside its signature.
+func mediaURL(refreshedURL string, media url.Values) string {
+	u, err := url.Parse(refreshedURL)
+	if err != nil {
+		return refreshedURL
+	}
+
+	query := u.Query()
+	for key := range media {
+		query.Set(key, media.Get(key))
+	}
+
+	u.Host = mediaProxyHost
+	u.RawQuery = query.Encode()
+	return u.String()
+}
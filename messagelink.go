@@ -0,0 +1,72 @@
+package discordcdn
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// messageLinkHosts are the Discord client hosts message links are copied
+// from.
+var messageLinkHosts = map[string]bool{
+	"discord.com":        true,
+	"ptb.discord.com":    true,
+	"canary.discord.com": true,
+	"discordapp.com":     true,
+}
+
+// MessageLink identifies a message by a link copied from the Discord client.
+// Messages in threads and forum posts carry the thread's ID as their channel.
+type MessageLink struct {
+	// GuildID is 0 for direct messages.
+	GuildID   int64
+	ChannelID int64
+	MessageID int64
+}
+
+// parseMessageLink parses a message link of the form
+// https://discord.com/channels/<guild>/<channel>/<message>. It also accepts
+// links to a thread or forum post, /channels/<guild>/<thread>, and their
+// split-view form /channels/<guild>/<channel>/threads/<thread>[/<message>],
+// which stand for the message the thread starts from.
+func parseMessageLink(raw string) (*MessageLink, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || !messageLinkHosts[strings.ToLower(u.Hostname())] {
+		return nil, false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "channels" {
+		return nil, false
+	}
+	parts = parts[1:]
+
+	var guildID int64
+	if parts[0] != "@me" {
+		if guildID, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return nil, false
+		}
+	}
+	ids := parts[1:]
+	if len(ids) >= 3 && ids[1] == "threads" {
+		ids = ids[2:]
+	}
+
+	var link MessageLink
+	link.GuildID = guildID
+	switch len(ids) {
+	case 1:
+		link.ChannelID, err = strconv.ParseInt(ids[0], 10, 64)
+		link.MessageID = link.ChannelID
+	case 2:
+		link.ChannelID, err = strconv.ParseInt(ids[0], 10, 64)
+		if err == nil {
+			link.MessageID, err = strconv.ParseInt(ids[1], 10, 64)
+		}
+	default:
+		return nil, false
+	}
+	if err != nil || !validSnowflake(link.ChannelID) || !validSnowflake(link.MessageID) {
+		return nil, false
+	}
+	return &link, true
+}
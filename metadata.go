@@ -0,0 +1,307 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// strippableExtensions are the images whose metadata is stripped in proxy
+// mode with DCDN_STRIP_METADATA.
+var strippableExtensions = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+var errMalformedImage = errors.New("image is malformed")
+
+// exifHeader prefixes EXIF data in JPEG APP1 segments, and sometimes in WebP.
+const exifHeader = "Exif\x00\x00"
+
+// strippedCacheKey keys the stripped copy of an attachment in the transform
+// cache, apart from its resized variants. Like theirs, the key carries the
+// channel, since cached copies are served after checking access to the
+// link's channel alone.
+func strippedCacheKey(data *LinkData) string {
+	key := fmt.Sprintf("%d/%d/stripped", data.ChannelID, data.FileID)
+	if len(data.Media) > 0 {
+		key += "?" + data.Media.Encode()
+	}
+	return key
+}
+
+// CachedStripped returns the stripped copy of an attachment, if cached.
+func (t *Transformer) CachedStripped(data *LinkData) ([]byte, string, bool) {
+	return t.cache.Get(strippedCacheKey(data))
+}
+
+// Stripped downloads the image at sourceURL and removes its metadata,
+// keeping the copy in the transform cache. Images larger than maxSize, if
+// set, or than transforms accept, are refused.
+func (t *Transformer) Stripped(ctx context.Context, data *LinkData, sourceURL string, maxSize int64) ([]byte, string, error) {
+	limit := int64(maxTransformSourceBytes)
+	if maxSize > 0 {
+		limit = min(limit, maxSize)
+	}
+	resp, err := t.client.Download(ctx, sourceURL, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > limit {
+		return nil, "", errImageTooLarge
+	}
+	source, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if int64(len(source)) > limit {
+		return nil, "", errImageTooLarge
+	}
+
+	stripped, format, err := stripMetadata(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if format != "" {
+		metrics.Count("metadata.stripped", 1, "format:"+format)
+	}
+	contentType := sniffContentType(resp.Header.Get("Content-Type"), stripped[:min(len(stripped), sniffLen)])
+	t.cache.Put(strippedCacheKey(data), contentType, stripped)
+	return stripped, contentType, nil
+}
+
+// serveStripped proxies an image with its metadata removed. The whole image
+// is read before anything is sent, so Range requests are answered from the
+// stripped copy rather than forwarded.
+func serveStripped(c *Context, transformer *Transformer, data *LinkData, sourceURL string, maxSize int64) {
+	stripped, contentType, err := transformer.Stripped(c.Request.Context(), data, sourceURL, maxSize)
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Image is too large to strip metadata from")
+	case errors.Is(err, errMalformedImage):
+		respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Image metadata couldn't be stripped")
+	case err != nil:
+		logf(c, slog.LevelError, "Error fetching image: %v", err)
+		reportError(c, err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to fetch attachment")
+	default:
+		serveStrippedBytes(c, stripped, contentType, data)
+	}
+}
+
+func serveStrippedBytes(c *Context, stripped []byte, contentType string, data *LinkData) {
+	setContentHeaders(c, contentType)
+	http.ServeContent(c.Writer, c.Request, "", snowflakeTime(data.FileID), bytes.NewReader(stripped))
+}
+
+// stripMetadata removes EXIF, XMP and textual metadata from a JPEG, PNG or
+// WebP image, returning the format it recognized, or the image unchanged and
+// "" if it is none of them. An EXIF orientation other than the default is
+// kept, alone, so the image isn't shown rotated.
+func stripMetadata(src []byte) ([]byte, string, error) {
+	switch {
+	case bytes.HasPrefix(src, []byte("\xff\xd8")):
+		out, err := stripJPEG(src)
+		return out, "jpeg", err
+	case bytes.HasPrefix(src, []byte("\x89PNG\r\n\x1a\n")):
+		out, err := stripPNG(src)
+		return out, "png", err
+	case len(src) >= 12 && string(src[:4]) == "RIFF" && string(src[8:12]) == "WEBP":
+		out, err := stripWebP(src)
+		return out, "webp", err
+	}
+	return src, "", nil
+}
+
+// stripJPEG drops the APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments before the image data.
+func stripJPEG(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	out = append(out, src[:2]...)
+	oriented := false
+	for i := 2; i < len(src); {
+		if src[i] != 0xff {
+			return nil, errMalformedImage
+		}
+		// Markers may be padded with any number of fill bytes.
+		for i+1 < len(src) && src[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(src) {
+			return nil, errMalformedImage
+		}
+		marker := src[i+1]
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// Start of scan or end of image: the rest is image data.
+			return append(out, src[i:]...), nil
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			out = append(out, src[i:i+2]...)
+			i += 2
+			continue
+		}
+		if i+4 > len(src) {
+			return nil, errMalformedImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(src[i+2:]))
+		if end < i+4 || end > len(src) {
+			return nil, errMalformedImage
+		}
+		switch marker {
+		case 0xe1:
+			payload := src[i+4 : end]
+			if !oriented && bytes.HasPrefix(payload, []byte(exifHeader)) {
+				if orientation := exifOrientation(payload[len(exifHeader):]); orientation > 1 {
+					segment := append([]byte(exifHeader), minimalEXIF(orientation)...)
+					out = append(out, 0xff, 0xe1, byte((len(segment)+2)>>8), byte(len(segment)+2))
+					out = append(out, segment...)
+					oriented = true
+				}
+			}
+		case 0xed, 0xfe:
+		default:
+			out = append(out, src[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripPNG drops the eXIf, textual (which carry XMP too) and tIME chunks.
+func stripPNG(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	out = append(out, src[:8]...)
+	for i := 8; i < len(src); {
+		if i+12 > len(src) {
+			return nil, errMalformedImage
+		}
+		n := int(binary.BigEndian.Uint32(src[i:]))
+		typ := string(src[i+4 : i+8])
+		end := i + 12 + n
+		if n < 0 || end > len(src) {
+			return nil, errMalformedImage
+		}
+		switch typ {
+		case "eXIf":
+			if orientation := exifOrientation(src[i+8 : i+8+n]); orientation > 1 {
+				out = appendPNGChunk(out, typ, minimalEXIF(orientation))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, src[i:end]...)
+		}
+		i = end
+		if typ == "IEND" {
+			break
+		}
+	}
+	return out, nil
+}
+
+func appendPNGChunk(out []byte, typ string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// VP8X flags announcing the metadata chunks of a WebP image.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks, clearing their flags in the VP8X
+// header and fixing the RIFF size.
+func stripWebP(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	out = append(out, src[:12]...)
+	var cleared byte
+	for i := 12; i < len(src); {
+		if i+8 > len(src) {
+			return nil, errMalformedImage
+		}
+		fourCC := string(src[i : i+4])
+		n := int(binary.LittleEndian.Uint32(src[i+4:]))
+		end := i + 8 + n + n&1
+		if n < 0 || i+8+n > len(src) {
+			return nil, errMalformedImage
+		}
+		// Some encoders leave out the padding of the last chunk.
+		end = min(end, len(src))
+		switch fourCC {
+		case "EXIF":
+			payload := bytes.TrimPrefix(src[i+8:i+8+n], []byte(exifHeader))
+			if orientation := exifOrientation(payload); orientation > 1 {
+				exif := minimalEXIF(orientation)
+				out = append(out, "EXIF"...)
+				out = binary.LittleEndian.AppendUint32(out, uint32(len(exif)))
+				out = append(out, exif...)
+			} else {
+				cleared |= webpFlagEXIF
+			}
+		case "XMP ":
+			cleared |= webpFlagXMP
+		default:
+			out = append(out, src[i:end]...)
+		}
+		i = end
+	}
+	if len(out) > 20 && string(out[12:16]) == "VP8X" {
+		out[20] &^= cleared
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// exifOrientation reads the orientation tag of EXIF data, a TIFF structure,
+// returning 0 if it has none.
+func exifOrientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int64(order.Uint32(tiff[4:]))
+	if offset+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for k := int64(0); k < count; k++ {
+		entry := offset + 2 + 12*k
+		if entry+12 > int64(len(tiff)) {
+			break
+		}
+		// The orientation is a SHORT, stored in the entry itself.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
+
+// minimalEXIF encodes EXIF data holding nothing but an orientation.
+func minimalEXIF(orientation uint16) []byte {
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian TIFF header, IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation >> 8), byte(orientation), 0, 0, // orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+}
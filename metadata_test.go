@@ -0,0 +1,34 @@
+package discordcdn
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestStrippedCacheIsPerChannel(t *testing.T) {
+	transformer := NewTransformer(NewDiscordClient("token"), NewByteCache(1<<20))
+	data := &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"}
+
+	if _, _, err := transformer.Stripped(context.Background(), data, servePNG(t, 4, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data *LinkData
+		hit  bool
+	}{
+		{"same channel and file", data, true},
+		{"other channel", &LinkData{ChannelID: testChannelID + 1, FileID: testFileID}, false},
+		{"other file", &LinkData{ChannelID: testChannelID, FileID: testFileID + 1}, false},
+		{"media parameters", &LinkData{ChannelID: testChannelID, FileID: testFileID, Media: url.Values{"width": {"2"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, hit := transformer.CachedStripped(tt.data); hit != tt.hit {
+				t.Errorf("CachedStripped() hit = %v, want %v", hit, tt.hit)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package discordcdn
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MetricsSink receives metrics as they are recorded. Tags are "key:value"
+// pairs.
+type MetricsSink interface {
+	Count(name string, value int64, tags []string)
+	Gauge(name string, value float64, tags []string)
+	Timing(name string, d time.Duration, tags []string)
+}
+
+// Metrics fans recorded metrics out to every configured sink. With no sinks,
+// recording is a no-op.
+type Metrics struct {
+	mu    sync.RWMutex
+	sinks []MetricsSink
+}
+
+// metrics is the process-wide registry that instrumented code records into.
+var metrics = &Metrics{}
+
+func (m *Metrics) AddSink(sink MetricsSink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks = append(m.sinks, sink)
+}
+
+func (m *Metrics) Count(name string, value int64, tags ...string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		s.Count(name, value, tags)
+	}
+}
+
+func (m *Metrics) Gauge(name string, value float64, tags ...string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		s.Gauge(name, value, tags)
+	}
+}
+
+func (m *Metrics) Timing(name string, d time.Duration, tags ...string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sinks {
+		s.Timing(name, d, tags)
+	}
+}
+
+// recordRequests records the count, latency and response size of every
+// request, tagged by route, method and status.
+func recordRequests() HandlerFunc {
+	return func(c *Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "refresh"
+		}
+		tags := []string{"route:" + route, "method:" + c.Request.Method, "status:" + strconv.Itoa(c.Writer.Status())}
+
+		metrics.Count("http.requests", 1, tags...)
+		metrics.Timing("http.request_duration", time.Since(start), tags...)
+		metrics.Count("http.response_bytes", int64(max(c.Writer.Size(), 0)), tags...)
+	}
+}
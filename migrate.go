@@ -0,0 +1,287 @@
+package discordcdn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migrateProgressInterval is how often the migrate command reports progress.
+const migrateProgressInterval = 5 * time.Second
+
+var migrateCSVHeader = []string{"url", "refreshedURL", "expiresAt", "errorCode", "error"}
+
+// runMigrate implements the migrate subcommand, which refreshes every link in
+// a CSV or JSONL file and writes the results to another. Results are flushed
+// after every batch, so an interrupted run picks up where it left off when
+// started again with the same output file.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn migrate <input> <output>")
+		fmt.Fprintln(fs.Output(), "Input and output are CSV files when named *.csv and JSON Lines otherwise.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	inputPath, outputPath := fs.Arg(0), fs.Arg(1)
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	links, err := readMigrateInput(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", inputPath, err)
+	}
+
+	done, err := resumeMigrateOutput(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", outputPath, err)
+	}
+	if done > len(links) {
+		return fmt.Errorf("%s has more results than %s has links", outputPath, inputPath)
+	}
+	if done > 0 {
+		log.Printf("Resuming after %d of %d links", done, len(links))
+	}
+
+	file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := newMigrateWriter(file, isCSV(outputPath))
+	if info, err := file.Stat(); err != nil {
+		return err
+	} else if info.Size() == 0 {
+		if err := out.header(); err != nil {
+			return err
+		}
+	}
+
+	client, err := newMigrateClient(config)
+	if err != nil {
+		return err
+	}
+	var failed int
+	lastReport := time.Now()
+	for start := done; start < len(links); start += refreshBatchSize {
+		if start > done && config.JobBatchInterval > 0 {
+			time.Sleep(config.JobBatchInterval)
+		}
+		results := refreshWithRetry(client, "migrate", links[start:min(start+refreshBatchSize, len(links))])
+		for _, r := range results {
+			if r.failed() {
+				failed++
+			}
+			if err := out.write(r); err != nil {
+				return err
+			}
+		}
+		if err := out.flush(); err != nil {
+			return err
+		}
+
+		processed := start + len(results)
+		if time.Since(lastReport) >= migrateProgressInterval || processed == len(links) {
+			log.Printf("Refreshed %d of %d links, %d failed", processed, len(links), failed)
+			lastReport = time.Now()
+		}
+	}
+	return nil
+}
+
+// newMigrateClient returns a Discord client for commands that refresh links
+// outside the server, set up like the server's.
+func newMigrateClient(config *Config) (*DiscordClient, error) {
+	// With Redis configured, the migration's calls are counted together with
+	// those of running instances, so it doesn't push them over Discord's
+	// limit.
+	counter, err := NewRequestCounter(config)
+	if err != nil {
+		return nil, err
+	}
+	client := NewDiscordClient(config.Token)
+	var dns *DNSCache
+	if config.DNSCacheTTL > 0 {
+		dns = NewDNSCache(config.DNSCacheTTL)
+	}
+	transport, err := upstreamTransport(config, dns)
+	if err != nil {
+		return nil, err
+	}
+	client.SetTransport(transport)
+	client.SetTokenMap(config.TokenMap)
+	client.SetShards(config.ShardTokens, config.ShardBy)
+	client.SetInteractiveReserve(config.InteractiveReserve)
+	client.SetRequestCounter(counter)
+	client.SetGlobalLimit(config.DiscordRateLimit)
+	client.SetHeaders(config.UserAgent, config.ExtraHeaders)
+	client.SetAPIVersion(config.DiscordAPIVersion, config.DiscordAPIFallback)
+	return client, nil
+}
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// readMigrateInput reads the links to refresh. CSV files take links from the
+// column headed "url", or from the first column when there is no such
+// header. JSON Lines files hold either strings or objects with a "url" field.
+func readMigrateInput(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if isCSV(path) {
+		return readCSVLinks(file)
+	}
+	return readJSONLLinks(file)
+}
+
+func readCSVLinks(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	column := 0
+	for i, name := range records[0] {
+		if strings.EqualFold(strings.TrimSpace(name), "url") {
+			column = i
+			records = records[1:]
+			break
+		}
+	}
+
+	links := make([]string, 0, len(records))
+	for i, record := range records {
+		if column >= len(record) {
+			return nil, fmt.Errorf("row %d has no column %d", i+1, column+1)
+		}
+		links = append(links, strings.TrimSpace(record[column]))
+	}
+	return links, nil
+}
+
+func readJSONLLinks(r io.Reader) ([]string, error) {
+	var links []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var link string
+		if text[0] == '{' {
+			var entry struct {
+				URL string `json:"url"`
+			}
+			if err := json.Unmarshal(text, &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			link = entry.URL
+		} else if err := json.Unmarshal(text, &link); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		links = append(links, link)
+	}
+	return links, scanner.Err()
+}
+
+// resumeMigrateOutput returns how many results an earlier run already wrote
+// to path, dropping a partially written last line so appending continues
+// cleanly.
+func resumeMigrateOutput(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	complete := bytes.LastIndexByte(content, '\n') + 1
+	if complete < len(content) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return 0, err
+		}
+	}
+
+	lines := bytes.Count(content[:complete], []byte("\n"))
+	if isCSV(path) && lines > 0 {
+		lines-- // header
+	}
+	return lines, nil
+}
+
+// migrateWriter writes results as CSV rows or JSON lines.
+type migrateWriter struct {
+	buf *bufio.Writer
+	csv *csv.Writer
+}
+
+func newMigrateWriter(w io.Writer, asCSV bool) *migrateWriter {
+	out := &migrateWriter{buf: bufio.NewWriter(w)}
+	if asCSV {
+		out.csv = csv.NewWriter(out.buf)
+	}
+	return out
+}
+
+func (w *migrateWriter) header() error {
+	if w.csv == nil {
+		return nil
+	}
+	return w.csv.Write(migrateCSVHeader)
+}
+
+func (w *migrateWriter) write(r linkRefresh) error {
+	result := newJobResult(r)
+	if w.csv == nil {
+		line, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = w.buf.Write(append(line, '\n'))
+		return err
+	}
+
+	var expiresAt string
+	if result.ExpiresAt != nil {
+		expiresAt = result.ExpiresAt.Format(time.RFC3339)
+	}
+	return w.csv.Write([]string{result.URL, result.RefreshedURL, expiresAt, result.ErrorCode, result.Error})
+}
+
+func (w *migrateWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
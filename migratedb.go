@@ -0,0 +1,357 @@
+package discordcdn
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cdnLinkPattern finds links to Discord attachments in free text, such as a
+// column holding a message or HTML rather than a bare URL.
+var cdnLinkPattern = regexp.MustCompile(`(?i)https?://(?:cdn\.discordapp\.com|media\.discordapp\.net)/attachments/[^\s"'<>()\[\]{}\\]+`)
+
+// sqlIdentifier is what table and column names may look like, so they can be
+// quoted into queries safely.
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// migrateDBDrivers maps the databases migrate-db supports to the name their
+// database/sql driver registers under.
+var migrateDBDrivers = map[string]string{
+	"mysql":    "mysql",
+	"postgres": "pgx",
+	"sqlite":   "sqlite",
+}
+
+// dbMigration rewrites the Discord links stored in columns of a database
+// table, a batch of rows at a time.
+type dbMigration struct {
+	db      *sql.DB
+	dialect string
+	table   string
+	key     string
+	columns []string
+	batch   int
+	dryRun  bool
+	// rewrite returns the new form of each link it can rewrite, keyed by
+	// the link as found.
+	rewrite func(links []string) map[string]string
+
+	rows, updated, rewritten, skipped int
+}
+
+// runMigrateDB implements the migrate-db subcommand, which rewrites the
+// Discord links stored in an application's database in place: to links
+// through this server, which keep working, or to freshly signed Discord URLs.
+func runMigrateDB(args []string) error {
+	fs := flag.NewFlagSet("migrate-db", flag.ExitOnError)
+	driver := fs.String("driver", "", "database: mysql, postgres or sqlite")
+	dsn := fs.String("dsn", os.Getenv(envPrefix+"MIGRATE_DSN"), "data source name of the database, "+envPrefix+"MIGRATE_DSN by default")
+	table := fs.String("table", "", "table holding the links")
+	columns := fs.String("columns", "", "comma-separated columns holding the links")
+	key := fs.String("key", "id", "unique column rows are walked and updated by")
+	mode := fs.String("mode", "proxy", "rewrite links to proxy links through this server, or to refreshed Discord URLs")
+	baseURL := fs.String("base-url", "", "base of proxy links, "+envPrefix+"PUBLIC_URL by default")
+	batch := fs.Int("batch-size", 500, "rows read and updated per transaction")
+	dryRun := fs.Bool("dry-run", false, "print the rewrites without updating the database")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn migrate-db -driver <driver> -table <table> -columns <columns> [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	driverName, ok := migrateDBDrivers[*driver]
+	if !ok {
+		return fmt.Errorf("-driver must be mysql, postgres or sqlite")
+	}
+	if !slices.Contains(sql.Drivers(), driverName) {
+		return fmt.Errorf("the %s driver isn't compiled in; build with -tags dbdrivers", *driver)
+	}
+	if *dsn == "" {
+		return fmt.Errorf("-dsn or %sMIGRATE_DSN is required", envPrefix)
+	}
+	cols := splitList(*columns)
+	if len(cols) == 0 {
+		return fmt.Errorf("-columns is required")
+	}
+	for _, name := range append([]string{*table, *key}, cols...) {
+		if !sqlIdentifier.MatchString(name) {
+			return fmt.Errorf("invalid table or column name %q", name)
+		}
+	}
+	if *batch <= 0 {
+		return fmt.Errorf("-batch-size must be positive")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	m := &dbMigration{dialect: *driver, table: *table, key: *key, columns: cols, batch: *batch, dryRun: *dryRun}
+	switch *mode {
+	case "proxy":
+		base := strings.TrimSuffix(*baseURL, "/")
+		if base == "" {
+			base = config.PublicURL
+		}
+		if base == "" {
+			return fmt.Errorf("-base-url or %sPUBLIC_URL is required to rewrite links to proxy links", envPrefix)
+		}
+		m.rewrite = func(links []string) map[string]string {
+			return proxyLinks(base, links)
+		}
+	case "refresh":
+		client, err := newMigrateClient(config)
+		if err != nil {
+			return err
+		}
+		m.rewrite = func(links []string) map[string]string {
+			return refreshedLinks(client, config.JobBatchInterval, links)
+		}
+	default:
+		return fmt.Errorf("-mode must be proxy or refresh")
+	}
+
+	m.db, err = sql.Open(driverName, *dsn)
+	if err != nil {
+		return err
+	}
+	defer m.db.Close()
+	if err := m.db.Ping(); err != nil {
+		return fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	if err := m.run(context.Background()); err != nil {
+		return err
+	}
+	if m.dryRun {
+		log.Printf("Dry run: would update %d of %d rows, rewriting %d links; %d links can't be rewritten", m.updated, m.rows, m.rewritten, m.skipped)
+	} else {
+		log.Printf("Updated %d of %d rows, rewriting %d links; %d links couldn't be rewritten", m.updated, m.rows, m.rewritten, m.skipped)
+	}
+	return nil
+}
+
+// run walks the table in key order, only reading rows whose columns mention
+// Discord, so links already rewritten to proxy links are passed over when a
+// run is repeated.
+func (m *dbMigration) run(ctx context.Context) error {
+	var last any
+	lastReport := time.Now()
+	for {
+		keys, values, err := m.read(ctx, last)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := m.update(ctx, keys, values); err != nil {
+			return err
+		}
+		m.rows += len(keys)
+		last = keys[len(keys)-1]
+
+		if time.Since(lastReport) >= migrateProgressInterval {
+			log.Printf("Read %d rows, updated %d", m.rows, m.updated)
+			lastReport = time.Now()
+		}
+	}
+}
+
+// read returns the next batch of rows after the key last, or from the start
+// when last is nil, with their columns' values.
+func (m *dbMigration) read(ctx context.Context, last any) ([]any, [][]sql.NullString, error) {
+	var where, selected []string
+	var params []any
+	for _, col := range m.columns {
+		where = append(where, m.quote(col)+" LIKE "+m.placeholder(len(params)+1))
+		params = append(params, "%discordapp%")
+	}
+	query := "SELECT " + m.quote(m.key)
+	for _, col := range m.columns {
+		selected = append(selected, m.quote(col))
+	}
+	query += ", " + strings.Join(selected, ", ") + " FROM " + m.quote(m.table) + " WHERE (" + strings.Join(where, " OR ") + ")"
+	if last != nil {
+		query += " AND " + m.quote(m.key) + " > " + m.placeholder(len(params)+1)
+		params = append(params, last)
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", m.quote(m.key), m.batch)
+
+	rows, err := m.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", m.table, err)
+	}
+	defer rows.Close()
+	var keys []any
+	var values [][]sql.NullString
+	for rows.Next() {
+		var key any
+		cols := make([]sql.NullString, len(m.columns))
+		dest := []any{&key}
+		for i := range cols {
+			dest = append(dest, &cols[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", m.table, err)
+		}
+		// Text keys come back as bytes, which would be sent back as binary.
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+		keys = append(keys, key)
+		values = append(values, cols)
+	}
+	return keys, values, rows.Err()
+}
+
+// update rewrites the links in a batch of rows and writes back the rows that
+// changed in one transaction, or prints them on a dry run.
+func (m *dbMigration) update(ctx context.Context, keys []any, values [][]sql.NullString) error {
+	var links []string
+	for _, row := range values {
+		for _, value := range row {
+			links = append(links, findCDNLinks(value.String)...)
+		}
+	}
+	slices.Sort(links)
+	links = slices.Compact(links)
+	if len(links) == 0 {
+		return nil
+	}
+	rewrites := m.rewrite(links)
+	m.rewritten += len(rewrites)
+	m.skipped += len(links) - len(rewrites)
+
+	var set []string
+	for i, col := range m.columns {
+		set = append(set, m.quote(col)+" = "+m.placeholder(i+1))
+	}
+	query := "UPDATE " + m.quote(m.table) + " SET " + strings.Join(set, ", ") + " WHERE " + m.quote(m.key) + " = " + m.placeholder(len(m.columns)+1)
+
+	var tx *sql.Tx
+	if !m.dryRun {
+		var err error
+		if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+	for i, row := range values {
+		changed := false
+		params := make([]any, 0, len(row)+1)
+		for j, value := range row {
+			newValue := rewriteCDNLinks(value.String, rewrites)
+			if value.Valid && newValue != value.String {
+				changed = true
+				value.String = newValue
+				if m.dryRun {
+					for _, link := range findCDNLinks(row[j].String) {
+						if newLink, ok := rewrites[link]; ok {
+							fmt.Printf("%v\t%s\t%s\t%s\n", keys[i], m.columns[j], link, newLink)
+						}
+					}
+				}
+			}
+			params = append(params, value)
+		}
+		if !changed {
+			continue
+		}
+		m.updated++
+		if m.dryRun {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, query, append(params, keys[i])...); err != nil {
+			return fmt.Errorf("failed to update %s %v: %w", m.key, keys[i], err)
+		}
+	}
+	if tx == nil {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// quote quotes a table or column name, already checked against
+// sqlIdentifier, in the dialect's way.
+func (m *dbMigration) quote(name string) string {
+	q := `"`
+	if m.dialect == "mysql" {
+		q = "`"
+	}
+	return q + strings.ReplaceAll(name, ".", q+"."+q) + q
+}
+
+// placeholder returns the dialect's placeholder for the nth parameter.
+func (m *dbMigration) placeholder(n int) string {
+	if m.dialect == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// findCDNLinks returns the Discord attachment links in text, less any
+// punctuation ending the sentence they're in.
+func findCDNLinks(text string) []string {
+	links := cdnLinkPattern.FindAllString(text, -1)
+	for i, link := range links {
+		links[i] = strings.TrimRight(link, ".,;:!")
+	}
+	return links
+}
+
+// rewriteCDNLinks replaces the Discord attachment links in text that have a
+// rewrite, leaving the rest of the text as it is.
+func rewriteCDNLinks(text string, rewrites map[string]string) string {
+	return cdnLinkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		link := strings.TrimRight(match, ".,;:!")
+		if newLink, ok := rewrites[link]; ok {
+			return newLink + match[len(link):]
+		}
+		return match
+	})
+}
+
+// proxyLinks rewrites links to their canonical form through this server,
+// keeping media proxy parameters. Links that don't parse are left out.
+func proxyLinks(base string, links []string) map[string]string {
+	rewrites := make(map[string]string, len(links))
+	for _, link := range links {
+		parsed := parseLink(link)
+		if parsed.Error != "" {
+			log.Printf("Skipping %s: %s", link, parsed.Error)
+			continue
+		}
+		newLink := base + "/" + parsed.Data.Path()
+		if len(parsed.Data.Media) > 0 {
+			newLink += "?" + parsed.Data.Media.Encode()
+		}
+		rewrites[link] = newLink
+	}
+	return rewrites
+}
+
+// refreshedLinks refreshes links with Discord like the migrate command does,
+// pausing interval between batches. Links that fail to refresh are left out.
+func refreshedLinks(client *DiscordClient, interval time.Duration, links []string) map[string]string {
+	rewrites := make(map[string]string, len(links))
+	for start := 0; start < len(links); start += refreshBatchSize {
+		if start > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
+		for _, r := range refreshWithRetry(client, "migrate", links[start:min(start+refreshBatchSize, len(links))]) {
+			if r.failed() {
+				log.Printf("Skipping %s: %s", r.raw, r.message)
+				continue
+			}
+			rewrites[r.raw] = r.url
+		}
+	}
+	return rewrites
+}
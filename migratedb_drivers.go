@@ -0,0 +1,11 @@
+//go:build dbdrivers
+
+package discordcdn
+
+// The database drivers of migrate-db are left out of default builds, which
+// don't need them. Build with -tags dbdrivers to include them.
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,9 @@
+-- Each store document is kept as one row per top-level field, such as
+-- manifests or usage, so saving writes only the fields that changed. store
+-- is the tenant's name, empty for the default configuration.
+CREATE TABLE store_fields (
+	store TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (store, name)
+);
@@ -0,0 +1,229 @@
+package discordcdn
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of checking a mirrored copy, as tagged on the mirror.files metric.
+const (
+	mirrorVerified = "verified"
+	mirrorFetched  = "fetched"
+	mirrorDeleted  = "deleted"
+	mirrorFailed   = "failed"
+)
+
+// Mirrorer keeps a directory of copies of the indexed attachments, laid out
+// as <channelID>/<fileID>/<fileName> like the mirror behind DCDN_MIRROR_URL
+// expects. Every pass checks each copy against Discord, and fetches those
+// missing or different again, so the mirror can be trusted once Discord has
+// deleted the originals.
+type Mirrorer struct {
+	client      *DiscordClient
+	store       *Store
+	dir         string
+	interval    time.Duration
+	concurrency int
+}
+
+func NewMirrorer(client *DiscordClient, store *Store, dir string, interval time.Duration, concurrency int) *Mirrorer {
+	return &Mirrorer{client: client, store: store, dir: dir, interval: interval, concurrency: concurrency}
+}
+
+// run checks the mirror right away, then every interval until ctx is done.
+func (m *Mirrorer) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.verify(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// verify checks every indexed attachment in the allowlist, refreshing them a
+// batch at a time at background priority and checking the copies of each
+// batch concurrently.
+func (m *Mirrorer) verify(ctx context.Context) {
+	start := time.Now()
+	attachments := m.store.FindAttachments(func(a *IndexedAttachment) bool {
+		return m.client.allowsChannel(a.ChannelID)
+	})
+	// Takedowns look up the store, so they can't be checked while it is
+	// searched.
+	attachments = slices.DeleteFunc(attachments, func(a IndexedAttachment) bool {
+		return m.client.takedown(a.FileID) != nil
+	})
+
+	var mu sync.Mutex
+	outcomes := map[string]int{}
+	slots := make(chan struct{}, m.concurrency)
+	for i := 0; i < len(attachments) && ctx.Err() == nil; i += refreshBatchSize {
+		batch := attachments[i:min(i+refreshBatchSize, len(attachments))]
+		raws := make([]string, len(batch))
+		for j, a := range batch {
+			raws[j] = attachmentURL(a.ChannelID, a.FileID, a.FileName)
+		}
+		results := refreshWithRetry(m.client, "mirror", raws)
+
+		var wg sync.WaitGroup
+		for j := range batch {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(a *IndexedAttachment, r *linkRefresh) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				outcome := m.check(ctx, a, r)
+				metrics.Count("mirror.files", 1, "result:"+outcome)
+				mu.Lock()
+				outcomes[outcome]++
+				mu.Unlock()
+			}(&batch[j], &results[j])
+		}
+		wg.Wait()
+	}
+	log.Printf("Mirror check of %d attachments took %s: %d verified, %d fetched, %d deleted from Discord, %d failed",
+		len(attachments), time.Since(start).Round(time.Second), outcomes[mirrorVerified], outcomes[mirrorFetched], outcomes[mirrorDeleted], outcomes[mirrorFailed])
+}
+
+// check compares the copy of an attachment with the checksum recorded for
+// it, fetching it again if it is missing, differs or was never hashed.
+// Copies of attachments deleted from Discord are left as they are.
+func (m *Mirrorer) check(ctx context.Context, a *IndexedAttachment, r *linkRefresh) string {
+	if r.code == codeAttachmentNotFound {
+		return mirrorDeleted
+	}
+	if r.failed() {
+		logAt(slog.LevelWarn, "Can't mirror %s: %s", a.Path(), r.message)
+		return mirrorFailed
+	}
+	path, err := m.path(a)
+	if err != nil {
+		logAt(slog.LevelWarn, "Can't mirror %s: %v", a.Path(), err)
+		return mirrorFailed
+	}
+
+	if sum, ok := m.store.Checksum(a.FileID); ok && (a.Size <= 0 || a.Size == sum.Size) {
+		intact, err := matchesChecksum(path, sum)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logAt(slog.LevelWarn, "Failed to hash mirrored copy of %s: %v", a.Path(), err)
+		}
+		if intact {
+			return mirrorVerified
+		}
+	}
+	err = m.fetch(ctx, a, r.url, path)
+	if errors.Is(err, errAttachmentNotFound) {
+		return mirrorDeleted
+	}
+	if err != nil {
+		logAt(slog.LevelError, "Failed to mirror %s: %v", a.Path(), err)
+		return mirrorFailed
+	}
+	return mirrorFetched
+}
+
+// path returns where the copy of an attachment is kept.
+func (m *Mirrorer) path(a *IndexedAttachment) (string, error) {
+	if a.FileName == "" || a.FileName == "." || a.FileName == ".." || strings.ContainsAny(a.FileName, `/\`) {
+		return "", fmt.Errorf("invalid file name %q", a.FileName)
+	}
+	return filepath.Join(m.dir, strconv.FormatInt(a.ChannelID, 10), strconv.FormatInt(a.FileID, 10), a.FileName), nil
+}
+
+// matchesChecksum reports whether the file at path has the size and SHA-256
+// of sum.
+func matchesChecksum(path string, sum *Checksum) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	sha := sha256.New()
+	size, err := io.Copy(sha, file)
+	if err != nil {
+		return false, err
+	}
+	return size == sum.Size && hex.EncodeToString(sha.Sum(nil)) == sum.SHA256, nil
+}
+
+// fetch downloads an attachment into its copy, hashing it on the way, and
+// records the checksum the next pass checks the copy against. The copy is
+// only replaced once the download is complete.
+func (m *Mirrorer) fetch(ctx context.Context, a *IndexedAttachment, signedURL, path string) error {
+	resp, err := m.client.Download(ctx, signedURL, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errAttachmentNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	sha, md := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sha, md), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return fmt.Errorf("downloaded %d of %d bytes", size, resp.ContentLength)
+	}
+	if a.Size > 0 && size != a.Size {
+		return fmt.Errorf("downloaded %d bytes, Discord reported %d", size, a.Size)
+	}
+	// Copies are served by whatever serves the mirror, so they are readable
+	// by everyone like any other static file.
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	sum := &Checksum{
+		FileID:     a.FileID,
+		Size:       size,
+		SHA256:     hex.EncodeToString(sha.Sum(nil)),
+		MD5:        hex.EncodeToString(md.Sum(nil)),
+		ComputedAt: time.Now().UTC(),
+	}
+	if err := m.store.AddChecksum(sum); err != nil {
+		logAt(slog.LevelError, "Failed to save checksum of %s: %v", a.Path(), err)
+	}
+	return nil
+}
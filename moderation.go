@@ -0,0 +1,330 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModerationRequest describes an attachment for a Moderator to judge.
+type ModerationRequest struct {
+	ChannelID int64  `json:"channelID"`
+	FileID    int64  `json:"fileID"`
+	FileName  string `json:"fileName"`
+	// URL is a signed Discord URL the content can be fetched from, valid
+	// for about a day.
+	URL string `json:"url"`
+}
+
+// ModerationVerdict is the decision kept on an attachment.
+type ModerationVerdict struct {
+	FileID  int64  `json:"fileID"`
+	Path    string `json:"path"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	// Override marks a verdict set by an admin rather than the moderator.
+	Override  bool      `json:"override,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// ModerationOverride is the body of POST /admin/moderation/:fileID.
+type ModerationOverride struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Moderator decides whether an attachment may be served, such as by running
+// it through an image classifier. It is asked once per attachment, on its
+// first access.
+type Moderator interface {
+	Moderate(ctx context.Context, req *ModerationRequest) (allowed bool, reason string, err error)
+}
+
+// WebhookModerator is a Moderator that posts the ModerationRequest as JSON
+// to an endpoint, which answers with {"allowed": bool, "reason": string}.
+type WebhookModerator struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+func NewWebhookModerator(url, token string) *WebhookModerator {
+	return &WebhookModerator{url: url, token: token, http: &http.Client{}}
+}
+
+func (m *WebhookModerator) Moderate(ctx context.Context, req *ModerationRequest) (bool, string, error) {
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return false, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if m.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+m.token)
+	}
+
+	resp, err := m.http.Do(httpReq)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, "", fmt.Errorf("moderation endpoint answered %d: %s", resp.StatusCode, strings.TrimSpace(string(text)))
+	}
+	var verdict struct {
+		Allowed *bool  `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&verdict); err != nil {
+		return false, "", fmt.Errorf("invalid moderation response: %w", err)
+	}
+	if verdict.Allowed == nil {
+		return false, "", errors.New("moderation response has no allowed field")
+	}
+	return *verdict.Allowed, verdict.Reason, nil
+}
+
+// moderationCall is a moderation in flight, shared by every request for the
+// same attachment.
+type moderationCall struct {
+	done    chan struct{}
+	verdict *ModerationVerdict
+	err     error
+}
+
+// Moderation runs attachments by a Moderator on their first access, and
+// keeps its verdicts in the store, so each attachment is judged once.
+// Failures aren't kept, so they are tried again on the next access.
+type Moderation struct {
+	moderator Moderator
+	store     *Store
+	timeout   time.Duration
+	failOpen  bool
+
+	mu      sync.Mutex
+	pending map[int64]*moderationCall
+}
+
+func NewModeration(moderator Moderator, store *Store, timeout time.Duration, failOpen bool) *Moderation {
+	return &Moderation{
+		moderator: moderator,
+		store:     store,
+		timeout:   timeout,
+		failOpen:  failOpen,
+		pending:   map[int64]*moderationCall{},
+	}
+}
+
+// SetModeration sets the moderation attachments are checked with.
+func (c *DiscordClient) SetModeration(moderation *Moderation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.moderation = moderation
+}
+
+// Moderation returns the content moderation, or nil if it is off.
+func (c *DiscordClient) Moderation() *Moderation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.moderation
+}
+
+// Verdict returns the verdict on an attachment, asking the moderator with
+// the signed URL if there is none yet. The moderator's call outlives the
+// request that started it, so its verdict is kept even if the request gives
+// up first.
+func (m *Moderation) Verdict(ctx context.Context, data *LinkData, signedURL string) (*ModerationVerdict, error) {
+	if verdict, ok := m.store.ModerationVerdict(data.FileID); ok {
+		return verdict, nil
+	}
+
+	m.mu.Lock()
+	call, ok := m.pending[data.FileID]
+	if !ok {
+		call = &moderationCall{done: make(chan struct{})}
+		m.pending[data.FileID] = call
+		go func() {
+			call.verdict, call.err = m.moderate(data, signedURL)
+			m.mu.Lock()
+			delete(m.pending, data.FileID)
+			m.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.verdict, call.err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func (m *Moderation) moderate(data *LinkData, signedURL string) (*ModerationVerdict, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	start := time.Now()
+	allowed, reason, err := m.moderator.Moderate(ctx, &ModerationRequest{
+		ChannelID: data.ChannelID,
+		FileID:    data.FileID,
+		FileName:  data.FileName,
+		URL:       signedURL,
+	})
+	if err != nil {
+		metrics.Count("moderation.verdicts", 1, "result:error")
+		return nil, fmt.Errorf("failed to moderate %s: %w", data.Path(), err)
+	}
+
+	verdict := &ModerationVerdict{
+		FileID:    data.FileID,
+		Path:      data.Path(),
+		Allowed:   allowed,
+		Reason:    reason,
+		CheckedAt: time.Now().UTC(),
+	}
+	if allowed {
+		logAt(slog.LevelDebug, "Moderation allowed %s in %s", verdict.Path, time.Since(start).Round(time.Millisecond))
+		metrics.Count("moderation.verdicts", 1, "result:allowed")
+	} else {
+		logAt(slog.LevelWarn, "Moderation denied %s: %s", verdict.Path, reason)
+		metrics.Count("moderation.verdicts", 1, "result:denied")
+	}
+	if err := m.store.SetModerationVerdict(verdict); err != nil {
+		logAt(slog.LevelError, "Failed to save moderation verdict on %s: %v", verdict.Path, err)
+	}
+	return verdict, nil
+}
+
+// denied reports whether an attachment was already denied, responding with
+// an error if so. It only reads kept verdicts, for responses served without
+// refreshing the attachment.
+func (m *Moderation) denied(c *Context, fileID int64) bool {
+	verdict, ok := m.store.ModerationVerdict(fileID)
+	if !ok || verdict.Allowed {
+		return false
+	}
+	respondError(c, http.StatusForbidden, codeContentBlocked, "Attachment was blocked by moderation")
+	return true
+}
+
+// judged reports whether an attachment has a kept verdict.
+func (m *Moderation) judged(fileID int64) bool {
+	_, ok := m.store.ModerationVerdict(fileID)
+	return ok
+}
+
+// moderateAttachment checks an attachment about to be served, responding
+// with an error if it must not be. Attachments the moderator couldn't judge
+// are only served when failing open.
+func moderateAttachment(c *Context, moderation *Moderation, data *LinkData, signedURL string) bool {
+	verdict, err := moderation.Verdict(c.Request.Context(), data, signedURL)
+	if err != nil && moderation.failOpen {
+		logf(c, slog.LevelWarn, "Serving unmoderated: %v", err)
+		return true
+	}
+	if err != nil {
+		logf(c, slog.LevelError, "Refused unmoderated: %v", err)
+		respondError(c, http.StatusServiceUnavailable, codeModerationFailed, "Failed to moderate attachment")
+		return false
+	}
+	if !verdict.Allowed {
+		logf(c, slog.LevelInfo, "Refused %s, denied by moderation: %s", verdict.Path, verdict.Reason)
+		respondError(c, http.StatusForbidden, codeContentBlocked, "Attachment was blocked by moderation")
+		return false
+	}
+	return true
+}
+
+// handleModerationVerdicts lists the verdicts on attachments, only denials
+// unless all=true.
+func handleModerationVerdicts(store *Store) HandlerFunc {
+	return func(c *Context) {
+		all := c.Query("all") == "true"
+		verdicts := store.ModerationVerdicts(func(v *ModerationVerdict) bool {
+			return all || !v.Allowed
+		})
+		c.JSON(http.StatusOK, H{"verdicts": verdicts})
+	}
+}
+
+// handleOverrideModeration sets the verdict on an attachment, overriding
+// the moderator's.
+func handleOverrideModeration(client *DiscordClient, store *Store) HandlerFunc {
+	return func(c *Context) {
+		fileID, err := strconv.ParseInt(c.Param("fileID"), 10, 64)
+		if err != nil || !validSnowflake(fileID) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid file ID")
+			return
+		}
+		var req ModerationOverride
+		err = c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid request body")
+			return
+		}
+
+		verdict := &ModerationVerdict{
+			FileID:    fileID,
+			Allowed:   req.Allowed,
+			Reason:    req.Reason,
+			Override:  true,
+			CheckedAt: time.Now().UTC(),
+		}
+		if previous, ok := store.ModerationVerdict(fileID); ok {
+			verdict.Path = previous.Path
+		}
+		if err := store.SetModerationVerdict(verdict); err != nil {
+			logf(c, slog.LevelError, "Failed to save moderation verdict: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save verdict")
+			return
+		}
+		// Redirects and responses cached at the edge would keep serving an
+		// attachment denied after the fact.
+		if !req.Allowed {
+			client.mu.RLock()
+			purger := client.purger
+			client.mu.RUnlock()
+			purger.Purge(fileSurrogateKey(fileID))
+			client.invalidateAttachment(fileID)
+		}
+		logf(c, slog.LevelInfo, "Moderation of %d overridden: allowed=%t", fileID, req.Allowed)
+		c.JSON(http.StatusOK, verdict)
+	}
+}
+
+// handleForgetModeration drops the verdict on an attachment, so it is
+// moderated again on its next access.
+func handleForgetModeration(store *Store) HandlerFunc {
+	return func(c *Context) {
+		fileID, err := strconv.ParseInt(c.Param("fileID"), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid file ID")
+			return
+		}
+		found, err := store.DeleteModerationVerdict(fileID)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to delete moderation verdict: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to delete verdict")
+			return
+		}
+		if !found {
+			respondError(c, http.StatusNotFound, codeNotFound, "No verdict on this attachment")
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,88 @@
+package discordcdn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// certPrefix marks a requester that authenticated with a client certificate
+// rather than an API key, such as cert:billing.internal.
+const certPrefix = "cert:"
+
+// loadServerTLS builds the TLS configuration of the HTTP and gRPC listeners,
+// or returns nil when no certificate is configured. With a client CA bundle,
+// clients may present a certificate signed by one of its CAs, and must when
+// RequireClientCert is set.
+func loadServerTLS(config *Config) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if config.ClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(config.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("client CA bundle has no PEM certificates")
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		// Certificates the allowlist doesn't name are turned away during
+		// the handshake, since the connection is of no use to them.
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		names := config.ClientCertNames
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if _, ok := clientCertName(state.PeerCertificates[0], names); !ok {
+				metrics.Count("mtls.rejected", 1)
+				return errors.New("client certificate is not allowed")
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientCertName returns the name a client certificate is known by: the
+// first of its common name and DNS, URI and email SANs that names lists, or
+// when names is empty the first it has.
+func clientCertName(cert *x509.Certificate, names []string) (string, bool) {
+	candidates := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		candidates = append(candidates, uri.String())
+	}
+	candidates = append(candidates, cert.EmailAddresses...)
+	for _, name := range candidates {
+		if name != "" && (len(names) == 0 || slices.Contains(names, name)) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// requestClientCert returns the name of the verified client certificate the
+// request's connection was made with, if any and if names allows it.
+func requestClientCert(c *Context, names []string) (string, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	return clientCertName(state.PeerCertificates[0], names)
+}
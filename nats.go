@@ -0,0 +1,370 @@
+package discordcdn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// natsMaxURLs bounds the links of a single refresh message, so its
+	// results fit in a message under NATS's default 1 MB payload limit.
+	natsMaxURLs = 1000
+	// natsPingInterval is how often the server is pinged; a connection that
+	// hasn't heard from it in three intervals is dropped.
+	natsPingInterval = time.Minute
+	natsDialTimeout  = 10 * time.Second
+
+	natsMinBackoff = time.Second
+	natsMaxBackoff = time.Minute
+)
+
+// NATSRefreshRequest is a refresh request consumed from NATS.
+type NATSRefreshRequest struct {
+	// ID, if set, is copied to the results so they can be matched up.
+	ID   string   `json:"id,omitempty"`
+	URLs []string `json:"urls"`
+}
+
+// NATSRefreshResult is published with the results of a NATSRefreshRequest,
+// or the reason it was rejected.
+type NATSRefreshResult struct {
+	ID        string      `json:"id,omitempty"`
+	Results   []JobResult `json:"results,omitempty"`
+	ErrorCode string      `json:"errorCode,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// natsInfo is the part of the server's INFO message the consumer uses.
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect is the CONNECT message sent to the server.
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// NATSConsumer refreshes the links of messages published to a NATS subject,
+// for event-driven pipelines that would rather not call the HTTP API. It
+// subscribes in a queue group, so each message is handled by one replica,
+// and publishes the results to the message's reply subject, or to the
+// result subject for messages without one. It speaks the core NATS protocol
+// itself rather than pulling in a client library.
+type NATSConsumer struct {
+	client        *DiscordClient
+	url           *url.URL
+	subject       string
+	queue         string
+	resultSubject string
+	slots         chan struct{}
+
+	// mu serializes writes to the connection.
+	mu         sync.Mutex
+	w          *bufio.Writer
+	maxPayload int
+}
+
+func NewNATSConsumer(client *DiscordClient, rawURL, subject, queue, resultSubject string, concurrency int) (*NATSConsumer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &NATSConsumer{
+		client:        client,
+		url:           u,
+		subject:       subject,
+		queue:         queue,
+		resultSubject: resultSubject,
+		slots:         make(chan struct{}, concurrency),
+	}, nil
+}
+
+// run keeps a subscription open, reconnecting with backoff when the
+// connection drops, until ctx is done.
+func (n *NATSConsumer) run(ctx context.Context) {
+	backoff := natsMinBackoff
+	for {
+		start := time.Now()
+		err := n.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > natsMaxBackoff {
+			backoff = natsMinBackoff
+		}
+		logAt(slog.LevelWarn, "NATS disconnected: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, natsMaxBackoff)
+	}
+}
+
+// connect runs a single connection until it fails.
+func (n *NATSConsumer) connect(ctx context.Context) error {
+	host := n.url.Host
+	if n.url.Port() == "" {
+		host = net.JoinHostPort(n.url.Hostname(), "4222")
+	}
+	dialer := &net.Dialer{Timeout: natsDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	line, err := readNATSLine(r)
+	if err != nil {
+		return err
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if op != "INFO" {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return fmt.Errorf("invalid INFO: %w", err)
+	}
+
+	secure := n.url.Scheme == "tls" || info.TLSRequired
+	if secure {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: n.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		defer tlsConn.Close()
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	hello := natsConnect{TLSRequired: secure, Name: "discord-cdn", Lang: "go", Version: "1", Protocol: 1}
+	if user := n.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			hello.User, hello.Pass = user.Username(), pass
+		} else {
+			hello.AuthToken = user.Username()
+		}
+	}
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.w = bufio.NewWriter(conn)
+	n.maxPayload = info.MaxPayload
+	n.mu.Unlock()
+	if err := n.send("CONNECT " + string(payload) + "\r\nPING\r\n"); err != nil {
+		return err
+	}
+	// The server answers PING with PONG once CONNECT is accepted, and with
+	// -ERR if it isn't, such as on bad credentials.
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if msg, ok := strings.CutPrefix(line, "-ERR "); ok {
+			return fmt.Errorf("server refused connection: %s", msg)
+		}
+	}
+	if err := n.send(fmt.Sprintf("SUB %s %s 1\r\n", n.subject, n.queue)); err != nil {
+		return err
+	}
+	log.Printf("Consuming refresh requests from NATS subject %s", n.subject)
+
+	go n.ping(ctx, conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * natsPingInterval))
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch op {
+		case "MSG":
+			if err := n.receive(r, args); err != nil {
+				return err
+			}
+		case "PING":
+			if err := n.send("PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("server error: %s", args)
+		}
+	}
+}
+
+// ping pings the server every natsPingInterval for as long as the
+// connection lasts, so a dead connection is noticed by the read deadline.
+func (n *NATSConsumer) ping(ctx context.Context, conn net.Conn) {
+	ticker := time.NewTicker(natsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.send("PING\r\n"); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// receive reads the payload of a MSG and handles it once a slot is free.
+func (n *NATSConsumer) receive(r *bufio.Reader, args string) error {
+	// MSG <subject> <sid> [reply-to] <#bytes>
+	fields := strings.Fields(args)
+	if len(fields) < 3 || len(fields) > 4 {
+		return fmt.Errorf("invalid MSG %q", args)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid MSG %q", args)
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	reply := ""
+	if len(fields) == 4 {
+		reply = fields[2]
+	}
+
+	n.slots <- struct{}{}
+	go func() {
+		defer func() { <-n.slots }()
+		n.handle(payload[:size], reply)
+	}()
+	return nil
+}
+
+// handle refreshes the links of a message and publishes the results.
+func (n *NATSConsumer) handle(payload []byte, reply string) {
+	subject := reply
+	if subject == "" {
+		subject = n.resultSubject
+	}
+
+	var req NATSRefreshRequest
+	var result NATSRefreshResult
+	switch err := json.Unmarshal(payload, &req); {
+	case err != nil || len(req.URLs) == 0:
+		result.ErrorCode, result.Error = codeInvalidParameter, "URLs are required"
+	case len(req.URLs) > natsMaxURLs:
+		result.ID = req.ID
+		result.ErrorCode, result.Error = codeInvalidParameter, fmt.Sprintf("A message can refresh at most %d links", natsMaxURLs)
+	default:
+		result.ID = req.ID
+		result.Results = make([]JobResult, 0, len(req.URLs))
+		failed := 0
+		for start := 0; start < len(req.URLs); start += refreshBatchSize {
+			for _, r := range refreshWithRetry(n.client, "nats", req.URLs[start:min(start+refreshBatchSize, len(req.URLs))]) {
+				if r.failed() {
+					failed++
+				}
+				result.Results = append(result.Results, newJobResult(r))
+			}
+		}
+		logAt(slog.LevelDebug, "Refreshed %d links from NATS, %d failed", len(req.URLs), failed)
+	}
+	if result.ErrorCode != "" {
+		metrics.Count("nats.messages", 1, "result:invalid")
+	} else {
+		metrics.Count("nats.messages", 1, "result:refreshed")
+	}
+	if subject == "" {
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(result); err != nil {
+		logAt(slog.LevelError, "Failed to encode NATS results: %v", err)
+		return
+	}
+	if err := n.publish(subject, bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil {
+		logAt(slog.LevelError, "Failed to publish NATS results to %s: %v", subject, err)
+	}
+}
+
+// publish sends a message to subject.
+func (n *NATSConsumer) publish(subject string, body []byte) error {
+	n.mu.Lock()
+	maxPayload := n.maxPayload
+	n.mu.Unlock()
+	if maxPayload > 0 && len(body) > maxPayload {
+		return fmt.Errorf("results of %d bytes exceed the server's limit of %d", len(body), maxPayload)
+	}
+	return n.send(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(body), body))
+}
+
+// send writes a protocol message and flushes it.
+func (n *NATSConsumer) send(msg string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.w.WriteString(msg); err != nil {
+		return err
+	}
+	return n.w.Flush()
+}
+
+// readNATSLine reads a protocol line without its CRLF.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// validNATSSubject reports whether s can be subscribed or published to: one
+// or more dot-separated tokens without whitespace.
+func validNATSSubject(s string) bool {
+	if s == "" || strings.ContainsAny(s, " \t\r\n") {
+		return false
+	}
+	for _, token := range strings.Split(s, ".") {
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,294 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discordAuthorizeURL = "https://discord.com/oauth2/authorize"
+
+	sessionCookie = "dcdn_session"
+	stateCookie   = "dcdn_oauth_state"
+	// sessionKey holds the *oauthSession of a logged-in request.
+	sessionKey = "session"
+
+	// sessionTTL bounds how long a login lasts, so guild membership changes
+	// are picked up reasonably soon.
+	sessionTTL = 24 * time.Hour
+	// loginTimeout is how long a user has to complete the Discord login.
+	loginTimeout = 10 * time.Minute
+)
+
+type oauthSession struct {
+	userID    int64
+	username  string
+	guilds    map[int64]bool
+	expiresAt time.Time
+}
+
+type pendingLogin struct {
+	next      string
+	expiresAt time.Time
+}
+
+// OAuthGate requires visitors to log in with Discord and only serves
+// attachments from guilds they are a member of. Sessions are kept in memory,
+// so users log in again after a restart.
+type OAuthGate struct {
+	mu           sync.Mutex
+	clientID     string
+	clientSecret string
+	config       *Config
+	http         *http.Client
+	sessions     map[string]*oauthSession
+	pending      map[string]pendingLogin
+}
+
+func NewOAuthGate(config *Config) *OAuthGate {
+	g := &OAuthGate{
+		clientID:     config.OAuthClientID,
+		clientSecret: config.OAuthClientSecret,
+		config:       config,
+		http:         &http.Client{Timeout: 10 * time.Second},
+		sessions:     map[string]*oauthSession{},
+		pending:      map[string]pendingLogin{},
+	}
+	go g.cleanup()
+	return g
+}
+
+func (g *OAuthGate) redirectURL(c *Context) string {
+	return publicURL(c, g.config) + "/auth/callback"
+}
+
+// require rejects requests without a valid session, unless they were already
+// authenticated with a JWT. Browsers are sent to the login page and brought
+// back afterwards; other clients get a 401.
+func (g *OAuthGate) require() HandlerFunc {
+	return func(c *Context) {
+		if _, ok := c.Get(claimsKey); ok {
+			c.Next()
+			return
+		}
+		if session := g.session(c); session != nil {
+			c.Set(sessionKey, session)
+			c.Next()
+			return
+		}
+
+		if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			prefix := pathPrefix(c.Request)
+			c.Redirect(http.StatusFound, prefix+"/auth/login?next="+url.QueryEscape(prefix+c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Log in with Discord to access attachments")
+	}
+}
+
+// session returns the unexpired session the request's cookie belongs to, or
+// nil if there is none.
+func (g *OAuthGate) session(c *Context) *oauthSession {
+	id, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	g.mu.Lock()
+	session, ok := g.sessions[id]
+	g.mu.Unlock()
+	if !ok || !time.Now().Before(session.expiresAt) {
+		return nil
+	}
+	return session
+}
+
+func (g *OAuthGate) handleLogin() HandlerFunc {
+	return func(c *Context) {
+		state, err := newID(32)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to generate OAuth state: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to start login")
+			return
+		}
+
+		// Only local paths are accepted so the login can't be used as an
+		// open redirect.
+		next := c.Query("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = pathPrefix(c.Request) + "/"
+		}
+
+		g.mu.Lock()
+		g.pending[state] = pendingLogin{next: next, expiresAt: time.Now().Add(loginTimeout)}
+		g.mu.Unlock()
+
+		g.setCookie(c, stateCookie, state, loginTimeout)
+		query := url.Values{
+			"client_id":     {g.clientID},
+			"redirect_uri":  {g.redirectURL(c)},
+			"response_type": {"code"},
+			"scope":         {"identify guilds"},
+			"state":         {state},
+		}
+		c.Redirect(http.StatusFound, discordAuthorizeURL+"?"+query.Encode())
+	}
+}
+
+func (g *OAuthGate) handleCallback() HandlerFunc {
+	return func(c *Context) {
+		state := c.Query("state")
+		cookieState, _ := c.Cookie(stateCookie)
+		g.mu.Lock()
+		login, ok := g.pending[state]
+		delete(g.pending, state)
+		g.mu.Unlock()
+		if state == "" || state != cookieState || !ok || time.Now().After(login.expiresAt) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Login expired, try again")
+			return
+		}
+		g.setCookie(c, stateCookie, "", -1)
+
+		code := c.Query("code")
+		if code == "" {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Discord login was cancelled")
+			return
+		}
+
+		session, err := g.exchange(c, code)
+		if err != nil {
+			logf(c, slog.LevelError, "Discord login failed: %v", err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Discord login failed")
+			return
+		}
+
+		id, err := newID(32)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to generate session ID: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create session")
+			return
+		}
+		g.mu.Lock()
+		g.sessions[id] = session
+		g.mu.Unlock()
+
+		logf(c, slog.LevelInfo, "User %s (%d) logged in with %d guilds", session.username, session.userID, len(session.guilds))
+		g.setCookie(c, sessionCookie, id, sessionTTL)
+		c.Redirect(http.StatusFound, login.next)
+	}
+}
+
+func (g *OAuthGate) handleLogout() HandlerFunc {
+	return func(c *Context) {
+		if id, err := c.Cookie(sessionCookie); err == nil {
+			g.mu.Lock()
+			delete(g.sessions, id)
+			g.mu.Unlock()
+		}
+		g.setCookie(c, sessionCookie, "", -1)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (g *OAuthGate) setCookie(c *Context, name, value string, maxAge time.Duration) {
+	secure := strings.HasPrefix(publicURL(c, g.config), "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, int(maxAge/time.Second), "/", "", secure, true)
+}
+
+// exchange trades an authorization code for the user's identity and guilds.
+func (g *OAuthGate) exchange(c *Context, code string) (*oauthSession, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {g.redirectURL(c)},
+		"client_id":     {g.clientID},
+		"client_secret": {g.clientSecret},
+	}
+	resp, err := g.http.PostForm(discordAPIURL(g.config.DiscordAPIVersion)+"/oauth2/token", form)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newDiscordError(resp)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+	authorization := "Bearer " + token.AccessToken
+
+	var user User
+	if err := g.get(authorization, "/users/@me", &user); err != nil {
+		return nil, err
+	}
+	var guilds []struct {
+		ID string `json:"id"`
+	}
+	if err := g.get(authorization, "/users/@me/guilds?limit=200", &guilds); err != nil {
+		return nil, err
+	}
+
+	session := &oauthSession{
+		userID:    user.ID,
+		username:  user.Username,
+		guilds:    make(map[int64]bool, len(guilds)),
+		expiresAt: time.Now().Add(sessionTTL),
+	}
+	for _, guild := range guilds {
+		if id, err := strconv.ParseInt(guild.ID, 10, 64); err == nil {
+			session.guilds[id] = true
+		}
+	}
+	return session, nil
+}
+
+func (g *OAuthGate) get(authorization, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, discordAPIURL(g.config.DiscordAPIVersion)+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newDiscordError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (g *OAuthGate) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		g.mu.Lock()
+		for id, session := range g.sessions {
+			if now.After(session.expiresAt) {
+				delete(g.sessions, id)
+			}
+		}
+		for state, login := range g.pending {
+			if now.After(login.expiresAt) {
+				delete(g.pending, state)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,185 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"image"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultEmbedWidth  = 640
+	defaultEmbedHeight = 360
+)
+
+var (
+	imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif"}
+	videoExtensions = []string{".mp4", ".webm", ".mov"}
+	audioExtensions = []string{".mp3", ".ogg", ".opus", ".wav", ".m4a", ".flac"}
+)
+
+func hasExtension(fileName string, extensions []string) bool {
+	ext := strings.ToLower(path.Ext(fileName))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// linkFromEmbedURL resolves the url parameter of an embed request, which may
+// be a Discord CDN link, a link to this service, or a short link, permalink
+// or alias. Links to this service start with prefix, the path prefix the
+// embed request arrived under.
+func linkFromEmbedURL(store *Store, raw, prefix string) (*LinkData, string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "Invalid URL format"
+	}
+
+	linkPath := u.Path
+	if prefix != "" && underPrefix(linkPath, prefix) {
+		linkPath = strings.TrimPrefix(linkPath, prefix)
+	}
+	linkPath = strings.TrimPrefix(linkPath, "/")
+	if slug, ok := strings.CutPrefix(linkPath, "s/"); ok {
+		link, ok := store.ShortLink(slug)
+		if !ok {
+			return nil, "Short link not found"
+		}
+		return &link.LinkData, ""
+	}
+	if id, ok := strings.CutPrefix(linkPath, "p/"); ok {
+		link, ok := store.Permalink(id)
+		if !ok {
+			return nil, "Permalink not found"
+		}
+		return &link.LinkData, ""
+	}
+	if name, ok := strings.CutPrefix(linkPath, "a/"); ok {
+		alias, ok := store.Alias(name)
+		if !ok {
+			return nil, "Alias not found"
+		}
+		return &alias.LinkData, ""
+	}
+
+	if u.RawQuery != "" {
+		linkPath += "?" + u.RawQuery
+	}
+	parsedLink := parseLink(linkPath)
+	if parsedLink.Error != "" {
+		return nil, parsedLink.Error
+	}
+	return parsedLink.Data, ""
+}
+
+func handleOEmbed(client *DiscordClient, store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		if format := c.DefaultQuery("format", "json"); format != "json" {
+			respondError(c, http.StatusNotImplemented, codeInvalidParameter, "Only the json format is supported")
+			return
+		}
+
+		raw := c.Query("url")
+		if raw == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+			return
+		}
+
+		data, errMsg := linkFromEmbedURL(store, raw, pathPrefix(c.Request))
+		if data == nil {
+			respondError(c, http.StatusNotFound, codeInvalidLink, errMsg)
+			return
+		}
+		if !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+
+		proxyURL := publicURL(c, config) + "/" + data.Path()
+		embed := H{
+			"version":       "1.0",
+			"provider_name": "Discord CDN",
+			"provider_url":  publicURL(c, config),
+			"title":         data.FileName,
+		}
+
+		maxWidth, _ := strconv.Atoi(c.Query("maxwidth"))
+		maxHeight, _ := strconv.Atoi(c.Query("maxheight"))
+
+		switch {
+		case hasExtension(data.FileName, imageExtensions):
+			newURL, err := client.RefreshAttachmentURL(c.Request.Context(), requesterOf(c), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+			if err != nil {
+				respondRefreshError(c, err)
+				return
+			}
+
+			width, height, err := imageDimensions(c.Request.Context(), client, newURL)
+			if err != nil {
+				logf(c, slog.LevelError, "Error reading image dimensions: %v", err)
+				respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to read image dimensions")
+				return
+			}
+			width, height = fitDimensions(width, height, maxWidth, maxHeight)
+
+			embed["type"] = "photo"
+			embed["url"] = proxyURL
+			embed["width"] = width
+			embed["height"] = height
+		case hasExtension(data.FileName, videoExtensions):
+			width, height := fitDimensions(defaultEmbedWidth, defaultEmbedHeight, maxWidth, maxHeight)
+
+			embed["type"] = "video"
+			embed["width"] = width
+			embed["height"] = height
+			embed["html"] = fmt.Sprintf(`<video src="%s" width="%d" height="%d" controls></video>`,
+				html.EscapeString(proxyURL), width, height)
+		default:
+			embed["type"] = "link"
+		}
+
+		c.JSON(http.StatusOK, embed)
+	}
+}
+
+// imageDimensions reads just enough of the image at target to decode its
+// header.
+func imageDimensions(ctx context.Context, client *DiscordClient, target string) (int, int, error) {
+	resp, err := client.Download(ctx, target, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+
+	cfg, _, err := image.DecodeConfig(resp.Body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image header: %w", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// fitDimensions scales width x height down to fit the optional bounds,
+// preserving the aspect ratio.
+func fitDimensions(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
@@ -0,0 +1,54 @@
+package discordcdn
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLinkFromEmbedURL(t *testing.T) {
+	store, err := OpenStore(t.TempDir() + "/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "a.png"}
+	if err := store.AddShortLink(&ShortLink{Slug: "abc", LinkData: data}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddPermalink(&Permalink{ID: "perm", LinkData: data}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddAlias(&Alias{Name: "logo", LinkData: data}); err != nil {
+		t.Fatal(err)
+	}
+	attachment := fmt.Sprintf("%d/%d/a.png", testChannelID, testFileID)
+
+	tests := []struct {
+		name   string
+		url    string
+		prefix string
+		ok     bool
+	}{
+		{"CDN link", "https://cdn.discordapp.com/attachments/" + attachment + "?ex=1", "", true},
+		{"attachment link", "https://cdn.example.com/" + attachment, "", true},
+		{"short link", "https://cdn.example.com/s/abc", "", true},
+		{"permalink", "https://cdn.example.com/p/perm", "", true},
+		{"alias", "https://cdn.example.com/a/logo", "", true},
+		{"attachment under prefix", "https://example.com/cdn/acme/" + attachment, "/cdn/acme", true},
+		{"short link under prefix", "https://example.com/cdn/acme/s/abc", "/cdn/acme", true},
+		{"permalink under prefix", "https://example.com/cdn/acme/p/perm", "/cdn/acme", true},
+		{"unknown short link", "https://cdn.example.com/s/nope", "", false},
+		{"unknown permalink", "https://cdn.example.com/p/nope", "", false},
+		{"unknown alias", "https://cdn.example.com/a/nope", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errMsg := linkFromEmbedURL(store, tt.url, tt.prefix)
+			if (got != nil) != tt.ok {
+				t.Fatalf("linkFromEmbedURL() = %v, %q", got, errMsg)
+			}
+			if got != nil && (got.ChannelID != data.ChannelID || got.FileID != data.FileID || got.FileName != data.FileName) {
+				t.Errorf("linkFromEmbedURL() = %+v, want %+v", got, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+package discordcdn
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// routeDoc describes a route in the OpenAPI document. The routes themselves
+// are read from the router, so every registered route is listed and none
+// can be documented without existing; routeDocs adds what the router can't
+// know.
+type routeDoc struct {
+	summary string
+	tag     string
+	// auth marks routes that take an API key, or an admin key for those
+	// tagged admin, and adminToken those that take DCDN_ADMIN_TOKEN.
+	auth       bool
+	adminToken bool
+	query      []paramDoc
+	// body is the schema of the JSON request body, or "multipart" for a
+	// file upload.
+	body string
+	// status and contentType describe a successful response, 200 with JSON
+	// unless set.
+	status      int
+	contentType string
+}
+
+type paramDoc struct {
+	name, typ, description string
+}
+
+// pathParamDocs describes the path parameters used across routes.
+var pathParamDocs = map[string]string{
+	"channelID": "Discord channel ID",
+	"fileID":    "Discord attachment ID",
+	"fileName":  "Attachment file name",
+	"link":      "Attachment link in any accepted form, such as a CDN URL or channelID/fileID/fileName",
+	"id":        "Resource ID",
+	"slug":      "Short link slug",
+	"name":      "Alias name",
+	"hash":      "Image hash",
+	"token":     "Signed share token",
+	"message":   "Discord message link, or its guildID/channelID/messageID part",
+	"key":       "Key of a flagged file, its file ID or f/<upload ID>, or of a takedown, its file ID or SHA-256",
+	"stickerID": "Discord sticker ID",
+}
+
+var (
+	linkQuery = []paramDoc{
+		{"format", "string", "Format passed to Discord's media proxy"},
+		{"width", "integer", "Width passed to Discord's media proxy"},
+		{"height", "integer", "Height passed to Discord's media proxy"},
+		{"quality", "string", "Quality passed to Discord's media proxy"},
+		{"name", "string", "File name to serve the attachment under"},
+	}
+	proxyQuery = []paramDoc{
+		{"w", "integer", "Width to resize images to in proxy mode"},
+		{"h", "integer", "Height to resize images to in proxy mode"},
+		{"fmt", "string", "Format to re-encode images to in proxy mode: jpeg, png, webp or avif"},
+		{"download", "boolean", "Serve the attachment as a download in proxy mode"},
+	}
+	pageQuery = []paramDoc{
+		{"limit", "integer", "Most results to return"},
+		{"offset", "integer", "Results to skip"},
+	}
+)
+
+// attachmentDoc describes attachment links, which the router's fallback
+// serves rather than a route.
+var attachmentDoc = routeDoc{
+	summary: "Redirect to a freshly signed URL of an attachment, or serve it in proxy mode",
+	tag:     "attachments",
+	query:   append(append([]paramDoc{}, linkQuery...), proxyQuery...),
+	status:  http.StatusMovedPermanently,
+}
+
+// routeDocs returns the description of every route, keyed by method and
+// pattern.
+func routeDocs() map[string]routeDoc {
+	docs := map[string]routeDoc{
+		"GET /healthz":        {summary: "Liveness check", tag: "health"},
+		"GET /readyz":         {summary: "Readiness check", tag: "health"},
+		"GET /healthz/deps":   {summary: "Status and latency of each dependency", tag: "health"},
+		"GET /healthz/canary": {summary: "Outcome of the latest canary refresh", tag: "health"},
+		"GET /robots.txt":     {summary: "robots.txt for crawlers", tag: "meta", contentType: "text/plain"},
+		"GET /":               {summary: "Link conversion page", tag: "meta", contentType: "text/html"},
+		"GET /openapi.json":   {summary: "This OpenAPI document", tag: "meta"},
+		"GET /version":        {summary: "Build version and enabled features", tag: "meta"},
+		"GET /auth/login":     {summary: "Start a Discord login", tag: "auth", status: http.StatusFound},
+		"GET /auth/callback":  {summary: "Finish a Discord login", tag: "auth", status: http.StatusFound},
+		"POST /auth/logout":   {summary: "End the Discord login session", tag: "auth"},
+		"GET /auth":           {summary: "Check credentials for a reverse proxy's forward auth", tag: "auth"},
+		"HEAD /auth":          {summary: "Check credentials for a reverse proxy's forward auth", tag: "auth"},
+
+		"GET /f/:id":                {summary: "Serve an uploaded file", tag: "uploads", status: http.StatusMovedPermanently},
+		"GET /f/:id/:fileName":      {summary: "Serve an uploaded file under a file name", tag: "uploads", status: http.StatusMovedPermanently},
+		"POST /upload":              {summary: "Upload a file to the upload channel", tag: "uploads", auth: true, body: "multipart", status: http.StatusCreated},
+		"GET /s/:slug":              {summary: "Follow a short link", tag: "links", query: linkQuery, status: http.StatusMovedPermanently},
+		"POST /api/shorten":         {summary: "Create a short link", tag: "links", auth: true, body: "ShortenRequest", status: http.StatusCreated},
+		"GET /p/:id":                {summary: "Follow a permalink", tag: "links", query: linkQuery, status: http.StatusMovedPermanently},
+		"POST /api/permalink":       {summary: "Create a permalink", tag: "links", auth: true, body: "PermalinkRequest", status: http.StatusCreated},
+		"POST /api/permalink/:id":   {summary: "Point a permalink at another attachment", tag: "links", auth: true, body: "PermalinkRequest"},
+		"GET /a/:name":              {summary: "Follow an alias", tag: "links", query: linkQuery, status: http.StatusMovedPermanently},
+		"GET /api/aliases":          {summary: "List aliases", tag: "links", auth: true},
+		"POST /api/aliases":         {summary: "Create an alias", tag: "links", auth: true, body: "AliasRequest", status: http.StatusCreated},
+		"POST /api/aliases/:name":   {summary: "Point an alias at another attachment", tag: "links", auth: true, body: "AliasRequest"},
+		"DELETE /api/aliases/:name": {summary: "Delete an alias", tag: "links", auth: true, status: http.StatusNoContent},
+		"GET /share/:token":         {summary: "Follow a share link until it expires", tag: "links", query: linkQuery, status: http.StatusMovedPermanently},
+		"POST /api/share":           {summary: "Create a share link that expires", tag: "links", auth: true, body: "ShareRequest", status: http.StatusCreated},
+		"POST /api/import/aliases": {summary: "Import aliases in bulk", tag: "links", auth: true, body: "AliasImport", query: []paramDoc{
+			{"dryRun", "boolean", "Only validate the import"},
+			{"replace", "boolean", "Point aliases that already exist at the imported attachments"},
+		}},
+
+		"GET /api/info/:channelID/:fileID/:fileName": {summary: "Describe a link without contacting Discord", tag: "links", auth: true},
+		"GET /api/validate/*link":                    {summary: "Parse a link as the proxy would, without contacting Discord", tag: "links", auth: true},
+		"GET /api/metadata/*link":                    {summary: "Fetch an attachment's metadata", tag: "links", auth: true},
+		"GET /api/exists/*link":                      {summary: "Check whether an attachment still exists", tag: "links", auth: true},
+		"GET /api/checksum/*link":                    {summary: "SHA-256 and MD5 checksums of an attachment", tag: "links", auth: true},
+		"GET /api/search": {summary: "Search indexed attachments", tag: "links", auth: true, query: append([]paramDoc{
+			{"filename", "string", "Part of the file name"},
+			{"text", "string", "Part of the message text"},
+			{"type", "string", "Content type"},
+			{"channel", "string", "Channel ID"},
+			{"after", "string", "Only attachments posted after this time"},
+			{"before", "string", "Only attachments posted before this time"},
+		}, pageQuery...)},
+		"GET /api/channels/:channelID/export": {summary: "Export the indexed attachments of a channel as a tar archive", tag: "links", auth: true, contentType: "application/x-tar", query: []paramDoc{
+			{"after", "string", "Only attachments posted after this time"},
+			{"before", "string", "Only attachments posted before this time"},
+		}},
+		"GET /qr/*link":         {summary: "QR code of a link", tag: "links", contentType: "image/png", query: []paramDoc{{"size", "integer", "Size in pixels"}, {"format", "string", "png or svg"}}},
+		"GET /preview/*link":    {summary: "HTML preview page of an attachment", tag: "links", contentType: "text/html"},
+		"GET /gallery/*message": {summary: "Gallery of a message's attachments", tag: "links", contentType: "text/html", query: []paramDoc{{"format", "string", "html, json or zip"}}},
+		"POST /api/zip":         {summary: "Download attachments as one ZIP archive", tag: "links", auth: true, body: "ZipRequest", contentType: "application/zip"},
+		"POST /api/convert":     {summary: "Proxy URLs and refreshed URLs of an attachment or message link", tag: "links", auth: true, body: "ConvertRequest"},
+		"GET /poster/*link":     {summary: "Frame of a video as an image", tag: "links", contentType: "image/jpeg", query: []paramDoc{{"t", "number", "Offset in seconds"}, {"fmt", "string", "jpeg, png or webp"}}},
+		"GET /placeholder/*link": {summary: "Blurred placeholder or blurhash of an image", tag: "links", contentType: "image/jpeg", query: []paramDoc{
+			{"format", "string", "jpeg or blurhash"},
+			{"x", "integer", "Horizontal blurhash components, 1 to 9"},
+			{"y", "integer", "Vertical blurhash components, 1 to 9"},
+		}},
+		"GET /waveform/*link": {summary: "Waveform of a voice message", tag: "links", query: []paramDoc{{"samples", "integer", "Number of peaks, 1 to 1024"}}},
+		"GET /sticker/:stickerID": {summary: "Lottie sticker converted to an animated image", tag: "links", contentType: "image/gif", query: []paramDoc{
+			{"fmt", "string", "gif, apng or webp"},
+			{"size", "integer", "Width and height in pixels, 16 to 512"},
+		}},
+		"GET /oembed": {summary: "oEmbed description of a link", tag: "links", query: []paramDoc{
+			{"url", "string", "Link to describe"},
+			{"format", "string", "Response format, only json"},
+			{"maxwidth", "integer", "Largest width of the embed"},
+			{"maxheight", "integer", "Largest height of the embed"},
+		}},
+		"POST /graphql": {summary: "GraphQL API", tag: "api", body: "GraphQLRequest"},
+
+		"POST /report":         {summary: "Report an attachment for review", tag: "links", body: "ReportRequest", status: http.StatusCreated},
+		"POST /jobs/refresh":   {summary: "Queue a refresh job", tag: "jobs", auth: true, body: "RefreshJobRequest", status: http.StatusAccepted},
+		"GET /jobs/:id":        {summary: "Status and results of a refresh job", tag: "jobs", auth: true, query: pageQuery},
+		"GET /jobs/:id/events": {summary: "Progress of a refresh job as server-sent events", tag: "jobs", auth: true, contentType: "text/event-stream"},
+
+		"GET /stats":         {summary: "Usage statistics", tag: "admin", auth: true, query: []paramDoc{{"hours", "integer", "Hours of history"}, {"limit", "integer", "Most entries per list"}}},
+		"GET /admin/":        {summary: "Admin dashboard", tag: "admin", auth: true, contentType: "text/html"},
+		"GET /admin/stats":   {summary: "Dashboard statistics", tag: "admin", auth: true},
+		"POST /admin/reload": {summary: "Reload the configuration", tag: "admin", auth: true, status: http.StatusNoContent},
+		"GET /admin/keys":    {summary: "Usage and quota of each API key", tag: "admin", auth: true},
+		"GET /admin/usage/export": {summary: "Export usage", tag: "admin", auth: true, contentType: "text/csv", query: []paramDoc{
+			{"from", "string", "First day, as YYYY-MM-DD"},
+			{"to", "string", "Last day, as YYYY-MM-DD"},
+			{"group", "string", "Grouping of the rows"},
+			{"format", "string", "csv or json"},
+		}},
+		"GET /admin/tokens": {summary: "Health of each bot token", tag: "admin", auth: true},
+		"GET /admin/audit": {summary: "Audit log entries", tag: "admin", auth: true, query: []paramDoc{
+			{"attachment", "string", "Attachment URL or ID"},
+			{"requester", "string", "Requester"},
+			{"token", "string", "Token ID"},
+			{"outcome", "string", "Outcome"},
+			{"limit", "integer", "Most entries to return"},
+		}},
+		"GET /admin/cache": {summary: "Dump the URL cache", tag: "admin", auth: true, contentType: "application/jsonl", query: []paramDoc{
+			{"format", "string", "jsonl or links"},
+		}},
+		"DELETE /admin/disk-cache/:fileID": {summary: "Remove an attachment from the disk cache", tag: "admin", auth: true},
+		"GET /admin/upstream":              {summary: "Discord API latency and availability", tag: "admin", auth: true},
+		"GET /admin/log":                   {summary: "Log level and format", tag: "admin", auth: true},
+		"POST /admin/log":                  {summary: "Change the log level or format until the next reload", tag: "admin", auth: true, body: "LogSettings"},
+		"GET /admin/reports": {summary: "Abuse reports awaiting review", tag: "admin", auth: true, query: []paramDoc{
+			{"all", "boolean", "Include resolved reports"},
+		}},
+		"POST /admin/reports/:id/takedown": {summary: "Take down the attachment a report is about", tag: "admin", auth: true, body: "ReportTakedown"},
+		"POST /admin/reports/:id/dismiss":  {summary: "Dismiss a report", tag: "admin", auth: true, status: http.StatusNoContent},
+		"GET /admin/takedowns":             {summary: "Attachments taken down", tag: "admin", auth: true},
+		"POST /admin/takedowns":            {summary: "Take an attachment down and purge its copies", tag: "admin", auth: true, body: "TakedownRequest", status: http.StatusCreated},
+		"DELETE /admin/takedowns/:key":     {summary: "Lift a takedown, by file ID or SHA-256", tag: "admin", auth: true, status: http.StatusNoContent},
+		"GET /admin/flagged":               {summary: "Files the virus scanner flagged", tag: "admin", auth: true},
+		"DELETE /admin/flagged/*key":       {summary: "Serve a flagged file again, as a false positive", tag: "admin", auth: true, status: http.StatusNoContent},
+		"GET /admin/moderation": {summary: "Moderation verdicts on attachments", tag: "admin", auth: true, query: []paramDoc{
+			{"all", "boolean", "Include allowed attachments, not only denied ones"},
+		}},
+		"POST /admin/moderation/:fileID":   {summary: "Override the moderation verdict on an attachment", tag: "admin", auth: true, body: "ModerationOverride"},
+		"DELETE /admin/moderation/:fileID": {summary: "Moderate an attachment again on its next access", tag: "admin", auth: true, status: http.StatusNoContent},
+
+		"GET /admin/ops":                {summary: "Draining and maintenance mode", tag: "ops", adminToken: true},
+		"POST /admin/ops/drain":         {summary: "Fail readiness checks and close connections", tag: "ops", adminToken: true},
+		"DELETE /admin/ops/drain":       {summary: "Stop draining", tag: "ops", adminToken: true},
+		"POST /admin/ops/maintenance":   {summary: "Turn requests away with 503", tag: "ops", adminToken: true, body: "MaintenanceRequest"},
+		"DELETE /admin/ops/maintenance": {summary: "End maintenance mode", tag: "ops", adminToken: true},
+		"POST /admin/ops/flush":         {summary: "Empty the URL, transform and disk caches", tag: "ops", adminToken: true},
+		"POST /admin/ops/token":         {summary: "Switch to another Discord token until the next reload", tag: "ops", adminToken: true, body: "RotateTokenRequest"},
+		"GET /admin/ops/config":         {summary: "The running configuration, with secrets redacted", tag: "ops", adminToken: true},
+	}
+	for _, kind := range assetKinds {
+		docs["GET /"+kind+"/:id/:hash"] = routeDoc{
+			summary: "Redirect to a Discord " + strings.TrimSuffix(kind, "s") + " image",
+			tag:     "assets",
+			query:   []paramDoc{{"format", "string", "Image format"}, {"static", "boolean", "Serve animated images as a still"}, {"size", "integer", "Size in pixels"}},
+			status:  http.StatusMovedPermanently,
+		}
+	}
+	return docs
+}
+
+// openAPISchemas are the request and error schemas shared by routes.
+var openAPISchemas = H{
+	"ErrorResponse": H{
+		"type":     "object",
+		"required": []string{"error", "code"},
+		"properties": H{
+			"error":     H{"type": "string"},
+			"code":      H{"type": "string", "enum": errorCodes},
+			"requestID": H{"type": "string"},
+			"discord": H{
+				"type": "object",
+				"properties": H{
+					"code":    H{"type": "integer"},
+					"message": H{"type": "string"},
+					"errors":  H{"type": "object", "additionalProperties": H{"type": "string"}},
+				},
+			},
+		},
+	},
+	"ShortenRequest": H{
+		"type":       "object",
+		"required":   []string{"url"},
+		"properties": H{"url": H{"type": "string"}},
+	},
+	"PermalinkRequest": H{
+		"type":       "object",
+		"required":   []string{"url"},
+		"properties": H{"url": H{"type": "string"}},
+	},
+	"AliasRequest": H{
+		"type":     "object",
+		"required": []string{"url"},
+		"properties": H{
+			"name": H{"type": "string", "description": "Name of the alias, when creating one"},
+			"url":  H{"type": "string"},
+		},
+	},
+	"ModerationOverride": H{
+		"type":     "object",
+		"required": []string{"allowed"},
+		"properties": H{
+			"allowed": H{"type": "boolean"},
+			"reason":  H{"type": "string"},
+		},
+	},
+	"AliasImport": H{
+		"type":        "array",
+		"description": "Aliases to import, also accepted as one per line, or as CSV with name and url columns",
+		"items":       H{"$ref": "#/components/schemas/AliasRequest"},
+	},
+	"ZipRequest": H{
+		"type": "object",
+		"properties": H{
+			"links":   H{"type": "array", "items": H{"type": "string"}, "description": "Attachments to archive, up to 50"},
+			"message": H{"type": "string", "description": "Message link whose attachments to archive, instead of links"},
+			"name":    H{"type": "string", "description": "File name of the archive"},
+		},
+	},
+	"ConvertRequest": H{
+		"type":       "object",
+		"required":   []string{"link"},
+		"properties": H{"link": H{"type": "string", "description": "Attachment link, or message link whose attachments to convert"}},
+	},
+	"ShareRequest": H{
+		"type":     "object",
+		"required": []string{"url"},
+		"properties": H{
+			"url":       H{"type": "string"},
+			"expiresIn": H{"type": "string", "description": "How long the link works, such as 24h"},
+			"once":      H{"type": "boolean", "description": "Only let the link be fetched once"},
+		},
+	},
+	"LogSettings": H{
+		"type": "object",
+		"properties": H{
+			"level":  H{"type": "string", "enum": []string{"debug", "info", "warn", "error"}},
+			"format": H{"type": "string", "enum": []string{logFormatConsole, logFormatJSON}},
+		},
+	},
+	"ReportRequest": H{
+		"type":     "object",
+		"required": []string{"url", "reason"},
+		"properties": H{
+			"url":     H{"type": "string"},
+			"reason":  H{"type": "string", "enum": reportReasons},
+			"details": H{"type": "string", "maxLength": maxReportDetails},
+			"contact": H{"type": "string", "maxLength": maxReportContact},
+		},
+	},
+	"ReportTakedown": H{
+		"type": "object",
+		"properties": H{
+			"status": H{"type": "integer", "enum": []int{http.StatusUnavailableForLegalReasons, http.StatusGone}},
+		},
+	},
+	"TakedownRequest": H{
+		"type":        "object",
+		"description": "Either fileID or sha256",
+		"properties": H{
+			"fileID": H{"type": "integer", "format": "int64"},
+			"sha256": H{"type": "string"},
+			"status": H{"type": "integer", "enum": []int{http.StatusUnavailableForLegalReasons, http.StatusGone}},
+			"reason": H{"type": "string"},
+		},
+	},
+	"MaintenanceRequest": H{
+		"type": "object",
+		"properties": H{
+			"message": H{"type": "string"},
+		},
+	},
+	"RotateTokenRequest": H{
+		"type":     "object",
+		"required": []string{"token"},
+		"properties": H{
+			"token": H{"type": "string"},
+		},
+	},
+	"RefreshJobRequest": H{
+		"type":     "object",
+		"required": []string{"urls"},
+		"properties": H{
+			"urls":        H{"type": "array", "items": H{"type": "string"}, "maxItems": maxJobURLs},
+			"callbackURL": H{"type": "string", "description": "URL posted the signed results once the job is done"},
+		},
+	},
+	"GraphQLRequest": H{
+		"type":     "object",
+		"required": []string{"query"},
+		"properties": H{
+			"query":         H{"type": "string"},
+			"operationName": H{"type": "string"},
+			"variables":     H{"type": "object"},
+		},
+	},
+}
+
+// buildOpenAPI describes the routes of engines, which may be the same.
+// Routes without a description are still listed, and logged so they get
+// one.
+func buildOpenAPI(engines ...*Engine) H {
+	docs := routeDocs()
+	paths := H{}
+	seen := map[string]bool{}
+	for _, e := range engines {
+		for _, r := range e.Routes() {
+			key := r.Method + " " + r.Path
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			doc, ok := docs[key]
+			if !ok {
+				logAt(slog.LevelWarn, "OpenAPI document has no description of %s", key)
+			}
+			path, params := openAPIPath(r.Path)
+			item, _ := paths[path].(H)
+			if item == nil {
+				item = H{}
+				paths[path] = item
+			}
+			item[strings.ToLower(r.Method)] = doc.operation(params)
+		}
+	}
+	paths["/{link}"] = H{"get": attachmentDoc.operation([]string{"link"})}
+
+	return H{
+		"openapi": "3.0.3",
+		"info": H{
+			"title":   "Discord CDN Refresh",
+			"version": version,
+		},
+		"paths": paths,
+		"components": H{
+			"schemas": openAPISchemas,
+			"securitySchemes": H{
+				"apiKey": H{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": H{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// openAPIPath converts a route pattern to an OpenAPI path, returning the
+// names of its parameters.
+func openAPIPath(pattern string) (string, []string) {
+	segments := strings.Split(pattern, "/")
+	var params []string
+	for i, s := range segments {
+		if s != "" && (s[0] == ':' || s[0] == '*') {
+			params = append(params, s[1:])
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func (d routeDoc) operation(pathParams []string) H {
+	op := H{"summary": d.summary}
+	if d.tag != "" {
+		op["tags"] = []string{d.tag}
+	}
+
+	var params []H
+	for _, name := range pathParams {
+		params = append(params, H{"name": name, "in": "path", "required": true, "description": pathParamDocs[name], "schema": H{"type": "string"}})
+	}
+	for _, q := range d.query {
+		params = append(params, H{"name": q.name, "in": "query", "description": q.description, "schema": H{"type": q.typ}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	switch d.body {
+	case "":
+	case "multipart":
+		op["requestBody"] = H{"required": true, "content": H{"multipart/form-data": H{"schema": H{
+			"type":       "object",
+			"required":   []string{"file"},
+			"properties": H{"file": H{"type": "string", "format": "binary"}},
+		}}}}
+	default:
+		op["requestBody"] = H{"required": true, "content": H{"application/json": H{"schema": H{"$ref": "#/components/schemas/" + d.body}}}}
+	}
+
+	status, contentType := d.status, d.contentType
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	success := H{"description": http.StatusText(status)}
+	switch {
+	case status >= 300 && status < 400:
+		success["headers"] = H{"Location": H{"schema": H{"type": "string"}}}
+	case status != http.StatusNoContent:
+		success["content"] = H{contentType: H{}}
+	}
+	op["responses"] = H{
+		strconv.Itoa(status): success,
+		"default": H{
+			"description": "Error",
+			"content":     H{"application/json": H{"schema": H{"$ref": "#/components/schemas/ErrorResponse"}}},
+		},
+	}
+	if d.auth {
+		op["security"] = []H{{"apiKey": []string{}}, {"bearer": []string{}}}
+	}
+	if d.adminToken {
+		op["security"] = []H{{"bearer": []string{}}}
+	}
+	return op
+}
+
+// handleOpenAPI serves the OpenAPI document of engines. It is built on
+// first request, once every route is registered.
+func handleOpenAPI(engines ...*Engine) HandlerFunc {
+	var once sync.Once
+	var doc H
+	return func(c *Context) {
+		once.Do(func() { doc = buildOpenAPI(engines...) })
+		// Paths are relative to the base path and tenant prefix the
+		// document was requested under.
+		if prefix := pathPrefix(c.Request); prefix != "" {
+			served := maps.Clone(doc)
+			served["servers"] = []H{{"url": prefix}}
+			c.JSON(http.StatusOK, served)
+			return
+		}
+		c.JSON(http.StatusOK, doc)
+	}
+}
@@ -0,0 +1,238 @@
+package discordcdn
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minAdminTokenLength keeps DCDN_ADMIN_TOKEN out of reach of guessing.
+const minAdminTokenLength = 32
+
+// maintenanceRetryAfter is the Retry-After sent with maintenance responses.
+const maintenanceRetryAfter = 60 * time.Second
+
+// Maintenance describes maintenance mode while it is on.
+type Maintenance struct {
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// opsState holds the switches of the operations API. They cover the whole
+// instance, every tenant included, like the log settings.
+type opsState struct {
+	draining    atomic.Bool
+	mu          sync.RWMutex
+	maintenance *Maintenance
+}
+
+var ops = &opsState{}
+
+func (s *opsState) Maintenance() *Maintenance {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maintenance
+}
+
+func (s *opsState) setMaintenance(m *Maintenance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maintenance = m
+}
+
+// OpsStatus is the state reported by the operations API.
+type OpsStatus struct {
+	Draining    bool         `json:"draining"`
+	Maintenance *Maintenance `json:"maintenance"`
+}
+
+func (s *opsState) status() OpsStatus {
+	return OpsStatus{Draining: s.draining.Load(), Maintenance: s.Maintenance()}
+}
+
+// checkMaintenance turns requests away with 503 while maintenance mode is on,
+// and asks clients to reconnect elsewhere while the instance is draining.
+// Routes registered before it, such as health checks, are left alone.
+func checkMaintenance() HandlerFunc {
+	return func(c *Context) {
+		if ops.draining.Load() {
+			c.Header("Connection", "close")
+		}
+		if m := ops.Maintenance(); m != nil {
+			c.Header("Retry-After", retryAfterHeader(maintenanceRetryAfter))
+			respondError(c, http.StatusServiceUnavailable, codeMaintenance, m.Message)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdminToken lets through requests bearing DCDN_ADMIN_TOKEN. Unlike
+// API keys, which are handed to clients, the token is only for operators.
+func requireAdminToken(token string) HandlerFunc {
+	return func(c *Context) {
+		bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="discord-cdn"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid admin token")
+			return
+		}
+		c.Next()
+	}
+}
+
+func handleOpsStatus() HandlerFunc {
+	return func(c *Context) {
+		c.JSON(http.StatusOK, ops.status())
+	}
+}
+
+// handleDrain fails readiness checks, so load balancers stop sending the
+// instance traffic, and closes connections after their current response.
+// Draining stops when the request is sent with DELETE.
+func handleDrain(drain bool) HandlerFunc {
+	return func(c *Context) {
+		ops.draining.Store(drain)
+		if drain {
+			logf(c, slog.LevelWarn, "Draining: readiness checks fail until drained with DELETE")
+		} else {
+			logf(c, slog.LevelInfo, "No longer draining")
+		}
+		c.JSON(http.StatusOK, ops.status())
+	}
+}
+
+// MaintenanceRequest turns maintenance mode on.
+type MaintenanceRequest struct {
+	// Message is returned with every request turned away.
+	Message string `json:"message"`
+}
+
+// handleSetMaintenance turns maintenance mode on, with the message given.
+func handleSetMaintenance() HandlerFunc {
+	return func(c *Context) {
+		var req MaintenanceRequest
+		if c.Request.ContentLength != 0 {
+			err := c.ShouldBindJSON(&req)
+			if bodyTooLarge(c, err) {
+				return
+			}
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Body must be a JSON object with a message")
+				return
+			}
+		}
+		if req.Message == "" {
+			req.Message = "Down for maintenance"
+		}
+		ops.setMaintenance(&Maintenance{Message: req.Message, Since: time.Now().UTC()})
+		logf(c, slog.LevelWarn, "Maintenance mode on: %s", req.Message)
+		c.JSON(http.StatusOK, ops.status())
+	}
+}
+
+func handleClearMaintenance() HandlerFunc {
+	return func(c *Context) {
+		ops.setMaintenance(nil)
+		logf(c, slog.LevelInfo, "Maintenance mode off")
+		c.JSON(http.StatusOK, ops.status())
+	}
+}
+
+// handleFlushCaches empties the URL, transform and disk caches of a client,
+// reporting how many entries each held.
+func handleFlushCaches(client *DiscordClient) HandlerFunc {
+	return func(c *Context) {
+		client.mu.RLock()
+		stale, variants, disk := client.stale, client.variants, client.diskCache
+		client.mu.RUnlock()
+
+		flushed := H{}
+		if stale != nil {
+			flushed[cacheURLs] = stale.Clear()
+		}
+		if variants != nil {
+			flushed[cacheVariants] = variants.Clear()
+		}
+		if disk != nil {
+			flushed[cacheDisk] = disk.Clear()
+		}
+		logf(c, slog.LevelWarn, "Flushed caches: %v", flushed)
+		c.JSON(http.StatusOK, H{"flushed": flushed})
+	}
+}
+
+// RotateTokenRequest replaces the Discord token.
+type RotateTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// handleRotateToken checks a new Discord token and switches the client to
+// it, until the next reload reads the configured token again.
+func handleRotateToken(client *DiscordClient, reloader *Reloader) HandlerFunc {
+	return func(c *Context) {
+		var req RotateTokenRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || strings.TrimSpace(req.Token) == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Body must be a JSON object with a token")
+			return
+		}
+		token := strings.TrimSpace(req.Token)
+		// Unlike the check at startup, a token that couldn't be checked
+		// isn't switched to.
+		ctx, cancel := context.WithTimeout(c.Request.Context(), tokenCheckTimeout)
+		user, err := client.TokenUser(ctx, token)
+		cancel()
+		var discordErr *DiscordError
+		if errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusUnauthorized {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Discord rejected the token")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to check new token: %v", err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to check the token with Discord")
+			return
+		}
+
+		client.SetToken(token)
+		if monitor := client.Monitor(); monitor != nil {
+			config := *reloader.Config()
+			config.Token = token
+			monitor.SetTokens(configuredTokens(&config))
+		}
+		logf(c, slog.LevelWarn, "Discord token rotated to %s, belonging to %s (%d)", tokenID(token), user.Username, user.ID)
+		c.JSON(http.StatusOK, H{"token": tokenID(token)})
+	}
+}
+
+// ConfigSetting is a setting reported by the operations API.
+type ConfigSetting struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// handleDumpConfig reports the configuration as last loaded or reloaded, in
+// the order and form of --print-config, with secrets redacted.
+func handleDumpConfig(reloader *Reloader) HandlerFunc {
+	return func(c *Context) {
+		config := reloader.Config()
+		settings := make([]ConfigSetting, 0, len(config.settings))
+		for _, s := range config.settings {
+			value := s.value
+			if s.secret && value != "" {
+				value = "[redacted]"
+			}
+			settings = append(settings, ConfigSetting{Name: s.name, Value: value})
+		}
+		c.JSON(http.StatusOK, H{"settings": settings})
+	}
+}
@@ -0,0 +1,261 @@
+package discordcdn
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const (
+	testChannelID = 1151234567890123456
+	testFileID    = 1151234567890123457
+)
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  *LinkData
+		err   string
+	}{
+		{
+			name:  "bare path",
+			input: "1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "cdn url",
+			input: "https://cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "media proxy url",
+			input: "https://media.discordapp.net/attachments/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "legacy attachments host",
+			input: "https://cdn.discord.com/attachments/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "without scheme",
+			input: "cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "uppercase host and path",
+			input: "HTTPS://CDN.DISCORDAPP.COM/ATTACHMENTS/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "signed query string",
+			input: "https://cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png?ex=6a000000&is=69000000&hm=abc&",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "media proxy parameters",
+			input: "https://media.discordapp.net/attachments/1151234567890123456/1151234567890123457/image.png?ex=6a000000&width=320&height=240&format=webp",
+			want: &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png", Media: url.Values{
+				"width": {"320"}, "height": {"240"}, "format": {"webp"},
+			}},
+		},
+		{
+			name:  "fragment",
+			input: "https://cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png#preview",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "doubled and trailing slashes",
+			input: "https://cdn.discordapp.com/attachments//1151234567890123456//1151234567890123457/image.png/",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "leading slash",
+			input: "/1151234567890123456/1151234567890123457/image.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "display name",
+			input: "1151234567890123456/1151234567890123457/image.png/My%20Photo.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png", DisplayName: "My Photo.png"},
+		},
+		{
+			name:  "percent-encoded name",
+			input: "1151234567890123456/1151234567890123457/my%20file.tar.gz",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "my file.tar.gz"},
+		},
+		{
+			name:  "unicode name",
+			input: "1151234567890123456/1151234567890123457/фото_日本.jpg",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "фото_日本.jpg"},
+		},
+		{
+			name:  "percent-encoded unicode name",
+			input: "1151234567890123456/1151234567890123457/%D1%84%D0%BE%D1%82%D0%BE.jpg",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "фото.jpg"},
+		},
+		{
+			name:  "extra dots and spaces in name",
+			input: "1151234567890123456/1151234567890123457/..my . file..png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "..my . file..png"},
+		},
+		{
+			name:  "wrapped in angle brackets",
+			input: "<https://cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png>",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "quoted with whitespace",
+			input: " \u200b\"https://cdn.discordapp.com/attachments/1151234567890123456/1151234567890123457/image.png\"\n",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "json escaped slashes",
+			input: `https:\/\/cdn.discordapp.com\/attachments\/1151234567890123456\/1151234567890123457\/image.png`,
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "encoded whole",
+			input: "https%3A%2F%2Fcdn.discordapp.com%2Fattachments%2F1151234567890123456%2F1151234567890123457%2Fimage.png",
+			want:  &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"},
+		},
+		{
+			name:  "too few segments",
+			input: "1151234567890123456/image.png",
+			err:   "Invalid link format",
+		},
+		{
+			name:  "too many segments",
+			input: "1151234567890123456/1151234567890123457/image.png/name.png/extra",
+			err:   "Invalid link format",
+		},
+		{
+			name:  "non-numeric channel id",
+			input: "general/1151234567890123457/image.png",
+			err:   "Invalid Channel ID",
+		},
+		{
+			name:  "channel id too small",
+			input: "123/1151234567890123457/image.png",
+			err:   "Channel ID is not a Discord ID",
+		},
+		{
+			name:  "non-numeric file id",
+			input: "1151234567890123456/abc/image.png",
+			err:   "Invalid File ID",
+		},
+		{
+			name:  "file id overflows",
+			input: "1151234567890123456/99999999999999999999/image.png",
+			err:   "Invalid File ID",
+		},
+		{
+			name:  "file id from the future",
+			input: "1151234567890123456/9151234567890123457/image.png",
+			err:   "File ID is not a Discord ID",
+		},
+		{
+			name:  "name without extension",
+			input: "1151234567890123456/1151234567890123457/image",
+			err:   "File name must include extension",
+		},
+		{
+			name:  "empty",
+			input: "",
+			err:   "Invalid link format",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseLink(tt.input)
+			if got.Error != tt.err {
+				t.Fatalf("parseLink(%q) error = %q, want %q", tt.input, got.Error, tt.err)
+			}
+			if !reflect.DeepEqual(got.Data, tt.want) {
+				t.Errorf("parseLink(%q) = %+v, want %+v", tt.input, got.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "https://cdn.discordapp.com/a.png", "https://cdn.discordapp.com/a.png"},
+		{"whitespace", " \t https://cdn.discordapp.com/a.png \r\n", "https://cdn.discordapp.com/a.png"},
+		{"invisible characters", "\ufeff\u200bhttps://cdn.discordapp.com/a.png\u200b", "https://cdn.discordapp.com/a.png"},
+		{"angle brackets", "<https://cdn.discordapp.com/a.png>", "https://cdn.discordapp.com/a.png"},
+		{"double quotes", `"https://cdn.discordapp.com/a.png"`, "https://cdn.discordapp.com/a.png"},
+		{"single quotes", "'https://cdn.discordapp.com/a.png'", "https://cdn.discordapp.com/a.png"},
+		{"quotes in angle brackets", `<"https://cdn.discordapp.com/a.png">`, "https://cdn.discordapp.com/a.png"},
+		{"escaped slashes", `https:\/\/cdn.discordapp.com\/a.png`, "https://cdn.discordapp.com/a.png"},
+		{"unbalanced bracket", "<https://cdn.discordapp.com/a.png", "<https://cdn.discordapp.com/a.png"},
+		{"single character", "<", "<"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unwrapLink(tt.input); got != tt.want {
+				t.Errorf("unwrapLink(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeFileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"no escapes", "image.png", "image.png"},
+		{"space", "my%20file.png", "my file.png"},
+		{"plus is kept", "a+b.png", "a+b.png"},
+		{"unicode", "%E6%97%A5%E6%9C%AC.png", "日本.png"},
+		{"raw unicode", "日本.png", "日本.png"},
+		{"invalid escape", "100%.png", "100%.png"},
+		{"invalid utf-8", "%FF%FE.png", "%FF%FE.png"},
+		{"encoded slash", "a%2Fb.png", "a%2Fb.png"},
+		{"encoded query", "image.png%3Fex%3D6a000000", "image.png"},
+		{"encoded fragment", "image.png%23top", "image.png"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unescapeFileName(tt.input); got != tt.want {
+				t.Errorf("unescapeFileName(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"clean", "1/2/a.png", "1/2/a.png"},
+		{"cdn url", "https://cdn.discordapp.com/attachments/1/2/a.png", "1/2/a.png"},
+		{"media proxy url", "https://media.discordapp.net/attachments/1/2/a.png", "1/2/a.png"},
+		{"without scheme", "cdn.discordapp.com/attachments/1/2/a.png", "1/2/a.png"},
+		{"uppercase", "HTTPS://CDN.DISCORDAPP.COM/Attachments/1/2/a.png", "1/2/a.png"},
+		{"query string", "https://cdn.discordapp.com/attachments/1/2/a.png?ex=1&hm=2", "1/2/a.png"},
+		{"leading and trailing slashes", "/1/2/a.png/", "1/2/a.png"},
+		{"doubled slashes", "1//2///a.png", "1/2/a.png"},
+		{"doubled slashes after host", "https://cdn.discordapp.com/attachments//1//2/a.png", "1/2/a.png"},
+		{"display name", "1/2/a.png/b.png", "1/2/a.png/b.png"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanURL(tt.input); got != tt.want {
+				t.Errorf("cleanURL(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
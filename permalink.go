@@ -0,0 +1,137 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	permalinkLength = 8
+	// permalinkMaxAge is how long clients may cache where a permalink or
+	// alias leads, and so how long an update can take to reach them.
+	permalinkMaxAge = 5 * time.Minute
+)
+
+var errPermalinkNotFound = errors.New("permalink not found")
+
+// Permalink is a stable ID for an attachment whose target can be changed,
+// such as when the file is uploaded again elsewhere.
+type Permalink struct {
+	ID string `json:"id"`
+	LinkData
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type PermalinkRequest struct {
+	URL string `json:"url"`
+}
+
+// bindPermalinkRequest reads the attachment a permalink request points at,
+// responding with an error if there isn't one.
+func bindPermalinkRequest(c *Context) (*LinkData, bool) {
+	var req PermalinkRequest
+	err := c.ShouldBindJSON(&req)
+	if bodyTooLarge(c, err) {
+		return nil, false
+	}
+	if err != nil || req.URL == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+		return nil, false
+	}
+	parsedLink := parseLink(req.URL)
+	if parsedLink.Error != "" {
+		respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+		return nil, false
+	}
+	return parsedLink.Data, true
+}
+
+func handleCreatePermalink(store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		data, ok := bindPermalinkRequest(c)
+		if !ok {
+			return
+		}
+
+		for attempt := 0; attempt < 5; attempt++ {
+			id, err := newID(permalinkLength)
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to generate permalink ID: %v", err)
+				break
+			}
+
+			now := time.Now().UTC()
+			err = store.AddPermalink(&Permalink{ID: id, LinkData: *data, CreatedAt: now, UpdatedAt: now})
+			if errors.Is(err, errSlugTaken) {
+				continue
+			}
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to save permalink: %v", err)
+				break
+			}
+
+			c.JSON(http.StatusCreated, H{
+				"id":  id,
+				"url": publicURL(c, config) + "/p/" + id,
+			})
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create permalink")
+	}
+}
+
+// handleUpdatePermalink points a permalink at another attachment. Responses
+// cached at the edge for the attachment it pointed at are purged, so the
+// change shows there right away.
+func handleUpdatePermalink(client *DiscordClient, store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		data, ok := bindPermalinkRequest(c)
+		if !ok {
+			return
+		}
+
+		id := c.Param("id")
+		previous, err := store.UpdatePermalink(id, *data)
+		if errors.Is(err, errPermalinkNotFound) {
+			respondError(c, http.StatusNotFound, codeNotFound, "Permalink not found")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to save permalink: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to update permalink")
+			return
+		}
+		if previous.FileID != data.FileID {
+			client.purgeAttachment(attachmentURL(previous.ChannelID, previous.FileID, previous.FileName))
+		}
+		logf(c, slog.LevelInfo, "Permalink %s moved from %s to %s", id, previous.Path(), data.Path())
+
+		c.JSON(http.StatusOK, H{
+			"id":  id,
+			"url": publicURL(c, config) + "/p/" + id,
+		})
+	}
+}
+
+func handlePermalink(client *DiscordClient, store *Store, transformer *Transformer, config *Config) HandlerFunc {
+	return func(c *Context) {
+		link, ok := store.Permalink(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, codeNotFound, "Permalink not found")
+			return
+		}
+
+		// Redirects are permanent, and browsers would keep following the
+		// old target after an update without a bound on caching them.
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(permalinkMaxAge.Seconds())))
+
+		data := link.LinkData
+		data.applyQuery(c.QueryValues())
+		serveAttachment(c, client, transformer, config, &data)
+	}
+}
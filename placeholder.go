@@ -0,0 +1,285 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// placeholderSize bounds the larger side of blurred placeholders, which
+	// browsers stretch over the image's box while it loads.
+	placeholderSize = 32
+	// blurhashSampleSize bounds the image blurhashes are computed from; the
+	// few components they keep don't need more.
+	blurhashSampleSize = 64
+)
+
+// blurhashDigits are the base 83 digits of blurhash strings.
+const blurhashDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// PlaceholderOptions describes a placeholder requested through the format,
+// x and y query parameters.
+type PlaceholderOptions struct {
+	// Format is "jpeg" for a tiny blurred image or "blurhash".
+	Format string
+	// X and Y are the blurhash components along each axis.
+	X, Y int
+}
+
+// cacheKey keys a placeholder by the image's channel as well as its file,
+// since cached placeholders are served after checking access to the link's
+// channel alone.
+func (o *PlaceholderOptions) cacheKey(data *LinkData) string {
+	if o.Format == "blurhash" {
+		return fmt.Sprintf("placeholder/%d/%d/blurhash/%dx%d", data.ChannelID, data.FileID, o.X, o.Y)
+	}
+	return fmt.Sprintf("placeholder/%d/%d/%s", data.ChannelID, data.FileID, o.Format)
+}
+
+// Blurhash is the response of /placeholder with format=blurhash. The
+// dimensions are the image's, so the page can reserve its box.
+type Blurhash struct {
+	Blurhash string `json:"blurhash"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+func (t *Transformer) CachedPlaceholder(data *LinkData, opts *PlaceholderOptions) ([]byte, string, bool) {
+	return t.cache.Get(opts.cacheKey(data))
+}
+
+// Placeholder downloads the image at sourceURL and renders a placeholder for
+// it, caching it with the other variants.
+func (t *Transformer) Placeholder(ctx context.Context, data *LinkData, sourceURL string, opts *PlaceholderOptions) ([]byte, string, error) {
+	img, _, err := t.download(ctx, sourceURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	contentType := "image/jpeg"
+	if opts.Format == "blurhash" {
+		bounds := img.Bounds()
+		contentType = "application/json"
+		err = json.NewEncoder(&buf).Encode(&Blurhash{
+			Blurhash: encodeBlurhash(resizeImage(img, blurhashSampleSize, blurhashSampleSize), opts.X, opts.Y),
+			Width:    bounds.Dx(),
+			Height:   bounds.Dy(),
+		})
+	} else {
+		err = jpeg.Encode(&buf, blurImage(resizeImage(img, placeholderSize, placeholderSize)), &jpeg.Options{Quality: 50})
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode placeholder: %w", err)
+	}
+
+	t.cache.Put(opts.cacheKey(data), contentType, buf.Bytes())
+	return buf.Bytes(), contentType, nil
+}
+
+// blurImage smooths a tiny image with two passes of a 3x3 box blur, so the
+// blocks of a scaled-up JPEG don't show.
+func blurImage(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewRGBA(src.Bounds())
+	for range 2 {
+		w, h := src.Rect.Dx(), src.Rect.Dy()
+		for y := range h {
+			for x := range w {
+				var sum [4]int
+				n := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						sx, sy := x+dx, y+dy
+						if sx < 0 || sy < 0 || sx >= w || sy >= h {
+							continue
+						}
+						i := src.PixOffset(sx, sy)
+						for k := range sum {
+							sum[k] += int(src.Pix[i+k])
+						}
+						n++
+					}
+				}
+				i := dst.PixOffset(x, y)
+				for k := range sum {
+					dst.Pix[i+k] = uint8(sum[k] / n)
+				}
+			}
+		}
+		src, dst = dst, src
+	}
+	return src
+}
+
+// encodeBlurhash computes the blurhash of img with x by y components: the
+// coefficients of a few cosines over the image in linear light, quantized
+// and written in base 83.
+func encodeBlurhash(img image.Image, x, y int) string {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	linear := make([][3]float64, w*h)
+	for py := range h {
+		for px := range w {
+			r, g, b, _ := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+			linear[py*w+px] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, x*y)
+	for j := range y {
+		for i := range x {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for py := range h {
+				for px := range w {
+					basis := normalization * math.Cos(math.Pi*float64(i*px)/float64(w)) * math.Cos(math.Pi*float64(j*py)/float64(h))
+					for k, c := range linear[py*w+px] {
+						factor[k] += basis * c
+					}
+				}
+			}
+			for k := range factor {
+				factor[k] /= float64(w * h)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := appendBase83(nil, (x-1)+(y-1)*9, 1)
+	maximum := 1.0
+	if len(factors) > 1 {
+		var actual float64
+		for _, factor := range factors[1:] {
+			for _, c := range factor {
+				actual = max(actual, math.Abs(c))
+			}
+		}
+		quantized := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantized+1) / 166
+		hash = appendBase83(hash, quantized, 1)
+	} else {
+		hash = appendBase83(hash, 0, 1)
+	}
+
+	dc := factors[0]
+	hash = appendBase83(hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, c := range factor {
+			value = value*19 + int(max(0, min(18, math.Floor(signedPow(c/maximum, 0.5)*9+9.5))))
+		}
+		hash = appendBase83(hash, value, 2)
+	}
+	return string(hash)
+}
+
+func appendBase83(dst []byte, value, length int) []byte {
+	for i := length - 1; i >= 0; i-- {
+		dst = append(dst, blurhashDigits[value/int(math.Pow(83, float64(i)))%83])
+	}
+	return dst
+}
+
+func srgbToLinear(v uint32) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := max(0, min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// parseBlurhashComponents reads a blurhash component count, 1 to 9.
+func parseBlurhashComponents(raw string, fallback int) (int, bool) {
+	if raw == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(raw)
+	return n, err == nil && n >= 1 && n <= 9
+}
+
+func handlePlaceholder(client *DiscordClient, transformer *Transformer) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil || !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+
+		opts := &PlaceholderOptions{Format: c.DefaultQuery("format", "jpeg")}
+		if opts.Format != "jpeg" && opts.Format != "blurhash" {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Format must be jpeg or blurhash")
+			return
+		}
+		var okX, okY bool
+		opts.X, okX = parseBlurhashComponents(c.Query("x"), 4)
+		opts.Y, okY = parseBlurhashComponents(c.Query("y"), 3)
+		if !okX || !okY {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Components must be between 1 and 9")
+			return
+		}
+
+		// A blurred preview still gives away an image blocked by moderation.
+		if moderation := client.Moderation(); moderation != nil && moderation.denied(c, data.FileID) {
+			return
+		}
+		if placeholder, contentType, ok := transformer.CachedPlaceholder(data, opts); ok {
+			servePlaceholder(c, contentType, placeholder)
+			return
+		}
+
+		newURL, err := client.RefreshAttachmentURL(c.Request.Context(), requesterOf(c), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+
+		placeholder, contentType, err := transformer.Placeholder(c.Request.Context(), data, newURL, opts)
+		switch {
+		case errors.Is(err, errNotImage):
+			respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Attachment is not a supported image")
+		case errors.Is(err, errImageTooLarge):
+			respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Image is too large for a placeholder")
+		case err != nil:
+			logf(c, slog.LevelError, "Error rendering placeholder: %v", err)
+			reportError(c, err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to render placeholder")
+		default:
+			servePlaceholder(c, contentType, placeholder)
+		}
+	}
+}
+
+// servePlaceholder sends a placeholder, cacheable for good since the image
+// behind it never changes.
+func servePlaceholder(c *Context, contentType string, placeholder []byte) {
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Data(http.StatusOK, contentType, placeholder)
+}
@@ -0,0 +1,36 @@
+package discordcdn
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPlaceholderCacheIsPerChannel(t *testing.T) {
+	transformer := NewTransformer(NewDiscordClient("token"), NewByteCache(1<<20))
+	opts := &PlaceholderOptions{Format: "blurhash", X: 4, Y: 3}
+	data := &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"}
+
+	if _, _, err := transformer.Placeholder(context.Background(), data, servePNG(t, 16, 16), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data *LinkData
+		opts *PlaceholderOptions
+		hit  bool
+	}{
+		{"same channel and file", data, opts, true},
+		{"other channel", &LinkData{ChannelID: testChannelID + 1, FileID: testFileID}, opts, false},
+		{"other file", &LinkData{ChannelID: testChannelID, FileID: testFileID + 1}, opts, false},
+		{"other components", data, &PlaceholderOptions{Format: "blurhash", X: 3, Y: 3}, false},
+		{"other format", data, &PlaceholderOptions{Format: "jpeg"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, hit := transformer.CachedPlaceholder(tt.data, tt.opts); hit != tt.hit {
+				t.Errorf("CachedPlaceholder() hit = %v, want %v", hit, tt.hit)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const posterTimeout = 30 * time.Second
+
+// PosterExtractor renders still frames from video attachments using ffmpeg,
+// caching the encoded frames alongside other image variants.
+type PosterExtractor struct {
+	ffmpeg string
+	cache  *ByteCache
+}
+
+func NewPosterExtractor(ffmpegPath string, cache *ByteCache) *PosterExtractor {
+	return &PosterExtractor{ffmpeg: ffmpegPath, cache: cache}
+}
+
+// posterCacheKey keys a frame by the video's channel as well as its file,
+// since cached frames are served after checking access to the link's
+// channel alone.
+func posterCacheKey(data *LinkData, offset float64, format string) string {
+	return fmt.Sprintf("poster/%d/%d/%g/%s", data.ChannelID, data.FileID, offset, format)
+}
+
+func (p *PosterExtractor) Cached(data *LinkData, offset float64, format string) ([]byte, string, bool) {
+	return p.cache.Get(posterCacheKey(data, offset, format))
+}
+
+// Extract grabs the frame at offset seconds into the video at sourceURL. ffmpeg
+// reads the URL itself, so only the bytes up to the frame are downloaded.
+func (p *PosterExtractor) Extract(ctx context.Context, data *LinkData, sourceURL string, offset float64, format string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.ffmpeg,
+		"-nostdin", "-loglevel", "error",
+		"-ss", strconv.FormatFloat(offset, 'f', -1, 64),
+		"-i", sourceURL,
+		"-frames:v", "1",
+		"-f", "image2pipe", "-c:v", "png", "pipe:1",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	frame, err := png.Decode(&stdout)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+
+	var buf bytes.Buffer
+	contentType, err := encodeImage(&buf, frame, format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p.cache.Put(posterCacheKey(data, offset, format), contentType, buf.Bytes())
+	return buf.Bytes(), contentType, nil
+}
+
+func handlePoster(client *DiscordClient, posters *PosterExtractor) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil || !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+
+		offset, err := strconv.ParseFloat(c.DefaultQuery("t", "0"), 64)
+		if err != nil || offset < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Timestamp must be a non-negative number of seconds")
+			return
+		}
+
+		format := c.DefaultQuery("fmt", "jpeg")
+		if format != "jpeg" && format != "webp" {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Format must be jpeg or webp")
+			return
+		}
+
+		if frame, contentType, ok := posters.Cached(data, offset, format); ok {
+			c.Data(http.StatusOK, contentType, frame)
+			return
+		}
+
+		newURL, err := client.RefreshAttachmentURL(c.Request.Context(), requesterOf(c), attachmentURL(data.ChannelID, data.FileID, data.FileName))
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+
+		frame, contentType, err := posters.Extract(c.Request.Context(), data, newURL, offset, format)
+		if err != nil {
+			logf(c, slog.LevelError, "Error extracting poster frame: %v", err)
+			respondError(c, http.StatusUnprocessableEntity, codeUnsupportedMedia, "Failed to extract frame from video")
+			return
+		}
+
+		c.Data(http.StatusOK, contentType, frame)
+	}
+}
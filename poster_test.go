@@ -0,0 +1,28 @@
+package discordcdn
+
+import "testing"
+
+func TestPosterCacheIsPerChannel(t *testing.T) {
+	posters := NewPosterExtractor("ffmpeg", NewByteCache(1<<20))
+	data := &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "video.mp4"}
+	posters.cache.Put(posterCacheKey(data, 1, "jpeg"), "image/jpeg", []byte("frame"))
+
+	tests := []struct {
+		name   string
+		data   *LinkData
+		offset float64
+		hit    bool
+	}{
+		{"same channel and file", data, 1, true},
+		{"other channel", &LinkData{ChannelID: testChannelID + 1, FileID: testFileID}, 1, false},
+		{"other file", &LinkData{ChannelID: testChannelID, FileID: testFileID + 1}, 1, false},
+		{"other offset", data, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, hit := posters.Cached(tt.data, tt.offset, "jpeg"); hit != tt.hit {
+				t.Errorf("Cached() hit = %v, want %v", hit, tt.hit)
+			}
+		})
+	}
+}
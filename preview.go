@@ -0,0 +1,93 @@
+package discordcdn
+
+import (
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.URL}}">
+{{- if .IsImage}}
+<meta property="og:type" content="website">
+<meta property="og:image" content="{{.URL}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.URL}}">
+{{- else if .IsVideo}}
+<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.URL}}">
+<meta property="og:video:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{- else if .IsAudio}}
+<meta property="og:type" content="music.song">
+<meta property="og:audio" content="{{.URL}}">
+<meta property="og:audio:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{- else}}
+<meta property="og:type" content="website">
+<meta name="twitter:card" content="summary">
+{{- end}}
+<meta name="twitter:title" content="{{.Title}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}">
+<style>body{margin:0;background:#111;display:flex;align-items:center;justify-content:center;min-height:100vh}img,video{max-width:100%;max-height:100vh}audio{width:min(480px,90vw)}a{color:#ddd;font-family:sans-serif}</style>
+</head>
+<body>
+{{- if .IsImage}}
+<img src="{{.URL}}" alt="{{.Title}}">
+{{- else if .IsVideo}}
+<video src="{{.URL}}" controls></video>
+{{- else if .IsAudio}}
+<audio src="{{.URL}}" controls></audio>
+{{- else}}
+<a href="{{.URL}}">{{.Title}}</a>
+{{- end}}
+</body>
+</html>
+`))
+
+type previewPage struct {
+	Title       string
+	URL         string
+	ContentType string
+	OEmbedURL   string
+	IsImage     bool
+	IsVideo     bool
+	IsAudio     bool
+}
+
+func handlePreview(config *Config) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+
+		proxyURL := publicURL(c, config) + "/" + data.Path()
+		page := previewPage{
+			Title:       data.FileName,
+			URL:         proxyURL,
+			ContentType: mime.TypeByExtension(path.Ext(data.FileName)),
+			OEmbedURL:   publicURL(c, config) + "/oembed?url=" + url.QueryEscape(proxyURL),
+			IsImage:     hasExtension(data.FileName, imageExtensions),
+			IsVideo:     hasExtension(data.FileName, videoExtensions),
+			IsAudio:     hasExtension(data.FileName, audioExtensions),
+		}
+
+		if config.ClientHints {
+			c.Header("Accept-CH", acceptClientHints)
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := previewTemplate.Execute(c.Writer, page); err != nil {
+			logf(c, slog.LevelError, "Failed to render preview page: %v", err)
+		}
+	}
+}
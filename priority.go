@@ -0,0 +1,174 @@
+package discordcdn
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Priority tags a Discord API call so that calls a client is waiting on win
+// over bulk work when the rate limit budget runs low.
+type Priority int
+
+const (
+	// PriorityInteractive is for redirects and other single refreshes, which
+	// are never held back.
+	PriorityInteractive Priority = iota
+	// PriorityBackground is for batch refreshes and jobs, which wait for the
+	// rate limit to reset once the budget is down to the interactive reserve.
+	PriorityBackground
+)
+
+func (p Priority) String() string {
+	if p == PriorityInteractive {
+		return "interactive"
+	}
+	return "background"
+}
+
+// rateBudget tracks Discord's remaining rate limit budget from the headers of
+// its responses.
+type rateBudget struct {
+	mu      sync.Mutex
+	reserve int
+	// remaining is -1 until Discord has reported a budget.
+	remaining int
+	resetAt   time.Time
+}
+
+func newRateBudget() *rateBudget {
+	return &rateBudget{remaining: -1}
+}
+
+func (b *rateBudget) setReserve(reserve int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserve = reserve
+}
+
+// wait blocks a call of the given priority until the budget allows it. When
+// that would take longer than maxWait, unless it is zero, it returns an
+// OverloadError instead, and once ctx is done, ctx's error.
+func (b *rateBudget) wait(ctx context.Context, priority Priority, maxWait time.Duration) error {
+	if priority == PriorityInteractive {
+		return nil
+	}
+
+	start := time.Now()
+	waited := false
+	for {
+		b.mu.Lock()
+		delay := time.Until(b.resetAt)
+		scarce := b.remaining >= 0 && b.remaining <= b.reserve && delay > 0
+		b.mu.Unlock()
+		if !scarce {
+			break
+		}
+		if maxWait > 0 && time.Since(start)+delay > maxWait {
+			return newOverloadError(queueBudget, delay)
+		}
+		waited = true
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if waited {
+		metrics.Timing("discord.priority_wait", time.Since(start), "priority:"+priority.String())
+	}
+	return nil
+}
+
+// update records the budget reported by a response. A rate-limited response
+// empties the budget until Discord's Retry-After has passed.
+func (b *rateBudget) update(resp *http.Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		b.remaining = 0
+		b.resetAt = time.Now().Add(retryAfter(&DiscordError{RetryAfter: resp.Header.Get("Retry-After")}))
+		return
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+	b.remaining = remaining
+	b.resetAt = time.Now().Add(time.Duration(resetAfter * float64(time.Second)))
+}
+
+// globalLimitPeriod is the window of Discord's global rate limit, which
+// applies to each bot token across every instance using it.
+const globalLimitPeriod = time.Second
+
+// waitGlobal blocks an API call until the token's share of Discord's global
+// rate limit allows it. Calls are counted with the client's request counter,
+// so instances sharing Redis keep to the limit together rather than each
+// assuming it has the whole budget. Background calls leave the interactive
+// reserve free. If the counter fails, calls go ahead. Waiting stops with
+// ctx's error once ctx is done, or with an OverloadError as soon as it would
+// last longer than the client's maximum queue wait.
+func (c *DiscordClient) waitGlobal(ctx context.Context, token string, priority Priority) error {
+	c.mu.RLock()
+	counter, limit, reserve, maxWait := c.counter, int64(c.globalLimit), int64(c.reserve), c.maxQueueWait
+	c.mu.RUnlock()
+	if counter == nil || limit <= 0 {
+		return nil
+	}
+	if priority == PriorityBackground {
+		limit = max(limit-reserve, 1)
+	}
+
+	key := "discord:" + tokenID(token)
+	start := time.Now()
+	waited := false
+	for {
+		now := time.Now()
+		window := now.Truncate(globalLimitPeriod)
+		count, err := counter.take(context.Background(), key, window, globalLimitPeriod)
+		if err != nil {
+			metrics.Count("ratelimit.errors", 1, "scope:discord")
+			if !c.counterFailing.Swap(true) {
+				logAt(slog.LevelWarn, "Discord global rate limit is failing open: %v", err)
+			}
+			break
+		}
+		if c.counterFailing.Swap(false) {
+			log.Printf("Discord global rate limit recovered")
+		}
+		if count <= limit {
+			break
+		}
+		// Calls over the limit are let through a window's worth at a time,
+		// so this one goes once those ahead of it have.
+		delay := window.Add(globalLimitPeriod).Sub(now) + globalLimitPeriod*time.Duration((count-limit-1)/limit)
+		if maxWait > 0 && time.Since(start)+delay > maxWait {
+			return newOverloadError(queueGlobal, delay)
+		}
+		waited = true
+		timer := time.NewTimer(window.Add(globalLimitPeriod).Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if waited {
+		metrics.Timing("discord.global_wait", time.Since(start), "priority:"+priority.String())
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package discordcdn
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// proxiedHeaders are copied from the CDN response onto the client response
+// when streaming an attachment. Validators are deliberately left out: the
+// service sets its own stable ETag and Last-Modified.
+var proxiedHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+}
+
+// sniffLen is how much of a file is looked at to tell its type, all that
+// http.DetectContentType considers.
+const sniffLen = 512
+
+// textTypes are the types, besides text/*, +json and +xml, that content
+// recognized as text may be served as.
+var textTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+}
+
+// activeTypes are the types browsers run script in, besides +xml types other
+// than SVG, which setContentHeaders never serves files as.
+var activeTypes = []string{
+	"text/html",
+	"text/xml",
+	"text/xsl",
+	"application/xml",
+}
+
+// proxyContent streams target to the client, forwarding the client's Range
+// header upstream so partial requests keep working. The type is taken from
+// the content rather than the filename where they disagree, and browsers are
+// told not to second-guess it. Compressible content is encoded on the fly
+// when the client accepts it. With a cacheKey, complete responses are kept
+// in the disk cache, if there is one.
+func proxyContent(c *Context, client *DiscordClient, target string, maxSize int64, cacheKey string) {
+	resp, err := client.Download(c.Request.Context(), target, c.GetHeader("Range"))
+	if err != nil {
+		logf(c, slog.LevelError, "Error fetching attachment: %v", err)
+		reportError(c, err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to fetch attachment")
+		return
+	}
+	defer resp.Body.Close()
+
+	if maxSize > 0 && responseSize(resp) > maxSize {
+		respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Attachment is too large to proxy")
+		return
+	}
+
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
+	if startsAtZero(resp) {
+		head, _ := body.Peek(sniffLen)
+		declared := resp.Header.Get("Content-Type")
+		if contentType := sniffContentType(declared, head); contentType != declared {
+			logf(c, slog.LevelDebug, "Serving %s as %s rather than %s", target, contentType, declared)
+			metrics.Count("proxy.type_overrides", 1)
+			resp.Header.Set("Content-Type", contentType)
+		}
+	}
+	// The type is made safe before it is copied below, or kept on disk.
+	resp.Header.Set("Content-Type", inertContentType(resp.Header.Get("Content-Type")))
+	setContentHeaders(c, resp.Header.Get("Content-Type"))
+
+	for _, header := range proxiedHeaders {
+		// A Cache-Control set by the route, such as for a share link that
+		// expires, wins over the CDN's.
+		if header == "Cache-Control" && c.Writer.Header().Get(header) != "" {
+			continue
+		}
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+
+	var dst io.Writer = c.Writer
+	if isCompressible(resp.Header.Get("Content-Type")) {
+		c.Header("Vary", "Accept-Encoding")
+		if encoding := negotiateEncoding(c.GetHeader("Accept-Encoding")); encoding != "" && shouldCompress(resp) {
+			c.Header("Content-Encoding", encoding)
+			c.Writer.Header().Del("Content-Length")
+			c.Writer.Header().Del("Accept-Ranges")
+			// The encoded bytes differ from the identity representation, so
+			// only a weak validator still holds.
+			if etag := c.Writer.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				c.Header("ETag", "W/"+etag)
+			}
+
+			encoder := compressWriter(c.Writer, encoding)
+			defer encoder.Close()
+			dst = encoder
+		}
+	}
+	c.Status(resp.StatusCode)
+
+	var src io.Reader = body
+	if maxSize > 0 {
+		// Guards against upstreams that don't announce a length: the copy
+		// stops one byte past the cap so an oversized body is detectable.
+		src = io.LimitReader(body, maxSize+1)
+	}
+	// A ranged response covering the whole file is as good as a full one.
+	var cached *DiskCacheWriter
+	if disk := client.DiskCache(); disk != nil && cacheKey != "" && startsAtZero(resp) && (resp.StatusCode == http.StatusOK || resp.ContentLength == responseSize(resp)) {
+		if cached = disk.Create(cacheKey, resp.Header.Get("Content-Type"), responseSize(resp)); cached != nil {
+			src = io.TeeReader(src, cached)
+		}
+	}
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		logf(c, slog.LevelError, "Error streaming attachment: %v", err)
+	}
+	tooLarge := maxSize > 0 && n > maxSize
+	if cached != nil {
+		if err != nil || tooLarge {
+			cached.Abort()
+		} else {
+			cached.Commit(responseSize(resp))
+		}
+	}
+	if tooLarge {
+		// Ending the response normally would pass the truncated file off as
+		// complete, so the connection is cut instead.
+		logf(c, slog.LevelWarn, "Aborted stream of %s after exceeding the %d byte limit", target, maxSize)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// startsAtZero reports whether a response body starts at the beginning of
+// the file, so its first bytes tell the file's type.
+func startsAtZero(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK ||
+		resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-")
+}
+
+// sniffContentType returns the type to serve a file as, given the type its
+// extension implies and its first bytes. Text is only served as the declared
+// type when that is a text type too, so HTML or script named like an image is
+// served as plain text rather than as anything a browser would run, and
+// binary content named like text is served as the format recognized, if any.
+// Otherwise the declared type stands, unless the content is recognized as
+// another media format of the same kind, such as a GIF named .png.
+func sniffContentType(declared string, head []byte) string {
+	if len(head) == 0 {
+		return declared
+	}
+	sniffed := http.DetectContentType(head)
+	sniffedType, _, _ := mime.ParseMediaType(sniffed)
+	declaredType, _, _ := mime.ParseMediaType(declared)
+	sniffedKind, _, _ := strings.Cut(sniffedType, "/")
+	declaredKind, _, _ := strings.Cut(declaredType, "/")
+
+	switch {
+	case sniffedType == "text/plain" || sniffedType == "text/html" || sniffedType == "text/xml":
+		if isTextType(declared) {
+			return declared
+		}
+		return "text/plain; charset=utf-8"
+	case declared == "" || isTextType(declared):
+		return sniffed
+	case sniffedKind == declaredKind && sniffedKind != "application":
+		// Many application formats are ZIP or other containers underneath,
+		// so only images, audio, video and fonts are corrected.
+		return sniffed
+	}
+	return declared
+}
+
+// setContentHeaders sets the type of a file served from Discord, or uploaded
+// through the service, and the headers keeping browsers from running it on
+// the service's origin, where it could act on behalf of its visitors: HTML
+// and XML are served as plain text, browsers are told not to second-guess
+// the type, and a sandbox policy stops script in anything else they render,
+// such as SVG.
+func setContentHeaders(c *Context, contentType string) {
+	c.Header("Content-Type", inertContentType(contentType))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+}
+
+// inertContentType returns contentType, or plain text if browsers would run
+// script in it.
+func inertContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	if slices.Contains(activeTypes, mediaType) || strings.HasSuffix(mediaType, "+xml") && mediaType != "image/svg+xml" {
+		return "text/plain; charset=utf-8"
+	}
+	return contentType
+}
+
+// isTextType reports whether contentType is a textual type.
+func isTextType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		slices.Contains(textTypes, mediaType)
+}
+
+// responseSize returns the full size of the upstream file, taking it from
+// Content-Range for partial responses so ranged requests can't be used to
+// fetch an oversized file piece by piece. It returns -1 when unknown.
+func responseSize(resp *http.Response) int64 {
+	if resp.StatusCode == http.StatusPartialContent {
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				return size
+			}
+		}
+	}
+	return resp.ContentLength
+}
+
+// applyContentDisposition names the response fileName. It is marked as a
+// download when the client asked for one with ?download=1, and otherwise only
+// set when the name was overridden.
+func applyContentDisposition(c *Context, fileName string, renamed bool) {
+	dispositionType := "inline"
+	if download, _ := strconv.ParseBool(c.Query("download")); download {
+		dispositionType = "attachment"
+	} else if !renamed {
+		return
+	}
+
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": fileName})
+	if disposition == "" {
+		disposition = dispositionType
+	}
+	c.Header("Content-Disposition", disposition)
+}
+
+// chunkReader presents the chunks of a manifest as one seekable stream. Chunk
+// bodies are fetched lazily with ranged requests, so seeking never downloads
+// the bytes being skipped.
+type chunkReader struct {
+	ctx       context.Context
+	client    *DiscordClient
+	chunks    []Chunk
+	urls      []string
+	size      int64
+	offset    int64
+	body      io.ReadCloser
+	remaining int64
+}
+
+func newChunkReader(ctx context.Context, client *DiscordClient, manifest *Manifest, urls []string) *chunkReader {
+	return &chunkReader{
+		ctx:    ctx,
+		client: client,
+		chunks: manifest.Chunks,
+		urls:   urls,
+		size:   manifest.Size,
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+
+	if r.remaining == 0 {
+		r.body.Close()
+		r.body = nil
+		if err == io.EOF {
+			err = nil
+		}
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open starts a request for the chunk containing the current offset.
+func (r *chunkReader) open() error {
+	var start int64
+	for i, chunk := range r.chunks {
+		if r.offset >= start+chunk.Size {
+			start += chunk.Size
+			continue
+		}
+
+		skip := r.offset - start
+		resp, err := r.client.Download(r.ctx, r.urls[i], fmt.Sprintf("bytes=%d-", skip))
+		if err != nil {
+			return fmt.Errorf("failed to fetch chunk %d: %w", i+1, err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			if _, err := io.CopyN(io.Discard, resp.Body, skip); err != nil {
+				resp.Body.Close()
+				return fmt.Errorf("failed to skip into chunk %d: %w", i+1, err)
+			}
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("CDN error for chunk %d: %d", i+1, resp.StatusCode)
+		}
+
+		r.body = resp.Body
+		r.remaining = chunk.Size - skip
+		return nil
+	}
+	return io.EOF
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package discordcdn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n"
+	gif := "GIF89a"
+	html := "<!DOCTYPE html><script>alert(1)</script>"
+	tests := []struct {
+		name     string
+		declared string
+		head     string
+		want     string
+	}{
+		{"matching image", "image/png", png, "image/png"},
+		{"gif named png", "image/png", gif, "image/gif"},
+		{"html named png", "image/png", html, "text/plain; charset=utf-8"},
+		{"text named text", "text/plain", "hello", "text/plain"},
+		{"binary named text", "text/plain", png, "image/png"},
+		{"undeclared", "", png, "image/png"},
+		{"nothing read", "image/png", "", "image/png"},
+		{"zip container", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "PK\x03\x04", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffContentType(tt.declared, []byte(tt.head)); got != tt.want {
+				t.Errorf("sniffContentType(%q) = %q, want %q", tt.declared, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInertContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"text/html", "text/plain; charset=utf-8"},
+		{"text/html; charset=utf-8", "text/plain; charset=utf-8"},
+		{"TEXT/HTML", "text/plain; charset=utf-8"},
+		{"application/xhtml+xml", "text/plain; charset=utf-8"},
+		{"text/xml", "text/plain; charset=utf-8"},
+		{"application/xml", "text/plain; charset=utf-8"},
+		{"application/rss+xml", "text/plain; charset=utf-8"},
+		{"image/svg+xml", "image/svg+xml"},
+		{"text/plain", "text/plain"},
+		{"text/css", "text/css"},
+		{"image/png", "image/png"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := inertContentType(tt.contentType); got != tt.want {
+				t.Errorf("inertContentType(%q) = %q, want %q", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetContentHeaders(t *testing.T) {
+	router := NewEngine()
+	router.GET("/file", func(c *Context) {
+		setContentHeaders(c, sniffContentType("text/html", []byte("<html><script>alert(1)</script>")))
+		c.Status(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	for header, want := range map[string]string{
+		"Content-Type":            "text/plain; charset=utf-8",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package discordcdn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CDNs whose caches can be purged when an attachment changes.
+const (
+	purgeCloudflare = "cloudflare"
+	purgeFastly     = "fastly"
+)
+
+var purgeProviders = []string{purgeCloudflare, purgeFastly}
+
+// purgeBatch is how many keys go into one purge call: Cloudflare takes up to
+// 30 tags per request, and Fastly up to 256 surrogate keys.
+var purgeBatch = map[string]int{purgeCloudflare: 30, purgeFastly: 256}
+
+// purgeTimeout bounds each call to the CDN's API.
+const purgeTimeout = 10 * time.Second
+
+// CDNPurger purges responses tagged with surrogate keys (see surrogate.go)
+// from the CDN in front of the server. Keys are collected and purged in
+// batches every interval, so a burst of deleted attachments doesn't run into
+// the CDN's API limits.
+type CDNPurger struct {
+	mu       sync.Mutex
+	provider string
+	// zone is the Cloudflare zone ID or the Fastly service ID.
+	zone    string
+	token   string
+	http    *http.Client
+	pending map[string]bool
+}
+
+func NewCDNPurger(provider, zone, token string, interval time.Duration) *CDNPurger {
+	p := &CDNPurger{
+		provider: provider,
+		zone:     zone,
+		token:    token,
+		http:     &http.Client{Timeout: purgeTimeout},
+		pending:  map[string]bool{},
+	}
+	go func() {
+		for range time.Tick(interval) {
+			p.flush()
+		}
+	}()
+	return p
+}
+
+// Purge queues keys for the next batch. It is a no-op on a nil purger, so
+// callers needn't check whether purging is configured.
+func (p *CDNPurger) Purge(keys ...string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		p.pending[key] = true
+	}
+}
+
+// flush purges the pending keys. Keys whose purge fails are logged and
+// dropped rather than retried, as cached responses expire on their own.
+func (p *CDNPurger) flush() {
+	p.mu.Lock()
+	keys := make([]string, 0, len(p.pending))
+	for key := range p.pending {
+		keys = append(keys, key)
+	}
+	clear(p.pending)
+	p.mu.Unlock()
+
+	for batch := range slices.Chunk(keys, purgeBatch[p.provider]) {
+		status := "status:ok"
+		if err := p.send(batch); err != nil {
+			logAt(slog.LevelError, "Failed to purge %d keys from %s: %v", len(batch), p.provider, err)
+			status = "status:error"
+		}
+		metrics.Count("cdn.purges", int64(len(batch)), "provider:"+p.provider, status)
+	}
+}
+
+func (p *CDNPurger) send(keys []string) error {
+	var req *http.Request
+	var err error
+	switch p.provider {
+	case purgeCloudflare:
+		body, _ := json.Marshal(map[string][]string{"tags": keys})
+		endpoint := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/purge_cache", p.zone)
+		req, err = http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+	case purgeFastly:
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.fastly.com/service/%s/purge", p.zone), nil)
+		if err == nil {
+			req.Header.Set("Fastly-Key", p.token)
+			req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s answered %d: %s", p.provider, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func validatePurge(provider, zone, token string) error {
+	if provider == "" {
+		return nil
+	}
+	if !slices.Contains(purgeProviders, provider) {
+		return fmt.Errorf("must be one of %s", strings.Join(purgeProviders, ", "))
+	}
+	if zone == "" || token == "" {
+		return fmt.Errorf("requires %sPURGE_ZONE and %sPURGE_TOKEN", envPrefix, envPrefix)
+	}
+	return nil
+}
+
+// SetPurger sets the purger told about attachments that were deleted or
+// whose signed URL changed.
+func (c *DiscordClient) SetPurger(purger *CDNPurger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purger = purger
+}
+
+// purgeAttachment purges every cached response for a CDN attachment URL.
+func (c *DiscordClient) purgeAttachment(attachmentURL string) {
+	c.mu.RLock()
+	purger := c.purger
+	c.mu.RUnlock()
+	if _, fileID := attachmentIDs(attachmentURL); fileID != 0 {
+		purger.Purge(fileSurrogateKey(fileID))
+	}
+}
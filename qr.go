@@ -0,0 +1,71 @@
+package discordcdn
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	maxQRSize     = 2048
+)
+
+func handleQR(config *Config) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil {
+			return
+		}
+
+		size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultQRSize)))
+		if err != nil || size <= 0 || size > maxQRSize {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Size must be between 1 and %d", maxQRSize))
+			return
+		}
+
+		code, err := qrcode.New(publicURL(c, config)+"/"+data.Path(), qrcode.Medium)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to encode QR code: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to generate QR code")
+			return
+		}
+
+		switch c.DefaultQuery("format", "png") {
+		case "png":
+			png, err := code.PNG(size)
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to render QR code: %v", err)
+				respondError(c, http.StatusInternalServerError, codeInternal, "Failed to generate QR code")
+				return
+			}
+			c.Data(http.StatusOK, "image/png", png)
+		case "svg":
+			c.Data(http.StatusOK, "image/svg+xml", qrSVG(code.Bitmap(), size))
+		default:
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Format must be png or svg")
+		}
+	}
+}
+
+// qrSVG renders a QR bitmap as a single SVG path, one unit square per dark
+// module, scaled to size pixels.
+func qrSVG(bitmap [][]bool, size int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	n := len(bitmap)
+	return []byte(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, n, n, path.String()))
+}
@@ -0,0 +1,118 @@
+package discordcdn
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// keyRequests returns the requests made with an API key today and this
+// month, including counts not yet saved. Callers must hold t.mu.
+func (t *UsageTracker) keyRequests(id string, now time.Time) (today, month int64) {
+	day := now.Format(usageDayFormat)
+	monthStart := now.Format("2006-01") + "-01"
+
+	today = t.store.KeyRequests(id, day, day)
+	month = t.store.KeyRequests(id, monthStart, day)
+	for _, u := range []*UsageData{t.pending, t.flushing} {
+		if u != nil {
+			today += u.keyRequests(id, day, day)
+			month += u.keyRequests(id, monthStart, day)
+		}
+	}
+	return today, month
+}
+
+// limitKey counts requests per API key and rejects them with a 429 once the
+// key has used up its daily or monthly quota. A zero quota is unlimited. It
+// must run after requireAPIKey.
+func (t *UsageTracker) limitKey(daily, monthly int64) HandlerFunc {
+	return func(c *Context) {
+		now := time.Now().UTC()
+		if reset := t.takeQuota(c.GetString(apiKeyKey), daily, monthly, now); !reset.IsZero() {
+			c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			respondError(c, http.StatusTooManyRequests, codeQuotaExceeded, "API key quota exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// takeQuota counts a request made with the API key id, unless it has used up
+// its daily or monthly quota, in which case it returns when that quota
+// resets. It returns the zero time for requests within the quotas.
+func (t *UsageTracker) takeQuota(id string, daily, monthly int64, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	today, month := t.keyRequests(id, now)
+	switch {
+	case monthly > 0 && month >= monthly:
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	case daily > 0 && today >= daily:
+		return now.Truncate(24*time.Hour).AddDate(0, 0, 1)
+	}
+	t.pending.keyDays(id)[now.Format(usageDayFormat)]++
+	return time.Time{}
+}
+
+type KeyUsageDay struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+}
+
+type KeyUsage struct {
+	ID           string        `json:"id"`
+	Configured   bool          `json:"configured"`
+	Today        int64         `json:"today"`
+	ThisMonth    int64         `json:"thisMonth"`
+	DailyQuota   int64         `json:"dailyQuota"`
+	MonthlyQuota int64         `json:"monthlyQuota"`
+	Days         []KeyUsageDay `json:"days"`
+}
+
+// handleKeyUsage reports each API key's requests per day, along with its
+// quotas. Keys that have since been removed are listed while they still have
+// history.
+func handleKeyUsage(tracker *UsageTracker, store *Store, keys *KeySet, config *Config) HandlerFunc {
+	return func(c *Context) {
+		tracker.Flush()
+		usage := store.Usage()
+
+		configured := map[string]bool{}
+		for _, k := range keys.Keys() {
+			configured[keyID(k)] = true
+		}
+		ids := map[string]bool{}
+		for id := range configured {
+			ids[id] = true
+		}
+		for id := range usage.Keys {
+			ids[id] = true
+		}
+
+		now := time.Now().UTC()
+		day := now.Format(usageDayFormat)
+		monthStart := now.Format("2006-01") + "-01"
+		report := make([]KeyUsage, 0, len(ids))
+		for id := range ids {
+			entry := KeyUsage{
+				ID:           id,
+				Configured:   configured[id],
+				Today:        usage.keyRequests(id, day, day),
+				ThisMonth:    usage.keyRequests(id, monthStart, day),
+				DailyQuota:   config.KeyDailyQuota,
+				MonthlyQuota: config.KeyMonthlyQuota,
+				Days:         []KeyUsageDay{},
+			}
+			for d, n := range usage.Keys[id] {
+				entry.Days = append(entry.Days, KeyUsageDay{Day: d, Requests: n})
+			}
+			sort.Slice(entry.Days, func(i, j int) bool { return entry.Days[i].Day < entry.Days[j].Day })
+			report = append(report, entry)
+		}
+		sort.Slice(report, func(i, j int) bool { return report[i].ID < report[j].ID })
+
+		c.JSON(http.StatusOK, H{"keys": report})
+	}
+}
@@ -0,0 +1,185 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// rateLimitWindow is the period request limits are counted over.
+	rateLimitWindow = time.Minute
+	// redisTimeout bounds how long a request waits on Redis before it is let
+	// through unlimited.
+	redisTimeout = 250 * time.Millisecond
+)
+
+// RequestCounter counts requests in fixed windows. take records a request for
+// key in the window starting at window and lasting period, and returns how
+// many requests the key has made in that window, including this one.
+type RequestCounter interface {
+	take(ctx context.Context, key string, window time.Time, period time.Duration) (int64, error)
+}
+
+// NewRequestCounter counts requests in Redis when a URL is configured, so
+// limits hold across every replica, and in memory otherwise.
+func NewRequestCounter(config *Config) (RequestCounter, error) {
+	if config.RedisURL == "" {
+		return newLocalCounter(), nil
+	}
+	options, err := redis.ParseURL(config.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	return &redisCounter{client: redis.NewClient(options), prefix: config.RedisPrefix + "ratelimit:"}, nil
+}
+
+// localCounter keeps counts in memory, so each replica enforces its own
+// limits.
+type localCounter struct {
+	mu     sync.Mutex
+	counts map[string]*windowCount
+}
+
+type windowCount struct {
+	window time.Time
+	end    time.Time
+	count  int64
+}
+
+func newLocalCounter() *localCounter {
+	c := &localCounter{counts: map[string]*windowCount{}}
+	go c.cleanup()
+	return c
+}
+
+func (c *localCounter) take(_ context.Context, key string, window time.Time, period time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.counts[key]
+	if !ok || !entry.window.Equal(window) {
+		entry = &windowCount{window: window, end: window.Add(period)}
+		c.counts[key] = entry
+	}
+	entry.count++
+	return entry.count, nil
+}
+
+func (c *localCounter) cleanup() {
+	for range time.Tick(rateLimitWindow) {
+		now := time.Now()
+		c.mu.Lock()
+		for key, entry := range c.counts {
+			if now.After(entry.end) {
+				delete(c.counts, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// redisCounter keeps counts in Redis under one key per window, which expires
+// once the window is over.
+type redisCounter struct {
+	client *redis.Client
+	prefix string
+}
+
+func (c *redisCounter) take(ctx context.Context, key string, window time.Time, period time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	k := c.prefix + key + ":" + strconv.FormatInt(window.UnixMilli(), 10)
+	var incr *redis.IntCmd
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, k)
+		pipe.PExpireAt(ctx, k, window.Add(2*period))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// limitRequests rejects requests with a 429 once the key returned by keyFunc
+// has made limit requests in the current window, and tells clients where they
+// stand in X-RateLimit headers. A zero limit disables limiting. When the
+// counter fails, requests are let through rather than turned away.
+func limitRequests(counter RequestCounter, scope string, limit *atomic.Int64, keyFunc func(*Context) string) HandlerFunc {
+	var failing atomic.Bool
+	return func(c *Context) {
+		if allowRequest(c, counter, scope, keyFunc(c), limit.Load(), &failing, true) {
+			c.Next()
+		}
+	}
+}
+
+// allowRequest counts a request for key and reports whether it is within
+// limit, writing a 429 when it isn't. failing tracks whether the counter is
+// failing, so that is logged once rather than for every request. With
+// headers set, the limit, requests remaining and reset time are added to the
+// response.
+func allowRequest(c *Context, counter RequestCounter, scope, key string, limit int64, failing *atomic.Bool, headers bool) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	count, window, ok := countRequest(c.Request.Context(), counter, scope, key, now, failing)
+	if !ok {
+		return true
+	}
+	if headers {
+		setRateLimitHeaders(c, limit, max(limit-count, 0), window.Add(rateLimitWindow))
+	}
+	if count > limit {
+		metrics.Count("ratelimit.rejected", 1, "scope:"+scope)
+		c.Header("Retry-After", strconv.Itoa(int(window.Add(rateLimitWindow).Sub(now).Seconds())+1))
+		respondError(c, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+		return false
+	}
+	return true
+}
+
+// countRequest counts a request for key in the window now falls in, returning
+// the requests made in it so far. ok is false when the counter failed, in
+// which case the request should be let through.
+func countRequest(ctx context.Context, counter RequestCounter, scope, key string, now time.Time, failing *atomic.Bool) (count int64, window time.Time, ok bool) {
+	window = now.Truncate(rateLimitWindow)
+	count, err := counter.take(ctx, scope+":"+key, window, rateLimitWindow)
+	if err != nil {
+		metrics.Count("ratelimit.errors", 1, "scope:"+scope)
+		if !failing.Swap(true) {
+			logAt(slog.LevelWarn, "Rate limiting by %s is failing open: %v", scope, err)
+		}
+		return 0, window, false
+	}
+	if failing.Swap(false) {
+		log.Printf("Rate limiting by %s recovered", scope)
+	}
+	return count, window, true
+}
+
+// setRateLimitHeaders reports a limit, the requests left under it and when
+// it resets, as Unix seconds. A request counted by several limits reports the
+// one with the fewest requests left, since that is the one it runs into
+// first.
+func setRateLimitHeaders(c *Context, limit, remaining int64, reset time.Time) {
+	h := c.Writer.Header()
+	if current, err := strconv.ParseInt(h.Get("X-RateLimit-Remaining"), 10, 64); err == nil && current <= remaining {
+		return
+	}
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
@@ -0,0 +1,62 @@
+package discordcdn
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// recoverPanics turns a panic in a later handler into the usual error
+// envelope with a 500, so the client gets a request ID to report. The panic
+// is logged with its stack and the request it happened on, and counted in
+// metrics. Panics from clients that went away just end the request, and
+// http.ErrAbortHandler cuts the connection once the middleware before this
+// one, such as request logging, is done with the request.
+func recoverPanics() HandlerFunc {
+	return func(c *Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler || isBrokenPipe(err) {
+				c.severed = err == http.ErrAbortHandler
+				c.Abort()
+				return
+			}
+
+			route := c.FullPath()
+			if route == "" {
+				route = "refresh"
+			}
+			logf(c, slog.LevelError, "Panic recovered on %s %s (route %s, client %s): %v\n%s", c.Request.Method, c.Request.URL.Path, route, c.ClientIP(), err, debug.Stack())
+			metrics.Count("http.panics", 1, "route:"+route)
+			if c.Writer.Written() {
+				// The response is under way, so the best left to do is to
+				// stop it.
+				c.Abort()
+				return
+			}
+			respondError(c, http.StatusInternalServerError, codeInternal, "Internal server error")
+		}()
+		c.Next()
+	}
+}
+
+// isBrokenPipe reports whether a panic was caused by writing to a closed
+// connection.
+func isBrokenPipe(err interface{}) bool {
+	e, ok := err.(error)
+	if !ok {
+		return false
+	}
+	var opErr *net.OpError
+	if !errors.As(e, &opErr) {
+		return false
+	}
+	msg := strings.ToLower(opErr.Error())
+	return strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer")
+}
@@ -0,0 +1,163 @@
+package discordcdn
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/time/rate"
+)
+
+// startupEnv records which variables were set in the process environment
+// before .env was loaded, so a reload can tell them apart from values that
+// came from the file.
+var startupEnv = environKeys()
+
+func environKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		keys[k] = true
+	}
+	return keys
+}
+
+// reloadMu serializes reloads, which rewrite the process environment, across
+// the reloaders of every tenant.
+var reloadMu sync.Mutex
+
+// Reloader applies the settings that can change without a restart: the
+// Discord tokens, interactive reserve, Discord rate limit, API keys, access
+// rules, basic auth users, transfer limits, request limits, channel limits and
+// channel allowlist. Everything else is read once
+// at startup.
+type Reloader struct {
+	// tenant is the tenant whose settings are applied, or empty for the
+	// deployment's own.
+	tenant         string
+	client         *DiscordClient
+	keys           *KeySet
+	acl            *ACL
+	basicAuth      *BasicAuth
+	streams        *StreamLimiter
+	perConnection  *atomic.Int64
+	perIP          *IPLimiters
+	requestsPerIP  *atomic.Int64
+	requestsPerKey *atomic.Int64
+	channels       *ChannelLimiter
+	// counter and usage count requests against the per-key rate limit and
+	// quotas, which the gRPC server enforces too.
+	counter RequestCounter
+	usage   *UsageTracker
+	// config is the configuration as last loaded or reloaded.
+	config atomic.Pointer[Config]
+}
+
+// Config returns the configuration as last loaded or reloaded.
+func (r *Reloader) Config() *Config {
+	return r.config.Load()
+}
+
+// Reload re-reads .env and the environment and applies the reloadable
+// settings. The running configuration is left untouched if the new one is
+// invalid.
+func (r *Reloader) Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := reloadEnvFile(); err != nil {
+		return err
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if r.tenant != "" {
+		if config, err = config.tenantConfig(r.tenant); err != nil {
+			return err
+		}
+	}
+
+	if r.tenant == "" {
+		setLogging(config.LogLevel, config.LogFormat)
+	}
+	r.client.SetToken(config.Token)
+	r.client.SetTokenMap(config.TokenMap)
+	r.client.SetShards(config.ShardTokens, config.ShardBy)
+	r.client.SetChannelAllowlist(config.AllowedChannels, config.AllowedGuilds)
+	if monitor := r.client.Monitor(); monitor != nil {
+		monitor.SetTokens(configuredTokens(config))
+	}
+	r.client.SetInteractiveReserve(config.InteractiveReserve)
+	r.client.SetGlobalLimit(config.DiscordRateLimit)
+	r.client.SetMaxQueueWait(config.MaxQueueWait)
+	r.client.SetHeaders(config.UserAgent, config.ExtraHeaders)
+	r.keys.Set(config.APIKeys)
+	r.acl.Set(config.ACL)
+	r.basicAuth.Set(config.HtpasswdUsers)
+	r.streams.SetLimits(config.MaxStreams, config.MaxStreamsPerIP)
+	r.perConnection.Store(config.BandwidthPerConnection)
+	r.perIP.SetLimit(rate.Limit(config.BandwidthPerIP), bandwidthBurst(config.BandwidthPerIP))
+	r.requestsPerIP.Store(config.RequestsPerIP)
+	r.requestsPerKey.Store(config.RequestsPerKey)
+	r.channels.SetLimits(config.RequestsPerChannel, config.BandwidthPerChannel, config.ChannelLimits)
+	r.config.Store(config)
+	return nil
+}
+
+// reloadEnvFile applies the current contents of .env, without overriding
+// variables that were set in the real environment at startup.
+func reloadEnvFile() error {
+	values, err := godotenv.Read()
+	if os.IsNotExist(err) {
+		values = map[string]string{}
+	} else if err != nil {
+		return fmt.Errorf("failed to read .env: %w", err)
+	}
+
+	for k := range environKeys() {
+		if _, ok := values[k]; !ok && !startupEnv[k] {
+			os.Unsetenv(k)
+		}
+	}
+	for k, v := range values {
+		if !startupEnv[k] {
+			os.Setenv(k, v)
+		}
+	}
+	return nil
+}
+
+// watchSignals reloads the configuration whenever the process receives
+// SIGHUP.
+func (r *Reloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := r.Reload(); err != nil {
+			logAt(slog.LevelError, "Failed to reload config: %v", err)
+			continue
+		}
+		log.Printf("Config reloaded")
+	}
+}
+
+func handleReload(reloader *Reloader) HandlerFunc {
+	return func(c *Context) {
+		if err := reloader.Reload(); err != nil {
+			logf(c, slog.LevelError, "Failed to reload config: %v", err)
+			respondError(c, http.StatusBadRequest, codeInvalidConfig, "Failed to reload config: "+err.Error())
+			return
+		}
+		logf(c, slog.LevelInfo, "Config reloaded")
+		c.Status(http.StatusNoContent)
+	}
+}
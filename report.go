@@ -0,0 +1,205 @@
+package discordcdn
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// Reasons an attachment can be reported for.
+var reportReasons = []string{"copyright", "illegal", "abuse", "malware", "spam", "other"}
+
+// Statuses of a report: open until an admin takes the attachment down or
+// dismisses it.
+const (
+	reportOpen      = "open"
+	reportTakenDown = "taken_down"
+	reportDismissed = "dismissed"
+)
+
+const (
+	reportIDLength   = 12
+	maxReportDetails = 2000
+	maxReportContact = 200
+)
+
+// ReportRequest is the body of POST /report.
+type ReportRequest struct {
+	// URL is the reported attachment, in any form links are accepted in.
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+	// Details and Contact are optional free text from the reporter.
+	Details string `json:"details,omitempty"`
+	Contact string `json:"contact,omitempty"`
+}
+
+// Report is an abuse report on an attachment, kept for admins to review.
+type Report struct {
+	ID      string `json:"id"`
+	FileID  int64  `json:"fileID"`
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+	Contact string `json:"contact,omitempty"`
+	// IP is the client IP the report came from, to spot reporters abusing
+	// the queue.
+	IP         string     `json:"ip"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// handleReport files an abuse report on an attachment. Anyone may report,
+// so reports are only queued for review and never act on their own, and
+// the queue is capped at maxOpen reports.
+func handleReport(store *Store, maxOpen int) HandlerFunc {
+	return func(c *Context) {
+		var req ReportRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || req.URL == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+			return
+		}
+		parsedLink := parseLink(req.URL)
+		if parsedLink.Error != "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+			return
+		}
+		if !slices.Contains(reportReasons, req.Reason) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Reason must be one of copyright, illegal, abuse, malware, spam or other")
+			return
+		}
+		if utf8.RuneCountInString(req.Details) > maxReportDetails || utf8.RuneCountInString(req.Contact) > maxReportContact {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Details or contact too long")
+			return
+		}
+
+		id, err := newID(reportIDLength)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to generate report ID: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save report")
+			return
+		}
+		report := &Report{
+			ID:        id,
+			FileID:    parsedLink.Data.FileID,
+			Path:      parsedLink.Data.Path(),
+			Reason:    req.Reason,
+			Details:   req.Details,
+			Contact:   req.Contact,
+			IP:        c.ClientIP(),
+			Status:    reportOpen,
+			CreatedAt: time.Now().UTC(),
+		}
+		err = store.AddReport(report, maxOpen)
+		if errors.Is(err, errReportQueueFull) {
+			logf(c, slog.LevelWarn, "Report queue full, refused report on %s", report.Path)
+			respondError(c, http.StatusServiceUnavailable, codeOverloaded, "Too many reports await review, try again later")
+			return
+		}
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to save report: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save report")
+			return
+		}
+		logf(c, slog.LevelInfo, "Report %s on %s: %s", report.ID, report.Path, report.Reason)
+		metrics.Count("reports.received", 1, "reason:"+report.Reason)
+		c.JSON(http.StatusCreated, H{"id": report.ID})
+	}
+}
+
+// handleReports lists the open reports, oldest first, or every report with
+// all=true.
+func handleReports(store *Store) HandlerFunc {
+	return func(c *Context) {
+		all := c.Query("all") == "true"
+		reports := store.Reports(func(r *Report) bool {
+			return all || r.Status == reportOpen
+		})
+		c.JSON(http.StatusOK, H{"reports": reports})
+	}
+}
+
+// ReportTakedown is the optional body of POST /admin/reports/:id/takedown.
+type ReportTakedown struct {
+	// Status is 451, the default, or 410.
+	Status int `json:"status,omitempty"`
+}
+
+// handleApproveReport takes down the attachment a report is about and
+// resolves every open report on it.
+func handleApproveReport(client *DiscordClient, takedowns *Takedowns) HandlerFunc {
+	return func(c *Context) {
+		report, ok := takedowns.store.Report(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, codeNotFound, "Report not found")
+			return
+		}
+		var req ReportTakedown
+		if c.Request.ContentLength != 0 {
+			err := c.ShouldBindJSON(&req)
+			if bodyTooLarge(c, err) {
+				return
+			}
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid request body")
+				return
+			}
+		}
+		if req.Status == 0 {
+			req.Status = http.StatusUnavailableForLegalReasons
+		}
+		if req.Status != http.StatusUnavailableForLegalReasons && req.Status != http.StatusGone {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "status must be 451 or 410")
+			return
+		}
+
+		takedown := &Takedown{
+			FileID:    report.FileID,
+			Status:    req.Status,
+			Reason:    fmt.Sprintf("Reported as %s in %s", report.Reason, report.ID),
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := takedowns.store.AddTakedown(takedown); err != nil {
+			logf(c, slog.LevelError, "Failed to save takedown: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save takedown")
+			return
+		}
+		takedowns.purge(client, takedown)
+		resolved, err := takedowns.store.ResolveReports(report.FileID, reportTakenDown)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to resolve reports: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to resolve reports")
+			return
+		}
+		logf(c, slog.LevelWarn, "Took down %s on report %s, resolving %d reports", report.Path, report.ID, resolved)
+		metrics.Count("reports.resolved", int64(resolved), "status:"+reportTakenDown)
+		c.JSON(http.StatusOK, H{"takedown": takedown, "resolved": resolved})
+	}
+}
+
+// handleDismissReport closes a report without acting on it.
+func handleDismissReport(store *Store) HandlerFunc {
+	return func(c *Context) {
+		found, err := store.DismissReport(c.Param("id"))
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to dismiss report: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to dismiss report")
+			return
+		}
+		if !found {
+			respondError(c, http.StatusNotFound, codeNotFound, "Report not found")
+			return
+		}
+		logf(c, slog.LevelInfo, "Dismissed report %s", c.Param("id"))
+		metrics.Count("reports.resolved", 1, "status:"+reportDismissed)
+		c.Status(http.StatusNoContent)
+	}
+}
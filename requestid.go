@@ -0,0 +1,98 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+
+	maxRequestIDLength = 128
+)
+
+// assignRequestID tags every request with an identifier, reusing a
+// well-formed X-Request-ID from the client or a proxy in front of us, and
+// echoes it on the response so reports can be matched against logs.
+func assignRequestID() HandlerFunc {
+	return func(c *Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			id, err = newID(16)
+			if err != nil {
+				logAt(slog.LevelError, "Failed to generate request ID: %v", err)
+			}
+		}
+
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logf logs a message at level, tagged with the request's ID.
+func logf(c *Context, level slog.Level, format string, args ...interface{}) {
+	slog.Default().Log(c.Request.Context(), level, fmt.Sprintf(format, args...), requestIDKey, c.GetString(requestIDKey))
+}
+
+// requestLogWriter receives a line for every request served.
+var requestLogWriter io.Writer = os.Stdout
+
+// logRequests writes a line for every request to requestLogWriter, with its
+// status, latency, client, route and request ID.
+func logRequests() HandlerFunc {
+	return func(c *Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		if raw := c.Request.URL.RawQuery; raw != "" {
+			path += "?" + raw
+		}
+		c.Next()
+
+		now := time.Now()
+		latency := now.Sub(start)
+		if logJSON.Load() {
+			line, _ := json.Marshal(requestLogEntry{
+				Time:      now,
+				Status:    c.Writer.Status(),
+				LatencyMS: milliseconds(latency),
+				ClientIP:  c.ClientIP(),
+				Method:    c.Request.Method,
+				Path:      path,
+				RequestID: c.GetString(requestIDKey),
+			})
+			requestLogWriter.Write(append(line, '\n'))
+			return
+		}
+		if latency > time.Minute {
+			latency = latency.Truncate(time.Second)
+		}
+		fmt.Fprintf(requestLogWriter, "[HTTP] %v | %3d | %13v | %15s | %-7s %#v | %s\n",
+			now.Format("2006/01/02 - 15:04:05"),
+			c.Writer.Status(),
+			latency,
+			c.ClientIP(),
+			c.Request.Method,
+			path,
+			c.GetString(requestIDKey),
+		)
+	}
+}
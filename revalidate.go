@@ -0,0 +1,81 @@
+package discordcdn
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// revalidateTimeout bounds a background refresh, which no request waits on.
+const revalidateTimeout = 30 * time.Second
+
+// SetStaleWhileRevalidate sets how long after Discord refreshed an
+// attachment's URL it is served again without waiting for Discord, while a
+// refresh in the background replaces it. 0 waits for every refresh.
+func (c *DiscordClient) SetStaleWhileRevalidate(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revalidateWindow = window
+}
+
+// revalidate returns the URL Discord last returned for an attachment if it
+// did so within the stale-while-revalidate window and the signature is
+// still valid, and starts refreshing it in the background unless a refresh
+// is already under way. Serving it risks a link Discord has since revoked,
+// but never one older than the window.
+func (c *DiscordClient) revalidate(requester, attachmentURL string) (string, bool) {
+	c.mu.RLock()
+	window, stale := c.revalidateWindow, c.stale
+	c.mu.RUnlock()
+	// Refreshes skip attachments outside the allowlist, so those must never
+	// be served from the cache either.
+	if window <= 0 || !c.allowsChannel(attachmentChannel(attachmentURL)) {
+		return "", false
+	}
+	entry, ok := c.lookupURL(stale, attachmentURL)
+	if !ok || time.Since(entry.stored) > window {
+		return "", false
+	}
+	if expiry, ok := urlExpiry(entry.url); !ok || !time.Now().Before(expiry) {
+		return "", false
+	}
+
+	c.mu.Lock()
+	if c.revalidating == nil {
+		c.revalidating = map[string]bool{}
+	}
+	pending := c.revalidating[attachmentURL]
+	c.revalidating[attachmentURL] = true
+	c.mu.Unlock()
+	if !pending {
+		go c.refreshInBackground(requester, attachmentURL, stale)
+	}
+	metrics.Count("cache.stale_serves", 1, "cache:"+cacheURLs)
+	return entry.url, true
+}
+
+// refreshInBackground refreshes an attachment URL served stale, which
+// updates the URL cache. An attachment that turns out to be gone or
+// inaccessible is dropped from it, so it isn't served again.
+func (c *DiscordClient) refreshInBackground(requester, attachmentURL string, stale *urlCache) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.revalidating, attachmentURL)
+		c.mu.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+	defer cancel()
+	refreshed, err := c.RefreshAttachmentURLs(ctx, PriorityBackground, requester, []string{attachmentURL})
+	if err == nil && refreshed[attachmentURL] == "" {
+		err = errAttachmentNotFound
+	}
+	if err == nil {
+		return
+	}
+	logAt(slog.LevelDebug, "Background refresh of %s failed: %v", attachmentURL, err)
+	if status := classifyRefreshError(err).status; status == http.StatusNotFound || status == http.StatusForbidden {
+		stale.Delete(attachmentURL)
+		c.unshareURL(attachmentURL)
+	}
+}
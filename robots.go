@@ -0,0 +1,37 @@
+package discordcdn
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// defaultRobotsTxt keeps well-behaved crawlers away from every route, as
+// attachment links are neither worth indexing nor cheap to crawl.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// crawlerAgents matches the User-Agents of search engine, SEO and AI
+// crawlers. Link preview bots such as Discordbot, Twitterbot and
+// facebookexternalhit are left out, as embeds rely on them.
+var crawlerAgents = regexp.MustCompile(`(?i)googlebot|bingbot|slurp|duckduckbot|baiduspider|yandex(bot|images)|sogou|exabot|ia_archiver|` +
+	`ahrefsbot|semrushbot|mj12bot|dotbot|petalbot|bytespider|gptbot|ccbot|claudebot|anthropic-ai|amazonbot|perplexitybot|applebot|` +
+	`seznambot|blexbot|dataforseobot`)
+
+func handleRobots(robotsTxt string) HandlerFunc {
+	return func(c *Context) {
+		c.String(http.StatusOK, robotsTxt)
+	}
+}
+
+// crawlerControls marks media responses as not to be indexed and, with block
+// set, turns known crawlers away before they cost a refresh.
+func crawlerControls(block bool) HandlerFunc {
+	return func(c *Context) {
+		c.Header("X-Robots-Tag", "noindex, nofollow")
+		if block && crawlerAgents.MatchString(c.Request.UserAgent()) {
+			metrics.Count("crawlers.rejected", 1)
+			respondError(c, http.StatusForbidden, codeCrawlerBlocked, "Crawlers are not allowed")
+			return
+		}
+		c.Next()
+	}
+}
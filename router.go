@@ -0,0 +1,715 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The HTTP layer is a small router over net/http. Routes use the familiar
+// /users/:id and /files/*path patterns, and every request runs a chain of
+// handlers sharing one Context, taken from a pool so a request allocates as
+// little as possible.
+
+// H is a shortcut for JSON objects.
+type H map[string]interface{}
+
+// HandlerFunc is one link in a request's handler chain.
+type HandlerFunc func(*Context)
+
+// maxMultipartMemory is how much of a multipart form is kept in memory
+// before spilling to temporary files.
+const maxMultipartMemory = 32 << 20
+
+// abortIndex is past the end of any handler chain.
+const abortIndex = 1 << 30
+
+// Param is a path parameter. The value of a catch-all parameter keeps its
+// leading slash.
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Context carries a request through its handler chain.
+type Context struct {
+	Request *http.Request
+	Writer  ResponseWriter
+
+	writer   responseWriter
+	params   []Param
+	query    url.Values
+	queried  bool
+	fullPath string
+	handlers []HandlerFunc
+	index    int
+	sameSite http.SameSite
+	// trusted are the proxies whose forwarding headers are believed.
+	trusted []*net.IPNet
+	// severed is set when the response must be cut off rather than ended,
+	// so the client can tell it is incomplete.
+	severed bool
+
+	mu   sync.RWMutex
+	keys map[string]interface{}
+}
+
+func (c *Context) reset(w http.ResponseWriter, req *http.Request, trusted []*net.IPNet) {
+	c.writer.reset(w)
+	c.Writer = &c.writer
+	c.Request = req
+	c.params = c.params[:0]
+	c.query = nil
+	c.queried = false
+	c.fullPath = ""
+	c.handlers = nil
+	c.index = -1
+	c.sameSite = http.SameSiteDefaultMode
+	c.trusted = trusted
+	c.severed = false
+	// The map is kept for the next request, so most requests don't
+	// allocate one.
+	clear(c.keys)
+}
+
+// Next runs the rest of the chain, for middleware that acts after the
+// handlers that follow it.
+func (c *Context) Next() {
+	for c.index++; c.index < len(c.handlers); c.index++ {
+		c.handlers[c.index](c)
+	}
+}
+
+// Abort stops the handlers after the current one from running.
+func (c *Context) Abort() {
+	c.index = abortIndex
+}
+
+func (c *Context) IsAborted() bool {
+	return c.index >= abortIndex
+}
+
+func (c *Context) AbortWithStatus(code int) {
+	c.Status(code)
+	c.Writer.WriteHeaderNow()
+	c.Abort()
+}
+
+func (c *Context) AbortWithStatusJSON(code int, obj interface{}) {
+	c.Abort()
+	c.JSON(code, obj)
+}
+
+// Set stores a value for the rest of the request.
+func (c *Context) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		c.keys = map[string]interface{}{}
+	}
+	c.keys[key] = value
+}
+
+func (c *Context) Get(key string) (value interface{}, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, ok = c.keys[key]
+	return value, ok
+}
+
+func (c *Context) GetString(key string) string {
+	value, _ := c.Get(key)
+	s, _ := value.(string)
+	return s
+}
+
+// Param returns the value of a path parameter, or "" if the route has none
+// by that name.
+func (c *Context) Param(key string) string {
+	for _, p := range c.params {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// FullPath returns the pattern of the matched route, or "" when no route
+// matched.
+func (c *Context) FullPath() string {
+	return c.fullPath
+}
+
+func (c *Context) Query(key string) string {
+	return c.DefaultQuery(key, "")
+}
+
+func (c *Context) DefaultQuery(key, defaultValue string) string {
+	if values, ok := c.QueryValues()[key]; ok && len(values) > 0 {
+		return values[0]
+	}
+	return defaultValue
+}
+
+// QueryValues returns the parsed query string, which is nil when there is
+// none. It is parsed once per request and must not be modified.
+func (c *Context) QueryValues() url.Values {
+	if !c.queried {
+		c.queried = true
+		if c.Request.URL.RawQuery != "" {
+			c.query = c.Request.URL.Query()
+		}
+	}
+	return c.query
+}
+
+func (c *Context) GetHeader(key string) string {
+	return c.Request.Header.Get(key)
+}
+
+// Header sets a response header, or deletes it when value is empty.
+func (c *Context) Header(key, value string) {
+	if value == "" {
+		c.Writer.Header().Del(key)
+		return
+	}
+	c.Writer.Header().Set(key, value)
+}
+
+// ClientIP returns the client's address. Requests from a trusted proxy are
+// taken to be from the address it forwarded them for, in X-Forwarded-For or
+// X-Real-IP; anyone else could set those headers to whatever they like, so
+// they are ignored.
+func (c *Context) ClientIP() string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	if !trustedIP(c.trusted, net.ParseIP(host)) {
+		return host
+	}
+	if ip := forwardedIP(c.Request.Header.Get("X-Forwarded-For"), c.trusted); ip != "" {
+		return ip
+	}
+	if ip := forwardedIP(c.Request.Header.Get("X-Real-IP"), c.trusted); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// forwardedIP returns the client address in a forwarding header: the last
+// one not added by a trusted proxy, since those before it could have been
+// made up by the client. It returns an empty string when an address it
+// reaches is invalid.
+func forwardedIP(header string, trusted []*net.IPNet) string {
+	if header == "" {
+		return ""
+	}
+	items := strings.Split(header, ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		item := strings.TrimSpace(items[i])
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !trustedIP(trusted, ip) {
+			return item
+		}
+	}
+	return ""
+}
+
+func trustedIP(trusted []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Context) Cookie(name string) (string, error) {
+	cookie, err := c.Request.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return url.QueryUnescape(cookie.Value)
+}
+
+// SetSameSite sets the SameSite attribute of cookies set afterwards.
+func (c *Context) SetSameSite(sameSite http.SameSite) {
+	c.sameSite = sameSite
+}
+
+func (c *Context) SetCookie(name, value string, maxAge int, path, domain string, secure, httpOnly bool) {
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   maxAge,
+		Path:     path,
+		Domain:   domain,
+		SameSite: c.sameSite,
+		Secure:   secure,
+		HttpOnly: httpOnly,
+	})
+}
+
+// ShouldBindJSON decodes the request body into obj.
+func (c *Context) ShouldBindJSON(obj interface{}) error {
+	if c.Request.Body == nil {
+		return errors.New("missing request body")
+	}
+	return json.NewDecoder(c.Request.Body).Decode(obj)
+}
+
+func (c *Context) FormFile(name string) (*multipart.FileHeader, error) {
+	if c.Request.MultipartForm == nil {
+		if err := c.Request.ParseMultipartForm(maxMultipartMemory); err != nil {
+			return nil, err
+		}
+	}
+	file, header, err := c.Request.FormFile(name)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return header, nil
+}
+
+// Status sets the response status, which is sent with the first write or
+// once the handlers are done.
+func (c *Context) Status(code int) {
+	c.Writer.WriteHeader(code)
+}
+
+func (c *Context) JSON(code int, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	c.Data(code, "application/json; charset=utf-8", body)
+}
+
+func (c *Context) Data(code int, contentType string, data []byte) {
+	c.Status(code)
+	c.Writer.Header().Set("Content-Type", contentType)
+	if !bodyAllowedForStatus(code) {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(data)
+}
+
+func (c *Context) String(code int, format string, values ...interface{}) {
+	if len(values) > 0 {
+		format = fmt.Sprintf(format, values...)
+	}
+	c.Data(code, "text/plain; charset=utf-8", []byte(format))
+}
+
+func (c *Context) Redirect(code int, location string) {
+	if (code < http.StatusMultipleChoices || code > http.StatusPermanentRedirect) && code != http.StatusCreated {
+		panic(fmt.Sprintf("cannot redirect with status code %d", code))
+	}
+	http.Redirect(c.Writer, c.Request, location, code)
+}
+
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// ResponseWriter is the http.ResponseWriter handlers write to. It holds the
+// status back until the body is written, so middleware can still change it,
+// and records what was sent.
+type ResponseWriter interface {
+	http.ResponseWriter
+	http.Flusher
+	// Status returns the response status, 200 unless set otherwise.
+	Status() int
+	// Size returns how many body bytes were written, or -1 if the header
+	// hasn't been sent yet.
+	Size() int
+	Written() bool
+	// WriteHeaderNow sends the status and headers if they haven't been.
+	WriteHeaderNow()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *responseWriter) reset(rw http.ResponseWriter) {
+	w.ResponseWriter = rw
+	w.status = http.StatusOK
+	w.size = -1
+}
+
+// WriteHeader records the status to send. Informational responses such as
+// Early Hints go out straight away, since they don't end the response.
+func (w *responseWriter) WriteHeader(code int) {
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		if !w.Written() {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	if code > 0 && !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *responseWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *responseWriter) WriteString(s string) (int, error) {
+	w.WriteHeaderNow()
+	n, err := io.WriteString(w.ResponseWriter, s)
+	w.size += n
+	return n, err
+}
+
+func (w *responseWriter) Status() int   { return w.status }
+func (w *responseWriter) Size() int     { return w.size }
+func (w *responseWriter) Written() bool { return w.size != -1 }
+
+func (w *responseWriter) Flush() {
+	w.WriteHeaderNow()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RouterGroup registers routes under a common prefix and middleware.
+type RouterGroup struct {
+	prefix   string
+	handlers []HandlerFunc
+	engine   *Engine
+}
+
+// Use adds middleware to routes registered on the group afterwards.
+func (g *RouterGroup) Use(middleware ...HandlerFunc) {
+	g.handlers = append(g.handlers, middleware...)
+}
+
+// Group returns a group for routes under relativePath, running the given
+// middleware after the group's own.
+func (g *RouterGroup) Group(relativePath string, handlers ...HandlerFunc) *RouterGroup {
+	return &RouterGroup{
+		prefix:   joinPaths(g.prefix, relativePath),
+		handlers: g.combine(handlers),
+		engine:   g.engine,
+	}
+}
+
+func (g *RouterGroup) GET(relativePath string, handlers ...HandlerFunc) {
+	g.Handle(http.MethodGet, relativePath, handlers...)
+}
+
+func (g *RouterGroup) POST(relativePath string, handlers ...HandlerFunc) {
+	g.Handle(http.MethodPost, relativePath, handlers...)
+}
+
+func (g *RouterGroup) DELETE(relativePath string, handlers ...HandlerFunc) {
+	g.Handle(http.MethodDelete, relativePath, handlers...)
+}
+
+func (g *RouterGroup) Handle(method, relativePath string, handlers ...HandlerFunc) {
+	pattern := joinPaths(g.prefix, relativePath)
+	table := g.engine.routes[method]
+	if table == nil {
+		table = &routeTable{static: map[string][]*route{}}
+		g.engine.routes[method] = table
+	}
+	table.add(newRoute(pattern, g.combine(handlers)))
+}
+
+func (g *RouterGroup) combine(handlers []HandlerFunc) []HandlerFunc {
+	return append(append(make([]HandlerFunc, 0, len(g.handlers)+len(handlers)), g.handlers...), handlers...)
+}
+
+// joinPaths joins a group prefix and a route path, keeping a trailing slash
+// on the route.
+func joinPaths(prefix, relativePath string) string {
+	if relativePath == "" {
+		return prefix
+	}
+	joined := path.Join(prefix, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// Engine is an http.Handler dispatching requests to their route's handlers.
+type Engine struct {
+	RouterGroup
+	routes  map[string]*routeTable
+	noRoute []HandlerFunc
+	pool    sync.Pool
+	trusted []*net.IPNet
+}
+
+func NewEngine() *Engine {
+	e := &Engine{routes: map[string]*routeTable{}}
+	e.engine = e
+	e.prefix = "/"
+	e.pool.New = func() interface{} { return &Context{} }
+	return e
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For and X-Real-IP
+// headers ClientIP believes. It must be called before serving.
+func (e *Engine) SetTrustedProxies(networks []*net.IPNet) {
+	e.trusted = networks
+}
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	Method string
+	Path   string
+}
+
+// Routes returns the engine's routes, sorted by path and then method.
+func (e *Engine) Routes() []RouteInfo {
+	var routes []RouteInfo
+	for method, table := range e.routes {
+		for _, rs := range table.static {
+			for _, r := range rs {
+				routes = append(routes, RouteInfo{Method: method, Path: r.pattern})
+			}
+		}
+		for _, r := range table.dynamic {
+			routes = append(routes, RouteInfo{Method: method, Path: r.pattern})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// NoRoute sets the handlers of requests no route matches under any method,
+// run after the engine's middleware. Without any, such requests get a plain 404.
+func (e *Engine) NoRoute(handlers ...HandlerFunc) {
+	e.noRoute = handlers
+}
+
+func (e *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := e.pool.Get().(*Context)
+	c.reset(w, req, e.trusted)
+	e.handle(c)
+	severed := c.severed
+	e.pool.Put(c)
+	if severed {
+		// The server closes the connection without ending the response.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (e *Engine) handle(c *Context) {
+	method, p := c.Request.Method, c.Request.URL.Path
+	if r := e.match(c, method, p); r != nil {
+		c.handlers = r.handlers
+		c.fullPath = r.pattern
+		c.Next()
+		c.Writer.WriteHeaderNow()
+		return
+	}
+
+	// Like most routers, a path that only differs from a route by its
+	// trailing slash is redirected to the route. Adding the slash has the
+	// same first segment, so paths no route shares it with, such as
+	// attachment links, are let through without trying.
+	if p != "/" && method != http.MethodConnect && e.routes[method].indexes(p) {
+		alt := p + "/"
+		if strings.HasSuffix(p, "/") {
+			alt = p[:len(p)-1]
+		}
+		if e.match(c, method, alt) != nil {
+			code := http.StatusMovedPermanently
+			if method != http.MethodGet {
+				code = http.StatusTemporaryRedirect
+			}
+			target := url.URL{Path: pathPrefix(c.Request) + alt, RawQuery: c.Request.URL.RawQuery}
+			http.Redirect(c.Writer, c.Request, target.String(), code)
+			c.Writer.WriteHeaderNow()
+			return
+		}
+		c.params = c.params[:0]
+	}
+
+	// A path with routes for other methods only is answered 405 rather than
+	// handed to NoRoute.
+	if allow := e.allowed(c, method, p); allow != "" {
+		c.Header("Allow", allow)
+		e.serveError(c, http.StatusMethodNotAllowed, "405 method not allowed", nil)
+		return
+	}
+	e.serveError(c, http.StatusNotFound, "404 page not found", e.noRoute)
+}
+
+// serveError runs the engine's middleware and then handlers for a request no
+// route takes, answering code with message if nothing else responds.
+func (e *Engine) serveError(c *Context, code int, message string, handlers []HandlerFunc) {
+	c.handlers = e.combine(handlers)
+	c.Writer.WriteHeader(code)
+	c.Next()
+	if !c.Writer.Written() && c.Writer.Status() == code {
+		c.String(code, message)
+	}
+	c.Writer.WriteHeaderNow()
+}
+
+// allowed returns the methods other than method with a route matching p, as
+// an Allow header, or "" when there are none.
+func (e *Engine) allowed(c *Context, method, p string) string {
+	var methods []string
+	for m, table := range e.routes {
+		if m != method && table.indexes(p) && e.match(c, m, p) != nil {
+			methods = append(methods, m)
+		}
+	}
+	c.params = c.params[:0]
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// match finds the route for a request, setting its path parameters. A route
+// with more literal segments wins over one matching by parameters.
+func (e *Engine) match(c *Context, method, p string) *route {
+	static, dynamic := e.routes[method].candidates(p)
+	var best *route
+	for _, rs := range [...][]*route{static, dynamic} {
+		for _, r := range rs {
+			if _, ok := r.match(p, c.params[:0]); ok && (best == nil || r.literals > best.literals) {
+				best = r
+			}
+		}
+	}
+	c.params = c.params[:0]
+	if best != nil {
+		c.params, _ = best.match(p, c.params)
+	}
+	return best
+}
+
+// routeTable holds the routes of a method, indexed by their first segment
+// so that a request only tries the routes it could match.
+type routeTable struct {
+	static map[string][]*route
+	// dynamic are the routes whose first segment is a parameter.
+	dynamic []*route
+}
+
+func (t *routeTable) add(r *route) {
+	if seg := r.segments[0]; strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+		t.dynamic = append(t.dynamic, r)
+	} else {
+		t.static[seg] = append(t.static[seg], r)
+	}
+}
+
+// candidates returns the routes that could match p: those with p's first
+// segment, and those starting with a parameter.
+func (t *routeTable) candidates(p string) (static, dynamic []*route) {
+	if t == nil {
+		return nil, nil
+	}
+	seg := strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(seg, '/'); i >= 0 {
+		seg = seg[:i]
+	}
+	return t.static[seg], t.dynamic
+}
+
+// indexes reports whether any route could match p.
+func (t *routeTable) indexes(p string) bool {
+	static, dynamic := t.candidates(p)
+	return len(static) > 0 || len(dynamic) > 0
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	literals int
+	handlers []HandlerFunc
+}
+
+func newRoute(pattern string, handlers []HandlerFunc) *route {
+	r := &route{pattern: pattern, segments: strings.Split(strings.TrimPrefix(pattern, "/"), "/"), handlers: handlers}
+	for _, seg := range r.segments {
+		if !strings.HasPrefix(seg, ":") && !strings.HasPrefix(seg, "*") {
+			r.literals++
+		}
+	}
+	return r
+}
+
+// match reports whether p matches the route, appending its parameters.
+func (r *route) match(p string, params []Param) ([]Param, bool) {
+	rest := p
+	for _, seg := range r.segments {
+		if rest == "" || rest[0] != '/' {
+			return params, false
+		}
+		rest = rest[1:]
+		if strings.HasPrefix(seg, "*") {
+			return append(params, Param{Key: seg[1:], Value: "/" + rest}), true
+		}
+		part := rest
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			part, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			if part == "" {
+				return params, false
+			}
+			params = append(params, Param{Key: seg[1:], Value: part})
+		case part != seg:
+			return params, false
+		}
+	}
+	return params, rest == ""
+}
@@ -0,0 +1,151 @@
+package discordcdn
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newRouterTest returns an engine whose routes answer with their pattern and
+// parameters.
+func newRouterTest() *Engine {
+	e := NewEngine()
+	echo := func(c *Context) {
+		var b strings.Builder
+		b.WriteString(c.FullPath())
+		for _, p := range c.params {
+			b.WriteString(" " + p.Key + "=" + p.Value)
+		}
+		c.String(http.StatusOK, b.String())
+	}
+	e.GET("/", echo)
+	e.GET("/f/:id", echo)
+	e.GET("/f/:id/:fileName", echo)
+	e.GET("/f/latest", echo)
+	e.GET("/api/validate/*link", echo)
+	e.POST("/upload", echo)
+	e.DELETE("/api/aliases/:name", echo)
+	e.POST("/api/aliases/:name", echo)
+	e.GET("/admin/", echo)
+	e.GET("/:kind/info", echo)
+	return e
+}
+
+func TestRouterMatch(t *testing.T) {
+	e := newRouterTest()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"root", http.MethodGet, "/", http.StatusOK, "/"},
+		{"param", http.MethodGet, "/f/abc", http.StatusOK, "/f/:id id=abc"},
+		{"two params", http.MethodGet, "/f/abc/a.png", http.StatusOK, "/f/:id/:fileName id=abc fileName=a.png"},
+		{"literal wins", http.MethodGet, "/f/latest", http.StatusOK, "/f/latest"},
+		{"param first", http.MethodGet, "/s/info", http.StatusOK, "/:kind/info kind=s"},
+		{"empty param", http.MethodGet, "/f//a.png", http.StatusNotFound, "404 page not found"},
+		{"wildcard", http.MethodGet, "/api/validate/1/2/a.png", http.StatusOK, "/api/validate/*link link=/1/2/a.png"},
+		{"empty wildcard", http.MethodGet, "/api/validate/", http.StatusOK, "/api/validate/*link link=/"},
+		{"too long", http.MethodGet, "/f/abc/a.png/more", http.StatusNotFound, "404 page not found"},
+		{"unknown", http.MethodGet, "/1/2/a.png", http.StatusNotFound, "404 page not found"},
+		{"wrong method", http.MethodGet, "/upload", http.StatusMethodNotAllowed, "405 method not allowed"},
+		{"unknown under another method", http.MethodPut, "/nothing", http.StatusNotFound, "404 page not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(e, tt.method, tt.path, nil)
+			if w.Code != tt.status || w.Body.String() != tt.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	e := newRouterTest()
+	w := doRequest(e, http.MethodGet, "/api/aliases/x", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if got := w.Header().Get("Allow"); got != "DELETE, POST" {
+		t.Errorf("Allow = %q, want %q", got, "DELETE, POST")
+	}
+
+	// NoRoute still takes paths no method has a route for.
+	e.NoRoute(func(c *Context) { c.String(http.StatusTeapot, "no route") })
+	if w := doRequest(e, http.MethodGet, "/1/2/a.png", nil); w.Code != http.StatusTeapot {
+		t.Errorf("NoRoute status = %d, want %d", w.Code, http.StatusTeapot)
+	}
+	if w := doRequest(e, http.MethodGet, "/upload", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRouterTrailingSlash(t *testing.T) {
+	e := newRouterTest()
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		status   int
+		location string
+	}{
+		{"add slash", http.MethodGet, "/admin?tab=keys", http.StatusMovedPermanently, "/admin/?tab=keys"},
+		{"drop slash", http.MethodGet, "/f/abc/", http.StatusMovedPermanently, "/f/abc"},
+		{"not a GET", http.MethodPost, "/upload/", http.StatusTemporaryRedirect, "/upload"},
+		{"no route either way", http.MethodGet, "/1/2/", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(e, tt.method, tt.path, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    []string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted forwarder", "192.0.2.1:1234", []string{"X-Forwarded-For", "198.51.100.7"}, "192.0.2.1"},
+		{"untrusted real IP", "192.0.2.1:1234", []string{"X-Real-IP", "198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hop", "10.0.0.1:1234", []string{"X-Forwarded-For", "203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"trusted real IP", "10.0.0.1:1234", []string{"X-Real-IP", "198.51.100.7"}, "198.51.100.7"},
+		{"invalid header", "10.0.0.1:1234", []string{"X-Forwarded-For", "not-an-ip"}, "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEngine()
+			e.SetTrustedProxies([]*net.IPNet{proxies})
+			var got string
+			e.GET("/", func(c *Context) { got = c.ClientIP() })
+
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for i := 0; i+1 < len(tt.headers); i += 2 {
+				req.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			e.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package discordcdn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clamdChunkSize is the size of the chunks content is streamed to clamd
+	// in.
+	clamdChunkSize = 64 << 10
+	// maxCleanVerdicts bounds the files remembered as clean; past it, the
+	// memory starts over.
+	maxCleanVerdicts = 100000
+)
+
+// FlaggedFile is a file the virus scanner found infected. Attachments are
+// keyed by file ID and uploads by f/<manifest ID>.
+type FlaggedFile struct {
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	Signature string    `json:"signature"`
+	FlaggedAt time.Time `json:"flaggedAt"`
+	// Allowed marks a false positive, served again.
+	Allowed bool `json:"allowed,omitempty"`
+}
+
+// Scanner checks files with clamd before they are served from the service's
+// domain, where malware would be blamed on it. Files found infected are
+// flagged in the store for good, since the content behind a key never
+// changes; clean ones are remembered in memory.
+type Scanner struct {
+	network  string
+	address  string
+	timeout  time.Duration
+	maxSize  int64
+	failOpen bool
+	store    *Store
+
+	mu    sync.Mutex
+	clean map[string]struct{}
+}
+
+func NewScanner(config *Config, store *Store) *Scanner {
+	network, address := "tcp", strings.TrimPrefix(config.ClamAVAddress, "tcp://")
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	return &Scanner{
+		network:  network,
+		address:  address,
+		timeout:  config.ClamAVTimeout,
+		maxSize:  config.ClamAVMaxSize,
+		failOpen: config.ClamAVFailOpen,
+		store:    store,
+		clean:    map[string]struct{}{},
+	}
+}
+
+// SetScanner sets the scanner proxied attachments are checked with.
+func (c *DiscordClient) SetScanner(scanner *Scanner) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scanner = scanner
+}
+
+// Scanner returns the virus scanner, or nil if scanning is off.
+func (c *DiscordClient) Scanner() *Scanner {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.scanner
+}
+
+// Check returns the flag of a file found infected, scanning the content
+// open returns, along with its size or -1, unless the file was checked
+// before.
+func (s *Scanner) Check(ctx context.Context, key, path string, open func(context.Context) (io.ReadCloser, int64, error)) (*FlaggedFile, error) {
+	if flag, ok := s.store.Flagged(key); ok {
+		if flag.Allowed {
+			return nil, nil
+		}
+		return flag, nil
+	}
+	s.mu.Lock()
+	_, clean := s.clean[key]
+	s.mu.Unlock()
+	if clean {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	r, size, err := open(ctx)
+	if err != nil {
+		metrics.Count("scan.results", 1, "result:error")
+		return nil, fmt.Errorf("failed to read %s for scanning: %w", path, err)
+	}
+	defer r.Close()
+	signature, err := s.scan(ctx, path, r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature == "" {
+		s.mu.Lock()
+		if len(s.clean) >= maxCleanVerdicts {
+			s.clean = map[string]struct{}{}
+		}
+		s.clean[key] = struct{}{}
+		s.mu.Unlock()
+		return nil, nil
+	}
+	flag := &FlaggedFile{Key: key, Path: path, Signature: signature, FlaggedAt: time.Now().UTC()}
+	if err := s.store.FlagFile(flag); err != nil {
+		logAt(slog.LevelError, "Failed to save flag of %s: %v", path, err)
+	}
+	return flag, nil
+}
+
+// scan streams a file of the given size, or -1 if unknown, to clamd,
+// returning the signature it matched, or "" if it is clean or too large to
+// scan. Of a file of unknown size, only the first maxSize bytes are
+// scanned.
+func (s *Scanner) scan(ctx context.Context, path string, r io.Reader, size int64) (string, error) {
+	if s.maxSize > 0 {
+		if size > s.maxSize {
+			logAt(slog.LevelDebug, "Serving %s unscanned: %d bytes is over the scan limit", path, size)
+			metrics.Count("scan.results", 1, "result:skipped")
+			return "", nil
+		}
+		r = io.LimitReader(r, s.maxSize)
+	}
+
+	start := time.Now()
+	signature, err := s.instream(ctx, r)
+	if err != nil {
+		metrics.Count("scan.results", 1, "result:error")
+		return "", fmt.Errorf("failed to scan %s: %w", path, err)
+	}
+	if signature != "" {
+		logAt(slog.LevelWarn, "Virus scanner found %s in %s", signature, path)
+		metrics.Count("scan.results", 1, "result:infected")
+		return signature, nil
+	}
+	logAt(slog.LevelDebug, "Scanned %s in %s", path, time.Since(start).Round(time.Millisecond))
+	metrics.Count("scan.results", 1, "result:clean")
+	return "", nil
+}
+
+// instream sends content to clamd with the INSTREAM command: chunks
+// prefixed with their length, ended by an empty one.
+func (s *Scanner) instream(ctx context.Context, r io.Reader) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+	if _, err := conn.Write(make([]byte, 4)); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// ScanUpload scans a file being uploaded, returning the signature it
+// matched, or "" if it is clean. Uploads have no key until they are stored,
+// so nothing is flagged.
+func (s *Scanner) ScanUpload(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.scan(ctx, "upload "+name, r, size)
+}
+
+// allowScanned reports whether a file may be served after a scan, responding
+// with an error if not. Files the scanner couldn't check are only served
+// when failing open.
+func (s *Scanner) allowScanned(c *Context, flag *FlaggedFile, err error) bool {
+	if flag != nil {
+		logf(c, slog.LevelInfo, "Refused %s, flagged with %s", flag.Path, flag.Signature)
+		respondError(c, http.StatusForbidden, codeMalwareDetected, "File was flagged by the virus scanner")
+		return false
+	}
+	if err != nil && s.failOpen {
+		logf(c, slog.LevelWarn, "Serving unscanned: %v", err)
+		return true
+	}
+	if err != nil {
+		logf(c, slog.LevelError, "Refused unscanned: %v", err)
+		respondError(c, http.StatusServiceUnavailable, codeScanFailed, "Failed to scan file")
+		return false
+	}
+	return true
+}
+
+// scanAttachment checks an attachment about to be proxied from target.
+func scanAttachment(c *Context, scanner *Scanner, client *DiscordClient, data *LinkData, target string) bool {
+	flag, err := scanner.Check(c.Request.Context(), fmt.Sprint(data.FileID), data.Path(), func(ctx context.Context) (io.ReadCloser, int64, error) {
+		resp, err := client.Download(ctx, target, "")
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("CDN error: %d", resp.StatusCode)
+		}
+		return resp.Body, responseSize(resp), nil
+	})
+	return scanner.allowScanned(c, flag, err)
+}
+
+// handleFlagged lists the files the virus scanner flagged.
+func handleFlagged(store *Store) HandlerFunc {
+	return func(c *Context) {
+		c.JSON(http.StatusOK, H{"flagged": store.FlaggedFiles()})
+	}
+}
+
+// handleAllowFlagged marks a flagged file as a false positive.
+func handleAllowFlagged(store *Store) HandlerFunc {
+	return func(c *Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		found, err := store.AllowFlagged(key)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to allow %s: %v", key, err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to allow file")
+			return
+		}
+		if !found {
+			respondError(c, http.StatusNotFound, codeNotFound, "File isn't flagged")
+			return
+		}
+		logf(c, slog.LevelInfo, "Allowed flagged file %s", key)
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,132 @@
+package discordcdn
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// SearchResult is an indexed attachment with the link that serves it.
+type SearchResult struct {
+	IndexedAttachment
+	URL string `json:"url"`
+}
+
+// attachmentFilter holds the criteria of a search. Zero fields match
+// everything.
+type attachmentFilter struct {
+	channelID int64
+	// fileName matches case-insensitively anywhere in the filename.
+	fileName string
+	// text matches case-insensitively anywhere in the message's text.
+	text string
+	// contentType matches a full content type or just its top-level type,
+	// such as "image".
+	contentType string
+	after       time.Time
+	before      time.Time
+}
+
+func (f *attachmentFilter) match(a *IndexedAttachment) bool {
+	if f.channelID != 0 && a.ChannelID != f.channelID {
+		return false
+	}
+	if f.fileName != "" && !strings.Contains(strings.ToLower(a.FileName), f.fileName) {
+		return false
+	}
+	if f.text != "" && !strings.Contains(strings.ToLower(a.Content), f.text) {
+		return false
+	}
+	if f.contentType != "" {
+		mediaType, _, _ := strings.Cut(a.ContentType, ";")
+		topLevel, _, _ := strings.Cut(mediaType, "/")
+		if !strings.EqualFold(mediaType, f.contentType) && !strings.EqualFold(topLevel, f.contentType) {
+			return false
+		}
+	}
+	if !f.after.IsZero() && !a.CreatedAt.After(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && !a.CreatedAt.Before(f.before) {
+		return false
+	}
+	return true
+}
+
+func handleSearch(store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		filter := attachmentFilter{
+			fileName:    strings.ToLower(c.Query("filename")),
+			text:        strings.ToLower(c.Query("text")),
+			contentType: c.Query("type"),
+		}
+		if v := c.Query("channel"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !validSnowflake(id) {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Channel must be a channel ID")
+				return
+			}
+			filter.channelID = id
+		}
+		if v := c.Query("after"); v != "" {
+			after, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "After must be an RFC 3339 timestamp")
+				return
+			}
+			filter.after = after
+		}
+		if v := c.Query("before"); v != "" {
+			before, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Before must be an RFC 3339 timestamp")
+				return
+			}
+			filter.before = before
+		}
+
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Offset must be a non-negative integer")
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+
+		matches := store.FindAttachments(filter.match)
+		sort.Slice(matches, func(i, j int) bool {
+			if !matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+				return matches[i].CreatedAt.After(matches[j].CreatedAt)
+			}
+			return matches[i].FileID > matches[j].FileID
+		})
+
+		start := min(offset, len(matches))
+		end := min(start+limit, len(matches))
+		base := publicURL(c, config)
+		results := make([]SearchResult, 0, end-start)
+		for _, a := range matches[start:end] {
+			results = append(results, SearchResult{IndexedAttachment: a, URL: base + "/" + a.Path()})
+		}
+
+		response := H{
+			"total":   len(matches),
+			"results": results,
+		}
+		if end < len(matches) {
+			response["nextOffset"] = end
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
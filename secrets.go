@@ -0,0 +1,191 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secret settings can be given directly in the environment, in a file named
+// by the same variable with a _FILE suffix, as Docker and Kubernetes mount
+// secrets, or as a reference to a secret in Vault such as
+// vault:secret/data/discord#token, or in AWS (see aws.go).
+const vaultPrefix = "vault:"
+
+// vaultTimeout bounds each call to Vault.
+const vaultTimeout = 10 * time.Second
+
+// secretValue returns the secret setting key, read from the file named by
+// key_FILE when that is set, and resolved from Vault when it refers to it.
+func (p *configParser) secretValue(key string) string {
+	value := p.lookup(key, "", true)
+	if path := getEnv(key+"_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			p.fail(key+"_FILE", "could not be read: %v", err)
+			return ""
+		}
+		if value = strings.TrimSpace(string(data)); value == "" {
+			p.fail(key+"_FILE", "is empty")
+		}
+	}
+
+	if ref, ok := strings.CutPrefix(value, awsSecretsManagerPrefix); ok {
+		return p.awsValue(key, ref, p.awsClient().secret)
+	}
+	if ref, ok := strings.CutPrefix(value, awsParameterPrefix); ok {
+		return p.awsValue(key, ref, p.awsClient().parameter)
+	}
+	ref, ok := strings.CutPrefix(value, vaultPrefix)
+	if !ok {
+		return value
+	}
+	vault, err := p.vaultClient()
+	if err != nil {
+		p.fail(key, "%v", err)
+		return ""
+	}
+	value, err = vault.read(ref)
+	if err != nil {
+		p.fail(key, "%v", err)
+		return ""
+	}
+	p.vaultValues[ref] = value
+	return value
+}
+
+func (p *configParser) awsClient() *AWSClient {
+	if p.aws == nil {
+		p.aws = newAWSClient()
+	}
+	return p.aws
+}
+
+// awsValue reads the secret setting key from AWS with fetch.
+func (p *configParser) awsValue(key, ref string, fetch func(string) (string, error)) string {
+	value, err := fetch(ref)
+	if err != nil {
+		p.fail(key, "could not be read from AWS: %v", err)
+		return ""
+	}
+	return value
+}
+
+// vaultClient returns the Vault client for this configuration, set up on
+// first use so configurations without Vault references need no Vault
+// settings.
+func (p *configParser) vaultClient() (*VaultClient, error) {
+	if p.vault != nil {
+		return p.vault, nil
+	}
+	addr := strings.TrimSuffix(p.string("VAULT_ADDR", ""), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("refers to Vault, but %sVAULT_ADDR is not set", envPrefix)
+	}
+	token := p.secretValue("VAULT_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("refers to Vault, but %sVAULT_TOKEN is not set", envPrefix)
+	}
+	p.vault = &VaultClient{addr: addr, token: token, http: &http.Client{Timeout: vaultTimeout}}
+	p.vaultValues = map[string]string{}
+	return p.vault, nil
+}
+
+// VaultClient reads secrets from HashiCorp Vault over its HTTP API.
+type VaultClient struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func (v *VaultClient) call(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Vault answered %d for %s", resp.StatusCode, path)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	return nil
+}
+
+// read returns one field of a secret, given as path#field. Both KV version 1
+// and version 2 mounts are understood.
+func (v *VaultClient) read(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", errors.New("Vault reference must look like vault:<path>#<field>")
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.call(http.MethodGet, path, &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = inner
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %q", path, field)
+	}
+	return value, nil
+}
+
+// renew extends the lease of the Vault token, so a renewable token doesn't
+// expire while the server runs.
+func (v *VaultClient) renew() error {
+	var out struct{}
+	return v.call(http.MethodPost, "auth/token/renew-self", &out)
+}
+
+// watchVault renews the Vault token every interval and reloads the
+// configuration when any secret read from Vault has changed, so rotated
+// secrets are picked up without a restart.
+func (r *Reloader) watchVault(config *Config, interval time.Duration) {
+	current := config
+	renewFailing := false
+	for range time.Tick(interval) {
+		if current.vault != nil {
+			err := current.vault.renew()
+			if err != nil && !renewFailing {
+				logAt(slog.LevelError, "Failed to renew Vault token: %v", err)
+			}
+			renewFailing = err != nil
+		}
+
+		latest, err := loadConfig()
+		if err != nil {
+			logAt(slog.LevelError, "Failed to read secrets from Vault: %v", err)
+			continue
+		}
+		if maps.Equal(latest.vaultValues, current.vaultValues) {
+			current = latest
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			logAt(slog.LevelWarn, "Vault secrets changed, but failed to reload config: %v", err)
+			continue
+		}
+		current = latest
+		log.Printf("Vault secrets changed, config reloaded")
+	}
+}
@@ -0,0 +1,47 @@
+package discordcdn
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// sentryMiddleware attaches a Sentry hub to each request, tagged with the
+// request ID. Panics are reported and then re-raised for recoverPanics.
+func sentryMiddleware() HandlerFunc {
+	return func(c *Context) {
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(c.Request)
+		hub.Scope().SetTag("request_id", c.GetString(requestIDKey))
+		c.Request = c.Request.WithContext(sentry.SetHubOnContext(c.Request.Context(), hub))
+		defer func() {
+			if err := recover(); err != nil {
+				if err != http.ErrAbortHandler && !isBrokenPipe(err) {
+					hub.RecoverWithContext(context.WithValue(c.Request.Context(), sentry.RequestContextKey, c.Request), err)
+				}
+				panic(err)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// reportError sends err to Sentry with the request's context. It is a no-op
+// when Sentry is not configured or the client has already gone away.
+func reportError(c *Context, err error) {
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	if hub := sentry.GetHubFromContext(c.Request.Context()); hub != nil {
+		hub.CaptureException(err)
+	}
+}
+
+func initSentry(config *Config) error {
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         config.SentryDSN,
+		Environment: config.SentryEnvironment,
+		SampleRate:  config.SentrySampleRate,
+	})
+}
@@ -0,0 +1,186 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os/exec"
+)
+
+// service is everything the server runs, set up from a configuration: the
+// handlers of the public and admin listeners and the background work behind
+// them.
+type service struct {
+	// public and private are what the public and admin listeners serve,
+	// with tenants and the base path applied. private is only served apart
+	// when admin is a router of its own.
+	public, private http.Handler
+	router, admin   *Engine
+	// reloaders reload the configuration of the service and its tenants.
+	reloaders []*Reloader
+	client    *DiscordClient
+	store     *Store
+	closers   []io.Closer
+}
+
+// newService sets up the service and starts its background work, which runs
+// for the life of the process.
+func newService(config *Config) (*service, error) {
+	svc := &service{}
+	if config.StatsDAddr != "" {
+		sink, err := NewStatsDSink(config.StatsDAddr, config.StatsDPrefix, config.StatsDDatadog, config.StatsDFlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up StatsD: %w", err)
+		}
+		metrics.AddSink(sink)
+	}
+
+	store, err := openStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	svc.store = store
+
+	counter, err := NewRequestCounter(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up rate limiting: %w", err)
+	}
+
+	var dns *DNSCache
+	if config.DNSCacheTTL > 0 {
+		dns = NewDNSCache(config.DNSCacheTTL)
+		if config.DNSRefreshInterval > 0 {
+			go dns.run(config.DNSRefreshInterval)
+		}
+	}
+	transport, err := upstreamTransport(config, dns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up egress pool: %w", err)
+	}
+	upstream := NewUpstreamStats(config.UpstreamWindow)
+	metrics.AddSink(upstream)
+	go upstream.run(upstreamGaugeInterval)
+
+	invalidator, err := NewInvalidator(counter, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up cache invalidation: %w", err)
+	}
+	if invalidator != nil {
+		go invalidator.run()
+	}
+
+	discordClient, err := newDiscordClient(config, counter, transport, upstream, invalidator)
+	if err != nil {
+		return nil, err
+	}
+	svc.client = discordClient
+	if len(config.IndexChannels) > 0 {
+		elector, err := NewLeaderElector(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up leader election: %w", err)
+		}
+		go elector.Run("gateway", NewGateway(discordClient, store, config.IndexChannels).run)
+	}
+	if config.MirrorPath != "" {
+		elector, err := NewLeaderElector(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up leader election: %w", err)
+		}
+		go elector.Run("mirror", NewMirrorer(discordClient, store, config.MirrorPath, config.MirrorInterval, config.MirrorConcurrency).run)
+	}
+	if config.NATSURL != "" {
+		consumer, err := NewNATSConsumer(discordClient, config.NATSURL, config.NATSSubject, config.NATSQueue, config.NATSResultSubject, config.NATSConcurrency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up NATS: %w", err)
+		}
+		go consumer.run(context.Background())
+	}
+	variants := NewByteCache(config.TransformCache)
+	transformer := NewTransformer(discordClient, variants)
+
+	var posters *PosterExtractor
+	ffmpegPath, err := exec.LookPath(config.FFmpegPath)
+	if err == nil {
+		posters = NewPosterExtractor(ffmpegPath, variants)
+	} else {
+		ffmpegPath = ""
+		logAt(slog.LevelWarn, "Poster frames disabled: %v", err)
+	}
+
+	var accessLogFile io.Writer
+	if config.AccessLogPath != "" {
+		file, err := OpenRotatingFile(config.AccessLogPath, config.AccessLogMaxSize, config.AccessLogRotate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %w", err)
+		}
+		svc.closers = append(svc.closers, file)
+		accessLogFile = file
+	}
+
+	router, admin, reloader := setupRouter(config, discordClient, store, transformer, posters, counter, accessLogFile)
+	svc.router, svc.admin, svc.reloaders = router, admin, []*Reloader{reloader}
+	if config.TokenFile != "" {
+		go reloader.watchTokenFile(config.TokenFile)
+	}
+	if config.vault != nil {
+		go reloader.watchVault(config, config.VaultRenewInterval)
+	}
+
+	// Tenants get routers of their own, which requests are sent to by host
+	// or path prefix.
+	svc.public, svc.private = svc.router, svc.admin
+	if len(config.Tenants) > 0 {
+		publicMux, adminMux := NewTenantMux(svc.router), NewTenantMux(svc.admin)
+		for i := range config.Tenants {
+			tenant := &config.Tenants[i]
+			tenantRouter, tenantAdmin, tenantReloader, err := setupTenant(config, tenant.Name, counter, transport, upstream, invalidator, ffmpegPath, accessLogFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up tenant %s: %w", tenant.Name, err)
+			}
+			svc.reloaders = append(svc.reloaders, tenantReloader)
+			publicMux.Add(tenant, tenantRouter)
+			adminMux.Add(tenant, tenantAdmin)
+			log.Printf("Serving tenant %s", tenant.Name)
+		}
+		svc.public, svc.private = publicMux, adminMux
+	}
+	if config.BasePath != "" {
+		svc.public, svc.private = mountBasePath(config.BasePath, svc.public), mountBasePath(config.BasePath, svc.private)
+	}
+	return svc, nil
+}
+
+// Close closes the files the service writes to.
+func (svc *service) Close() {
+	for _, c := range svc.closers {
+		c.Close()
+	}
+}
+
+// LoadConfig reads the configuration from the environment, and any .env
+// file, as the server does.
+func LoadConfig() (*Config, error) {
+	return loadConfig()
+}
+
+// NewHandler sets up the whole service as a handler, for mounting inside
+// another Go web application instead of running the server. It serves what
+// the public listeners would, admin routes included unless
+// DCDN_ADMIN_LISTEN is set, which NewHandler doesn't listen on. The listener,
+// TLS, logging, Sentry and signal settings are left to the application;
+// everything else, background work included, runs as configured for the life
+// of the process.
+//
+// To mount the handler under a prefix, set DCDN_BASE_PATH to it and route the
+// prefix to the handler without stripping it, so the links it hands out
+// include it.
+func NewHandler(config *Config) (http.Handler, error) {
+	svc, err := newService(config)
+	if err != nil {
+		return nil, err
+	}
+	return svc.public, nil
+}
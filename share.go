@@ -0,0 +1,253 @@
+package discordcdn
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// shareClaims is the payload of a share token: the link it grants access to
+// and when it stops working. One-time links carry a random ID, under which
+// their use is recorded.
+type shareClaims struct {
+	LinkData
+	Expires int64  `json:"exp"`
+	ID      string `json:"jti,omitempty"`
+}
+
+// ShareSigner mints and checks share tokens, which embed the link and its
+// expiry with an HMAC-SHA256 signature, so they need no storage and are
+// valid on every instance sharing the secret.
+type ShareSigner struct {
+	secret []byte
+}
+
+func NewShareSigner(secret string) *ShareSigner {
+	return &ShareSigner{secret: []byte(secret)}
+}
+
+func (s *ShareSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a token granting access to data until expires, or with once
+// set until it is first used.
+func (s *ShareSigner) Token(data *LinkData, expires time.Time, once bool) (string, error) {
+	claims := shareClaims{LinkData: *data, Expires: expires.Unix()}
+	if once {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = base64.RawURLEncoding.EncodeToString(id)
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + s.sign(payload), nil
+}
+
+var errShareExpired = errors.New("share link expired")
+
+// Verify checks a token's signature and expiry and returns its claims.
+func (s *ShareSigner) Verify(token string) (*shareClaims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return nil, errors.New("invalid signature")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var claims shareClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return &claims, errShareExpired
+	}
+	return &claims, nil
+}
+
+type ShareRequest struct {
+	URL string `json:"url"`
+	// ExpiresIn is how long the link works, as a duration such as "24h".
+	ExpiresIn string `json:"expiresIn,omitempty"`
+	// Once makes a link that only works until it is first fetched.
+	Once bool `json:"once,omitempty"`
+}
+
+func handleShare(signer *ShareSigner, config *Config) HandlerFunc {
+	return func(c *Context) {
+		var req ShareRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || req.URL == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+			return
+		}
+
+		ttl := config.ShareTTL
+		if req.ExpiresIn != "" {
+			ttl, err = time.ParseDuration(req.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "expiresIn must be a positive duration, such as 24h")
+				return
+			}
+		}
+		if config.ShareMaxTTL > 0 && ttl > config.ShareMaxTTL {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "expiresIn must be at most "+config.ShareMaxTTL.String())
+			return
+		}
+
+		parsedLink := parseLink(req.URL)
+		if parsedLink.Error != "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+			return
+		}
+
+		expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+		token, err := signer.Token(parsedLink.Data, expires, req.Once)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to sign share link: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create share link")
+			return
+		}
+		response := H{
+			"url":       publicURL(c, config) + "/share/" + token,
+			"expiresAt": expires,
+		}
+		if req.Once {
+			response["once"] = true
+		}
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+func handleShareLink(client *DiscordClient, signer *ShareSigner, uses ShareUses, transformer *Transformer, config *Config) HandlerFunc {
+	// A redirect would hand out Discord's signed URL, which works until
+	// Discord's expiry however often it is fetched, so one-time links are
+	// always proxied.
+	proxied := *config
+	proxied.ProxyMode = true
+	return func(c *Context) {
+		claims, err := signer.Verify(c.Param("token"))
+		if errors.Is(err, errShareExpired) {
+			metrics.Count("share.rejected", 1, "reason:expired")
+			respondError(c, http.StatusGone, codeShareExpired, "Share link has expired")
+			return
+		}
+		if err != nil {
+			metrics.Count("share.rejected", 1, "reason:invalid")
+			respondError(c, http.StatusNotFound, codeNotFound, "Share link not found")
+			return
+		}
+
+		if claims.ID != "" {
+			// The link is claimed before serving, so two requests racing
+			// for it can't both win, and given back if serving fails.
+			claimed, err := uses.claim(c.Request.Context(), claims.ID, time.Unix(claims.Expires, 0))
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to claim one-time share link: %v", err)
+				respondError(c, http.StatusInternalServerError, codeInternal, "Failed to check share link")
+				return
+			}
+			if !claimed {
+				metrics.Count("share.rejected", 1, "reason:used")
+				respondError(c, http.StatusGone, codeShareUsed, "Share link has already been used")
+				return
+			}
+			defer func() {
+				if c.Writer.Status() < http.StatusBadRequest {
+					return
+				}
+				if err := uses.release(context.Background(), claims.ID); err != nil {
+					logf(c, slog.LevelError, "Failed to release one-time share link: %v", err)
+				}
+			}()
+		}
+
+		// Neither the redirect nor the content may outlive the link in a
+		// cache, and a one-time link's must not be kept at all.
+		cacheControl := "no-store"
+		if claims.ID == "" {
+			remaining := time.Until(time.Unix(claims.Expires, 0))
+			cacheControl = fmt.Sprintf("private, max-age=%d", int(remaining.Seconds()))
+		}
+		c.Header("Cache-Control", cacheControl)
+
+		data := claims.LinkData
+		data.applyQuery(c.QueryValues())
+		if claims.ID != "" {
+			serveAttachment(c, client, transformer, &proxied, &data)
+			return
+		}
+		serveAttachment(c, client, transformer, config, &data)
+	}
+}
+
+// ShareUses records which one-time share links have been used.
+type ShareUses interface {
+	// claim marks a link used, reporting whether it wasn't already. The
+	// record can be forgotten once the link expires.
+	claim(ctx context.Context, id string, expires time.Time) (bool, error)
+	// release marks a link unused again.
+	release(ctx context.Context, id string) error
+}
+
+// newShareUses records uses in Redis when the rate limits are counted
+// there, so a link is only good once across every replica, and in the store
+// otherwise, so it stays used across restarts.
+func newShareUses(counter RequestCounter, store *Store, config *Config) ShareUses {
+	if r, ok := counter.(*redisCounter); ok {
+		return &redisShareUses{client: r.client, prefix: config.RedisPrefix + "share:"}
+	}
+	return storeShareUses{store}
+}
+
+type storeShareUses struct {
+	store *Store
+}
+
+func (u storeShareUses) claim(_ context.Context, id string, expires time.Time) (bool, error) {
+	return u.store.ClaimShare(id, expires)
+}
+
+func (u storeShareUses) release(_ context.Context, id string) error {
+	return u.store.ReleaseShare(id)
+}
+
+// redisShareUses keeps a key per used link, which expires with the link.
+type redisShareUses struct {
+	client *redis.Client
+	prefix string
+}
+
+func (u *redisShareUses) claim(ctx context.Context, id string, expires time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	return u.client.SetNX(ctx, u.prefix+id, 1, max(time.Until(expires), time.Second)).Result()
+}
+
+func (u *redisShareUses) release(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	return u.client.Del(ctx, u.prefix+id).Err()
+}
@@ -0,0 +1,105 @@
+package discordcdn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareToken(t *testing.T) {
+	signer := NewShareSigner("secret")
+	data := &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "a.png"}
+	token, err := signer.Token(data, time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if claims.ChannelID != data.ChannelID || claims.FileID != data.FileID || claims.FileName != data.FileName {
+		t.Errorf("claims link = %+v, want %+v", claims.LinkData, *data)
+	}
+
+	// A payload granting another file, signed with the original signature.
+	payload, signature, _ := strings.Cut(token, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(payload)
+	var forged shareClaims
+	json.Unmarshal(raw, &forged)
+	forged.FileName = "b.png"
+	raw, _ = json.Marshal(forged)
+	forgedPayload := base64.RawURLEncoding.EncodeToString(raw)
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	expired, err := signer.Token(data, time.Now().Add(-time.Second), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		signer *ShareSigner
+		token  string
+	}{
+		{"tampered payload", signer, forgedPayload + "." + signature},
+		{"tampered signature", signer, payload + "." + string(flipped)},
+		{"no signature", signer, payload},
+		{"wrong key", NewShareSigner("other"), token},
+		{"expired", signer, expired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.signer.Verify(tt.token); err == nil {
+				t.Error("Verify() accepted the token")
+			}
+		})
+	}
+	if _, err := signer.Verify(expired); err != errShareExpired {
+		t.Errorf("expired token error = %v, want %v", err, errShareExpired)
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	fake, client := newFakeDiscord(t)
+	link := fake.put(testChannelID, testFileID, "a.png", []byte("image"))
+	router := newTestRouter(t, &Config{APIKeys: []string{"key"}, ShareSecret: "secret", ShareTTL: time.Hour}, client)
+	share := func(body string) string {
+		t.Helper()
+		w := doRequest(router, http.MethodPost, "/api/share", strings.NewReader(body), "X-API-Key", "key", "Content-Type", "application/json")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("share status = %d: %s", w.Code, w.Body)
+		}
+		var resp struct {
+			URL string `json:"url"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.URL[strings.Index(resp.URL, "/share/"):]
+	}
+
+	// Without proxy mode, share links redirect.
+	path := share(`{"url": "` + link[1:] + `"}`)
+	if w := doRequest(router, http.MethodGet, path, nil); w.Code != http.StatusMovedPermanently {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMovedPermanently)
+	}
+	if w := doRequest(router, http.MethodGet, path[:len(path)-1]+"A", nil); w.Code != http.StatusNotFound {
+		t.Errorf("tampered link status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// One-time links are proxied instead, so no Discord URL is handed out
+	// to be used again.
+	path = share(`{"url": "` + link[1:] + `", "once": true}`)
+	w := doRequest(router, http.MethodGet, path, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "image" {
+		t.Fatalf("one-time link got %d %q, want the content", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "" {
+		t.Errorf("one-time link redirected to %s", location)
+	}
+	if w := doRequest(router, http.MethodGet, path, nil); w.Code != http.StatusGone {
+		t.Errorf("second use status = %d, want %d", w.Code, http.StatusGone)
+	}
+}
@@ -0,0 +1,280 @@
+package discordcdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backends the URL cache can be shared through, set with URL_CACHE_BACKEND.
+// memory shares nothing.
+const (
+	urlCacheMemory   = "memory"
+	urlCacheRedis    = "redis"
+	urlCacheDynamoDB = "dynamodb"
+)
+
+const (
+	// dynamoDBTimeout bounds each call to DynamoDB, which requests wait on.
+	dynamoDBTimeout = 2 * time.Second
+	// dynamoDBBatchSize is the most items BatchWriteItem takes at once.
+	dynamoDBBatchSize = 25
+)
+
+// sharedURLCache keeps refreshed URLs where every instance finds them, behind
+// the URL cache in memory, so an instance that just started, such as a Lambda
+// function on a cold start, reuses what the others refreshed instead of
+// asking Discord again. Entries are forgotten once their signature expires.
+type sharedURLCache interface {
+	get(key string) (url string, stored time.Time, ok bool, err error)
+	put(urls map[string]string) error
+	delete(key string) error
+}
+
+// newSharedURLCache returns the shared URL cache URL_CACHE_BACKEND selects, or
+// nil to keep URLs in memory only. The Redis one reuses the rate limit
+// counter's connection. Tenants' keys are prefixed with their name, so one
+// tenant never serves what another refreshed.
+func newSharedURLCache(config *Config, counter RequestCounter) (sharedURLCache, error) {
+	prefix := ""
+	if config.Tenant != "" {
+		prefix = config.Tenant + ":"
+	}
+	switch config.URLCacheBackend {
+	case urlCacheRedis:
+		r, ok := counter.(*redisCounter)
+		if !ok {
+			return nil, errors.New("the redis URL cache requires Redis rate limiting")
+		}
+		return &redisURLCache{client: r.client, prefix: config.RedisPrefix + "urls:" + prefix}, nil
+	case urlCacheDynamoDB:
+		region, err := awsRegion(config.DynamoDBTable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up DynamoDB URL cache: %w", err)
+		}
+		return &dynamoURLCache{
+			aws:    &AWSClient{http: &http.Client{Timeout: dynamoDBTimeout}},
+			region: region,
+			table:  config.DynamoDBTable,
+			prefix: prefix,
+		}, nil
+	}
+	return nil, nil
+}
+
+// SetSharedURLCache sets the cache refreshed URLs are shared through.
+func (c *DiscordClient) SetSharedURLCache(shared sharedURLCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shared = shared
+}
+
+// lookupURL returns the entry for an attachment URL from the URL cache, or
+// else from the shared cache, which then fills the URL cache.
+func (c *DiscordClient) lookupURL(stale *urlCache, key string) (urlCacheEntry, bool) {
+	if entry, ok := stale.Lookup(key); ok {
+		return entry, true
+	}
+	c.mu.RLock()
+	shared := c.shared
+	c.mu.RUnlock()
+	if shared == nil {
+		return urlCacheEntry{}, false
+	}
+	url, stored, ok, err := shared.get(key)
+	if err != nil {
+		logAt(slog.LevelWarn, "Failed to read shared URL cache: %v", err)
+		metrics.Count("cache.shared_errors", 1, "op:get")
+		return urlCacheEntry{}, false
+	}
+	if !ok {
+		metrics.Count("cache.shared_lookups", 1, "result:miss")
+		return urlCacheEntry{}, false
+	}
+	metrics.Count("cache.shared_lookups", 1, "result:hit")
+	entry := urlCacheEntry{key: key, url: url, stored: stored, used: time.Now()}
+	if stale != nil {
+		stale.Restore([]urlCacheEntry{entry})
+	}
+	return entry, true
+}
+
+// shareURLs writes refreshed URLs to the shared cache, if there is one.
+func (c *DiscordClient) shareURLs(refreshed map[string]string) {
+	c.mu.RLock()
+	shared := c.shared
+	c.mu.RUnlock()
+	if shared == nil {
+		return
+	}
+	urls := make(map[string]string, len(refreshed))
+	for original, newURL := range refreshed {
+		if newURL != "" {
+			urls[original] = newURL
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	if err := shared.put(urls); err != nil {
+		logAt(slog.LevelWarn, "Failed to write shared URL cache: %v", err)
+		metrics.Count("cache.shared_errors", 1, "op:put")
+	}
+}
+
+// unshareURL drops an attachment URL from the shared cache, if there is one.
+func (c *DiscordClient) unshareURL(key string) {
+	c.mu.RLock()
+	shared := c.shared
+	c.mu.RUnlock()
+	if shared == nil {
+		return
+	}
+	if err := shared.delete(key); err != nil {
+		logAt(slog.LevelWarn, "Failed to delete from shared URL cache: %v", err)
+		metrics.Count("cache.shared_errors", 1, "op:delete")
+	}
+}
+
+// redisURLCache keeps each URL under a key expiring with its signature, with
+// when it was stored ahead of it.
+type redisURLCache struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *redisURLCache) get(key string) (string, time.Time, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	value, err := r.client.Get(ctx, r.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	storedMs, url, ok := strings.Cut(value, " ")
+	ms, err := strconv.ParseInt(storedMs, 10, 64)
+	if !ok || err != nil {
+		return "", time.Time{}, false, fmt.Errorf("malformed entry for %s", key)
+	}
+	return url, time.UnixMilli(ms), true, nil
+}
+
+func (r *redisURLCache) put(urls map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	stored := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, url := range urls {
+			if expiry, ok := urlExpiry(url); ok && time.Until(expiry) > 0 {
+				pipe.Set(ctx, r.prefix+key, stored+" "+url, time.Until(expiry))
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisURLCache) delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// dynamoURLCache keeps URLs in a DynamoDB table whose partition key is the
+// attachment string attribute. Items carry when their signature expires in
+// the expires attribute, in Unix seconds, for DynamoDB's time to live to
+// delete them; until it gets to them, expired items are passed over.
+type dynamoURLCache struct {
+	aws    *AWSClient
+	region string
+	table  string
+	prefix string
+}
+
+// dynamoItem is a URL cache item in DynamoDB's attribute value format.
+type dynamoItem struct {
+	Attachment dynamoString  `json:"attachment"`
+	URL        *dynamoString `json:"url,omitempty"`
+	Stored     *dynamoNumber `json:"stored,omitempty"`
+	Expires    *dynamoNumber `json:"expires,omitempty"`
+}
+
+type dynamoString struct {
+	S string `json:"S"`
+}
+
+type dynamoNumber struct {
+	N string `json:"N"`
+}
+
+func (d *dynamoURLCache) get(key string) (string, time.Time, bool, error) {
+	in := map[string]interface{}{
+		"TableName": d.table,
+		"Key":       dynamoItem{Attachment: dynamoString{d.prefix + key}},
+	}
+	var out struct {
+		Item *dynamoItem `json:"Item"`
+	}
+	if err := d.aws.call("dynamodb", d.region, "DynamoDB_20120810.GetItem", in, &out); err != nil {
+		return "", time.Time{}, false, err
+	}
+	item := out.Item
+	if item == nil || item.URL == nil || item.Stored == nil || item.Expires == nil {
+		return "", time.Time{}, false, nil
+	}
+	stored, err := strconv.ParseInt(item.Stored.N, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false, fmt.Errorf("malformed entry for %s", key)
+	}
+	if expires, err := strconv.ParseInt(item.Expires.N, 10, 64); err != nil || time.Now().Unix() >= expires {
+		return "", time.Time{}, false, nil
+	}
+	return item.URL.S, time.Unix(stored, 0), true, nil
+}
+
+func (d *dynamoURLCache) put(urls map[string]string) error {
+	stored := strconv.FormatInt(time.Now().Unix(), 10)
+	var requests []interface{}
+	for key, url := range urls {
+		expiry, ok := urlExpiry(url)
+		if !ok || time.Until(expiry) <= 0 {
+			continue
+		}
+		requests = append(requests, map[string]interface{}{"PutRequest": map[string]interface{}{"Item": dynamoItem{
+			Attachment: dynamoString{d.prefix + key},
+			URL:        &dynamoString{url},
+			Stored:     &dynamoNumber{stored},
+			Expires:    &dynamoNumber{strconv.FormatInt(expiry.Unix(), 10)},
+		}}})
+	}
+	for start := 0; start < len(requests); start += dynamoDBBatchSize {
+		in := map[string]interface{}{
+			"RequestItems": map[string]interface{}{d.table: requests[start:min(start+dynamoDBBatchSize, len(requests))]},
+		}
+		// Items DynamoDB doesn't get to are left out rather than retried;
+		// they are only refreshed again sooner.
+		var out struct{}
+		if err := d.aws.call("dynamodb", d.region, "DynamoDB_20120810.BatchWriteItem", in, &out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dynamoURLCache) delete(key string) error {
+	in := map[string]interface{}{
+		"TableName": d.table,
+		"Key":       dynamoItem{Attachment: dynamoString{d.prefix + key}},
+	}
+	var out struct{}
+	return d.aws.call("dynamodb", d.region, "DynamoDB_20120810.DeleteItem", in, &out)
+}
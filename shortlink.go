@@ -0,0 +1,80 @@
+package discordcdn
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const shortLinkLength = 6
+
+type ShortenRequest struct {
+	URL string `json:"url"`
+}
+
+func handleShorten(store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		var req ShortenRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || req.URL == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, "URL is required")
+			return
+		}
+
+		parsedLink := parseLink(req.URL)
+		if parsedLink.Error != "" {
+			respondError(c, http.StatusBadRequest, codeInvalidLink, parsedLink.Error)
+			return
+		}
+
+		// Slugs are random, so retry a few times on the rare collision rather
+		// than growing the slug length.
+		for attempt := 0; attempt < 5; attempt++ {
+			slug, err := newID(shortLinkLength)
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to generate slug: %v", err)
+				break
+			}
+
+			err = store.AddShortLink(&ShortLink{
+				Slug:      slug,
+				LinkData:  *parsedLink.Data,
+				CreatedAt: time.Now().UTC(),
+			})
+			if errors.Is(err, errSlugTaken) {
+				continue
+			}
+			if err != nil {
+				logf(c, slog.LevelError, "Failed to save short link: %v", err)
+				break
+			}
+
+			c.JSON(http.StatusCreated, H{
+				"slug": slug,
+				"url":  publicURL(c, config) + "/s/" + slug,
+			})
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to create short link")
+	}
+}
+
+func handleShortLink(client *DiscordClient, store *Store, transformer *Transformer, config *Config) HandlerFunc {
+	return func(c *Context) {
+		link, ok := store.ShortLink(c.Param("slug"))
+		if !ok {
+			respondError(c, http.StatusNotFound, codeNotFound, "Short link not found")
+			return
+		}
+		c.Set(servedRecordKey, recordKey(recordShortLink, link.Slug))
+
+		data := link.LinkData
+		data.applyQuery(c.QueryValues())
+		serveAttachment(c, client, transformer, config, &data)
+	}
+}
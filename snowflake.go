@@ -0,0 +1,26 @@
+package discordcdn
+
+import "time"
+
+// discordEpoch is the first millisecond of 2015, which Discord snowflake
+// timestamps count from.
+const discordEpoch = 1420070400000
+
+// snowflakeTime returns the creation time embedded in a Discord snowflake.
+func snowflakeTime(id int64) time.Time {
+	return time.UnixMilli(id>>22 + discordEpoch).UTC()
+}
+
+// minSnowflake is the smallest plausible snowflake: anything shorter than 17
+// digits would have been created within a month of the epoch, before Discord
+// handed out any IDs.
+const minSnowflake = 10_000_000_000_000_000
+
+// snowflakeSkew allows for clocks running behind Discord's.
+const snowflakeSkew = time.Hour
+
+// validSnowflake reports whether id could be a Discord ID: long enough, and
+// not created in the future.
+func validSnowflake(id int64) bool {
+	return id >= minSnowflake && snowflakeTime(id).Before(time.Now().Add(snowflakeSkew))
+}
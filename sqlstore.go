@@ -0,0 +1,342 @@
+package discordcdn
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaFS holds the schema migrations of each database, one directory per
+// dialect, in files named <version>_<description>.sql.
+//
+//go:embed migrations
+var schemaFS embed.FS
+
+// storeDatabaseDrivers maps the databases a store can be kept in to the name
+// their database/sql driver registers under.
+var storeDatabaseDrivers = map[string]string{
+	"postgres": "pgx",
+	"sqlite":   "sqlite",
+}
+
+// schemaMigration changes the database schema from one version to the next.
+type schemaMigration struct {
+	version     int
+	description string
+	sql         string
+}
+
+// schemaMigrations returns the migrations of a dialect in order. Releases
+// that change the schema add a file for each dialect; existing files must
+// never change.
+func schemaMigrations(dialect string) ([]schemaMigration, error) {
+	dir := "migrations/" + dialect
+	entries, err := fs.ReadDir(schemaFS, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []schemaMigration
+	for _, entry := range entries {
+		prefix, description, _ := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version != len(migrations)+1 {
+			return nil, fmt.Errorf("migration %s/%s is out of sequence", dir, entry.Name())
+		}
+		raw, err := schemaFS.ReadFile(dir + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, schemaMigration{
+			version:     version,
+			description: strings.ReplaceAll(description, "_", " "),
+			sql:         string(raw),
+		})
+	}
+	return migrations, nil
+}
+
+// parseDatabaseURL splits DCDN_DATABASE_URL into the database's dialect and
+// the data source name its driver takes.
+func parseDatabaseURL(raw string) (dialect, dsn string, err error) {
+	switch {
+	case strings.HasPrefix(raw, "postgres://"), strings.HasPrefix(raw, "postgresql://"):
+		return "postgres", raw, nil
+	case strings.HasPrefix(raw, "sqlite:"):
+		if dsn = strings.TrimPrefix(raw, "sqlite:"); dsn == "" {
+			return "", "", errors.New("must name a database file after sqlite:")
+		}
+		return "sqlite", dsn, nil
+	}
+	return "", "", errors.New("must start with sqlite: or postgres://")
+}
+
+// openDatabase connects to the database named by DCDN_DATABASE_URL.
+func openDatabase(ctx context.Context, url string) (*sql.DB, string, error) {
+	dialect, dsn, err := parseDatabaseURL(url)
+	if err != nil {
+		return nil, "", err
+	}
+	if !slices.Contains(sql.Drivers(), storeDatabaseDrivers[dialect]) {
+		return nil, "", fmt.Errorf("the %s driver isn't compiled in; build with -tags dbdrivers", dialect)
+	}
+	if dialect == "sqlite" && !strings.Contains(dsn, "busy_timeout") {
+		// Tenants write the same file through pools of their own, so wait
+		// for each other's writes rather than fail on them.
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=busy_timeout(5000)"
+	}
+	db, err := sql.Open(storeDatabaseDrivers[dialect], dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	if dialect == "sqlite" {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, "", fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	return db, dialect, nil
+}
+
+// rebind rewrites the ? placeholders of query to the dialect's own.
+func rebind(dialect, query string) string {
+	if dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pendingSchemaMigrations returns the schema version of the database and the
+// migrations it is missing, creating the table versions are recorded in.
+func pendingSchemaMigrations(ctx context.Context, db *sql.DB, dialect string) (int, []schemaMigration, error) {
+	migrations, err := schemaMigrations(dialect)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, nil, fmt.Errorf("failed to read the schema version: %w", err)
+	}
+	if int(version.Int64) > len(migrations) {
+		return 0, nil, fmt.Errorf("database schema is at version %d, newer than the %d this release supports; upgrade the server", version.Int64, len(migrations))
+	}
+	return int(version.Int64), migrations[version.Int64:], nil
+}
+
+// migrateSchema applies migrations in order, each in a transaction along
+// with its row in schema_migrations, so a failed migration leaves the
+// database at the version before it. A migration another replica applied in
+// the meantime is passed over.
+func migrateSchema(ctx context.Context, db *sql.DB, dialect string, migrations []schemaMigration) error {
+	for _, m := range migrations {
+		if err := applySchemaMigration(ctx, db, dialect, m); err != nil {
+			return fmt.Errorf("schema migration to version %d failed: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applySchemaMigration(ctx context.Context, db *sql.DB, dialect string, m schemaMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// SQLite locks the whole database on the first write; Postgres needs
+	// telling, so replicas starting together take turns.
+	if dialect == "postgres" {
+		if _, err := tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+	}
+	var applied int
+	if err := tx.QueryRowContext(ctx, rebind(dialect, "SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), m.version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, rebind(dialect, "INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"), m.version, m.description, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Applied database migration %d: %s", m.version, m.description)
+	return nil
+}
+
+// sqlStore keeps a store document in the store_fields table, a row for each
+// of its top-level fields.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+	// name is the tenant the document belongs to, empty for the default
+	// configuration.
+	name string
+	// saved holds each field as last read or written, so that saving only
+	// writes the fields that changed.
+	saved map[string]string
+}
+
+// load returns the store document, or nil when the store has none yet.
+func (b *sqlStore) load(ctx context.Context) ([]byte, error) {
+	rows, err := b.db.QueryContext(ctx, rebind(b.dialect, "SELECT name, value FROM store_fields WHERE store = ?"), b.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	defer rows.Close()
+	doc := map[string]json.RawMessage{}
+	b.saved = map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("failed to read store: %w", err)
+		}
+		doc[name] = json.RawMessage(value)
+		b.saved[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	if len(doc) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(doc)
+}
+
+// save writes the fields of the document raw that changed since the last
+// save, in one transaction.
+func (b *sqlStore) save(raw []byte) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+	ctx := context.Background()
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	defer tx.Rollback()
+	upsert := rebind(b.dialect, "INSERT INTO store_fields (store, name, value) VALUES (?, ?, ?) ON CONFLICT (store, name) DO UPDATE SET value = excluded.value")
+	changed := map[string]string{}
+	for name, value := range doc {
+		if b.saved[name] == string(value) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, upsert, b.name, name, string(value)); err != nil {
+			return fmt.Errorf("failed to write store: %w", err)
+		}
+		changed[name] = string(value)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if b.saved == nil {
+		b.saved = map[string]string{}
+	}
+	for name, value := range changed {
+		b.saved[name] = value
+	}
+	return nil
+}
+
+// openSQLStore opens the store of config in DCDN_DATABASE_URL, migrating the
+// schema and the document unless automatic migration is off, in which case
+// either needing it is an error.
+func openSQLStore(config *Config) (*Store, error) {
+	ctx := context.Background()
+	db, dialect, err := openDatabase(ctx, config.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	s, err := loadSQLStore(ctx, db, dialect, config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func loadSQLStore(ctx context.Context, db *sql.DB, dialect string, config *Config) (*Store, error) {
+	version, pending, err := pendingSchemaMigrations(ctx, db, dialect)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		if !config.StoreAutoMigrate {
+			return nil, fmt.Errorf("database schema is at version %d, %d behind this release; run discord-cdn migrate-store", version, len(pending))
+		}
+		if err := migrateSchema(ctx, db, dialect, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store{db: &sqlStore{db: db, dialect: dialect, name: config.Tenant}}
+	raw, err := s.db.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		s.data.Version = storeVersion
+		s.data.init()
+		return s, nil
+	}
+	if !config.StoreAutoMigrate {
+		version, pending, err := pendingDocumentMigrations(raw)
+		if err != nil {
+			return nil, err
+		}
+		if pending > 0 {
+			return nil, fmt.Errorf("store is at version %d, %d behind this release; run discord-cdn migrate-store", version, pending)
+		}
+	}
+	from, err := s.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if from < storeVersion {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		log.Printf("Migrated store %q in the database from version %d to %d", config.Tenant, from, storeVersion)
+	}
+	return s, nil
+}
@@ -0,0 +1,64 @@
+//go:build dbdrivers
+
+package discordcdn
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	config := &Config{DatabaseURL: "sqlite:" + t.TempDir() + "/data.db", StoreAutoMigrate: true}
+	store, err := openStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ShortLink{Slug: "ab12cd", LinkData: LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "a.png"}}
+	if err := store.AddShortLink(link); err != nil {
+		t.Fatal(err)
+	}
+	store.db.db.Close()
+
+	reopened, err := openStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.db.db.Close()
+	if got, ok := reopened.ShortLink(link.Slug); !ok || got.FileID != testFileID {
+		t.Errorf("short link after reopening = %v, %v", got, ok)
+	}
+
+	version, pending, err := pendingSchemaMigrations(context.Background(), reopened.db.db, "sqlite")
+	if err != nil || len(pending) != 0 || version == 0 {
+		t.Errorf("schema at version %d with %d pending: %v", version, len(pending), err)
+	}
+}
+
+func TestSQLiteStoreMigrationsOff(t *testing.T) {
+	config := &Config{DatabaseURL: "sqlite:" + t.TempDir() + "/data.db"}
+	if _, err := openStore(config); err == nil {
+		t.Fatal("opened a database missing its schema with automatic migration off")
+	}
+}
+
+func TestSQLiteStoreTenants(t *testing.T) {
+	url := "sqlite:" + t.TempDir() + "/data.db"
+	acme, err := openStore(&Config{DatabaseURL: url, StoreAutoMigrate: true, Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acme.db.db.Close()
+	link := &ShortLink{Slug: "ab12cd", LinkData: LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "a.png"}}
+	if err := acme.AddShortLink(link); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openStore(&Config{DatabaseURL: url, StoreAutoMigrate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.db.db.Close()
+	if _, ok := other.ShortLink(link.Slug); ok {
+		t.Error("one tenant's short link found in another's store")
+	}
+}
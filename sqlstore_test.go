@@ -0,0 +1,62 @@
+package discordcdn
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSchemaMigrationsMatch(t *testing.T) {
+	var versions [][]int
+	for dialect := range storeDatabaseDrivers {
+		migrations, err := schemaMigrations(dialect)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("%s has no migrations", dialect)
+		}
+		var v []int
+		for _, m := range migrations {
+			v = append(v, m.version)
+		}
+		versions = append(versions, v)
+	}
+	for _, v := range versions[1:] {
+		if !slices.Equal(v, versions[0]) {
+			t.Errorf("dialects have different migrations: %v and %v", versions[0], v)
+		}
+	}
+}
+
+func TestParseDatabaseURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		dialect string
+		dsn     string
+		wantErr bool
+	}{
+		{"sqlite:/var/lib/discord-cdn/data.db", "sqlite", "/var/lib/discord-cdn/data.db", false},
+		{"postgres://cdn:secret@db/cdn?sslmode=disable", "postgres", "postgres://cdn:secret@db/cdn?sslmode=disable", false},
+		{"postgresql://db/cdn", "postgres", "postgresql://db/cdn", false},
+		{"sqlite:", "", "", true},
+		{"mysql://db/cdn", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			dialect, dsn, err := parseDatabaseURL(tt.url)
+			if (err != nil) != tt.wantErr || dialect != tt.dialect || dsn != tt.dsn {
+				t.Errorf("parseDatabaseURL() = %q, %q, %v", dialect, dsn, err)
+			}
+		})
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT name FROM store_fields WHERE store = ? AND name = ?"
+	if got := rebind("sqlite", query); got != query {
+		t.Errorf("sqlite: %q", got)
+	}
+	if got, want := rebind("postgres", query), "SELECT name FROM store_fields WHERE store = $1 AND name = $2"; got != want {
+		t.Errorf("postgres: %q, want %q", got, want)
+	}
+}
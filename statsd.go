@@ -0,0 +1,87 @@
+package discordcdn
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacket keeps batched packets under the common 1500 byte MTU.
+const statsdMaxPacket = 1432
+
+// StatsDSink sends metrics over UDP in the StatsD line format. Lines are
+// batched and flushed every interval or once a packet fills up. With
+// datadog set, tags are sent using the DogStatsD extension; otherwise they are
+// dropped, since plain StatsD has no notion of tags.
+type StatsDSink struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	prefix  string
+	datadog bool
+	buf     []byte
+}
+
+func NewStatsDSink(addr, prefix string, datadog bool, interval time.Duration) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD: %w", err)
+	}
+
+	s := &StatsDSink{
+		conn:    conn,
+		prefix:  prefix,
+		datadog: datadog,
+	}
+	go func() {
+		for range time.Tick(interval) {
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		}
+	}()
+	return s, nil
+}
+
+func (s *StatsDSink) Count(name string, value int64, tags []string) {
+	s.write(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+func (s *StatsDSink) Gauge(name string, value float64, tags []string) {
+	s.write(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (s *StatsDSink) Timing(name string, d time.Duration, tags []string) {
+	s.write(name, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64), "ms", tags)
+}
+
+func (s *StatsDSink) write(name, value, kind string, tags []string) {
+	line := s.prefix + name + ":" + value + "|" + kind
+	if s.datadog && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) > 0 && len(s.buf)+1+len(line) > statsdMaxPacket {
+		s.flush()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// flush sends the pending batch. Callers must hold the lock.
+func (s *StatsDSink) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf); err != nil {
+		logAt(slog.LevelError, "Failed to send StatsD metrics: %v", err)
+	}
+	s.buf = s.buf[:0]
+}
@@ -0,0 +1,208 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// stickerTimeout bounds a conversion; long stickers render many frames.
+	stickerTimeout = time.Minute
+	// maxStickerSize bounds the Lottie JSON downloaded; Discord caps sticker
+	// uploads at 512 KiB.
+	maxStickerSize = 1 << 20
+	// defaultStickerSize is the size Discord renders stickers at.
+	defaultStickerSize  = 320
+	maxStickerDimension = 512
+)
+
+// stickerURL is where Discord serves the Lottie JSON of a sticker. Unlike
+// attachments, sticker URLs aren't signed.
+const stickerURL = "https://" + mediaProxyHost + "/stickers/%d.json"
+
+// stickerFormats are the formats Lottie stickers are converted to, with the
+// lottie-converter script producing each and its content type.
+var stickerFormats = map[string]struct {
+	script      string
+	contentType string
+}{
+	"gif":  {"lottie_to_gif.sh", "image/gif"},
+	"apng": {"lottie_to_apng.sh", "image/apng"},
+	"webp": {"lottie_to_webp.sh", "image/webp"},
+}
+
+var errStickerNotFound = errors.New("sticker not found")
+
+// StickerRenderer converts Discord's Lottie stickers, which browsers can't
+// display, to animated images using lottie-converter's scripts, caching the
+// results alongside other image variants.
+type StickerRenderer struct {
+	client *DiscordClient
+	cache  *ByteCache
+	// scripts holds the path of the script for each format found.
+	scripts map[string]string
+}
+
+// NewStickerRenderer looks up lottie-converter's scripts in dir, or on the
+// PATH if dir is empty, returning nil if none is found.
+func NewStickerRenderer(client *DiscordClient, cache *ByteCache, dir string) *StickerRenderer {
+	scripts := map[string]string{}
+	for format, f := range stickerFormats {
+		name := f.script
+		if dir != "" {
+			name = filepath.Join(dir, name)
+		}
+		if path, err := exec.LookPath(name); err == nil {
+			scripts[format] = path
+		}
+	}
+	if len(scripts) == 0 {
+		logAt(slog.LevelDebug, "Lottie sticker conversion disabled: lottie-converter not found")
+		return nil
+	}
+	return &StickerRenderer{client: client, cache: cache, scripts: scripts}
+}
+
+func stickerCacheKey(stickerID int64, format string, size int) string {
+	return fmt.Sprintf("sticker/%d/%s/%d", stickerID, format, size)
+}
+
+func (s *StickerRenderer) Cached(stickerID int64, format string, size int) ([]byte, string, bool) {
+	return s.cache.Get(stickerCacheKey(stickerID, format, size))
+}
+
+// Render downloads a sticker's Lottie JSON and converts it to format at size
+// pixels square. The scripts only read and write files, so the conversion
+// goes through a temporary directory.
+func (s *StickerRenderer) Render(ctx context.Context, stickerID int64, format string, size int) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stickerTimeout)
+	defer cancel()
+
+	lottie, err := s.download(ctx, stickerID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir, err := os.MkdirTemp("", "sticker-")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "sticker.json"), filepath.Join(dir, "sticker."+format)
+	if err := os.WriteFile(input, lottie, 0o600); err != nil {
+		return nil, "", fmt.Errorf("failed to write sticker: %w", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.scripts[format],
+		"--output", output,
+		"--width", strconv.Itoa(size),
+		"--height", strconv.Itoa(size),
+		input,
+	)
+	cmd.Stderr = &stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("lottie-converter failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	image, err := os.ReadFile(output)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read converted sticker: %w", err)
+	}
+	logAt(slog.LevelDebug, "Converted sticker %d to %s in %s", stickerID, format, time.Since(start).Round(time.Millisecond))
+	metrics.Count("stickers.converted", 1, "format:"+format)
+
+	contentType := stickerFormats[format].contentType
+	s.cache.Put(stickerCacheKey(stickerID, format, size), contentType, image)
+	return image, contentType, nil
+}
+
+func (s *StickerRenderer) download(ctx context.Context, stickerID int64) ([]byte, error) {
+	resp, err := s.client.Download(ctx, fmt.Sprintf(stickerURL, stickerID), "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Stickers that aren't Lottie have no JSON.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errStickerNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	lottie, err := io.ReadAll(io.LimitReader(resp.Body, maxStickerSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sticker: %w", err)
+	}
+	if len(lottie) > maxStickerSize {
+		return nil, errImageTooLarge
+	}
+	return lottie, nil
+}
+
+func handleSticker(stickers *StickerRenderer) HandlerFunc {
+	return func(c *Context) {
+		stickerID, err := strconv.ParseInt(c.Param("stickerID"), 10, 64)
+		if err != nil || !validSnowflake(stickerID) {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid sticker ID")
+			return
+		}
+
+		format := c.DefaultQuery("fmt", "gif")
+		if _, ok := stickers.scripts[format]; !ok {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Format must be one of "+stickers.formatList())
+			return
+		}
+		size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultStickerSize)))
+		if err != nil || size < 16 || size > maxStickerDimension {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Size must be between 16 and %d", maxStickerDimension))
+			return
+		}
+
+		image, contentType, ok := stickers.Cached(stickerID, format, size)
+		if !ok {
+			image, contentType, err = stickers.Render(c.Request.Context(), stickerID, format, size)
+		}
+		switch {
+		case errors.Is(err, errStickerNotFound):
+			respondError(c, http.StatusNotFound, codeNotFound, "Sticker not found or not a Lottie sticker")
+		case errors.Is(err, errImageTooLarge):
+			respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Sticker is too large to convert")
+		case err != nil:
+			logf(c, slog.LevelError, "Error converting sticker: %v", err)
+			reportError(c, err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to convert sticker")
+		default:
+			// Stickers can't be edited, so a conversion never goes stale.
+			c.Header("Cache-Control", "public, max-age=31536000, immutable")
+			c.Data(http.StatusOK, contentType, image)
+		}
+	}
+}
+
+// formatList names the formats stickers can be converted to, in a fixed
+// order.
+func (s *StickerRenderer) formatList() string {
+	var list string
+	for _, format := range []string{"gif", "apng", "webp"} {
+		if _, ok := s.scripts[format]; !ok {
+			continue
+		}
+		if list != "" {
+			list += ", "
+		}
+		list += format
+	}
+	return list
+}
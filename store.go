@@ -0,0 +1,905 @@
+package discordcdn
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Chunk struct {
+	ChannelID int64  `json:"channelID"`
+	FileID    int64  `json:"fileID"`
+	FileName  string `json:"fileName"`
+	Size      int64  `json:"size"`
+}
+
+type Manifest struct {
+	ID          string    `json:"id"`
+	FileName    string    `json:"fileName"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Chunks      []Chunk   `json:"chunks"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ShortLink struct {
+	Slug string `json:"slug"`
+	LinkData
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IndexedAttachment is an attachment seen by the gateway indexer or looked
+// up by the enricher. Content is the start of the message's text.
+type IndexedAttachment struct {
+	LinkData
+	GuildID     int64     `json:"guildID,omitempty"`
+	MessageID   int64     `json:"messageID"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	UploaderID  int64     `json:"uploaderID"`
+	Uploader    string    `json:"uploader"`
+	MessageURL  string    `json:"messageURL"`
+	Content     string    `json:"content,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// DurationSecs and Waveform are set on voice messages, the waveform
+	// base64 encoded as Discord sends it.
+	DurationSecs float64 `json:"durationSecs,omitempty"`
+	Waveform     string  `json:"waveform,omitempty"`
+}
+
+type storeData struct {
+	// Version is the schema version of the document; see storeMigrations.
+	Version     int                           `json:"version"`
+	Manifests   map[string]*Manifest          `json:"manifests"`
+	ShortLinks  map[string]*ShortLink         `json:"shortLinks"`
+	Permalinks  map[string]*Permalink         `json:"permalinks"`
+	Aliases     map[string]*Alias             `json:"aliases"`
+	Usage       *UsageData                    `json:"usage"`
+	Attachments map[string]*IndexedAttachment `json:"attachments"`
+	// Accessed holds when each manifest, short link and indexed attachment
+	// was last served, keyed by recordKey.
+	Accessed map[string]time.Time `json:"accessed"`
+	// UsedShares holds when each used one-time share link expires, keyed
+	// by its ID.
+	UsedShares map[string]time.Time `json:"usedShares"`
+	// Checksums holds the checksums of attachments' content, keyed by file
+	// ID, which never changes for a given file.
+	Checksums map[string]*Checksum `json:"checksums"`
+	// Flagged holds the files the virus scanner found infected, keyed as in
+	// FlaggedFile, so they stay blocked without being scanned again.
+	Flagged map[string]*FlaggedFile `json:"flagged"`
+	// Moderation holds the moderation verdicts on attachments, keyed by
+	// file ID.
+	Moderation map[string]*ModerationVerdict `json:"moderation"`
+	// Takedowns holds the attachments that must not be served, keyed by
+	// file ID or SHA-256.
+	Takedowns map[string]*Takedown `json:"takedowns"`
+	// Reports holds the abuse reports on attachments, keyed by ID.
+	Reports map[string]*Report `json:"reports"`
+}
+
+var errSlugTaken = errors.New("slug already in use")
+
+// errReportQueueFull is returned when too many reports await review to take
+// another.
+var errReportQueueFull = errors.New("report queue full")
+
+// Store persists service data as a single JSON document, on disk or in a
+// database.
+type Store struct {
+	mu   sync.RWMutex
+	path string
+	// db, when set, holds the document in place of the file at path.
+	db   *sqlStore
+	data storeData
+
+	// accessed buffers the access times Touch records, keyed by recordKey,
+	// until the janitor merges them into data. accessedKeys counts them.
+	accessed     sync.Map
+	accessedKeys atomic.Int64
+}
+
+func OpenStore(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.data.Version = storeVersion
+		s.data.init()
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+
+	from, err := s.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if from < storeVersion {
+		if err := backupStore(path, raw, from); err != nil {
+			return nil, err
+		}
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		log.Printf("Migrated store %s from version %d to %d", path, from, storeVersion)
+	}
+	return s, nil
+}
+
+// decode loads the store document raw, upgrading it to the current version,
+// and returns the version it was at.
+func (s *Store) decode(raw []byte) (int, error) {
+	migrated, from, err := migrateStoreDocument(raw)
+	if err != nil {
+		return from, err
+	}
+	if err := json.Unmarshal(migrated, &s.data); err != nil {
+		return from, fmt.Errorf("failed to decode store: %w", err)
+	}
+	s.data.init()
+	return from, nil
+}
+
+// init allocates any collections missing from a freshly created or older
+// store document.
+func (d *storeData) init() {
+	if d.Manifests == nil {
+		d.Manifests = map[string]*Manifest{}
+	}
+	if d.ShortLinks == nil {
+		d.ShortLinks = map[string]*ShortLink{}
+	}
+	if d.Attachments == nil {
+		d.Attachments = map[string]*IndexedAttachment{}
+	}
+	if d.Accessed == nil {
+		d.Accessed = map[string]time.Time{}
+	}
+	if d.Permalinks == nil {
+		d.Permalinks = map[string]*Permalink{}
+	}
+	if d.Aliases == nil {
+		d.Aliases = map[string]*Alias{}
+	}
+	if d.UsedShares == nil {
+		d.UsedShares = map[string]time.Time{}
+	}
+	if d.Checksums == nil {
+		d.Checksums = map[string]*Checksum{}
+	}
+	if d.Flagged == nil {
+		d.Flagged = map[string]*FlaggedFile{}
+	}
+	if d.Moderation == nil {
+		d.Moderation = map[string]*ModerationVerdict{}
+	}
+	if d.Takedowns == nil {
+		d.Takedowns = map[string]*Takedown{}
+	}
+	if d.Reports == nil {
+		d.Reports = map[string]*Report{}
+	}
+	if d.Usage == nil {
+		d.Usage = newUsageData()
+	}
+	if d.Usage.Hours == nil {
+		d.Usage.Hours = map[string]*UsageCounts{}
+	}
+	if d.Usage.Channels == nil {
+		d.Usage.Channels = map[string]*UsageCounts{}
+	}
+	if d.Usage.Attachments == nil {
+		d.Usage.Attachments = map[string]*AttachmentUsage{}
+	}
+	if d.Usage.Keys == nil {
+		d.Usage.Keys = map[string]map[string]int64{}
+	}
+	if d.Usage.ChannelDays == nil {
+		d.Usage.ChannelDays = map[string]map[string]*UsageCounts{}
+	}
+}
+
+func (s *Store) Manifest(id string) (*Manifest, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.data.Manifests[id]
+	return m, ok
+}
+
+func (s *Store) PutManifest(m *Manifest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Manifests[m.ID] = m
+	return s.save()
+}
+
+func (s *Store) ShortLink(slug string) (*ShortLink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	link, ok := s.data.ShortLinks[slug]
+	return link, ok
+}
+
+// AddShortLink stores link, returning errSlugTaken if its slug is already
+// mapped.
+func (s *Store) AddShortLink(link *ShortLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.ShortLinks[link.Slug]; ok {
+		return errSlugTaken
+	}
+	s.data.ShortLinks[link.Slug] = link
+	return s.save()
+}
+
+func (s *Store) Permalink(id string) (*Permalink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	link, ok := s.data.Permalinks[id]
+	return link, ok
+}
+
+// AddPermalink stores link, returning errSlugTaken if its ID is already
+// mapped.
+func (s *Store) AddPermalink(link *Permalink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Permalinks[link.ID]; ok {
+		return errSlugTaken
+	}
+	s.data.Permalinks[link.ID] = link
+	return s.save()
+}
+
+// UpdatePermalink points a permalink at data and returns where it pointed
+// before.
+func (s *Store) UpdatePermalink(id string, data LinkData) (LinkData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.data.Permalinks[id]
+	if !ok {
+		return LinkData{}, errPermalinkNotFound
+	}
+	// Readers hold on to the old record, so it is replaced rather than
+	// changed in place.
+	updated := *link
+	updated.LinkData = data
+	updated.UpdatedAt = time.Now().UTC()
+	s.data.Permalinks[id] = &updated
+	if err := s.save(); err != nil {
+		s.data.Permalinks[id] = link
+		return LinkData{}, err
+	}
+	return link.LinkData, nil
+}
+
+// Alias looks up an alias by name, ignoring case.
+func (s *Store) Alias(name string) (*Alias, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	alias, ok := s.data.Aliases[strings.ToLower(name)]
+	return alias, ok
+}
+
+// AddAlias stores alias, returning errSlugTaken and the alias holding the
+// name if it is already taken in any case.
+func (s *Store) AddAlias(alias *Alias) (*Alias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(alias.Name)
+	if existing, ok := s.data.Aliases[key]; ok {
+		return existing, errSlugTaken
+	}
+	s.data.Aliases[key] = alias
+	if err := s.save(); err != nil {
+		delete(s.data.Aliases, key)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// UpdateAlias points an alias at data, returning the updated alias and
+// where it pointed before.
+func (s *Store) UpdateAlias(name string, data LinkData) (*Alias, LinkData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(name)
+	alias, ok := s.data.Aliases[key]
+	if !ok {
+		return nil, LinkData{}, errAliasNotFound
+	}
+	updated := *alias
+	updated.LinkData = data
+	updated.UpdatedAt = time.Now().UTC()
+	s.data.Aliases[key] = &updated
+	if err := s.save(); err != nil {
+		s.data.Aliases[key] = alias
+		return nil, LinkData{}, err
+	}
+	return &updated, alias.LinkData, nil
+}
+
+// DeleteAlias removes an alias and returns it.
+func (s *Store) DeleteAlias(name string) (*Alias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(name)
+	alias, ok := s.data.Aliases[key]
+	if !ok {
+		return nil, errAliasNotFound
+	}
+	delete(s.data.Aliases, key)
+	if err := s.save(); err != nil {
+		s.data.Aliases[key] = alias
+		return nil, err
+	}
+	return alias, nil
+}
+
+// Aliases returns copies of every alias, sorted by name.
+func (s *Store) Aliases() []Alias {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	aliases := make([]Alias, 0, len(s.data.Aliases))
+	for _, alias := range s.data.Aliases {
+		aliases = append(aliases, *alias)
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return strings.ToLower(aliases[i].Name) < strings.ToLower(aliases[j].Name)
+	})
+	return aliases
+}
+
+// AliasImport is the outcome of Store.ImportAliases.
+type AliasImport struct {
+	Created int
+	// Moved holds where each replaced alias pointing at another file
+	// pointed before.
+	Moved []LinkData
+	// Taken holds the indexes of the aliases whose name was already taken,
+	// when not replacing.
+	Taken []int
+}
+
+// ImportAliases stores aliases at once, with a single save. Unless replace is
+// set, nothing is stored if any of their names is taken. With dryRun set,
+// nothing is stored either way.
+func (s *Store) ImportAliases(aliases []*Alias, replace, dryRun bool) (*AliasImport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := &AliasImport{}
+	replaced := map[string]*Alias{}
+	for i, alias := range aliases {
+		key := strings.ToLower(alias.Name)
+		existing, ok := s.data.Aliases[key]
+		switch {
+		case !ok:
+			result.Created++
+		case !replace:
+			result.Taken = append(result.Taken, i)
+		default:
+			replaced[key] = existing
+			if existing.FileID != alias.FileID {
+				result.Moved = append(result.Moved, existing.LinkData)
+			}
+		}
+	}
+	if dryRun || len(result.Taken) > 0 {
+		return result, nil
+	}
+
+	for _, alias := range aliases {
+		key := strings.ToLower(alias.Name)
+		if existing, ok := replaced[key]; ok {
+			updated := *alias
+			updated.Name = existing.Name
+			updated.CreatedAt = existing.CreatedAt
+			alias = &updated
+		}
+		s.data.Aliases[key] = alias
+	}
+	if err := s.save(); err != nil {
+		for _, alias := range aliases {
+			key := strings.ToLower(alias.Name)
+			if existing, ok := replaced[key]; ok {
+				s.data.Aliases[key] = existing
+			} else {
+				delete(s.data.Aliases, key)
+			}
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// IndexAttachments records attachments, keyed by file ID, replacing any
+// earlier entry for the same file.
+func (s *Store) IndexAttachments(attachments []*IndexedAttachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attachments {
+		s.data.Attachments[strconv.FormatInt(a.FileID, 10)] = a
+	}
+	return s.save()
+}
+
+// ClaimShare records a one-time share link as used until it expires,
+// reporting whether it wasn't already. Links that have expired are
+// forgotten along the way.
+func (s *Store) ClaimShare(id string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.UsedShares[id]; ok {
+		return false, nil
+	}
+	now := time.Now()
+	for used, at := range s.data.UsedShares {
+		if now.After(at) {
+			delete(s.data.UsedShares, used)
+		}
+	}
+	s.data.UsedShares[id] = expires.UTC()
+	if err := s.save(); err != nil {
+		delete(s.data.UsedShares, id)
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseShare records a one-time share link as unused again.
+func (s *Store) ReleaseShare(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.UsedShares, id)
+	return s.save()
+}
+
+// HasAttachment reports whether an attachment is indexed.
+func (s *Store) HasAttachment(fileID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.data.Attachments[strconv.FormatInt(fileID, 10)]
+	return ok
+}
+
+// IndexedAttachment returns an indexed attachment.
+func (s *Store) IndexedAttachment(fileID int64) (*IndexedAttachment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.data.Attachments[strconv.FormatInt(fileID, 10)]
+	return a, ok
+}
+
+// Checksum returns the recorded checksum of an attachment.
+func (s *Store) Checksum(fileID int64) (*Checksum, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sum, ok := s.data.Checksums[strconv.FormatInt(fileID, 10)]
+	return sum, ok
+}
+
+// AddChecksum records the checksum of an attachment.
+func (s *Store) AddChecksum(sum *Checksum) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(sum.FileID, 10)
+	s.data.Checksums[key] = sum
+	if err := s.save(); err != nil {
+		delete(s.data.Checksums, key)
+		return err
+	}
+	return nil
+}
+
+// Flagged returns the record of a file the virus scanner found infected.
+func (s *Store) Flagged(key string) (*FlaggedFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flag, ok := s.data.Flagged[key]
+	return flag, ok
+}
+
+// FlagFile records a file the virus scanner found infected.
+func (s *Store) FlagFile(flag *FlaggedFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.data.Flagged[flag.Key]
+	s.data.Flagged[flag.Key] = flag
+	if err := s.save(); err != nil {
+		if existed {
+			s.data.Flagged[flag.Key] = previous
+		} else {
+			delete(s.data.Flagged, flag.Key)
+		}
+		return err
+	}
+	return nil
+}
+
+// AllowFlagged marks a flagged file as a false positive, to be served
+// without being scanned again, reporting whether it was flagged.
+func (s *Store) AllowFlagged(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flag, ok := s.data.Flagged[key]
+	if !ok {
+		return false, nil
+	}
+	if flag.Allowed {
+		return true, nil
+	}
+	allowed := *flag
+	allowed.Allowed = true
+	s.data.Flagged[key] = &allowed
+	if err := s.save(); err != nil {
+		s.data.Flagged[key] = flag
+		return false, err
+	}
+	return true, nil
+}
+
+// FlaggedFiles returns copies of every flag, most recent first.
+func (s *Store) FlaggedFiles() []FlaggedFile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := make([]FlaggedFile, 0, len(s.data.Flagged))
+	for _, flag := range s.data.Flagged {
+		flags = append(flags, *flag)
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].FlaggedAt.After(flags[j].FlaggedAt)
+	})
+	return flags
+}
+
+// ModerationVerdict returns the moderation verdict on an attachment.
+func (s *Store) ModerationVerdict(fileID int64) (*ModerationVerdict, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	verdict, ok := s.data.Moderation[strconv.FormatInt(fileID, 10)]
+	return verdict, ok
+}
+
+// SetModerationVerdict records the moderation verdict on an attachment.
+func (s *Store) SetModerationVerdict(verdict *ModerationVerdict) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(verdict.FileID, 10)
+	previous, existed := s.data.Moderation[key]
+	s.data.Moderation[key] = verdict
+	if err := s.save(); err != nil {
+		if existed {
+			s.data.Moderation[key] = previous
+		} else {
+			delete(s.data.Moderation, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteModerationVerdict drops the moderation verdict on an attachment,
+// reporting whether there was one.
+func (s *Store) DeleteModerationVerdict(fileID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(fileID, 10)
+	verdict, ok := s.data.Moderation[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.data.Moderation, key)
+	if err := s.save(); err != nil {
+		s.data.Moderation[key] = verdict
+		return false, err
+	}
+	return true, nil
+}
+
+// ModerationVerdicts returns copies of the moderation verdicts that match,
+// most recent first.
+func (s *Store) ModerationVerdicts(match func(*ModerationVerdict) bool) []ModerationVerdict {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	verdicts := []ModerationVerdict{}
+	for _, verdict := range s.data.Moderation {
+		if match(verdict) {
+			verdicts = append(verdicts, *verdict)
+		}
+	}
+	sort.Slice(verdicts, func(i, j int) bool {
+		return verdicts[i].CheckedAt.After(verdicts[j].CheckedAt)
+	})
+	return verdicts
+}
+
+// Takedown returns the takedown covering an attachment, by its file ID or
+// the SHA-256 recorded for its content.
+func (s *Store) Takedown(fileID int64) (*Takedown, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := strconv.FormatInt(fileID, 10)
+	if t, ok := s.data.Takedowns[key]; ok {
+		return t, true
+	}
+	if sum, ok := s.data.Checksums[key]; ok {
+		t, ok := s.data.Takedowns[sum.SHA256]
+		return t, ok
+	}
+	return nil, false
+}
+
+// AddTakedown records a takedown, replacing any with the same key.
+func (s *Store) AddTakedown(t *Takedown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := t.Key()
+	previous, existed := s.data.Takedowns[key]
+	s.data.Takedowns[key] = t
+	if err := s.save(); err != nil {
+		if existed {
+			s.data.Takedowns[key] = previous
+		} else {
+			delete(s.data.Takedowns, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteTakedown lifts a takedown, reporting whether there was one.
+func (s *Store) DeleteTakedown(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.data.Takedowns[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.data.Takedowns, key)
+	if err := s.save(); err != nil {
+		s.data.Takedowns[key] = t
+		return false, err
+	}
+	return true, nil
+}
+
+// Takedowns returns copies of every takedown, most recent first.
+func (s *Store) Takedowns() []Takedown {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	takedowns := make([]Takedown, 0, len(s.data.Takedowns))
+	for _, t := range s.data.Takedowns {
+		takedowns = append(takedowns, *t)
+	}
+	sort.Slice(takedowns, func(i, j int) bool {
+		return takedowns[i].CreatedAt.After(takedowns[j].CreatedAt)
+	})
+	return takedowns
+}
+
+// FilesWithSHA256 returns the file IDs of the attachments whose recorded
+// checksum is sum.
+func (s *Store) FilesWithSHA256(sum string) []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var fileIDs []int64
+	for _, c := range s.data.Checksums {
+		if c.SHA256 == sum {
+			fileIDs = append(fileIDs, c.FileID)
+		}
+	}
+	return fileIDs
+}
+
+// Report returns a copy of an abuse report.
+func (s *Store) Report(id string) (Report, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.data.Reports[id]
+	if !ok {
+		return Report{}, false
+	}
+	return *r, true
+}
+
+// AddReport records an abuse report, unless maxOpen reports are already
+// open.
+func (s *Store) AddReport(r *Report, maxOpen int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	open := 0
+	for _, existing := range s.data.Reports {
+		if existing.Status == reportOpen {
+			open++
+		}
+	}
+	if open >= maxOpen {
+		return errReportQueueFull
+	}
+	s.data.Reports[r.ID] = r
+	if err := s.save(); err != nil {
+		delete(s.data.Reports, r.ID)
+		return err
+	}
+	return nil
+}
+
+// ResolveReports closes every open report on an attachment with status,
+// returning how many there were.
+func (s *Store) ResolveReports(fileID int64, status string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	var resolved []*Report
+	for id, r := range s.data.Reports {
+		if r.FileID != fileID || r.Status != reportOpen {
+			continue
+		}
+		closed := *r
+		closed.Status, closed.ResolvedAt = status, &now
+		s.data.Reports[id] = &closed
+		resolved = append(resolved, r)
+	}
+	if len(resolved) == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		for _, r := range resolved {
+			s.data.Reports[r.ID] = r
+		}
+		return 0, err
+	}
+	return len(resolved), nil
+}
+
+// DismissReport closes an open report without acting on it, reporting
+// whether the report exists.
+func (s *Store) DismissReport(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.data.Reports[id]
+	if !ok || r.Status != reportOpen {
+		return ok, nil
+	}
+	now := time.Now().UTC()
+	dismissed := *r
+	dismissed.Status, dismissed.ResolvedAt = reportDismissed, &now
+	s.data.Reports[id] = &dismissed
+	if err := s.save(); err != nil {
+		s.data.Reports[id] = r
+		return false, err
+	}
+	return true, nil
+}
+
+// Reports returns copies of the abuse reports that match, oldest first.
+func (s *Store) Reports(match func(*Report) bool) []Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reports := []Report{}
+	for _, r := range s.data.Reports {
+		if match(r) {
+			reports = append(reports, *r)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].CreatedAt.Before(reports[j].CreatedAt)
+	})
+	return reports
+}
+
+// FindAttachments returns copies of the indexed attachments that match.
+func (s *Store) FindAttachments(match func(*IndexedAttachment) bool) []IndexedAttachment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []IndexedAttachment
+	for _, a := range s.data.Attachments {
+		if match(a) {
+			found = append(found, *a)
+		}
+	}
+	return found
+}
+
+// MergeUsage adds delta to the persisted usage statistics.
+func (s *Store) MergeUsage(delta *UsageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Usage.merge(delta)
+	return s.save()
+}
+
+// Usage returns a copy of the persisted usage statistics.
+func (s *Store) Usage() *UsageData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usage := newUsageData()
+	for k, c := range s.data.Usage.Hours {
+		counts := *c
+		usage.Hours[k] = &counts
+	}
+	for k, c := range s.data.Usage.Channels {
+		counts := *c
+		usage.Channels[k] = &counts
+	}
+	for k, a := range s.data.Usage.Attachments {
+		attachment := *a
+		usage.Attachments[k] = &attachment
+	}
+	for id, days := range s.data.Usage.Keys {
+		usage.Keys[id] = maps.Clone(days)
+	}
+	for channel, days := range s.data.Usage.ChannelDays {
+		for day, c := range days {
+			usage.channelDay(channel, day).add(c)
+		}
+	}
+	return usage
+}
+
+// KeyRequests returns the persisted requests made with an API key from day
+// from to day to, inclusive.
+func (s *Store) KeyRequests(id, from, to string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.Usage.keyRequests(id, from, to)
+}
+
+// save writes the store to a temporary file and renames it into place so a
+// crash mid-write never leaves a truncated document behind, or to the
+// database when it is kept in one. Callers must hold the write lock.
+func (s *Store) save() error {
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+	if s.db != nil {
+		return s.db.save(raw)
+	}
+
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace store: %w", err)
+	}
+	return nil
+}
+
+const idAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func newID(length int) (string, error) {
+	max := big.NewInt(int64(len(idAlphabet)))
+	id := make([]byte, length)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate id: %w", err)
+		}
+		id[i] = idAlphabet[n.Int64()]
+	}
+	return string(id), nil
+}
@@ -0,0 +1,334 @@
+package discordcdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// storeMigration upgrades the store document from one schema version to the
+// next. It works on the raw document, so it keeps working however the Go
+// types change later. Stores kept in a database have their schema migrated
+// apart, by schemaMigrations.
+type storeMigration struct {
+	description string
+	apply       func(doc map[string]json.RawMessage) error
+}
+
+// storeMigrations upgrade the store document in order: the first takes a
+// document without a version to version 1, the next version 1 to 2, and so
+// on. Releases that change the document append a migration; existing ones
+// must never change.
+var storeMigrations = []storeMigration{
+	{
+		description: "Record the schema version and add collections missing from early documents",
+		apply: func(doc map[string]json.RawMessage) error {
+			for _, key := range []string{"manifests", "shortLinks", "attachments"} {
+				if raw, ok := doc[key]; !ok || string(raw) == "null" {
+					doc[key] = json.RawMessage("{}")
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "Track when records were last accessed, counting existing ones as accessed now",
+		apply: func(doc map[string]json.RawMessage) error {
+			accessed := map[string]time.Time{}
+			now := time.Now().UTC()
+			for _, kind := range []string{recordManifest, recordShortLink, recordAttachment} {
+				var records map[string]json.RawMessage
+				if err := json.Unmarshal(doc[recordCollections[kind]], &records); err != nil {
+					return err
+				}
+				for id := range records {
+					accessed[recordKey(kind, id)] = now
+				}
+			}
+			raw, err := json.Marshal(accessed)
+			doc["accessed"] = raw
+			return err
+		},
+	},
+	{
+		description: "Add the used one-time share links",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["usedShares"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add permalinks",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["permalinks"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add aliases",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["aliases"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add attachment checksums",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["checksums"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add files flagged by the virus scanner",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["flagged"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add moderation verdicts",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["moderation"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add takedowns",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["takedowns"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+	{
+		description: "Add abuse reports",
+		apply: func(doc map[string]json.RawMessage) error {
+			doc["reports"] = json.RawMessage("{}")
+			return nil
+		},
+	},
+}
+
+// storeVersion is the schema version of the documents this build writes.
+var storeVersion = len(storeMigrations)
+
+// documentVersion returns the schema version of a store document, 0 for one
+// written before versioning.
+func documentVersion(doc map[string]json.RawMessage) (int, error) {
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(raw))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid store version %s", raw)
+	}
+	if version > storeVersion {
+		return 0, fmt.Errorf("store is at version %d, newer than the %d this release supports; upgrade the server", version, storeVersion)
+	}
+	return version, nil
+}
+
+// migrateStoreDocument applies the migrations raw is missing and returns the
+// upgraded document along with the version it started at. A document that
+// is up to date is returned as is.
+func migrateStoreDocument(raw []byte) ([]byte, int, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode store: %w", err)
+	}
+	from, err := documentVersion(doc)
+	if err != nil || from == storeVersion {
+		return raw, from, err
+	}
+	for version := from; version < storeVersion; version++ {
+		if err := storeMigrations[version].apply(doc); err != nil {
+			return nil, from, fmt.Errorf("migration to version %d failed: %w", version+1, err)
+		}
+	}
+	doc["version"] = json.RawMessage(strconv.Itoa(storeVersion))
+	migrated, err := json.Marshal(doc)
+	return migrated, from, err
+}
+
+// pendingStoreMigrations returns the version of the store at path and how
+// many migrations it is missing. A store that doesn't exist yet needs none.
+func pendingStoreMigrations(path string) (version, pending int, err error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return storeVersion, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read store: %w", err)
+	}
+	return pendingDocumentMigrations(raw)
+}
+
+// pendingDocumentMigrations returns the version of the store document raw
+// and how many migrations it is missing.
+func pendingDocumentMigrations(raw []byte) (version, pending int, err error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode store: %w", err)
+	}
+	version, err = documentVersion(doc)
+	return version, storeVersion - version, err
+}
+
+// backupStore copies the store document before it is migrated, to
+// <path>.v<version>.bak, so a release can be rolled back along with its data.
+func backupStore(path string, raw []byte, version int) error {
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	if err := os.WriteFile(backup, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to back up store: %w", err)
+	}
+	return nil
+}
+
+// openStore opens the configured store, migrating it unless automatic
+// migration is off, in which case a store that needs migrating is an error.
+func openStore(config *Config) (*Store, error) {
+	if config.DatabaseURL != "" {
+		return openSQLStore(config)
+	}
+	if !config.StoreAutoMigrate {
+		version, pending, err := pendingStoreMigrations(config.DataPath)
+		if err != nil {
+			return nil, err
+		}
+		if pending > 0 {
+			return nil, fmt.Errorf("store %s is at version %d, %d behind this release; run discord-cdn migrate-store", config.DataPath, version, pending)
+		}
+	}
+	return OpenStore(config.DataPath)
+}
+
+// runMigrateStore implements the migrate-store subcommand, which upgrades the
+// store documents of the deployment and of every tenant, and the database
+// schema when stores are kept in one, for deployments that turn automatic
+// migration off.
+func runMigrateStore(args []string) error {
+	fs := flag.NewFlagSet("migrate-store", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report the migrations each store needs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: discord-cdn migrate-store [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if config.DatabaseURL != "" {
+		return migrateDatabase(config, *dryRun)
+	}
+	paths := []string{config.DataPath}
+	for _, t := range config.Tenants {
+		paths = append(paths, tenantPath(config.DataPath, t.Name))
+	}
+
+	for _, path := range paths {
+		version, pending, err := pendingStoreMigrations(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if pending == 0 {
+			fmt.Printf("%s: up to date at version %d\n", path, version)
+			continue
+		}
+		for v := version; v < storeVersion; v++ {
+			fmt.Printf("%s: %d -> %d: %s\n", path, v, v+1, storeMigrations[v].description)
+		}
+		if *dryRun {
+			continue
+		}
+		// Opening the store migrates it.
+		if _, err := OpenStore(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("%s: migrated to version %d\n", path, storeVersion)
+	}
+	return nil
+}
+
+// migrateDatabase is migrate-store for stores kept in DCDN_DATABASE_URL: it
+// migrates the schema, then the store document of every tenant.
+func migrateDatabase(config *Config, dryRun bool) error {
+	ctx := context.Background()
+	db, dialect, err := openDatabase(ctx, config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, pending, err := pendingSchemaMigrations(ctx, db, dialect)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("schema: up to date at version %d\n", version)
+	}
+	for _, m := range pending {
+		fmt.Printf("schema: %d -> %d: %s\n", m.version-1, m.version, m.description)
+	}
+	if dryRun {
+		// The stores can't be read before the schema is up to date.
+		if len(pending) > 0 {
+			return nil
+		}
+	} else if err := migrateSchema(ctx, db, dialect, pending); err != nil {
+		return err
+	}
+
+	configs := []*Config{config}
+	for _, t := range config.Tenants {
+		tenant, err := config.tenantConfig(t.Name)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, tenant)
+	}
+	for _, c := range configs {
+		name := "store"
+		if c.Tenant != "" {
+			name = "store of " + c.Tenant
+		}
+		backend := &sqlStore{db: db, dialect: dialect, name: c.Tenant}
+		raw, err := backend.load(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if raw == nil {
+			fmt.Printf("%s: empty\n", name)
+			continue
+		}
+		version, pending, err := pendingDocumentMigrations(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if pending == 0 {
+			fmt.Printf("%s: up to date at version %d\n", name, version)
+			continue
+		}
+		for v := version; v < storeVersion; v++ {
+			fmt.Printf("%s: %d -> %d: %s\n", name, v, v+1, storeMigrations[v].description)
+		}
+		if dryRun {
+			continue
+		}
+		s := &Store{db: backend}
+		if _, err := s.decode(raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := s.save(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("%s: migrated to version %d\n", name, storeVersion)
+	}
+	return nil
+}
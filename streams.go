@@ -0,0 +1,71 @@
+package discordcdn
+
+import (
+	"net/http"
+	"sync"
+)
+
+// streamRetryAfter is the Retry-After hint, in seconds, sent when a transfer
+// is turned away.
+const streamRetryAfter = "5"
+
+// StreamLimiter caps the number of simultaneous transfers, both overall and
+// per client IP. A zero limit disables that dimension.
+type StreamLimiter struct {
+	mu     sync.Mutex
+	global int
+	perIP  int
+	total  int
+	byIP   map[string]int
+}
+
+func NewStreamLimiter(global, perIP int) *StreamLimiter {
+	return &StreamLimiter{global: global, perIP: perIP, byIP: map[string]int{}}
+}
+
+// SetLimits changes the limits applied to new transfers. Transfers already in
+// flight are unaffected.
+func (l *StreamLimiter) SetLimits(global, perIP int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = global
+	l.perIP = perIP
+}
+
+func (l *StreamLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.global > 0 && l.total >= l.global {
+		return false
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return false
+	}
+	l.total++
+	l.byIP[ip]++
+	return true
+}
+
+func (l *StreamLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+func limitStreams(limiter *StreamLimiter) HandlerFunc {
+	return func(c *Context) {
+		ip := c.ClientIP()
+		if !limiter.acquire(ip) {
+			c.Header("Retry-After", streamRetryAfter)
+			respondError(c, http.StatusServiceUnavailable, codeTooManyTransfers, "Too many concurrent transfers")
+			return
+		}
+		defer limiter.release(ip)
+		c.Next()
+	}
+}
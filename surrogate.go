@@ -0,0 +1,33 @@
+package discordcdn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// setSurrogateKeys tags the response with the attachment's channel and file,
+// so a CDN in front of the server can purge every cached response for one
+// attachment, or a whole channel, in one call. Fastly reads Surrogate-Key,
+// space-separated, and Cloudflare reads Cache-Tag, comma-separated.
+func setSurrogateKeys(c *Context, data *LinkData) {
+	var b strings.Builder
+	var ids [20]byte
+	b.Grow(2 * (len("channel- file-") + 2*len(ids)))
+	for _, sep := range []byte{' ', ','} {
+		b.WriteString("channel-")
+		b.Write(strconv.AppendInt(ids[:0], data.ChannelID, 10))
+		b.WriteByte(sep)
+		b.WriteString("file-")
+		b.Write(strconv.AppendInt(ids[:0], data.FileID, 10))
+	}
+	// Both headers share one string: the space-separated keys followed by
+	// the comma-separated ones, which are the same length.
+	keys := b.String()
+	c.Header("Surrogate-Key", keys[:len(keys)/2])
+	c.Header("Cache-Tag", keys[len(keys)/2:])
+}
+
+func fileSurrogateKey(fileID int64) string {
+	return fmt.Sprintf("file-%d", fileID)
+}
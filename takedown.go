@@ -0,0 +1,227 @@
+package discordcdn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Takedown keeps an attachment from being served, such as to honor a DMCA
+// notice. It covers either a single attachment, by file ID, or every
+// attachment with the same content, by SHA-256.
+type Takedown struct {
+	FileID int64  `json:"fileID,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Status is answered for the attachment: 451 for content removed for
+	// legal reasons, 410 for content gone for good.
+	Status int `json:"status"`
+	// Reason is kept for the record, such as a notice's reference, and is
+	// never shown to clients.
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Key returns the key a takedown is stored and removed under: the file ID
+// or the hash.
+func (t *Takedown) Key() string {
+	if t.SHA256 != "" {
+		return t.SHA256
+	}
+	return strconv.FormatInt(t.FileID, 10)
+}
+
+// TakedownRequest is the body of POST /admin/takedowns, with either a file
+// ID or a SHA-256.
+type TakedownRequest struct {
+	FileID int64  `json:"fileID,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Status is 451, the default, or 410.
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// TakedownError is returned when refreshing an attachment taken down.
+type TakedownError struct {
+	FileID int64
+	Status int
+}
+
+func (e *TakedownError) Error() string {
+	return fmt.Sprintf("attachment %d was taken down", e.FileID)
+}
+
+// Takedowns keeps the attachments taken down in the store, and removes their
+// mirrored copies along with them.
+type Takedowns struct {
+	store      *Store
+	mirrorPath string
+}
+
+func NewTakedowns(store *Store, mirrorPath string) *Takedowns {
+	return &Takedowns{store: store, mirrorPath: mirrorPath}
+}
+
+// SetTakedowns sets the takedowns attachments are checked against.
+func (c *DiscordClient) SetTakedowns(takedowns *Takedowns) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.takedowns = takedowns
+}
+
+// Takedowns returns the takedowns, or nil if there are none.
+func (c *DiscordClient) Takedowns() *Takedowns {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.takedowns
+}
+
+// takedown returns the takedown covering an attachment, or nil if it may be
+// served.
+func (c *DiscordClient) takedown(fileID int64) *Takedown {
+	takedowns := c.Takedowns()
+	if takedowns == nil {
+		return nil
+	}
+	t, _ := takedowns.store.Takedown(fileID)
+	return t
+}
+
+// takenDown reports whether an attachment was taken down, responding with
+// an error if so.
+func takenDown(c *Context, client *DiscordClient, fileID int64) bool {
+	t := client.takedown(fileID)
+	if t == nil {
+		return false
+	}
+	logf(c, slog.LevelInfo, "Refused %d, taken down", fileID)
+	metrics.Count("takedowns.refused", 1)
+	respondError(c, t.Status, codeTakenDown, "Attachment was taken down")
+	return true
+}
+
+// removeMirrored deletes the mirrored copies of an attachment, returning how
+// many there were.
+func (t *Takedowns) removeMirrored(fileID int64) int {
+	if t.mirrorPath == "" {
+		return 0
+	}
+	dirs, _ := filepath.Glob(filepath.Join(t.mirrorPath, "*", strconv.FormatInt(fileID, 10)))
+	removed := 0
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logAt(slog.LevelError, "Failed to remove mirrored copy %s: %v", dir, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// purge removes every copy of the attachments a takedown covers: URLs and
+// content cached here and on other replicas, responses cached at the edge
+// and mirrored copies. It returns the file IDs purged.
+func (t *Takedowns) purge(client *DiscordClient, takedown *Takedown) []int64 {
+	fileIDs := []int64{takedown.FileID}
+	if takedown.SHA256 != "" {
+		fileIDs = t.store.FilesWithSHA256(takedown.SHA256)
+	}
+	client.mu.RLock()
+	purger := client.purger
+	client.mu.RUnlock()
+	for _, fileID := range fileIDs {
+		purger.Purge(fileSurrogateKey(fileID))
+		client.invalidateAttachment(fileID)
+		t.removeMirrored(fileID)
+	}
+	return fileIDs
+}
+
+func handleTakedowns(store *Store) HandlerFunc {
+	return func(c *Context) {
+		c.JSON(http.StatusOK, H{"takedowns": store.Takedowns()})
+	}
+}
+
+// handleAddTakedown takes an attachment down and purges its copies.
+func handleAddTakedown(client *DiscordClient, takedowns *Takedowns) HandlerFunc {
+	return func(c *Context) {
+		var req TakedownRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid request body")
+			return
+		}
+		req.SHA256 = strings.ToLower(req.SHA256)
+		switch {
+		case (req.FileID == 0) == (req.SHA256 == ""):
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Exactly one of fileID and sha256 is required")
+			return
+		case req.FileID != 0 && !validSnowflake(req.FileID):
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid file ID")
+			return
+		case req.SHA256 != "" && !validSHA256(req.SHA256):
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "sha256 must be 64 hex digits")
+			return
+		}
+		if req.Status == 0 {
+			req.Status = http.StatusUnavailableForLegalReasons
+		}
+		if req.Status != http.StatusUnavailableForLegalReasons && req.Status != http.StatusGone {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "status must be 451 or 410")
+			return
+		}
+
+		takedown := &Takedown{
+			FileID:    req.FileID,
+			SHA256:    req.SHA256,
+			Status:    req.Status,
+			Reason:    req.Reason,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := takedowns.store.AddTakedown(takedown); err != nil {
+			logf(c, slog.LevelError, "Failed to save takedown: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to save takedown")
+			return
+		}
+		purged := takedowns.purge(client, takedown)
+		logf(c, slog.LevelWarn, "Took down %s (%s), purging %d attachments", takedown.Key(), takedown.Reason, len(purged))
+		c.JSON(http.StatusCreated, H{"takedown": takedown, "purged": purged})
+	}
+}
+
+// handleDeleteTakedown lifts a takedown, by file ID or SHA-256.
+func handleDeleteTakedown(store *Store) HandlerFunc {
+	return func(c *Context) {
+		key := strings.ToLower(c.Param("key"))
+		found, err := store.DeleteTakedown(key)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to delete takedown: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to delete takedown")
+			return
+		}
+		if !found {
+			respondError(c, http.StatusNotFound, codeNotFound, "No takedown with this key")
+			return
+		}
+		logf(c, slog.LevelWarn, "Lifted takedown of %s", key)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// validSHA256 reports whether s is a lowercase hex SHA-256.
+func validSHA256(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
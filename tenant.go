@@ -0,0 +1,245 @@
+package discordcdn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Tenant is one community served by a multi-tenant deployment, with its own
+// tokens, API keys, data and limits. Requests reach it through its hosts, or
+// through its path prefix on any host no tenant claims.
+type Tenant struct {
+	Name     string   `json:"name"`
+	Hosts    []string `json:"hosts,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Token    string   `json:"token"`
+	TokenMap string   `json:"tokenMap,omitempty"`
+	// ShardTokens are the tenant's own tokens to shard its channels across.
+	ShardTokens []string `json:"shardTokens,omitempty"`
+	APIKeys     []string `json:"apiKeys,omitempty"`
+	AdminKeys   []string `json:"adminKeys,omitempty"`
+	// Channels and Guilds, when either is set, are the only channels and
+	// guilds whose attachments the tenant serves.
+	Channels        []int64  `json:"channels,omitempty"`
+	Guilds          []int64  `json:"guilds,omitempty"`
+	HotlinkAllow    []string `json:"hotlinkAllow,omitempty"`
+	PublicURL       string   `json:"publicURL,omitempty"`
+	UploadChannelID int64    `json:"uploadChannelID,omitempty"`
+	// Quotas left out are inherited from the deployment's settings.
+	KeyDailyQuota   *int64 `json:"keyDailyQuota,omitempty"`
+	KeyMonthlyQuota *int64 `json:"keyMonthlyQuota,omitempty"`
+	RequestsPerKey  *int64 `json:"requestsPerKey,omitempty"`
+
+	tokenMap []TokenRule
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// parseTenants reads a JSON array of tenants and checks that their names,
+// hosts and prefixes don't overlap.
+func parseTenants(raw string) ([]Tenant, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var tenants []Tenant
+	if err := decoder.Decode(&tenants); err != nil {
+		return nil, fmt.Errorf("must be a JSON array of tenants: %w", err)
+	}
+
+	names, hosts, prefixes := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for i := range tenants {
+		t := &tenants[i]
+		if !tenantNamePattern.MatchString(t.Name) {
+			return nil, fmt.Errorf("tenant %d: name must be lowercase letters, digits and dashes, got %q", i+1, t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %s is listed twice", t.Name)
+		}
+		names[t.Name] = true
+		if t.Token == "" {
+			return nil, fmt.Errorf("tenant %s has no token", t.Name)
+		}
+		if len(t.Hosts) == 0 && t.Prefix == "" {
+			return nil, fmt.Errorf("tenant %s needs hosts or a prefix", t.Name)
+		}
+		for j, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || strings.ContainsAny(host, ":/") {
+				return nil, fmt.Errorf("tenant %s: host %q must be a bare hostname", t.Name, host)
+			}
+			if hosts[host] {
+				return nil, fmt.Errorf("tenant %s: host %s belongs to another tenant", t.Name, host)
+			}
+			hosts[host] = true
+			t.Hosts[j] = host
+		}
+		if t.Prefix != "" {
+			if !strings.HasPrefix(t.Prefix, "/") || strings.HasSuffix(t.Prefix, "/") || strings.Count(t.Prefix, "/") != 1 {
+				return nil, fmt.Errorf("tenant %s: prefix must be a single path segment such as /%s", t.Name, t.Name)
+			}
+			if prefixes[t.Prefix] {
+				return nil, fmt.Errorf("tenant %s: prefix %s belongs to another tenant", t.Name, t.Prefix)
+			}
+			prefixes[t.Prefix] = true
+		}
+		rules, err := parseTokenMap(t.TokenMap)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: token map: %w", t.Name, err)
+		}
+		t.tokenMap = rules
+		for _, quota := range []*int64{t.KeyDailyQuota, t.KeyMonthlyQuota, t.RequestsPerKey} {
+			if quota != nil && *quota < 0 {
+				return nil, fmt.Errorf("tenant %s: quotas and limits must not be negative", t.Name)
+			}
+		}
+	}
+	return tenants, nil
+}
+
+// tenantConfig returns the configuration of the named tenant: the
+// deployment's settings with the tenant's own tokens, keys and limits, and
+// data kept apart from every other tenant's.
+func (c *Config) tenantConfig(name string) (*Config, error) {
+	i := slices.IndexFunc(c.Tenants, func(t Tenant) bool { return t.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("tenant %s no longer exists", name)
+	}
+	t := &c.Tenants[i]
+
+	config := *c
+	config.Tenant = t.Name
+	config.Tenants = nil
+	config.Token = t.Token
+	config.TokenFile = ""
+	config.TokenMap = t.tokenMap
+	config.ShardTokens = t.ShardTokens
+	config.APIKeys = t.APIKeys
+	config.AdminKeys = t.AdminKeys
+	config.AllowedChannels = t.Channels
+	config.AllowedGuilds = t.Guilds
+	config.UploadChannelID = t.UploadChannelID
+	config.IndexChannels = nil
+	config.DataPath = tenantPath(c.DataPath, t.Name)
+	if c.AuditLogPath != "" {
+		config.AuditLogPath = tenantPath(c.AuditLogPath, t.Name)
+	}
+	if c.DiskCachePath != "" {
+		config.DiskCachePath = filepath.Join(c.DiskCachePath, t.Name)
+	}
+	if c.URLCacheFile != "" {
+		config.URLCacheFile = tenantPath(c.URLCacheFile, t.Name)
+	}
+	if t.HotlinkAllow != nil {
+		config.HotlinkAllow = t.HotlinkAllow
+	}
+	config.PublicURL = strings.TrimSuffix(t.PublicURL, "/")
+	if config.PublicURL == "" && c.PublicURL != "" && t.Prefix != "" {
+		config.PublicURL = c.PublicURL + t.Prefix
+	}
+	// A share link minted for one tenant must not open on another.
+	if c.ShareSecret != "" {
+		config.ShareSecret = c.ShareSecret + "/" + t.Name
+	}
+	if t.KeyDailyQuota != nil {
+		config.KeyDailyQuota = *t.KeyDailyQuota
+	}
+	if t.KeyMonthlyQuota != nil {
+		config.KeyMonthlyQuota = *t.KeyMonthlyQuota
+	}
+	if t.RequestsPerKey != nil {
+		config.RequestsPerKey = *t.RequestsPerKey
+	}
+	if config.UploadChannelID != 0 && !config.apiAuth() {
+		return nil, fmt.Errorf("tenant %s needs API keys to enable uploads", t.Name)
+	}
+	if slices.ContainsFunc(t.AdminKeys, func(key string) bool { return slices.Contains(t.APIKeys, key) }) {
+		return nil, fmt.Errorf("tenant %s repeats an API key among its admin keys", t.Name)
+	}
+	return &config, nil
+}
+
+// tenantPath names a tenant's copy of a data file, such as data.acme.json
+// for data.json.
+func tenantPath(path, tenant string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + tenant + ext
+}
+
+// TenantMux sends each request to its tenant's router: by host first, then
+// by path prefix, which is stripped before the router sees the request.
+// Requests matching no tenant go to the default router.
+type TenantMux struct {
+	hosts    map[string]http.Handler
+	prefixes []tenantRoute
+	fallback http.Handler
+}
+
+type tenantRoute struct {
+	prefix  string
+	handler http.Handler
+}
+
+func NewTenantMux(fallback http.Handler) *TenantMux {
+	return &TenantMux{hosts: map[string]http.Handler{}, fallback: fallback}
+}
+
+// Add routes the tenant's hosts and prefix to handler.
+func (m *TenantMux) Add(t *Tenant, handler http.Handler) {
+	for _, host := range t.Hosts {
+		m.hosts[host] = handler
+	}
+	if t.Prefix != "" {
+		m.prefixes = append(m.prefixes, tenantRoute{t.Prefix, handler})
+	}
+}
+
+func (m *TenantMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if handler, ok := m.hosts[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	for _, route := range m.prefixes {
+		if !underPrefix(r.URL.Path, route.prefix) {
+			continue
+		}
+		route.handler.ServeHTTP(w, mount(r, route.prefix))
+		return
+	}
+	m.fallback.ServeHTTP(w, r)
+}
+
+// SetChannelAllowlist limits the attachments the client refreshes to those
+// in channels, or in channels of guilds. Both empty allow every channel.
+func (c *DiscordClient) SetChannelAllowlist(channels, guilds []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowedChannels, c.allowedGuilds = channels, guilds
+}
+
+// allowsChannel reports whether the allowlist lets the client serve the
+// channel's attachments, looking up its guild if need be.
+func (c *DiscordClient) allowsChannel(channelID int64) bool {
+	c.mu.RLock()
+	channels, guilds := c.allowedChannels, c.allowedGuilds
+	c.mu.RUnlock()
+	if len(channels) == 0 && len(guilds) == 0 {
+		return true
+	}
+	if slices.Contains(channels, channelID) {
+		return true
+	}
+	return len(guilds) > 0 && slices.Contains(guilds, c.ChannelGuild(channelID))
+}
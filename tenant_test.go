@@ -0,0 +1,73 @@
+package discordcdn
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	tenants, err := parseTenants(fmt.Sprintf(`[
+		{"name": "acme", "hosts": ["cdn.acme.example"], "prefix": "/acme", "token": "Bot acme", "apiKeys": ["acme-key"], "channels": [%d]},
+		{"name": "beta", "prefix": "/beta", "token": "Bot beta", "apiKeys": ["beta-key"], "channels": [%d]}
+	]`, testChannelID, testChannelID+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &Config{Tenants: tenants, APIKeys: []string{"default-key"}, ShareSecret: "secret", ShareTTL: time.Hour}
+
+	_, client := newFakeDiscord(t)
+	mux := NewTenantMux(newTestRouter(t, base, client))
+	var link string
+	for i := range tenants {
+		config, err := base.tenantConfig(tenants[i].Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both tenants' tokens could read the attachment; only the
+		// allowlist keeps it from the other.
+		fake, client := newFakeDiscord(t)
+		link = fake.put(testChannelID, testFileID, "a.png", []byte("image"))
+		client.SetChannelAllowlist(config.AllowedChannels, config.AllowedGuilds)
+		mux.Add(&tenants[i], newTestRouter(t, config, client))
+	}
+	info := fmt.Sprintf("/api/info/%d/%d/a.png", testChannelID, testFileID)
+
+	tests := []struct {
+		name    string
+		target  string
+		headers []string
+		status  int
+	}{
+		{"own attachment by prefix", "/acme" + link, nil, http.StatusMovedPermanently},
+		{"own attachment by host", "http://cdn.acme.example" + link, nil, http.StatusMovedPermanently},
+		{"other tenant's attachment", "/beta" + link, nil, http.StatusNotFound},
+		{"own API key", "/beta" + info, []string{"X-API-Key", "beta-key"}, http.StatusOK},
+		{"other tenant's API key", "/beta" + info, []string{"X-API-Key", "acme-key"}, http.StatusUnauthorized},
+		{"default API key", "/beta" + info, []string{"X-API-Key", "default-key"}, http.StatusUnauthorized},
+		{"tenant key on the default", info, []string{"X-API-Key", "acme-key"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doRequest(mux, http.MethodGet, tt.target, nil, tt.headers...); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	// A share link minted for one tenant doesn't open on another.
+	w := doRequest(mux, http.MethodPost, "/acme/api/share", strings.NewReader(`{"url": "`+link[1:]+`"}`), "X-API-Key", "acme-key", "Content-Type", "application/json")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("share status = %d: %s", w.Code, w.Body)
+	}
+	_, token, _ := strings.Cut(w.Body.String(), "/share/")
+	token, _, _ = strings.Cut(token, `"`)
+	if w := doRequest(mux, http.MethodGet, "/acme/share/"+token, nil); w.Code != http.StatusMovedPermanently {
+		t.Errorf("share link status = %d, want %d", w.Code, http.StatusMovedPermanently)
+	}
+	if w := doRequest(mux, http.MethodGet, "/beta/share/"+token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("share link on another tenant status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,144 @@
+package discordcdn
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const limiterIdleTimeout = 10 * time.Minute
+
+// IPLimiters hands out one shared rate limiter per client IP, forgetting
+// clients that have been idle for a while. A zero limit disables limiting.
+type IPLimiters struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*ipLimiter
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewIPLimiters(limit rate.Limit, burst int) *IPLimiters {
+	l := &IPLimiters{
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*ipLimiter{},
+	}
+	go l.cleanup()
+	return l
+}
+
+// Get returns the limiter for ip, or nil when limiting is disabled.
+func (l *IPLimiters) Get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit == 0 {
+		return nil
+	}
+
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// SetLimit changes the limit of every client, including those mid-transfer.
+func (l *IPLimiters) SetLimit(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	l.burst = burst
+	for ip, entry := range l.limiters {
+		if limit == 0 {
+			// A zero rate.Limit blocks forever, so release transfers that
+			// are still holding the old limiter and forget it.
+			entry.limiter.SetLimit(rate.Inf)
+			entry.limiter.SetBurst(math.MaxInt)
+			delete(l.limiters, ip)
+			continue
+		}
+		entry.limiter.SetLimit(limit)
+		entry.limiter.SetBurst(burst)
+	}
+}
+
+func (l *IPLimiters) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, entry := range l.limiters {
+			if time.Since(entry.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// bandwidthBurst sizes a limiter's bucket to a quarter second of traffic, so
+// throttled streams stay smooth without tiny writes.
+func bandwidthBurst(bytesPerSecond int64) int {
+	return int(max(bytesPerSecond/4, 1))
+}
+
+// throttledWriter paces writes through every limiter it holds.
+type throttledWriter struct {
+	ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		for _, limiter := range w.limiters {
+			n = min(n, limiter.Burst())
+		}
+
+		for _, limiter := range w.limiters {
+			if err := limiter.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttleBandwidth limits response bandwidth per connection and per client
+// IP. A zero limit disables that dimension.
+func throttleBandwidth(perConnection *atomic.Int64, perIP *IPLimiters) HandlerFunc {
+	return func(c *Context) {
+		var limiters []*rate.Limiter
+		if limit := perConnection.Load(); limit > 0 {
+			limiters = append(limiters, rate.NewLimiter(rate.Limit(limit), bandwidthBurst(limit)))
+		}
+		if limiter := perIP.Get(c.ClientIP()); limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+
+		if len(limiters) > 0 {
+			c.Writer = &throttledWriter{ResponseWriter: c.Writer, ctx: c.Request.Context(), limiters: limiters}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,70 @@
+package discordcdn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errRequestTimeout is the cause of a request's context being canceled
+// because it ran out of time.
+var errRequestTimeout = errors.New("request timed out")
+
+// requestTimeout gives each request timeout to start its response. Past
+// that, its context is canceled, abandoning Discord calls still waiting or
+// in flight, and the client gets a 504 unless the handler already answered.
+// Once the response has started the deadline is lifted, so long downloads
+// and streams run to completion.
+func requestTimeout(timeout time.Duration) HandlerFunc {
+	return func(c *Context) {
+		ctx, cancel := context.WithCancelCause(c.Request.Context())
+		defer cancel(nil)
+		timer := time.AfterFunc(timeout, func() { cancel(errRequestTimeout) })
+		defer timer.Stop()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer = &deadlineWriter{ResponseWriter: c.Writer, timer: timer}
+		c.Next()
+
+		if timedOut(c) && !c.Writer.Written() {
+			respondTimeout(c)
+		}
+	}
+}
+
+// timedOut reports whether the request ran out of time.
+func timedOut(c *Context) bool {
+	return errors.Is(context.Cause(c.Request.Context()), errRequestTimeout)
+}
+
+func respondTimeout(c *Context) {
+	metrics.Count("http.timeouts", 1, "route:"+c.FullPath())
+	respondError(c, http.StatusGatewayTimeout, codeRequestTimeout, "Request timed out")
+}
+
+// deadlineWriter stops the request's deadline when the response starts.
+type deadlineWriter struct {
+	ResponseWriter
+	timer *time.Timer
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.timer.Stop()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.timer.Stop()
+	return w.Write([]byte(s))
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	w.timer.Stop()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *deadlineWriter) Flush() {
+	w.timer.Stop()
+	w.ResponseWriter.Flush()
+}
@@ -0,0 +1,43 @@
+package discordcdn
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenFileInterval is how often the token file is checked for changes.
+const tokenFileInterval = 10 * time.Second
+
+// readTokenFile returns the token stored in path, without the trailing
+// newline most editors and secret stores add.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not be read: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// watchTokenFile reloads the configuration whenever the token in path
+// changes. The file is polled rather than watched, since mounted Kubernetes
+// secrets are updated by swapping a symlink, which file watchers easily
+// miss. A file that can't be read is left for the next check.
+func (r *Reloader) watchTokenFile(path string) {
+	last, _ := readTokenFile(path)
+	for range time.Tick(tokenFileInterval) {
+		token, err := readTokenFile(path)
+		if err != nil || token == "" || token == last {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			logAt(slog.LevelWarn, "Token file changed, but failed to reload config: %v", err)
+			continue
+		}
+		last = token
+		log.Printf("Token file changed, config reloaded")
+	}
+}
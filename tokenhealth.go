@@ -0,0 +1,411 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenHealthWindow is how many minutes of calls a token's error rate
+	// is computed over.
+	tokenHealthWindow = 5
+	// tokenHealthMinCalls keeps a couple of failures on a quiet token from
+	// marking it unhealthy.
+	tokenHealthMinCalls = 10
+	// tokenHealthInterval is how often health is evaluated and unhealthy
+	// tokens are checked for recovery.
+	tokenHealthInterval = 30 * time.Second
+)
+
+// tokenState is what the monitor knows about one token.
+type tokenState struct {
+	// calls and errors count API calls per minute, indexed by minute modulo
+	// the window; minutes records which minute each slot holds.
+	calls   [tokenHealthWindow]int64
+	errors  [tokenHealthWindow]int64
+	minutes [tokenHealthWindow]int64
+
+	// rejected is set once Discord answers 401, and cleared by a successful
+	// call.
+	rejected  bool
+	lastError string
+
+	remaining int
+	limit     int
+	resetAt   time.Time
+
+	healthy bool
+	reason  string
+}
+
+func (s *tokenState) count(now time.Time, failed bool) {
+	minute := now.Unix() / 60
+	i := minute % tokenHealthWindow
+	if s.minutes[i] != minute {
+		s.minutes[i] = minute
+		s.calls[i] = 0
+		s.errors[i] = 0
+	}
+	s.calls[i]++
+	if failed {
+		s.errors[i]++
+	}
+}
+
+// totals sums the calls and errors within the window.
+func (s *tokenState) totals(now time.Time) (calls, errs int64) {
+	minute := now.Unix() / 60
+	for i := range s.minutes {
+		if minute-s.minutes[i] < tokenHealthWindow {
+			calls += s.calls[i]
+			errs += s.errors[i]
+		}
+	}
+	return calls, errs
+}
+
+// poolIncident tracks a failure rate across every token, and is open while
+// the rate is at or above threshold.
+type poolIncident struct {
+	window    tokenState
+	threshold float64
+	open      bool
+	// raised and cleared are the events sent when the incident opens and
+	// closes, and noun what is counted, for the alert's reason.
+	raised, cleared, noun string
+}
+
+// evaluate updates the incident and returns the alert to send if it opened
+// or closed.
+func (p *poolIncident) evaluate(now time.Time) (Alert, bool) {
+	calls, errs := p.window.totals(now)
+	// Quiet periods don't close an incident; only enough calls that succeed
+	// do.
+	if calls < tokenHealthMinCalls {
+		return Alert{}, false
+	}
+	rate := float64(errs) / float64(calls)
+	open := rate >= p.threshold
+	if open == p.open {
+		return Alert{}, false
+	}
+	p.open = open
+	if !open {
+		return Alert{Event: p.cleared, ErrorRate: rate}, true
+	}
+	return Alert{Event: p.raised, Reason: fmt.Sprintf("%d of %d %s", errs, calls, p.noun), ErrorRate: rate}, true
+}
+
+// TokenMonitor tracks the health of each configured token from the results
+// of its API calls, and sends an alert when a token becomes unhealthy, too
+// few healthy tokens remain, or Discord is failing, rate limiting or
+// refusing refreshes across the board.
+type TokenMonitor struct {
+	mu     sync.Mutex
+	client *DiscordClient
+	tokens map[string]*tokenState
+	// order keeps reports in configuration order.
+	order []string
+	// refreshes counts refreshes that failed upstream, outage API calls that
+	// failed with a network or server error, and rateLimited calls answered
+	// with 429, each across every token.
+	refreshes   poolIncident
+	outage      poolIncident
+	rateLimited poolIncident
+
+	alerter        *Alerter
+	errorThreshold float64
+	minHealthy     float64
+	degraded       bool
+}
+
+func NewTokenMonitor(client *DiscordClient, config *Config) *TokenMonitor {
+	m := &TokenMonitor{
+		client:         client,
+		tokens:         map[string]*tokenState{},
+		alerter:        NewAlerter(config),
+		errorThreshold: config.TokenErrorThreshold,
+		minHealthy:     config.TokenPoolMinHealthy,
+		refreshes: poolIncident{
+			threshold: config.RefreshErrorThreshold,
+			raised:    "refresh_errors_high", cleared: "refresh_errors_recovered", noun: "refreshes failed",
+		},
+		outage: poolIncident{
+			threshold: config.OutageThreshold,
+			raised:    "discord_outage", cleared: "discord_recovered", noun: "API calls failed",
+		},
+		rateLimited: poolIncident{
+			threshold: config.RateLimitThreshold,
+			raised:    "rate_limited", cleared: "rate_limit_recovered", noun: "API calls were rate limited",
+		},
+	}
+	m.SetTokens(configuredTokens(config))
+	return m
+}
+
+// SetTokens replaces the set of tokens monitored, keeping the history of
+// tokens that remain.
+func (m *TokenMonitor) SetTokens(tokens []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[string]*tokenState, len(tokens))
+	for _, token := range tokens {
+		if s, ok := m.tokens[token]; ok {
+			states[token] = s
+		} else {
+			states[token] = &tokenState{healthy: true, remaining: -1}
+		}
+	}
+	m.tokens = states
+	m.order = tokens
+}
+
+// record counts the result of an API call made with token. Only failures
+// that say something about the token count as errors: network errors,
+// server errors and 401s, not missing permissions on a channel.
+func (m *TokenMonitor) record(token string, resp *http.Response, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.outage.window.count(now, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	m.rateLimited.window.count(now, err == nil && resp.StatusCode == http.StatusTooManyRequests)
+
+	s, ok := m.tokens[token]
+	if !ok {
+		return
+	}
+
+	switch {
+	case err != nil:
+		s.count(now, true)
+		s.lastError = err.Error()
+		return
+	case resp.StatusCode == http.StatusUnauthorized:
+		s.count(now, true)
+		s.rejected = true
+		s.lastError = "token rejected by Discord"
+		return
+	case resp.StatusCode >= http.StatusInternalServerError:
+		s.count(now, true)
+		s.lastError = fmt.Sprintf("Discord answered %d", resp.StatusCode)
+	default:
+		s.count(now, false)
+		if resp.StatusCode < http.StatusBadRequest {
+			s.rejected = false
+		}
+	}
+
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		s.remaining = remaining
+		s.limit, _ = strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+		if resetAfter, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset-After"), 64); err == nil {
+			s.resetAt = now.Add(time.Duration(resetAfter * float64(time.Second)))
+		}
+	}
+}
+
+// recordRefresh counts a refresh towards the refresh error rate. Only
+// upstream failures count as errors, not attachments that are gone.
+func (m *TokenMonitor) recordRefresh(failed bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshes.window.count(time.Now(), failed)
+}
+
+// Healthy reports whether token was healthy when last evaluated. Tokens the
+// monitor doesn't know, and every token without a monitor, count as healthy.
+func (m *TokenMonitor) Healthy(token string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.tokens[token]
+	return !ok || (s.healthy && !s.rejected)
+}
+
+func (m *TokenMonitor) run() {
+	for range time.Tick(tokenHealthInterval) {
+		m.probe()
+		m.evaluate()
+	}
+}
+
+// probe checks whether rejected tokens are accepted again, since little
+// else may be calling Discord with them. A successful call is recorded like
+// any other and clears the rejection.
+func (m *TokenMonitor) probe() {
+	m.mu.Lock()
+	var rejected []string
+	for token, s := range m.tokens {
+		if s.rejected {
+			rejected = append(rejected, token)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, token := range rejected {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenCheckTimeout)
+		m.client.TokenUser(ctx, token)
+		cancel()
+	}
+}
+
+// evaluate updates each token's health and alerts on changes.
+func (m *TokenMonitor) evaluate() {
+	var alerts []Alert
+	now := time.Now()
+
+	m.mu.Lock()
+	healthy := 0
+	for _, token := range m.order {
+		s := m.tokens[token]
+		calls, errs := s.totals(now)
+		wasHealthy := s.healthy
+		switch {
+		case s.rejected:
+			s.healthy, s.reason = false, "rejected by Discord"
+		case calls >= tokenHealthMinCalls && float64(errs)/float64(calls) >= m.errorThreshold:
+			s.healthy, s.reason = false, fmt.Sprintf("%d of %d calls failed", errs, calls)
+		default:
+			s.healthy, s.reason = true, ""
+		}
+
+		if s.healthy {
+			healthy++
+		}
+		if s.healthy != wasHealthy {
+			event := "token_recovered"
+			if !s.healthy {
+				event = "token_unhealthy"
+			}
+			alerts = append(alerts, Alert{Event: event, Token: tokenID(token), Reason: s.reason})
+		}
+	}
+
+	total := len(m.order)
+	degraded := total > 0 && float64(healthy)/float64(total) < m.minHealthy
+	if degraded != m.degraded {
+		m.degraded = degraded
+		event := "pool_recovered"
+		if degraded {
+			event = "pool_degraded"
+		}
+		alerts = append(alerts, Alert{Event: event})
+	}
+
+	for _, incident := range []*poolIncident{&m.refreshes, &m.outage, &m.rateLimited} {
+		if alert, ok := incident.evaluate(now); ok {
+			alerts = append(alerts, alert)
+		}
+	}
+	m.mu.Unlock()
+
+	metrics.Gauge("tokens.healthy", float64(healthy))
+	metrics.Gauge("tokens.total", float64(total))
+	for _, alert := range alerts {
+		alert.Time = now.UTC()
+		alert.Healthy = healthy
+		alert.Total = total
+		m.alert(alert)
+	}
+}
+
+func (m *TokenMonitor) alert(alert Alert) {
+	switch alert.Event {
+	case "token_unhealthy":
+		alert.Content = fmt.Sprintf("Token %s is unhealthy: %s", alert.Token, alert.Reason)
+	case "token_recovered":
+		alert.Content = fmt.Sprintf("Token %s has recovered", alert.Token)
+	case "pool_degraded":
+		alert.Content = fmt.Sprintf("Only %d of %d tokens are healthy", alert.Healthy, alert.Total)
+	case "pool_recovered":
+		alert.Content = fmt.Sprintf("%d of %d tokens are healthy again", alert.Healthy, alert.Total)
+	case "refresh_errors_high":
+		alert.Content = fmt.Sprintf("Refreshes are failing: %s in the last %d minutes", alert.Reason, tokenHealthWindow)
+	case "refresh_errors_recovered":
+		alert.Content = "Refreshes are succeeding again"
+	case "discord_outage":
+		alert.Content = fmt.Sprintf("Discord appears to be down: %s in the last %d minutes", alert.Reason, tokenHealthWindow)
+	case "discord_recovered":
+		alert.Content = "Discord is answering again"
+	case "rate_limited":
+		alert.Content = fmt.Sprintf("Discord is rate limiting: %s in the last %d minutes", alert.Reason, tokenHealthWindow)
+	case "rate_limit_recovered":
+		alert.Content = "Discord is no longer rate limiting"
+	}
+	m.alerter.Send(alert)
+}
+
+type TokenReport struct {
+	ID        string  `json:"id"`
+	Healthy   bool    `json:"healthy"`
+	Reason    string  `json:"reason,omitempty"`
+	Calls     int64   `json:"calls"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	LastError string  `json:"lastError,omitempty"`
+	// Remaining and Limit are the rate limit headroom Discord last reported,
+	// or -1 and 0 before it has reported any.
+	Remaining int        `json:"rateLimitRemaining"`
+	Limit     int        `json:"rateLimitLimit"`
+	ResetAt   *time.Time `json:"rateLimitResetAt,omitempty"`
+}
+
+// Report returns the health of each token over the last few minutes, in
+// configuration order.
+func (m *TokenMonitor) Report() []TokenReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	report := make([]TokenReport, 0, len(m.order))
+	for _, token := range m.order {
+		s := m.tokens[token]
+		calls, errs := s.totals(now)
+		r := TokenReport{
+			ID:        tokenID(token),
+			Healthy:   s.healthy,
+			Reason:    s.reason,
+			Calls:     calls,
+			Errors:    errs,
+			LastError: s.lastError,
+			Remaining: s.remaining,
+			Limit:     s.limit,
+		}
+		if calls > 0 {
+			r.ErrorRate = float64(errs) / float64(calls)
+		}
+		if s.resetAt.After(now) {
+			resetAt := s.resetAt
+			r.ResetAt = &resetAt
+		}
+		report = append(report, r)
+	}
+	return report
+}
+
+func handleTokenHealth(monitor *TokenMonitor) HandlerFunc {
+	return func(c *Context) {
+		report := monitor.Report()
+		healthy := 0
+		for _, r := range report {
+			if r.Healthy {
+				healthy++
+			}
+		}
+		c.JSON(http.StatusOK, H{"healthy": healthy, "total": len(report), "tokens": report})
+	}
+}
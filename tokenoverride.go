@@ -0,0 +1,129 @@
+package discordcdn
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discordTokenHeader carries a caller's own Discord token, used instead of
+// the configured ones for the refreshes its request makes.
+const discordTokenHeader = "X-Discord-Token"
+
+const (
+	// maxOverrideBudgets bounds how many callers' tokens have their rate
+	// limits tracked at once.
+	maxOverrideBudgets = 10000
+	// overrideBudgetIdle is how long a caller's token goes unused before
+	// its rate limit may be forgotten.
+	overrideBudgetIdle = 10 * time.Minute
+)
+
+type discordTokenKey struct{}
+
+// withDiscordToken returns ctx carrying a caller's Discord token.
+func withDiscordToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, discordTokenKey{}, token)
+}
+
+// discordTokenFrom returns the caller's Discord token ctx carries, if any.
+func discordTokenFrom(ctx context.Context) string {
+	token, _ := ctx.Value(discordTokenKey{}).(string)
+	return token
+}
+
+// overrideToken lets callers holding an API key refresh attachments with
+// their own Discord token, sent in X-Discord-Token, so they spend their own
+// rate limits rather than the service's. The header is refused without a key,
+// or unless enabled is set, rather than ignored, so callers never spend the
+// service's limits thinking they spend their own.
+func overrideToken(keys *KeySet, certNames []string, enabled bool) HandlerFunc {
+	return func(c *Context) {
+		token := strings.TrimSpace(c.GetHeader(discordTokenHeader))
+		if token == "" {
+			c.Next()
+			return
+		}
+		// The token is kept out of anything that reports request headers,
+		// such as Sentry.
+		c.Request.Header.Del(discordTokenHeader)
+		if !enabled {
+			respondError(c, http.StatusForbidden, codeAccessDenied, "Discord token override isn't enabled")
+			return
+		}
+		if c.GetString(apiKeyKey) == "" && !authenticateAPIKey(c, keys, certNames) {
+			c.Header("WWW-Authenticate", `Basic realm="discord-cdn"`)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "An API key is required to use a Discord token")
+			return
+		}
+		logf(c, slog.LevelDebug, "Refreshing with the caller's Discord token %s", tokenID(token))
+		c.Request = c.Request.WithContext(withDiscordToken(c.Request.Context(), token))
+		// Shared caches mustn't hand what one caller's token can see to
+		// another.
+		c.Writer.Header().Add("Vary", discordTokenHeader)
+		c.Next()
+	}
+}
+
+// overrideBudgets tracks the rate limits of callers' own tokens, keyed by
+// tokenID so the tokens themselves aren't kept. Unlike the configured
+// tokens', they come and go with callers, so once maxOverrideBudgets are
+// tracked, those idle for overrideBudgetIdle are forgotten, or else the
+// least recently used.
+type overrideBudgets struct {
+	mu      sync.Mutex
+	budgets map[string]*overrideBudget
+}
+
+type overrideBudget struct {
+	budget *rateBudget
+	used   time.Time
+}
+
+// overrideBudgetFor returns the rate limit budget of a caller's token.
+func (c *DiscordClient) overrideBudgetFor(token string) *rateBudget {
+	c.mu.RLock()
+	reserve := c.reserve
+	c.mu.RUnlock()
+	return c.overrides.get(tokenID(token), reserve, time.Now())
+}
+
+func (o *overrideBudgets) get(id string, reserve int, now time.Time) *rateBudget {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if b, ok := o.budgets[id]; ok {
+		b.used = now
+		return b.budget
+	}
+	if o.budgets == nil {
+		o.budgets = map[string]*overrideBudget{}
+	}
+	if len(o.budgets) >= maxOverrideBudgets {
+		o.prune(now)
+	}
+	b := &overrideBudget{budget: newRateBudget(), used: now}
+	b.budget.setReserve(reserve)
+	o.budgets[id] = b
+	return b.budget
+}
+
+// prune forgets the budgets idle for overrideBudgetIdle, or the least
+// recently used one if none are.
+func (o *overrideBudgets) prune(now time.Time) {
+	var oldest string
+	for id, b := range o.budgets {
+		if now.Sub(b.used) >= overrideBudgetIdle {
+			delete(o.budgets, id)
+			continue
+		}
+		if oldest == "" || b.used.Before(o.budgets[oldest].used) {
+			oldest = id
+		}
+	}
+	if len(o.budgets) >= maxOverrideBudgets {
+		delete(o.budgets, oldest)
+	}
+}
@@ -0,0 +1,67 @@
+package discordcdn
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		headers []string
+		status  int
+	}{
+		{"with key", true, []string{"X-API-Key", "key", discordTokenHeader, "Bot caller"}, http.StatusMovedPermanently},
+		{"without key", true, []string{discordTokenHeader, "Bot caller"}, http.StatusUnauthorized},
+		{"disabled", false, []string{"X-API-Key", "key", discordTokenHeader, "Bot caller"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeDiscord(t)
+			router := newTestRouter(t, &Config{APIKeys: []string{"key"}, TokenOverride: tt.enabled}, client)
+			path := fake.put(testChannelID, testFileID, "a.png", []byte("png"))
+
+			w := doRequest(router, http.MethodGet, path, nil, tt.headers...)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusMovedPermanently {
+				return
+			}
+			if !slices.Contains(fake.tokens, "Bot caller") || slices.Contains(fake.tokens, "token") {
+				t.Errorf("Discord called with %v, want the caller's token only", fake.tokens)
+			}
+			if _, ok := client.budgets["Bot caller"]; ok {
+				t.Error("caller's token tracked among the configured tokens")
+			}
+		})
+	}
+}
+
+func TestOverrideBudgetsBounded(t *testing.T) {
+	var budgets overrideBudgets
+	start := time.Now()
+	for i := range maxOverrideBudgets {
+		budgets.get(fmt.Sprintf("token_%d", i), 0, start.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	// Full of recently used tokens, the least recently used makes way.
+	now := start.Add(time.Minute)
+	budgets.get("token_new", 0, now)
+	if n := len(budgets.budgets); n != maxOverrideBudgets {
+		t.Errorf("tracking %d budgets, want %d", n, maxOverrideBudgets)
+	}
+	if _, ok := budgets.budgets["token_0"]; ok {
+		t.Error("least recently used budget kept")
+	}
+
+	// Once they have been idle long enough, they all go.
+	budgets.get("token_later", 0, now.Add(overrideBudgetIdle+time.Minute))
+	if n := len(budgets.budgets); n != 1 {
+		t.Errorf("tracking %d budgets after they went idle, want 1", n)
+	}
+}
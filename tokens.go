@@ -0,0 +1,330 @@
+package discordcdn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// guildLookupRetry is how long a channel whose guild couldn't be
+	// determined keeps using the default token before the lookup is tried
+	// again.
+	guildLookupRetry = 10 * time.Minute
+	// tokenCheckTimeout bounds the startup check of each token.
+	tokenCheckTimeout = 10 * time.Second
+)
+
+// What shard tokens are assigned by, set with SHARD_BY.
+const (
+	shardByChannel = "channel"
+	shardByGuild   = "guild"
+)
+
+// TokenRule routes API calls for a range of channel or guild IDs to a
+// specific token, for deployments serving guilds whose bots can't see each
+// other's channels.
+type TokenRule struct {
+	// Guild is set when the range matches guild IDs rather than channel IDs.
+	Guild    bool
+	From, To int64
+	Token    string
+}
+
+func (r *TokenRule) contains(id int64) bool {
+	return id >= r.From && id <= r.To
+}
+
+// parseTokenMap parses comma-separated rules of the form
+// channel:<id>=<token> or guild:<id>=<token>, where the ID may also be a
+// range such as 100-200.
+func parseTokenMap(raw string) ([]TokenRule, error) {
+	var rules []TokenRule
+	for _, entry := range splitList(raw) {
+		scope, rest, ok := strings.Cut(entry, ":")
+		if !ok || (scope != "channel" && scope != "guild") {
+			return nil, errors.New("entry must start with channel: or guild:")
+		}
+		ids, token, ok := strings.Cut(rest, "=")
+		if !ok || token == "" {
+			return nil, fmt.Errorf("entry for %s:%s has no token", scope, ids)
+		}
+
+		from, to, isRange := strings.Cut(ids, "-")
+		rule := TokenRule{Guild: scope == "guild", Token: token}
+		var err error
+		if rule.From, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid ID %q", from)
+		}
+		rule.To = rule.From
+		if isRange {
+			if rule.To, err = strconv.ParseInt(to, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid ID %q", to)
+			}
+		}
+		if rule.To < rule.From {
+			return nil, fmt.Errorf("range %s is empty", ids)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// tokenID identifies a Discord token in logs and shared state without
+// revealing it.
+func tokenID(token string) string {
+	return "token_" + secretHash(token)
+}
+
+// configuredTokens returns the default token followed by every other token
+// the token map routes to.
+func configuredTokens(config *Config) []string {
+	tokens := []string{config.Token}
+	for _, r := range config.TokenMap {
+		if !slices.Contains(tokens, r.Token) {
+			tokens = append(tokens, r.Token)
+		}
+	}
+	for _, token := range config.ShardTokens {
+		if !slices.Contains(tokens, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// validateTokens checks each token against Discord and returns an error
+// naming the ones it rejected. Tokens that couldn't be checked, because
+// Discord was unreachable for instance, are only logged.
+func validateTokens(client *DiscordClient, tokens []string) error {
+	var rejected []string
+	for _, token := range tokens {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenCheckTimeout)
+		user, err := client.TokenUser(ctx, token)
+		cancel()
+
+		var discordErr *DiscordError
+		switch {
+		case err == nil:
+			log.Printf("Token %s belongs to %s (%d)", tokenID(token), user.Username, user.ID)
+		case errors.As(err, &discordErr) && discordErr.StatusCode == http.StatusUnauthorized:
+			rejected = append(rejected, tokenID(token))
+		default:
+			logAt(slog.LevelError, "Failed to validate token %s: %v", tokenID(token), err)
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("tokens rejected by Discord: %s", strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+type guildLookup struct {
+	guildID   int64
+	checkedAt time.Time
+}
+
+// SetTokenMap replaces the rules choosing a token per channel or guild.
+func (c *DiscordClient) SetTokenMap(rules []TokenRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokenMap = rules
+}
+
+// SetShards replaces the tokens calls about channels no token map rule
+// matches are spread across, and sets whether each channel's shard is chosen
+// by its own ID or its guild's.
+func (c *DiscordClient) SetShards(tokens []string, by string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shards = tokens
+	c.shardBy = by
+}
+
+// shardToken returns the token whose shard id falls in, by rendezvous
+// hashing: every token scores the ID and the highest score wins. The choice
+// only depends on the tokens, so every instance makes the same one, and
+// adding or removing a token only moves the IDs of its own shard.
+func shardToken(tokens []string, id int64) string {
+	var best string
+	var bestScore uint64
+	for _, token := range tokens {
+		sum := sha256.Sum256([]byte(secretHash(token) + ":" + strconv.FormatInt(id, 10)))
+		if score := binary.BigEndian.Uint64(sum[:8]); best == "" || score > bestScore {
+			best, bestScore = token, score
+		}
+	}
+	return best
+}
+
+// alternateToken returns a token to retry a call with after Discord answered
+// err to it with token: another token that is currently healthy, for a 401
+// or 403. It returns "" when the call shouldn't be retried.
+func (c *DiscordClient) alternateToken(token string, err error) string {
+	var discordErr *DiscordError
+	if !errors.As(err, &discordErr) {
+		return ""
+	}
+	if discordErr.StatusCode != http.StatusUnauthorized && discordErr.StatusCode != http.StatusForbidden {
+		return ""
+	}
+
+	c.mu.RLock()
+	tokens := []string{c.token}
+	for _, r := range c.tokenMap {
+		if !slices.Contains(tokens, r.Token) {
+			tokens = append(tokens, r.Token)
+		}
+	}
+	for _, t := range c.shards {
+		if !slices.Contains(tokens, t) {
+			tokens = append(tokens, t)
+		}
+	}
+	monitor := c.monitor
+	c.mu.RUnlock()
+
+	for _, t := range tokens {
+		if t != token && monitor.Healthy(t) {
+			return t
+		}
+	}
+	return ""
+}
+
+// tokenFor returns the token to use for calls about channelID: the first
+// matching channel rule, then the first matching guild rule, then the token
+// of the channel's shard, then the default token.
+func (c *DiscordClient) tokenFor(channelID int64) string {
+	c.mu.RLock()
+	rules, token := c.tokenMap, c.token
+	shards, shardBy := c.shards, c.shardBy
+	c.mu.RUnlock()
+
+	var guildRules []TokenRule
+	for _, r := range rules {
+		if r.Guild {
+			guildRules = append(guildRules, r)
+		} else if r.contains(channelID) {
+			return r.Token
+		}
+	}
+	if channelID == 0 {
+		return token
+	}
+
+	var guildID int64
+	if len(guildRules) > 0 || len(shards) > 0 && shardBy == shardByGuild {
+		// The guild is looked up with the channel's shard first, so the
+		// lookups are spread like the calls.
+		var tokens []string
+		if len(shards) > 0 {
+			tokens = append(tokens, shardToken(shards, channelID))
+		}
+		for _, r := range guildRules {
+			tokens = append(tokens, r.Token)
+		}
+		if shardBy == shardByGuild {
+			tokens = append(tokens, shards...)
+		}
+		guildID = c.channelGuild(channelID, tokens)
+		for _, r := range guildRules {
+			if r.contains(guildID) {
+				return r.Token
+			}
+		}
+	}
+	switch {
+	case len(shards) == 0:
+		return token
+	case shardBy == shardByGuild && guildID != 0:
+		return shardToken(shards, guildID)
+	}
+	// Direct messages, and channels no token can see, are sharded by
+	// channel.
+	return shardToken(shards, channelID)
+}
+
+// ChannelGuild returns the guild a channel belongs to, or 0 if none of the
+// configured tokens can see the channel.
+func (c *DiscordClient) ChannelGuild(channelID int64) int64 {
+	tokens := []string{c.tokenFor(channelID)}
+	c.mu.RLock()
+	for _, r := range c.tokenMap {
+		if r.Guild {
+			tokens = append(tokens, r.Token)
+		}
+	}
+	tokens = append(tokens, c.shards...)
+	c.mu.RUnlock()
+	return c.channelGuild(channelID, tokens)
+}
+
+// channelGuild returns the guild a channel belongs to, asking Discord with
+// each token until one can see the channel. Results are cached, and 0 is
+// returned when no token could.
+func (c *DiscordClient) channelGuild(channelID int64, tokens []string) int64 {
+	c.guildsMu.Lock()
+	cached, ok := c.guilds[channelID]
+	c.guildsMu.Unlock()
+	if ok && (cached.guildID != 0 || time.Since(cached.checkedAt) < guildLookupRetry) {
+		return cached.guildID
+	}
+
+	var guildID int64
+	tried := map[string]bool{}
+	for _, token := range tokens {
+		if tried[token] {
+			continue
+		}
+		tried[token] = true
+		if channel, err := c.fetchChannel(token, channelID); err == nil {
+			guildID = channel.GuildID
+			break
+		}
+	}
+
+	c.guildsMu.Lock()
+	c.guilds[channelID] = guildLookup{guildID: guildID, checkedAt: time.Now()}
+	c.guildsMu.Unlock()
+	return guildID
+}
+
+func (c *DiscordClient) fetchChannel(token string, channelID int64) (*Channel, error) {
+	var channel Channel
+	if err := c.get(PriorityInteractive, token, "channel", fmt.Sprintf("/channels/%d", channelID), &channel); err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+// attachmentChannel returns the channel ID of a CDN attachment URL, or 0 if
+// it can't be parsed.
+func attachmentChannel(attachmentURL string) int64 {
+	channelID, _ := attachmentIDs(attachmentURL)
+	return channelID
+}
+
+// attachmentIDs returns the channel and file IDs of a CDN attachment URL,
+// each 0 if it can't be parsed.
+func attachmentIDs(attachmentURL string) (channelID, fileID int64) {
+	path, _, _ := strings.Cut(attachmentURL, "?")
+	_, path, ok := strings.Cut(path, "/attachments/")
+	if !ok {
+		return 0, 0
+	}
+	channel, rest, _ := strings.Cut(path, "/")
+	file, _, _ := strings.Cut(rest, "/")
+	channelID, _ = strconv.ParseInt(channel, 10, 64)
+	fileID, _ = strconv.ParseInt(file, 10, 64)
+	return channelID, fileID
+}
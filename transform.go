@@ -0,0 +1,274 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+const (
+	maxTransformDimension   = 4096
+	maxTransformSourceBytes = 32 << 20
+	maxTransformPixels      = 50_000_000
+)
+
+var (
+	errNotImage      = errors.New("attachment is not a supported image")
+	errImageTooLarge = errors.New("image is too large to transform")
+)
+
+// TransformOptions describes a server-side resize or re-encode requested
+// through the w, h and fmt query parameters.
+type TransformOptions struct {
+	Width  int
+	Height int
+	Format string
+	// Watermark overlays the configured watermark; it is set by the server
+	// rather than the query.
+	Watermark bool
+}
+
+// parseTransformOptions returns nil when the query requests no transform.
+func parseTransformOptions(query url.Values) (*TransformOptions, error) {
+	opts := &TransformOptions{Format: query.Get("fmt")}
+
+	for key, dst := range map[string]*int{"w": &opts.Width, "h": &opts.Height} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxTransformDimension {
+			return nil, fmt.Errorf("%s must be between 1 and %d", key, maxTransformDimension)
+		}
+		*dst = n
+	}
+
+	switch opts.Format {
+	case "", "jpeg", "png", "webp", "avif":
+	default:
+		return nil, fmt.Errorf("fmt must be one of jpeg, png, webp or avif")
+	}
+
+	if opts.Width == 0 && opts.Height == 0 && opts.Format == "" {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// negotiableExtensions are the images whose format is negotiated with
+// DCDN_NEGOTIATE_FORMAT.
+var negotiableExtensions = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+// negotiateImageFormat picks the best format a client accepts from an Accept
+// header, preferring AVIF over WebP whatever their weights. It returns ""
+// when the original should be served. Wildcards are ignored, since browsers
+// send them regardless of what they decode.
+func negotiateImageFormat(accept string) string {
+	var webp bool
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		switch mediaType {
+		case "image/avif":
+			return "avif"
+		case "image/webp":
+			webp = true
+		}
+	}
+	if webp {
+		return "webp"
+	}
+	return ""
+}
+
+// cacheKey keys a variant by the channel as well as the file, since cached
+// variants are served after checking access to the link's channel alone.
+func (o *TransformOptions) cacheKey(channelID, fileID int64) string {
+	key := fmt.Sprintf("%d/%d/%dx%d/%s", channelID, fileID, o.Width, o.Height, o.Format)
+	if o.Watermark {
+		key += "/watermark"
+	}
+	return key
+}
+
+// Transformer produces resized and re-encoded variants of image attachments,
+// keeping recent variants in memory.
+type Transformer struct {
+	client    *DiscordClient
+	cache     *ByteCache
+	watermark *Watermark
+}
+
+func NewTransformer(client *DiscordClient, cache *ByteCache) *Transformer {
+	return &Transformer{client: client, cache: cache}
+}
+
+// SetWatermark sets the watermark overlaid on variants that ask for it. It
+// must be called before the transformer is used.
+func (t *Transformer) SetWatermark(watermark *Watermark) {
+	t.watermark = watermark
+}
+
+func (t *Transformer) Cached(data *LinkData, opts *TransformOptions) ([]byte, string, bool) {
+	return t.cache.Get(opts.cacheKey(data.ChannelID, data.FileID))
+}
+
+// Transform downloads the image at sourceURL and renders the requested
+// variant, returning the encoded bytes and their content type.
+func (t *Transformer) Transform(ctx context.Context, data *LinkData, sourceURL string, opts *TransformOptions) ([]byte, string, error) {
+	img, sourceFormat, err := t.download(ctx, sourceURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img = resizeImage(img, opts.Width, opts.Height)
+	if opts.Watermark && t.watermark != nil {
+		img = t.watermark.apply(img)
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = sourceFormat
+	}
+
+	var buf bytes.Buffer
+	contentType, err := encodeImage(&buf, img, format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t.cache.Put(opts.cacheKey(data.ChannelID, data.FileID), contentType, buf.Bytes())
+	return buf.Bytes(), contentType, nil
+}
+
+// download fetches and decodes the image at sourceURL, refusing images too
+// large to hold in memory.
+func (t *Transformer) download(ctx context.Context, sourceURL string) (image.Image, string, error) {
+	resp, err := t.client.Download(ctx, sourceURL, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxTransformSourceBytes {
+		return nil, "", errImageTooLarge
+	}
+
+	source, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformSourceBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(source) > maxTransformSourceBytes {
+		return nil, "", errImageTooLarge
+	}
+
+	cfg, sourceFormat, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	if cfg.Width*cfg.Height > maxTransformPixels {
+		return nil, "", errImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	return img, sourceFormat, nil
+}
+
+func serveTransformed(c *Context, transformer *Transformer, data *LinkData, sourceURL string, opts *TransformOptions) {
+	variant, contentType, err := transformer.Transform(c.Request.Context(), data, sourceURL, opts)
+	switch {
+	case errors.Is(err, errNotImage):
+		respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Attachment is not a supported image")
+	case errors.Is(err, errImageTooLarge):
+		respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Image is too large to transform")
+	case err != nil:
+		logf(c, slog.LevelError, "Error transforming image: %v", err)
+		reportError(c, err)
+		respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to transform image")
+	default:
+		c.Data(http.StatusOK, contentType, variant)
+	}
+}
+
+// resizeImage scales img down to fit within width x height, preserving the
+// aspect ratio. A zero dimension is derived from the other one. Images are
+// never scaled up.
+func resizeImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if (width == 0 && height == 0) || srcW == 0 || srcH == 0 {
+		return img
+	}
+
+	scale := 1.0
+	if width > 0 {
+		scale = min(scale, float64(width)/float64(srcW))
+	}
+	if height > 0 {
+		scale = min(scale, float64(height)/float64(srcH))
+	}
+	if scale >= 1 {
+		return img
+	}
+
+	dstW := max(1, int(float64(srcW)*scale+0.5))
+	dstH := max(1, int(float64(srcH)*scale+0.5))
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, format string) (string, error) {
+	var err error
+	contentType := "image/" + format
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "webp":
+		err = webp.Encode(w, img, webp.Options{Quality: 80})
+	case "avif":
+		err = avif.Encode(w, img, avif.Options{Quality: 60, Speed: 8})
+	default:
+		// Sources without an encoder of their own (gif) fall back to png.
+		contentType = "image/png"
+		err = png.Encode(w, img)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s: %w", format, err)
+	}
+	return contentType, nil
+}
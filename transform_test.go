@@ -0,0 +1,74 @@
+package discordcdn
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func servePNG(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/image.png"
+}
+
+func TestTransformerCacheIsPerChannel(t *testing.T) {
+	transformer := NewTransformer(NewDiscordClient("token"), NewByteCache(1<<20))
+	opts := &TransformOptions{Width: 8, Format: "png"}
+	data := &LinkData{ChannelID: testChannelID, FileID: testFileID, FileName: "image.png"}
+
+	if _, _, err := transformer.Transform(context.Background(), data, servePNG(t, 16, 16), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data *LinkData
+		opts *TransformOptions
+		hit  bool
+	}{
+		{"same channel and file", data, opts, true},
+		{"other channel", &LinkData{ChannelID: testChannelID + 1, FileID: testFileID}, opts, false},
+		{"other file", &LinkData{ChannelID: testChannelID, FileID: testFileID + 1}, opts, false},
+		{"other size", data, &TransformOptions{Width: 4, Format: "png"}, false},
+		{"watermarked", data, &TransformOptions{Width: 8, Format: "png", Watermark: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, hit := transformer.Cached(tt.data, tt.opts); hit != tt.hit {
+				t.Errorf("Cached() hit = %v, want %v", hit, tt.hit)
+			}
+		})
+	}
+}
+
+func TestTransformCacheKey(t *testing.T) {
+	tests := []struct {
+		name string
+		opts TransformOptions
+		want string
+	}{
+		{"width", TransformOptions{Width: 320}, "1151234567890123456/1151234567890123457/320x0/"},
+		{"both sides and format", TransformOptions{Width: 320, Height: 240, Format: "webp"}, "1151234567890123456/1151234567890123457/320x240/webp"},
+		{"watermark", TransformOptions{Format: "avif", Watermark: true}, "1151234567890123456/1151234567890123457/0x0/avif/watermark"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.cacheKey(testChannelID, testFileID); got != tt.want {
+				t.Errorf("cacheKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package discordcdn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultUpstreamIdleConns   = 100
+	defaultUpstreamIdleTimeout = 90 * time.Second
+	// upstreamTLSSessions is how many TLS sessions are kept for resumption,
+	// enough for Discord's API and CDN hosts several times over.
+	upstreamTLSSessions = 64
+	// upstreamDialTimeout and upstreamKeepAlive apply to each new connection.
+	upstreamDialTimeout = 10 * time.Second
+	upstreamKeepAlive   = 30 * time.Second
+)
+
+// newUpstreamTransport returns the transport for calls to Discord and its
+// CDN. Go's default keeps only two idle connections per host, so under load
+// most calls opened a new connection and paid for a TLS handshake; this keeps
+// up to maxIdlePerHost connections to each host alive for idleTimeout, and
+// resumes TLS sessions when one does have to be opened. Hosts are resolved
+// through dns when it isn't nil.
+//
+// HTTP/2 is negotiated with hosts that support it, as Discord's do, so
+// concurrent calls share one connection instead of each holding their own.
+// http1 limits connections to HTTP/1.1, for debugging with tools that only
+// understand it.
+//
+// Connections leave from bind when it isn't nil, for multi-homed hosts where
+// Discord traffic must use a particular address. Only hosts of its address
+// family can then be reached.
+func newUpstreamTransport(maxIdlePerHost int, idleTimeout time.Duration, dns *DNSCache, http1 bool, bind net.IP) *http.Transport {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: upstreamKeepAlive}
+	if bind != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: bind}
+	}
+	dial := dialer.DialContext
+	if dns != nil {
+		dial = dns.dialer(dialer)
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   upstreamDialTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(upstreamTLSSessions),
+		},
+	}
+	if http1 {
+		disableHTTP2(transport)
+	}
+	return transport
+}
+
+// upstreamTransport returns the transport for calls to Discord and its CDN as
+// configured: a pool of egresses with DCDN_EGRESS_POOL, or else a single
+// transport.
+func upstreamTransport(config *Config, dns *DNSCache) (http.RoundTripper, error) {
+	newTransport := func(bind net.IP) *http.Transport {
+		return newUpstreamTransport(config.UpstreamIdleConns, config.UpstreamIdleTimeout, dns, config.UpstreamHTTP1, bind)
+	}
+	if len(config.EgressPool) > 0 {
+		return NewEgressPool(config.EgressPool, config.EgressCooldown, newTransport)
+	}
+	return newTransport(config.OutboundBindIP), nil
+}
+
+func disableHTTP2(transport *http.Transport) {
+	// A non-nil, empty TLSNextProto turns off HTTP/2.
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+}
+
+// outboundBindIP returns the address to bind upstream connections to:
+// value itself if it is an IP, or else the first address of the network
+// interface it names, preferring IPv4.
+func outboundBindIP(value string) (net.IP, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(value)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", value)
+	}
+	return found, nil
+}
+
+// SetTransport replaces the transport used for calls to Discord and its CDN.
+func (c *DiscordClient) SetTransport(transport http.RoundTripper) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = &http.Client{Transport: transport}
+}
+
+func (c *DiscordClient) httpClient() *http.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+// websocketClient returns a client for the gateway's WebSocket, dialing like
+// the transport calls to Discord are made with but over HTTP/1.1, which the
+// WebSocket handshake needs.
+func (c *DiscordClient) websocketClient() *http.Client {
+	var transport *http.Transport
+	switch t := c.httpClient().Transport.(type) {
+	case *http.Transport:
+		transport = t.Clone()
+	case *EgressPool:
+		transport = t.pick().transport.Clone()
+	default:
+		return nil
+	}
+	disableHTTP2(transport)
+	return &http.Client{Transport: transport}
+}
+
+// traceConnection counts whether req is sent on a reused connection, and
+// the protocol negotiated on it, so the effect of the connection settings
+// shows in metrics.
+func traceConnection(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.Count("discord.connections", 1, "host:"+req.URL.Host, "reused:"+strconv.FormatBool(info.Reused), "protocol:"+connProtocol(info.Conn))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// connProtocol returns the protocol negotiated on conn: h2 for HTTP/2, and
+// http/1.1 otherwise.
+func connProtocol(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return "h2"
+	}
+	return "http/1.1"
+}
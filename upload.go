@@ -0,0 +1,271 @@
+package discordcdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func handleUpload(client *DiscordClient, store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		fileHeader, err := c.FormFile("file")
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidUpload, "File is required")
+			return
+		}
+		if fileHeader.Size == 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidUpload, "File is empty")
+			return
+		}
+		if !strings.Contains(fileHeader.Filename, ".") {
+			respondError(c, http.StatusBadRequest, codeInvalidUpload, "File name must include extension")
+			return
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to open uploaded file: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to read upload")
+			return
+		}
+		defer file.Close()
+
+		// The type the client declared is checked against the content, and
+		// files browsers would run script in are refused, so uploads can't
+		// put pages on the service's origin.
+		head := make([]byte, sniffLen)
+		n, _ := file.ReadAt(head, 0)
+		contentType := sniffContentType(fileHeader.Header.Get("Content-Type"), head[:n])
+		if inertContentType(contentType) != contentType {
+			respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "HTML and XML files can't be uploaded")
+			return
+		}
+
+		if scanner := client.Scanner(); scanner != nil {
+			signature, err := scanner.ScanUpload(c.Request.Context(), fileHeader.Filename, io.NewSectionReader(file, 0, fileHeader.Size), fileHeader.Size)
+			if signature != "" {
+				respondError(c, http.StatusUnprocessableEntity, codeMalwareDetected, "File was flagged by the virus scanner")
+				return
+			}
+			if err != nil && !scanner.allowScanned(c, nil, err) {
+				return
+			}
+		}
+
+		id, err := newID(10)
+		if err != nil {
+			logf(c, slog.LevelError, "Failed to generate manifest ID: %v", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to store upload")
+			return
+		}
+
+		manifest := &Manifest{
+			ID:          id,
+			FileName:    fileHeader.Filename,
+			ContentType: contentType,
+			Size:        fileHeader.Size,
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		count := int((fileHeader.Size + config.ChunkSize - 1) / config.ChunkSize)
+		// posted holds the IDs of the messages carrying the chunks so far,
+		// which are deleted if the upload fails.
+		var posted []int64
+		for i := 0; i < count; i++ {
+			offset := int64(i) * config.ChunkSize
+			size := min(config.ChunkSize, fileHeader.Size-offset)
+
+			name := fileHeader.Filename
+			if count > 1 {
+				name = fmt.Sprintf("%s.part%03d", fileHeader.Filename, i+1)
+			}
+
+			message, err := client.UploadAttachment(c.Request.Context(), config.UploadChannelID, name, io.NewSectionReader(file, offset, size))
+			if err != nil {
+				logf(c, slog.LevelError, "Error uploading chunk %d/%d: %v", i+1, count, err)
+				deleteChunks(c, client, config.UploadChannelID, posted)
+				if respondOverloaded(c, err) {
+					return
+				}
+				reportError(c, err)
+				respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to upload file")
+				return
+			}
+
+			posted = append(posted, message.ID)
+			attachment := message.Attachments[0]
+			manifest.Chunks = append(manifest.Chunks, Chunk{
+				ChannelID: config.UploadChannelID,
+				FileID:    attachment.ID,
+				FileName:  attachment.FileName,
+				Size:      attachment.Size,
+			})
+		}
+
+		if err := store.PutManifest(manifest); err != nil {
+			logf(c, slog.LevelError, "Failed to save manifest: %v", err)
+			deleteChunks(c, client, config.UploadChannelID, posted)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to store upload")
+			return
+		}
+
+		c.JSON(http.StatusCreated, H{
+			"id":     manifest.ID,
+			"url":    fmt.Sprintf("%s/f/%s/%s", publicURL(c, config), manifest.ID, url.PathEscape(manifest.FileName)),
+			"size":   manifest.Size,
+			"chunks": len(manifest.Chunks),
+		})
+	}
+}
+
+// deleteChunks deletes the messages of a failed upload's chunks, which no
+// manifest points at. It carries on after the request is canceled, since
+// that is often why the upload failed.
+func deleteChunks(c *Context, client *DiscordClient, channelID int64, messageIDs []int64) {
+	ctx := context.WithoutCancel(c.Request.Context())
+	for _, id := range messageIDs {
+		if err := client.DeleteMessage(ctx, channelID, id); err != nil {
+			logf(c, slog.LevelWarn, "Failed to delete message %d of a failed upload: %v", id, err)
+		}
+	}
+}
+
+func handleManifest(client *DiscordClient, store *Store, config *Config) HandlerFunc {
+	return func(c *Context) {
+		manifest, ok := store.Manifest(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, codeNotFound, "File not found")
+			return
+		}
+		c.Set(attachmentKey, "f/"+manifest.ID+"/"+manifest.FileName)
+		c.Set(servedRecordKey, recordKey(recordManifest, manifest.ID))
+		if len(manifest.Chunks) > 0 && !authorizeChannel(c, client, manifest.Chunks[0].ChannelID) {
+			return
+		}
+
+		if config.ProxyMode && config.MaxProxySize > 0 && manifest.Size > config.MaxProxySize {
+			respondError(c, http.StatusRequestEntityTooLarge, codeAttachmentTooLarge, "Attachment is too large to proxy")
+			return
+		}
+
+		if config.ProxyMode {
+			etag := `"` + manifest.ID + `"`
+			c.Header("ETag", etag)
+			if notModified(c.Request, etag, manifest.CreatedAt) {
+				c.Header("Last-Modified", manifest.CreatedAt.Format(http.TimeFormat))
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+
+		urls := make([]string, len(manifest.Chunks))
+		for i, chunk := range manifest.Chunks {
+			urls[i] = attachmentURL(chunk.ChannelID, chunk.FileID, chunk.FileName)
+		}
+
+		refreshed, err := client.RefreshAttachmentURLs(c.Request.Context(), PriorityInteractive, requesterOf(c), urls)
+		if err == nil {
+			for _, u := range urls {
+				if refreshed[u] == "" {
+					err = fmt.Errorf("chunk %s: %w", u, errAttachmentNotFound)
+					break
+				}
+			}
+		}
+		c.Set(refreshedKey, err == nil)
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+
+		if config.ProxyMode {
+			reader := newChunkReader(c.Request.Context(), client, manifest, refreshedChunkURLs(urls, refreshed))
+			defer reader.Close()
+
+			if scanner := client.Scanner(); scanner != nil {
+				path := "f/" + manifest.ID + "/" + manifest.FileName
+				flag, err := scanner.Check(c.Request.Context(), "f/"+manifest.ID, path, func(context.Context) (io.ReadCloser, int64, error) {
+					return io.NopCloser(reader), manifest.Size, nil
+				})
+				if !scanner.allowScanned(c, flag, err) {
+					return
+				}
+				if _, err := reader.Seek(0, io.SeekStart); err != nil {
+					logf(c, slog.LevelError, "Error fetching chunks: %v", err)
+					respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to fetch attachment")
+					return
+				}
+			}
+
+			// The type declared at upload is checked against the content,
+			// as for single attachments.
+			head := make([]byte, sniffLen)
+			n, err := io.ReadFull(reader, head)
+			if err == nil || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				_, err = reader.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				logf(c, slog.LevelError, "Error fetching chunks: %v", err)
+				respondError(c, http.StatusBadGateway, codeUpstreamError, "Failed to fetch attachment")
+				return
+			}
+			setContentHeaders(c, sniffContentType(manifest.ContentType, head[:n]))
+			applyContentDisposition(c, manifest.FileName, false)
+			http.ServeContent(c.Writer, c.Request, manifest.FileName, manifest.CreatedAt, reader)
+			return
+		}
+
+		if len(manifest.Chunks) == 1 {
+			c.Redirect(http.StatusMovedPermanently, refreshed[urls[0]])
+			return
+		}
+
+		chunks := make([]H, len(manifest.Chunks))
+		for i, chunk := range manifest.Chunks {
+			chunks[i] = H{"size": chunk.Size, "url": refreshed[urls[i]]}
+		}
+
+		c.JSON(http.StatusOK, H{
+			"fileName":    manifest.FileName,
+			"contentType": manifest.ContentType,
+			"size":        manifest.Size,
+			"chunks":      chunks,
+		})
+	}
+}
+
+func refreshedChunkURLs(urls []string, refreshed map[string]string) []string {
+	out := make([]string, len(urls))
+	for i, u := range urls {
+		out[i] = refreshed[u]
+	}
+	return out
+}
+
+// publicURL returns the externally visible origin of the service, preferring
+// the configured PUBLIC_URL over the request's own host. The path prefix the
+// request came in under, the base path or a tenant's, is included, unless
+// PUBLIC_URL already ends with it.
+func publicURL(c *Context, config *Config) string {
+	if config.PublicURL != "" {
+		if prefix := pathPrefix(c.Request); !strings.HasSuffix(config.PublicURL, prefix) {
+			return config.PublicURL + prefix
+		}
+		return config.PublicURL
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + pathPrefix(c.Request)
+}
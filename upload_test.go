@@ -0,0 +1,100 @@
+package discordcdn
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// uploadBody returns a multipart body uploading content as name, declared
+// as contentType, and the body's own content type.
+func uploadBody(t *testing.T, name, contentType string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	return &body, form.FormDataContentType()
+}
+
+func TestUploadContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		content     []byte
+		status      int
+	}{
+		{"image", "image.png", "image/png", png, http.StatusCreated},
+		{"text", "notes.txt", "text/plain", []byte("hello"), http.StatusCreated},
+		{"declared html", "page.html", "text/html", []byte("<!DOCTYPE html><script>alert(1)</script>"), http.StatusUnsupportedMediaType},
+		{"html declared as image", "page.png", "image/png", []byte("<html><script>alert(1)</script>"), http.StatusCreated},
+		{"undeclared html", "page.bin", "", []byte("<html><script>alert(1)</script>"), http.StatusCreated},
+		{"xhtml", "page.xhtml", "application/xhtml+xml", []byte(`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"/>`), http.StatusUnsupportedMediaType},
+		{"xml", "feed.xml", "application/xml", []byte(`<?xml version="1.0"?><feed/>`), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newFakeDiscord(t)
+			router := newTestRouter(t, &Config{APIKeys: []string{"key"}, UploadChannelID: testChannelID, ChunkSize: 1 << 20}, client)
+
+			body, contentType := uploadBody(t, tt.fileName, tt.contentType, tt.content)
+			w := doRequest(router, http.MethodPost, "/upload", body, "X-API-Key", "key", "Content-Type", contentType)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestUploadServesSafeType(t *testing.T) {
+	_, client := newFakeDiscord(t)
+	router := newTestRouter(t, &Config{APIKeys: []string{"key"}, UploadChannelID: testChannelID, ChunkSize: 1 << 20, ProxyMode: true}, client)
+
+	// HTML named like an image is stored as plain text.
+	body, contentType := uploadBody(t, "page.png", "image/png", []byte("<html><script>alert(1)</script>"))
+	w := doRequest(router, http.MethodPost, "/upload", body, "X-API-Key", "key", "Content-Type", contentType)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+	}
+	_, path, _ := strings.Cut(w.Body.String(), `"url":"`)
+	path, _, _ = strings.Cut(path, `"`)
+	path = path[strings.Index(path, "/f/"):]
+
+	w = doRequest(router, http.MethodGet, path, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download status = %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", got)
+	}
+}
+
+func TestUploadDeletesChunksOnFailure(t *testing.T) {
+	fake, client := newFakeDiscord(t)
+	fake.failUpload = func(n int) bool { return n == 3 }
+	router := newTestRouter(t, &Config{APIKeys: []string{"key"}, UploadChannelID: testChannelID, ChunkSize: 10}, client)
+
+	body, contentType := uploadBody(t, "notes.txt", "text/plain", bytes.Repeat([]byte("x"), 35))
+	w := doRequest(router, http.MethodPost, "/upload", body, "X-API-Key", "key", "Content-Type", contentType)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+	if len(fake.deleted) != 2 {
+		t.Errorf("deleted %d messages, want the 2 chunks posted: %v", len(fake.deleted), fake.deleted)
+	}
+}
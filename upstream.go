@@ -0,0 +1,218 @@
+package discordcdn
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamMaxSamples bounds how many Discord API calls are kept; under
+	// heavy traffic the window covers only the most recent calls.
+	upstreamMaxSamples = 10000
+	// upstreamGaugeInterval is how often the upstream gauges are sent.
+	upstreamGaugeInterval = 10 * time.Second
+)
+
+// upstreamQuantiles are the latency percentiles reported.
+var upstreamQuantiles = []struct {
+	name string
+	q    float64
+}{{"p50", 0.5}, {"p95", 0.95}, {"p99", 0.99}}
+
+// UpstreamStats keeps the latency and outcome of every Discord API call over
+// a sliding window, apart from the request-level metrics, so slowness and
+// errors can be pinned on Discord or on the server. It is fed by the metrics
+// registry.
+type UpstreamStats struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []upstreamSample
+}
+
+type upstreamSample struct {
+	at       time.Time
+	endpoint string
+	// status is the HTTP status, or "error" when no response came back.
+	status  string
+	latency time.Duration
+}
+
+// UpstreamSummary describes the Discord API calls in the window. Calls that
+// failed without a response have no latency and aren't in the percentiles.
+type UpstreamSummary struct {
+	Calls        int64              `json:"calls"`
+	Availability float64            `json:"availability"`
+	Statuses     map[string]int64   `json:"statuses"`
+	LatencyMS    map[string]float64 `json:"latencyMs"`
+}
+
+type UpstreamReport struct {
+	Window string `json:"window"`
+	UpstreamSummary
+	Endpoints   map[string]UpstreamSummary `json:"endpoints"`
+	Concurrency *ConcurrencyReport         `json:"concurrency,omitempty"`
+}
+
+// ConcurrencyReport is where the adaptive concurrency limit stands.
+type ConcurrencyReport struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"inFlight"`
+}
+
+func NewUpstreamStats(window time.Duration) *UpstreamStats {
+	return &UpstreamStats{window: window}
+}
+
+// SetUpstreamStats sets the statistics served on the admin API.
+func (c *DiscordClient) SetUpstreamStats(upstream *UpstreamStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = upstream
+}
+
+// UpstreamStats returns the upstream statistics, or nil if there are none.
+func (c *DiscordClient) UpstreamStats() *UpstreamStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.upstream
+}
+
+// Count records calls that failed without a response. Calls that got one
+// are recorded from their timing instead, so they aren't counted twice.
+func (u *UpstreamStats) Count(name string, value int64, tags []string) {
+	if name != "discord.requests" || tagValue(tags, "status") != "error" {
+		return
+	}
+	u.add(upstreamSample{at: time.Now(), endpoint: tagValue(tags, "endpoint"), status: "error"})
+}
+
+func (u *UpstreamStats) Gauge(string, float64, []string) {}
+
+func (u *UpstreamStats) Timing(name string, d time.Duration, tags []string) {
+	if name != "discord.request_duration" {
+		return
+	}
+	u.add(upstreamSample{at: time.Now(), endpoint: tagValue(tags, "endpoint"), status: tagValue(tags, "status"), latency: d})
+}
+
+func (u *UpstreamStats) add(s upstreamSample) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.samples = append(u.samples, s)
+	u.prune(s.at)
+}
+
+// prune drops samples that fell out of the window, or beyond the sample cap.
+// Samples are appended in time order, so the expired ones are at the front.
+func (u *UpstreamStats) prune(now time.Time) {
+	drop := max(len(u.samples)-upstreamMaxSamples, 0)
+	for drop < len(u.samples) && now.Sub(u.samples[drop].at) > u.window {
+		drop++
+	}
+	if drop > 0 {
+		u.samples = append(u.samples[:0], u.samples[drop:]...)
+	}
+}
+
+// Report summarizes the window, overall and per endpoint.
+func (u *UpstreamStats) Report() UpstreamReport {
+	u.mu.Lock()
+	u.prune(time.Now())
+	samples := append([]upstreamSample(nil), u.samples...)
+	u.mu.Unlock()
+
+	byEndpoint := map[string][]upstreamSample{}
+	for _, s := range samples {
+		byEndpoint[s.endpoint] = append(byEndpoint[s.endpoint], s)
+	}
+	report := UpstreamReport{
+		Window:          u.window.String(),
+		UpstreamSummary: summarizeUpstream(samples),
+		Endpoints:       map[string]UpstreamSummary{},
+	}
+	for endpoint, s := range byEndpoint {
+		report.Endpoints[endpoint] = summarizeUpstream(s)
+	}
+	return report
+}
+
+// summarizeUpstream counts samples by status and computes their latency
+// percentiles. Availability is the share of calls Discord answered without
+// a server error; rate limiting is left to the status counts, since it
+// usually reflects the server's own traffic. With no calls, Discord is
+// taken to be available.
+func summarizeUpstream(samples []upstreamSample) UpstreamSummary {
+	summary := UpstreamSummary{
+		Calls:        int64(len(samples)),
+		Availability: 1,
+		Statuses:     map[string]int64{},
+		LatencyMS:    map[string]float64{},
+	}
+	var failed int64
+	var latencies []time.Duration
+	for _, s := range samples {
+		summary.Statuses[s.status]++
+		if s.status == "error" || strings.HasPrefix(s.status, "5") {
+			failed++
+			if s.status == "error" {
+				continue
+			}
+		}
+		latencies = append(latencies, s.latency)
+	}
+	if summary.Calls > 0 {
+		summary.Availability = 1 - float64(failed)/float64(summary.Calls)
+	}
+	if len(latencies) == 0 {
+		return summary
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, q := range upstreamQuantiles {
+		summary.LatencyMS[q.name] = milliseconds(percentile(latencies, q.q))
+	}
+	summary.LatencyMS["max"] = milliseconds(latencies[len(latencies)-1])
+	return summary
+}
+
+// percentile returns the nearest-rank q quantile of sorted latencies: the
+// smallest latency at least q of them are as fast as.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// run sends the window's latency percentiles and availability as gauges
+// every interval, for sinks that can't compute them from the raw timings.
+func (u *UpstreamStats) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		report := u.Report()
+		if report.Calls == 0 {
+			continue
+		}
+		metrics.Gauge("discord.availability", report.Availability)
+		for _, q := range upstreamQuantiles {
+			if latency, ok := report.LatencyMS[q.name]; ok {
+				metrics.Gauge("discord.latency", latency, "quantile:"+q.name)
+			}
+		}
+	}
+}
+
+func handleUpstream(upstream *UpstreamStats, concurrency *ConcurrencyLimiter) HandlerFunc {
+	return func(c *Context) {
+		report := upstream.Report()
+		if concurrency != nil {
+			limit, inFlight := concurrency.Limit()
+			report.Concurrency = &ConcurrencyReport{Limit: limit, InFlight: inFlight}
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,112 @@
+package discordcdn
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// urlSnapshotInterval is how often the URL cache is written to its snapshot,
+// when it has changed.
+const urlSnapshotInterval = time.Minute
+
+// refreshedURLs returns the cache of refreshed URLs.
+func (c *DiscordClient) refreshedURLs() *urlCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stale
+}
+
+// LoadURLSnapshot fills the URL cache from a snapshot written by
+// runURLSnapshots, in the JSON lines format of the cache dump, so the stale
+// fallback has something to serve when Discord is down right after a
+// restart. URLs whose signature has expired are skipped, and a missing
+// snapshot is not an error.
+func (c *DiscordClient) LoadURLSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open URL cache snapshot: %w", err)
+	}
+	defer file.Close()
+
+	var entries []urlCacheEntry
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var line CachedURL
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("failed to decode URL cache snapshot: %w", err)
+		}
+		if expiry, ok := urlExpiry(line.URL); !ok || !now.Before(expiry) {
+			continue
+		}
+		entries = append(entries, urlCacheEntry{
+			key:    line.Attachment,
+			url:    line.URL,
+			stored: line.Stored,
+			used:   line.LastUsed,
+			hits:   line.Hits,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read URL cache snapshot: %w", err)
+	}
+	log.Printf("Restored %d refreshed URLs from %s", c.refreshedURLs().Restore(entries), path)
+	return nil
+}
+
+// runURLSnapshots writes the URL cache to path every interval, whenever it
+// has changed since the last snapshot.
+func (c *DiscordClient) runURLSnapshots(path string, interval time.Duration) {
+	var saved uint64
+	for range time.Tick(interval) {
+		stale := c.refreshedURLs()
+		changes := stale.Changes()
+		if changes == saved {
+			continue
+		}
+		if err := writeURLSnapshot(path, stale.Entries()); err != nil {
+			logAt(slog.LevelError, "Failed to save URL cache snapshot: %v", err)
+			continue
+		}
+		saved = changes
+	}
+}
+
+// writeURLSnapshot writes entries to a temporary file and renames it into
+// place, so a crash mid-write leaves the previous snapshot intact.
+func writeURLSnapshot(path string, entries []urlCacheEntry) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = writeCacheDump(w, entries, cacheDumpJSONL)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,373 @@
+package discordcdn
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// linkKey holds the *LinkData of the attachment a request served.
+	linkKey = "link"
+	// refreshedKey records whether the request's URL refresh succeeded.
+	refreshedKey = "refreshed"
+
+	usageHourFormat = "2006-01-02T15"
+	usageDayFormat  = "2006-01-02"
+	usageRetention  = 30 * 24 * time.Hour
+	// dailyUsageRetention keeps two months of per-day history, so the
+	// previous month can still be reported in full.
+	dailyUsageRetention = 62 * 24 * time.Hour
+	usageMaxAttachments = 10000
+	usageFlushInterval  = time.Minute
+
+	defaultStatsHours = 24
+	defaultStatsLimit = 20
+	maxStatsLimit     = 100
+)
+
+// UsageCounts are the counters kept for each hour and each channel.
+type UsageCounts struct {
+	Requests      int64 `json:"requests"`
+	Refreshes     int64 `json:"refreshes"`
+	RefreshErrors int64 `json:"refreshErrors"`
+}
+
+func (u *UsageCounts) add(o *UsageCounts) {
+	u.Requests += o.Requests
+	u.Refreshes += o.Refreshes
+	u.RefreshErrors += o.RefreshErrors
+}
+
+// errorRate returns the fraction of refreshes that failed.
+func (u *UsageCounts) errorRate() float64 {
+	if u.Refreshes == 0 {
+		return 0
+	}
+	return float64(u.RefreshErrors) / float64(u.Refreshes)
+}
+
+type AttachmentUsage struct {
+	ChannelID     int64     `json:"channelID"`
+	FileID        int64     `json:"fileID"`
+	FileName      string    `json:"fileName"`
+	Requests      int64     `json:"requests"`
+	LastRequested time.Time `json:"lastRequested"`
+}
+
+// UsageData is the persisted usage history. Hours are keyed by UTC hour,
+// channels by channel ID and attachments by channelID/fileID. Keys holds the
+// requests of each API key per UTC day, and ChannelDays the counts of each
+// channel per UTC day.
+type UsageData struct {
+	Hours       map[string]*UsageCounts            `json:"hours"`
+	Channels    map[string]*UsageCounts            `json:"channels"`
+	Attachments map[string]*AttachmentUsage        `json:"attachments"`
+	Keys        map[string]map[string]int64        `json:"keys"`
+	ChannelDays map[string]map[string]*UsageCounts `json:"channelDays"`
+}
+
+func newUsageData() *UsageData {
+	return &UsageData{
+		Hours:       map[string]*UsageCounts{},
+		Channels:    map[string]*UsageCounts{},
+		Attachments: map[string]*AttachmentUsage{},
+		Keys:        map[string]map[string]int64{},
+		ChannelDays: map[string]map[string]*UsageCounts{},
+	}
+}
+
+func (u *UsageData) keyDays(id string) map[string]int64 {
+	days, ok := u.Keys[id]
+	if !ok {
+		days = map[string]int64{}
+		u.Keys[id] = days
+	}
+	return days
+}
+
+// keyRequests sums the requests made with an API key from day from to day
+// to, inclusive.
+func (u *UsageData) keyRequests(id, from, to string) int64 {
+	var total int64
+	for day, n := range u.Keys[id] {
+		if day >= from && day <= to {
+			total += n
+		}
+	}
+	return total
+}
+
+func (u *UsageData) channelDay(channel, day string) *UsageCounts {
+	days, ok := u.ChannelDays[channel]
+	if !ok {
+		days = map[string]*UsageCounts{}
+		u.ChannelDays[channel] = days
+	}
+	return u.counts(days, day)
+}
+
+func (u *UsageData) counts(m map[string]*UsageCounts, key string) *UsageCounts {
+	c, ok := m[key]
+	if !ok {
+		c = &UsageCounts{}
+		m[key] = c
+	}
+	return c
+}
+
+// merge adds delta into u, then drops hours past the retention window and the
+// least requested attachments beyond the tracking limit.
+func (u *UsageData) merge(delta *UsageData) {
+	for k, c := range delta.Hours {
+		u.counts(u.Hours, k).add(c)
+	}
+	for k, c := range delta.Channels {
+		u.counts(u.Channels, k).add(c)
+	}
+	for k, a := range delta.Attachments {
+		existing, ok := u.Attachments[k]
+		if !ok {
+			u.Attachments[k] = a
+			continue
+		}
+		existing.Requests += a.Requests
+		if a.LastRequested.After(existing.LastRequested) {
+			existing.LastRequested = a.LastRequested
+			existing.FileName = a.FileName
+		}
+	}
+
+	for id, days := range delta.Keys {
+		for day, n := range days {
+			u.keyDays(id)[day] += n
+		}
+	}
+	for channel, days := range delta.ChannelDays {
+		for day, c := range days {
+			u.channelDay(channel, day).add(c)
+		}
+	}
+
+	cutoff := time.Now().UTC().Add(-usageRetention).Format(usageHourFormat)
+	for k := range u.Hours {
+		if k < cutoff {
+			delete(u.Hours, k)
+		}
+	}
+
+	dayCutoff := time.Now().UTC().Add(-dailyUsageRetention).Format(usageDayFormat)
+	for id, days := range u.Keys {
+		for day := range days {
+			if day < dayCutoff {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(u.Keys, id)
+		}
+	}
+	for channel, days := range u.ChannelDays {
+		for day := range days {
+			if day < dayCutoff {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(u.ChannelDays, channel)
+		}
+	}
+
+	if excess := len(u.Attachments) - usageMaxAttachments; excess > 0 {
+		for _, a := range u.topAttachments(len(u.Attachments))[usageMaxAttachments:] {
+			delete(u.Attachments, attachmentUsageKey(a.ChannelID, a.FileID))
+		}
+	}
+}
+
+func (u *UsageData) topAttachments(limit int) []*AttachmentUsage {
+	top := make([]*AttachmentUsage, 0, len(u.Attachments))
+	for _, a := range u.Attachments {
+		top = append(top, a)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+		return top[i].LastRequested.After(top[j].LastRequested)
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+func attachmentUsageKey(channelID, fileID int64) string {
+	return strconv.FormatInt(channelID, 10) + "/" + strconv.FormatInt(fileID, 10)
+}
+
+// UsageTracker counts attachment requests in memory and periodically merges
+// them into the store, so serving a request never waits on a disk write.
+type UsageTracker struct {
+	mu      sync.Mutex
+	store   *Store
+	pending *UsageData
+	// flushing holds counts being merged into the store, so quotas still
+	// see them while the write is in progress.
+	flushing *UsageData
+}
+
+func NewUsageTracker(store *Store) *UsageTracker {
+	return &UsageTracker{
+		store:   store,
+		pending: newUsageData(),
+	}
+}
+
+func (t *UsageTracker) record() HandlerFunc {
+	return func(c *Context) {
+		c.Next()
+
+		if c.GetString(attachmentKey) == "" {
+			return
+		}
+
+		now := time.Now().UTC()
+		var counts UsageCounts
+		counts.Requests = 1
+		if refreshed, ok := c.Get(refreshedKey); ok {
+			counts.Refreshes = 1
+			if !refreshed.(bool) {
+				counts.RefreshErrors = 1
+			}
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.pending.counts(t.pending.Hours, now.Format(usageHourFormat)).add(&counts)
+
+		v, ok := c.Get(linkKey)
+		if !ok {
+			return
+		}
+		data := v.(*LinkData)
+		channel := strconv.FormatInt(data.ChannelID, 10)
+		t.pending.counts(t.pending.Channels, channel).add(&counts)
+		t.pending.channelDay(channel, now.Format(usageDayFormat)).add(&counts)
+
+		if counts.RefreshErrors > 0 || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		key := attachmentUsageKey(data.ChannelID, data.FileID)
+		a, ok := t.pending.Attachments[key]
+		if !ok {
+			a = &AttachmentUsage{ChannelID: data.ChannelID, FileID: data.FileID}
+			t.pending.Attachments[key] = a
+		}
+		a.FileName = data.FileName
+		a.Requests++
+		a.LastRequested = now
+	}
+}
+
+// Flush merges the pending counts into the store.
+func (t *UsageTracker) Flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = newUsageData()
+	t.flushing = pending
+	t.mu.Unlock()
+
+	if err := t.store.MergeUsage(pending); err != nil {
+		logAt(slog.LevelError, "Failed to save usage statistics: %v", err)
+	}
+
+	t.mu.Lock()
+	t.flushing = nil
+	t.mu.Unlock()
+}
+
+func (t *UsageTracker) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.Flush()
+	}
+}
+
+type UsageHour struct {
+	Hour time.Time `json:"hour"`
+	UsageCounts
+}
+
+type UsageChannel struct {
+	ChannelID int64 `json:"channelID"`
+	UsageCounts
+	RefreshErrorRate float64 `json:"refreshErrorRate"`
+}
+
+type StatsResponse struct {
+	Since            time.Time          `json:"since"`
+	Totals           UsageCounts        `json:"totals"`
+	RefreshErrorRate float64            `json:"refreshErrorRate"`
+	Hours            []UsageHour        `json:"hours"`
+	Channels         []UsageChannel     `json:"channels"`
+	TopAttachments   []*AttachmentUsage `json:"topAttachments"`
+}
+
+// handleStats reports usage over the last ?hours (default 24) along with the
+// ?limit (default 20) most requested attachments and per-channel totals.
+func handleStats(tracker *UsageTracker, store *Store) HandlerFunc {
+	return func(c *Context) {
+		hours := defaultStatsHours
+		if v := c.Query("hours"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || time.Duration(n)*time.Hour > usageRetention {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Hours must be between 1 and "+strconv.Itoa(int(usageRetention/time.Hour)))
+				return
+			}
+			hours = n
+		}
+
+		limit := defaultStatsLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxStatsLimit {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Limit must be between 1 and "+strconv.Itoa(maxStatsLimit))
+				return
+			}
+			limit = n
+		}
+
+		tracker.Flush()
+		usage := store.Usage()
+
+		now := time.Now().UTC().Truncate(time.Hour)
+		resp := StatsResponse{
+			Since:    now.Add(-time.Duration(hours-1) * time.Hour),
+			Hours:    make([]UsageHour, 0, hours),
+			Channels: make([]UsageChannel, 0, len(usage.Channels)),
+		}
+		for hour := resp.Since; !hour.After(now); hour = hour.Add(time.Hour) {
+			entry := UsageHour{Hour: hour}
+			if counts, ok := usage.Hours[hour.Format(usageHourFormat)]; ok {
+				entry.UsageCounts = *counts
+			}
+			resp.Totals.add(&entry.UsageCounts)
+			resp.Hours = append(resp.Hours, entry)
+		}
+		resp.RefreshErrorRate = resp.Totals.errorRate()
+
+		for k, counts := range usage.Channels {
+			id, _ := strconv.ParseInt(k, 10, 64)
+			resp.Channels = append(resp.Channels, UsageChannel{ChannelID: id, UsageCounts: *counts, RefreshErrorRate: counts.errorRate()})
+		}
+		sort.Slice(resp.Channels, func(i, j int) bool { return resp.Channels[i].Requests > resp.Channels[j].Requests })
+
+		resp.TopAttachments = usage.topAttachments(limit)
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
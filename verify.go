@@ -0,0 +1,68 @@
+package discordcdn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// verifyTimeout bounds the HEAD checking a refreshed URL, which the client
+// waits on before it is redirected.
+const verifyTimeout = 3 * time.Second
+
+// VerifyRedirect checks that the CDN accepts a refreshed URL before a client
+// is sent to it, since Discord now and then returns one its CDN rejects right
+// away. A URL whose signature has already expired, or that the CDN answers
+// with 403 or 404, is dropped from the URL caches and the attachment
+// refreshed once more, and the new URL is returned without checking it
+// again. When the CDN can't be reached the URL is assumed to be fine, so
+// verifying never turns away requests a redirect would have served.
+func (c *DiscordClient) VerifyRedirect(ctx context.Context, requester, attachmentURL, newURL string) (string, error) {
+	reason, err := c.rejection(ctx, newURL)
+	if err != nil {
+		logAt(slog.LevelDebug, "Could not verify refreshed URL for %s: %v", attachmentURL, err)
+		metrics.Count("refresh.verifications", 1, "result:error")
+		return newURL, nil
+	}
+	if reason == "" {
+		metrics.Count("refresh.verifications", 1, "result:ok")
+		return newURL, nil
+	}
+
+	logAt(slog.LevelWarn, "Refreshed URL for %s was rejected (%s), refreshing again", attachmentURL, reason)
+	metrics.Count("refresh.verifications", 1, "result:rejected")
+	c.mu.RLock()
+	stale := c.stale
+	c.mu.RUnlock()
+	if stale != nil {
+		stale.Delete(attachmentURL)
+	}
+	c.unshareURL(attachmentURL)
+	return c.RefreshAttachmentURL(ctx, requester, attachmentURL)
+}
+
+// rejection returns why the CDN would reject a signed URL, or an empty
+// string if it accepts it.
+func (c *DiscordClient) rejection(ctx context.Context, target string) (string, error) {
+	if expiry, ok := urlExpiry(target); ok && !time.Now().Before(expiry) {
+		return "signature expired", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound:
+		return fmt.Sprintf("CDN answered %d", resp.StatusCode), nil
+	}
+	return "", nil
+}
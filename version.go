@@ -0,0 +1,55 @@
+package discordcdn
+
+import (
+	"net/http"
+)
+
+// Build information, set at build time with
+// -ldflags "-X github.com/rexdotsh/discord-cdn.version=...", and likewise for
+// commit and buildDate.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type VersionResponse struct {
+	Version   string          `json:"version"`
+	Commit    string          `json:"commit"`
+	BuildDate string          `json:"buildDate"`
+	Features  VersionFeatures `json:"features"`
+}
+
+// VersionFeatures reports which optional subsystems this instance has enabled.
+type VersionFeatures struct {
+	ProxyMode    bool   `json:"proxyMode"`
+	CacheBackend string `json:"cacheBackend"`
+	Uploads      bool   `json:"uploads"`
+	ShortLinks   bool   `json:"shortLinks"`
+	Posters      bool   `json:"posters"`
+	AccessLog    bool   `json:"accessLog"`
+	Sentry       bool   `json:"sentry"`
+	StatsD       bool   `json:"statsd"`
+}
+
+func handleVersion(config *Config, posters *PosterExtractor) HandlerFunc {
+	resp := VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Features: VersionFeatures{
+			ProxyMode:    config.ProxyMode,
+			CacheBackend: config.URLCacheBackend,
+			Uploads:      config.UploadChannelID != 0,
+			ShortLinks:   config.apiAuth(),
+			Posters:      posters != nil,
+			AccessLog:    config.AccessLogPath != "",
+			Sentry:       config.SentryDSN != "",
+			StatsD:       config.StatsDAddr != "",
+		},
+	}
+
+	return func(c *Context) {
+		c.JSON(http.StatusOK, resp)
+	}
+}
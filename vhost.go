@@ -0,0 +1,114 @@
+package discordcdn
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultChannelKey holds the channel ID that links on the request's host
+// default to.
+const defaultChannelKey = "defaultChannel"
+
+// VirtualHost maps a hostname to a tenant, a default channel, or both, so
+// communities can be given domains of their own.
+type VirtualHost struct {
+	Host      string
+	Tenant    string
+	ChannelID int64
+}
+
+// parseVirtualHosts parses comma-separated <host>=tenant:<name> and
+// <host>=channel:<id> entries. A host listed twice combines both.
+func parseVirtualHosts(raw string) ([]VirtualHost, error) {
+	var hosts []VirtualHost
+	for _, entry := range splitList(raw) {
+		host, target, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" || strings.ContainsAny(host, ":/") {
+			return nil, fmt.Errorf("entry %q must look like <host>=tenant:<name> or <host>=channel:<id>", entry)
+		}
+		i := slices.IndexFunc(hosts, func(v VirtualHost) bool { return v.Host == host })
+		if i < 0 {
+			hosts = append(hosts, VirtualHost{Host: host})
+			i = len(hosts) - 1
+		}
+
+		kind, value, _ := strings.Cut(strings.TrimSpace(target), ":")
+		switch {
+		case kind == "tenant" && value != "" && hosts[i].Tenant == "":
+			hosts[i].Tenant = value
+		case kind == "channel" && hosts[i].ChannelID == 0:
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || !validSnowflake(id) {
+				return nil, fmt.Errorf("entry %q has an invalid channel ID", entry)
+			}
+			hosts[i].ChannelID = id
+		case kind == "tenant" || kind == "channel":
+			return nil, fmt.Errorf("host %s has more than one %s", host, kind)
+		default:
+			return nil, fmt.Errorf("entry %q must look like <host>=tenant:<name> or <host>=channel:<id>", entry)
+		}
+	}
+	return hosts, nil
+}
+
+// applyVirtualHosts adds hosts mapped to a tenant to the tenant's hosts.
+func (c *Config) applyVirtualHosts(p *configParser) {
+	for _, v := range c.VirtualHosts {
+		if v.Tenant == "" {
+			continue
+		}
+		owner := slices.IndexFunc(c.Tenants, func(t Tenant) bool { return slices.Contains(t.Hosts, v.Host) })
+		i := slices.IndexFunc(c.Tenants, func(t Tenant) bool { return t.Name == v.Tenant })
+		switch {
+		case i < 0:
+			p.fail("VIRTUAL_HOSTS", "maps %s to unknown tenant %s", v.Host, v.Tenant)
+		case owner >= 0 && owner != i:
+			p.fail("VIRTUAL_HOSTS", "maps %s to tenant %s, but it belongs to tenant %s", v.Host, v.Tenant, c.Tenants[owner].Name)
+		case owner < 0:
+			c.Tenants[i].Hosts = append(c.Tenants[i].Hosts, v.Host)
+		}
+	}
+}
+
+// virtualHosts records the default channel of the request's host, if it has
+// one, for parseLinkPath.
+func virtualHosts(hosts []VirtualHost) HandlerFunc {
+	channels := map[string]int64{}
+	for _, v := range hosts {
+		if v.ChannelID != 0 {
+			channels[v.Host] = v.ChannelID
+		}
+	}
+	return func(c *Context) {
+		host := c.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if channelID, ok := channels[strings.ToLower(host)]; ok {
+			c.Set(defaultChannelKey, channelID)
+		}
+		c.Next()
+	}
+}
+
+// withDefaultChannel prefixes a fileID/fileName link, which leaves out the
+// channel, with channelID. Any other link is returned as is.
+func withDefaultChannel(link string, channelID int64) string {
+	first, rest, ok := strings.Cut(link, "/")
+	if !ok || rest == "" {
+		return link
+	}
+	second, _, _ := strings.Cut(rest, "/")
+	if _, err := strconv.ParseInt(first, 10, 64); err != nil {
+		return link
+	}
+	// channelID/fileID/fileName links have a second ID.
+	if _, err := strconv.ParseInt(second, 10, 64); err == nil {
+		return link
+	}
+	return strconv.FormatInt(channelID, 10) + "/" + link
+}
@@ -0,0 +1,98 @@
+package discordcdn
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// warmupLinks lists the attachments to warm: the top most requested ones in
+// the usage statistics, then the links of the warm-list file, one per line.
+// Links are deduplicated, keeping the first.
+func warmupLinks(store *Store, top int, path string) ([]string, error) {
+	var links []string
+	seen := map[string]bool{}
+	add := func(link string) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	if top > 0 {
+		for _, a := range store.Usage().topAttachments(top) {
+			add(attachmentURL(a.ChannelID, a.FileID, a.FileName))
+		}
+	}
+	if path == "" {
+		return links, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open warm-list: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			add(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read warm-list: %w", err)
+	}
+	return links, nil
+}
+
+// warmCache fills the URL cache with the warm-up links, so Early Hints and the
+// stale fallback work from the first request after a deploy. Signed links
+// still valid are cached as they are. With refresh set, the rest are refreshed
+// right away at background priority, leaving interactive traffic its share of
+// the rate limit.
+func warmCache(client *DiscordClient, store *Store, top int, path string, refresh bool) {
+	start := time.Now()
+	links, err := warmupLinks(store, top, path)
+	if err != nil {
+		logAt(slog.LevelError, "Cache warm-up failed: %v", err)
+		return
+	}
+
+	signed := map[string]string{}
+	var stale []string
+	invalid := 0
+	for _, raw := range links {
+		parsed := parseLink(raw)
+		if parsed.Error != "" {
+			invalid++
+			continue
+		}
+		target := attachmentURL(parsed.Data.ChannelID, parsed.Data.FileID, parsed.Data.FileName)
+		if expiry, ok := urlExpiry(raw); ok && time.Until(expiry) > 0 && strings.HasPrefix(raw, attachmentURLPrefix) {
+			signed[target] = raw
+		} else {
+			stale = append(stale, target)
+		}
+	}
+	if invalid > 0 {
+		logAt(slog.LevelWarn, "Cache warm-up skipped %d invalid links", invalid)
+	}
+	client.remember(signed)
+	metrics.Count("warmup.links", int64(len(signed)), "source:signed")
+
+	refreshed := 0
+	if refresh {
+		for i := 0; i < len(stale); i += refreshBatchSize {
+			for _, r := range refreshWithRetry(client, "warmup", stale[i:min(i+refreshBatchSize, len(stale))]) {
+				if !r.failed() {
+					refreshed++
+				}
+			}
+		}
+		metrics.Count("warmup.links", int64(refreshed), "source:refreshed")
+	}
+	log.Printf("Cache warm-up cached %d of %d links in %s, %d of them refreshed", len(signed)+refreshed, len(links), time.Since(start).Round(time.Millisecond), refreshed)
+}
@@ -0,0 +1,116 @@
+package discordcdn
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"slices"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// watermarkExtensions are the images watermarked in proxy mode. GIFs are
+// left alone, since transforms only keep their first frame.
+var watermarkExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".avif"}
+
+// watermarkPositions are the corners, or the center, a watermark is placed
+// at.
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// Watermark is an image or text overlaid on proxied images, for
+// attribution. It is applied as part of transforms, so watermarked images
+// are cached with the other variants.
+type Watermark struct {
+	mark     image.Image
+	scaler   draw.Scaler
+	position string
+	opacity  float64
+	// size is the watermark's width as a fraction of the image's.
+	size     float64
+	channels []int64
+}
+
+// NewWatermark returns the configured watermark, or nil if there is none.
+// The image was decoded once already when the configuration was validated.
+func NewWatermark(config *Config) *Watermark {
+	w := &Watermark{
+		position: config.WatermarkPosition,
+		opacity:  config.WatermarkOpacity,
+		size:     config.WatermarkSize,
+		channels: config.WatermarkChannels,
+	}
+	switch {
+	case config.WatermarkImage != "":
+		w.mark, _, _ = image.Decode(bytes.NewReader([]byte(config.WatermarkImage)))
+		w.scaler = draw.CatmullRom
+	case config.WatermarkText != "":
+		w.mark = renderWatermarkText(config.WatermarkText)
+		// The bitmap font is scaled up without blurring its pixels.
+		w.scaler = draw.NearestNeighbor
+	}
+	if w.mark == nil {
+		return nil
+	}
+	return w
+}
+
+// renderWatermarkText draws text in white over a dark outline, legible on
+// light and dark images alike.
+func renderWatermarkText(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	img := image.NewRGBA(image.Rect(0, 0, width+2, face.Height+2))
+	drawer := &font.Drawer{Dst: img, Face: face, Src: image.NewUniform(color.RGBA{0, 0, 0, 160})}
+	for _, offset := range []image.Point{{0, 1}, {2, 1}, {1, 0}, {1, 2}} {
+		drawer.Dot = fixed.P(offset.X, offset.Y+face.Ascent)
+		drawer.DrawString(text)
+	}
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(1, 1+face.Ascent)
+	drawer.DrawString(text)
+	return img
+}
+
+// appliesTo reports whether an attachment is watermarked. It is false on a
+// nil watermark, so callers needn't check whether one is configured.
+func (w *Watermark) appliesTo(data *LinkData) bool {
+	if w == nil || !hasExtension(data.FileName, watermarkExtensions) {
+		return false
+	}
+	return len(w.channels) == 0 || slices.Contains(w.channels, data.ChannelID)
+}
+
+// apply overlays the watermark on img, scaled to its share of the image's
+// width and inset from the edges.
+func (w *Watermark) apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	markBounds := w.mark.Bounds()
+	width := max(1, int(float64(bounds.Dx())*w.size+0.5))
+	height := max(1, markBounds.Dy()*width/markBounds.Dx())
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	w.scaler.Scale(scaled, scaled.Bounds(), w.mark, markBounds, draw.Src, nil)
+
+	margin := min(bounds.Dx(), bounds.Dy()) / 50
+	var at image.Point
+	switch w.position {
+	case "top-left":
+		at = image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	case "top-right":
+		at = image.Pt(bounds.Max.X-margin-width, bounds.Min.Y+margin)
+	case "bottom-left":
+		at = image.Pt(bounds.Min.X+margin, bounds.Max.Y-margin-height)
+	case "center":
+		at = image.Pt(bounds.Min.X+(bounds.Dx()-width)/2, bounds.Min.Y+(bounds.Dy()-height)/2)
+	default:
+		at = image.Pt(bounds.Max.X-margin-width, bounds.Max.Y-margin-height)
+	}
+
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	mask := image.NewUniform(color.Alpha{A: uint8(w.opacity*255 + 0.5)})
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(scaled.Bounds().Size())}, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	return dst
+}
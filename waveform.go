@@ -0,0 +1,122 @@
+package discordcdn
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// maxWaveformSamples bounds the samples a waveform may be resampled to.
+const maxWaveformSamples = 1024
+
+// voiceExtensions are the files that may be voice messages, which Discord
+// always names voice-message.ogg.
+var voiceExtensions = []string{".ogg"}
+
+// VoiceWaveform is the response of /waveform: the peaks of a voice
+// message's amplitude, from 0 to 1, spread evenly over its duration.
+type VoiceWaveform struct {
+	DurationSecs float64   `json:"durationSecs"`
+	Peaks        []float64 `json:"peaks"`
+}
+
+// voiceMessage returns the voice message metadata of an attachment, looking
+// up its message when the index doesn't have it, and indexing it then.
+// Attachments indexed before voice messages were recorded are looked up
+// again if they might be one.
+func voiceMessage(client *DiscordClient, store *Store, data *LinkData) (*IndexedAttachment, error) {
+	if a, ok := store.IndexedAttachment(data.FileID); ok && (a.Waveform != "" || !hasExtension(a.FileName, voiceExtensions)) {
+		return a, nil
+	}
+	message, err := client.attachmentMessage(PriorityInteractive, data.ChannelID, data.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, errAttachmentNotFound
+	}
+	attachments := indexedAttachments(message)
+	if err := store.IndexAttachments(attachments); err != nil {
+		logAt(slog.LevelError, "Failed to index attachments of message %d: %v", message.ID, err)
+	}
+	for _, a := range attachments {
+		if a.FileID == data.FileID {
+			return a, nil
+		}
+	}
+	return nil, errAttachmentNotFound
+}
+
+// waveformPeaks decodes a waveform as Discord sends it, resampled to the
+// given number of samples, or left as is if 0. Each resampled peak is the
+// loudest of the samples it covers.
+func waveformPeaks(waveform string, samples int) ([]float64, error) {
+	raw, err := base64.StdEncoding.DecodeString(waveform)
+	if err != nil {
+		return nil, err
+	}
+	if samples == 0 {
+		samples = len(raw)
+	}
+	peaks := make([]float64, samples)
+	if len(raw) == 0 {
+		return peaks, nil
+	}
+	for i := range peaks {
+		start := i * len(raw) / samples
+		end := max(start+1, (i+1)*len(raw)/samples)
+		var peak byte
+		for _, v := range raw[start:end] {
+			peak = max(peak, v)
+		}
+		peaks[i] = math.Round(float64(peak)/255*1000) / 1000
+	}
+	return peaks, nil
+}
+
+func handleWaveform(client *DiscordClient, store *Store) HandlerFunc {
+	return func(c *Context) {
+		data := parseLinkPath(c, c.Param("link"))
+		if data == nil || !authorizeChannel(c, client, data.ChannelID) {
+			return
+		}
+		// Indexed waveforms skip Discord, so the allowlist is checked here
+		// rather than by the lookup.
+		if !client.allowsChannel(data.ChannelID) {
+			respondError(c, http.StatusNotFound, codeAttachmentNotFound, "Attachment not found")
+			return
+		}
+
+		samples := 0
+		if raw := c.Query("samples"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxWaveformSamples {
+				respondError(c, http.StatusBadRequest, codeInvalidParameter, "Samples must be between 1 and "+strconv.Itoa(maxWaveformSamples))
+				return
+			}
+			samples = n
+		}
+
+		attachment, err := voiceMessage(client, store, data)
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+		if attachment.Waveform == "" {
+			respondError(c, http.StatusUnprocessableEntity, codeUnsupportedMedia, "Attachment is not a voice message")
+			return
+		}
+		peaks, err := waveformPeaks(attachment.Waveform, samples)
+		if err != nil {
+			logf(c, slog.LevelError, "Invalid waveform of %s: %v", data.Path(), err)
+			respondError(c, http.StatusBadGateway, codeUpstreamError, "Discord sent an invalid waveform")
+			return
+		}
+
+		// The waveform of an attachment never changes.
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		c.JSON(http.StatusOK, &VoiceWaveform{DurationSecs: attachment.DurationSecs, Peaks: peaks})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package discordcdn
+
+import "errors"
+
+var errNotWindows = errors.New("Windows services are only supported on Windows")
+
+func inWindowsService() bool {
+	return false
+}
+
+func installWindowsService() error {
+	return errNotWindows
+}
+
+func uninstallWindowsService() error {
+	return errNotWindows
+}
+
+func runWindowsService(run func(stop <-chan struct{}) error) error {
+	return errNotWindows
+}
@@ -0,0 +1,140 @@
+//go:build windows
+
+package discordcdn
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	windowsServiceDescription = "Serves Discord attachments through permanent links."
+	// windowsStopWaitHint is how long the service manager is told stopping
+	// may take.
+	windowsStopWaitHint = 30 * time.Second
+)
+
+// inWindowsService reports whether the process was started by the Windows
+// service manager.
+func inWindowsService() bool {
+	service, err := svc.IsWindowsService()
+	return err == nil && service
+}
+
+// installWindowsService installs the running executable as a service started
+// with the system, and restarted should it fail, that runs in the current
+// directory so it finds the same .env and data.
+func installWindowsService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(windowsServiceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", windowsServiceName)
+	}
+
+	s, err := m.CreateService(windowsServiceName, exe, mgr.Config{
+		DisplayName: windowsServiceName,
+		Description: windowsServiceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "-chdir", dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	if err := eventlog.InstallAsEventCreate(windowsServiceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event log source: %w", err)
+	}
+	return nil
+}
+
+// uninstallWindowsService removes the service, which stops once it is no
+// longer running.
+func uninstallWindowsService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", windowsServiceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(windowsServiceName)
+	return nil
+}
+
+// runWindowsService runs the server under the service manager until it asks
+// the service to stop, as on shutdown, when stop is closed. Failures are
+// written to the Application event log as well as the service log.
+func runWindowsService(run func(stop <-chan struct{}) error) error {
+	return svc.Run(windowsServiceName, &windowsService{run: run})
+}
+
+type windowsService struct {
+	run func(stop <-chan struct{}) error
+}
+
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			return s.exit(err)
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(windowsStopWaitHint.Milliseconds())}
+				close(stop)
+				return s.exit(<-done)
+			}
+		}
+	}
+}
+
+// exit reports how the server ended to the service manager, as a
+// service-specific exit code of 1 when it failed.
+func (s *windowsService) exit(err error) (bool, uint32) {
+	if err == nil {
+		return false, 0
+	}
+	if elog, openErr := eventlog.Open(windowsServiceName); openErr == nil {
+		elog.Error(1, err.Error())
+		elog.Close()
+	}
+	return true, 1
+}
@@ -0,0 +1,79 @@
+package discordcdn
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errPoolFull = errors.New("worker queue is full")
+
+type task struct {
+	fn       func()
+	queuedAt time.Time
+}
+
+// WorkerPool runs background tasks on a fixed number of goroutines, with a
+// bounded queue in front of them.
+type WorkerPool struct {
+	name  string
+	size  int
+	tasks chan task
+	// taskTime is a moving average of how long tasks take, in nanoseconds.
+	taskTime atomic.Int64
+}
+
+// NewWorkerPool starts size workers that take tasks from a queue holding up to
+// depth waiting tasks. name tags the pool's metrics.
+func NewWorkerPool(name string, size, depth int) *WorkerPool {
+	p := &WorkerPool{
+		name:  name,
+		size:  size,
+		tasks: make(chan task, depth),
+	}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues fn, returning errPoolFull instead of blocking when the queue
+// is full.
+func (p *WorkerPool) Submit(fn func()) error {
+	select {
+	case p.tasks <- task{fn: fn, queuedAt: time.Now()}:
+		metrics.Gauge("workers.queue_length", float64(len(p.tasks)), "pool:"+p.name)
+		return nil
+	default:
+		metrics.Count("workers.rejected", 1, "pool:"+p.name)
+		return errPoolFull
+	}
+}
+
+func (p *WorkerPool) work() {
+	for t := range p.tasks {
+		metrics.Gauge("workers.queue_length", float64(len(p.tasks)), "pool:"+p.name)
+		metrics.Timing("workers.wait_duration", time.Since(t.queuedAt), "pool:"+p.name)
+
+		start := time.Now()
+		t.fn()
+		elapsed := time.Since(start)
+		metrics.Timing("workers.task_duration", elapsed, "pool:"+p.name)
+		if avg := p.taskTime.Load(); avg == 0 {
+			p.taskTime.Store(int64(elapsed))
+		} else {
+			p.taskTime.Store(avg + (int64(elapsed)-avg)/8)
+		}
+	}
+}
+
+// RetryAfter estimates when a task submitted now would be picked up: the
+// queued tasks spread across the workers, at their average duration, up to
+// an hour. Until a task has finished, a minute is assumed.
+func (p *WorkerPool) RetryAfter() time.Duration {
+	avg := time.Duration(p.taskTime.Load())
+	if avg == 0 {
+		return time.Minute
+	}
+	return min(avg*time.Duration(len(p.tasks)+1)/time.Duration(p.size), time.Hour)
+}
@@ -0,0 +1,171 @@
+package discordcdn
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxZipFiles bounds the attachments of an archive, so they are refreshed
+// with a single Discord call.
+const maxZipFiles = refreshBatchSize
+
+type ZipRequest struct {
+	// Links lists the attachments to archive, in any accepted form.
+	Links []string `json:"links,omitempty"`
+	// Message archives every attachment of a message instead, given as for
+	// galleries.
+	Message string `json:"message,omitempty"`
+	// Name is the file name of the archive.
+	Name string `json:"name,omitempty"`
+}
+
+// zipEntryNames names the archive's entries after their attachments,
+// numbering repeated names so no entry hides another.
+func zipEntryNames(files []LinkData) []string {
+	names := make([]string, len(files))
+	seen := map[string]bool{}
+	for i := range files {
+		name := strings.ReplaceAll(files[i].Name(), "/", "_")
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		seen[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// serveZip streams files as a ZIP archive built on the fly, one attachment
+// at a time, so nothing but the copy buffer is held in memory. Entries are
+// stored rather than compressed, since media rarely shrinks. Every URL is
+// refreshed before the response starts, so a missing attachment is reported
+// with the usual error; a download failing midway can only cut the archive
+// short, leaving it without its central directory and so unreadable.
+func serveZip(c *Context, client *DiscordClient, config *Config, files []LinkData, name string) {
+	targets := make([]string, len(files))
+	for i := range files {
+		targets[i] = attachmentURL(files[i].ChannelID, files[i].FileID, files[i].FileName)
+	}
+	refreshed, err := client.RefreshAttachmentURLs(c.Request.Context(), PriorityInteractive, requesterOf(c), targets)
+	c.Set(refreshedKey, err == nil)
+	if err != nil {
+		respondRefreshError(c, err)
+		return
+	}
+	for i, target := range targets {
+		if refreshed[target] == "" {
+			respondError(c, http.StatusNotFound, codeAttachmentNotFound, fmt.Sprintf("Attachment %s not found", files[i].Name()))
+			return
+		}
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Status(http.StatusOK)
+
+	archive := zip.NewWriter(c.Writer)
+	for i, entry := range zipEntryNames(files) {
+		if err := writeZipEntry(c, client, archive, entry, refreshed[targets[i]], &files[i], config.MaxProxySize); err != nil {
+			logf(c, slog.LevelError, "Aborted archive %s at %s: %v", name, entry, err)
+			c.Abort()
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logf(c, slog.LevelError, "Failed to finish archive %s: %v", name, err)
+	}
+}
+
+// writeZipEntry downloads an attachment into the next entry of archive.
+func writeZipEntry(c *Context, client *DiscordClient, archive *zip.Writer, entry, target string, data *LinkData, maxSize int64) error {
+	resp, err := client.Download(c.Request.Context(), target, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CDN error: %d", resp.StatusCode)
+	}
+	if maxSize > 0 && responseSize(resp) > maxSize {
+		return fmt.Errorf("attachment exceeds the %d byte limit", maxSize)
+	}
+
+	w, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     entry,
+		Method:   zip.Store,
+		Modified: snowflakeTime(data.FileID),
+	})
+	if err != nil {
+		return err
+	}
+	var src io.Reader = resp.Body
+	if maxSize > 0 {
+		src = io.LimitReader(resp.Body, maxSize+1)
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && n > maxSize {
+		return fmt.Errorf("attachment exceeds the %d byte limit", maxSize)
+	}
+	return nil
+}
+
+// handleZip archives a list of attachments, or those of a message, in one
+// download.
+func handleZip(client *DiscordClient, config *Config) HandlerFunc {
+	return func(c *Context) {
+		var req ZipRequest
+		err := c.ShouldBindJSON(&req)
+		if bodyTooLarge(c, err) {
+			return
+		}
+		if err != nil || (len(req.Links) == 0) == (req.Message == "") {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, "Either links or message is required")
+			return
+		}
+		if len(req.Links) > maxZipFiles {
+			respondError(c, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("Archives are limited to %d attachments", maxZipFiles))
+			return
+		}
+
+		var files []LinkData
+		name := "attachments.zip"
+		if req.Message != "" {
+			link, message, ok := fetchGalleryMessage(c, client, req.Message)
+			if !ok {
+				return
+			}
+			files = messageFiles(message)
+			name = fmt.Sprintf("%d.zip", link.MessageID)
+		} else {
+			for _, raw := range req.Links {
+				parsedLink := parseLink(raw)
+				if parsedLink.Error != "" {
+					respondError(c, http.StatusBadRequest, codeInvalidLink, fmt.Sprintf("%s: %s", raw, parsedLink.Error))
+					return
+				}
+				if !authorizeChannel(c, client, parsedLink.Data.ChannelID) {
+					return
+				}
+				files = append(files, *parsedLink.Data)
+			}
+		}
+		if req.Name != "" {
+			name = strings.ReplaceAll(req.Name, "/", "_")
+			if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+				name += ".zip"
+			}
+		}
+		serveZip(c, client, config, files, name)
+	}
+}